@@ -0,0 +1,94 @@
+// Command encfs-fsck checks the metadata of an encrypted tree
+//
+//	encfs-fsck [-repair] [-json] <encrypted dir>
+//
+// Data files without meta, orphaned meta files, names which can not be decrypted, invalid or damaged meta and files
+// of another key are reported, -repair removes orphaned meta files and invalid meta files of empty data files and
+// rewrites damaged meta files from their redundant copy. Volumes are opened with the passphrase read from
+// ENCFS_PASSPHRASE or the terminal, other trees with ENCRYPTED_ENCRYPTION_MASTER_KEY.
+// The exit status is 0 for a clean tree, 1 when all issues were repaired, 4 when issues are left and 8 on errors.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/jht5945/encfs-afero/internal/cli"
+)
+
+const (
+	EXIT_CLEAN      = 0
+	EXIT_REPAIRED   = 1
+	EXIT_UNREPAIRED = 4
+	EXIT_ERROR      = 8
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "apply the safe fixes")
+	jsonOutput := flag.Bool("json", false, "print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <encrypted dir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	report, err := fsck(flag.Arg(0), *repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encfs-fsck:", err)
+		os.Exit(EXIT_ERROR)
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, "encfs-fsck:", err)
+			os.Exit(EXIT_ERROR)
+		}
+	} else {
+		printReport(report)
+	}
+	switch {
+	case report.RepairedCount < len(report.Issues):
+		os.Exit(EXIT_UNREPAIRED)
+	case report.RepairedCount > 0:
+		os.Exit(EXIT_REPAIRED)
+	}
+	os.Exit(EXIT_CLEAN)
+}
+
+func fsck(encryptedDir string, repair bool) (*encfs.FsckReport, error) {
+	encryptedDir, err := filepath.Abs(encryptedDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(encryptedDir); err != nil {
+		return nil, err
+	}
+	encFs, root, err := cli.OpenTree(encryptedDir)
+	if err != nil {
+		return nil, err
+	}
+	return encFs.Fsck(root, repair)
+}
+
+func printReport(report *encfs.FsckReport) {
+	for _, issue := range report.Issues {
+		status := ""
+		if issue.Repaired {
+			status = " (repaired)"
+		}
+		fmt.Printf("%s: %s%s\n", issue.Kind, issue.Name, status)
+		fmt.Printf("\t%s\n", issue.EncryptedName)
+		if issue.Detail != "" {
+			fmt.Printf("\t%s\n", issue.Detail)
+		}
+	}
+	fmt.Printf("%d files checked, %d issues, %d repaired\n", report.ScannedCount, len(report.Issues), report.RepairedCount)
+}
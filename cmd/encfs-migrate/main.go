@@ -0,0 +1,105 @@
+// Command encfs-migrate encrypts an existing plaintext directory, in place or into a volume in another directory
+//
+//	encfs-migrate [-remove-source] [-verbose] <plaintext dir> [<volume dir>]
+//
+// Without a volume dir the plaintext dir becomes a volume, files are removed as they are encrypted. The volume dir is
+// created when it does not exist. The passphrase is read from ENCFS_PASSPHRASE or prompted on the terminal, an
+// interrupted run is resumed by running the command again, files encrypted already are skipped.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/jht5945/encfs-afero/internal/cli"
+	"github.com/spf13/afero"
+)
+
+const PROGRESS_INTERVAL = 200 * time.Millisecond
+
+var ErrVolumeInsideSource = errors.New("the volume dir must not be inside the plaintext dir")
+
+func main() {
+	removeSource := flag.Bool("remove-source", false, "remove plaintext files once they are encrypted into the volume dir")
+	verbose := flag.Bool("verbose", false, "print every file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <plaintext dir> [<volume dir>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := migrate(ctx, flag.Args(), *removeSource, *verbose)
+	if report != nil {
+		fmt.Fprintf(os.Stderr, "\rencrypted %d files (%d bytes), skipped %d already encrypted\n",
+			report.EncryptedCount, report.EncryptedBytes, report.SkippedCount)
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "encfs-migrate: interrupted, run it again to resume")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encfs-migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func migrate(ctx context.Context, args []string, removeSource, verbose bool) (*encfs.EncryptTreeReport, error) {
+	plaintextDir, err := filepath.Abs(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(plaintextDir); err != nil {
+		return nil, err
+	}
+	passphrase, err := cli.ReadPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	options := &encfs.EncryptTreeOptions{RemoveSource: removeSource, Progress: newProgress(verbose)}
+	if len(args) == 1 {
+		_, report, err := encfs.EncryptTreeInPlace(ctx, afero.NewOsFs(), plaintextDir, passphrase, nil, options)
+		return report, err
+	}
+	volumeDir, err := filepath.Abs(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if volumeDir == plaintextDir || strings.HasPrefix(volumeDir, plaintextDir+string(filepath.Separator)) {
+		return nil, ErrVolumeInsideSource
+	}
+	encFs, err := cli.OpenVolume(volumeDir, passphrase, true)
+	if err != nil {
+		return nil, err
+	}
+	return encFs.EncryptTree(ctx, afero.NewOsFs(), plaintextDir, "/", options)
+}
+
+// newProgress prints every file with verbose, a counter updated every PROGRESS_INTERVAL otherwise
+func newProgress(verbose bool) func(name string, report *encfs.EncryptTreeReport) {
+	var lastPrint time.Time
+	return func(name string, report *encfs.EncryptTreeReport) {
+		if verbose {
+			fmt.Fprintln(os.Stderr, name)
+			return
+		}
+		if time.Since(lastPrint) < PROGRESS_INTERVAL {
+			return
+		}
+		lastPrint = time.Now()
+		fmt.Fprintf(os.Stderr, "\r%d files, %d bytes encrypted", report.ScannedCount, report.EncryptedBytes)
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux || darwin || freebsd
+
+// Command encfs-mount mounts an encrypted volume created by encfs.InitVolume as a plaintext FUSE filesystem, so
+// programs not written in Go read and write the same on-disk format
+//
+//	encfs-mount [-init] [-read-only] [-allow-other] [-debug] <volume dir> <mount point>
+//
+// The passphrase is read from ENCFS_PASSPHRASE or prompted on the terminal, the volume is unmounted on SIGINT and
+// SIGTERM.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jht5945/encfs-afero/encfs"
+	encfsfuse "github.com/jht5945/encfs-afero/fuse"
+	"github.com/jht5945/encfs-afero/internal/cli"
+)
+
+func main() {
+	initVolume := flag.Bool("init", false, "create the volume when it does not exist")
+	readOnly := flag.Bool("read-only", false, "mount read only")
+	allowOther := flag.Bool("allow-other", false, "allow other users to access the mount")
+	debug := flag.Bool("debug", false, "log FUSE requests and filesystem operations")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <volume dir> <mount point>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := mount(flag.Arg(0), flag.Arg(1), *initVolume, *readOnly, *allowOther, *debug); err != nil {
+		fmt.Fprintln(os.Stderr, "encfs-mount:", err)
+		os.Exit(1)
+	}
+}
+
+func mount(volumeDir, mountPoint string, initVolume, readOnly, allowOther, debug bool) error {
+	encfs.SetLogger(encfs.NewStdLogger(log.New(os.Stderr, "encfs-mount: ", log.LstdFlags), debug))
+	passphrase, err := cli.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	encFs, err := cli.OpenVolume(volumeDir, passphrase, initVolume)
+	if err != nil {
+		return err
+	}
+	encFs.WithOperationTrace(debug)
+	root := encfsfuse.NewRoot(encFs, &encfsfuse.Options{ReadOnly: readOnly})
+	server, err := fs.Mount(mountPoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: allowOther,
+			Debug:      debug,
+			FsName:     volumeDir,
+			Name:       "encfs",
+			// mount(2) needs no fusermount when running as root like in containers, fusermount is used otherwise
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			fmt.Fprintln(os.Stderr, "encfs-mount: unmount:", err)
+		}
+	}()
+	server.Wait()
+	return nil
+}
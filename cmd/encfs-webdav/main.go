@@ -0,0 +1,105 @@
+// Command encfs-webdav serves the decrypted view of a volume created by encfs.InitVolume over WebDAV
+//
+//	encfs-webdav [-listen addr] [-prefix /dav] [-read-only] [-user name] [-tls-cert file -tls-key file]
+//		[-metrics addr] <volume dir>
+//
+// The passphrase is read from ENCFS_PASSPHRASE or prompted on the terminal, with -user the password of basic
+// authentication is read from ENCFS_WEBDAV_PASSWORD. With -metrics Prometheus metrics are served at /metrics of a
+// separate address.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/jht5945/encfs-afero/internal/cli"
+	"github.com/jht5945/encfs-afero/webdav"
+)
+
+const WEBDAV_PASSWORD_ENV = "ENCFS_WEBDAV_PASSWORD"
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	prefix := flag.String("prefix", "", "URL path prefix of the volume")
+	initVolume := flag.Bool("init", false, "create the volume when it does not exist")
+	readOnly := flag.Bool("read-only", false, "refuse all changes")
+	username := flag.String("user", "", "require basic authentication as user, the password is read from "+WEBDAV_PASSWORD_ENV)
+	tlsCert := flag.String("tls-cert", "", "serve HTTPS with this certificate")
+	tlsKey := flag.String("tls-key", "", "private key of -tls-cert")
+	verbose := flag.Bool("verbose", false, "log every request and filesystem operation")
+	metricsListen := flag.String("metrics", "", "serve Prometheus metrics on this address at /metrics")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <volume dir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || (*tlsCert == "") != (*tlsKey == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	options := &webdav.Options{Prefix: *prefix, ReadOnly: *readOnly}
+	if *username != "" {
+		password, ok := os.LookupEnv(WEBDAV_PASSWORD_ENV)
+		if !ok || password == "" {
+			log.Fatalf("encfs-webdav: -user requires %s", WEBDAV_PASSWORD_ENV)
+		}
+		options.Username, options.Password = *username, password
+	}
+	options.Logger = func(request *http.Request, err error) {
+		if err != nil {
+			log.Printf("%s %s: %v", request.Method, request.URL.Path, err)
+		} else if *verbose {
+			log.Printf("%s %s", request.Method, request.URL.Path)
+		}
+	}
+	encfs.SetLogger(encfs.NewStdLogger(log.Default(), *verbose))
+	if *metricsListen != "" {
+		serveMetrics(*metricsListen)
+	}
+	if err := serve(flag.Arg(0), *listen, *initVolume, *tlsCert, *tlsKey, options, *verbose); err != nil {
+		log.Fatal("encfs-webdav: ", err)
+	}
+}
+
+func serve(volumeDir, listen string, initVolume bool, tlsCert, tlsKey string, options *webdav.Options,
+	verbose bool) error {
+	passphrase, err := cli.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	encFs, err := cli.OpenVolume(volumeDir, passphrase, initVolume)
+	if err != nil {
+		return err
+	}
+	encFs.WithOperationTrace(verbose)
+	if options.Username != "" && tlsCert == "" {
+		log.Print("encfs-webdav: basic authentication without -tls-cert sends the password in clear")
+	}
+	server := &http.Server{Addr: listen, Handler: webdav.NewHandler(encFs, options)}
+	if tlsCert != "" {
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// serveMetrics collects the metrics of all file systems and serves them on a separate listener, so they are never
+// exposed on the WebDAV address
+func serveMetrics(listen string) {
+	prometheusCollector := encfs.NewPrometheusCollector()
+	encfs.SetMetricsCollector(prometheusCollector)
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/metrics", prometheusCollector)
+	go func() {
+		log.Fatal("encfs-webdav: metrics: ", http.ListenAndServe(listen, serveMux))
+	}()
+}
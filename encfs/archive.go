@@ -0,0 +1,272 @@
+package encfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrUnsupportedArchiveEntry = errors.New("archive entry is not a file, directory or symlink")
+)
+
+// archiveEntry is a file of an archive being imported, modes and times are applied after all entries are written
+type archiveEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// ExportTar writes the decrypted tree of fs to w as a PAX tar archive keeping modes and modification times with
+// nanoseconds, meta files of EncFs are not listed so they are never exported
+func ExportTar(fs afero.Fs, w io.Writer) error {
+	tarWriter := tar.NewWriter(w)
+	err := walkArchive(fs, func(name string, fileInfo os.FileInfo, linkTarget string) error {
+		header, err := tar.FileInfoHeader(fileInfo, linkTarget)
+		if err != nil {
+			return err
+		}
+		header.Name, header.Format = name, tar.FormatPAX
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if fileInfo.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		return copyFileTo(fs, name, tarWriter, header.Size)
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// ImportTar writes the files, directories and symlinks of the tar archive r into fs, hard links are imported as
+// copies, names are kept inside the root of fs whatever ".." they contain
+func ImportTar(fs afero.Fs, r io.Reader) error {
+	tarReader := tar.NewReader(r)
+	var entries []archiveEntry
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanArchiveName(header.Name)
+		if name == "/" {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fs.MkdirAll(name, 0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeArchiveFile(fs, name, tarReader)
+		case tar.TypeSymlink:
+			err = symlinkArchiveFile(fs, name, header.Linkname)
+		case tar.TypeLink:
+			err = linkArchiveFile(fs, name, cleanArchiveName(header.Linkname))
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = &os.PathError{Op: "import", Path: header.Name, Err: ErrUnsupportedArchiveEntry}
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, archiveEntry{name: name, mode: header.FileInfo().Mode(), modTime: header.ModTime})
+	}
+	return applyArchiveEntries(fs, entries)
+}
+
+// ExportZip is ExportTar writing a zip archive, modification times are kept with seconds
+func ExportZip(fs afero.Fs, w io.Writer) error {
+	zipWriter := zip.NewWriter(w)
+	err := walkArchive(fs, func(name string, fileInfo os.FileInfo, linkTarget string) error {
+		header, err := zip.FileInfoHeader(fileInfo)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if fileInfo.IsDir() {
+			header.Name += "/"
+		} else if fileInfo.Mode().IsRegular() {
+			header.Method = zip.Deflate
+		}
+		entryWriter, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fileInfo.Mode()&os.ModeSymlink != 0:
+			// symlinks of zip archives store the target as contents
+			_, err = io.WriteString(entryWriter, linkTarget)
+			return err
+		case fileInfo.Mode().IsRegular():
+			return copyFileTo(fs, name, entryWriter, fileInfo.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// ImportZip is ImportTar reading the zip archive r of size bytes
+func ImportZip(fs afero.Fs, r io.ReaderAt, size int64) error {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	var entries []archiveEntry
+	for _, zipFile := range zipReader.File {
+		name := cleanArchiveName(zipFile.Name)
+		if name == "/" {
+			continue
+		}
+		if err := importZipFile(fs, name, zipFile); err != nil {
+			return err
+		}
+		entries = append(entries, archiveEntry{name: name, mode: zipFile.Mode(), modTime: zipFile.Modified})
+	}
+	return applyArchiveEntries(fs, entries)
+}
+
+func importZipFile(fs afero.Fs, name string, zipFile *zip.File) error {
+	mode := zipFile.Mode()
+	if mode.IsDir() {
+		return fs.MkdirAll(name, 0700)
+	}
+	if mode&os.ModeType&^os.ModeSymlink != 0 {
+		return &os.PathError{Op: "import", Path: zipFile.Name, Err: ErrUnsupportedArchiveEntry}
+	}
+	entryReader, err := zipFile.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = entryReader.Close()
+	}()
+	if mode&os.ModeSymlink != 0 {
+		linkTarget, err := io.ReadAll(io.LimitReader(entryReader, 4096))
+		if err != nil {
+			return err
+		}
+		return symlinkArchiveFile(fs, name, string(linkTarget))
+	}
+	return writeArchiveFile(fs, name, entryReader)
+}
+
+// walkArchive calls fn with the slash separated names relative to the root of fs, the root itself is skipped
+func walkArchive(fs afero.Fs, fn func(name string, fileInfo os.FileInfo, linkTarget string) error) error {
+	return afero.Walk(fs, "/", func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relName := strings.TrimPrefix(filepath.ToSlash(name), "/")
+		if relName == "" {
+			return nil
+		}
+		linkTarget := ""
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			linkReader, ok := fs.(afero.LinkReader)
+			if !ok {
+				return nil
+			}
+			if linkTarget, err = linkReader.ReadlinkIfPossible(name); err != nil {
+				return err
+			}
+		}
+		return fn(relName, fileInfo, linkTarget)
+	})
+}
+
+// copyFileTo copies size bytes of name to w, files changing while exported fail instead of breaking the archive
+func copyFileTo(fs afero.Fs, name string, w io.Writer, size int64) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := io.CopyN(w, f, size); err != nil {
+		if err == io.EOF {
+			return &os.PathError{Op: "export", Path: name, Err: io.ErrUnexpectedEOF}
+		}
+		return err
+	}
+	return nil
+}
+
+func cleanArchiveName(name string) string {
+	return path.Clean("/" + strings.TrimSuffix(filepath.ToSlash(name), "/"))
+}
+
+func writeArchiveFile(fs afero.Fs, name string, r io.Reader) error {
+	if err := fs.MkdirAll(path.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func symlinkArchiveFile(fs afero.Fs, name, linkTarget string) error {
+	linker, ok := fs.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: linkTarget, New: name, Err: afero.ErrNoSymlink}
+	}
+	if err := fs.MkdirAll(path.Dir(name), 0700); err != nil {
+		return err
+	}
+	return linker.SymlinkIfPossible(linkTarget, name)
+}
+
+func linkArchiveFile(fs afero.Fs, name, linkName string) error {
+	f, err := fs.Open(linkName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return writeArchiveFile(fs, name, f)
+}
+
+// applyArchiveEntries sets modes and times in reverse order, directories last since writing files changes them
+func applyArchiveEntries(fs afero.Fs, entries []archiveEntry) error {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.mode&os.ModeSymlink != 0 {
+			continue
+		}
+		if err := fs.Chmod(entry.name, entry.mode.Perm()); err != nil {
+			return err
+		}
+		if err := fs.Chtimes(entry.name, entry.modTime, entry.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
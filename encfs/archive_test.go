@@ -0,0 +1,213 @@
+package encfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// testLinkFs is a temporary directory keeping symlink targets as they are, afero.BasePathFs makes them absolute
+type testLinkFs struct {
+	*afero.BasePathFs
+}
+
+func (fs testLinkFs) SymlinkIfPossible(oldname, newname string) error {
+	realName, err := fs.RealPath(newname)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(oldname, realName)
+}
+
+func (fs testLinkFs) ReadlinkIfPossible(name string) (string, error) {
+	realName, err := fs.RealPath(name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(realName)
+}
+
+// newTestArchiveFs returns an EncFs over a temporary directory so symlinks are supported
+func newTestArchiveFs(t *testing.T) *EncFs {
+	t.Helper()
+	base := testLinkFs{afero.NewBasePathFs(afero.NewOsFs(), t.TempDir()).(*afero.BasePathFs)}
+	return NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	modTime := time.Date(2021, 2, 3, 4, 5, 6, 789, time.UTC)
+	tests := []struct {
+		name     string
+		export   func(fs afero.Fs, w io.Writer) error
+		importFn func(fs afero.Fs, data []byte) error
+		// timePrecision is the precision of modification times in the archive
+		timePrecision time.Duration
+	}{
+		{"tar", ExportTar, func(fs afero.Fs, data []byte) error {
+			return ImportTar(fs, bytes.NewReader(data))
+		}, time.Nanosecond},
+		{"zip", ExportZip, func(fs afero.Fs, data []byte) error {
+			return ImportZip(fs, bytes.NewReader(data), int64(len(data)))
+		}, time.Second},
+	}
+	files := map[string][]byte{
+		"/plainname.txt":  []byte("text"),
+		"/empty":          {},
+		"/dir/large":      testPattern(3*CONTENT_CHUNK_SIZE + 17),
+		"/dir/sub/nested": []byte("nested"),
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newTestArchiveFs(t)
+			if err := src.MkdirAll("/dir/sub", 0750); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range files {
+				writeTestFile(t, src, name, data)
+				if err := src.Chmod(name, 0640); err != nil {
+					t.Fatal(err)
+				}
+				if err := src.Chtimes(name, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := src.SymlinkIfPossible("sub/nested", "/dir/link"); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.Chtimes("/dir", modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			var archive bytes.Buffer
+			if err := test.export(src, &archive); err != nil {
+				t.Fatal(err)
+			}
+			// meta files are never exported, contents are plaintext
+			if bytes.Contains(archive.Bytes(), []byte(EncFileExt)) {
+				t.Fatal("the archive holds meta files")
+			}
+
+			dst := newTestArchiveFs(t)
+			if err := test.importFn(dst, archive.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range files {
+				checkTestFile(t, dst, name, data)
+				fileInfo, err := dst.Stat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fileInfo.Mode() != 0640 || !fileInfo.ModTime().Equal(modTime.Truncate(test.timePrecision)) {
+					t.Fatalf("%s: got mode %v and time %v", name, fileInfo.Mode(), fileInfo.ModTime())
+				}
+			}
+			fileInfo, err := dst.Stat("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Mode() != os.ModeDir|0750 || !fileInfo.ModTime().Equal(modTime.Truncate(test.timePrecision)) {
+				t.Fatalf("/dir: got mode %v and time %v", fileInfo.Mode(), fileInfo.ModTime())
+			}
+			if linkTarget, err := dst.ReadlinkIfPossible("/dir/link"); err != nil || linkTarget != "sub/nested" {
+				t.Fatalf("got link target %q: %v", linkTarget, err)
+			}
+		})
+	}
+}
+
+func TestImportTarEntries(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   []*tar.Header
+		wantFiles map[string]string
+		wantErr   error
+	}{
+		{"names inside the root", []*tar.Header{
+			{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "/absolute", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "dir/../../up", Typeflag: tar.TypeReg, Mode: 0644},
+		}, map[string]string{"/outside": "../outside", "/absolute": "/absolute", "/up": "dir/../../up"}, nil},
+		{"parent directories are created", []*tar.Header{
+			{Name: "a/b/c", Typeflag: tar.TypeReg, Mode: 0600},
+		}, map[string]string{"/a/b/c": "a/b/c"}, nil},
+		{"hard link", []*tar.Header{
+			{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "file", Mode: 0644},
+		}, map[string]string{"/file": "file", "/link": "file"}, nil},
+		{"hard link to a missing file", []*tar.Header{
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "missing", Mode: 0644},
+		}, nil, os.ErrNotExist},
+		{"device", []*tar.Header{
+			{Name: "dev", Typeflag: tar.TypeChar, Mode: 0644},
+		}, nil, ErrUnsupportedArchiveEntry},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			tarWriter := tar.NewWriter(&archive)
+			for _, header := range test.headers {
+				// every file holds its archive name
+				if header.Typeflag == tar.TypeReg {
+					header.Size = int64(len(header.Name))
+				}
+				if err := tarWriter.WriteHeader(header); err != nil {
+					t.Fatal(err)
+				}
+				if header.Typeflag == tar.TypeReg {
+					if _, err := io.WriteString(tarWriter, header.Name); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := tarWriter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			err := ImportTar(encFs, &archive)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			for name, data := range test.wantFiles {
+				checkTestFile(t, encFs, name, []byte(data))
+			}
+		})
+	}
+}
+
+func TestImportZipEntries(t *testing.T) {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	header := &zip.FileHeader{Name: "../dir/file"}
+	header.SetMode(0604)
+	entryWriter, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(entryWriter, "data"); err != nil {
+		t.Fatal(err)
+	}
+	header = &zip.FileHeader{Name: "pipe"}
+	header.SetMode(os.ModeNamedPipe | 0644)
+	if _, err := zipWriter.CreateHeader(header); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	err = ImportZip(encFs, bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if !errors.Is(err, ErrUnsupportedArchiveEntry) {
+		t.Fatalf("got %v, want %v", err, ErrUnsupportedArchiveEntry)
+	}
+	// entries before the unsupported one are imported
+	checkTestFile(t, encFs, "/dir/file", []byte("data"))
+	if err := ImportZip(encFs, bytes.NewReader([]byte("not a zip")), 9); err == nil {
+		t.Fatal("imported a broken archive")
+	}
+}
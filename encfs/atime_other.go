@@ -0,0 +1,13 @@
+//go:build !(linux || openbsd || dragonfly || darwin || freebsd || netbsd)
+
+package encfs
+
+import (
+	"os"
+	"time"
+)
+
+// fileAccessTime returns false, access times are not read on this platform
+func fileAccessTime(fileInfo os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
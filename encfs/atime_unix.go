@@ -0,0 +1,18 @@
+//go:build linux || openbsd || dragonfly
+
+package encfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileAccessTime returns the access time of fileInfo of an os backend
+func fileAccessTime(fileInfo os.FileInfo) (time.Time, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)), true
+}
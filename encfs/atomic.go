@@ -0,0 +1,76 @@
+package encfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const ATOMIC_TEMP_FILE_SUFFIX = ".tmp-"
+
+// WriteFileAtomic replaces name with the content of r, the content is written to an encrypted temp
+// file in the same directory, data and meta are synced and then renamed into place, readers see either
+// the old or the new content, a crash between renaming meta and data is not covered
+func (encFs *EncFs) WriteFileAtomic(name string, r io.Reader, perm os.FileMode) (err error) {
+	tempName, err := atomicTempFileName(name)
+	if err != nil {
+		return err
+	}
+	f, err := encFs.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = encFs.Remove(tempName)
+		}
+	}()
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	encryptedTempName := f.(*EncFile).file.Name()
+	if err = encFs.syncBackendFile(encFs.encFileMetaName(encryptedTempName)); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = encFs.Rename(tempName, name); err != nil {
+		return err
+	}
+	// rename is durable only after the directory is synced
+	return encFs.syncBackendFile(filepath.Dir(encryptedTempName))
+}
+
+func atomicTempFileName(name string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, "."+base+ATOMIC_TEMP_FILE_SUFFIX+hex.EncodeToString(random)), nil
+}
+
+// syncBackendFile syncs a file or directory of the backend
+func (encFs *EncFs) syncBackendFile(encryptedName string) error {
+	f, err := encFs.base.Open(encryptedName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// files without meta
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return callErrWithRetry(encFs, retryIdempotent, "sync", encryptedName, func() error {
+		return f.Sync()
+	})
+}
@@ -0,0 +1,94 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/spf13/afero"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	errRead := errors.New("read failed")
+	oldData, newData := []byte("old content"), testPattern(3*CONTENT_CHUNK_SIZE+10)
+	formats := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+	}
+	readers := []struct {
+		name    string
+		reader  func() io.Reader
+		wantErr error
+	}{
+		{"complete", func() io.Reader { return bytes.NewReader(newData) }, nil},
+		{"empty", func() io.Reader { return bytes.NewReader(nil) }, nil},
+		{"error at start", func() io.Reader { return iotest.ErrReader(errRead) }, errRead},
+		// whole chunks are already written to the temp file
+		{"error mid stream", func() io.Reader {
+			return io.MultiReader(bytes.NewReader(newData[:2*CONTENT_CHUNK_SIZE+5]), iotest.ErrReader(errRead))
+		}, errRead},
+	}
+	for _, format := range formats {
+		for _, reader := range readers {
+			t.Run(format.name+" "+reader.name, func(t *testing.T) {
+				key := NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12])
+				encFs, base := newTestEncFs(key)
+				if err := format.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/dir/file", oldData)
+				before := snapshotTestFs(t, base)
+
+				err := encFs.WriteFileAtomic("/dir/file", reader.reader(), 0600)
+				if !errors.Is(err, reader.wantErr) {
+					t.Fatalf("got %v, want %v", err, reader.wantErr)
+				}
+				if reader.wantErr != nil {
+					// no temp file or orphan meta file is left
+					if after := snapshotTestFs(t, base); !reflect.DeepEqual(after, before) {
+						t.Fatalf("got backend files %d, want %d", len(after), len(before))
+					}
+					checkTestFile(t, encFs, "/dir/file", oldData)
+					return
+				}
+				all, err := io.ReadAll(reader.reader())
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, encFs, "/dir/file", all)
+				fileInfos, err := afero.ReadDir(encFs, "/dir")
+				if err != nil || len(fileInfos) != 1 || fileInfos[0].Name() != "file" {
+					t.Fatalf("got %d files: %v, want only the file", len(fileInfos), err)
+				}
+				if after := snapshotTestFs(t, base); len(after) != len(before) {
+					t.Fatalf("got %d backend files, want %d", len(after), len(before))
+				}
+			})
+		}
+	}
+}
+
+func TestAtomicTempFileName(t *testing.T) {
+	first, err := atomicTempFileName("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := atomicTempFileName("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "/dir/.file"+ATOMIC_TEMP_FILE_SUFFIX) || first == second {
+		t.Fatalf("got %s and %s", first, second)
+	}
+}
@@ -0,0 +1,267 @@
+package encfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+)
+
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"new_path,omitempty"`
+	Flag    int       `json:"flag,omitempty"`
+	Purpose string    `json:"purpose,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// AuditSink receives audit events of filesystem operations, paths are plaintext
+type AuditSink interface {
+	WriteAuditEvent(event *AuditEvent) error
+	Close() error
+}
+
+// WithAuditSink sends audit events of EncFs operations to sink, nil disables auditing
+func (encFs *EncFs) WithAuditSink(auditSink AuditSink) {
+	encFs.auditSink = auditSink
+}
+
+func (encFs *EncFs) audit(op, name, newName string, flag int, err *error) {
+	encFs.auditWithPurpose(op, name, newName, flag, "", err)
+}
+
+// auditWithPurpose records why a file was accessed, e.g. the purpose tag of a scan view
+func (encFs *EncFs) auditWithPurpose(op, name, newName string, flag int, purpose string, err *error) {
+	encFs.recordAuditedChange(op, name, newName, err)
+	encFs.trace(op, name, newName, flag, err)
+	encFs.countOperation(op, err)
+	if encFs.auditSink == nil {
+		return
+	}
+	event := &AuditEvent{
+		Time:    time.Now(),
+		Op:      op,
+		Path:    name,
+		NewPath: newName,
+		Flag:    flag,
+		Purpose: purpose,
+	}
+	if err != nil && *err != nil {
+		event.Error = (*err).Error()
+	}
+	// audit failures must not change the result of the operation
+	if auditErr := encFs.auditSink.WriteAuditEvent(event); auditErr != nil {
+		encFs.getLogger().Error("audit event not written", "op", op, "path", name, "error", auditErr)
+	}
+}
+
+type MultiAuditSink struct {
+	auditSinks []AuditSink
+}
+
+func NewMultiAuditSink(auditSinks ...AuditSink) AuditSink {
+	return &MultiAuditSink{
+		auditSinks: auditSinks,
+	}
+}
+
+func (s *MultiAuditSink) WriteAuditEvent(event *AuditEvent) error {
+	var firstErr error
+	for _, auditSink := range s.auditSinks {
+		if err := auditSink.WriteAuditEvent(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *MultiAuditSink) Close() error {
+	var firstErr error
+	for _, auditSink := range s.auditSinks {
+		if err := auditSink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type hashChainAuditRecord struct {
+	Event    *AuditEvent `json:"event"`
+	PrevHash string      `json:"prev_hash"`
+	Hash     string      `json:"hash"`
+}
+
+// HashChainFileAuditSink appends JSON lines to a local file, every line carries the hash of
+// the previous line so removed or modified lines are detected by VerifyAuditLog
+type HashChainFileAuditSink struct {
+	mutex    *sync.Mutex
+	file     *os.File
+	prevHash string
+}
+
+func NewHashChainFileAuditSink(name string) (AuditSink, error) {
+	prevHash, err := readLastAuditHash(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &HashChainFileAuditSink{
+		mutex:    &sync.Mutex{},
+		file:     file,
+		prevHash: prevHash,
+	}, nil
+}
+
+func (s *HashChainFileAuditSink) WriteAuditEvent(event *AuditEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hash, err := hashAuditEvent(s.prevHash, event)
+	if err != nil {
+		return err
+	}
+	recordBytes, err := json.Marshal(&hashChainAuditRecord{
+		Event:    event,
+		PrevHash: s.prevHash,
+		Hash:     hash,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(recordBytes, '\n')); err != nil {
+		return err
+	}
+	s.prevHash = hash
+	return nil
+}
+
+func (s *HashChainFileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of a file written by HashChainFileAuditSink
+// and returns the count of verified events, lines cut from the end only lower the count
+func VerifyAuditLog(name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	count := 0
+	prevHash := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record hashChainAuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("%w: line %d", ErrAuditChainBroken, count+1)
+		}
+		hash, err := hashAuditEvent(prevHash, record.Event)
+		if err != nil {
+			return count, err
+		}
+		if record.PrevHash != prevHash || record.Hash != hash {
+			return count, fmt.Errorf("%w: line %d", ErrAuditChainBroken, count+1)
+		}
+		prevHash = hash
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func hashAuditEvent(prevHash string, event *AuditEvent) (string, error) {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write(eventBytes)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readLastAuditHash(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	lastHash := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record hashChainAuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return "", ErrAuditChainBroken
+		}
+		lastHash = record.Hash
+	}
+	return lastHash, scanner.Err()
+}
+
+// WebhookAuditSink posts every event as JSON, e.g. to a SIEM collector or a Kafka REST proxy
+type WebhookAuditSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookAuditSink(url string, headers map[string]string) AuditSink {
+	return &WebhookAuditSink{
+		url:     url,
+		headers: headers,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (s *WebhookAuditSink) WriteAuditEvent(event *AuditEvent) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(eventBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook failed, http status: %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookAuditSink) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+
+package encfs
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink sends events as JSON messages, network and raddr are passed to syslog.Dial
+func NewSyslogAuditSink(network, raddr, tag string) (AuditSink, error) {
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{
+		writer: writer,
+	}, nil
+}
+
+func (s *SyslogAuditSink) WriteAuditEvent(event *AuditEvent) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Error != "" {
+		return s.writer.Warning(string(eventBytes))
+	}
+	return s.writer.Info(string(eventBytes))
+}
+
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,199 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestAuditLog writes count events to a new hash chain log in two sessions and returns its lines
+func writeTestAuditLog(t *testing.T, name string, count int) []string {
+	t.Helper()
+	for _, events := range [][2]int{{0, count / 2}, {count / 2, count}} {
+		// the chain goes on after reopening the log
+		auditSink, err := NewHashChainFileAuditSink(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := events[0]; i < events[1]; i++ {
+			event := &AuditEvent{Time: time.Unix(int64(i), 0), Op: "open", Path: fmt.Sprintf("/file%d", i)}
+			if err := auditSink.WriteAuditEvent(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := auditSink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n")[:count]
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	const count = 6
+	tests := []struct {
+		name string
+		// change changes the lines of the log
+		change    func(t *testing.T, lines []string) []string
+		wantCount int
+		wantErr   error
+	}{
+		{"intact", func(t *testing.T, lines []string) []string { return lines }, count, nil},
+		{"edited", func(t *testing.T, lines []string) []string {
+			lines[2] = strings.Replace(lines[2], "/file2", "/fileX", 1)
+			return lines
+		}, 2, ErrAuditChainBroken},
+		// the hash is recomputed but the next line still carries the old one
+		{"edited and rehashed", func(t *testing.T, lines []string) []string {
+			var record hashChainAuditRecord
+			if err := json.Unmarshal([]byte(lines[2]), &record); err != nil {
+				t.Fatal(err)
+			}
+			record.Event.Path = "/fileX"
+			hash, err := hashAuditEvent(record.PrevHash, record.Event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record.Hash = hash
+			recordBytes, err := json.Marshal(&record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[2] = string(recordBytes) + "\n"
+			return lines
+		}, 3, ErrAuditChainBroken},
+		{"deleted", func(t *testing.T, lines []string) []string {
+			return append(lines[:3], lines[4:]...)
+		}, 3, ErrAuditChainBroken},
+		{"deleted first", func(t *testing.T, lines []string) []string { return lines[1:] }, 0, ErrAuditChainBroken},
+		{"reordered", func(t *testing.T, lines []string) []string {
+			lines[3], lines[4] = lines[4], lines[3]
+			return lines
+		}, 3, ErrAuditChainBroken},
+		{"garbled", func(t *testing.T, lines []string) []string {
+			lines[5] = "{" + lines[5]
+			return lines
+		}, 5, ErrAuditChainBroken},
+		// a chain carries no anchor of its end, removed last lines are only seen in the count
+		{"deleted last", func(t *testing.T, lines []string) []string { return lines[:count-1] }, count - 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "audit.log")
+			lines := writeTestAuditLog(t, name, count)
+			if err := os.WriteFile(name, []byte(strings.Join(test.change(t, lines), "")), 0600); err != nil {
+				t.Fatal(err)
+			}
+			gotCount, err := VerifyAuditLog(name)
+			if gotCount != test.wantCount || !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %d, %v, want %d, %v", gotCount, err, test.wantCount, test.wantErr)
+			}
+			if wantLine := fmt.Sprintf("line %d", test.wantCount+1); err != nil && !strings.HasSuffix(err.Error(), wantLine) {
+				t.Fatalf("got %v, want %s", err, wantLine)
+			}
+		})
+	}
+}
+
+func TestHashChainFileAuditSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	auditSink, err := NewHashChainFileAuditSink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	encFs.WithAuditSink(auditSink)
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	if err := encFs.Rename("/file", "/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	_ = encFs.Remove("/missing")
+	if err := auditSink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	count, err := VerifyAuditLog(name)
+	if err != nil || count == 0 {
+		t.Fatalf("got %d, %v", count, err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"op":"rename","path":"/file","new_path":"/renamed"`,
+		`"op":"remove","path":"/missing"`,
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Fatalf("got log %s, want %s", data, want)
+		}
+	}
+
+	// a broken log is not appended to
+	if err := os.WriteFile(name, []byte("not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHashChainFileAuditSink(name); !errors.Is(err, ErrAuditChainBroken) {
+		t.Fatalf("got %v, want %v", err, ErrAuditChainBroken)
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"accepted", http.StatusAccepted, false},
+		{"server error", http.StatusInternalServerError, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var requests []*http.Request
+			var bodies [][]byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mutex.Lock()
+				requests, bodies = append(requests, r), append(bodies, body)
+				mutex.Unlock()
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			auditSink := NewWebhookAuditSink(server.URL+"/events", map[string]string{"X-Api-Key": "secret"})
+			event := &AuditEvent{Time: time.Unix(1, 0).UTC(), Op: "rename", Path: "/a", NewPath: "/b"}
+			if err := auditSink.WriteAuditEvent(event); (err != nil) != test.wantErr {
+				t.Fatalf("got %v, want error %v", err, test.wantErr)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests", len(requests))
+			}
+			request := requests[0]
+			if request.Method != http.MethodPost || request.URL.Path != "/events" ||
+				request.Header.Get("Content-Type") != "application/json" || request.Header.Get("X-Api-Key") != "secret" {
+				t.Fatalf("got %s %s %v", request.Method, request.URL, request.Header)
+			}
+			var got AuditEvent
+			if err := json.Unmarshal(bodies[0], &got); err != nil || !got.Time.Equal(event.Time) ||
+				got.Op != event.Op || got.Path != event.Path || got.NewPath != event.NewPath {
+				t.Fatalf("got %s: %v", bodies[0], err)
+			}
+		})
+	}
+}
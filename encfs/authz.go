@@ -0,0 +1,73 @@
+package encfs
+
+import (
+	"context"
+	"os"
+)
+
+type principalContextKey struct{}
+
+// AccessRequest describes an operation on plaintext paths, NewPath is the new name of rename or the target of
+// symlink, Flag is set for open
+type AccessRequest struct {
+	Op      string
+	Path    string
+	NewPath string
+	Flag    int
+}
+
+// Authorizer is consulted before every operation of EncFs, a non nil error denies the operation and is returned
+// wrapped in a *os.PathError, return os.ErrPermission so callers can check it by errors.Is
+type Authorizer interface {
+	Authorize(ctx context.Context, request *AccessRequest) error
+}
+
+type AuthorizerFunc func(ctx context.Context, request *AccessRequest) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, request *AccessRequest) error {
+	return f(ctx, request)
+}
+
+// WithAuthorizer enforces per path access control inside the encryption layer, nil allows everything
+func (encFs *EncFs) WithAuthorizer(authorizer Authorizer) {
+	encFs.authorizer = authorizer
+}
+
+// ContextWithPrincipal returns ctx carrying the user or service on whose behalf operations run
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal set by ContextWithPrincipal, empty when none
+func PrincipalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalContextKey{}).(string)
+	return principal
+}
+
+// ForContext returns a view of encFs for one request or principal, the view shares files, caches and settings
+// with encFs, ctx is passed to the authorizer and cancels pending underlying operations like WithOperationContext
+func (encFs *EncFs) ForContext(ctx context.Context) *EncFs {
+	view := *encFs
+	view.operationContext = ctx
+	return &view
+}
+
+func (encFs *EncFs) authorize(op, name, newName string, flag int) error {
+	if encFs.authorizer == nil {
+		return nil
+	}
+	ctx := encFs.operationContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := encFs.authorizer.Authorize(ctx, &AccessRequest{
+		Op:      op,
+		Path:    name,
+		NewPath: newName,
+		Flag:    flag,
+	})
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// testAuthorizer records the requests and principals, paths in denied are refused with os.ErrPermission
+type testAuthorizer struct {
+	mutex      sync.Mutex
+	denied     map[string]bool
+	requests   []AccessRequest
+	principals []string
+}
+
+func (a *testAuthorizer) Authorize(ctx context.Context, request *AccessRequest) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.requests = append(a.requests, *request)
+	a.principals = append(a.principals, PrincipalFromContext(ctx))
+	if a.denied[request.Path] {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	modTime := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name        string
+		op          func(encFs *EncFs) error
+		wantRequest AccessRequest
+		// the error of allowed operations the memory backend does not support
+		wantErr error
+	}{
+		{"create", func(encFs *EncFs) error {
+			f, err := encFs.Create("/dir/file")
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}, AccessRequest{Op: "create", Path: "/dir/file", Flag: os.O_RDWR | os.O_CREATE | os.O_TRUNC}, nil},
+		{"open", func(encFs *EncFs) error {
+			f, err := encFs.Open("/dir/existing")
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}, AccessRequest{Op: "open", Path: "/dir/existing", Flag: os.O_RDONLY}, nil},
+		{"open file", func(encFs *EncFs) error {
+			f, err := encFs.OpenFile("/dir/existing", os.O_WRONLY|os.O_APPEND, 0)
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}, AccessRequest{Op: "open", Path: "/dir/existing", Flag: os.O_WRONLY | os.O_APPEND}, nil},
+		{"mkdir", func(encFs *EncFs) error { return encFs.Mkdir("/dir/sub", 0755) },
+			AccessRequest{Op: "mkdir", Path: "/dir/sub"}, nil},
+		{"mkdirall", func(encFs *EncFs) error { return encFs.MkdirAll("/dir/sub/sub", 0755) },
+			AccessRequest{Op: "mkdirall", Path: "/dir/sub/sub"}, nil},
+		{"remove", func(encFs *EncFs) error { return encFs.Remove("/dir/existing") },
+			AccessRequest{Op: "remove", Path: "/dir/existing"}, nil},
+		{"removeall", func(encFs *EncFs) error { return encFs.RemoveAll("/dir") },
+			AccessRequest{Op: "removeall", Path: "/dir"}, nil},
+		{"rename", func(encFs *EncFs) error { return encFs.Rename("/dir/existing", "/dir/renamed") },
+			AccessRequest{Op: "rename", Path: "/dir/existing", NewPath: "/dir/renamed"}, nil},
+		{"stat", func(encFs *EncFs) error {
+			_, err := encFs.Stat("/dir/existing")
+			return err
+		}, AccessRequest{Op: "stat", Path: "/dir/existing"}, nil},
+		{"chmod", func(encFs *EncFs) error { return encFs.Chmod("/dir/existing", 0600) },
+			AccessRequest{Op: "chmod", Path: "/dir/existing"}, nil},
+		{"chtimes", func(encFs *EncFs) error { return encFs.Chtimes("/dir/existing", modTime, modTime) },
+			AccessRequest{Op: "chtimes", Path: "/dir/existing"}, nil},
+		// the path of a symlink is the link, its target is the new path
+		{"symlink", func(encFs *EncFs) error { return encFs.SymlinkIfPossible("/dir/existing", "/dir/link") },
+			AccessRequest{Op: "symlink", Path: "/dir/link", NewPath: "/dir/existing"}, afero.ErrNoSymlink},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, deny := range []bool{false, true} {
+				encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := encFs.MkdirAll("/dir", 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/dir/existing", []byte("data"))
+				authorizer := &testAuthorizer{denied: map[string]bool{test.wantRequest.Path: deny}}
+				encFs.WithAuthorizer(authorizer)
+				snapshot := snapshotTestFs(t, base)
+
+				err := test.op(encFs.ForContext(ContextWithPrincipal(context.Background(), "alice")))
+				if len(authorizer.requests) == 0 || !reflect.DeepEqual(authorizer.requests[0], test.wantRequest) {
+					t.Fatalf("got requests %+v, want %+v", authorizer.requests, test.wantRequest)
+				}
+				if authorizer.principals[0] != "alice" {
+					t.Fatalf("got principal %q", authorizer.principals[0])
+				}
+				if !deny {
+					if !errors.Is(err, test.wantErr) {
+						t.Fatalf("got %v, want %v", err, test.wantErr)
+					}
+					continue
+				}
+				var pathError *os.PathError
+				if !errors.Is(err, os.ErrPermission) || !errors.As(err, &pathError) ||
+					pathError.Path != test.wantRequest.Path {
+					t.Fatalf("got %v, want a permission path error", err)
+				}
+				// denied operations leave the backend unchanged
+				if !equalTestSnapshots(snapshot, snapshotTestFs(t, base)) {
+					t.Fatal("denied operation changed the backend")
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizerOfViews(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	authorizer := &testAuthorizer{}
+	encFs.WithAuthorizer(authorizer)
+	tests := []struct {
+		name          string
+		encFs         *EncFs
+		wantPrincipal string
+	}{
+		{"without context", encFs, ""},
+		{"without principal", encFs.ForContext(context.Background()), ""},
+		{"alice", encFs.ForContext(ContextWithPrincipal(context.Background(), "alice")), "alice"},
+		{"bob", encFs.ForContext(ContextWithPrincipal(context.Background(), "bob")), "bob"},
+	}
+	for _, test := range tests {
+		authorizer.principals = nil
+		// views share the files of encFs
+		checkTestFile(t, test.encFs, "/file", []byte("data"))
+		if len(authorizer.principals) == 0 || authorizer.principals[0] != test.wantPrincipal {
+			t.Fatalf("%s: got principals %q, want %q", test.name, authorizer.principals, test.wantPrincipal)
+		}
+	}
+	// nil allows everything again
+	encFs.WithAuthorizer(nil)
+	authorizer.requests = nil
+	readTestFile(t, encFs, "/file")
+	if len(authorizer.requests) != 0 {
+		t.Fatalf("got requests %+v", authorizer.requests)
+	}
+}
@@ -0,0 +1,107 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+func (encFs *EncFs) isOsBackend() bool {
+	_, isOsFs := encFs.base.(*afero.OsFs)
+	return isOsFs
+}
+
+// encryptFileName encrypts name for the backend, names of the os backend are made absolute
+// while other backends are rooted at "/" since they have no working directory
+func (encFs *EncFs) encryptFileName(name string) string {
+	return encFs.encryptMemoizedFileName(name, nil)
+}
+
+func (encFs *EncFs) encryptMemoizedFileName(name string, memo map[string]string) string {
+	if encFs.caseInsensitive {
+		name = encFs.resolveFoldedName(name)
+	}
+	return encFs.encryptExactMemoizedFileName(name, memo)
+}
+
+func (encFs *EncFs) encryptExactFileName(name string) string {
+	return encFs.encryptExactMemoizedFileName(name, nil)
+}
+
+func (encFs *EncFs) encryptExactMemoizedFileName(name string, memo map[string]string) string {
+	if parentName, passthroughName, found := encFs.splitPassthroughName(name); found && encFs.key.isFileNameEncrypted() {
+		// parts from the first passthrough part on are never encrypted, files encrypted before the pattern was set
+		// keep their encrypted names so they stay reachable
+		passthroughPath := filepath.Join(encFs.encryptExactMemoizedFileName(parentName, memo),
+			filepath.FromSlash(passthroughName))
+		if _, err := encFs.base.Stat(passthroughPath); !os.IsNotExist(err) {
+			return passthroughPath
+		}
+		if encryptedName := encFs.encryptEveryPartOfFileName(name, memo); encryptedName != passthroughPath {
+			if _, err := encFs.base.Stat(encryptedName); err == nil {
+				return encryptedName
+			}
+		}
+		return passthroughPath
+	}
+	return encFs.encryptEveryPartOfFileName(name, memo)
+}
+
+// encryptEveryPartOfFileName encrypts name ignoring the passthrough patterns
+func (encFs *EncFs) encryptEveryPartOfFileName(name string, memo map[string]string) string {
+	if !encFs.key.isFileNameEncrypted() {
+		return name
+	}
+	cleanName := filepath.ToSlash(filepath.Clean(string(filepath.Separator) + name))
+	if encFs.isOsBackend() {
+		absName, err := filepath.Abs(name)
+		if err != nil {
+			// should not happen, file name is not encrypted
+			return name
+		}
+		cleanName = absName
+	}
+	return encFs.key.recursiveEncrpteFileName(cleanName, encFs.existsPath, memo)
+}
+
+func (encFs *EncFs) existsPath(path string) bool {
+	// perm store plaintext path in memory, per backend
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	if exists, found := encFs.pathExistsMap[path]; found {
+		return exists
+	}
+	_, err := encFs.base.Stat(path)
+	exists := err == nil
+	encFs.pathExistsMap[path] = exists
+	return exists
+}
+
+// backend returns the backend of encFs
+func (encFs *EncFs) backend() afero.Fs {
+	return encFs.base
+}
+
+// lstat falls back to Stat when the backend has no symlinks, like afero.Lstater
+func (encFs *EncFs) lstat(name string) (os.FileInfo, bool, error) {
+	if lstater, ok := encFs.base.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fileInfo, err := encFs.base.Stat(name)
+	return fileInfo, false, err
+}
+
+func (encFs *EncFs) symlink(oldname, newname string) error {
+	if linker, ok := encFs.base.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (encFs *EncFs) readlink(name string) (string, error) {
+	if linkReader, ok := encFs.base.(afero.LinkReader); ok {
+		return linkReader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
@@ -0,0 +1,61 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestStoresUseTheirBackend(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "encfs-backend-test-store")
+	tests := []struct {
+		name    string
+		newFs   func(base afero.Fs) (afero.Fs, error)
+		collect func(fs afero.Fs) (*GcReport, error)
+	}{
+		{
+			name: "flat",
+			newFs: func(base afero.Fs) (afero.Fs, error) {
+				return NewFlatEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), root, base)
+			},
+			collect: func(fs afero.Fs) (*GcReport, error) { return fs.(*FlatEncFs).CollectGarbage(false) },
+		},
+		{
+			name: "chunk store",
+			newFs: func(base afero.Fs) (afero.Fs, error) {
+				return NewChunkStoreFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), root, base)
+			},
+			collect: func(fs afero.Fs) (*GcReport, error) { return fs.(*ChunkStoreFs).CollectGarbage(false) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			storeFs, err := test.newFs(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(5000)
+			writeTestFile(t, storeFs, "/a", data)
+			writeTestFile(t, storeFs, "/b", []byte("b"))
+			if err := storeFs.Chmod("/a", 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := storeFs.Remove("/b"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := test.collect(storeFs); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, storeFs, "/a", data)
+			if _, err := os.Stat(root); !os.IsNotExist(err) {
+				t.Fatalf("store wrote to the os: %v", err)
+			}
+			if len(snapshotTestFs(t, base)) == 0 {
+				t.Fatal("store wrote nothing to its backend")
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	BACKUP_SET_PREFIX      = "backup-"
+	BACKUP_INDEX_FILE_NAME = "index"
+	BACKUP_CHUNKS_DIR      = "chunks"
+)
+
+var (
+	ErrBadBackupSet      = errors.New("backup set is broken")
+	ErrBackupSetNotFound = errors.New("backup set not found")
+)
+
+type BackupFile struct {
+	Path    string      `json:"path"`
+	IsDir   bool        `json:"is_dir"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size"`
+	Chunks  []ChunkRef  `json:"chunks,omitempty"`
+}
+
+// BackupSet is a full backup when Parent is empty, otherwise it is a delta which only
+// holds chunks not stored in its parent chain
+type BackupSet struct {
+	Name          string       `json:"name"`
+	Parent        string       `json:"parent,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Files         []BackupFile `json:"files"`
+	NewChunkCount int          `json:"new_chunk_count"`
+	NewChunkBytes int64        `json:"new_chunk_bytes"`
+}
+
+// BackupEngine writes encrypted backup sets under targetRoot of any afero target
+type BackupEngine struct {
+	key        *EncryptionMasterKey
+	target     afero.Fs
+	targetRoot string
+	chunker    *contentChunker
+}
+
+func NewBackupEngine(key *EncryptionMasterKey, target afero.Fs, targetRoot string) *BackupEngine {
+	return &BackupEngine{
+		key:        key,
+		target:     target,
+		targetRoot: targetRoot,
+		chunker:    newContentChunker(key.key),
+	}
+}
+
+// ListBackupSets returns completed backup set names, oldest first
+func (e *BackupEngine) ListBackupSets() ([]string, error) {
+	dirEntries, err := afero.ReadDir(e.target, e.targetRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !strings.HasPrefix(dirEntry.Name(), BACKUP_SET_PREFIX) {
+			continue
+		}
+		// sets without index are interrupted backups
+		indexExists, err := afero.Exists(e.target, path.Join(e.targetRoot, dirEntry.Name(), BACKUP_INDEX_FILE_NAME))
+		if err != nil {
+			return nil, err
+		}
+		if indexExists {
+			names = append(names, dirEntry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (e *BackupEngine) ReadBackupSet(name string) (*BackupSet, error) {
+	sealedIndex, err := afero.ReadFile(e.target, path.Join(e.targetRoot, name, BACKUP_INDEX_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBackupSetNotFound
+		}
+		return nil, err
+	}
+	indexBytes, err := openWithRandomNonce(e.key.key, sealedIndex)
+	if err != nil {
+		return nil, ErrBadBackupSet
+	}
+	var backupSet BackupSet
+	if err := json.Unmarshal(indexBytes, &backupSet); err != nil {
+		return nil, ErrBadBackupSet
+	}
+	return &backupSet, nil
+}
+
+// Backup walks sourceRoot of source and writes a new backup set, unless full is true the set is
+// a delta against the latest set, every file is read and chunked again and only chunks whose hash is
+// not stored in the parent chain are written, so rewrites keeping the size and mtime are backed up
+func (e *BackupEngine) Backup(source afero.Fs, sourceRoot string, full bool) (*BackupSet, error) {
+	backupSet := &BackupSet{
+		Name:      BACKUP_SET_PREFIX + time.Now().UTC().Format("20060102T150405.000000000Z"),
+		CreatedAt: time.Now(),
+		Files:     make([]BackupFile, 0),
+	}
+	storedChunkIds := make(map[string]bool)
+	if !full {
+		names, err := e.ListBackupSets()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			backupSet.Parent = names[len(names)-1]
+			chain, err := e.readBackupSetChain(backupSet.Parent)
+			if err != nil {
+				return nil, err
+			}
+			for _, chainSet := range chain {
+				for _, file := range chainSet.Files {
+					for _, chunkRef := range file.Chunks {
+						storedChunkIds[chunkRef.Id] = true
+					}
+				}
+			}
+		}
+	}
+
+	setDir := path.Join(e.targetRoot, backupSet.Name)
+	if err := e.target.MkdirAll(path.Join(setDir, BACKUP_CHUNKS_DIR), 0700); err != nil {
+		return nil, err
+	}
+	err := afero.Walk(source, sourceRoot, func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relName, err := filepath.Rel(sourceRoot, name)
+		if err != nil {
+			return err
+		}
+		backupFile := BackupFile{
+			Path:    filepath.ToSlash(relName),
+			IsDir:   fileInfo.IsDir(),
+			Mode:    fileInfo.Mode(),
+			ModTime: fileInfo.ModTime(),
+			Size:    fileInfo.Size(),
+		}
+		if !fileInfo.Mode().IsRegular() {
+			if fileInfo.IsDir() {
+				backupSet.Files = append(backupSet.Files, backupFile)
+			}
+			return nil
+		}
+		chunks, err := e.backupFileChunks(source, name, setDir, storedChunkIds, backupSet)
+		if err != nil {
+			return err
+		}
+		backupFile.Chunks = chunks
+		backupSet.Files = append(backupSet.Files, backupFile)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	indexBytes, err := json.Marshal(backupSet)
+	if err != nil {
+		return nil, err
+	}
+	sealedIndex, err := sealWithRandomNonce(e.key.key, indexBytes)
+	if err != nil {
+		return nil, err
+	}
+	// index is written last, a set without index is an interrupted backup
+	if err := afero.WriteFile(e.target, path.Join(setDir, BACKUP_INDEX_FILE_NAME), sealedIndex, 0600); err != nil {
+		return nil, err
+	}
+	return backupSet, nil
+}
+
+func (e *BackupEngine) backupFileChunks(source afero.Fs, name, setDir string, storedChunkIds map[string]bool, backupSet *BackupSet) ([]ChunkRef, error) {
+	file, err := source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	chunks := make([]ChunkRef, 0)
+	err = e.chunker.splitChunkStream(file, func(chunk []byte) error {
+		id := e.chunker.chunkId(chunk)
+		chunks = append(chunks, ChunkRef{Id: id, Size: int64(len(chunk))})
+		if storedChunkIds[id] {
+			return nil
+		}
+		encryptedChunk, err := e.chunker.sealChunk(id, chunk)
+		if err != nil {
+			return err
+		}
+		if err := afero.WriteFile(e.target, path.Join(setDir, BACKUP_CHUNKS_DIR, id), encryptedChunk, 0600); err != nil {
+			return err
+		}
+		storedChunkIds[id] = true
+		backupSet.NewChunkCount++
+		backupSet.NewChunkBytes += int64(len(encryptedChunk))
+		return nil
+	})
+	return chunks, err
+}
+
+// readBackupSetChain returns the set followed by its ancestors up to the full backup
+func (e *BackupEngine) readBackupSetChain(name string) ([]*BackupSet, error) {
+	chain := make([]*BackupSet, 0)
+	visited := make(map[string]bool)
+	for name != "" {
+		if visited[name] {
+			return nil, ErrBadBackupSet
+		}
+		visited[name] = true
+		backupSet, err := e.ReadBackupSet(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, backupSet)
+		name = backupSet.Parent
+	}
+	return chain, nil
+}
+
+// Restore writes files of backup set name to destinationRoot of destination
+func (e *BackupEngine) Restore(name string, destination afero.Fs, destinationRoot string) error {
+	chain, err := e.readBackupSetChain(name)
+	if err != nil {
+		return err
+	}
+	chunkSetDirs := make(map[string]string)
+	for i := len(chain) - 1; i >= 0; i-- {
+		setDir := path.Join(e.targetRoot, chain[i].Name)
+		chunkInfos, err := afero.ReadDir(e.target, path.Join(setDir, BACKUP_CHUNKS_DIR))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, chunkInfo := range chunkInfos {
+			chunkSetDirs[chunkInfo.Name()] = setDir
+		}
+	}
+
+	backupSet := chain[0]
+	for _, file := range backupSet.Files {
+		destinationName := filepath.Join(destinationRoot, filepath.FromSlash(file.Path))
+		if file.IsDir {
+			if err := destination.MkdirAll(destinationName, file.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.restoreFile(file, destination, destinationName, chunkSetDirs); err != nil {
+			return err
+		}
+	}
+	// directory modes and times are restored last, restoring files changes them
+	for i := len(backupSet.Files) - 1; i >= 0; i-- {
+		file := backupSet.Files[i]
+		destinationName := filepath.Join(destinationRoot, filepath.FromSlash(file.Path))
+		if err := destination.Chmod(destinationName, file.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := destination.Chtimes(destinationName, file.ModTime, file.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *BackupEngine) restoreFile(file BackupFile, destination afero.Fs, destinationName string, chunkSetDirs map[string]string) error {
+	destinationFile, err := destination.OpenFile(destinationName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, chunkRef := range file.Chunks {
+		setDir, found := chunkSetDirs[chunkRef.Id]
+		if !found || !isChunkId(chunkRef.Id) {
+			_ = destinationFile.Close()
+			return ErrBadBackupSet
+		}
+		encryptedChunk, err := afero.ReadFile(e.target, path.Join(setDir, BACKUP_CHUNKS_DIR, chunkRef.Id))
+		if err != nil {
+			_ = destinationFile.Close()
+			return err
+		}
+		chunk, err := e.chunker.openChunk(chunkRef.Id, encryptedChunk)
+		if err != nil {
+			_ = destinationFile.Close()
+			return err
+		}
+		if _, err := destinationFile.Write(chunk); err != nil {
+			_ = destinationFile.Close()
+			return err
+		}
+	}
+	return destinationFile.Close()
+}
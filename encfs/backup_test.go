@@ -0,0 +1,118 @@
+package encfs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestBackupRestore(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		// modify changes the source after the full backup
+		modify        func(t *testing.T, source afero.Fs)
+		wantNewChunks int
+	}{
+		{"unchanged", func(t *testing.T, source afero.Fs) {}, 0},
+		// the size and mtime are kept, only the chunk hash tells the change
+		{"same size rewrite", func(t *testing.T, source afero.Fs) {
+			writeTestFile(t, source, "/dir/a", []byte("AAAA"))
+			if err := source.Chtimes("/dir/a", modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+		{"new file", func(t *testing.T, source afero.Fs) {
+			writeTestFile(t, source, "/dir/c", []byte("cccc"))
+		}, 1},
+		{"removed file", func(t *testing.T, source afero.Fs) {
+			if err := source.Remove("/b"); err != nil {
+				t.Fatal(err)
+			}
+		}, 0},
+		// chunks stored by the full backup are not written again
+		{"copied file", func(t *testing.T, source afero.Fs) {
+			writeTestFile(t, source, "/dir/copy", []byte("aaaa"))
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, target := afero.NewMemMapFs(), afero.NewMemMapFs()
+			for name, data := range map[string]string{"/dir/a": "aaaa", "/b": "bbbb"} {
+				writeTestFile(t, source, name, []byte(data))
+				if err := source.Chtimes(name, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			engine := NewBackupEngine(NewEncryptionMasterKey(testKeyBytes(1)), target, "/backups")
+			fullSet, err := engine.Backup(source, "/", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fullSnapshot := snapshotTestFs(t, source)
+			test.modify(t, source)
+			deltaSet, err := engine.Backup(source, "/", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deltaSet.Parent != fullSet.Name || deltaSet.NewChunkCount != test.wantNewChunks {
+				t.Fatalf("got parent %q with %d new chunks, want %q with %d", deltaSet.Parent,
+					deltaSet.NewChunkCount, fullSet.Name, test.wantNewChunks)
+			}
+			names, err := engine.ListBackupSets()
+			if err != nil || !reflect.DeepEqual(names, []string{fullSet.Name, deltaSet.Name}) {
+				t.Fatalf("got sets %q: %v", names, err)
+			}
+
+			for _, restored := range []struct {
+				name         string
+				wantSnapshot map[string]string
+			}{{fullSet.Name, fullSnapshot}, {deltaSet.Name, snapshotTestFs(t, source)}} {
+				destination := afero.NewMemMapFs()
+				if err := engine.Restore(restored.name, destination, "/"); err != nil {
+					t.Fatal(err)
+				}
+				if snapshot := snapshotTestFs(t, destination); !reflect.DeepEqual(snapshot, restored.wantSnapshot) {
+					t.Fatalf("restored %v of %s, want %v", snapshot, restored.name, restored.wantSnapshot)
+				}
+				fileInfo, err := destination.Stat("/b")
+				if err == nil && !fileInfo.ModTime().Equal(modTime) {
+					t.Fatalf("restored mtime %v, want %v", fileInfo.ModTime(), modTime)
+				}
+			}
+		})
+	}
+}
+
+func TestBackupSetErrors(t *testing.T) {
+	target := afero.NewMemMapFs()
+	engine := NewBackupEngine(NewEncryptionMasterKey(testKeyBytes(1)), target, "/backups")
+	source := afero.NewMemMapFs()
+	writeTestFile(t, source, "/a", []byte("a"))
+	backupSet, err := engine.Backup(source, "/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		engine  *BackupEngine
+		setName string
+		wantErr error
+	}{
+		{"missing", engine, BACKUP_SET_PREFIX + "missing", ErrBackupSetNotFound},
+		{"wrong key", NewBackupEngine(NewEncryptionMasterKey(testKeyBytes(2)), target, "/backups"), backupSet.Name,
+			ErrBadBackupSet},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.engine.ReadBackupSet(test.setName); err != test.wantErr {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err := test.engine.Restore(test.setName, afero.NewMemMapFs(), "/"); err != test.wantErr {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
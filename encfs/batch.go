@@ -0,0 +1,108 @@
+package encfs
+
+import (
+	"os"
+	"time"
+)
+
+// MetadataSpec describes metadata changes applied by ApplyMetadata, nil fields are left unchanged
+type MetadataSpec struct {
+	// Mode is applied to files and their meta files, DirMode is applied to directories
+	Mode    *os.FileMode
+	DirMode *os.FileMode
+	Uid     *int
+	Gid     *int
+	Atime   *time.Time
+	Mtime   *time.Time
+	// Filter selects files by plaintext path, all files are selected when nil
+	Filter func(name string, fileInfo os.FileInfo) bool
+}
+
+// ApplyMetadata walks walkRoot and applies spec to every file and directory, only walkRoot is
+// encrypted, children are walked by on-disk names so name encryption is not repeated per file
+func (encFs *EncFs) ApplyMetadata(walkRoot string, spec *MetadataSpec) (int, error) {
+	appliedCount := 0
+	err := encFs.walkEncrypted(walkRoot, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if spec.Filter != nil && !spec.Filter(plainName, fileInfo) {
+			return nil
+		}
+		if err := encFs.applyMetadata(encryptedName, fileInfo, spec); err != nil {
+			return err
+		}
+		appliedCount++
+		return nil
+	})
+	return appliedCount, err
+}
+
+func (encFs *EncFs) applyMetadata(encryptedName string, fileInfo os.FileInfo, spec *MetadataSpec) error {
+	names := []string{encryptedName}
+	if !fileInfo.IsDir() {
+		encFileMetaName := encFs.encFileMetaName(encryptedName)
+		if _, _, err := encFs.lstat(encFileMetaName); err == nil {
+			names = append(names, encFileMetaName)
+		}
+	}
+	mode := spec.Mode
+	if fileInfo.IsDir() {
+		mode = spec.DirMode
+	}
+	for _, name := range names {
+		if mode != nil {
+			if err := callErrWithRetry(encFs, retryIdempotent, "chmod", name, func() error {
+				return encFs.base.Chmod(name, *mode)
+			}); err != nil {
+				return err
+			}
+		}
+		if spec.Uid != nil || spec.Gid != nil {
+			uid, gid := -1, -1
+			if spec.Uid != nil {
+				uid = *spec.Uid
+			}
+			if spec.Gid != nil {
+				gid = *spec.Gid
+			}
+			if err := callErrWithRetry(encFs, retryIdempotent, "chown", name, func() error {
+				return encFs.base.Chown(name, uid, gid)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if spec.Atime != nil || spec.Mtime != nil {
+		atime, mtime, err := encFs.currentFileTimes(encryptedName, fileInfo)
+		if err != nil {
+			return err
+		}
+		if spec.Atime != nil {
+			atime = *spec.Atime
+		}
+		if spec.Mtime != nil {
+			mtime = *spec.Mtime
+		}
+		return callErrWithRetry(encFs, retryIdempotent, "chtimes", encryptedName, func() error {
+			return encFs.base.Chtimes(encryptedName, atime, mtime)
+		})
+	}
+	return nil
+}
+
+// currentFileTimes returns the access and modification times Chtimes of encryptedName keeps, Chtimes follows symlinks
+// so they are read by Stat, the access time is the modification time when the backend does not report it
+func (encFs *EncFs) currentFileTimes(encryptedName string, fileInfo os.FileInfo) (time.Time, time.Time, error) {
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		var err error
+		fileInfo, err = callWithRetry(encFs, retryIdempotent, "stat", encryptedName, func() (os.FileInfo, error) {
+			return encFs.base.Stat(encryptedName)
+		}, nil)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	atime, ok := fileAccessTime(fileInfo)
+	if !ok {
+		atime = fileInfo.ModTime()
+	}
+	return atime, fileInfo.ModTime(), nil
+}
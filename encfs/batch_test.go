@@ -0,0 +1,55 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestApplyMetadataTimes(t *testing.T) {
+	oldAtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	oldMtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	newTime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name      string
+		spec      *MetadataSpec
+		wantAtime time.Time
+		wantMtime time.Time
+	}{
+		{"mtime keeps atime", &MetadataSpec{Mtime: &newTime}, oldAtime, newTime},
+		{"atime keeps mtime", &MetadataSpec{Atime: &newTime}, newTime, oldMtime},
+		{"both", &MetadataSpec{Atime: &newTime, Mtime: &newTime}, newTime, newTime},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), afero.NewOsFs()).(*EncFs)
+			name := filepath.Join(root, "file")
+			writeTestFile(t, encFs, name, []byte("data"))
+			encryptedName := encFs.encryptFileName(name)
+			if err := os.Chtimes(encryptedName, oldAtime, oldMtime); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := encFs.ApplyMetadata(name, test.spec); err != nil {
+				t.Fatal(err)
+			}
+			fileInfo, err := os.Stat(encryptedName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fileInfo.ModTime().Equal(test.wantMtime) {
+				t.Fatalf("mtime %v, want %v", fileInfo.ModTime(), test.wantMtime)
+			}
+			atime, ok := fileAccessTime(fileInfo)
+			if !ok {
+				t.Skip("access times are not read on this platform")
+			}
+			if !atime.Equal(test.wantAtime) {
+				t.Fatalf("atime %v, want %v", atime, test.wantAtime)
+			}
+		})
+	}
+}
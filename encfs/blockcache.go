@@ -0,0 +1,220 @@
+package encfs
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BLOCK_CACHE_MIN_BLOCK_SIZE = 4 << 10
+	BLOCK_CACHE_MAX_BLOCK_SIZE = 64 << 10
+)
+
+var (
+	ErrBadBlockCacheSize = errors.New("block cache block size must be a power of two from 4KiB to 64KiB")
+)
+
+// blockCache holds decrypted blocks of files by encrypted name and block index, the least recently used block is
+// evicted first, blocks of a file are dropped when its IV changes
+type blockCache struct {
+	mutex     sync.Mutex
+	blockSize int
+	maxBlocks int
+	// lru holds *blockCacheEntry, the most recently used in front
+	lru   *list.List
+	files map[string]*blockCacheFile
+	// generation changes on every invalidation, blocks read before an invalidation are not cached
+	generation uint64
+}
+
+type blockCacheFile struct {
+	iv     string
+	blocks map[int64]*list.Element
+}
+
+type blockCacheEntry struct {
+	name  string
+	index int64
+	data  []byte
+}
+
+// WithBlockCache caches up to maxBlocks decrypted blocks of blockSize bytes, a power of two from 4KiB to 64KiB,
+// shared by all handles so repeated reads of the same regions are not decrypted again, writes, truncates and new
+// IVs through this EncFs invalidate the blocks they touch, changes of the backend by others are not seen,
+// maxBlocks 0 disables the cache
+func (encFs *EncFs) WithBlockCache(blockSize int, maxBlocks int) error {
+	if maxBlocks <= 0 {
+		encFs.blockCache = nil
+		return nil
+	}
+	if blockSize < BLOCK_CACHE_MIN_BLOCK_SIZE || blockSize > BLOCK_CACHE_MAX_BLOCK_SIZE || blockSize&(blockSize-1) != 0 {
+		return ErrBadBlockCacheSize
+	}
+	encFs.blockCache = newBlockCache(blockSize, maxBlocks)
+	return nil
+}
+
+func newBlockCache(blockSize int, maxBlocks int) *blockCache {
+	return &blockCache{
+		blockSize: blockSize,
+		maxBlocks: maxBlocks,
+		lru:       list.New(),
+		files:     map[string]*blockCacheFile{},
+	}
+}
+
+// get returns block index of name if cached with iv, and the generation to pass to put
+func (c *blockCache) get(name, iv string, index int64) ([]byte, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	file := c.files[name]
+	if file == nil {
+		return nil, c.generation
+	}
+	if file.iv != iv {
+		c.forgetLocked(name)
+		return nil, c.generation
+	}
+	element := file.blocks[index]
+	if element == nil {
+		return nil, c.generation
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).data, c.generation
+}
+
+// put caches block index of name unless something was invalidated since generation was returned by get
+func (c *blockCache) put(name, iv string, index int64, data []byte, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	file := c.files[name]
+	if file == nil {
+		file = &blockCacheFile{iv: iv, blocks: map[int64]*list.Element{}}
+		c.files[name] = file
+	} else if file.iv != iv {
+		return
+	}
+	if element := file.blocks[index]; element != nil {
+		element.Value.(*blockCacheEntry).data = data
+		c.lru.MoveToFront(element)
+		return
+	}
+	file.blocks[index] = c.lru.PushFront(&blockCacheEntry{name: name, index: index, data: data})
+	for c.lru.Len() > c.maxBlocks {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops the blocks of name overlapping n bytes at off, n < 0 drops all blocks from off
+func (c *blockCache) invalidate(name string, off, n int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	file := c.files[name]
+	if file == nil || n == 0 {
+		return
+	}
+	blockSize := int64(c.blockSize)
+	first := off / blockSize
+	if n > 0 && (off+n-1)/blockSize-first < int64(len(file.blocks)) {
+		for index := first; index <= (off+n-1)/blockSize; index++ {
+			if element := file.blocks[index]; element != nil {
+				c.removeLocked(element)
+			}
+		}
+		return
+	}
+	for index, element := range file.blocks {
+		if index >= first && (n < 0 || index <= (off+n-1)/blockSize) {
+			c.removeLocked(element)
+		}
+	}
+}
+
+func (c *blockCache) forgetLocked(name string) {
+	if file := c.files[name]; file != nil {
+		for _, element := range file.blocks {
+			c.lru.Remove(element)
+		}
+		delete(c.files, name)
+	}
+}
+
+func (c *blockCache) removeLocked(element *list.Element) {
+	entry := c.lru.Remove(element).(*blockCacheEntry)
+	file := c.files[entry.name]
+	delete(file.blocks, entry.index)
+	if len(file.blocks) == 0 {
+		delete(c.files, entry.name)
+	}
+}
+
+func (f *EncFile) getBlockCache() *blockCache {
+	if f.encFs.key == nil || f.encFileMeta == nil {
+		return nil
+	}
+	return f.encFs.blockCache
+}
+
+// invalidateBlockCache drops cached blocks of the file overlapping n bytes at off, n < 0 drops all blocks from off,
+// read-ahead buffers of all handles become stale
+func (f *EncFile) invalidateBlockCache(off, n int64) {
+	atomic.AddUint64(&f.encFs.contentGeneration, 1)
+	if cache := f.getBlockCache(); cache != nil {
+		cache.invalidate(f.file.Name(), off, n)
+	}
+}
+
+// readAtBlockCache reads like readAt through the block cache, missing blocks are read and decrypted whole, only
+// complete blocks are cached so a short block is the end of file
+func (f *EncFile) readAtBlockCache(cache *blockCache, p []byte, off int64) (int, error) {
+	name := f.file.Name()
+	iv := string(f.encFileMeta.Iv)
+	blockSize := int64(cache.blockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / blockSize
+		block, generation := cache.get(name, iv, index)
+		f.encFs.countCacheRequest(METRIC_CACHE_BLOCK, block != nil)
+		if block == nil {
+			readBuff := make([]byte, blockSize)
+			readLen, err := f.readAt(readBuff, index*blockSize)
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			block = readBuff[:readLen]
+			if int64(readLen) == blockSize {
+				cache.put(name, iv, index, block, generation)
+			}
+		}
+		blockOffset := int(pos - index*blockSize)
+		if blockOffset >= len(block) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], block[blockOffset:])
+		if int64(len(block)) < blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// readBlockCache reads like Read through the block cache
+func (f *EncFile) readBlockCache(cache *blockCache, p []byte) (int, error) {
+	readLen, err := f.readAtBlockCache(cache, p, f.filePos)
+	f.filePos += int64(readLen)
+	if err := f.seekUnderlyingFilePos(readLen); err != nil {
+		return readLen, err
+	}
+	if err == io.EOF && readLen > 0 {
+		err = nil
+	}
+	return readLen, err
+}
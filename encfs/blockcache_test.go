@@ -0,0 +1,227 @@
+package encfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestWithBlockCache(t *testing.T) {
+	tests := []struct {
+		blockSize int
+		maxBlocks int
+		wantErr   error
+		wantCache bool
+	}{
+		{4096, 10, nil, true},
+		{BLOCK_CACHE_MAX_BLOCK_SIZE, 1, nil, true},
+		{8192, 0, nil, false},
+		// the block size is not checked when the cache is disabled
+		{100, 0, nil, false},
+		{2048, 10, ErrBadBlockCacheSize, false},
+		{2 * BLOCK_CACHE_MAX_BLOCK_SIZE, 10, ErrBadBlockCacheSize, false},
+		{5000, 10, ErrBadBlockCacheSize, false},
+	}
+	for _, test := range tests {
+		encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+		err := encFs.WithBlockCache(test.blockSize, test.maxBlocks)
+		if err != test.wantErr || (encFs.blockCache != nil) != test.wantCache {
+			t.Fatalf("%d blocks of %d bytes: got %v and cache %t", test.maxBlocks, test.blockSize, err,
+				encFs.blockCache != nil)
+		}
+	}
+}
+
+// cachedTestBlocks returns the cached block indexes of name
+func cachedTestBlocks(c *blockCache, name string) []int64 {
+	var indexes []int64
+	if file := c.files[name]; file != nil {
+		for index := range file.blocks {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	c := newBlockCache(4096, 3)
+	for index := int64(0); index < 3; index++ {
+		_, generation := c.get("a", "iv", index)
+		c.put("a", "iv", index, []byte{byte(index)}, generation)
+	}
+	// the least recently used block is evicted first
+	if data, _ := c.get("a", "iv", 0); !bytes.Equal(data, []byte{0}) {
+		t.Fatalf("got block %v", data)
+	}
+	_, generation := c.get("b", "iv", 0)
+	c.put("b", "iv", 0, []byte{9}, generation)
+	if got := cachedTestBlocks(c, "a"); len(got) != 2 || got[0] != 0 || got[1] != 2 {
+		t.Fatalf("cached blocks %v of a", got)
+	}
+	// blocks read before an invalidation are not cached
+	_, generation = c.get("a", "iv", 5)
+	c.invalidate("other", 0, 1)
+	c.put("a", "iv", 5, []byte{5}, generation)
+	if data, _ := c.get("a", "iv", 5); data != nil {
+		t.Fatal("cached a block read before an invalidation")
+	}
+	// a new IV drops the blocks of the file
+	if data, _ := c.get("a", "other iv", 0); data != nil {
+		t.Fatal("got a block of another IV")
+	}
+	if got := cachedTestBlocks(c, "a"); len(got) != 0 || c.lru.Len() != 1 {
+		t.Fatalf("cached blocks %v of a and %d blocks", got, c.lru.Len())
+	}
+}
+
+func TestBlockCacheInvalidate(t *testing.T) {
+	tests := []struct {
+		name string
+		off  int64
+		n    int64
+		want []int64
+	}{
+		{"nothing", 4096, 0, []int64{0, 1, 2, 3, 10}},
+		{"one byte", 4096, 1, []int64{0, 2, 3, 10}},
+		{"across blocks", 4095, 2, []int64{2, 3, 10}},
+		{"last byte of a block", 3*4096 - 1, 1, []int64{0, 1, 3, 10}},
+		{"more blocks than cached", 4096, 100 * 4096, []int64{0}},
+		{"to the end", 2 * 4096, -1, []int64{0, 1}},
+		{"from the start", 0, -1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newBlockCache(4096, 100)
+			for _, index := range []int64{0, 1, 2, 3, 10} {
+				c.put("a", "iv", index, []byte{byte(index)}, 0)
+			}
+			c.invalidate("a", test.off, test.n)
+			got := cachedTestBlocks(c, "a")
+			if len(got) != len(test.want) || (len(got) > 0 && !equalTestInt64s(got, test.want)) {
+				t.Fatalf("got blocks %v, want %v", got, test.want)
+			}
+			if c.lru.Len() != len(test.want) {
+				t.Fatalf("got %d blocks in the lru list, want %d", c.lru.Len(), len(test.want))
+			}
+		})
+	}
+}
+
+func equalTestInt64s(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlockCacheReads(t *testing.T) {
+	tests := []struct {
+		name   string
+		cipher string
+		change func(t *testing.T, encFs *EncFs, data []byte) []byte
+	}{
+		{"ctr", CIPHER_AES_CTR, nil},
+		{"gcm", CIPHER_AES_GCM, nil},
+		{"ctr written", CIPHER_AES_CTR, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			if _, err := f.WriteAt([]byte("changed"), 5000); err != nil {
+				t.Fatal(err)
+			}
+			return overwriteTestBytes(data, 5000, []byte("changed"))
+		}},
+		{"gcm written", CIPHER_AES_GCM, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			if _, err := f.Seek(9000, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("changed")); err != nil {
+				t.Fatal(err)
+			}
+			return overwriteTestBytes(data, 9000, []byte("changed"))
+		}},
+		{"truncated", CIPHER_AES_CTR, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			if err := f.Truncate(6000); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(10000); err != nil {
+				t.Fatal(err)
+			}
+			return append(append([]byte(nil), data[:6000]...), make([]byte, 4000)...)
+		}},
+		{"rewritten with a new IV", CIPHER_AES_GCM, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			writeTestFile(t, encFs, "/file", []byte("new"))
+			return []byte("new")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(test.cipher); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.WithBlockCache(4096, 100); err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(3*4096 + 100)
+			writeTestFile(t, encFs, "/file", data)
+			checkTestFile(t, encFs, "/file", data)
+			// the short last block is not cached
+			if got := cachedTestBlocks(encFs.blockCache, encFs.encryptFileName("/file")); len(got) != 3 {
+				t.Fatalf("cached blocks %v", got)
+			}
+			if test.change != nil {
+				data = test.change(t, encFs, data)
+			}
+			checkTestFile(t, encFs, "/file", data)
+			f, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			// reads across blocks and past the end of file
+			for _, off := range []int64{0, 4090, int64(len(data)) - 3, int64(len(data))} {
+				if off > int64(len(data)) {
+					continue
+				}
+				buff := make([]byte, 5000)
+				n, err := f.ReadAt(buff, off)
+				want := data[off:]
+				if len(want) > len(buff) {
+					want = want[:len(buff)]
+				}
+				if !bytes.Equal(buff[:n], want) || (n < len(buff) && err != io.EOF) {
+					t.Fatalf("read %d bytes at %d: %v", n, off, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package encfs
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WithCaseInsensitiveLookup resolves names ignoring case like Windows and macOS clients expect, an existing
+// name with the exact case is preferred, otherwise the entry with the same folded name is used, directory
+// listings are indexed so files added to the backend behind the EncFs are only found by their exact case
+// until their directory changes through it
+func (encFs *EncFs) WithCaseInsensitiveLookup(caseInsensitive bool) {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	encFs.caseInsensitive = caseInsensitive
+	encFs.foldedNameIndexes = make(map[string]map[string][]string)
+}
+
+func foldName(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// resolveFoldedName returns name with every existing part replaced by its on-disk case, parts are looked up
+// in the directory indexes only so resolving costs no backend call once they are built, parts after the first
+// one missing from the index are kept as given
+func (encFs *EncFs) resolveFoldedName(name string) string {
+	absName, err := encFs.absBackendName(name)
+	if err != nil {
+		return name
+	}
+	separator := string(filepath.Separator)
+	parts := strings.Split(strings.TrimPrefix(absName, filepath.VolumeName(absName)+separator), separator)
+	resolvedName := filepath.VolumeName(absName) + separator
+	memo := make(map[string]string)
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		plainNames := encFs.foldedNameIndex(resolvedName, memo)[foldName(part)]
+		if len(plainNames) == 0 {
+			return filepath.Join(append([]string{resolvedName}, parts[i:]...)...)
+		}
+		// the exact case is preferred, otherwise the first in order of names only differing in case
+		actualPart := plainNames[0]
+		for _, plainName := range plainNames {
+			if plainName == part {
+				actualPart = part
+				break
+			}
+		}
+		resolvedName = filepath.Join(resolvedName, actualPart)
+	}
+	return resolvedName
+}
+
+// foldedNameIndex maps folded names to the sorted plaintext names of directory plainDirName, the index is
+// built on first use and dropped when the directory changes
+func (encFs *EncFs) foldedNameIndex(plainDirName string, memo map[string]string) map[string][]string {
+	encryptedDirName := encFs.encryptExactMemoizedFileName(plainDirName, memo)
+	encFs.mutex.Lock()
+	foldedNames, found := encFs.foldedNameIndexes[encryptedDirName]
+	encFs.mutex.Unlock()
+	if found {
+		return foldedNames
+	}
+
+	foldedNames = make(map[string][]string)
+	dir, err := encFs.base.Open(encryptedDirName)
+	if err != nil {
+		return foldedNames
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return foldedNames
+	}
+	for _, name := range names {
+		if encFs.metaFileNaming().isInternalName(name) {
+			continue
+		}
+		plainName := encFs.key.decryptFileNamePart(encryptedDirName, name)
+		foldedName := foldName(plainName)
+		foldedNames[foldedName] = append(foldedNames[foldedName], plainName)
+	}
+	for _, plainNames := range foldedNames {
+		sort.Strings(plainNames)
+	}
+	encFs.mutex.Lock()
+	encFs.foldedNameIndexes[encryptedDirName] = foldedNames
+	encFs.mutex.Unlock()
+	return foldedNames
+}
+
+// invalidateFoldedNameIndex drops the index of the parent directory of encryptedName
+func (encFs *EncFs) invalidateFoldedNameIndex(encryptedName string) {
+	if !encFs.caseInsensitive {
+		return
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	delete(encFs.foldedNameIndexes, filepath.Dir(encryptedName))
+}
+
+// invalidateFoldedNameIndexes drops all indexes, used when whole subtrees change
+func (encFs *EncFs) invalidateFoldedNameIndexes() {
+	if !encFs.caseInsensitive {
+		return
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	encFs.foldedNameIndexes = make(map[string]map[string][]string)
+}
@@ -0,0 +1,166 @@
+package encfs
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCaseInsensitiveLookup(t *testing.T) {
+	keys := []struct {
+		name string
+		key  func() *EncryptionMasterKey
+	}{
+		{"plain names", func() *EncryptionMasterKey { return NewEncryptionMasterKey(testKeyBytes(1)) }},
+		{"gcm names", func() *EncryptionMasterKey {
+			return NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12])
+		}},
+	}
+	tests := []struct {
+		name string
+		// change changes the files after the index of /Dir is built
+		change func(t *testing.T, encFs *EncFs)
+		// wantFiles maps looked up names to their contents, nil when they do not exist
+		wantFiles map[string][]byte
+	}{
+		{"mixed case", func(t *testing.T, encFs *EncFs) {}, map[string][]byte{
+			"/Dir/File.txt":   []byte("file"),
+			"/dir/FILE.TXT":   []byte("file"),
+			"/DIR/sub/Deep":   []byte("deep"),
+			"/dir/Sub/dEEP":   []byte("deep"),
+			"/dir/missing":    nil,
+			"/missing/File":   nil,
+			"/dir/File.txt/x": nil,
+		}},
+		// names only differing in case, the exact case wins, otherwise the first in order
+		{"collision", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, NewEncFsWithBackend(encFs.key, encFs.base), "/Dir/file.TXT", []byte("second"))
+			encFs.invalidateFoldedNameIndexes()
+		}, map[string][]byte{
+			"/dir/FILE.txt": []byte("file"),
+			"/dir/File.txt": []byte("file"),
+			"/dir/file.TXT": []byte("second"),
+		}},
+		{"renamed", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/file.txt", "/DIR/Renamed"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{
+			"/dir/FILE.TXT": nil,
+			"/Dir/File.txt": nil,
+			"/dir/renamed":  []byte("file"),
+		}},
+		{"renamed directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/sub", "/dir/Other"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{
+			"/dir/sub/deep":   nil,
+			"/dir/OTHER/deep": []byte("deep"),
+		}},
+		{"removed", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/DIR/FILE.TXT"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{
+			"/dir/file.txt": nil,
+			"/Dir/File.txt": nil,
+			"/dir/sub/deep": []byte("deep"),
+		}},
+		// the other name of a collision is found once the first is removed
+		{"removed collision", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, NewEncFsWithBackend(encFs.key, encFs.base), "/Dir/file.TXT", []byte("second"))
+			encFs.invalidateFoldedNameIndexes()
+			checkTestFile(t, encFs, "/dir/FILE.txt", []byte("file"))
+			if err := encFs.Remove("/Dir/File.txt"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{
+			"/dir/FILE.txt": []byte("second"),
+			"/Dir/File.txt": []byte("second"),
+		}},
+		{"created", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, encFs, "/dir/New", []byte("new"))
+			// the existing name is written, not a second one only differing in case
+			writeTestFile(t, encFs, "/dir/file.txt", []byte("rewritten"))
+		}, map[string][]byte{
+			"/dir/NEW":      []byte("new"),
+			"/Dir/File.txt": []byte("rewritten"),
+			"/Dir/file.txt": []byte("rewritten"),
+		}},
+	}
+	for _, key := range keys {
+		for _, test := range tests {
+			t.Run(key.name+" "+test.name, func(t *testing.T) {
+				encFs, _ := newTestEncFs(key.key())
+				writeTestFile(t, encFs, "/Dir/File.txt", []byte("file"))
+				writeTestFile(t, encFs, "/Dir/Sub/Deep", []byte("deep"))
+				encFs.WithCaseInsensitiveLookup(true)
+				checkTestFile(t, encFs, "/dir/FILE.TXT", []byte("file"))
+				test.change(t, encFs)
+				for name, want := range test.wantFiles {
+					got, err := afero.ReadFile(encFs, name)
+					if want == nil && err == nil {
+						t.Fatalf("got %q of %s, want not exist", got, name)
+					}
+					if want != nil && (err != nil || !bytes.Equal(got, want)) {
+						t.Fatalf("got %q, %v of %s, want %q", got, err, name, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCaseSensitiveLookup(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/Dir/File", []byte("file"))
+	if _, err := encFs.Stat("/dir/file"); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+	writeTestFile(t, encFs, "/Dir/file", []byte("second"))
+	checkTestFile(t, encFs, "/Dir/File", []byte("file"))
+}
+
+func TestResolveFoldedNameCalls(t *testing.T) {
+	base := newTestRecordingFs(afero.NewMemMapFs())
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12]),
+		base).(*EncFs)
+	writeTestFile(t, encFs, "/Dir/Sub/File", []byte("file"))
+	encFs.WithCaseInsensitiveLookup(true)
+	tests := []struct {
+		name   string
+		lookup string
+		want   string
+		// wantOpens are the directories read, no part is looked up by lstat
+		wantOpens int
+	}{
+		// the indexes of /, /Dir and /Dir/Sub are read once
+		{"first lookup", "/dir/sub/FILE", "/Dir/Sub/File", 3},
+		{"indexed", "/DIR/SUB/file", "/Dir/Sub/File", 0},
+		{"exact case", "/Dir/Sub/File", "/Dir/Sub/File", 0},
+		{"missing", "/dir/missing/File", "/Dir/missing/File", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base.takeCalls()
+			got := encFs.resolveFoldedName(test.lookup)
+			calls := base.takeCalls()
+			opens := 0
+			for _, call := range calls {
+				if strings.HasPrefix(call, "open ") {
+					opens++
+				}
+				if strings.HasPrefix(call, "lstat ") {
+					t.Fatalf("got call %s", call)
+				}
+			}
+			if got != test.want || opens != test.wantOpens {
+				t.Fatalf("got %s with calls %q, want %s with %d opens", got, calls, test.want, test.wantOpens)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package encfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const (
+	CHUNK_MIN_SIZE = 16 * 1024
+	CHUNK_AVG_SIZE = 64 * 1024
+	CHUNK_MAX_SIZE = 256 * 1024
+)
+
+var (
+	ErrBadChunk = errors.New("chunk is broken")
+)
+
+// contentChunker splits data into content-defined chunks and encrypts them by keyed hash
+type contentChunker struct {
+	key       []byte
+	gearTable [256]uint64
+}
+
+func newContentChunker(key []byte) *contentChunker {
+	chunker := &contentChunker{
+		key: key,
+	}
+	// gear table is derived from the key, chunk boundaries do not leak content to the storage
+	for i := 0; i < 256; i++ {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("gear:"))
+		mac.Write([]byte{byte(i)})
+		chunker.gearTable[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+	return chunker
+}
+
+// chunkId is a keyed hash, identical chunks are stored once without leaking plaintext hashes
+func (c *contentChunker) chunkId(chunk []byte) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("chunk:"))
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *contentChunker) sealChunk(id string, chunk []byte) ([]byte, error) {
+	aesgcm, err := newAesGcm(c.key)
+	if err != nil {
+		return nil, err
+	}
+	idBytes, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	// nonce is derived from the chunk id, same chunk always encrypts to same bytes
+	return aesgcm.Seal(nil, idBytes[:aesgcm.NonceSize()], chunk, nil), nil
+}
+
+func (c *contentChunker) openChunk(id string, encryptedChunk []byte) ([]byte, error) {
+	aesgcm, err := newAesGcm(c.key)
+	if err != nil {
+		return nil, err
+	}
+	idBytes, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, ErrBadChunk
+	}
+	chunk, err := aesgcm.Open(nil, idBytes[:aesgcm.NonceSize()], encryptedChunk, nil)
+	if err != nil {
+		return nil, ErrBadChunk
+	}
+	return chunk, nil
+}
+
+// splitChunks splits data with a gear rolling hash into content-defined chunks
+func (c *contentChunker) splitChunks(data []byte) [][]byte {
+	const mask = uint64(CHUNK_AVG_SIZE - 1)
+	chunks := make([][]byte, 0)
+	for len(data) > 0 {
+		if len(data) <= CHUNK_MIN_SIZE {
+			chunks = append(chunks, data)
+			break
+		}
+		var hash uint64
+		cut := len(data)
+		if cut > CHUNK_MAX_SIZE {
+			cut = CHUNK_MAX_SIZE
+		}
+		for i := CHUNK_MIN_SIZE; i < len(data) && i < CHUNK_MAX_SIZE; i++ {
+			hash = (hash << 1) + c.gearTable[data[i]]
+			if hash&mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	return chunks
+}
+
+// splitChunkStream reads r and calls fn with each content-defined chunk, chunks are the same
+// as splitChunks on the whole content, chunk slices are only valid during fn
+func (c *contentChunker) splitChunkStream(r io.Reader, fn func(chunk []byte) error) error {
+	buffer := make([]byte, 0, 4*CHUNK_MAX_SIZE)
+	eof := false
+	for {
+		for !eof && len(buffer) < cap(buffer) {
+			readLen, err := r.Read(buffer[len(buffer):cap(buffer)])
+			buffer = buffer[:len(buffer)+readLen]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		chunks := c.splitChunks(buffer)
+		if !eof && len(chunks) > 0 {
+			// last chunk may continue in the unread content
+			chunks = chunks[:len(chunks)-1]
+		}
+		consumed := 0
+		for _, chunk := range chunks {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			consumed += len(chunk)
+		}
+		if eof {
+			return nil
+		}
+		buffer = buffer[:copy(buffer, buffer[consumed:])]
+	}
+}
+
+func isChunkId(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,667 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	CHUNK_STORE_CHUNKS_DIR = "chunks"
+	CHUNK_STORE_FILES_DIR  = "files"
+)
+
+var (
+	ErrBadChunkManifest = errors.New("chunk manifest is broken")
+)
+
+type ChunkRef struct {
+	Id   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+type ChunkManifest struct {
+	Size   int64      `json:"size"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// ChunkStoreFs splits file content into content-defined chunks stored by keyed hash under
+// root/chunks, files are encrypted chunk lists stored under root/files
+type ChunkStoreFs struct {
+	key     *EncryptionMasterKey
+	root    string
+	treeFs  *EncFs
+	chunker *contentChunker
+	// writers hold read lock, garbage collection holds write lock
+	volumeLock *sync.RWMutex
+}
+
+func NewChunkStoreFs(key *EncryptionMasterKey, root string) (*ChunkStoreFs, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkStoreFsWithBackend(key, absRoot, afero.NewOsFs())
+}
+
+// NewChunkStoreFsWithBackend stores the chunks and the files in root of base
+func NewChunkStoreFsWithBackend(key *EncryptionMasterKey, root string, base afero.Fs) (*ChunkStoreFs, error) {
+	root = filepath.Clean(root)
+	for _, dir := range []string{CHUNK_STORE_CHUNKS_DIR, CHUNK_STORE_FILES_DIR} {
+		if err := base.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	chunkStoreFs := &ChunkStoreFs{
+		key:        key,
+		root:       root,
+		treeFs:     newEncFs(key, base),
+		chunker:    newContentChunker(key.key),
+		volumeLock: &sync.RWMutex{},
+	}
+	return chunkStoreFs, nil
+}
+
+func (*ChunkStoreFs) Name() string { return "ChunkStoreFs" }
+
+func (chunkFs *ChunkStoreFs) Create(name string) (afero.File, error) {
+	return chunkFs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (chunkFs *ChunkStoreFs) Mkdir(name string, perm os.FileMode) error {
+	return chunkFs.treeFs.Mkdir(chunkFs.treeName(name), perm)
+}
+
+func (chunkFs *ChunkStoreFs) MkdirAll(name string, perm os.FileMode) error {
+	return chunkFs.treeFs.MkdirAll(chunkFs.treeName(name), perm)
+}
+
+func (chunkFs *ChunkStoreFs) Open(name string) (afero.File, error) {
+	return chunkFs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (chunkFs *ChunkStoreFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name = cleanFlatPath(name)
+	treeName := chunkFs.treeName(name)
+	fileInfo, err := chunkFs.treeFs.Stat(treeName)
+	if err == nil && fileInfo.IsDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		dirFile, err := chunkFs.treeFs.Open(treeName)
+		if err != nil {
+			return nil, err
+		}
+		return &ChunkFile{chunkFs: chunkFs, name: name, flag: flag, dirFile: dirFile}, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	chunkFile := &ChunkFile{chunkFs: chunkFs, name: name, flag: flag, manifest: &ChunkManifest{}}
+	if exists && flag&os.O_TRUNC == 0 {
+		manifest, err := chunkFs.readManifest(treeName)
+		if err != nil {
+			return nil, err
+		}
+		chunkFile.manifest = manifest
+	} else {
+		// new or truncated file, the empty manifest is written immediately
+		chunkFile.segments = []*chunkSegment{}
+		chunkFile.dirty = true
+		if err := chunkFile.flush(perm); err != nil {
+			return nil, err
+		}
+	}
+	if flag&os.O_APPEND != 0 {
+		chunkFile.pos = chunkFile.manifest.Size
+	}
+	return chunkFile, nil
+}
+
+func (chunkFs *ChunkStoreFs) Remove(name string) error {
+	return chunkFs.treeFs.Remove(chunkFs.treeName(name))
+}
+
+func (chunkFs *ChunkStoreFs) RemoveAll(name string) error {
+	return chunkFs.treeFs.RemoveAll(chunkFs.treeName(name))
+}
+
+func (chunkFs *ChunkStoreFs) Rename(oldname, newname string) error {
+	return chunkFs.treeFs.Rename(chunkFs.treeName(oldname), chunkFs.treeName(newname))
+}
+
+func (chunkFs *ChunkStoreFs) Stat(name string) (os.FileInfo, error) {
+	name = cleanFlatPath(name)
+	treeName := chunkFs.treeName(name)
+	fileInfo, err := chunkFs.treeFs.Stat(treeName)
+	if err != nil {
+		return nil, err
+	}
+	return chunkFs.logicalFileInfo(treeName, path.Base(name), fileInfo)
+}
+
+func (chunkFs *ChunkStoreFs) Chmod(name string, mode os.FileMode) error {
+	return chunkFs.treeFs.Chmod(chunkFs.treeName(name), mode)
+}
+
+func (chunkFs *ChunkStoreFs) Chown(name string, uid, gid int) error {
+	return chunkFs.treeFs.Chown(chunkFs.treeName(name), uid, gid)
+}
+
+func (chunkFs *ChunkStoreFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return chunkFs.treeFs.Chtimes(chunkFs.treeName(name), atime, mtime)
+}
+
+func (chunkFs *ChunkStoreFs) treeName(name string) string {
+	return filepath.Join(chunkFs.root, CHUNK_STORE_FILES_DIR, filepath.FromSlash(cleanFlatPath(name)))
+}
+
+// backend returns the fs holding the chunks and the files
+func (chunkFs *ChunkStoreFs) backend() afero.Fs {
+	return chunkFs.treeFs.backend()
+}
+
+func (chunkFs *ChunkStoreFs) chunkName(id string) string {
+	return filepath.Join(chunkFs.root, CHUNK_STORE_CHUNKS_DIR, id[:2], id)
+}
+
+func (chunkFs *ChunkStoreFs) logicalFileInfo(treeName, name string, fileInfo os.FileInfo) (os.FileInfo, error) {
+	logicalFileInfo := &FlatFileInfo{
+		name:    name,
+		mode:    fileInfo.Mode(),
+		modTime: fileInfo.ModTime(),
+		sys:     fileInfo.Sys(),
+	}
+	if !fileInfo.IsDir() {
+		manifest, err := chunkFs.readManifest(treeName)
+		if err != nil {
+			return nil, err
+		}
+		logicalFileInfo.size = manifest.Size
+	}
+	return logicalFileInfo, nil
+}
+
+func (chunkFs *ChunkStoreFs) readManifest(treeName string) (*ChunkManifest, error) {
+	manifestFile, err := chunkFs.treeFs.Open(treeName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = manifestFile.Close()
+	}()
+	return readChunkManifest(manifestFile)
+}
+
+func readChunkManifest(manifestFile io.Reader) (*ChunkManifest, error) {
+	manifestBytes, err := io.ReadAll(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ChunkManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, ErrBadChunkManifest
+	}
+	return &manifest, nil
+}
+
+// writeManifest replaces the manifest atomically, readers and a crash leave either the old or the new chunk list, an
+// existing manifest keeps its mode
+func (chunkFs *ChunkStoreFs) writeManifest(treeName string, manifest *ChunkManifest, perm os.FileMode) error {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if fileInfo, err := chunkFs.treeFs.Stat(treeName); err == nil {
+		perm = fileInfo.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return chunkFs.treeFs.WriteFileAtomic(treeName, bytes.NewReader(manifestBytes), perm)
+}
+
+func (chunkFs *ChunkStoreFs) writeChunk(chunk []byte) (string, error) {
+	id := chunkFs.chunker.chunkId(chunk)
+	chunkName := chunkFs.chunkName(id)
+	if _, err := chunkFs.backend().Stat(chunkName); err == nil {
+		// already stored, deduplicated
+		return id, nil
+	}
+	encryptedChunk, err := chunkFs.chunker.sealChunk(id, chunk)
+	if err != nil {
+		return "", err
+	}
+	if err := chunkFs.backend().MkdirAll(filepath.Dir(chunkName), 0700); err != nil {
+		return "", err
+	}
+	tempChunkName := chunkName + ".tmp"
+	if err := afero.WriteFile(chunkFs.backend(), tempChunkName, encryptedChunk, 0600); err != nil {
+		return "", err
+	}
+	return id, chunkFs.backend().Rename(tempChunkName, chunkName)
+}
+
+// readChunkOf returns the plaintext of chunkRef, it must have the size recorded in the manifest
+func (chunkFs *ChunkStoreFs) readChunkOf(chunkRef ChunkRef) ([]byte, error) {
+	chunk, err := chunkFs.readChunk(chunkRef.Id)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(chunk)) != chunkRef.Size {
+		return nil, ErrBadChunkManifest
+	}
+	return chunk, nil
+}
+
+func (chunkFs *ChunkStoreFs) readChunk(id string) ([]byte, error) {
+	if !isChunkId(id) {
+		return nil, ErrBadChunkManifest
+	}
+	encryptedChunk, err := afero.ReadFile(chunkFs.backend(), chunkFs.chunkName(id))
+	if err != nil {
+		return nil, err
+	}
+	return chunkFs.chunker.openChunk(id, encryptedChunk)
+}
+
+type ChunkFile struct {
+	chunkFs  *ChunkStoreFs
+	name     string
+	flag     int
+	closed   bool
+	dirFile  afero.File
+	manifest *ChunkManifest
+	// segments are the chunks of the file after the first modification, only chunks touched by writes are loaded,
+	// reads are served from the manifest before
+	segments []*chunkSegment
+	dirty    bool
+	pos      int64
+}
+
+// chunkSegment is a stored chunk of a file, or plaintext replacing stored chunks on the next flush when loaded
+type chunkSegment struct {
+	ref    ChunkRef
+	data   []byte
+	loaded bool
+}
+
+func (s *chunkSegment) size() int64 {
+	if s.loaded {
+		return int64(len(s.data))
+	}
+	return s.ref.Size
+}
+
+func (f *ChunkFile) Close() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	f.closed = true
+	if f.dirFile != nil {
+		return f.dirFile.Close()
+	}
+	return f.flush(0666)
+}
+
+func (f *ChunkFile) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ChunkFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if err := f.checkIsFile(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	var segmentOffset int64
+	for _, segment := range f.readSegments() {
+		if n >= len(p) {
+			break
+		}
+		readOffset := off + int64(n)
+		segmentEnd := segmentOffset + segment.size()
+		if readOffset >= segmentEnd {
+			segmentOffset = segmentEnd
+			continue
+		}
+		data := segment.data
+		if !segment.loaded {
+			if data, err = f.chunkFs.readChunkOf(segment.ref); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], data[readOffset-segmentOffset:])
+		segmentOffset = segmentEnd
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *ChunkFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.checkIsFile(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *ChunkFile) Write(p []byte) (n int, err error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = f.size()
+	}
+	n, err = f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *ChunkFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if err := f.checkIsFile(); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.initSegments()
+	if size := f.size(); off > size {
+		// the gap reads as zeros
+		f.segments = append(f.segments, &chunkSegment{data: make([]byte, off-size), loaded: true})
+	}
+	endOffset := off + int64(len(p))
+	merged, mergedOffset, err := f.mergeSegments(off, endOffset)
+	if err != nil {
+		return 0, err
+	}
+	if mergedEnd := mergedOffset + int64(len(merged.data)); endOffset > mergedEnd {
+		merged.data = append(merged.data, make([]byte, endOffset-mergedEnd)...)
+	}
+	copy(merged.data[off-mergedOffset:], p)
+	f.dirty = true
+	return len(p), nil
+}
+
+func (f *ChunkFile) Name() string {
+	return f.name
+}
+
+func (f *ChunkFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.dirFile == nil {
+		return nil, syscall.ENOTDIR
+	}
+	fileInfos, err := f.dirFile.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	logicalFileInfos := make([]os.FileInfo, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		childName := path.Join(f.name, fileInfo.Name())
+		logicalFileInfo, err := f.chunkFs.logicalFileInfo(f.chunkFs.treeName(childName), fileInfo.Name(), fileInfo)
+		if err != nil {
+			return logicalFileInfos, err
+		}
+		logicalFileInfos = append(logicalFileInfos, logicalFileInfo)
+	}
+	sort.Slice(logicalFileInfos, func(i, j int) bool {
+		return logicalFileInfos[i].Name() < logicalFileInfos[j].Name()
+	})
+	return logicalFileInfos, nil
+}
+
+func (f *ChunkFile) Readdirnames(n int) ([]string, error) {
+	fi, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range fi {
+		names = append(names, f.Name())
+	}
+
+	return names, nil
+}
+
+func (f *ChunkFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	fileInfo, err := f.chunkFs.Stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	if flatFileInfo, ok := fileInfo.(*FlatFileInfo); ok && !fileInfo.IsDir() {
+		flatFileInfo.size = f.size()
+	}
+	return fileInfo, nil
+}
+
+func (f *ChunkFile) Sync() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	if f.dirFile != nil {
+		return nil
+	}
+	return f.flush(0666)
+}
+
+func (f *ChunkFile) Truncate(size int64) error {
+	if err := f.checkIsFile(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.initSegments()
+	f.dirty = true
+	if currentSize := f.size(); size >= currentSize {
+		if size > currentSize {
+			f.segments = append(f.segments, &chunkSegment{data: make([]byte, size-currentSize), loaded: true})
+		}
+		return nil
+	}
+	// only the chunk holding the new end is loaded and cut
+	var segmentOffset int64
+	for i, segment := range f.segments {
+		segmentEnd := segmentOffset + segment.size()
+		if segmentEnd <= size {
+			segmentOffset = segmentEnd
+			continue
+		}
+		if segmentOffset == size {
+			f.segments = f.segments[:i]
+			return nil
+		}
+		if err := f.chunkFs.loadSegment(segment); err != nil {
+			return err
+		}
+		segment.data = segment.data[:size-segmentOffset]
+		f.segments = f.segments[:i+1]
+		return nil
+	}
+	return nil
+}
+
+func (f *ChunkFile) WriteString(s string) (ret int, err error) {
+	return f.Write([]byte(s))
+}
+
+func (f *ChunkFile) checkIsFile() error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	if f.dirFile != nil {
+		return syscall.EISDIR
+	}
+	return nil
+}
+
+func (f *ChunkFile) size() int64 {
+	if f.segments == nil {
+		return f.manifest.Size
+	}
+	var size int64
+	for _, segment := range f.segments {
+		size += segment.size()
+	}
+	return size
+}
+
+// initSegments starts modifying the file, every chunk of the manifest becomes a segment which is not loaded
+func (f *ChunkFile) initSegments() {
+	if f.segments == nil {
+		f.segments = f.readSegments()
+	}
+}
+
+// readSegments returns the segments of a modified file, or those of the manifest
+func (f *ChunkFile) readSegments() []*chunkSegment {
+	if f.segments != nil {
+		return f.segments
+	}
+	segments := make([]*chunkSegment, 0, len(f.manifest.Chunks))
+	for _, chunkRef := range f.manifest.Chunks {
+		segments = append(segments, &chunkSegment{ref: chunkRef})
+	}
+	return segments
+}
+
+func (chunkFs *ChunkStoreFs) loadSegment(segment *chunkSegment) error {
+	if segment.loaded {
+		return nil
+	}
+	chunk, err := chunkFs.readChunkOf(segment.ref)
+	if err != nil {
+		return err
+	}
+	segment.data = chunk
+	segment.loaded = true
+	return nil
+}
+
+// mergeSegments loads the segments overlapping off to end and replaces them by one loaded segment, which is returned
+// with its offset, a loaded segment ending at off is merged too so appends extend it, off must not be after the end
+func (f *ChunkFile) mergeSegments(off, end int64) (*chunkSegment, int64, error) {
+	first, last := -1, -1
+	var segmentOffset, mergedOffset int64
+	for i, segment := range f.segments {
+		segmentEnd := segmentOffset + segment.size()
+		if segmentOffset < end && segmentEnd > off || segment.loaded && segmentEnd == off {
+			if first < 0 {
+				first, mergedOffset = i, segmentOffset
+			}
+			last = i
+		}
+		segmentOffset = segmentEnd
+	}
+	if first < 0 {
+		// off is the end of the file after a stored chunk
+		merged := &chunkSegment{data: []byte{}, loaded: true}
+		f.segments = append(f.segments, merged)
+		return merged, segmentOffset, nil
+	}
+	var data []byte
+	for _, segment := range f.segments[first : last+1] {
+		if err := f.chunkFs.loadSegment(segment); err != nil {
+			return nil, 0, err
+		}
+		data = append(data, segment.data...)
+	}
+	merged := &chunkSegment{data: data, loaded: true}
+	f.segments = append(f.segments[:first], append([]*chunkSegment{merged}, f.segments[last+1:]...)...)
+	return merged, mergedOffset, nil
+}
+
+// flush stores the loaded segments as new chunks and keeps the chunks of the others, runs of loaded segments are
+// split separately so a chunk boundary is kept at both of their ends
+func (f *ChunkFile) flush(perm os.FileMode) error {
+	if !f.dirty {
+		return nil
+	}
+	f.chunkFs.volumeLock.RLock()
+	defer f.chunkFs.volumeLock.RUnlock()
+	manifest := &ChunkManifest{
+		Chunks: make([]ChunkRef, 0),
+	}
+	var pending []byte
+	writePending := func() error {
+		for _, chunk := range f.chunkFs.chunker.splitChunks(pending) {
+			id, err := f.chunkFs.writeChunk(chunk)
+			if err != nil {
+				return err
+			}
+			manifest.Chunks = append(manifest.Chunks, ChunkRef{Id: id, Size: int64(len(chunk))})
+		}
+		pending = nil
+		return nil
+	}
+	for _, segment := range f.segments {
+		manifest.Size += segment.size()
+		if segment.loaded {
+			pending = append(pending, segment.data...)
+			continue
+		}
+		if err := writePending(); err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, segment.ref)
+	}
+	if err := writePending(); err != nil {
+		return err
+	}
+	if err := f.chunkFs.writeManifest(f.chunkFs.treeName(f.name), manifest, perm); err != nil {
+		return err
+	}
+	f.manifest = manifest
+	f.segments = nil
+	f.dirty = false
+	return nil
+}
@@ -0,0 +1,187 @@
+package encfs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func newTestChunkStoreFs(t *testing.T) *ChunkStoreFs {
+	t.Helper()
+	chunkFs, err := NewChunkStoreFs(NewEncryptionMasterKey(testKeyBytes(1)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunkFs
+}
+
+func testRandomBytes(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkFileModifications(t *testing.T) {
+	original := testRandomBytes(1<<20, 1)
+	patch := testRandomBytes(1000, 2)
+	tests := []struct {
+		name   string
+		modify func(f *ChunkFile) error
+		want   func() []byte
+	}{
+		{
+			name: "write in the middle",
+			modify: func(f *ChunkFile) error {
+				_, err := f.WriteAt(patch, 500000)
+				return err
+			},
+			want: func() []byte {
+				data := append([]byte(nil), original...)
+				copy(data[500000:], patch)
+				return data
+			},
+		},
+		{
+			name: "append",
+			modify: func(f *ChunkFile) error {
+				_, err := f.WriteAt(patch, int64(len(original)))
+				return err
+			},
+			want: func() []byte { return append(append([]byte(nil), original...), patch...) },
+		},
+		{
+			name: "write after a gap",
+			modify: func(f *ChunkFile) error {
+				_, err := f.WriteAt(patch, int64(len(original))+100)
+				return err
+			},
+			want: func() []byte {
+				data := append(append([]byte(nil), original...), make([]byte, 100)...)
+				return append(data, patch...)
+			},
+		},
+		{
+			name: "overlapping writes",
+			modify: func(f *ChunkFile) error {
+				if _, err := f.WriteAt(patch, 300000); err != nil {
+					return err
+				}
+				_, err := f.WriteAt(patch, 300500)
+				return err
+			},
+			want: func() []byte {
+				data := append([]byte(nil), original...)
+				copy(data[300000:], patch)
+				copy(data[300500:], patch)
+				return data
+			},
+		},
+		{
+			name:   "truncate shorter",
+			modify: func(f *ChunkFile) error { return f.Truncate(123457) },
+			want:   func() []byte { return append([]byte(nil), original[:123457]...) },
+		},
+		{
+			name:   "truncate longer",
+			modify: func(f *ChunkFile) error { return f.Truncate(int64(len(original)) + 10) },
+			want:   func() []byte { return append(append([]byte(nil), original...), make([]byte, 10)...) },
+		},
+		{
+			name: "truncate and write",
+			modify: func(f *ChunkFile) error {
+				if err := f.Truncate(1000); err != nil {
+					return err
+				}
+				_, err := f.WriteAt(patch, 2000)
+				return err
+			},
+			want: func() []byte {
+				data := append(append([]byte(nil), original[:1000]...), make([]byte, 1000)...)
+				return append(data, patch...)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkFs := newTestChunkStoreFs(t)
+			writeTestFile(t, chunkFs, "/file", original)
+			f, err := chunkFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.modify(f.(*ChunkFile)); err != nil {
+				t.Fatal(err)
+			}
+			want := test.want()
+			// reads before the flush see the modification
+			got := make([]byte, len(want))
+			if n, err := f.ReadAt(got, 0); n != len(want) || !bytes.Equal(got, want) {
+				t.Fatalf("read before close: %d bytes, %v", n, err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, chunkFs, "/file", want)
+			fileInfo, err := chunkFs.Stat("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Size() != int64(len(want)) {
+				t.Fatalf("size %d, want %d", fileInfo.Size(), len(want))
+			}
+		})
+	}
+}
+
+func TestChunkFileWriteLoadsOnlyTouchedChunks(t *testing.T) {
+	chunkFs := newTestChunkStoreFs(t)
+	original := testRandomBytes(1<<20, 1)
+	writeTestFile(t, chunkFs, "/file", original)
+	manifest, err := chunkFs.readManifest(chunkFs.treeName("/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) < 3 {
+		t.Fatalf("got %d chunks, want at least 3", len(manifest.Chunks))
+	}
+	// the last chunk can not be read, a write to the first chunk must not need it
+	lastChunk := manifest.Chunks[len(manifest.Chunks)-1]
+	if err := os.Remove(chunkFs.chunkName(lastChunk.Id)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := chunkFs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("patched"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err = chunkFs.readManifest(chunkFs.treeName("/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Size != int64(len(original)) || manifest.Chunks[len(manifest.Chunks)-1] != lastChunk {
+		t.Fatalf("untouched last chunk was not kept")
+	}
+}
+
+func TestChunkFileManifestKeepsMode(t *testing.T) {
+	chunkFs := newTestChunkStoreFs(t)
+	writeTestFile(t, chunkFs, "/file", []byte("data"))
+	if err := chunkFs.Chmod("/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, chunkFs, "/file", []byte("new data"))
+	fileInfo, err := chunkFs.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("mode %v, want %v", fileInfo.Mode().Perm(), os.FileMode(0600))
+	}
+	checkTestFile(t, chunkFs, "/file", []byte("new data"))
+}
@@ -0,0 +1,75 @@
+package encfs
+
+import (
+	"crypto/cipher"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	CIPHER_CHACHA20_POLY1305  = "chacha20-poly1305"
+	CIPHER_XCHACHA20_POLY1305 = "xchacha20-poly1305"
+
+	CHUNK_TAG_SIZE = 16
+)
+
+// chunkedCipherSuite seals content chunks, the nonce size is needed to locate chunks without a key
+type chunkedCipherSuite struct {
+	nonceSize int
+	newAead   func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	ErrBadChunkedCipher    = errors.New("chunked cipher needs a name, a nonce size and an AEAD")
+	ErrChunkedCipherExists = errors.New("chunked cipher is already registered")
+)
+
+var (
+	chunkedCipherSuitesMutex = &sync.RWMutex{}
+	chunkedCipherSuites      = map[string]*chunkedCipherSuite{
+		CIPHER_AES_GCM:            {nonceSize: 12, newAead: newAesGcm},
+		CIPHER_CHACHA20_POLY1305:  {nonceSize: chacha20poly1305.NonceSize, newAead: chacha20poly1305.New},
+		CIPHER_XCHACHA20_POLY1305: {nonceSize: chacha20poly1305.NonceSizeX, newAead: chacha20poly1305.NewX},
+	}
+)
+
+// RegisterChunkedCipher adds a cipher suite for chunked content, newAead must return an AEAD with a
+// 16 bytes tag and nonceSize bytes nonces, the name is recorded in the meta file of every file so registered
+// names can not be replaced, files written with the old suite would no longer decrypt
+func RegisterChunkedCipher(name string, nonceSize int, newAead func(key []byte) (cipher.AEAD, error)) error {
+	if name == "" || nonceSize <= 0 || newAead == nil {
+		return ErrBadChunkedCipher
+	}
+	chunkedCipherSuitesMutex.Lock()
+	defer chunkedCipherSuitesMutex.Unlock()
+	if _, found := chunkedCipherSuites[name]; found || name == CIPHER_AES_CTR || name == CIPHER_NONE {
+		return ErrChunkedCipherExists
+	}
+	chunkedCipherSuites[name] = &chunkedCipherSuite{nonceSize: nonceSize, newAead: newAead}
+	return nil
+}
+
+func getChunkedCipherSuite(name string) *chunkedCipherSuite {
+	chunkedCipherSuitesMutex.RLock()
+	defer chunkedCipherSuitesMutex.RUnlock()
+	return chunkedCipherSuites[name]
+}
+
+func isSupportedContentCipher(contentCipher string) bool {
+	return contentCipher == CIPHER_AES_CTR || getChunkedCipherSuite(contentCipher) != nil
+}
+
+// WithContentCipher sets the default cipher of files created with this key, EncFs.WithContentCipher
+// takes precedence, e.g. CIPHER_CHACHA20_POLY1305 on devices without AES instructions
+func (k *EncryptionMasterKey) WithContentCipher(contentCipher string) error {
+	if !isSupportedContentCipher(contentCipher) {
+		return ErrUnsupportedCipher
+	}
+	if contentCipher == CIPHER_AES_CTR {
+		contentCipher = ""
+	}
+	k.contentCipher = contentCipher
+	return nil
+}
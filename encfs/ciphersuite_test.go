@@ -0,0 +1,104 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+)
+
+// newTestAesGcm16 returns AES/GCM with 16 bytes nonces, a suite not registered by the package
+func newTestAesGcm16(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, 16)
+}
+
+// registerTestChunkedCipher registers name for the test only
+func registerTestChunkedCipher(t *testing.T, name string) {
+	t.Helper()
+	if err := RegisterChunkedCipher(name, 16, newTestAesGcm16); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		chunkedCipherSuitesMutex.Lock()
+		defer chunkedCipherSuitesMutex.Unlock()
+		delete(chunkedCipherSuites, name)
+	})
+}
+
+func TestRegisterChunkedCipher(t *testing.T) {
+	registerTestChunkedCipher(t, "test-aes-gcm-16")
+	tests := []struct {
+		name      string
+		suiteName string
+		nonceSize int
+		newAead   func(key []byte) (cipher.AEAD, error)
+		wantErr   error
+	}{
+		{"duplicate", "test-aes-gcm-16", 16, newTestAesGcm16, ErrChunkedCipherExists},
+		// built in names can not be replaced, files of the built in suites would no longer decrypt
+		{"gcm", CIPHER_AES_GCM, 16, newTestAesGcm16, ErrChunkedCipherExists},
+		{"chacha20-poly1305", CIPHER_CHACHA20_POLY1305, 16, newTestAesGcm16, ErrChunkedCipherExists},
+		{"ctr", CIPHER_AES_CTR, 16, newTestAesGcm16, ErrChunkedCipherExists},
+		{"none", CIPHER_NONE, 16, newTestAesGcm16, ErrChunkedCipherExists},
+		{"empty name", "", 16, newTestAesGcm16, ErrBadChunkedCipher},
+		{"no nonce", "test-no-nonce", 0, newTestAesGcm16, ErrBadChunkedCipher},
+		{"no aead", "test-no-aead", 16, nil, ErrBadChunkedCipher},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := getChunkedCipherSuite(test.suiteName)
+			if err := RegisterChunkedCipher(test.suiteName, test.nonceSize, test.newAead); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			// refused suites leave the registry unchanged
+			if after := getChunkedCipherSuite(test.suiteName); after != before {
+				t.Fatal("a refused suite was registered")
+			}
+		})
+	}
+}
+
+func TestRegisteredChunkedCipherRoundTrip(t *testing.T) {
+	const suiteName = "test-aes-gcm-16"
+	registerTestChunkedCipher(t, suiteName)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one chunk", CONTENT_CHUNK_SIZE},
+		{"partial chunk", 2*CONTENT_CHUNK_SIZE + 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(suiteName); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.SelfTest(""); err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(test.size)
+			writeTestFile(t, encFs, "/file", data)
+			checkTestFile(t, encFs, "/file", data)
+
+			// the cipher is read from the meta file, not from the default of the reader
+			reader := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			checkTestFile(t, reader, "/file", data)
+			// names are not encrypted by a key without name mapper
+			encFileMeta, _, err := reader.readFileMeta("/file")
+			if err != nil || encFileMeta.Cipher != suiteName {
+				t.Fatalf("got meta %+v: %v", encFileMeta, err)
+			}
+			// every chunk has a 16 bytes nonce and tag
+			_, encryptedChunkSize := chunkedTestLayout(t, reader, "/file")
+			if encryptedChunkSize != CONTENT_CHUNK_SIZE+16+CHUNK_TAG_SIZE {
+				t.Fatalf("got encrypted chunk size %d", encryptedChunkSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package encfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+type CloneOptions struct {
+	// Root is the plaintext directory cloned, "/" when empty
+	Root string
+	// RandomSource replaces the random source of the clone, a deterministic reader makes clones reproducible
+	RandomSource io.Reader
+}
+
+type CloneReport struct {
+	DirCount          int `json:"dir_count"`
+	FileCount         int `json:"file_count"`
+	SymlinkCount      int `json:"symlink_count"`
+	SkippedCount      int `json:"skipped_count"`
+	JournalEventCount int `json:"journal_event_count"`
+}
+
+type clonedDir struct {
+	encryptedName string
+	modTime       time.Time
+}
+
+// CloneVolume copies the volume of src to the backend dst re-encrypted under newKey with new IVs, directories,
+// permissions, modification times, ciphers and size padding of every file and the change journal with its
+// generations are kept, dst uses the policies of src, special files are skipped
+func CloneVolume(src *EncFs, dst afero.Fs, newKey *EncryptionMasterKey, options *CloneOptions) (*CloneReport, error) {
+	if options == nil {
+		options = &CloneOptions{}
+	}
+	root := options.Root
+	if root == "" {
+		root = "/"
+	}
+	dstFs := src.cloneSettings(newKey, dst)
+	if options.RandomSource != nil {
+		if err := dstFs.WithRandomSource(options.RandomSource); err != nil {
+			return nil, err
+		}
+	}
+	rootInfo, err := src.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := dstFs.MkdirAll(root, rootInfo.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	report := &CloneReport{}
+	plainDirs := make(map[string]string)
+	// directory times are set after their entries were created
+	clonedDirs := make([]clonedDir, 0)
+	err = src.walkEncryptedInternal(root, true, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if plainName == "" {
+			if fileInfo.Name() != CHANGE_JOURNAL_FILE_NAME {
+				return nil
+			}
+			eventCount, err := src.cloneChangeJournal(dstFs, encryptedName, plainDirs[filepath.Dir(encryptedName)])
+			report.JournalEventCount += eventCount
+			return err
+		}
+		switch {
+		case fileInfo.IsDir():
+			plainDirs[encryptedName] = plainName
+			if plainName != root {
+				if err := dstFs.Mkdir(plainName, fileInfo.Mode().Perm()); err != nil {
+					return err
+				}
+				report.DirCount++
+			}
+			clonedDirs = append(clonedDirs, clonedDir{dstFs.encryptFileName(plainName), fileInfo.ModTime()})
+		case fileInfo.Mode()&os.ModeSymlink != 0:
+			target, err := src.ReadlinkIfPossible(plainName)
+			if err != nil {
+				return err
+			}
+			if err := dstFs.SymlinkIfPossible(target, plainName); err != nil {
+				return err
+			}
+			report.SymlinkCount++
+		case fileInfo.Mode().IsRegular():
+			if err := src.cloneFile(dstFs, plainName, encryptedName, fileInfo); err != nil {
+				return err
+			}
+			report.FileCount++
+		default:
+			report.SkippedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for i := len(clonedDirs) - 1; i >= 0; i-- {
+		if err := dst.Chtimes(clonedDirs[i].encryptedName, clonedDirs[i].modTime, clonedDirs[i].modTime); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// cloneSettings returns an EncFs of key and base with the policies and defaults for new files of encFs
+func (encFs *EncFs) cloneSettings(key *EncryptionMasterKey, base afero.Fs) *EncFs {
+	cloneFs := newEncFs(key, base)
+	cloneFs.retryPolicy = encFs.retryPolicy
+	cloneFs.symlinkPolicy = encFs.symlinkPolicy
+	cloneFs.specialFilePolicy = encFs.specialFilePolicy
+	cloneFs.contentCipher = encFs.contentCipher
+	cloneFs.caseInsensitive = encFs.caseInsensitive
+	cloneFs.durabilityPolicy = encFs.durabilityPolicy
+	cloneFs.writeBufferSize = encFs.writeBufferSize
+	cloneFs.fileFormat = encFs.fileFormat
+	cloneFs.integrityTags = encFs.integrityTags
+	cloneFs.openFlagsPolicy = encFs.openFlagsPolicy
+	cloneFs.sizePadding = encFs.sizePadding
+	cloneFs.sizePaddingBlockSize = encFs.sizePaddingBlockSize
+	cloneFs.strictMetadata = encFs.strictMetadata
+	cloneFs.passthroughPatterns = encFs.passthroughPatterns
+	cloneFs.keystreamParallelism = encFs.keystreamParallelism
+	cloneFs.readAheadChunks = encFs.readAheadChunks
+	if encFs.blockCache != nil {
+		// cached blocks are decrypted with the key of encFs, clones get an empty cache of the same size
+		cloneFs.blockCache = newBlockCache(encFs.blockCache.blockSize, encFs.blockCache.maxBlocks)
+	}
+	return cloneFs
+}
+
+// cloneFile re-encrypts a file like Rekey with the cipher, chunk size, format and padding of its meta, files
+// without meta are not encrypted and are copied through dstFs
+func (encFs *EncFs) cloneFile(dstFs *EncFs, plainName, encryptedName string, fileInfo os.FileInfo) error {
+	encFileMeta, headerSize, err := encFs.readFileMeta(encryptedName)
+	if err != nil {
+		return err
+	}
+	if encFileMeta == nil {
+		return encFs.copyFile(dstFs, plainName, fileInfo)
+	}
+	iv := make([]byte, 16)
+	if err := dstFs.readRandom(iv); err != nil {
+		return err
+	}
+	newEncFileMeta := &EncFileMeta{
+		Magic:            ENC_FILE_META_MAGIC,
+		Version:          ENC_FILE_META_VERSION,
+		Iv:               iv,
+		Cipher:           encFileMeta.Cipher,
+		ChunkSize:        encFileMeta.ChunkSize,
+		KeyId:            dstFs.key.KeyId(),
+		Padding:          encFileMeta.Padding,
+		PaddingBlockSize: encFileMeta.PaddingBlockSize,
+	}
+	if newEncFileMeta.isPadded() {
+		newEncFileMeta.setFlag(META_FLAG_PADDING)
+	}
+	newEncFileMeta.applyFinalChunk()
+	dstFs.applySubkeys(newEncFileMeta)
+	newEncFileMeta.hasCopy = dstFs.metaCopy
+	dstFs.applyEncryptedMeta(newEncFileMeta)
+	dstName := dstFs.encryptFileName(plainName)
+	if err := dstFs.recordFileName(plainName, dstName); err != nil {
+		return err
+	}
+	if err := encFs.rekeyFileContent(dstFs, encryptedName, dstName, newEncFileMeta, headerSize, fileInfo); err != nil {
+		return err
+	}
+	if !newEncFileMeta.isChunked() {
+		if _, err := encFs.base.Stat(encryptedName + INTEGRITY_FILE_SUFFIX); err == nil {
+			if err := dstFs.writeIntegrityTags(dstName, dstName, newEncFileMeta, headerSize); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if headerSize == 0 {
+		tempName, err := newEncFileMetaTempName(dstFs, dstName)
+		if err != nil {
+			return err
+		}
+		if err := writeEncFileMeta(dstFs.base, tempName, newEncFileMeta); err != nil {
+			_ = dstFs.base.Remove(tempName)
+			return err
+		}
+		if err := renameEncFileMeta(dstFs.base, tempName, dstFs.encFileMetaName(dstName)); err != nil {
+			return err
+		}
+	}
+	if err := dstFs.base.Chmod(dstName, fileInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return dstFs.base.Chtimes(dstName, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+func (encFs *EncFs) copyFile(dstFs *EncFs, plainName string, fileInfo os.FileInfo) error {
+	srcFile, err := encFs.Open(plainName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	dstFile, err := dstFs.OpenFile(plainName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		_ = dstFile.Close()
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+	return dstFs.Chtimes(plainName, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+// cloneChangeJournal re-encrypts the events of the journal encryptedName of the plaintext directory plainDir,
+// generations, times and file ids are kept so sync cursors stay valid on the clone
+func (encFs *EncFs) cloneChangeJournal(dstFs *EncFs, encryptedName, plainDir string) (int, error) {
+	journal := &changeJournal{
+		fs:   encFs.base,
+		name: encryptedName,
+		key:  hkdfSha256(encFs.key.key, nil, []byte(CHANGE_JOURNAL_KEY_INFO), 32),
+	}
+	dstJournal := &changeJournal{
+		fs:   dstFs.base,
+		name: filepath.Join(dstFs.encryptFileName(plainDir), CHANGE_JOURNAL_FILE_NAME),
+		key:  hkdfSha256(dstFs.key.key, nil, []byte(CHANGE_JOURNAL_KEY_INFO), 32),
+	}
+	if err := dstFs.base.Remove(dstJournal.name); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	eventCount := 0
+	err := journal.read(func(event *ChangeEvent) error {
+		eventCount++
+		return dstJournal.write(dstFs, event)
+	})
+	return eventCount, err
+}
@@ -0,0 +1,241 @@
+package encfs
+
+import (
+	"bytes"
+	mathrand "math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestCloneVolume(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"ctr integrity tags", func(encFs *EncFs) error {
+			encFs.WithIntegrityTags(true)
+			return nil
+		}},
+		{"padded gcm", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}},
+		{"hmac names", nil},
+	}
+	files := map[string][]byte{
+		"/c":          testPattern(100),
+		"/empty":      {},
+		"/dir/a":      testPattern(3*CONTENT_CHUNK_SIZE + 17),
+		"/dir/sub/b":  []byte("data"),
+		"/dir/sub/b2": testPattern(5000),
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var src *EncFs
+			if test.setup == nil {
+				src, _ = newTestHmacEncFs()
+			} else {
+				src, _ = newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := test.setup(src); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := src.MkdirAll("/dir/sub", 0750); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range files {
+				writeTestFile(t, src, name, data)
+				if err := src.Chmod(name, 0640); err != nil {
+					t.Fatal(err)
+				}
+				if err := src.Chtimes(name, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"/dir/sub", "/dir"} {
+				if err := src.Chtimes(name, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := afero.NewMemMapFs()
+			newKey := NewEncryptionMasterKey(testKeyBytes(2))
+			report, err := CloneVolume(src, dst, newKey, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantReport := CloneReport{DirCount: 2, FileCount: len(files)}
+			if *report != wantReport {
+				t.Fatalf("got report %+v, want %+v", *report, wantReport)
+			}
+			// the clone is read by the new key only, it keeps contents, modes and times
+			clone := NewEncFsWithBackend(newKey, dst).(*EncFs)
+			if test.setup != nil {
+				// header format files are only read by an EncFs configured for them
+				if err := test.setup(clone); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, data := range files {
+				checkTestFile(t, clone, name, data)
+				fileInfo, err := clone.Stat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fileInfo.Size() != int64(len(data)) || fileInfo.Mode().Perm() != 0640 ||
+					!fileInfo.ModTime().Equal(modTime) {
+					t.Fatalf("%s: got size %d, mode %v and time %v", name, fileInfo.Size(), fileInfo.Mode(),
+						fileInfo.ModTime())
+				}
+			}
+			for _, name := range []string{"/dir", "/dir/sub"} {
+				fileInfo, err := clone.Stat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !fileInfo.IsDir() || fileInfo.Mode().Perm() != 0750 || !fileInfo.ModTime().Equal(modTime) {
+					t.Fatalf("%s: got mode %v and time %v", name, fileInfo.Mode(), fileInfo.ModTime())
+				}
+			}
+			// new IVs give other ciphertext, the clone holds no plaintext
+			srcSnapshot, dstSnapshot := snapshotTestFs(t, src.base), snapshotTestFs(t, dst)
+			for name, contents := range dstSnapshot {
+				if len(contents) > 16 && srcSnapshot[name] == contents {
+					t.Fatalf("%s is the same in the clone", name)
+				}
+				if bytes.Contains([]byte(contents), testPattern(100)) {
+					t.Fatalf("%s holds plaintext", name)
+				}
+			}
+			oldKey := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), dst)
+			if data, err := afero.ReadFile(oldKey, "/c"); err == nil && bytes.Equal(data, files["/c"]) {
+				t.Fatal("the old key reads the clone")
+			}
+		})
+	}
+}
+
+func TestCloneVolumeOptions(t *testing.T) {
+	src, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if err := src.WithChangeJournal("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.WithPassthroughPatterns([]string{"*.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, src, "/dir/a", []byte("a"))
+	writeTestFile(t, src, "/dir/sub/b", []byte("b"))
+	writeTestFile(t, src, "/dir/photo.jpg", []byte("photo"))
+	writeTestFile(t, src, "/other", []byte("other"))
+	srcChanges, _, err := src.ChangesSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		options    *CloneOptions
+		wantReport CloneReport
+		wantFiles  []string
+		wantNone   []string
+	}{
+		{"volume", nil, CloneReport{DirCount: 2, FileCount: 4, JournalEventCount: len(srcChanges)},
+			[]string{"/dir/a", "/dir/sub/b", "/dir/photo.jpg", "/other"}, nil},
+		{"root", &CloneOptions{Root: "/dir"}, CloneReport{DirCount: 1, FileCount: 3},
+			[]string{"/dir/a", "/dir/sub/b", "/dir/photo.jpg"}, []string{"/other"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := afero.NewMemMapFs()
+			newKey := NewEncryptionMasterKey(testKeyBytes(2))
+			report, err := CloneVolume(src, dst, newKey, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *report != test.wantReport {
+				t.Fatalf("got report %+v, want %+v", *report, test.wantReport)
+			}
+			clone := NewEncFsWithBackend(newKey, dst).(*EncFs)
+			for _, name := range test.wantFiles {
+				checkTestFile(t, clone, name, readTestFile(t, src, name))
+			}
+			for _, name := range test.wantNone {
+				if _, err := clone.Stat(name); !os.IsNotExist(err) {
+					t.Fatalf("%s: got %v, want not exist", name, err)
+				}
+			}
+			// passthrough files stay plain in the clone
+			checkTestFile(t, dst, "/dir/photo.jpg", []byte("photo"))
+			if test.wantReport.JournalEventCount == 0 {
+				return
+			}
+			// generations and file ids are kept, the journal continues on the clone
+			if err := clone.WithChangeJournal("/"); err != nil {
+				t.Fatal(err)
+			}
+			changes, _, err := clone.ChangesSince(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != len(srcChanges) {
+				t.Fatalf("got %d changes, want %d", len(changes), len(srcChanges))
+			}
+			for i := range changes {
+				if changes[i].Generation != srcChanges[i].Generation || changes[i].FileId != srcChanges[i].FileId ||
+					changes[i].Path != srcChanges[i].Path {
+					t.Fatalf("got change %+v, want %+v", changes[i], srcChanges[i])
+				}
+			}
+			if err := clone.Remove("/other"); err != nil {
+				t.Fatal(err)
+			}
+			changes, _, err = clone.ChangesSince(srcChanges[len(srcChanges)-1].Generation, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 1 || changes[0].Generation != srcChanges[len(srcChanges)-1].Generation+1 {
+				t.Fatalf("got changes %+v after the clone", changes)
+			}
+		})
+	}
+}
+
+func TestCloneVolumeRandomSource(t *testing.T) {
+	src, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, src, "/file", testPattern(5000))
+	// the same seeded source gives the same clone
+	var snapshots []map[string]string
+	for i := 0; i < 2; i++ {
+		dst := afero.NewMemMapFs()
+		options := &CloneOptions{RandomSource: mathrand.New(mathrand.NewSource(1))}
+		if _, err := CloneVolume(src, dst, NewEncryptionMasterKey(testKeyBytes(2)), options); err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, snapshotTestFs(t, dst))
+	}
+	if len(snapshots[0]) == 0 || !equalTestSnapshots(snapshots[0], snapshots[1]) {
+		t.Fatal("seeded sources gave other clones")
+	}
+	if _, err := CloneVolume(src, afero.NewMemMapFs(), NewEncryptionMasterKey(testKeyBytes(2)),
+		&CloneOptions{Root: "/missing"}); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+}
@@ -0,0 +1,458 @@
+package encfs
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const CONTENT_CHUNK_SIZE = 64 * 1024
+
+var (
+	ErrUnsupportedCipher   = errors.New("unsupported cipher")
+	ErrWriteAtInAppendMode = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+)
+
+// WithContentCipher selects the cipher of files created afterwards, CIPHER_AES_CTR (default), CIPHER_AES_GCM
+// or another chunked cipher, existing files keep the cipher recorded in their meta file
+func (encFs *EncFs) WithContentCipher(contentCipher string) error {
+	if !isSupportedContentCipher(contentCipher) {
+		return ErrUnsupportedCipher
+	}
+	encFs.contentCipher = contentCipher
+	return nil
+}
+
+// newFileCipher returns the cipher of new files, empty for CIPHER_AES_CTR
+func (encFs *EncFs) newFileCipher() string {
+	contentCipher := encFs.contentCipher
+	if contentCipher == "" && encFs.key != nil {
+		contentCipher = encFs.key.contentCipher
+	}
+	if contentCipher == CIPHER_AES_CTR {
+		return ""
+	}
+	return contentCipher
+}
+
+func (encFileMeta *EncFileMeta) cipher() string {
+	if encFileMeta.Cipher == "" {
+		return CIPHER_AES_CTR
+	}
+	return encFileMeta.Cipher
+}
+
+func (encFileMeta *EncFileMeta) isChunked() bool {
+	return encFileMeta != nil && encFileMeta.Cipher != "" && getChunkedCipherSuite(encFileMeta.Cipher) != nil
+}
+
+// applyFinalChunk marks the last chunk of a new chunked file in its additional data
+func (encFileMeta *EncFileMeta) applyFinalChunk() {
+	if encFileMeta.isChunked() {
+		encFileMeta.setFlag(META_FLAG_FINAL_CHUNK)
+	}
+}
+
+func (encFileMeta *EncFileMeta) chunkSize() int64 {
+	if encFileMeta.ChunkSize > 0 {
+		return int64(encFileMeta.ChunkSize)
+	}
+	return CONTENT_CHUNK_SIZE
+}
+
+func (encFileMeta *EncFileMeta) chunkOverhead() int64 {
+	return int64(getChunkedCipherSuite(encFileMeta.Cipher).nonceSize + CHUNK_TAG_SIZE)
+}
+
+// logicalSize returns the plaintext size of a file with encryptedSize bytes on disk
+func (encFileMeta *EncFileMeta) logicalSize(encryptedSize int64) int64 {
+	if !encFileMeta.isChunked() {
+		return encryptedSize
+	}
+	chunkSize := encFileMeta.chunkSize()
+	chunkOverhead := encFileMeta.chunkOverhead()
+	encryptedChunkSize := chunkSize + chunkOverhead
+	size := (encryptedSize / encryptedChunkSize) * chunkSize
+	if lastChunkSize := encryptedSize % encryptedChunkSize; lastChunkSize > chunkOverhead {
+		size += lastChunkSize - chunkOverhead
+	}
+	return size
+}
+
+// contentOpenFlag makes chunked and header format files readable and drops O_APPEND since they are
+// written with ReadAt and WriteAt, append and write only are handled by EncFile instead, CTR files keep
+// write only but never O_APPEND, the backend would append at an offset the keystream does not know
+func (encFs *EncFs) contentOpenFlag(name string, flag int) int {
+	if flag&(os.O_WRONLY|os.O_APPEND) == 0 {
+		return flag
+	}
+	needsRead := encFs.newFileCipher() != "" || encFs.fileFormat == FILE_FORMAT_HEADER
+	if encFileMeta, err := openEncFileMeta(encFs, encFs.base, name); err == nil && encFileMeta != nil {
+		needsRead = encFileMeta.isChunked()
+	} else if _, err := encFs.base.Stat(name); err == nil && encFs.readsHeaders() {
+		// files without meta file may start with a header
+		needsRead = true
+	}
+	if !needsRead {
+		return flag &^ os.O_APPEND
+	}
+	return flag&^(os.O_WRONLY|os.O_APPEND) | os.O_RDWR
+}
+
+// emulateOpenFlags applies O_APPEND and O_WRONLY which contentOpenFlag dropped from baseFlag, the position of
+// append handles starts at the end of file and every write moves it there again
+func (f *EncFile) emulateOpenFlags(flag, baseFlag int) error {
+	if baseFlag != flag {
+		f.appendMode = flag&os.O_APPEND != 0
+		f.writeOnly = flag&os.O_WRONLY != 0
+	}
+	if !f.appendMode || f.encFileMeta == nil {
+		return nil
+	}
+	_, err := f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// chunk layout on disk: nonce || ciphertext || tag(16), the file IV and chunk index are
+// authenticated so chunks can not be swapped, files with META_FLAG_FINAL_CHUNK also authenticate whether a chunk is
+// the last one like STREAM, so cutting a file at a chunk boundary fails the read of its new last chunk
+func (f *EncFile) chunkAead() (cipher.AEAD, error) {
+	if f.cachedChunkAead == nil {
+		aead, err := getChunkedCipherSuite(f.encFileMeta.Cipher).newAead(f.contentKey())
+		if err != nil {
+			return nil, err
+		}
+		f.cachedChunkAead = aead
+	}
+	return f.cachedChunkAead, nil
+}
+
+// chunkAdditionalData returns IV || index || final || header, final is left out of files written before
+// META_FLAG_FINAL_CHUNK and header is the one of header format files binding it
+func (f *EncFile) chunkAdditionalData(index int64, final bool) ([]byte, error) {
+	additionalData := make([]byte, len(f.encFileMeta.Iv)+8, len(f.encFileMeta.Iv)+9+ENC_FILE_HEADER_SIZE)
+	copy(additionalData, f.encFileMeta.Iv)
+	binary.BigEndian.PutUint64(additionalData[len(f.encFileMeta.Iv):], uint64(index))
+	if f.encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK) {
+		finalByte := byte(0)
+		if final {
+			finalByte = 1
+		}
+		additionalData = append(additionalData, finalByte)
+	}
+	if f.encFileMeta.bindsHeader(f.headerSize) {
+		header, err := f.encFileMeta.headerBytes()
+		if err != nil {
+			return nil, err
+		}
+		additionalData = append(additionalData, header...)
+	}
+	return additionalData, nil
+}
+
+func (f *EncFile) encryptedChunkSize() int64 {
+	return f.encFileMeta.chunkSize() + f.encFileMeta.chunkOverhead()
+}
+
+// chunkCount returns the number of chunks on disk, the last one may be short
+func (f *EncFile) chunkCount() (int64, error) {
+	fileInfo, err := callWithRetry(f.encFs, retryIdempotent, "stat", f.file.Name(), func() (os.FileInfo, error) {
+		return f.file.Stat()
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	encryptedSize := fileInfo.Size() - f.headerSize
+	if encryptedSize <= 0 {
+		return 0, nil
+	}
+	return (encryptedSize + f.encryptedChunkSize() - 1) / f.encryptedChunkSize(), nil
+}
+
+// readChunk returns the plaintext of chunk index, io.EOF is returned after the last chunk, a byte more is read to
+// tell whether the chunk is the last one
+func (f *EncFile) readChunk(index int64) ([]byte, error) {
+	encryptedChunkSize := f.encryptedChunkSize()
+	encryptedChunk := make([]byte, encryptedChunkSize+1)
+	readLen, err := f.readBackendAt(encryptedChunk, f.headerSize+index*encryptedChunkSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if readLen == 0 {
+		return nil, io.EOF
+	}
+	final := int64(readLen) <= encryptedChunkSize
+	if !final {
+		readLen = int(encryptedChunkSize)
+	}
+	if int64(readLen) <= f.encFileMeta.chunkOverhead() {
+		return nil, &os.PathError{Op: "read", Path: f.Name(), Err: ErrDecryptFailed}
+	}
+	aead, err := f.chunkAead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := encryptedChunk[:aead.NonceSize()]
+	sealed := encryptedChunk[aead.NonceSize():readLen]
+	additionalData, err := f.chunkAdditionalData(index, final)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil && !final && f.encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK) {
+		// a crash while appending leaves the former last chunk final, it is not the end of the file still
+		additionalData, _ = f.chunkAdditionalData(index, true)
+		chunk, err = aead.Open(nil, nonce, sealed, additionalData)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: f.Name(), Err: ErrDecryptFailed}
+	}
+	f.encFs.countCipherBytes(false, f.encFileMeta.Cipher, len(chunk))
+	return chunk, nil
+}
+
+// writeChunk seals chunk index with a fresh random nonce, nonces are never reused on rewrite, final is set for the
+// last chunk of the file
+func (f *EncFile) writeChunk(index int64, chunk []byte, final bool) error {
+	encryptedChunk, err := f.sealChunk(index, chunk, final)
+	if err != nil {
+		return err
+	}
+	_, err = callWithRetry(f.encFs, retryWrite, "write", f.file.Name(), func() (int, error) {
+		return f.file.WriteAt(encryptedChunk, f.headerSize+index*f.encryptedChunkSize())
+	}, nil)
+	chunkSize := f.encFileMeta.chunkSize()
+	f.invalidateBlockCache(index*chunkSize, chunkSize)
+	return err
+}
+
+func (f *EncFile) sealChunk(index int64, chunk []byte, final bool) ([]byte, error) {
+	aead, err := f.chunkAead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if err := f.encFs.readRandom(nonce); err != nil {
+		return nil, err
+	}
+	additionalData, err := f.chunkAdditionalData(index, final)
+	if err != nil {
+		return nil, err
+	}
+	f.encFs.countCipherBytes(true, f.encFileMeta.Cipher, len(chunk))
+	return aead.Seal(nonce, nonce, chunk, additionalData), nil
+}
+
+// contentSize returns the plaintext size of the file
+func (f *EncFile) contentSize() (int64, error) {
+	fileInfo, err := callWithRetry(f.encFs, retryIdempotent, "stat", f.file.Name(), func() (os.FileInfo, error) {
+		return f.file.Stat()
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	size := logicalSizeOf(f.encFileMeta, f.headerSize, fileInfo.Size())
+	if f.encFileMeta.isPadded() {
+		return f.paddedContentSize(size)
+	}
+	return size, nil
+}
+
+func (f *EncFile) readChunkedAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if f.encFileMeta.isPadded() {
+		// the padding after the contents is never returned
+		size, err := f.contentSize()
+		if err != nil {
+			return 0, err
+		}
+		if off >= size {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > size-off {
+			n, err := f.readChunksAt(p[:size-off], off)
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+	return f.readChunksAt(p, off)
+}
+
+// readChunksAt reads the chunks covering p at off, including the padding of padded files
+func (f *EncFile) readChunksAt(p []byte, off int64) (int, error) {
+	chunkSize := f.encFileMeta.chunkSize()
+	n := 0
+	for n < len(p) {
+		index := (off + int64(n)) / chunkSize
+		chunkOffset := int((off + int64(n)) % chunkSize)
+		chunk, err := f.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+		if chunkOffset >= len(chunk) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], chunk[chunkOffset:])
+	}
+	return n, nil
+}
+
+func (f *EncFile) writeChunkedAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	size, err := f.contentSize()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.ensureHeader(); err != nil {
+		return 0, err
+	}
+	if off > size {
+		// chunks before off must be complete, the gap is filled with zeros
+		if err := f.fillChunked(size, off); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.updateChunks(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, f.writeSizePadding(size, off+int64(n))
+}
+
+func (f *EncFile) fillChunked(from, to int64) error {
+	chunkSize := f.encFileMeta.chunkSize()
+	zeros := make([]byte, chunkSize)
+	for from < to {
+		fillLen := chunkSize - from%chunkSize
+		if fillLen > to-from {
+			fillLen = to - from
+		}
+		if _, err := f.updateChunks(zeros[:fillLen], from); err != nil {
+			return err
+		}
+		from += fillLen
+	}
+	return nil
+}
+
+// updateChunks rewrites the chunks covering p at off, off must not be after the end of file, the former last chunk
+// is sealed again as not final once chunks are appended after it
+func (f *EncFile) updateChunks(p []byte, off int64) (int, error) {
+	chunkSize := f.encFileMeta.chunkSize()
+	chunkCount, err := f.chunkCount()
+	if err != nil {
+		return 0, err
+	}
+	lastIndex := chunkCount - 1
+	if len(p) > 0 && (off+int64(len(p))-1)/chunkSize > lastIndex {
+		lastIndex = (off + int64(len(p)) - 1) / chunkSize
+	}
+	n := 0
+	for n < len(p) {
+		index := (off + int64(n)) / chunkSize
+		chunkOffset := int((off + int64(n)) % chunkSize)
+		updateLen := len(p) - n
+		if updateLen > int(chunkSize)-chunkOffset {
+			updateLen = int(chunkSize) - chunkOffset
+		}
+		var chunk []byte
+		if chunkOffset > 0 || updateLen < int(chunkSize) {
+			existingChunk, err := f.readChunk(index)
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			chunk = existingChunk
+		}
+		if len(chunk) < chunkOffset+updateLen {
+			chunk = append(chunk, make([]byte, chunkOffset+updateLen-len(chunk))...)
+		}
+		copy(chunk[chunkOffset:], p[n:n+updateLen])
+		if err := f.writeChunk(index, chunk, index == lastIndex); err != nil {
+			return n, err
+		}
+		n += updateLen
+	}
+	// the new chunks are written first, a crash leaves a readable file
+	if formerLastIndex := chunkCount - 1; formerLastIndex >= 0 && formerLastIndex < off/chunkSize &&
+		lastIndex > formerLastIndex && f.encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK) {
+		chunk, err := f.readChunk(formerLastIndex)
+		if err != nil {
+			return n, err
+		}
+		if err := f.writeChunk(formerLastIndex, chunk, false); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (f *EncFile) truncateChunked(size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	currentSize, err := f.contentSize()
+	if err != nil {
+		return err
+	}
+	if size >= currentSize {
+		if err := f.fillChunked(currentSize, size); err != nil {
+			return err
+		}
+		return f.writeSizePadding(currentSize, size)
+	}
+	if f.encFileMeta.isPadded() {
+		return f.truncatePadded(size)
+	}
+	return f.truncateChunks(size)
+}
+
+// truncateChunks cuts the chunks at size, the last chunk is sealed again
+func (f *EncFile) truncateChunks(size int64) error {
+	encryptedSize := int64(0)
+	if size > 0 {
+		chunkSize := f.encFileMeta.chunkSize()
+		index := (size - 1) / chunkSize
+		keepLen := size - index*chunkSize
+		chunk, err := f.readChunk(index)
+		if err != nil {
+			return err
+		}
+		if err := f.writeChunk(index, chunk[:keepLen], true); err != nil {
+			return err
+		}
+		encryptedSize = index*f.encryptedChunkSize() + keepLen + f.encFileMeta.chunkOverhead()
+	}
+	return callErrWithRetry(f.encFs, retryIdempotent, "truncate", f.file.Name(), func() error {
+		return f.file.Truncate(f.headerSize + encryptedSize)
+	})
+}
+
+func (f *EncFile) seekChunked(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.filePos
+	case io.SeekEnd:
+		size, err := f.contentSize()
+		if err != nil {
+			return 0, err
+		}
+		base = size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if base+offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	f.filePos = base + offset
+	return f.filePos, nil
+}
@@ -0,0 +1,152 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// chunkedTestLayout returns the header size and encrypted chunk size of name
+func chunkedTestLayout(t *testing.T, encFs *EncFs, name string) (int64, int64) {
+	t.Helper()
+	f, err := encFs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	encFile := f.(*EncFile)
+	return encFile.headerSize, encFile.encryptedChunkSize()
+}
+
+func TestChunkedTruncation(t *testing.T) {
+	const chunkSize = CONTENT_CHUNK_SIZE
+	formats := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"xchacha20", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_XCHACHA20_POLY1305) }},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"gcm write buffer", func(encFs *EncFs) error {
+			encFs.WithWriteBufferSize(4096)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+	}
+	writes := []struct {
+		name string
+		// write writes the file and returns its contents
+		write func(t *testing.T, encFs *EncFs) []byte
+	}{
+		{"one write", func(t *testing.T, encFs *EncFs) []byte {
+			data := testPattern(3*chunkSize + 100)
+			writeTestFile(t, encFs, "/file", data)
+			return data
+		}},
+		// the last chunk is full
+		{"whole chunks", func(t *testing.T, encFs *EncFs) []byte {
+			data := testPattern(2 * chunkSize)
+			writeTestFile(t, encFs, "/file", data)
+			return data
+		}},
+		// the former last chunk is sealed again as not final
+		{"appended", func(t *testing.T, encFs *EncFs) []byte {
+			data := testPattern(3*chunkSize + 10)
+			writeTestFile(t, encFs, "/file", data[:chunkSize])
+			writeTestAppend(t, encFs, "/file", data[chunkSize:chunkSize+10])
+			writeTestAppend(t, encFs, "/file", data[chunkSize+10:])
+			return data
+		}},
+		{"truncated", func(t *testing.T, encFs *EncFs) []byte {
+			data := testPattern(3*chunkSize + 100)
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(2 * chunkSize); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			return data[:2*chunkSize]
+		}},
+		{"extended by truncate", func(t *testing.T, encFs *EncFs) []byte {
+			data := testPattern(chunkSize + 5)
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(3 * chunkSize); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			return append(data, make([]byte, 2*chunkSize-5)...)
+		}},
+	}
+	for _, format := range formats {
+		for _, write := range writes {
+			t.Run(format.name+" "+write.name, func(t *testing.T) {
+				encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := format.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				data := write.write(t, encFs)
+				checkTestFile(t, encFs, "/file", data)
+
+				headerSize, encryptedChunkSize := chunkedTestLayout(t, encFs, "/file")
+				encrypted := readTestFile(t, base, "/file")
+				for cut := headerSize + encryptedChunkSize; cut < int64(len(encrypted)); cut += encryptedChunkSize {
+					writeTestFile(t, base, "/file", encrypted[:cut])
+					if _, err := afero.ReadFile(encFs, "/file"); !errors.Is(err, ErrDecryptFailed) {
+						t.Fatalf("cut at %d: got %v, want %v", cut, err, ErrDecryptFailed)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChunkedWithoutFinalChunkFlag(t *testing.T) {
+	// files written before META_FLAG_FINAL_CHUNK do not authenticate their last chunk
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/file", nil)
+	encFileMeta, _, err := encFs.readFileMeta("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encFileMeta.Flags, encFileMeta.Version = nil, ENC_FILE_META_VERSION
+	if err := writeEncFileMeta(base, encFs.encFileMetaName("/file"), encFileMeta); err != nil {
+		t.Fatal(err)
+	}
+	encFs.forgetCachedEncFileMetas("/file")
+	data := testPattern(2*CONTENT_CHUNK_SIZE + 10)
+	f, err := encFs.OpenFile("/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/file", data)
+	_, encryptedChunkSize := chunkedTestLayout(t, encFs, "/file")
+	encrypted := readTestFile(t, base, "/file")
+	writeTestFile(t, base, "/file", encrypted[:2*encryptedChunkSize])
+	checkTestFile(t, encFs, "/file", data[:2*CONTENT_CHUNK_SIZE])
+}
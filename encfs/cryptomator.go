@@ -0,0 +1,840 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	CRYPTOMATOR_VAULT_FILE_NAME      = "vault.cryptomator"
+	CRYPTOMATOR_MASTERKEY_FILE_NAME  = "masterkey.cryptomator"
+	CRYPTOMATOR_VAULT_FORMAT         = 8
+	CRYPTOMATOR_CIPHER_COMBO_SIV_GCM = "SIV_GCM"
+
+	CRYPTOMATOR_NAME_EXT       = ".c9r"
+	CRYPTOMATOR_SHORT_NAME_EXT = ".c9s"
+	CRYPTOMATOR_DIR_FILE       = "dir.c9r"
+	CRYPTOMATOR_SYMLINK_FILE   = "symlink.c9r"
+	CRYPTOMATOR_CONTENTS_FILE  = "contents.c9r"
+	CRYPTOMATOR_LONG_NAME_FILE = "name.c9s"
+
+	cryptomatorMasterkeyKidPrefix = "masterkeyfile:"
+	cryptomatorHeaderNonceSize    = 12
+	// nonce(12) || AES-GCM(reserved(8) || content key(32)) || tag(16)
+	cryptomatorHeaderSize      = cryptomatorHeaderNonceSize + 8 + 32 + 16
+	cryptomatorChunkSize       = 32 * 1024
+	cryptomatorChunkNonceSize  = 12
+	cryptomatorChunkTagSize    = 16
+	cryptomatorCipherChunkSize = cryptomatorChunkNonceSize + cryptomatorChunkSize + cryptomatorChunkTagSize
+	cryptomatorMaxSymlinkHops  = 40
+)
+
+var (
+	ErrCryptomatorVaultBroken       = errors.New("cryptomator vault is broken")
+	ErrCryptomatorWrongPassphrase   = errors.New("cryptomator vault passphrase is wrong")
+	ErrCryptomatorUnsupportedVault  = errors.New("unsupported cryptomator vault format or cipher combo")
+	ErrCryptomatorSymlinkNotInVault = errors.New("cryptomator symlink target is not in the vault")
+)
+
+type cryptomatorMasterkeyFile struct {
+	Version          int    `json:"version"`
+	ScryptSalt       string `json:"scryptSalt"`
+	ScryptCostParam  int    `json:"scryptCostParam"`
+	ScryptBlockSize  int    `json:"scryptBlockSize"`
+	PrimaryMasterKey string `json:"primaryMasterKey"`
+	HmacMasterKey    string `json:"hmacMasterKey"`
+	VersionMac       string `json:"versionMac"`
+}
+
+type cryptomatorVaultConfig struct {
+	Format              int    `json:"format"`
+	ShorteningThreshold int    `json:"shorteningThreshold"`
+	CipherCombo         string `json:"cipherCombo"`
+}
+
+// CryptomatorFs reads a Cryptomator vault of format 8 with the SIV_GCM cipher combo through the afero API,
+// the vault is read only, writes fail with os.ErrPermission so cloud synced vaults are never changed
+type CryptomatorFs struct {
+	fs                  afero.Fs
+	root                string
+	encKey              []byte
+	macKey              []byte
+	headerAead          cipher.AEAD
+	shorteningThreshold int
+}
+
+// cryptomatorNode is a resolved cleartext path, dirId is the directory id of directories and contentName the
+// backend file with the content of files and symlinks
+type cryptomatorNode struct {
+	name        string
+	backendName string
+	isDir       bool
+	isSymlink   bool
+	dirId       string
+	contentName string
+}
+
+// OpenCryptomatorVault unlocks the vault in vaultRoot of base with passphrase, the vault config is verified with
+// the master key so a replaced config is detected
+func OpenCryptomatorVault(base afero.Fs, vaultRoot, passphrase string) (*CryptomatorFs, error) {
+	vaultConfigBytes, err := afero.ReadFile(base, filepath.Join(vaultRoot, CRYPTOMATOR_VAULT_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	jwtParts := strings.Split(strings.TrimSpace(string(vaultConfigBytes)), ".")
+	if len(jwtParts) != 3 {
+		return nil, fmt.Errorf("%w: vault config is not a JWT", ErrCryptomatorVaultBroken)
+	}
+	var jwtHeader struct {
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+	}
+	if err := decodeCryptomatorJwtPart(jwtParts[0], &jwtHeader); err != nil {
+		return nil, err
+	}
+	masterkeyFileName := CRYPTOMATOR_MASTERKEY_FILE_NAME
+	if strings.HasPrefix(jwtHeader.Kid, cryptomatorMasterkeyKidPrefix) {
+		masterkeyFileName = path.Base(strings.TrimPrefix(jwtHeader.Kid, cryptomatorMasterkeyKidPrefix))
+	}
+	encKey, macKey, err := readCryptomatorMasterkey(base, filepath.Join(vaultRoot, masterkeyFileName), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var newHash func() hash.Hash
+	switch jwtHeader.Alg {
+	case "HS256":
+		newHash = sha256.New
+	case "HS384":
+		newHash = sha512.New384
+	case "HS512":
+		newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("%w: vault config algorithm %q", ErrCryptomatorUnsupportedVault, jwtHeader.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jwtParts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	// the vault config is signed with the raw master key, encryption key followed by MAC key
+	mac := hmac.New(newHash, append(append([]byte(nil), encKey...), macKey...))
+	mac.Write([]byte(jwtParts[0] + "." + jwtParts[1]))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, fmt.Errorf("%w: vault config signature mismatch", ErrCryptomatorVaultBroken)
+	}
+	var vaultConfig cryptomatorVaultConfig
+	if err := decodeCryptomatorJwtPart(jwtParts[1], &vaultConfig); err != nil {
+		return nil, err
+	}
+	if vaultConfig.Format != CRYPTOMATOR_VAULT_FORMAT || vaultConfig.CipherCombo != CRYPTOMATOR_CIPHER_COMBO_SIV_GCM {
+		return nil, fmt.Errorf("%w: format %d, cipher combo %s", ErrCryptomatorUnsupportedVault,
+			vaultConfig.Format, vaultConfig.CipherCombo)
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	headerAead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CryptomatorFs{
+		fs:                  base,
+		root:                vaultRoot,
+		encKey:              encKey,
+		macKey:              macKey,
+		headerAead:          headerAead,
+		shorteningThreshold: vaultConfig.ShorteningThreshold,
+	}, nil
+}
+
+func decodeCryptomatorJwtPart(part string, v interface{}) error {
+	partBytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	if err := json.Unmarshal(partBytes, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	return nil
+}
+
+// readCryptomatorMasterkey derives the key encryption key by scrypt and unwraps the encryption and MAC keys
+func readCryptomatorMasterkey(base afero.Fs, name, passphrase string) ([]byte, []byte, error) {
+	masterkeyFileBytes, err := afero.ReadFile(base, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var masterkeyFile cryptomatorMasterkeyFile
+	if err := json.Unmarshal(masterkeyFileBytes, &masterkeyFile); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(masterkeyFile.ScryptSalt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	wrappedEncKey, err := base64.StdEncoding.DecodeString(masterkeyFile.PrimaryMasterKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	wrappedMacKey, err := base64.StdEncoding.DecodeString(masterkeyFile.HmacMasterKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	kek, err := scrypt.Key([]byte(passphrase), salt, masterkeyFile.ScryptCostParam, masterkeyFile.ScryptBlockSize, 1, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+	}
+	encKey, err := aesKeyUnwrap(kek, wrappedEncKey)
+	if err != nil {
+		return nil, nil, ErrCryptomatorWrongPassphrase
+	}
+	macKey, err := aesKeyUnwrap(kek, wrappedMacKey)
+	if err != nil {
+		return nil, nil, ErrCryptomatorWrongPassphrase
+	}
+	if masterkeyFile.VersionMac != "" {
+		versionMac, err := base64.StdEncoding.DecodeString(masterkeyFile.VersionMac)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrCryptomatorVaultBroken, err)
+		}
+		versionBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(versionBytes, uint32(masterkeyFile.Version))
+		mac := hmac.New(sha256.New, macKey)
+		mac.Write(versionBytes)
+		if !hmac.Equal(mac.Sum(nil), versionMac) {
+			return nil, nil, fmt.Errorf("%w: master key version mac mismatch", ErrCryptomatorVaultBroken)
+		}
+	}
+	return encKey, macKey, nil
+}
+
+func (*CryptomatorFs) Name() string { return "CryptomatorFs" }
+
+// dirBackendName returns d/XX/YYYY of dirId, the base32 of SHA1 of the deterministically encrypted id
+func (c *CryptomatorFs) dirBackendName(dirId string) (string, error) {
+	encryptedDirId, err := aesSivEncrypt(c.encKey, c.macKey, []byte(dirId))
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.Sum(encryptedDirId)
+	dirHash := base32.StdEncoding.EncodeToString(hash[:])
+	return filepath.Join(c.root, "d", dirHash[:2], dirHash[2:]), nil
+}
+
+// encryptNodeName returns the ciphertext name of name in the directory dirId, names longer than the shortening
+// threshold are replaced by the hash of the ciphertext name
+func (c *CryptomatorFs) encryptNodeName(dirId, name string) (string, error) {
+	encryptedName, err := aesSivEncrypt(c.encKey, c.macKey, []byte(name), []byte(dirId))
+	if err != nil {
+		return "", err
+	}
+	nodeName := base64.URLEncoding.EncodeToString(encryptedName) + CRYPTOMATOR_NAME_EXT
+	if c.shorteningThreshold > 0 && len(nodeName) > c.shorteningThreshold {
+		hash := sha1.Sum([]byte(nodeName))
+		nodeName = base64.URLEncoding.EncodeToString(hash[:]) + CRYPTOMATOR_SHORT_NAME_EXT
+	}
+	return nodeName, nil
+}
+
+// decryptNodeName returns the cleartext name of a directory entry, other entries like dirid.c9r return an error
+func (c *CryptomatorFs) decryptNodeName(dirId, dirBackendName, nodeName string) (string, error) {
+	if strings.HasSuffix(nodeName, CRYPTOMATOR_SHORT_NAME_EXT) {
+		longNameBytes, err := afero.ReadFile(c.fs, filepath.Join(dirBackendName, nodeName, CRYPTOMATOR_LONG_NAME_FILE))
+		if err != nil {
+			return "", err
+		}
+		longName := string(longNameBytes)
+		hash := sha1.Sum(longNameBytes)
+		if base64.URLEncoding.EncodeToString(hash[:])+CRYPTOMATOR_SHORT_NAME_EXT != nodeName {
+			return "", ErrDecryptFailed
+		}
+		nodeName = longName
+	}
+	if !strings.HasSuffix(nodeName, CRYPTOMATOR_NAME_EXT) {
+		return "", ErrDecryptFailed
+	}
+	encryptedName, err := base64.URLEncoding.DecodeString(strings.TrimSuffix(nodeName, CRYPTOMATOR_NAME_EXT))
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	name, err := aesSivDecrypt(c.encKey, c.macKey, encryptedName, []byte(dirId))
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (c *CryptomatorFs) rootNode() (*cryptomatorNode, error) {
+	backendName, err := c.dirBackendName("")
+	if err != nil {
+		return nil, err
+	}
+	return &cryptomatorNode{name: "/", backendName: backendName, isDir: true}, nil
+}
+
+// readNode tells files, directories and symlinks apart by the files inside the backend node
+func (c *CryptomatorFs) readNode(name, backendName string) (*cryptomatorNode, error) {
+	fileInfo, err := c.fs.Stat(backendName)
+	if err != nil {
+		return nil, err
+	}
+	node := &cryptomatorNode{name: name, backendName: backendName}
+	if !fileInfo.IsDir() {
+		node.contentName = backendName
+		return node, nil
+	}
+	dirId, err := afero.ReadFile(c.fs, filepath.Join(backendName, CRYPTOMATOR_DIR_FILE))
+	if err == nil {
+		node.isDir = true
+		node.dirId = string(dirId)
+		return node, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, contentFile := range []string{CRYPTOMATOR_SYMLINK_FILE, CRYPTOMATOR_CONTENTS_FILE} {
+		contentName := filepath.Join(backendName, contentFile)
+		if _, err := c.fs.Stat(contentName); err == nil {
+			node.isSymlink = contentFile == CRYPTOMATOR_SYMLINK_FILE
+			node.contentName = contentName
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown node %s", ErrCryptomatorVaultBroken, backendName)
+}
+
+// resolve looks up the cleartext name, symlinks in the vault are followed in parent directories and for the last
+// part when followLast is set
+func (c *CryptomatorFs) resolve(op, name string, followLast bool) (*cryptomatorNode, error) {
+	node, err := c.rootNode()
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	parts := splitCryptomatorPath(name)
+	symlinkHops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if !node.isDir {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dirBackendName, err := c.dirBackendName(node.dirId)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+		nodeName, err := c.encryptNodeName(node.dirId, part)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+		child, err := c.readNode(path.Join(node.name, part), filepath.Join(dirBackendName, nodeName))
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+		}
+		if child.isSymlink && (len(parts) > 0 || followLast) {
+			symlinkHops++
+			if symlinkHops > cryptomatorMaxSymlinkHops {
+				return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target, err := c.readContent(child.contentName)
+			if err != nil {
+				return nil, &os.PathError{Op: op, Path: name, Err: err}
+			}
+			// absolute targets point outside of the vault in Cryptomator mounts
+			if path.IsAbs(string(target)) || filepath.IsAbs(string(target)) {
+				return nil, &os.PathError{Op: op, Path: name, Err: ErrCryptomatorSymlinkNotInVault}
+			}
+			parts = append(splitCryptomatorPath(path.Join(node.name, filepath.ToSlash(string(target)))), parts...)
+			if node, err = c.rootNode(); err != nil {
+				return nil, &os.PathError{Op: op, Path: name, Err: err}
+			}
+			continue
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func splitCryptomatorPath(name string) []string {
+	cleanName := path.Clean("/" + filepath.ToSlash(name))
+	if cleanName == "/" {
+		return nil
+	}
+	return strings.Split(cleanName[1:], "/")
+}
+
+func unwrapPathError(err error) error {
+	var pathError *os.PathError
+	if errors.As(err, &pathError) {
+		return pathError.Err
+	}
+	return err
+}
+
+// contentKey decrypts the file header and returns the content cipher and the header nonce
+func (c *CryptomatorFs) contentKey(header []byte) (cipher.AEAD, []byte, error) {
+	if len(header) != cryptomatorHeaderSize {
+		return nil, nil, ErrBadFileHeader
+	}
+	headerNonce := header[:cryptomatorHeaderNonceSize]
+	payload, err := c.headerAead.Open(nil, headerNonce, header[cryptomatorHeaderNonceSize:], nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadFileHeader, err)
+	}
+	block, err := aes.NewCipher(payload[8:])
+	if err != nil {
+		return nil, nil, err
+	}
+	contentAead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contentAead, append([]byte(nil), headerNonce...), nil
+}
+
+// readContent decrypts a whole backend file, used for symlink targets
+func (c *CryptomatorFs) readContent(contentName string) ([]byte, error) {
+	file, err := c.openContent(contentName, contentName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return io.ReadAll(file)
+}
+
+func (c *CryptomatorFs) openContent(name, contentName string) (*cryptomatorFile, error) {
+	backendFile, err := c.fs.Open(contentName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := backendFile.Stat()
+	if err != nil {
+		_ = backendFile.Close()
+		return nil, err
+	}
+	header := make([]byte, cryptomatorHeaderSize)
+	if _, err := io.ReadFull(backendFile, header); err != nil {
+		_ = backendFile.Close()
+		return nil, fmt.Errorf("%w: %v", ErrBadFileHeader, err)
+	}
+	contentAead, headerNonce, err := c.contentKey(header)
+	if err != nil {
+		_ = backendFile.Close()
+		return nil, err
+	}
+	size, err := cryptomatorCleartextSize(fileInfo.Size())
+	if err != nil {
+		_ = backendFile.Close()
+		return nil, err
+	}
+	return &cryptomatorFile{
+		name:        name,
+		backendFile: backendFile,
+		contentAead: contentAead,
+		headerNonce: headerNonce,
+		size:        size,
+		chunkIndex:  -1,
+	}, nil
+}
+
+func cryptomatorCleartextSize(ciphertextSize int64) (int64, error) {
+	if ciphertextSize < cryptomatorHeaderSize {
+		return 0, ErrBadFileHeader
+	}
+	bodySize := ciphertextSize - cryptomatorHeaderSize
+	chunks := bodySize / cryptomatorCipherChunkSize
+	lastChunkSize := bodySize % cryptomatorCipherChunkSize
+	size := chunks * cryptomatorChunkSize
+	if lastChunkSize > 0 {
+		if lastChunkSize <= cryptomatorChunkNonceSize+cryptomatorChunkTagSize {
+			return 0, ErrIntegrityCheckFailed
+		}
+		size += lastChunkSize - cryptomatorChunkNonceSize - cryptomatorChunkTagSize
+	}
+	return size, nil
+}
+
+func (c *CryptomatorFs) nodeFileInfo(node *cryptomatorNode) (os.FileInfo, error) {
+	backendFileInfo, err := c.fs.Stat(node.backendName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo := &cryptomatorFileInfo{
+		name:    path.Base(node.name),
+		mode:    backendFileInfo.Mode().Perm(),
+		modTime: backendFileInfo.ModTime(),
+	}
+	switch {
+	case node.isDir:
+		fileInfo.mode |= os.ModeDir
+	case node.isSymlink:
+		fileInfo.mode |= os.ModeSymlink
+	}
+	if node.contentName != "" {
+		contentFileInfo, err := c.fs.Stat(node.contentName)
+		if err != nil {
+			return nil, err
+		}
+		fileInfo.modTime = contentFileInfo.ModTime()
+		if !node.isSymlink {
+			// shortened files keep their content in a directory
+			fileInfo.mode = contentFileInfo.Mode().Perm()
+		}
+		if fileInfo.size, err = cryptomatorCleartextSize(contentFileInfo.Size()); err != nil {
+			return nil, err
+		}
+	}
+	return fileInfo, nil
+}
+
+func (c *CryptomatorFs) Open(name string) (afero.File, error) {
+	node, err := c.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.isDir {
+		fileInfo, err := c.nodeFileInfo(node)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+		}
+		return &cryptomatorFile{name: name, fs: c, dirNode: node, dirInfo: fileInfo}, nil
+	}
+	file, err := c.openContent(name, node.contentName)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	return file, nil
+}
+
+func (c *CryptomatorFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return c.Open(name)
+}
+
+func (c *CryptomatorFs) Stat(name string) (os.FileInfo, error) {
+	return c.stat("stat", name, true)
+}
+
+func (c *CryptomatorFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fileInfo, err := c.stat("lstat", name, false)
+	return fileInfo, true, err
+}
+
+func (c *CryptomatorFs) stat(op, name string, followLast bool) (os.FileInfo, error) {
+	node, err := c.resolve(op, name, followLast)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := c.nodeFileInfo(node)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+	}
+	return fileInfo, nil
+}
+
+func (c *CryptomatorFs) ReadlinkIfPossible(name string) (string, error) {
+	node, err := c.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !node.isSymlink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	target, err := c.readContent(node.contentName)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(target), nil
+}
+
+func (c *CryptomatorFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdirall", Path: path, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) RemoveAll(path string) error {
+	return &os.PathError{Op: "removeall", Path: path, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: os.ErrPermission}
+}
+
+func (c *CryptomatorFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrPermission}
+}
+
+type cryptomatorFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *cryptomatorFileInfo) Name() string       { return i.name }
+func (i *cryptomatorFileInfo) Size() int64        { return i.size }
+func (i *cryptomatorFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *cryptomatorFileInfo) ModTime() time.Time { return i.modTime }
+func (i *cryptomatorFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *cryptomatorFileInfo) Sys() interface{}   { return nil }
+
+// cryptomatorFile reads a file chunk by chunk, the last decrypted chunk is kept for sequential reads, directories
+// are listed when Readdir is first called
+type cryptomatorFile struct {
+	name        string
+	backendFile afero.File
+	contentAead cipher.AEAD
+	headerNonce []byte
+	size        int64
+	offset      int64
+	chunkIndex  int64
+	chunk       []byte
+
+	fs         *CryptomatorFs
+	dirNode    *cryptomatorNode
+	dirInfo    os.FileInfo
+	dirEntries []os.FileInfo
+	dirOffset  int
+}
+
+func (f *cryptomatorFile) Name() string { return f.name }
+
+func (f *cryptomatorFile) Close() error {
+	if f.backendFile == nil {
+		return nil
+	}
+	return f.backendFile.Close()
+}
+
+func (f *cryptomatorFile) Stat() (os.FileInfo, error) {
+	if f.dirNode != nil {
+		return f.dirInfo, nil
+	}
+	fileInfo, err := f.backendFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &cryptomatorFileInfo{
+		name:    path.Base(filepath.ToSlash(f.name)),
+		size:    f.size,
+		mode:    fileInfo.Mode().Perm(),
+		modTime: fileInfo.ModTime(),
+	}, nil
+}
+
+func (f *cryptomatorFile) readChunk(chunkIndex int64) ([]byte, error) {
+	if chunkIndex == f.chunkIndex {
+		return f.chunk, nil
+	}
+	cipherChunk := make([]byte, cryptomatorCipherChunkSize)
+	n, err := f.backendFile.ReadAt(cipherChunk, cryptomatorHeaderSize+chunkIndex*cryptomatorCipherChunkSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= cryptomatorChunkNonceSize+cryptomatorChunkTagSize {
+		return nil, ErrIntegrityCheckFailed
+	}
+	cipherChunk = cipherChunk[:n]
+	// the chunk number and the header nonce bind chunks to their position and file
+	additionalData := make([]byte, 8, 8+len(f.headerNonce))
+	binary.BigEndian.PutUint64(additionalData, uint64(chunkIndex))
+	additionalData = append(additionalData, f.headerNonce...)
+	chunk, err := f.contentAead.Open(nil, cipherChunk[:cryptomatorChunkNonceSize],
+		cipherChunk[cryptomatorChunkNonceSize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d", ErrDecryptFailed, chunkIndex)
+	}
+	f.chunkIndex = chunkIndex
+	f.chunk = chunk
+	return chunk, nil
+}
+
+func (f *cryptomatorFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.dirNode != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	read := 0
+	for read < len(p) && off < f.size {
+		chunk, err := f.readChunk(off / cryptomatorChunkSize)
+		if err != nil {
+			return read, &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		chunkOffset := int(off % cryptomatorChunkSize)
+		if chunkOffset >= len(chunk) {
+			return read, &os.PathError{Op: "read", Path: f.name, Err: ErrIntegrityCheckFailed}
+		}
+		n := copy(p[read:], chunk[chunkOffset:])
+		read += n
+		off += int64(n)
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (f *cryptomatorFile) Read(p []byte) (int, error) {
+	if len(p) > 0 && f.dirNode == nil && f.offset >= f.size {
+		return 0, io.EOF
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *cryptomatorFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *cryptomatorFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.dirNode == nil {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if f.dirEntries == nil {
+		dirEntries, err := f.fs.readDir(f.dirNode)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: f.name, Err: unwrapPathError(err)}
+		}
+		f.dirEntries = dirEntries
+	}
+	remaining := f.dirEntries[f.dirOffset:]
+	if count <= 0 {
+		f.dirOffset = len(f.dirEntries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.dirOffset += count
+	return remaining[:count], nil
+}
+
+func (f *cryptomatorFile) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := f.Readdir(n)
+	names := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		names[i] = fileInfo.Name()
+	}
+	return names, err
+}
+
+// readDir lists the cleartext entries of a directory node, entries that do not decrypt are skipped
+func (c *CryptomatorFs) readDir(dirNode *cryptomatorNode) ([]os.FileInfo, error) {
+	dirBackendName, err := c.dirBackendName(dirNode.dirId)
+	if err != nil {
+		return nil, err
+	}
+	backendDir, err := c.fs.Open(dirBackendName)
+	if err != nil {
+		return nil, err
+	}
+	nodeNames, err := backendDir.Readdirnames(-1)
+	_ = backendDir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nodeNames)
+	fileInfos := make([]os.FileInfo, 0, len(nodeNames))
+	for _, nodeName := range nodeNames {
+		name, err := c.decryptNodeName(dirNode.dirId, dirBackendName, nodeName)
+		if err != nil {
+			continue
+		}
+		node, err := c.readNode(path.Join(dirNode.name, name), filepath.Join(dirBackendName, nodeName))
+		if err != nil {
+			continue
+		}
+		fileInfo, err := c.nodeFileInfo(node)
+		if err != nil {
+			continue
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	return fileInfos, nil
+}
+
+func (f *cryptomatorFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *cryptomatorFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *cryptomatorFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *cryptomatorFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *cryptomatorFile) Sync() error {
+	return nil
+}
@@ -0,0 +1,153 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+const aesSivIvSize = 16
+
+// aesSivEncrypt is AES-SIV of RFC 5297 as used by Cryptomator, macKey keys S2V and ctrKey the CTR mode, the
+// result is the synthetic IV followed by the ciphertext
+func aesSivEncrypt(ctrKey, macKey, plaintext []byte, associatedData ...[]byte) ([]byte, error) {
+	iv, err := aesSivS2v(macKey, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, aesSivIvSize+len(plaintext))
+	copy(ciphertext, iv)
+	if err := aesSivCtr(ctrKey, iv, ciphertext[aesSivIvSize:], plaintext); err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+func aesSivDecrypt(ctrKey, macKey, ciphertext []byte, associatedData ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aesSivIvSize {
+		return nil, ErrDecryptFailed
+	}
+	iv := ciphertext[:aesSivIvSize]
+	plaintext := make([]byte, len(ciphertext)-aesSivIvSize)
+	if err := aesSivCtr(ctrKey, iv, plaintext, ciphertext[aesSivIvSize:]); err != nil {
+		return nil, err
+	}
+	expectedIv, err := aesSivS2v(macKey, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(iv, expectedIv) != 1 {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+func aesSivCtr(ctrKey, iv, dst, src []byte) error {
+	block, err := aes.NewCipher(ctrKey)
+	if err != nil {
+		return err
+	}
+	// the 31st and 63rd bit from the right are cleared so 32 and 64 bit counters never carry
+	counter := make([]byte, aesSivIvSize)
+	copy(counter, iv)
+	counter[8] &= 0x7f
+	counter[12] &= 0x7f
+	cipher.NewCTR(block, counter).XORKeyStream(dst, src)
+	return nil
+}
+
+// aesSivS2v is the S2V pseudo random function over the associated data and the plaintext as last string
+func aesSivS2v(macKey, plaintext []byte, associatedData [][]byte) ([]byte, error) {
+	block, err := aes.NewCipher(macKey)
+	if err != nil {
+		return nil, err
+	}
+	d := aesCmac(block, make([]byte, aes.BlockSize))
+	for _, data := range associatedData {
+		d = aesCmacDouble(d)
+		subtle.XORBytes(d, d, aesCmac(block, data))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte(nil), plaintext...)
+		subtle.XORBytes(t[len(t)-aes.BlockSize:], t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = aesCmacDouble(d)
+		padded := make([]byte, aes.BlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, padded)
+	}
+	return aesCmac(block, t), nil
+}
+
+// aesCmac is AES-CMAC of RFC 4493
+func aesCmac(block cipher.Block, message []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = aesCmacDouble(k1)
+	lastBlock := make([]byte, aes.BlockSize)
+	blockCount := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	if blockCount > 0 && len(message)%aes.BlockSize == 0 {
+		copy(lastBlock, message[len(message)-aes.BlockSize:])
+		subtle.XORBytes(lastBlock, lastBlock, k1)
+	} else {
+		if blockCount == 0 {
+			blockCount = 1
+		}
+		rest := message[(blockCount-1)*aes.BlockSize:]
+		copy(lastBlock, rest)
+		lastBlock[len(rest)] = 0x80
+		subtle.XORBytes(lastBlock, lastBlock, aesCmacDouble(k1))
+	}
+	mac := make([]byte, aes.BlockSize)
+	for i := 0; i < blockCount-1; i++ {
+		subtle.XORBytes(mac, mac, message[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(mac, mac)
+	}
+	subtle.XORBytes(mac, mac, lastBlock)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+// aesCmacDouble multiplies by x in GF(2^128)
+func aesCmacDouble(in []byte) []byte {
+	out := make([]byte, len(in))
+	carry := in[0] >> 7
+	for i := 0; i < len(in)-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[len(in)-1] = in[len(in)-1]<<1 ^ 0x87&-carry
+	return out
+}
+
+// aesKeyUnwrap is the AES key wrap of RFC 3394 used by Cryptomator master key files
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, ErrDecryptFailed
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	b := make([]byte, aes.BlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a)^uint64(n*j+i))
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}) != 1 {
+		return nil, ErrDecryptFailed
+	}
+	return r, nil
+}
@@ -0,0 +1,591 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/scrypt"
+)
+
+const testCryptomatorPassphrase = "correct horse battery staple"
+
+// testCryptomatorVault writes a format 8 vault like Cryptomator does, nodes are added by the id of their parent
+// directory, the root directory has the empty id
+type testCryptomatorVault struct {
+	t                   *testing.T
+	fs                  afero.Fs
+	root                string
+	encKey              []byte
+	macKey              []byte
+	shorteningThreshold int
+	dirIds              int
+}
+
+func newTestCryptomatorVault(t *testing.T, fs afero.Fs, root string, shorteningThreshold int) *testCryptomatorVault {
+	t.Helper()
+	vault := &testCryptomatorVault{
+		t:                   t,
+		fs:                  fs,
+		root:                root,
+		encKey:              testKeyBytes(11),
+		macKey:              testKeyBytes(12),
+		shorteningThreshold: shorteningThreshold,
+	}
+	salt := testKeyBytes(13)[:8]
+	kek, err := scrypt.Key([]byte(testCryptomatorPassphrase), salt, 1024, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionMac := hmac.New(sha256.New, vault.macKey)
+	versionMac.Write([]byte{0, 0, 3, 231})
+	masterkeyFile, err := json.Marshal(&cryptomatorMasterkeyFile{
+		Version:          999,
+		ScryptSalt:       base64.StdEncoding.EncodeToString(salt),
+		ScryptCostParam:  1024,
+		ScryptBlockSize:  8,
+		PrimaryMasterKey: base64.StdEncoding.EncodeToString(testAesKeyWrap(t, kek, vault.encKey)),
+		HmacMasterKey:    base64.StdEncoding.EncodeToString(testAesKeyWrap(t, kek, vault.macKey)),
+		VersionMac:       base64.StdEncoding.EncodeToString(versionMac.Sum(nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.writeFile(filepath.Join(root, CRYPTOMATOR_MASTERKEY_FILE_NAME), masterkeyFile)
+	vault.writeConfig(`{"kid":"masterkeyfile:masterkey.cryptomator","typ":"JWT","alg":"HS256"}`,
+		CRYPTOMATOR_VAULT_FORMAT, CRYPTOMATOR_CIPHER_COMBO_SIV_GCM)
+	if err := fs.MkdirAll(vault.dirName(""), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return vault
+}
+
+// writeConfig signs the vault config with the master key
+func (v *testCryptomatorVault) writeConfig(jwtHeader string, format int, cipherCombo string) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"format":              format,
+		"shorteningThreshold": v.shorteningThreshold,
+		"jti":                 "test-vault",
+		"cipherCombo":         cipherCombo,
+	})
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(jwtHeader)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, append(append([]byte(nil), v.encKey...), v.macKey...))
+	mac.Write([]byte(signingInput))
+	v.writeFile(filepath.Join(v.root, CRYPTOMATOR_VAULT_FILE_NAME),
+		[]byte(signingInput+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil))))
+}
+
+func (v *testCryptomatorVault) writeFile(name string, data []byte) {
+	if err := v.fs.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		v.t.Fatal(err)
+	}
+	if err := afero.WriteFile(v.fs, name, data, 0644); err != nil {
+		v.t.Fatal(err)
+	}
+}
+
+func (v *testCryptomatorVault) dirName(dirId string) string {
+	encryptedDirId, err := aesSivEncrypt(v.encKey, v.macKey, []byte(dirId))
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	hash := sha1.Sum(encryptedDirId)
+	dirHash := base32.StdEncoding.EncodeToString(hash[:])
+	return filepath.Join(v.root, "d", dirHash[:2], dirHash[2:])
+}
+
+// nodeName returns the backend name of name in the directory and whether it was shortened
+func (v *testCryptomatorVault) nodeName(parentDirId, name string) (string, bool) {
+	encryptedName, err := aesSivEncrypt(v.encKey, v.macKey, []byte(name), []byte(parentDirId))
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	nodeName := filepath.Join(v.dirName(parentDirId),
+		base64.URLEncoding.EncodeToString(encryptedName)+CRYPTOMATOR_NAME_EXT)
+	if len(filepath.Base(nodeName)) <= v.shorteningThreshold {
+		return nodeName, false
+	}
+	hash := sha1.Sum([]byte(filepath.Base(nodeName)))
+	shortName := filepath.Join(v.dirName(parentDirId), base64.URLEncoding.EncodeToString(hash[:])+
+		CRYPTOMATOR_SHORT_NAME_EXT)
+	v.writeFile(filepath.Join(shortName, CRYPTOMATOR_LONG_NAME_FILE), []byte(filepath.Base(nodeName)))
+	return shortName, true
+}
+
+// encrypt returns the header and the chunks of data
+func (v *testCryptomatorVault) encrypt(data []byte) []byte {
+	headerNonce := testRandomBytes(cryptomatorHeaderNonceSize, int64(len(data)))
+	contentKey := testKeyBytes(14)
+	headerAead := newTestGcm(v.t, v.encKey)
+	payload := append(bytes.Repeat([]byte{0xff}, 8), contentKey...)
+	encrypted := headerAead.Seal(append([]byte(nil), headerNonce...), headerNonce, payload, nil)
+	contentAead := newTestGcm(v.t, contentKey)
+	for chunkIndex := 0; chunkIndex*cryptomatorChunkSize < len(data); chunkIndex++ {
+		end := (chunkIndex + 1) * cryptomatorChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunkNonce := testRandomBytes(cryptomatorChunkNonceSize, int64(chunkIndex))
+		additionalData := binary.BigEndian.AppendUint64(nil, uint64(chunkIndex))
+		additionalData = append(additionalData, headerNonce...)
+		encrypted = append(encrypted, chunkNonce...)
+		encrypted = contentAead.Seal(encrypted, chunkNonce, data[chunkIndex*cryptomatorChunkSize:end], additionalData)
+	}
+	return encrypted
+}
+
+func (v *testCryptomatorVault) addFile(parentDirId, name string, data []byte) {
+	nodeName, shortened := v.nodeName(parentDirId, name)
+	if shortened {
+		nodeName = filepath.Join(nodeName, CRYPTOMATOR_CONTENTS_FILE)
+	}
+	v.writeFile(nodeName, v.encrypt(data))
+}
+
+func (v *testCryptomatorVault) addDir(parentDirId, name string) string {
+	v.dirIds++
+	dirId := "00000000-0000-0000-0000-" + strings.Repeat("0", 11) + string(rune('0'+v.dirIds))
+	nodeName, _ := v.nodeName(parentDirId, name)
+	v.writeFile(filepath.Join(nodeName, CRYPTOMATOR_DIR_FILE), []byte(dirId))
+	if err := v.fs.MkdirAll(v.dirName(dirId), 0755); err != nil {
+		v.t.Fatal(err)
+	}
+	// the backup of the directory id, which is no node
+	v.writeFile(filepath.Join(v.dirName(dirId), "dirid.c9r"), v.encrypt([]byte(dirId)))
+	return dirId
+}
+
+func (v *testCryptomatorVault) addSymlink(parentDirId, name, target string) {
+	nodeName, _ := v.nodeName(parentDirId, name)
+	v.writeFile(filepath.Join(nodeName, CRYPTOMATOR_SYMLINK_FILE), v.encrypt([]byte(target)))
+}
+
+func newTestGcm(t *testing.T, key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// testAesKeyWrap is the AES key wrap of RFC 3394
+func testAesKeyWrap(t *testing.T, kek, key []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte(nil), key...)
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func decodeTestHex(t *testing.T, s string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestCryptomatorPrimitives(t *testing.T) {
+	// AES-CMAC examples of RFC 4493
+	cmacKey := decodeTestHex(t, "2b7e1516 28aed2a6 abf71588 09cf4f3c")
+	block, err := aes.NewCipher(cmacKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmacTests := []struct {
+		message string
+		want    string
+	}{
+		{"", "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{"6bc1bee2 2e409f96 e93d7e11 7393172a", "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{"6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411",
+			"dfa66747 de9ae630 30ca3261 1497c827"},
+	}
+	for _, test := range cmacTests {
+		if got := aesCmac(block, decodeTestHex(t, test.message)); !bytes.Equal(got, decodeTestHex(t, test.want)) {
+			t.Fatalf("cmac of %q: got %x, want %s", test.message, got, test.want)
+		}
+	}
+
+	// deterministic AES-SIV example of RFC 5297, the first half of the key keys S2V
+	sivMacKey := decodeTestHex(t, "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0")
+	sivCtrKey := decodeTestHex(t, "f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff")
+	associatedData := decodeTestHex(t, "10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627")
+	plaintext := decodeTestHex(t, "11223344 55667788 99aabbcc ddee")
+	want := decodeTestHex(t, "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c")
+	ciphertext, err := aesSivEncrypt(sivCtrKey, sivMacKey, plaintext, associatedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ciphertext, want) {
+		t.Fatalf("siv: got %x, want %x", ciphertext, want)
+	}
+	sivTests := []struct {
+		name           string
+		ciphertext     []byte
+		associatedData []byte
+		wantErr        error
+	}{
+		{"ciphertext", ciphertext, associatedData, nil},
+		{"tampered", append(append([]byte(nil), ciphertext[:20]...), ciphertext[20]^1), associatedData,
+			ErrDecryptFailed},
+		{"other associated data", ciphertext, []byte("other"), ErrDecryptFailed},
+		{"too short", ciphertext[:aesSivIvSize-1], associatedData, ErrDecryptFailed},
+	}
+	for _, test := range sivTests {
+		decrypted, err := aesSivDecrypt(sivCtrKey, sivMacKey, test.ciphertext, test.associatedData)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if err == nil && !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("%s: got %x", test.name, decrypted)
+		}
+	}
+
+	// AES key wrap example of RFC 3394
+	kek := decodeTestHex(t, "00010203 04050607 08090a0b 0c0d0e0f")
+	key := decodeTestHex(t, "00112233 44556677 8899aabb ccddeeff")
+	wrapped := decodeTestHex(t, "1fa68b0a 8112b447 aef34bd8 fb5a7b82 9d3e8623 71d2cfe5")
+	if got := testAesKeyWrap(t, kek, key); !bytes.Equal(got, wrapped) {
+		t.Fatalf("wrap: got %x, want %x", got, wrapped)
+	}
+	unwrapTests := []struct {
+		name    string
+		kek     []byte
+		wrapped []byte
+		wantErr error
+	}{
+		{"wrapped", kek, wrapped, nil},
+		{"other kek", testKeyBytes(1)[:16], wrapped, ErrDecryptFailed},
+		{"too short", kek, wrapped[:16], ErrDecryptFailed},
+		{"not aligned", kek, wrapped[:23], ErrDecryptFailed},
+	}
+	for _, test := range unwrapTests {
+		unwrapped, err := aesKeyUnwrap(test.kek, test.wrapped)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if err == nil && !bytes.Equal(unwrapped, key) {
+			t.Fatalf("%s: got %x", test.name, unwrapped)
+		}
+	}
+}
+
+func TestCryptomatorFs(t *testing.T) {
+	base := afero.NewMemMapFs()
+	vault := newTestCryptomatorVault(t, base, "/vault", 220)
+	big := testPattern(3*cryptomatorChunkSize + 100)
+	longName := strings.Repeat("long name ", 20)
+	vault.addFile("", "a.txt", []byte("hello"))
+	vault.addFile("", "empty", nil)
+	vault.addFile("", "big", big)
+	vault.addFile("", longName, []byte("long"))
+	dirId := vault.addDir("", "dir")
+	subDirId := vault.addDir(dirId, "sub")
+	vault.addFile(subDirId, "nested", []byte("nested"))
+	vault.addSymlink("", "link", "dir/sub/nested")
+	vault.addSymlink(dirId, "parent link", "../a.txt")
+	vault.addSymlink("", "dir link", "dir")
+	vault.addSymlink("", "absolute", "/etc/passwd")
+	vault.addSymlink("", "loop", "loop")
+
+	cryptomatorFs, err := OpenCryptomatorVault(base, "/vault", testCryptomatorPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readTests := []struct {
+		name    string
+		want    []byte
+		wantErr error
+	}{
+		{"/a.txt", []byte("hello"), nil},
+		{"a.txt", []byte("hello"), nil},
+		{"/empty", []byte{}, nil},
+		{"/big", big, nil},
+		{"/" + longName, []byte("long"), nil},
+		{"/dir/sub/nested", []byte("nested"), nil},
+		{"/link", []byte("nested"), nil},
+		{"/dir/parent link", []byte("hello"), nil},
+		{"/dir link/sub/nested", []byte("nested"), nil},
+		{"/missing", nil, os.ErrNotExist},
+		{"/dir/missing/nested", nil, os.ErrNotExist},
+		{"/a.txt/child", nil, syscall.ENOTDIR},
+		{"/absolute", nil, ErrCryptomatorSymlinkNotInVault},
+		{"/loop", nil, syscall.ELOOP},
+	}
+	for _, test := range readTests {
+		got, err := afero.ReadFile(cryptomatorFs, test.name)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if err == nil && !bytes.Equal(got, test.want) {
+			t.Fatalf("%s: got %d bytes, want %d", test.name, len(got), len(test.want))
+		}
+		if err == nil {
+			fileInfo, err := cryptomatorFs.Stat(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Size() != int64(len(test.want)) {
+				t.Fatalf("%s: got size %d, want %d", test.name, fileInfo.Size(), len(test.want))
+			}
+		}
+	}
+
+	listTests := []struct {
+		name      string
+		wantNames []string
+	}{
+		{"/", []string{"a.txt", "absolute", "big", "dir", "dir link", "empty", "link", longName, "loop"}},
+		{"/dir", []string{"parent link", "sub"}},
+		{"/dir link", []string{"parent link", "sub"}},
+		{"/dir/sub", []string{"nested"}},
+	}
+	for _, test := range listTests {
+		fileInfos, err := afero.ReadDir(cryptomatorFs, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fileInfo := range fileInfos {
+			names = append(names, fileInfo.Name())
+		}
+		if !reflect.DeepEqual(names, test.wantNames) {
+			t.Fatalf("%s: listed %q, want %q", test.name, names, test.wantNames)
+		}
+	}
+
+	fileInfo, _, err := cryptomatorFs.LstatIfPossible("/link")
+	if err != nil || fileInfo.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lstat: got %v and %v", fileInfo, err)
+	}
+	if target, err := cryptomatorFs.ReadlinkIfPossible("/link"); err != nil || target != "dir/sub/nested" {
+		t.Fatalf("readlink: got %q and %v", target, err)
+	}
+	if _, err := cryptomatorFs.ReadlinkIfPossible("/a.txt"); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("readlink of a file: got %v", err)
+	}
+	if fileInfo, err := cryptomatorFs.Stat("/dir"); err != nil || !fileInfo.IsDir() {
+		t.Fatalf("stat of a directory: got %v and %v", fileInfo, err)
+	}
+
+	// reads across chunks and after seeks
+	f, err := cryptomatorFs.Open("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	p := make([]byte, 100)
+	if _, err := f.ReadAt(p, cryptomatorChunkSize-50); err != nil || !bytes.Equal(p, big[cryptomatorChunkSize-50:][:100]) {
+		t.Fatalf("read at: got %v", err)
+	}
+	if _, err := f.Seek(-30, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.ReadFull(f, p); err != io.ErrUnexpectedEOF || !bytes.Equal(p[:n], big[len(big)-30:]) {
+		t.Fatalf("read to the end: got %d bytes and %v", n, err)
+	}
+}
+
+func TestCryptomatorFsIsReadOnly(t *testing.T) {
+	base := afero.NewMemMapFs()
+	vault := newTestCryptomatorVault(t, base, "/vault", 220)
+	vault.addFile("", "file", []byte("data"))
+	cryptomatorFs, err := OpenCryptomatorVault(base, "/vault", testCryptomatorPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := snapshotTestFs(t, base)
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"create", func() error {
+			_, err := cryptomatorFs.Create("/new")
+			return err
+		}},
+		{"open for writing", func() error {
+			_, err := cryptomatorFs.OpenFile("/file", os.O_RDWR, 0)
+			return err
+		}},
+		{"write", func() error {
+			f, err := cryptomatorFs.Open("/file")
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			_, err = f.Write([]byte("x"))
+			return err
+		}},
+		{"mkdir", func() error { return cryptomatorFs.Mkdir("/dir", 0755) }},
+		{"remove", func() error { return cryptomatorFs.Remove("/file") }},
+		{"rename", func() error { return cryptomatorFs.Rename("/file", "/renamed") }},
+		{"chmod", func() error { return cryptomatorFs.Chmod("/file", 0600) }},
+	}
+	for _, test := range tests {
+		if err := test.op(); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, os.ErrPermission)
+		}
+	}
+	if !equalTestSnapshots(snapshot, snapshotTestFs(t, base)) {
+		t.Fatal("changed the vault")
+	}
+}
+
+func TestOpenCryptomatorVault(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		modify     func(vault *testCryptomatorVault)
+		wantErr    error
+	}{
+		{"vault", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {}, nil},
+		{"wrong passphrase", "wrong", func(vault *testCryptomatorVault) {}, ErrCryptomatorWrongPassphrase},
+		{"other format", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.writeConfig(`{"kid":"masterkeyfile:masterkey.cryptomator","alg":"HS256"}`, 7,
+				CRYPTOMATOR_CIPHER_COMBO_SIV_GCM)
+		}, ErrCryptomatorUnsupportedVault},
+		{"other cipher combo", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.writeConfig(`{"kid":"masterkeyfile:masterkey.cryptomator","alg":"HS256"}`,
+				CRYPTOMATOR_VAULT_FORMAT, "SIV_CTRMAC")
+		}, ErrCryptomatorUnsupportedVault},
+		{"unsigned", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.writeConfig(`{"kid":"masterkeyfile:masterkey.cryptomator","alg":"none"}`,
+				CRYPTOMATOR_VAULT_FORMAT, CRYPTOMATOR_CIPHER_COMBO_SIV_GCM)
+		}, ErrCryptomatorUnsupportedVault},
+		{"replaced config", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.encKey = testKeyBytes(21)
+			vault.writeConfig(`{"kid":"masterkeyfile:masterkey.cryptomator","alg":"HS256"}`,
+				CRYPTOMATOR_VAULT_FORMAT, CRYPTOMATOR_CIPHER_COMBO_SIV_GCM)
+		}, ErrCryptomatorVaultBroken},
+		{"not a jwt", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.writeFile("/vault/"+CRYPTOMATOR_VAULT_FILE_NAME, []byte("not a jwt"))
+		}, ErrCryptomatorVaultBroken},
+		{"broken master key file", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			vault.writeFile("/vault/"+CRYPTOMATOR_MASTERKEY_FILE_NAME, []byte("{"))
+		}, ErrCryptomatorVaultBroken},
+		{"missing master key file", testCryptomatorPassphrase, func(vault *testCryptomatorVault) {
+			if err := vault.fs.Remove("/vault/" + CRYPTOMATOR_MASTERKEY_FILE_NAME); err != nil {
+				t.Fatal(err)
+			}
+		}, os.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			vault := newTestCryptomatorVault(t, base, "/vault", 220)
+			test.modify(vault)
+			_, err := OpenCryptomatorVault(base, "/vault", test.passphrase)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCryptomatorFsCorruption(t *testing.T) {
+	data := testPattern(2*cryptomatorChunkSize + 100)
+	tests := []struct {
+		name    string
+		modify  func(t *testing.T, base afero.Fs, contentName string)
+		wantErr error
+	}{
+		{"changed chunk", func(t *testing.T, base afero.Fs, contentName string) {
+			flipTestByte(t, base, contentName, cryptomatorHeaderSize+cryptomatorCipherChunkSize+100)
+		}, ErrDecryptFailed},
+		// chunks are bound to their position
+		{"swapped chunks", func(t *testing.T, base afero.Fs, contentName string) {
+			encrypted, err := afero.ReadFile(base, contentName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := encrypted[cryptomatorHeaderSize:][:cryptomatorCipherChunkSize]
+			second := encrypted[cryptomatorHeaderSize+cryptomatorCipherChunkSize:][:cryptomatorCipherChunkSize]
+			swapped := append(append(append([]byte(nil), encrypted[:cryptomatorHeaderSize]...), second...), first...)
+			encrypted = append(swapped, encrypted[cryptomatorHeaderSize+2*cryptomatorCipherChunkSize:]...)
+			if err := afero.WriteFile(base, contentName, encrypted, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrDecryptFailed},
+		{"changed header", func(t *testing.T, base afero.Fs, contentName string) {
+			encrypted, err := afero.ReadFile(base, contentName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted[cryptomatorHeaderNonceSize] ^= 1
+			if err := afero.WriteFile(base, contentName, encrypted, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrBadFileHeader},
+		{"truncated", func(t *testing.T, base afero.Fs, contentName string) {
+			encrypted, err := afero.ReadFile(base, contentName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the last chunk is shorter than its nonce and tag
+			encrypted = encrypted[:cryptomatorHeaderSize+2*cryptomatorCipherChunkSize+10]
+			if err := afero.WriteFile(base, contentName, encrypted, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrIntegrityCheckFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			vault := newTestCryptomatorVault(t, base, "/vault", 220)
+			vault.addFile("", "file", data)
+			contentName, _ := vault.nodeName("", "file")
+			test.modify(t, base, contentName)
+			cryptomatorFs, err := OpenCryptomatorVault(base, "/vault", testCryptomatorPassphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := afero.ReadFile(cryptomatorFs, "/file"); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package encfs
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrBadIv = errors.New("iv must be 16 bytes")
+)
+
+// ctrStream is the AES/CTR keystream of CTR files at a plaintext offset
+type ctrStream struct {
+	key    []byte
+	iv     []byte
+	offset int64
+}
+
+func newCtrStream(key *EncryptionMasterKey, iv []byte) (*ctrStream, error) {
+	if len(iv) != 16 {
+		return nil, ErrBadIv
+	}
+	contentKey := key.key
+	if key.subkeys {
+		contentKey = key.contentSubkey()
+	}
+	return &ctrStream{key: contentKey, iv: append([]byte(nil), iv...)}, nil
+}
+
+// xor sets dst to src xor the keystream at the stream offset and moves the offset after src
+func (s *ctrStream) xor(dst, src []byte) error {
+	if err := xorCtrKeyStream(s.key, s.iv, s.offset, dst, src); err != nil {
+		return err
+	}
+	s.offset += int64(len(src))
+	return nil
+}
+
+type encryptWriter struct {
+	dst    io.Writer
+	stream *ctrStream
+}
+
+// NewEncryptWriter returns a writer encrypting to dst with AES/CTR exactly like the contents of CTR files, so data
+// can be uploaded or put into archives without a backend, store iv in the meta file or header of the file, keys
+// with WithSubkeys encrypt with the content subkey like version 3 files
+func NewEncryptWriter(dst io.Writer, key *EncryptionMasterKey, iv []byte) (io.Writer, error) {
+	stream, err := newCtrStream(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{dst: dst, stream: stream}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	if err := w.stream.xor(encrypted, p); err != nil {
+		return 0, err
+	}
+	n, err := w.dst.Write(encrypted)
+	// the keystream continues after the bytes really written
+	w.stream.offset -= int64(len(p) - n)
+	return n, err
+}
+
+type decryptReader struct {
+	src    io.Reader
+	stream *ctrStream
+}
+
+// NewDecryptReader returns a reader decrypting the contents of a CTR file or of NewEncryptWriter from src with the
+// iv of its meta file
+func NewDecryptReader(src io.Reader, key *EncryptionMasterKey, iv []byte) (io.Reader, error) {
+	stream, err := newCtrStream(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{src: src, stream: stream}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		if xorErr := r.stream.xor(p[:n], p[:n]); xorErr != nil {
+			return 0, xorErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,170 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/spf13/afero"
+)
+
+// shortWriter writes at most max bytes of each write
+type shortWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		n, _ := w.buf.Write(p[:w.max])
+		return n, io.ErrShortWrite
+	}
+	return w.buf.Write(p)
+}
+
+func TestCtrStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		subkeys bool
+		// writeSize is the size of each write, reads go one byte at a time when oneByteReads is set
+		writeSize    int
+		oneByteReads bool
+	}{
+		{"one write", false, 0, false},
+		{"writes of 1 byte", false, 1, false},
+		{"writes of 15 bytes", false, 15, false},
+		{"writes of a block", false, 16, false},
+		{"writes of 17 bytes", false, 17, true},
+		{"writes of 4097 bytes", false, 4097, false},
+		{"subkeys", true, 100, true},
+	}
+	data := testPattern(3*CONTENT_CHUNK_SIZE + 17)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := NewEncryptionMasterKey(testKeyBytes(1))
+			key.WithSubkeys(test.subkeys)
+			encFs, base := newTestEncFs(key)
+			// the stream of a CTR file is the one of its meta
+			writeTestFile(t, encFs, "/file", data)
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var encrypted bytes.Buffer
+			w, err := NewEncryptWriter(&encrypted, key, encFileMeta.Iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeSize := test.writeSize
+			if writeSize == 0 {
+				writeSize = len(data)
+			}
+			for off := 0; off < len(data); off += writeSize {
+				end := off + writeSize
+				if end > len(data) {
+					end = len(data)
+				}
+				if n, err := w.Write(data[off:end]); err != nil || n != end-off {
+					t.Fatalf("wrote %d bytes: %v", n, err)
+				}
+			}
+			if !bytes.Equal(encrypted.Bytes(), readTestFile(t, base, "/file")) {
+				t.Fatal("the writer encrypted other contents than the file")
+			}
+
+			var src io.Reader = bytes.NewReader(readTestFile(t, base, "/file"))
+			if test.oneByteReads {
+				src = iotest.OneByteReader(src)
+			}
+			r, err := NewDecryptReader(src, key, encFileMeta.Iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, data) {
+				t.Fatal("the reader decrypted other contents than the file")
+			}
+		})
+	}
+}
+
+func TestEncryptWriterShortWrites(t *testing.T) {
+	key := NewEncryptionMasterKey(testKeyBytes(1))
+	iv := testPattern(16)
+	data := testPattern(1000)
+	var want bytes.Buffer
+	w, err := NewEncryptWriter(&want, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keystream continues after the bytes written, so the rest can be written again
+	dst := &shortWriter{max: 7}
+	w, err = NewEncryptWriter(dst, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(data); {
+		n, err := w.Write(data[off:])
+		if err != nil && !errors.Is(err, io.ErrShortWrite) {
+			t.Fatal(err)
+		}
+		off += n
+	}
+	if !bytes.Equal(dst.buf.Bytes(), want.Bytes()) {
+		t.Fatal("short writes encrypted other contents")
+	}
+}
+
+func TestCtrStreamIvs(t *testing.T) {
+	key := NewEncryptionMasterKey(testKeyBytes(1))
+	for _, size := range []int{0, 8, 15, 17, 32} {
+		if _, err := NewEncryptWriter(io.Discard, key, make([]byte, size)); !errors.Is(err, ErrBadIv) {
+			t.Fatalf("writer of an iv of %d bytes: got %v, want %v", size, err, ErrBadIv)
+		}
+		if _, err := NewDecryptReader(bytes.NewReader(nil), key, make([]byte, size)); !errors.Is(err, ErrBadIv) {
+			t.Fatalf("reader of an iv of %d bytes: got %v, want %v", size, err, ErrBadIv)
+		}
+	}
+	// the iv is copied, callers may reuse its buffer
+	iv := testPattern(16)
+	var encrypted bytes.Buffer
+	w, err := NewEncryptWriter(&encrypted, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv[0] ^= 0xff
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDecryptReader(bytes.NewReader(encrypted.Bytes()), key, testPattern(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := io.ReadAll(r); err != nil || string(decrypted) != "data" {
+		t.Fatalf("got %q and %v", decrypted, err)
+	}
+	// an encrypted stream stored with the meta of a file is read by EncFs
+	encFs, base := newTestEncFs(key)
+	writeTestFile(t, encFs, "/file", []byte("xxxx"))
+	encFileMeta, _, err := encFs.readFileMeta("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encFileMeta.Iv = testPattern(16)
+	if err := writeEncFileMeta(base, encFs.encFileMetaName("/file"), encFileMeta); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(base, "/file", encrypted.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/file", []byte("data"))
+}
@@ -0,0 +1,102 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrOperationTimeout = errors.New("operation timeout")
+)
+
+// OperationTimeoutError is returned when an underlying operation exceeds the operation
+// timeout or the operation context is done, Err is context.DeadlineExceeded or context.Canceled
+type OperationTimeoutError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.Op, e.Path, ErrOperationTimeout.Error(), e.Err.Error())
+}
+
+func (e *OperationTimeoutError) Unwrap() error { return e.Err }
+
+func (e *OperationTimeoutError) Timeout() bool { return true }
+
+func (e *OperationTimeoutError) Is(target error) bool { return target == ErrOperationTimeout }
+
+// WithOperationTimeout bounds each underlying operation, after a timeout the operation keeps
+// running in background, file handles should be discarded because position may be lost
+func (encFs *EncFs) WithOperationTimeout(timeout time.Duration) {
+	encFs.operationTimeout = timeout
+}
+
+// WithOperationContext cancels pending underlying operations when ctx is done
+func (encFs *EncFs) WithOperationContext(ctx context.Context) {
+	encFs.operationContext = ctx
+}
+
+func (encFs *EncFs) hasOperationDeadline() bool {
+	return encFs != nil && (encFs.operationTimeout > 0 || encFs.operationContext != nil)
+}
+
+func callWithDeadline[T any](encFs *EncFs, op, name string, fn func() (T, error), cleanup func(T)) (T, error) {
+	if encFs != nil && encFs.selfTestErr != nil {
+		// no I/O after a failed self test
+		var zero T
+		return zero, &os.PathError{Op: op, Path: name, Err: encFs.selfTestErr}
+	}
+	if !encFs.hasOperationDeadline() {
+		return fn()
+	}
+	var zero T
+	ctx := encFs.operationContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if encFs.operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, encFs.operationTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return zero, &OperationTimeoutError{Op: op, Path: name, Err: err}
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		resultChan <- result{value, err}
+	}()
+	select {
+	case r := <-resultChan:
+		return r.value, r.err
+	case <-ctx.Done():
+		if cleanup != nil {
+			go func() {
+				r := <-resultChan
+				if r.err == nil {
+					cleanup(r.value)
+				}
+			}()
+		}
+		return zero, &OperationTimeoutError{Op: op, Path: name, Err: ctx.Err()}
+	}
+}
+
+func closeAbandonedFile(file afero.File) {
+	if file != nil {
+		_ = file.Close()
+	}
+}
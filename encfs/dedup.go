@@ -0,0 +1,114 @@
+package encfs
+
+import (
+	"os"
+)
+
+type DedupReport struct {
+	FileCount int `json:"file_count"`
+	// LogicalBytes is the plaintext size of all files
+	LogicalBytes     int64 `json:"logical_bytes"`
+	ChunkRefCount    int   `json:"chunk_ref_count"`
+	UniqueChunkCount int   `json:"unique_chunk_count"`
+	// SharedChunkCount counts chunks referenced more than once
+	SharedChunkCount int `json:"shared_chunk_count"`
+	// UniqueBytes is the plaintext size of unique chunks, StoredBytes their size on disk
+	UniqueBytes int64 `json:"unique_bytes"`
+	StoredBytes int64 `json:"stored_bytes"`
+	// DedupRatio is LogicalBytes / UniqueBytes, 1 means nothing is deduplicated
+	DedupRatio float64 `json:"dedup_ratio"`
+}
+
+// DedupStats reports how well chunks are deduplicated across all files, chunks not referenced by any file
+// are left to CollectGarbage and not counted
+func (chunkFs *ChunkStoreFs) DedupStats() (*DedupReport, error) {
+	chunkFs.volumeLock.RLock()
+	defer chunkFs.volumeLock.RUnlock()
+
+	report := &DedupReport{}
+	chunkRefCounts := make(map[string]int)
+	chunkSizes := make(map[string]int64)
+	err := chunkFs.walkManifests(func(treeName string, manifest *ChunkManifest) error {
+		report.FileCount++
+		report.LogicalBytes += manifest.Size
+		for _, chunkRef := range manifest.Chunks {
+			report.ChunkRefCount++
+			chunkRefCounts[chunkRef.Id]++
+			chunkSizes[chunkRef.Id] = chunkRef.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for id, chunkRefCount := range chunkRefCounts {
+		report.UniqueChunkCount++
+		if chunkRefCount > 1 {
+			report.SharedChunkCount++
+		}
+		report.UniqueBytes += chunkSizes[id]
+		storedSize, err := chunkFs.storedChunkSize(id)
+		if err != nil {
+			return nil, err
+		}
+		report.StoredBytes += storedSize
+	}
+	report.DedupRatio = 1
+	if report.UniqueBytes > 0 {
+		report.DedupRatio = float64(report.LogicalBytes) / float64(report.UniqueBytes)
+	}
+	return report, nil
+}
+
+// ReclaimableBytes returns the on-disk size of the chunks only referenced by name, the space CollectGarbage frees
+// after name is removed
+func (chunkFs *ChunkStoreFs) ReclaimableBytes(name string) (int64, error) {
+	chunkFs.volumeLock.RLock()
+	defer chunkFs.volumeLock.RUnlock()
+
+	manifest, err := chunkFs.readManifest(chunkFs.treeName(name))
+	if err != nil {
+		return 0, err
+	}
+	ownIds := make(map[string]bool)
+	for _, chunkRef := range manifest.Chunks {
+		ownIds[chunkRef.Id] = true
+	}
+	ownTreeName := chunkFs.treeName(name)
+	err = chunkFs.walkManifests(func(treeName string, manifest *ChunkManifest) error {
+		if treeName == ownTreeName {
+			return nil
+		}
+		for _, chunkRef := range manifest.Chunks {
+			delete(ownIds, chunkRef.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	reclaimableBytes := int64(0)
+	for id := range ownIds {
+		storedSize, err := chunkFs.storedChunkSize(id)
+		if err != nil {
+			return 0, err
+		}
+		reclaimableBytes += storedSize
+	}
+	return reclaimableBytes, nil
+}
+
+// storedChunkSize returns the on-disk size of chunk id, 0 when it is missing
+func (chunkFs *ChunkStoreFs) storedChunkSize(id string) (int64, error) {
+	if !isChunkId(id) {
+		return 0, ErrBadChunkManifest
+	}
+	fileInfo, err := chunkFs.backend().Stat(chunkFs.chunkName(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
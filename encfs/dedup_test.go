@@ -0,0 +1,93 @@
+package encfs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDedupStats(t *testing.T) {
+	shared := testRandomBytes(1<<20, 1)
+	tests := []struct {
+		name           string
+		files          map[string][]byte
+		wantSharedAll  bool
+		wantRatio      float64
+		wantReclaimAll bool
+	}{
+		{"empty", map[string][]byte{}, false, 1, false},
+		{"distinct", map[string][]byte{"/a": shared, "/b": testRandomBytes(1<<20, 2)}, false, 1, true},
+		{"copies", map[string][]byte{"/a": shared, "/b": shared}, true, 2, false},
+		{"three copies", map[string][]byte{"/a": shared, "/b": shared, "/c": shared}, true, 3, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkFs := newTestChunkStoreFs(t)
+			var logicalBytes int64
+			for name, data := range test.files {
+				writeTestFile(t, chunkFs, name, data)
+				logicalBytes += int64(len(data))
+			}
+			report, err := chunkFs.DedupStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.FileCount != len(test.files) || report.LogicalBytes != logicalBytes {
+				t.Fatalf("got %d files of %d bytes, want %d of %d", report.FileCount, report.LogicalBytes,
+					len(test.files), logicalBytes)
+			}
+			if math.Abs(report.DedupRatio-test.wantRatio) > 0.001 {
+				t.Fatalf("got ratio %f, want %f", report.DedupRatio, test.wantRatio)
+			}
+			if test.wantSharedAll && report.SharedChunkCount != report.UniqueChunkCount {
+				t.Fatalf("%d of %d chunks shared", report.SharedChunkCount, report.UniqueChunkCount)
+			}
+			if !test.wantSharedAll && report.SharedChunkCount != 0 {
+				t.Fatalf("%d chunks shared", report.SharedChunkCount)
+			}
+			// chunks are stored encrypted, so larger than their plaintext
+			if report.StoredBytes < report.UniqueBytes {
+				t.Fatalf("stored %d bytes of %d unique bytes", report.StoredBytes, report.UniqueBytes)
+			}
+
+			// only chunks no other file references are reclaimable
+			var reclaimableBytes int64
+			for name := range test.files {
+				fileReclaimableBytes, err := chunkFs.ReclaimableBytes(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (fileReclaimableBytes > 0) != test.wantReclaimAll {
+					t.Fatalf("%s: %d reclaimable bytes", name, fileReclaimableBytes)
+				}
+				reclaimableBytes += fileReclaimableBytes
+			}
+			if test.wantReclaimAll && reclaimableBytes != report.StoredBytes {
+				t.Fatalf("got %d reclaimable bytes, want %d", reclaimableBytes, report.StoredBytes)
+			}
+		})
+	}
+}
+
+func TestReclaimableBytesAfterRemove(t *testing.T) {
+	chunkFs := newTestChunkStoreFs(t)
+	data := testRandomBytes(1<<20, 1)
+	writeTestFile(t, chunkFs, "/a", data)
+	writeTestFile(t, chunkFs, "/b", data)
+	if err := chunkFs.Remove("/b"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := chunkFs.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaimableBytes, err := chunkFs.ReclaimableBytes("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimableBytes == 0 || reclaimableBytes != report.StoredBytes {
+		t.Fatalf("got %d reclaimable bytes, want %d", reclaimableBytes, report.StoredBytes)
+	}
+	if _, err := chunkFs.ReclaimableBytes("/b"); err == nil {
+		t.Fatal("got reclaimable bytes of a removed file")
+	}
+}
@@ -0,0 +1,95 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskUsageOptions selects what is counted in TotalBytes of DiskUsage, the other sizes are always reported
+type DiskUsageOptions struct {
+	// IncludeOverhead counts meta files, integrity tags, lookup tables, headers and chunk tags
+	IncludeOverhead bool
+	// IncludeTemp counts leftovers of interrupted rekey, migrate and atomic writes
+	IncludeTemp bool
+	// Filter selects files and directories by plaintext path, all are selected when nil, meta and temp files
+	// have no plaintext path and are always counted
+	Filter func(name string, fileInfo os.FileInfo) bool
+}
+
+type DiskUsageReport struct {
+	FileCount     int   `json:"file_count"`
+	DirCount      int   `json:"dir_count"`
+	LogicalBytes  int64 `json:"logical_bytes"`
+	OverheadBytes int64 `json:"overhead_bytes"`
+	TempFileCount int   `json:"temp_file_count"`
+	TempBytes     int64 `json:"temp_bytes"`
+	TotalBytes    int64 `json:"total_bytes"`
+}
+
+// DiskUsage reports the size of the tree under root, logical bytes are plaintext sizes, overhead is what the
+// encryption adds on disk, answers what is actually using space in a volume
+func (encFs *EncFs) DiskUsage(root string, options *DiskUsageOptions) (*DiskUsageReport, error) {
+	if options == nil {
+		options = &DiskUsageOptions{}
+	}
+	report := &DiskUsageReport{}
+	err := encFs.walkEncryptedInternal(root, true, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if plainName == "" {
+			if isTempFileName(fileInfo.Name()) {
+				report.TempFileCount++
+				report.TempBytes += fileInfo.Size()
+			} else {
+				report.OverheadBytes += fileInfo.Size()
+			}
+			return nil
+		}
+		if options.Filter != nil && !options.Filter(plainName, fileInfo) {
+			return nil
+		}
+		if fileInfo.IsDir() {
+			if plainName != root {
+				report.DirCount++
+			}
+			return nil
+		}
+		if isAtomicTempFileName(filepath.Base(plainName)) {
+			report.TempFileCount++
+			report.TempBytes += fileInfo.Size()
+			return nil
+		}
+		report.FileCount++
+		logicalSize := fileInfo.Size()
+		if fileInfo.Mode().IsRegular() {
+			if encFileMeta, headerSize, err := encFs.readFileMeta(encryptedName); err == nil && encFileMeta != nil {
+				logicalSize = encFs.fileLogicalSize(encryptedName, encFileMeta, headerSize, fileInfo.Size())
+			}
+		}
+		report.LogicalBytes += logicalSize
+		report.OverheadBytes += fileInfo.Size() - logicalSize
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.TotalBytes = report.LogicalBytes
+	if options.IncludeOverhead {
+		report.TotalBytes += report.OverheadBytes
+	}
+	if options.IncludeTemp {
+		report.TotalBytes += report.TempBytes
+	}
+	return report, nil
+}
+
+// isTempFileName reports on-disk temp files left by interrupted rekey, migrate, merkle root, truncate or meta creates
+func isTempFileName(name string) bool {
+	return strings.HasSuffix(name, REKEY_TEMP_FILE_SUFFIX) || strings.HasSuffix(name, REKEY_TEMP_META_FILE_SUFFIX) ||
+		strings.HasSuffix(name, MIGRATE_TEMP_META_FILE_SUFFIX) || strings.HasSuffix(name, MERKLE_TEMP_META_FILE_SUFFIX) ||
+		strings.HasSuffix(name, TRUNCATE_TEMP_META_FILE_SUFFIX) || strings.HasSuffix(name, NEW_TEMP_META_FILE_SUFFIX)
+}
+
+// isAtomicTempFileName reports plaintext names of temp files of WriteFileAtomic
+func isAtomicTempFileName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ATOMIC_TEMP_FILE_SUFFIX)
+}
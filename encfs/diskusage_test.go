@@ -0,0 +1,95 @@
+package encfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestDiskUsage(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentCipher string
+		fileFormat    FileFormat
+		options       *DiskUsageOptions
+		root          string
+		wantFiles     int
+		wantDirs      int
+		wantLogical   int64
+	}{
+		{"ctr", CIPHER_AES_CTR, FILE_FORMAT_SIDECAR, nil, "/", 3, 2, 5000 + 3 + 2*CONTENT_CHUNK_SIZE},
+		{"gcm", CIPHER_AES_GCM, FILE_FORMAT_SIDECAR, nil, "/", 3, 2, 5000 + 3 + 2*CONTENT_CHUNK_SIZE},
+		{"ctr header", CIPHER_AES_CTR, FILE_FORMAT_HEADER, nil, "/", 3, 2, 5000 + 3 + 2*CONTENT_CHUNK_SIZE},
+		{"overhead and temp", CIPHER_AES_GCM, FILE_FORMAT_SIDECAR,
+			&DiskUsageOptions{IncludeOverhead: true, IncludeTemp: true}, "/", 3, 2, 5000 + 3 + 2*CONTENT_CHUNK_SIZE},
+		{"subtree", CIPHER_AES_CTR, FILE_FORMAT_SIDECAR, nil, "/dir", 2, 1, 3 + 2*CONTENT_CHUNK_SIZE},
+		{"filter", CIPHER_AES_CTR, FILE_FORMAT_SIDECAR, &DiskUsageOptions{
+			Filter: func(name string, fileInfo os.FileInfo) bool { return !strings.HasSuffix(name, "big") },
+		}, "/", 2, 2, 5000 + 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithFileFormat(test.fileFormat)
+			if err := encFs.WithContentCipher(test.contentCipher); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/a", testPattern(5000))
+			writeTestFile(t, encFs, "/dir/b", []byte("abc"))
+			writeTestFile(t, encFs, "/dir/sub/big", testPattern(2*CONTENT_CHUNK_SIZE))
+			// leftovers of an interrupted rekey and an interrupted atomic write
+			writeTestFile(t, base, encFs.encryptFileName("/dir/b")+REKEY_TEMP_FILE_SUFFIX, []byte("rekey"))
+			writeTestFile(t, encFs, "/dir/.b"+ATOMIC_TEMP_FILE_SUFFIX+"0001", []byte("atomic"))
+
+			report, err := encFs.DiskUsage(test.root, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.FileCount != test.wantFiles || report.DirCount != test.wantDirs {
+				t.Fatalf("got %d files and %d dirs, want %d and %d", report.FileCount, report.DirCount,
+					test.wantFiles, test.wantDirs)
+			}
+			if report.LogicalBytes != test.wantLogical {
+				t.Fatalf("got %d logical bytes, want %d", report.LogicalBytes, test.wantLogical)
+			}
+			if report.TempFileCount != 2 {
+				t.Fatalf("got %d temp files, want 2", report.TempFileCount)
+			}
+			if report.OverheadBytes <= 0 {
+				t.Fatalf("got %d overhead bytes", report.OverheadBytes)
+			}
+			wantTotal := report.LogicalBytes
+			if test.options != nil && test.options.IncludeOverhead {
+				wantTotal += report.OverheadBytes
+			}
+			if test.options != nil && test.options.IncludeTemp {
+				wantTotal += report.TempBytes
+			}
+			if report.TotalBytes != wantTotal {
+				t.Fatalf("got %d total bytes, want %d", report.TotalBytes, wantTotal)
+			}
+			if test.options != nil || test.root != "/" {
+				return
+			}
+			// every byte of the backend is logical, overhead or temp
+			var backendBytes int64
+			err = afero.Walk(base, "/", func(name string, fileInfo os.FileInfo, err error) error {
+				if err == nil && !fileInfo.IsDir() {
+					backendBytes += fileInfo.Size()
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum := report.LogicalBytes + report.OverheadBytes + report.TempBytes; sum != backendBytes {
+				t.Fatalf("reported %d bytes, backend holds %d", sum, backendBytes)
+			}
+		})
+	}
+}
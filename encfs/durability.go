@@ -0,0 +1,42 @@
+package encfs
+
+import (
+	"path/filepath"
+)
+
+type DurabilityPolicy int
+
+const (
+	// Sync only syncs the data file
+	DURABILITY_POLICY_DATA DurabilityPolicy = iota
+	// Sync also syncs the meta file and the parent directory, once per handle
+	DURABILITY_POLICY_META
+	// like DURABILITY_POLICY_META and Close syncs written files
+	DURABILITY_POLICY_FULL
+)
+
+// WithDurabilityPolicy sets what Sync and Close make durable, DURABILITY_POLICY_DATA is the default,
+// without syncing meta files a power cut can lose the IV of data which survived
+func (encFs *EncFs) WithDurabilityPolicy(durabilityPolicy DurabilityPolicy) {
+	encFs.durabilityPolicy = durabilityPolicy
+}
+
+func (encFs *EncFs) getDurabilityPolicy() DurabilityPolicy {
+	return encFs.durabilityPolicy
+}
+
+// syncMeta syncs the meta file and the directory entries of the file and its meta
+func (f *EncFile) syncMeta() error {
+	if f.metaSynced || f.encFileMeta == nil {
+		return nil
+	}
+	encryptedName := f.file.Name()
+	if err := f.encFs.syncBackendFile(f.encFs.encFileMetaName(encryptedName)); err != nil {
+		return err
+	}
+	if err := f.encFs.syncBackendFile(filepath.Dir(encryptedName)); err != nil {
+		return err
+	}
+	f.metaSynced = true
+	return nil
+}
@@ -0,0 +1,83 @@
+package encfs
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestDurabilityPolicy(t *testing.T) {
+	const (
+		data = "sync /dir/file"
+		meta = "sync /dir/file" + EncFileExt
+		dir  = "sync /dir"
+	)
+	write := func(f afero.File) error {
+		_, err := f.Write([]byte("data"))
+		return err
+	}
+	type ops []func(f afero.File) error
+	tests := []struct {
+		name       string
+		policy     DurabilityPolicy
+		fileFormat FileFormat
+		flag       int
+		ops        ops
+		// wantSyncs are the syncs of the backend until the file is closed
+		wantSyncs []string
+	}{
+		{"data sync", DURABILITY_POLICY_DATA, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write, afero.File.Sync},
+			[]string{data}},
+		{"data close", DURABILITY_POLICY_DATA, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write}, nil},
+		{"meta sync", DURABILITY_POLICY_META, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write, afero.File.Sync},
+			[]string{data, meta, dir}},
+		// the meta file and directory are synced once per handle
+		{"meta sync twice", DURABILITY_POLICY_META, FILE_FORMAT_SIDECAR, os.O_RDWR,
+			ops{write, afero.File.Sync, write, afero.File.Sync}, []string{data, meta, dir, data}},
+		{"meta close", DURABILITY_POLICY_META, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write}, nil},
+		// header format files have no meta file
+		{"meta sync header", DURABILITY_POLICY_META, FILE_FORMAT_HEADER, os.O_RDWR, ops{write, afero.File.Sync},
+			[]string{data, dir}},
+		{"full close", DURABILITY_POLICY_FULL, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write},
+			[]string{data, meta, dir}},
+		// Close syncs the written data again, the meta file and directory once per handle
+		{"full sync", DURABILITY_POLICY_FULL, FILE_FORMAT_SIDECAR, os.O_RDWR, ops{write, afero.File.Sync},
+			[]string{data, meta, dir, data}},
+		// files which were not written are not synced by Close
+		{"full close clean", DURABILITY_POLICY_FULL, FILE_FORMAT_SIDECAR, os.O_RDONLY, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := newTestRecordingFs(afero.NewMemMapFs())
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			encFs.WithDurabilityPolicy(test.policy)
+			encFs.WithFileFormat(test.fileFormat)
+			writeTestFile(t, encFs, "/dir/file", []byte("old"))
+			f, err := encFs.OpenFile("/dir/file", test.flag, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base.takeCalls()
+			for _, op := range test.ops {
+				if err := op(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var syncs []string
+			for _, call := range base.takeCalls() {
+				if strings.HasPrefix(call, "sync ") {
+					syncs = append(syncs, call)
+				}
+			}
+			if !reflect.DeepEqual(syncs, test.wantSyncs) {
+				t.Fatalf("got %q, want %q", syncs, test.wantSyncs)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	ENCRYPT_TREE_STAGING_DIR_NAME = "__ENCFS_ENCRYPT_TREE__" + EncFileExt
+	ENCRYPT_TREE_TEMP_FILE_SUFFIX = ".__encrypttree"
+)
+
+var (
+	ErrEncryptTreeUnsupportedFile = errors.New("only files, directories and symlinks can be encrypted")
+)
+
+type EncryptTreeReport struct {
+	ScannedCount   int   `json:"scanned_count"`
+	EncryptedCount int   `json:"encrypted_count"`
+	SkippedCount   int   `json:"skipped_count"`
+	EncryptedBytes int64 `json:"encrypted_bytes"`
+}
+
+type EncryptTreeOptions struct {
+	// RemoveSource removes every source file once it is encrypted and the source directories at the end
+	RemoveSource bool
+	// Progress is called after every file with its name relative to the source root
+	Progress func(name string, report *EncryptTreeReport)
+}
+
+// encryptTreeDir is a directory of the source, its mode and time are applied once the files in it are written
+type encryptTreeDir struct {
+	sourceName string
+	name       string
+	fileInfo   os.FileInfo
+}
+
+// EncryptTree encrypts the plaintext tree sourceRoot of source into root of encFs keeping modes and modification
+// times, files already in encFs with the size and modification time of their source are skipped, so an interrupted
+// EncryptTree is resumed by calling it again, files are written to a temp name first and renamed when complete
+func (encFs *EncFs) EncryptTree(ctx context.Context, source afero.Fs, sourceRoot, root string,
+	options *EncryptTreeOptions) (*EncryptTreeReport, error) {
+	if options == nil {
+		options = &EncryptTreeOptions{}
+	}
+	report := &EncryptTreeReport{}
+	var dirs []encryptTreeDir
+	err := afero.Walk(source, sourceRoot, func(sourceName string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relName, err := filepath.Rel(sourceRoot, sourceName)
+		if err != nil {
+			return err
+		}
+		relName = filepath.ToSlash(relName)
+		name := path.Join(root, relName)
+		if fileInfo.IsDir() {
+			if err := encFs.MkdirAll(name, 0700); err != nil {
+				return err
+			}
+			if relName != "." {
+				dirs = append(dirs, encryptTreeDir{sourceName: sourceName, name: name, fileInfo: fileInfo})
+			}
+			return nil
+		}
+		report.ScannedCount++
+		encrypted, err := encFs.encryptTreeFile(source, sourceName, name, fileInfo)
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			report.EncryptedCount++
+			report.EncryptedBytes += fileInfo.Size()
+		} else {
+			report.SkippedCount++
+		}
+		if options.RemoveSource {
+			if err := source.Remove(sourceName); err != nil {
+				return err
+			}
+		}
+		if options.Progress != nil {
+			options.Progress(relName, report)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	// directories are finished in reverse order, children before their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if err := encFs.Chmod(dir.name, dir.fileInfo.Mode().Perm()); err != nil {
+			return report, err
+		}
+		if err := encFs.Chtimes(dir.name, dir.fileInfo.ModTime(), dir.fileInfo.ModTime()); err != nil {
+			return report, err
+		}
+		if options.RemoveSource {
+			if err := source.Remove(dir.sourceName); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// encryptTreeFile encrypts sourceName into name unless name already has its size and modification time
+func (encFs *EncFs) encryptTreeFile(source afero.Fs, sourceName, name string, fileInfo os.FileInfo) (bool, error) {
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		return encFs.encryptTreeSymlink(source, sourceName, name)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return false, &os.PathError{Op: "encrypttree", Path: sourceName, Err: ErrEncryptTreeUnsupportedFile}
+	}
+	if existingInfo, err := encFs.Stat(name); err == nil && existingInfo.Mode().IsRegular() &&
+		existingInfo.Size() == fileInfo.Size() && existingInfo.ModTime().Equal(fileInfo.ModTime()) {
+		return false, nil
+	}
+	sourceFile, err := source.Open(sourceName)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = sourceFile.Close()
+	}()
+	tempName := name + ENCRYPT_TREE_TEMP_FILE_SUFFIX
+	tempFile, err := encFs.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(tempFile, sourceFile); err != nil {
+		_ = tempFile.Close()
+		return false, err
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		return false, err
+	}
+	if err := tempFile.Close(); err != nil {
+		return false, err
+	}
+	if err := encFs.Chmod(tempName, fileInfo.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := encFs.Chtimes(tempName, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		return false, err
+	}
+	return true, encFs.Rename(tempName, name)
+}
+
+func (encFs *EncFs) encryptTreeSymlink(source afero.Fs, sourceName, name string) (bool, error) {
+	linkReader, ok := source.(afero.LinkReader)
+	if !ok {
+		return false, &os.PathError{Op: "encrypttree", Path: sourceName, Err: ErrEncryptTreeUnsupportedFile}
+	}
+	linkTarget, err := linkReader.ReadlinkIfPossible(sourceName)
+	if err != nil {
+		return false, err
+	}
+	// symlinks are created once, targets read back are backend names which can not be compared to the source
+	if existingInfo, _, err := encFs.LstatIfPossible(name); err == nil && existingInfo.Mode()&os.ModeSymlink != 0 {
+		return false, nil
+	}
+	// targets of EncFs symlinks are names in the volume, relative targets are resolved from the link
+	if !path.IsAbs(linkTarget) {
+		linkTarget = path.Join(path.Dir(name), linkTarget)
+	}
+	return true, encFs.SymlinkIfPossible(linkTarget, name)
+}
+
+// EncryptTreeInPlace encrypts the plaintext tree in root of base into a new volume in root, the tree is moved into
+// ENCRYPT_TREE_STAGING_DIR_NAME first and every file is removed from there once it is encrypted, call it again
+// with the same passphrase to resume an interrupted run, a volume without staging dir is opened and left unchanged,
+// directories emptied by an interrupted run get the modification times of the resumed run
+func EncryptTreeInPlace(ctx context.Context, base afero.Fs, root, passphrase string, volumeOptions *VolumeOptions,
+	options *EncryptTreeOptions) (*EncFs, *EncryptTreeReport, error) {
+	stagingName := filepath.Join(root, ENCRYPT_TREE_STAGING_DIR_NAME)
+	_, stagingErr := base.Stat(stagingName)
+	if stagingErr != nil && !os.IsNotExist(stagingErr) {
+		return nil, nil, stagingErr
+	}
+	_, configErr := base.Stat(filepath.Join(root, VOLUME_CONFIG_FILE_NAME))
+	if configErr != nil && !os.IsNotExist(configErr) {
+		return nil, nil, configErr
+	}
+	if configErr == nil && stagingErr != nil {
+		encFs, err := OpenVolume(base, root, passphrase)
+		return encFs, &EncryptTreeReport{}, err
+	}
+
+	var encFs *EncFs
+	var err error
+	if configErr != nil {
+		// the volume is created once the whole tree is staged, a missing config means staging was interrupted
+		if err := stageEncryptTree(base, root, stagingName); err != nil {
+			return nil, nil, err
+		}
+		encFs, err = InitVolume(base, root, passphrase, volumeOptions)
+	} else {
+		encFs, err = OpenVolume(base, root, passphrase)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	withOptions := EncryptTreeOptions{RemoveSource: true}
+	if options != nil {
+		withOptions.Progress = options.Progress
+	}
+	report, err := encFs.EncryptTree(ctx, afero.NewBasePathFs(base, stagingName), "/", "/", &withOptions)
+	if err != nil {
+		return encFs, report, err
+	}
+	return encFs, report, base.Remove(stagingName)
+}
+
+// stageEncryptTree moves every entry of root but the staging dir into the staging dir
+func stageEncryptTree(base afero.Fs, root, stagingName string) error {
+	if err := base.MkdirAll(stagingName, 0700); err != nil {
+		return err
+	}
+	entries, err := afero.ReadDir(base, root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == ENCRYPT_TREE_STAGING_DIR_NAME || strings.HasSuffix(entry.Name(), EncFileExt) {
+			continue
+		}
+		if err := base.Rename(filepath.Join(root, entry.Name()), filepath.Join(stagingName, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// writeTestTree writes files into fs with mode 0640 and modTime, parent directories get mode 0750
+func writeTestTree(t *testing.T, fs afero.Fs, root string, files map[string][]byte, modTime time.Time) {
+	t.Helper()
+	for name, data := range files {
+		name = filepath.Join(root, name)
+		if err := fs.MkdirAll(filepath.Dir(name), 0750); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, fs, name, data)
+		if err := fs.Chmod(name, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTestTree checks the contents, modes and modification times of files written by writeTestTree
+func checkTestTree(t *testing.T, fs afero.Fs, root string, files map[string][]byte, modTime time.Time) {
+	t.Helper()
+	for name, data := range files {
+		name = filepath.Join(root, name)
+		checkTestFile(t, fs, name, data)
+		fileInfo, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Mode() != 0640 || !fileInfo.ModTime().Equal(modTime) {
+			t.Fatalf("%s: got mode %v and time %v", name, fileInfo.Mode(), fileInfo.ModTime())
+		}
+	}
+}
+
+func TestEncryptTree(t *testing.T) {
+	modTime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	files := map[string][]byte{
+		"/plainname.txt":  []byte("text"),
+		"/empty":          {},
+		"/dir/large":      testPattern(3*CONTENT_CHUNK_SIZE + 17),
+		"/dir/sub/nested": []byte("nested"),
+	}
+	tests := []struct {
+		name    string
+		options *EncryptTreeOptions
+		// prepare changes the source or the volume after a first complete EncryptTree, nil runs once
+		prepare func(t *testing.T, source afero.Fs, encFs *EncFs)
+		// changedFiles are the files changed by prepare
+		changedFiles map[string][]byte
+		wantReport   EncryptTreeReport
+		wantRemoved  bool
+	}{
+		{"new tree", nil, nil, nil, EncryptTreeReport{4, 4, 0, 3*CONTENT_CHUNK_SIZE + 27}, false},
+		{"remove source", &EncryptTreeOptions{RemoveSource: true}, nil, nil,
+			EncryptTreeReport{4, 4, 0, 3*CONTENT_CHUNK_SIZE + 27}, true},
+		// files with the size and modification time of their source are skipped
+		{"resumed", nil, func(t *testing.T, source afero.Fs, encFs *EncFs) {}, nil,
+			EncryptTreeReport{4, 0, 4, 0}, false},
+		{"changed source", nil, func(t *testing.T, source afero.Fs, encFs *EncFs) {
+			writeTestTree(t, source, "/src", map[string][]byte{"/plainname.txt": []byte("TEXT!")}, modTime)
+		}, map[string][]byte{"/plainname.txt": []byte("TEXT!")}, EncryptTreeReport{4, 1, 3, 5}, false},
+		// temp files of an interrupted run are overwritten
+		{"interrupted file", nil, func(t *testing.T, source afero.Fs, encFs *EncFs) {
+			if err := encFs.Remove("/enc/dir/sub/nested"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/enc/dir/sub/nested"+ENCRYPT_TREE_TEMP_FILE_SUFFIX, []byte("partial data"))
+		}, nil, EncryptTreeReport{4, 1, 3, 6}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := afero.NewMemMapFs()
+			writeTestTree(t, source, "/src", files, modTime)
+			if err := source.Chtimes("/src/dir", modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if test.prepare != nil {
+				if _, err := encFs.EncryptTree(context.Background(), source, "/src", "/enc", nil); err != nil {
+					t.Fatal(err)
+				}
+				test.prepare(t, source, encFs)
+			}
+			wantFiles := make(map[string][]byte, len(files))
+			for name, data := range files {
+				wantFiles[name] = data
+			}
+			for name, data := range test.changedFiles {
+				wantFiles[name] = data
+			}
+			var progress []string
+			options := test.options
+			if options == nil {
+				options = &EncryptTreeOptions{}
+			}
+			options.Progress = func(name string, report *EncryptTreeReport) {
+				progress = append(progress, name)
+			}
+			report, err := encFs.EncryptTree(context.Background(), source, "/src", "/enc", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *report != test.wantReport {
+				t.Fatalf("got report %+v, want %+v", *report, test.wantReport)
+			}
+			wantProgress := []string{"dir/large", "dir/sub/nested", "empty", "plainname.txt"}
+			if !reflect.DeepEqual(progress, wantProgress) {
+				t.Fatalf("got progress %v, want %v", progress, wantProgress)
+			}
+			checkTestTree(t, encFs, "/enc", wantFiles, modTime)
+			fileInfo, err := encFs.Stat("/enc/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Mode() != os.ModeDir|0750 || !fileInfo.ModTime().Equal(modTime) {
+				t.Fatalf("/enc/dir: got mode %v and time %v", fileInfo.Mode(), fileInfo.ModTime())
+			}
+			if exists, err := afero.Exists(encFs, "/enc/dir/sub/nested"+ENCRYPT_TREE_TEMP_FILE_SUFFIX); err != nil ||
+				exists {
+				t.Fatalf("a temp file is left: %v", err)
+			}
+			// the source root is kept, its entries are removed
+			if exists, err := afero.Exists(source, "/src/dir"); err != nil || exists != !test.wantRemoved {
+				t.Fatalf("got source %t, want %t: %v", exists, !test.wantRemoved, err)
+			}
+		})
+	}
+}
+
+// testLstatFs has symlinks but can not read their targets
+type testLstatFs struct {
+	afero.Fs
+}
+
+func (fs testLstatFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	return fs.Fs.(afero.Lstater).LstatIfPossible(name)
+}
+func TestEncryptTreeSymlinks(t *testing.T) {
+	tests := []struct {
+		name       string
+		linkTarget string
+		wantTarget string
+	}{
+		// relative targets are resolved from the link
+		{"relative", "sub/nested", "/enc/dir/sub/nested"},
+		{"parent", "../plainname.txt", "/enc/plainname.txt"},
+		{"absolute", "/enc/plainname.txt", "/enc/plainname.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := testLinkFs{afero.NewBasePathFs(afero.NewOsFs(), t.TempDir()).(*afero.BasePathFs)}
+			writeTestTree(t, source, "/src", map[string][]byte{"/dir/sub/nested": []byte("nested")}, time.Now())
+			if err := source.SymlinkIfPossible(test.linkTarget, "/src/dir/link"); err != nil {
+				t.Fatal(err)
+			}
+			encFs := newTestArchiveFs(t)
+			// symlinks are created once, the second run skips the file and the link
+			linkSize := int64(len(test.linkTarget))
+			for i, wantReport := range []EncryptTreeReport{{2, 2, 0, 6 + linkSize}, {2, 0, 2, 0}} {
+				report, err := encFs.EncryptTree(context.Background(), source, "/src", "/enc", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *report != wantReport {
+					t.Fatalf("run %d: got report %+v, want %+v", i, *report, wantReport)
+				}
+			}
+			if linkTarget, err := encFs.ReadlinkIfPossible("/enc/dir/link"); err != nil || linkTarget != test.wantTarget {
+				t.Fatalf("got link target %q: %v", linkTarget, err)
+			}
+		})
+	}
+	// sources without symlinks support can not encrypt them
+	source := testLinkFs{afero.NewBasePathFs(afero.NewOsFs(), t.TempDir()).(*afero.BasePathFs)}
+	if err := source.SymlinkIfPossible("target", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	encFs := newTestArchiveFs(t)
+	_, err := encFs.EncryptTree(context.Background(), testLstatFs{source.BasePathFs}, "/", "/enc", nil)
+	if !errors.Is(err, ErrEncryptTreeUnsupportedFile) {
+		t.Fatalf("got %v, want %v", err, ErrEncryptTreeUnsupportedFile)
+	}
+}
+
+func TestEncryptTreeCancelled(t *testing.T) {
+	source := afero.NewMemMapFs()
+	writeTestTree(t, source, "/", map[string][]byte{"/a": []byte("a"), "/b": []byte("b")}, time.Now())
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	report, err := encFs.EncryptTree(ctx, source, "/", "/", &EncryptTreeOptions{
+		Progress: func(name string, report *EncryptTreeReport) { cancel() },
+	})
+	if !errors.Is(err, context.Canceled) || report.EncryptedCount != 1 {
+		t.Fatalf("got report %+v: %v", *report, err)
+	}
+	checkTestFile(t, encFs, "/a", []byte("a"))
+	if exists, err := afero.Exists(encFs, "/b"); err != nil || exists {
+		t.Fatalf("encrypted a file after cancel: %v", err)
+	}
+}
+
+func TestEncryptTreeInPlace(t *testing.T) {
+	modTime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	files := map[string][]byte{
+		"/plainname.txt":  []byte("text"),
+		"/dir/large":      testPattern(2*CONTENT_CHUNK_SIZE + 1),
+		"/dir/sub/nested": []byte("nested"),
+	}
+	tests := []struct {
+		name string
+		// interruptAfter is the number of files encrypted before a first run is cancelled, -1 runs once
+		interruptAfter int
+		// stageOnly stages the tree without creating the volume, like a run interrupted while staging
+		stageOnly bool
+	}{
+		{"complete", -1, false},
+		{"interrupted before the first file", 0, false},
+		{"interrupted after a file", 1, false},
+		{"interrupted while staging", -1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			writeTestTree(t, base, "/volume", files, modTime)
+			volumeOptions := &VolumeOptions{Kdf: testKdfParams()}
+			if test.stageOnly {
+				if err := stageEncryptTree(base, "/volume",
+					filepath.Join("/volume", ENCRYPT_TREE_STAGING_DIR_NAME)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.interruptAfter >= 0 {
+				ctx, cancel := context.WithCancel(context.Background())
+				if test.interruptAfter == 0 {
+					cancel()
+				}
+				_, report, err := EncryptTreeInPlace(ctx, base, "/volume", "passphrase", volumeOptions,
+					&EncryptTreeOptions{Progress: func(name string, report *EncryptTreeReport) {
+						if report.EncryptedCount == test.interruptAfter {
+							cancel()
+						}
+					}})
+				cancel()
+				if !errors.Is(err, context.Canceled) || report.EncryptedCount != test.interruptAfter {
+					t.Fatalf("got report %+v: %v", report, err)
+				}
+				// a resumed run needs the passphrase of the volume
+				if _, _, err := EncryptTreeInPlace(context.Background(), base, "/volume", "other", volumeOptions,
+					nil); err == nil {
+					t.Fatal("resumed with another passphrase")
+				}
+			}
+			encFs, report, err := EncryptTreeInPlace(context.Background(), base, "/volume", "passphrase",
+				volumeOptions, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCount := len(files)
+			if test.interruptAfter > 0 {
+				wantCount -= test.interruptAfter
+			}
+			if report.EncryptedCount != wantCount {
+				t.Fatalf("got report %+v, want %d encrypted", *report, wantCount)
+			}
+			checkTestTree(t, encFs, "/", files, modTime)
+			if exists, err := afero.Exists(base, filepath.Join("/volume", ENCRYPT_TREE_STAGING_DIR_NAME)); err != nil ||
+				exists {
+				t.Fatalf("the staging dir is left: %v", err)
+			}
+			// no plaintext name is left in the backend
+			for name := range snapshotTestFs(t, base) {
+				for _, plainName := range []string{"plainname.txt", "large", "nested"} {
+					if filepath.Base(name) == plainName {
+						t.Fatalf("found plaintext name %s", name)
+					}
+				}
+			}
+
+			// a complete volume is opened and left unchanged
+			snapshot := snapshotTestFs(t, base)
+			encFs, report, err = EncryptTreeInPlace(context.Background(), base, "/volume", "passphrase",
+				volumeOptions, nil)
+			if err != nil || *report != (EncryptTreeReport{}) {
+				t.Fatalf("got report %+v: %v", report, err)
+			}
+			if !reflect.DeepEqual(snapshotTestFs(t, base), snapshot) {
+				t.Fatal("a complete volume was changed")
+			}
+			checkTestTree(t, encFs, "/", files, modTime)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// FIPS 140-2 monobit test, the number of ones in 20000 random bits must be in the open interval
+const (
+	RANDOM_SELF_TEST_BYTES    = 2500
+	RANDOM_SELF_TEST_MIN_ONES = 9725
+	RANDOM_SELF_TEST_MAX_ONES = 10275
+)
+
+var (
+	ErrBrokenRandomSource = errors.New("random source failed self test")
+)
+
+var (
+	defaultRandomSourceOnce = &sync.Once{}
+	defaultRandomSourceErr  error
+)
+
+// WithRandomSource sets the random source of IVs, nonces and object names, e.g. a HSM provided RNG or a
+// deterministic reader in test harnesses, the source is self tested first and refused when it looks broken
+func (encFs *EncFs) WithRandomSource(randomSource io.Reader) error {
+	if err := checkRandomSource(randomSource); err != nil {
+		return err
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	encFs.randomSource = randomSource
+	encFs.lastRandomBlock = nil
+	return nil
+}
+
+// checkRandomSource runs the monobit test and checks two samples differ, a stuck or constant source fails
+func checkRandomSource(randomSource io.Reader) error {
+	sample := make([]byte, RANDOM_SELF_TEST_BYTES)
+	if _, err := io.ReadFull(randomSource, sample); err != nil {
+		return err
+	}
+	ones := 0
+	for _, b := range sample {
+		ones += bits.OnesCount8(b)
+	}
+	if ones <= RANDOM_SELF_TEST_MIN_ONES || ones >= RANDOM_SELF_TEST_MAX_ONES {
+		return ErrBrokenRandomSource
+	}
+	next := make([]byte, 32)
+	if _, err := io.ReadFull(randomSource, next); err != nil {
+		return err
+	}
+	if bytes.Equal(next, sample[:32]) {
+		return ErrBrokenRandomSource
+	}
+	return nil
+}
+
+func (encFs *EncFs) getRandomSource() (io.Reader, error) {
+	if encFs != nil && encFs.randomSource != nil {
+		return encFs.randomSource, nil
+	}
+	// the default source is self tested once before first use
+	defaultRandomSourceOnce.Do(func() {
+		defaultRandomSourceErr = checkRandomSource(rand.Reader)
+	})
+	return rand.Reader, defaultRandomSourceErr
+}
+
+// readRandom fills p from the random source, a block repeating the previous one fails like the continuous
+// random number generator test, so a broken source never silently produces the same IVs
+func (encFs *EncFs) readRandom(p []byte) error {
+	randomSource, err := encFs.getRandomSource()
+	if err != nil {
+		return err
+	}
+	if encFs == nil {
+		_, err := io.ReadFull(randomSource, p)
+		return err
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	if _, err := io.ReadFull(randomSource, p); err != nil {
+		return err
+	}
+	if len(p) < 8 {
+		return nil
+	}
+	if bytes.Equal(p[:8], encFs.lastRandomBlock) {
+		return ErrBrokenRandomSource
+	}
+	encFs.lastRandomBlock = append(encFs.lastRandomBlock[:0], p[:8]...)
+	return nil
+}
@@ -0,0 +1,122 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// stuckReader reads from random until limit bytes were read, then repeats zeros
+type stuckReader struct {
+	random io.Reader
+	limit  int
+}
+
+func (r *stuckReader) Read(p []byte) (int, error) {
+	if r.limit <= 0 {
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	if len(p) > r.limit {
+		p = p[:r.limit]
+	}
+	n, err := r.random.Read(p)
+	r.limit -= n
+	return n, err
+}
+
+func TestCheckRandomSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		randomSource io.Reader
+		wantErr      error
+	}{
+		{"crypto", rand.Reader, nil},
+		{"seeded", mathrand.New(mathrand.NewSource(1)), nil},
+		{"zeros", bytes.NewReader(make([]byte, 2*RANDOM_SELF_TEST_BYTES)), ErrBrokenRandomSource},
+		{"ones", bytes.NewReader(bytes.Repeat([]byte{0xff}, 2*RANDOM_SELF_TEST_BYTES)), ErrBrokenRandomSource},
+		// half of the bits are set, only the repeated sample gives it away
+		{"constant", bytes.NewReader(bytes.Repeat([]byte{0x55}, 2*RANDOM_SELF_TEST_BYTES)), ErrBrokenRandomSource},
+		{"repeating", bytes.NewReader(bytes.Repeat(testRandomBytes(RANDOM_SELF_TEST_BYTES, 1), 2)),
+			ErrBrokenRandomSource},
+		{"short", bytes.NewReader(testRandomBytes(RANDOM_SELF_TEST_BYTES/2, 1)), io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			err := encFs.WithRandomSource(test.randomSource)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err != nil && encFs.randomSource != nil {
+				t.Fatal("refused source is used")
+			}
+		})
+	}
+}
+
+func TestRandomSourceOfFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		fileFormat FileFormat
+		cipher     string
+	}{
+		{"ctr", FILE_FORMAT_SIDECAR, CIPHER_AES_CTR},
+		{"gcm", FILE_FORMAT_SIDECAR, CIPHER_AES_GCM},
+		{"ctr header", FILE_FORMAT_HEADER, CIPHER_AES_CTR},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := testPattern(5000)
+			// the same seeded source gives the same ciphertext
+			var snapshots []map[string]string
+			for i := 0; i < 2; i++ {
+				encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				encFs.WithFileFormat(test.fileFormat)
+				if err := encFs.WithContentCipher(test.cipher); err != nil {
+					t.Fatal(err)
+				}
+				if err := encFs.WithRandomSource(mathrand.New(mathrand.NewSource(1))); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/file", data)
+				checkTestFile(t, encFs, "/file", data)
+				snapshots = append(snapshots, snapshotTestFs(t, base))
+			}
+			if len(snapshots[0]) == 0 || !equalTestSnapshots(snapshots[0], snapshots[1]) {
+				t.Fatal("seeded sources gave other files")
+			}
+		})
+	}
+}
+
+func TestRandomSourceStuckAfterCheck(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	// passes the self test, then repeats zeros for every IV
+	randomSource := &stuckReader{random: rand.Reader, limit: RANDOM_SELF_TEST_BYTES + 32}
+	if err := encFs.WithRandomSource(randomSource); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(encFs, "/file", []byte("data"), 0644); !errors.Is(err, ErrBrokenRandomSource) {
+		t.Fatalf("got %v, want %v", err, ErrBrokenRandomSource)
+	}
+}
+
+func equalTestSnapshots(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, contents := range a {
+		if b[name] != contents {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package encfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+const ETAG_KEY_INFO = "encfs-afero etag"
+
+// ETager is implemented by file infos knowing a validator of their contents, the method set matches
+// golang.org/x/net/webdav.ETager
+type ETager interface {
+	ETag(ctx context.Context) (string, error)
+}
+
+// ETag returns a quoted validator of name for conditional HTTP requests, it is derived from the IV,
+// on-disk size, modification time and merkle root without reading the contents, rewriting a file with the same
+// size within the timestamp resolution of the backend keeps the ETag
+func (encFs *EncFs) ETag(name string) (string, error) {
+	encryptedName := encFs.encryptFileName(name)
+	fileInfo, _, err := encFs.lstat(encryptedName)
+	if err != nil {
+		return "", err
+	}
+	return encFs.fileETag(encryptedName, fileInfo)
+}
+
+func (encFileInfo *EncFileInfo) ETag(ctx context.Context) (string, error) {
+	encryptedName := filepath.Join(encFileInfo.encryptedParentName, encFileInfo.FileInfo.Name())
+	return encFileInfo.encFile.encFs.fileETag(encryptedName, encFileInfo.FileInfo)
+}
+
+// fileETag keys the validator so it tells nothing about the file without the key
+func (encFs *EncFs) fileETag(encryptedName string, fileInfo os.FileInfo) (string, error) {
+	mac := hmac.New(sha256.New, hkdfSha256(encFs.key.key, nil, []byte(ETAG_KEY_INFO), 32))
+	stamp := make([]byte, 16)
+	binary.BigEndian.PutUint64(stamp[:8], uint64(fileInfo.Size()))
+	binary.BigEndian.PutUint64(stamp[8:], uint64(fileInfo.ModTime().UnixNano()))
+	mac.Write(stamp)
+	if fileInfo.Mode().IsRegular() {
+		encFileMeta, _, err := encFs.readFileMeta(encryptedName)
+		if err != nil {
+			return "", err
+		}
+		if encFileMeta != nil {
+			mac.Write(encFileMeta.Iv)
+			mac.Write(encFileMeta.MerkleRoot)
+		}
+	}
+	return "\"" + hex.EncodeToString(mac.Sum(nil)[:16]) + "\"", nil
+}
@@ -0,0 +1,113 @@
+package encfs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestETag(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(t *testing.T, encFs *EncFs) *EncFs
+		wantSame bool
+	}{
+		{"unchanged", func(t *testing.T, encFs *EncFs) *EncFs { return encFs }, true},
+		{"read", func(t *testing.T, encFs *EncFs) *EncFs {
+			readTestFile(t, encFs, "/file")
+			return encFs
+		}, true},
+		// a rewrite of the same size gets a new IV
+		{"rewritten", func(t *testing.T, encFs *EncFs) *EncFs {
+			writeTestFile(t, encFs, "/file", []byte("atad"))
+			return encFs
+		}, false},
+		{"appended", func(t *testing.T, encFs *EncFs) *EncFs {
+			f, err := encFs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			if _, err := f.Write([]byte("more")); err != nil {
+				t.Fatal(err)
+			}
+			return encFs
+		}, false},
+		{"touched", func(t *testing.T, encFs *EncFs) *EncFs {
+			modTime := time.Now().Add(-time.Hour)
+			if err := encFs.Chtimes("/file", modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			return encFs
+		}, false},
+		{"other key", func(t *testing.T, encFs *EncFs) *EncFs {
+			return NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(2), NewNoopNameMapper()),
+				encFs.base).(*EncFs)
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewNoopNameMapper()))
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			etag, err := encFs.ETag("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(etag) != 34 || !strings.HasPrefix(etag, "\"") || !strings.HasSuffix(etag, "\"") {
+				t.Fatalf("got etag %s", etag)
+			}
+			modifiedFs := test.modify(t, encFs)
+			modified, err := modifiedFs.ETag("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (modified == etag) != test.wantSame {
+				t.Fatalf("got %s and %s", etag, modified)
+			}
+		})
+	}
+}
+
+func TestETagOfFileInfos(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/dir/a", []byte("a"))
+	writeTestFile(t, encFs, "/dir/b", []byte("b"))
+	fileInfos, err := afero.ReadDir(encFs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etags := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		etager, ok := fileInfo.(ETager)
+		if !ok {
+			t.Fatalf("%s has no etag", fileInfo.Name())
+		}
+		etag, err := etager.ETag(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := encFs.ETag("/dir/" + fileInfo.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != want {
+			t.Fatalf("%s: got %s, want %s", fileInfo.Name(), etag, want)
+		}
+		etags[etag] = true
+	}
+	if len(etags) != 3 {
+		t.Fatalf("got %d etags of 3 files", len(etags))
+	}
+	if _, err := encFs.ETag("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+}
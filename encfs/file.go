@@ -1,68 +1,185 @@
 package encfs
 
 import (
+	"bytes"
 	"crypto/aes"
-	"crypto/rand"
+	"crypto/cipher"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
+	"io/fs"
 	"math"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
 const EncFileExt = ".__encfile"
 
+const (
+	TRUNCATE_TEMP_META_FILE_SUFFIX = ".__truncatemeta" + EncFileExt
+	NEW_TEMP_META_FILE_SUFFIX      = ".__newmeta" + EncFileExt
+)
+
 var (
 	ErrFileForbiddenFileExt = errors.New("file ext is forbidden")
+	ErrBadLookupTable       = errors.New("file name lookup table is broken")
+	ErrDecryptFailed        = errors.New("decrypt failed")
+	ErrMissingFileMeta      = errors.New("file has no encryption meta")
 )
 
 type EncFileMeta struct {
+	// Magic and Version are empty for files created before format versioning
+	Magic   string `json:"magic,omitempty"`
+	Version int    `json:"version,omitempty"`
+	// Flags are the META_FLAG features of ENC_FILE_META_VERSION_FLAGS metas, readers refuse flags they do not know
+	Flags []string `json:"flags,omitempty"`
+	// Name is the backend name of the file, left empty since older versions wrote it in plaintext even for trees
+	// without name encryption
 	Name string `json:"name"`
 	Iv   []byte `json:"iv"`
+	// Cipher is empty for CIPHER_AES_CTR files created before chunked formats
+	Cipher    string `json:"cipher,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	// KeyId identifies the master key, empty for files created before key ids
+	KeyId string `json:"key_id,omitempty"`
+	// IntegrityTags is set when the file was created with integrity tags, opening it fails while the sidecar of the
+	// tags is missing, so tags can not be stripped to skip their verification
+	IntegrityTags bool `json:"integrity_tags,omitempty"`
+	// MerkleRoot authenticates all integrity tags of the file, empty for files without tags
+	MerkleRoot []byte `json:"merkle_root,omitempty"`
+	// Padding is the size padding of the contents, PaddingBlockSize is set for SIZE_PADDING_BLOCK only
+	Padding          string `json:"padding,omitempty"`
+	PaddingBlockSize int    `json:"padding_block_size,omitempty"`
+	// Checksum is the CRC-32C of the meta without it, empty for files created before checksums
+	Checksum string `json:"checksum,omitempty"`
+	// Sealed is the meta encrypted by the meta subkey of the key KeyId, only magic, version, key id and checksum are
+	// kept in plaintext next to it, see WithEncryptedMeta
+	Sealed []byte `json:"sealed,omitempty"`
+
+	// hasCopy keeps a redundant copy in the meta file, damaged is set when the meta was read from the copy
+	hasCopy bool
+	damaged bool
+	// sealKey seals the meta when it is written, nil for plaintext metas
+	sealKey *EncryptionMasterKey
+	// header is the header a header format file was read with, see bindsHeader
+	header []byte
 }
 
-func openOrNewEncFileMeta(name string) (*EncFileMeta, error) {
-	oldEncFileMeta, err := openEncFileMeta(name)
+func openOrNewEncFileMeta(encFs *EncFs, name string) (*EncFileMeta, error) {
+	fs := encFs.backend()
+	oldEncFileMeta, err := openEncFileMeta(encFs, fs, name)
 	if err == nil && oldEncFileMeta != nil {
 		return oldEncFileMeta, nil
 	}
 
 	iv := make([]byte, 16)
-	_, err = rand.Read(iv)
+	err = encFs.readRandom(iv)
 	if err != nil {
 		return nil, err
 	}
 	encFileMeta := &EncFileMeta{
-		Name: name,
-		Iv:   iv,
+		Magic:   ENC_FILE_META_MAGIC,
+		Version: ENC_FILE_META_VERSION,
+		Iv:      iv,
+		Cipher:  encFs.newFileCipher(),
+		KeyId:   encFs.newFileKeyId(),
 	}
-	encFileMetaName := name + EncFileExt
-	encFileMetaFile, err := os.Create(encFileMetaName)
+	if encFileMeta.isChunked() {
+		encFileMeta.ChunkSize = CONTENT_CHUNK_SIZE
+	}
+	encFileMeta.applyFinalChunk()
+	encFileMeta.IntegrityTags = encFs.integrityTags && !encFileMeta.isChunked()
+	encFs.applySizePadding(encFileMeta)
+	encFs.applySubkeys(encFileMeta)
+	encFs.applyEncryptedMeta(encFileMeta)
+	encFileMeta.hasCopy = encFs.metaCopy
+	encFileMetaName := encFs.encFileMetaName(name)
+	tempName, err := newEncFileMetaTempName(encFs, name)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		_ = encFileMetaFile.Close()
-	}()
-	encFileMetaBytes, err := marshalEncFileMeta(encFileMeta)
-	if err != nil {
+	if err := writeEncFileMeta(fs, tempName, encFileMeta); err != nil {
+		_ = fs.Remove(tempName)
 		return nil, err
 	}
-	_, err = encFileMetaFile.Write(encFileMetaBytes)
+	// concurrent creators of the same file must agree on one IV, the loser reads the meta of the winner, the empty
+	// meta file of the winner is replaced by the complete synced one with a rename
+	encFileMetaFile, err := fs.OpenFile(encFileMetaName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
+		_ = fs.Remove(tempName)
+		if os.IsExist(err) {
+			return openExistingEncFileMeta(encFs, fs, name)
+		}
+		return nil, err
+	}
+	_ = encFileMetaFile.Close()
+	if err := renameEncFileMeta(fs, tempName, encFileMetaName); err != nil {
+		_ = fs.Remove(encFileMetaName)
 		return nil, err
 	}
 	return encFileMeta, nil
 }
 
-func openEncFileMeta(name string) (*EncFileMeta, error) {
-	encFileMetaName := name + EncFileExt
-	encFileMetaFile, err := os.Open(encFileMetaName)
+// newEncFileMetaTempName returns a temp name of the meta of name which concurrent creators do not share
+func newEncFileMetaTempName(encFs *EncFs, name string) (string, error) {
+	random := make([]byte, 8)
+	if err := encFs.readRandom(random); err != nil {
+		return "", err
+	}
+	return name + "." + hex.EncodeToString(random) + NEW_TEMP_META_FILE_SUFFIX, nil
+}
+
+// renameEncFileMeta replaces the meta file name by the synced tempName and syncs the directory, a crash leaves the
+// old or the new meta but never a truncated one
+func renameEncFileMeta(fs afero.Fs, tempName, name string) error {
+	if err := fs.Rename(tempName, name); err != nil {
+		_ = fs.Remove(tempName)
+		return err
+	}
+	return syncBackendPath(fs, filepath.Dir(name))
+}
+
+// syncBackendPath syncs a file or directory of fs, e.g. a directory so a rename in it survives a crash
+func syncBackendPath(fs afero.Fs, name string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return f.Sync()
+}
+
+// openExistingEncFileMeta reads a meta file created by a concurrent opener, which may not be written yet
+func openExistingEncFileMeta(encFs *EncFs, fs afero.Fs, name string) (*EncFileMeta, error) {
+	var lastErr error
+	for i := 0; i < 10; i++ {
+		encFileMeta, err := openEncFileMeta(encFs, fs, name)
+		if err == nil && encFileMeta != nil {
+			return encFileMeta, nil
+		}
+		lastErr = err
+		time.Sleep(time.Duration(i+1) * time.Millisecond)
+	}
+	if lastErr == nil {
+		lastErr = os.ErrNotExist
+	}
+	return nil, &os.PathError{Op: "open", Path: encFs.encFileMetaName(name), Err: lastErr}
+}
+
+// openEncFileMeta reads the meta file of name, sealed metas are opened with the key of encFs or its keyring
+func openEncFileMeta(encFs *EncFs, fs afero.Fs, name string) (*EncFileMeta, error) {
+	encFileMetaName := encFs.encFileMetaName(name)
+	encFileMetaFile, err := fs.Open(encFileMetaName)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -77,255 +194,1014 @@ func openEncFileMeta(name string) (*EncFileMeta, error) {
 		return nil, err
 	}
 	encFileMeta, err := unmarchalEncFileMeta(encFileMetaBytes)
+	if errors.Is(err, ErrBadMetaChecksum) {
+		return nil, &os.PathError{Op: "open", Path: encFileMetaName, Err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := encFileMeta.checkVersion(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: encFileMetaName, Err: err}
+	}
+	if encFileMeta.Sealed != nil || encFileMeta.hasFlag(META_FLAG_SEALED) {
+		if encFileMeta, err = encFs.unsealEncFileMeta(encFileMeta); err != nil {
+			return nil, &os.PathError{Op: "open", Path: encFileMetaName, Err: err}
+		}
+	}
 	return encFileMeta, nil
 }
 
 func marshalEncFileMeta(encFileMeata *EncFileMeta) ([]byte, error) {
-	return json.Marshal(encFileMeata)
+	checksummed := *encFileMeata
+	if encFileMeata.sealKey != nil {
+		sealed, err := sealEncFileMeta(encFileMeata)
+		if err != nil {
+			return nil, err
+		}
+		checksummed = *sealed
+	}
+	checksummed.Checksum = ""
+	data, err := json.Marshal(&checksummed)
+	if err != nil {
+		return nil, err
+	}
+	checksummed.Checksum = encFileMetaChecksum(data)
+	data, err = json.Marshal(&checksummed)
+	if err != nil || !encFileMeata.hasCopy {
+		return data, err
+	}
+	return appendEncFileMetaCopy(data), nil
 }
 
+// unmarchalEncFileMeta parses the meta and verifies its checksum, a damaged meta is read from its copy
 func unmarchalEncFileMeta(data []byte) (*EncFileMeta, error) {
-	var encFileMeta EncFileMeta
-	err := json.Unmarshal(data, &encFileMeta)
-	if err != nil {
+	encFileMeta, err := decodeEncFileMeta(data)
+	copyData := findEncFileMetaCopy(data)
+	if err == nil || copyData == nil {
+		if encFileMeta != nil {
+			encFileMeta.hasCopy = copyData != nil
+		}
+		return encFileMeta, err
+	}
+	encFileMeta, copyErr := decodeEncFileMeta(copyData)
+	if copyErr != nil {
 		return nil, err
 	}
-	return &encFileMeta, nil
+	encFileMeta.hasCopy, encFileMeta.damaged = true, true
+	return encFileMeta, nil
 }
 
 type EncFileInfo struct {
 	os.FileInfo
-	encFile *EncFile
+	encFile             *EncFile
+	encryptedParentName string
+}
+
+// Size returns the plaintext size, meta files of listed entries are only read when needed
+func (encFileInfo *EncFileInfo) Size() int64 {
+	size := encFileInfo.FileInfo.Size()
+	if !encFileInfo.FileInfo.Mode().IsRegular() {
+		return size
+	}
+	encFileMeta, headerSize := encFileInfo.encFile.encFileMeta, encFileInfo.encFile.headerSize
+	encryptedName := encFileInfo.encFile.file.Name()
+	if encFileInfo.encFile.isDir {
+		var err error
+		encryptedName = filepath.Join(encFileInfo.encryptedParentName, encFileInfo.FileInfo.Name())
+		encFileMeta, headerSize, err = encFileInfo.encFile.encFs.readFileMeta(encryptedName)
+		if err != nil {
+			return size
+		}
+	}
+	return encFileInfo.encFile.encFs.fileLogicalSize(encryptedName, encFileMeta, headerSize, size)
 }
 
 func (encFileInfo *EncFileInfo) Name() string {
-	return encFileInfo.encFile.encFs.key.DecryptFileName(encFileInfo.FileInfo.Name())
+	return encFileInfo.encFile.encFs.key.decryptFileNamePart(encFileInfo.encryptedParentName, encFileInfo.FileInfo.Name())
+}
+
+// plainFileInfo is a backend file info translated to the plaintext name and size
+type plainFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (fileInfo *plainFileInfo) Name() string {
+	return fileInfo.name
+}
+
+func (fileInfo *plainFileInfo) Size() int64 {
+	return fileInfo.size
+}
+
+// logicalFileInfo translates the backend file info of encryptedName, the size excludes headers, tags and padding so
+// callers like http.ServeContent send the right Content-Length
+func (encFs *EncFs) logicalFileInfo(encryptedName string, fileInfo os.FileInfo) os.FileInfo {
+	logicalFileInfo := &plainFileInfo{fileInfo, fileInfo.Name(), fileInfo.Size()}
+	if encryptedParentName := filepath.Dir(encryptedName); encryptedParentName != encryptedName &&
+		fileInfo.Name() == filepath.Base(encryptedName) {
+		logicalFileInfo.name = encFs.key.decryptFileNamePart(encryptedParentName, fileInfo.Name())
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return logicalFileInfo
+	}
+	encFileMeta, headerSize, err := encFs.readFileMeta(encryptedName)
+	if err == nil && (encFileMeta.isChunked() || headerSize > 0) {
+		logicalFileInfo.size = encFs.fileLogicalSize(encryptedName, encFileMeta, headerSize, fileInfo.Size())
+	}
+	return logicalFileInfo
 }
 
 func NewEncFileInfo(encFile *EncFile, fileInfo os.FileInfo) os.FileInfo {
+	return newEncFileInfoInDir(encFile, fileInfo, filepath.Dir(encFile.file.Name()))
+}
+
+func newEncFileInfoInDir(encFile *EncFile, fileInfo os.FileInfo, encryptedParentName string) os.FileInfo {
 	return &EncFileInfo{
 		fileInfo,
 		encFile,
+		encryptedParentName,
 	}
 }
 
+// EncFile is safe for concurrent use, its methods are serialized by mutex so handles shared by goroutines keep the
+// file position and the keystream offset in step, directory iterators of DirIterator are not synchronized
 type EncFile struct {
+	mutex       sync.Mutex
 	isDir       bool
 	closed      bool
 	encFileMeta *EncFileMeta
 	encFs       *EncFs
 	filePos     int64
-	file        *os.File
+	file        afero.File
+	dirIterator *EncDirIterator
+	// appendMode and writeOnly are emulated for chunked files which are always opened read write, appendMode
+	// is emulated for CTR files too
+	appendMode bool
+	writeOnly  bool
+	dirty      bool
+	metaSynced bool
+	// underlyingPosMoved is set by WriteAt of the underlying file which moves its position on some backends like
+	// afero.MemMapFs, sequential reads and writes of CTR files seek back to filePos first
+	underlyingPosMoved bool
+	// writeBuffer holds plaintext written at writeBufferOffset which is not yet encrypted and written, by WriteAt
+	// when writeBufferAt is set, by Write otherwise
+	writeBuffer       []byte
+	writeBufferOffset int64
+	writeBufferAt     bool
+	// headerSize is the size of the header of FILE_FORMAT_HEADER files, contents start after it
+	headerSize    int64
+	headerPending bool
+	// integrityFile holds the block tags of CTR files with integrity tags, nil otherwise
+	integrityFile afero.File
+	merkleTree    *merkleTree
+	merkleDirty   bool
+	// streaming writes go to the backend with sequential Write calls only, see StreamingBackend
+	streaming bool
+	// lazyRekey is set when closing the handle may re-encrypt the file, see WithLazyRekey
+	lazyRekey bool
+	// ivGeneration is the IV generation of encFs the meta was last checked at, staleIv is set once another handle
+	// gave the file a new IV, see checkStaleIv
+	ivGeneration uint64
+	staleIv      bool
+	// ctrBlock is the AES block of the content key of CTR files, created on first use, it is only dropped when the
+	// meta of a stale handle is reloaded, ctrBuffer is reused for encrypted writes
+	ctrBlock  cipher.Block
+	ctrBuffer []byte
+	// cachedChunkAead is the AEAD of chunked files, created on first use
+	cachedChunkAead cipher.AEAD
+	// readAheadBuffers are prefetched after readAheadPos once readAheadStreak sequential reads were seen
+	readAheadBuffers []*readAheadBuffer
+	readAheadPos     int64
+	readAheadStreak  int
+}
+
+// NewEncFile wraps file opened read-write, encFs must not be nil, handles use it for keys, options and metas
+func NewEncFile(name string, file afero.File, encFs *EncFs, isCreate bool) (*EncFile, error) {
+	return newEncFile(name, file, encFs, isCreate, os.O_RDWR)
 }
 
-func NewEncFile(name string, file *os.File, encFs *EncFs, isCreate bool) (*EncFile, error) {
+// WithStrictMetadata refuses opening files which have neither a meta file nor a header with ErrMissingFileMeta,
+// by default they are passed through unencrypted, backup and sync tools use it to find lost meta files
+func (encFs *EncFs) WithStrictMetadata(strictMetadata bool) {
+	encFs.strictMetadata = strictMetadata
+}
+
+// newEncFile wraps file opened with flag, read only opens never write meta or integrity files, exclusive
+// creates replace a meta file left behind by a removed file instead of reusing its IV
+func newEncFile(name string, file afero.File, encFs *EncFs, isCreate bool, flag int) (*EncFile, error) {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 	isDir := fileInfo.IsDir()
 	var encFileMeta *EncFileMeta = nil
+	var headerSize int64 = 0
+	headerPending := false
 
-	fileState, err := os.Stat(name)
-	if err == nil && !fileState.IsDir() && fileState.Size() == 0 {
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR) == 0
+	if fileInfo.Mode().IsRegular() && fileInfo.Size() == 0 && !readOnly {
 		isCreate = true
 	}
+	ivGeneration := atomic.LoadUint64(&encFs.ivGeneration)
 
-	if !isDir {
-		if isCreate {
-			encFileMeta, err = openOrNewEncFileMeta(name)
-		} else {
-			encFileMeta, err = openEncFileMeta(name)
+	// special files like FIFOs are passed through without meta
+	if fileInfo.Mode().IsRegular() {
+		// O_TRUNC gives the file a new IV like an exclusive create, new contents never reuse the old keystream
+		replaceMeta := isExclusiveOpen(flag) || flag&os.O_TRUNC != 0 && !readOnly
+		if replaceMeta {
+			if err := encFs.backend().Remove(encFs.encFileMetaName(name)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			encFs.forgetCachedEncFileMetas(name)
+		}
+		encFileMeta, err = encFs.openCachedEncFileMeta(name)
+		passthrough := encFileMeta == nil && encFs.isPassthroughEncrypted(name)
+		if err == nil && encFileMeta == nil && !passthrough {
+			if isCreate && encFs.getFileFormat() == FILE_FORMAT_HEADER {
+				encFileMeta, err = newHeaderEncFileMeta(encFs)
+				headerPending = true
+			} else if isCreate {
+				encFileMeta, err = openOrNewEncFileMeta(encFs, name)
+			} else if encFs.readsHeaders() {
+				encFileMeta, err = readEncFileHeader(file)
+			}
+			if encFileMeta != nil && (headerPending || !isCreate) {
+				headerSize = ENC_FILE_HEADER_SIZE
+			}
+		}
+		if err != nil {
+			return nil, err
 		}
+		if replaceMeta && encFileMeta != nil && !headerPending {
+			// other handles of the file still have the old IV
+			atomic.AddUint64(&encFs.ivGeneration, 1)
+		}
+		if encFileMeta == nil && encFs.strictMetadata && !passthrough {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrMissingFileMeta}
+		}
+		if err := encFs.checkKeyId(name, encFileMeta); err != nil {
+			return nil, err
+		}
+	}
+	var integrityFile afero.File
+	if encFileMeta != nil && !encFileMeta.isChunked() {
+		if isCreate && encFs.integrityTags && headerPending {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrIntegrityTagsNeedSidecar}
+		}
+		createTags := isCreate && (encFs.integrityTags || encFileMeta.requiresIntegrityTags())
+		integrityFile, err = openIntegrityFile(encFs.backend(), name, isCreate, createTags)
 		if err != nil {
 			return nil, err
 		}
+		if integrityFile == nil && encFileMeta.requiresIntegrityTags() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrIntegrityCheckFailed}
+		}
+	}
+	if headerSize > 0 {
+		// sequential reads and writes of contents start after the header
+		if _, err := file.Seek(headerSize, io.SeekStart); err != nil {
+			return nil, err
+		}
 	}
-	return &EncFile{
-		isDir:       isDir,
-		closed:      false,
-		encFileMeta: encFileMeta,
-		encFs:       encFs,
-		filePos:     0,
-		file:        file,
-	}, nil
+	encFile := &EncFile{
+		isDir:         isDir,
+		closed:        false,
+		encFileMeta:   encFileMeta,
+		encFs:         encFs,
+		filePos:       0,
+		file:          file,
+		headerSize:    headerSize,
+		headerPending: headerPending,
+		integrityFile: integrityFile,
+		ivGeneration:  ivGeneration,
+	}
+	if err := encFile.openMerkleTree(isCreate); err != nil {
+		if integrityFile != nil {
+			_ = integrityFile.Close()
+		}
+		return nil, err
+	}
+	encFile.lazyRekey = encFs.trackLazyRekey(name, encFileMeta)
+	return encFile, nil
 }
 
-func (f *EncFile) Close() error {
+func (f *EncFile) Close() (err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if f.closed {
 		return afero.ErrFileClosed
 	}
+	if f.lazyRekey {
+		defer func() {
+			f.encFs.lazyRekeyOnClose(f.file.Name(), err == nil)
+		}()
+	}
+	if f.integrityFile != nil {
+		defer func() {
+			_ = f.integrityFile.Close()
+		}()
+	}
+	if err := f.flushWriteBuffer(false); err != nil {
+		_ = f.file.Close()
+		f.closed = true
+		return err
+	}
 
+	if f.dirty && f.encFs.getDurabilityPolicy() == DURABILITY_POLICY_FULL {
+		if err := f.sync(); err != nil {
+			_ = f.file.Close()
+			f.closed = true
+			return err
+		}
+	}
+	if err := f.saveMerkleRoot(); err != nil {
+		_ = f.file.Close()
+		f.closed = true
+		return err
+	}
 	f.closed = true
-	return f.file.Close()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.dirty {
+		f.encFs.recordChange(CHANGE_MODIFY, f.Name(), "", false)
+	}
+	return nil
 }
 
 func (f *EncFile) Read(p []byte) (n int, err error) {
+	defer f.restorePlainPath(&err)
+	defer f.encFs.countIo(METRIC_READS_TOTAL, METRIC_READ_BYTES_TOTAL, &n)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	defer func() {
+		f.encFs.autoQuarantineOnErr(f.file.Name(), err)
+	}()
 	checkIsFileErr := f.checkIsFile()
 	if checkIsFileErr != nil {
 		return 0, checkIsFileErr
 	}
+	if err := f.checkStaleIv(); err != nil {
+		return 0, err
+	}
+	if err := f.flushWriteBuffer(false); err != nil {
+		return 0, err
+	}
+	if f.writeOnly {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if chunks := f.encFs.getReadAheadChunks(); chunks > 0 && f.encFileMeta != nil {
+		return f.readAheadRead(p, chunks)
+	}
+	if cache := f.getBlockCache(); cache != nil {
+		return f.readBlockCache(cache, p)
+	}
+	if f.encFileMeta.isChunked() {
+		readLen, err := f.readChunkedAt(p, f.filePos)
+		f.filePos += int64(readLen)
+		if err == io.EOF && readLen > 0 {
+			err = nil
+		}
+		return readLen, err
+	}
 
+	if err := f.restoreUnderlyingFilePos(); err != nil {
+		return 0, err
+	}
 	beforeReadFilePos := f.filePos
-	readLen, err := f.file.Read(p)
-	if err == nil {
-		f.filePos += int64(readLen)
-		if f.encFs != nil && f.encFs.key != nil && f.encFileMeta != nil {
-			encryptedBytes, err := generateCtrEncryptBytes(f.encFs.key.key, f.encFileMeta.Iv, beforeReadFilePos, int64(readLen))
-			if err != nil {
-				return 0, err
-			}
-			for i := 0; i < readLen; i++ {
-				p[i] = p[i] ^ encryptedBytes[i]
-			}
+	readBuff := p
+	if f.encFs.hasOperationDeadline() {
+		// underlying read may complete after timeout, never hand p to it
+		readBuff = make([]byte, len(p))
+	}
+	readLen, err := callWithRetry(f.encFs, positionRetryClass(f.encFs, retryIdempotent), "read", f.file.Name(),
+		func() (int, error) {
+			return f.file.Read(readBuff)
+		}, nil)
+	if len(readBuff) > 0 && &readBuff[0] != &p[0] {
+		copy(p, readBuff[:readLen])
+	}
+	if err := f.verifyIntegrityTags(beforeReadFilePos, int64(readLen)); err != nil {
+		return 0, err
+	}
+	// bytes read before io.EOF are decrypted too
+	f.filePos += int64(readLen)
+	if readLen > 0 && f.encFs.key != nil && f.encFileMeta != nil {
+		if err := f.xorCtrKeyStream(beforeReadFilePos, p[:readLen], p[:readLen], false); err != nil {
+			return 0, err
 		}
 	}
 	return readLen, err
 }
 
 func (f *EncFile) ReadAt(p []byte, off int64) (n int, err error) {
+	defer f.restorePlainPath(&err)
+	defer f.encFs.countIo(METRIC_READS_TOTAL, METRIC_READ_BYTES_TOTAL, &n)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	defer func() {
+		f.encFs.autoQuarantineOnErr(f.file.Name(), err)
+	}()
 	checkIsFileErr := f.checkIsFile()
 	if checkIsFileErr != nil {
 		return 0, checkIsFileErr
 	}
+	if err := f.checkStaleIv(); err != nil {
+		return 0, err
+	}
+	if err := f.flushWriteBuffer(false); err != nil {
+		return 0, err
+	}
+	if f.writeOnly {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if cache := f.getBlockCache(); cache != nil {
+		return f.readAtBlockCache(cache, p, off)
+	}
+	return f.readAt(p, off)
+}
 
-	readLen, err := f.file.ReadAt(p, off)
-	if err == nil {
-		if f.encFs != nil && f.encFs.key != nil && f.encFileMeta != nil {
-			encryptedBytes, err := generateCtrEncryptBytes(f.encFs.key.key, f.encFileMeta.Iv, off, int64(readLen))
-			if err != nil {
-				return 0, err
-			}
-			for i := 0; i < readLen; i++ {
-				p[i] = p[i] ^ encryptedBytes[i]
-			}
+// readAt decrypts len(p) bytes at off without the block cache
+func (f *EncFile) readAt(p []byte, off int64) (int, error) {
+	if f.encFileMeta.isChunked() {
+		return f.readChunkedAt(p, off)
+	}
+
+	readLen, err := f.readBackendAt(p, off+f.headerSize)
+	if err := f.verifyIntegrityTags(off, int64(readLen)); err != nil {
+		return 0, err
+	}
+	// ReadAt returns io.EOF with the bytes before the end of file, they are decrypted too
+	if readLen > 0 && f.encFs.key != nil && f.encFileMeta != nil {
+		if err := f.xorCtrKeyStream(off, p[:readLen], p[:readLen], false); err != nil {
+			return 0, err
 		}
 	}
+	// some backends like MemMapFs return short reads without error, ReadAt must explain them
+	if err == nil && readLen < len(p) {
+		err = io.EOF
+	}
 	return readLen, err
 }
 
-func (f *EncFile) Seek(offset int64, whence int) (int64, error) {
+// readBackendAt reads len(p) bytes at off of the backend file, with an operation deadline every attempt reads into a
+// buffer of its own, a read abandoned after a timeout may still complete and must never write to p
+func (f *EncFile) readBackendAt(p []byte, off int64) (int, error) {
+	if !f.encFs.hasOperationDeadline() {
+		readLen, err := callWithRetry(f.encFs, retryIdempotent, "read", f.file.Name(), func() (int, error) {
+			return f.file.ReadAt(p, off)
+		}, nil)
+		return readLen, readBackendAtErr(readLen, err)
+	}
+	type readResult struct {
+		buff []byte
+		n    int
+	}
+	result, err := callWithRetry(f.encFs, retryIdempotent, "read", f.file.Name(), func() (readResult, error) {
+		buff := make([]byte, len(p))
+		n, err := f.file.ReadAt(buff, off)
+		return readResult{buff: buff, n: n}, err
+	}, nil)
+	copy(p, result.buff[:result.n])
+	return result.n, readBackendAtErr(result.n, err)
+}
+
+// readBackendAtErr turns the io.ErrUnexpectedEOF of MemMapFs for reads past the end of file into the io.EOF of
+// io.ReaderAt
+func readBackendAtErr(readLen int, err error) error {
+	if readLen == 0 && err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+func (f *EncFile) Seek(offset int64, whence int) (_ int64, err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.closed && f.isDir {
+		return f.seekDir(offset, whence)
+	}
 	checkIsFileErr := f.checkIsFile()
 	if checkIsFileErr != nil {
 		return 0, checkIsFileErr
 	}
+	if err := f.flushWriteBuffer(false); err != nil {
+		return 0, err
+	}
+	if f.encFileMeta.isChunked() {
+		return f.seekChunked(offset, whence)
+	}
+	if f.headerSize > 0 {
+		return f.seekAfterHeader(offset, whence)
+	}
+	if err := f.restoreUnderlyingFilePos(); err != nil {
+		return 0, err
+	}
 
-	ret, err := f.file.Seek(offset, whence)
+	ret, err := callWithRetry(f.encFs, positionRetryClass(f.encFs, seekRetryClass(whence)), "seek", f.file.Name(),
+		func() (int64, error) {
+			return f.file.Seek(offset, whence)
+		}, nil)
 	if err == nil {
 		f.filePos = ret
 	}
 	return ret, err
 }
 
+// seekDir only supports Seek(0, io.SeekStart) which rewinds the directory listing
+func (f *EncFile) seekDir(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	_, err := callWithRetry(f.encFs, retryIdempotent, "seek", f.file.Name(), func() (int64, error) {
+		return f.file.Seek(0, io.SeekStart)
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	f.dirIterator = nil
+	return 0, nil
+}
+
 func (f *EncFile) Write(p []byte) (n int, err error) {
+	defer f.restorePlainPath(&err)
+	defer f.encFs.countIo(METRIC_WRITES_TOTAL, METRIC_WRITTEN_BYTES_TOTAL, &n)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.write(p)
+}
+
+func (f *EncFile) write(p []byte) (n int, err error) {
 	checkIsFileErr := f.checkIsFile()
 	if checkIsFileErr != nil {
 		return 0, checkIsFileErr
 	}
+	if err := f.checkWriteIv("write"); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	if f.streaming {
+		return f.streamWrite(p)
+	}
+	if writeBufferSize := f.encFs.getWriteBufferSize(); writeBufferSize > 0 {
+		return f.bufferWrite(p, writeBufferSize)
+	}
+	return f.writeAtFilePos(p)
+}
 
-	writeBuff := p
-	if f.encFs != nil && f.encFs.key != nil && f.encFileMeta != nil {
-		buff := make([]byte, len(p))
-		encryptedBytes, err := generateCtrEncryptBytes(f.encFs.key.key, f.encFileMeta.Iv, f.filePos, int64(len(p)))
+func (f *EncFile) writeAtFilePos(p []byte) (n int, err error) {
+	if err := f.ensureHeader(); err != nil {
+		return 0, err
+	}
+	if f.appendMode {
+		// O_APPEND is emulated, the underlying file is opened without it, appends of all handles are serialized
+		// so the end of file can not move between finding it and writing there
+		f.encFs.appendMutex.Lock()
+		defer f.encFs.appendMutex.Unlock()
+		size, err := f.contentSize()
 		if err != nil {
 			return 0, err
 		}
-		for i := 0; i < len(p); i++ {
-			buff[i] = p[i] ^ encryptedBytes[i]
+		f.filePos = size
+		if !f.encFileMeta.isChunked() {
+			if _, err := f.file.Seek(size+f.headerSize, io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if f.encFileMeta.isChunked() {
+		writeLen, err := f.writeChunkedAt(p, f.filePos)
+		f.filePos += int64(writeLen)
+		return writeLen, err
+	}
+	if !f.appendMode && f.filePos > 0 {
+		if err := f.fillCtrGap(f.filePos); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.restoreUnderlyingFilePos(); err != nil {
+		return 0, err
+	}
+
+	writeBuff := p
+	if f.encFs.key != nil && f.encFileMeta != nil {
+		buff := f.ctrWriteBuffer(len(p))
+		if err := f.xorCtrKeyStream(f.filePos, buff, p, true); err != nil {
+			return 0, err
 		}
 		writeBuff = buff
 	}
 
-	writeLen, err := f.file.Write(writeBuff)
+	if f.encFs.hasOperationDeadline() && len(writeBuff) > 0 && &writeBuff[0] == &p[0] {
+		// underlying write may complete after timeout, never hand p to it
+		writeBuff = append([]byte(nil), p...)
+	}
+	writeLen, err := callWithRetry(f.encFs, positionRetryClass(f.encFs, retryWrite), "write", f.file.Name(),
+		func() (int, error) {
+			return f.file.Write(writeBuff)
+		}, nil)
+	f.invalidateBlockCache(f.filePos, int64(len(p)))
 	if err == nil {
+		err = f.updateIntegrityTags(f.filePos, int64(writeLen))
 		f.filePos += int64(writeLen)
 	}
 	return writeLen, err
 }
 
 func (f *EncFile) WriteAt(p []byte, off int64) (n int, err error) {
+	defer f.restorePlainPath(&err)
+	defer f.encFs.countIo(METRIC_WRITES_TOTAL, METRIC_WRITTEN_BYTES_TOTAL, &n)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	checkIsFileErr := f.checkIsFile()
 	if checkIsFileErr != nil {
 		return 0, checkIsFileErr
 	}
+	if f.appendMode {
+		return 0, &os.PathError{Op: "writeat", Path: f.Name(), Err: ErrWriteAtInAppendMode}
+	}
+	if err := f.checkWriteIv("writeat"); err != nil {
+		return 0, err
+	}
+	if writeBufferSize := f.encFs.getWriteBufferSize(); writeBufferSize > 0 && !f.streaming && off >= 0 {
+		f.dirty = true
+		return f.bufferWriteAt(p, off, writeBufferSize)
+	}
+	if err := f.flushWriteBuffer(false); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.writeAt(p, off)
+}
+
+func (f *EncFile) writeAt(p []byte, off int64) (n int, err error) {
+	if err := f.ensureHeader(); err != nil {
+		return 0, err
+	}
+	if f.encFileMeta.isChunked() {
+		return f.writeChunkedAt(p, off)
+	}
+	if err := f.fillCtrGap(off); err != nil {
+		return 0, err
+	}
 
 	writeBuff := p
-	if f.encFs != nil && f.encFs.key != nil && f.encFileMeta != nil {
-		buff := make([]byte, len(p))
-		encryptedBytes, err := generateCtrEncryptBytes(f.encFs.key.key, f.encFileMeta.Iv, off, int64(len(p)))
-		if err != nil {
+	if f.encFs.key != nil && f.encFileMeta != nil {
+		buff := f.ctrWriteBuffer(len(p))
+		if err := f.xorCtrKeyStream(off, buff, p, true); err != nil {
 			return 0, err
 		}
-		for i := 0; i < len(p); i++ {
-			buff[i] = p[i] ^ encryptedBytes[i]
-		}
 		writeBuff = buff
 	}
 
-	writeLen, err := f.file.WriteAt(writeBuff, off)
+	if f.encFs.hasOperationDeadline() && len(writeBuff) > 0 && &writeBuff[0] == &p[0] {
+		// underlying write may complete after timeout, never hand p to it
+		writeBuff = append([]byte(nil), p...)
+	}
+	writeLen, err := callWithRetry(f.encFs, retryWrite, "write", f.file.Name(), func() (int, error) {
+		return f.file.WriteAt(writeBuff, off+f.headerSize)
+	}, nil)
+	f.underlyingPosMoved = true
+	f.invalidateBlockCache(off, int64(len(p)))
+	if err == nil {
+		err = f.updateIntegrityTags(off, int64(writeLen))
+	}
 	return writeLen, err
 }
 
+// fillCtrGap writes encrypted zeros from the end of file to off, holes left by the backend would
+// otherwise decrypt to garbage instead of zeros
+func (f *EncFile) fillCtrGap(off int64) error {
+	if f.encFs.key == nil || f.encFileMeta == nil {
+		return nil
+	}
+	size, err := f.contentSize()
+	if err != nil || off <= size {
+		return err
+	}
+	for size < off {
+		// the keystream is the encryption of zeros
+		fillLen := int64(CONTENT_CHUNK_SIZE)
+		if fillLen > off-size {
+			fillLen = off - size
+		}
+		encryptedBytes := f.ctrWriteBuffer(int(fillLen))
+		for i := range encryptedBytes {
+			encryptedBytes[i] = 0
+		}
+		if err := f.xorCtrKeyStream(size, encryptedBytes, encryptedBytes, true); err != nil {
+			return err
+		}
+		fillOffset := size + f.headerSize
+		_, err = callWithRetry(f.encFs, retryWrite, "write", f.file.Name(), func() (int, error) {
+			return f.file.WriteAt(encryptedBytes, fillOffset)
+		}, nil)
+		f.underlyingPosMoved = true
+		if err != nil {
+			return err
+		}
+		if err := f.updateIntegrityTags(size, fillLen); err != nil {
+			return err
+		}
+		size += fillLen
+	}
+	return nil
+}
+
+// restoreUnderlyingFilePos seeks the underlying file of CTR files back to filePos after it was moved by WriteAt
+func (f *EncFile) restoreUnderlyingFilePos() error {
+	if !f.underlyingPosMoved {
+		return nil
+	}
+	if _, err := f.file.Seek(f.filePos+f.headerSize, io.SeekStart); err != nil {
+		return err
+	}
+	f.underlyingPosMoved = false
+	return nil
+}
+
 func (f *EncFile) Name() string {
 	return f.encFs.key.DecryptFileName(f.file.Name())
 }
 
-func (f *EncFile) Readdir(count int) ([]os.FileInfo, error) {
+// handleDirIterator returns the iterator kept on the handle, Readdir, ReadDir and Readdirnames resume after the
+// last entry returned by any of them
+func (f *EncFile) handleDirIterator() (*EncDirIterator, error) {
 	if f.closed {
 		return nil, afero.ErrFileClosed
 	}
+	if f.dirIterator == nil {
+		dirIterator, err := f.DirIterator()
+		if err != nil {
+			return nil, err
+		}
+		f.dirIterator = dirIterator
+	}
+	return f.dirIterator, nil
+}
 
-	// FIXME is count * 2 just ok?
-	fileInfos, err := f.file.Readdir(count * 2)
+func (f *EncFile) Readdir(count int) (_ []os.FileInfo, err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dirIterator, err := f.handleDirIterator()
 	if err != nil {
 		return nil, err
 	}
+	return readdirFromIterator(dirIterator, count)
+}
 
+// readdirFromIterator returns the infos of the next count entries of dirIterator like Readdir, entries removed after
+// they were listed are skipped
+func readdirFromIterator(dirIterator *EncDirIterator, count int) ([]os.FileInfo, error) {
 	filterFileInfos := make([]os.FileInfo, 0)
-	for _, fileInfo := range fileInfos {
-		isEncFileMetaFile := strings.HasSuffix(fileInfo.Name(), EncFileExt)
-		if !isEncFileMetaFile {
-			filterFileInfos = append(filterFileInfos, NewEncFileInfo(f, fileInfo))
-		}
-		if count > 0 && len(filterFileInfos) >= count {
+	for count <= 0 || len(filterFileInfos) < count {
+		dirEntry, err := dirIterator.Next()
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return filterFileInfos, err
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed after listed
+				continue
+			}
+			return filterFileInfos, err
+		}
+		filterFileInfos = append(filterFileInfos, fileInfo)
+	}
+	if count > 0 && len(filterFileInfos) == 0 {
+		return nil, io.EOF
 	}
 
 	return filterFileInfos, nil
 }
 
+// ReadDir implements fs.ReadDirFile, the backend directory is read in batches until count entries which are not
+// meta files are collected, entries are not stat until Info is called
+func (f *EncFile) ReadDir(count int) (_ []fs.DirEntry, err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dirIterator, err := f.handleDirIterator()
+	if err != nil {
+		return nil, err
+	}
+	return readDirFromIterator(dirIterator, count)
+}
+
+// readDirFromIterator returns the next count entries of dirIterator like ReadDir
+func readDirFromIterator(dirIterator *EncDirIterator, count int) ([]fs.DirEntry, error) {
+	dirEntries := make([]fs.DirEntry, 0)
+	for count <= 0 || len(dirEntries) < count {
+		dirEntry, err := dirIterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dirEntries, err
+		}
+		dirEntries = append(dirEntries, dirEntry)
+	}
+	if count > 0 && len(dirEntries) == 0 {
+		return nil, io.EOF
+	}
+
+	return dirEntries, nil
+}
+
 func (f *EncFile) Readdirnames(n int) ([]string, error) {
-	fi, err := f.Readdir(n)
+	dirEntries, err := f.ReadDir(n)
 	if err != nil {
 		return nil, err
 	}
 
 	var names []string
-	for _, f := range fi {
-		names = append(names, f.Name())
+	for _, dirEntry := range dirEntries {
+		names = append(names, dirEntry.Name())
 	}
 
 	return names, nil
 }
 
-func (f *EncFile) Stat() (os.FileInfo, error) {
-	fileInfo, err := f.file.Stat()
+func (f *EncFile) Stat() (_ os.FileInfo, err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.flushWriteBuffer(false); err != nil {
+		return nil, err
+	}
+	fileInfo, err := callWithRetry(f.encFs, retryIdempotent, "stat", f.file.Name(), func() (os.FileInfo, error) {
+		return f.file.Stat()
+	}, nil)
 	if err != nil {
 		return nil, err
 	}
 	return NewEncFileInfo(f, fileInfo), nil
 }
 
-func (f *EncFile) Sync() error {
-	return f.file.Sync()
+func (f *EncFile) Sync() (err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.sync()
+}
+
+func (f *EncFile) sync() error {
+	if err := f.flushWriteBuffer(false); err != nil {
+		return err
+	}
+	err := callErrWithRetry(f.encFs, retryIdempotent, "sync", f.file.Name(), func() error {
+		return f.file.Sync()
+	})
+	if err != nil {
+		return err
+	}
+	if f.integrityFile != nil {
+		if err := f.integrityFile.Sync(); err != nil {
+			return err
+		}
+		if err := f.saveMerkleRoot(); err != nil {
+			return err
+		}
+	}
+	if f.encFs.getDurabilityPolicy() >= DURABILITY_POLICY_META {
+		return f.syncMeta()
+	}
+	return nil
 }
 
-func (f *EncFile) Truncate(size int64) error {
-	return f.file.Truncate(size)
+func (f *EncFile) Truncate(size int64) (err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkStaleIv(); err != nil {
+		return err
+	}
+	// truncating to zero renews the IV, a stale handle may start over
+	if f.staleIv && size != 0 {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.ESTALE}
+	}
+	f.dirty = true
+	if err := f.flushWriteBuffer(false); err != nil {
+		return err
+	}
+	if err := f.ensureHeader(); err != nil {
+		return err
+	}
+	defer f.invalidateBlockCache(size, -1)
+	if f.encFileMeta.isChunked() {
+		if err := f.truncateChunked(size); err != nil || size != 0 {
+			return err
+		}
+		return f.renewIv()
+	}
+	if err := f.fillCtrGap(size); err != nil {
+		return err
+	}
+	err = callErrWithRetry(f.encFs, retryIdempotent, "truncate", f.file.Name(), func() error {
+		return f.file.Truncate(size + f.headerSize)
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.truncateIntegrityTags(size); err != nil || size != 0 {
+		return err
+	}
+	return f.renewIv()
+}
+
+// renewIv gives a file truncated to zero a new IV so rewritten contents never reuse the old keystream, other
+// handles of the file find the new IV with checkStaleIv
+func (f *EncFile) renewIv() error {
+	if f.encFileMeta == nil {
+		return nil
+	}
+	encFileMeta := *f.encFileMeta
+	encFileMeta.header = nil
+	encFileMeta.Iv = make([]byte, 16)
+	if err := f.encFs.readRandom(encFileMeta.Iv); err != nil {
+		return err
+	}
+	f.staleIv = false
+	if f.merkleTree != nil {
+		encFileMeta.MerkleRoot = f.merkleTree.root(integrityKey(f.contentKey()), encFileMeta.Iv)
+	}
+	if f.headerSize > 0 {
+		f.encFileMeta = &encFileMeta
+		f.headerPending = true
+		return f.ensureHeader()
+	}
+	encryptedName := f.file.Name()
+	tempName := encryptedName + TRUNCATE_TEMP_META_FILE_SUFFIX
+	if err := writeEncFileMeta(f.encFs.backend(), tempName, &encFileMeta); err != nil {
+		_ = f.encFs.backend().Remove(tempName)
+		return err
+	}
+	if err := renameEncFileMeta(f.encFs.backend(), tempName, f.encFs.encFileMetaName(encryptedName)); err != nil {
+		return err
+	}
+	f.encFs.forgetCachedEncFileMetas(encryptedName)
+	f.encFileMeta = &encFileMeta
+	atomic.AddUint64(&f.encFs.ivGeneration, 1)
+	return nil
+}
+
+// checkStaleIv reloads the meta after any file of encFs got a new IV, when another handle truncated the file to zero
+// or replaced it by O_TRUNC the handle reads the new contents with the new IV but is stale, writes encrypted with the
+// old IV would reuse its keystream or mix two keystreams in one file
+func (f *EncFile) checkStaleIv() error {
+	if f.encFileMeta == nil || f.headerPending || f.streaming {
+		return nil
+	}
+	ivGeneration := atomic.LoadUint64(&f.encFs.ivGeneration)
+	if ivGeneration == f.ivGeneration {
+		return nil
+	}
+	encFileMeta, headerSize, err := f.encFs.readFileMeta(f.file.Name())
+	if err != nil {
+		return err
+	}
+	f.ivGeneration = ivGeneration
+	// a removed or renamed file keeps the meta of the handle
+	if encFileMeta == nil || headerSize != f.headerSize || bytes.Equal(encFileMeta.Iv, f.encFileMeta.Iv) {
+		return nil
+	}
+	f.encFileMeta = encFileMeta
+	f.staleIv = true
+	f.ctrBlock = nil
+	f.cachedChunkAead = nil
+	f.readAheadBuffers = nil
+	if f.merkleTree != nil {
+		// the handle which renewed the IV saves the root, the tree of the new tags is kept unverified in case this
+		// handle truncates the file again
+		if _, err := f.integrityFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if f.merkleTree, err = readMerkleTree(f.integrityFile); err != nil {
+			return err
+		}
+		f.merkleDirty = false
+	}
+	return nil
+}
+
+// checkWriteIv refuses writes of stale handles with ESTALE, see checkStaleIv
+func (f *EncFile) checkWriteIv(op string) error {
+	if err := f.checkStaleIv(); err != nil {
+		return err
+	}
+	if f.staleIv {
+		return &os.PathError{Op: op, Path: f.Name(), Err: syscall.ESTALE}
+	}
+	return nil
 }
 
 func (f *EncFile) WriteString(s string) (ret int, err error) {
@@ -342,28 +1218,68 @@ func (f *EncFile) checkIsFile() error {
 	return nil
 }
 
+// generateCtrEncryptBytes returns len bytes of the AES/CTR keystream of key and iv at offset
 func generateCtrEncryptBytes(key, iv []byte, offset, len int64) ([]byte, error) {
-	endOffset := offset + len
-	blockOffset := offset / 16
-	encryptStartOffset := blockOffset * 16
-	encryptEndOffset := (endOffset / 16) * 16
-	if endOffset%16 > 0 {
-		encryptEndOffset += 16
+	encryptedBytes := make([]byte, len)
+	if err := xorCtrKeyStream(key, iv, offset, encryptedBytes, encryptedBytes); err != nil {
+		return nil, err
 	}
-	blocksCount := int((encryptEndOffset - encryptStartOffset) / 16)
+	return encryptedBytes, nil
+}
 
-	cipher, err := aes.NewCipher(key)
+// xorCtrKeyStream sets dst to src xor the AES/CTR keystream of key and iv at offset, dst and src may overlap entirely
+func xorCtrKeyStream(key, iv []byte, offset int64, dst, src []byte) error {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	encryptBytes := make([]byte, blocksCount*16)
-	for i := 0; i < blocksCount; i++ {
-		encNonce := nonceAdd(iv, uint64(i)+uint64(blockOffset))
-		cipher.Encrypt(encryptBytes[i*16:(i+1)*16], encNonce)
+	xorCtrBlockKeyStream(block, iv, offset, dst, src)
+	return nil
+}
+
+// xorCtrBlockKeyStream is xorCtrKeyStream with the AES block of the key, the counter is the iv plus the block index
+// as a 128 bit big endian number like nonceAdd
+func xorCtrBlockKeyStream(block cipher.Block, iv []byte, offset int64, dst, src []byte) {
+	stream := cipher.NewCTR(block, nonceAdd(iv, uint64(offset/16)))
+	if skipLen := offset % 16; skipLen > 0 {
+		// drop the keystream before offset in its block
+		var skipped [16]byte
+		stream.XORKeyStream(skipped[:skipLen], skipped[:skipLen])
 	}
-	encryptedBytes := encryptBytes[offset-encryptStartOffset : offset-encryptStartOffset+len]
-	//fmt.Println("XX", hex.EncodeToString(key), hex.EncodeToString(iv), offset, len, hex.EncodeToString(encryptedBytes))
-	return encryptedBytes, nil
+	stream.XORKeyStream(dst, src)
+}
+
+// xorCtrKeyStream encrypts or decrypts contents of a CTR file at offset with the cached AES block of the handle
+func (f *EncFile) xorCtrKeyStream(offset int64, dst, src []byte, encrypt bool) error {
+	if f.ctrBlock == nil {
+		block, err := aes.NewCipher(f.contentKey())
+		if err != nil {
+			return err
+		}
+		f.ctrBlock = block
+	}
+	metricsCollector := f.encFs.getMetricsCollector()
+	if metricsCollector == nil {
+		xorCtrBlockKeyStreamParallel(f.ctrBlock, f.encFileMeta.Iv, offset, dst, src, f.encFs.getKeystreamParallelism())
+		return nil
+	}
+	start := time.Now()
+	xorCtrBlockKeyStreamParallel(f.ctrBlock, f.encFileMeta.Iv, offset, dst, src, f.encFs.getKeystreamParallelism())
+	observeSince(metricsCollector, METRIC_KEYSTREAM_SECONDS, start)
+	f.encFs.countCipherBytes(encrypt, CIPHER_AES_CTR, len(src))
+	return nil
+}
+
+// ctrWriteBuffer returns a buffer of size for encrypted contents, it is reused by the next write unless a backend
+// write may outlive its operation deadline
+func (f *EncFile) ctrWriteBuffer(size int) []byte {
+	if f.encFs.hasOperationDeadline() {
+		return make([]byte, size)
+	}
+	if cap(f.ctrBuffer) < size {
+		f.ctrBuffer = make([]byte, size)
+	}
+	return f.ctrBuffer[:size]
 }
 
 func nonceAdd(nonce []byte, incrementValue uint64) []byte {
@@ -371,7 +1287,8 @@ func nonceAdd(nonce []byte, incrementValue uint64) []byte {
 	n2 := binary.BigEndian.Uint64(nonce[8:])
 
 	leftToMax := math.MaxUint64 - n2
-	if leftToMax <= incrementValue {
+	// carry into the high half only when the low half wraps
+	if leftToMax < incrementValue {
 		incrementValue -= leftToMax + 1
 		n2 = incrementValue
 		n1 += 1
@@ -0,0 +1,1152 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestEncFileFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"chacha20", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_CHACHA20_POLY1305) }},
+		{"xchacha20", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_XCHACHA20_POLY1305) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"ctr integrity tags", func(encFs *EncFs) error {
+			encFs.WithIntegrityTags(true)
+			return nil
+		}},
+		{"gcm block padding", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}},
+	}
+	data := testPattern(100000)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// plain names let another key find the file
+			encFs, base := newTestEncFs(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewNoopNameMapper()))
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", data)
+			for name, content := range snapshotTestFs(t, base) {
+				if strings.Contains(content, string(data[:64])) {
+					t.Fatalf("backend file %s contains plaintext", name)
+				}
+			}
+			checkTestFile(t, encFs, "/file", data)
+
+			f, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			reads := []struct {
+				off     int64
+				size    int
+				wantLen int
+				wantErr error
+			}{
+				{0, 100, 100, nil},
+				{70000, 1000, 1000, nil},
+				{99990, 100, 10, io.EOF},
+				{100000, 100, 0, io.EOF},
+				{200000, 100, 0, io.EOF},
+			}
+			for _, read := range reads {
+				p := make([]byte, read.size)
+				n, err := f.ReadAt(p, read.off)
+				if n != read.wantLen || err != read.wantErr {
+					t.Fatalf("read %d bytes at %d: got %d, %v, want %d, %v", read.size, read.off, n, err,
+						read.wantLen, read.wantErr)
+				}
+				if n > 0 && !bytes.Equal(p[:n], data[read.off:read.off+int64(n)]) {
+					t.Fatalf("read %d bytes at %d: wrong data", read.size, read.off)
+				}
+			}
+
+			// a different key can not read the file
+			otherKey := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(2), NewNoopNameMapper())
+			otherFs := NewEncFsWithBackend(otherKey, base).(*EncFs)
+			if err := test.setup(otherFs); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := afero.ReadFile(otherFs, "/file"); err == nil && bytes.Equal(got, data) {
+				t.Fatal("read the file with another key")
+			}
+		})
+	}
+}
+
+func TestStaleIvHandles(t *testing.T) {
+	formats := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"ctr integrity tags", func(encFs *EncFs) error {
+			encFs.WithIntegrityTags(true)
+			return nil
+		}},
+		{"ctr write buffer", func(encFs *EncFs) error {
+			encFs.WithWriteBufferSize(4096)
+			return nil
+		}},
+		{"ctr block cache", func(encFs *EncFs) error { return encFs.WithBlockCache(4096, 16) }},
+	}
+	renewals := []struct {
+		name  string
+		renew func(t *testing.T, encFs *EncFs, data []byte)
+	}{
+		{"o_trunc", func(t *testing.T, encFs *EncFs, data []byte) {
+			writeTestFile(t, encFs, "/file", data)
+		}},
+		{"truncate", func(t *testing.T, encFs *EncFs, data []byte) {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	oldData, newData := testPattern(10000), bytes.Repeat([]byte("new contents "), 500)
+	for _, format := range formats {
+		for _, renewal := range renewals {
+			t.Run(format.name+" "+renewal.name, func(t *testing.T) {
+				encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := format.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/file", oldData)
+				stale, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() {
+					_ = stale.Close()
+				}()
+				p := make([]byte, 100)
+				if _, err := stale.ReadAt(p, 0); err != nil || !bytes.Equal(p, oldData[:100]) {
+					t.Fatalf("read before renewal: %v", err)
+				}
+
+				renewal.renew(t, encFs, newData)
+				// the stale handle reads the new contents with the new IV
+				if _, err := stale.ReadAt(p, 1000); err != nil || !bytes.Equal(p, newData[1000:1100]) {
+					t.Fatalf("read after renewal: %v", err)
+				}
+				writes := []struct {
+					name  string
+					write func() error
+				}{
+					{"write", func() error {
+						_, err := stale.Write([]byte("stale"))
+						return err
+					}},
+					{"writeat", func() error {
+						_, err := stale.WriteAt([]byte("stale"), 10)
+						return err
+					}},
+					{"truncate", func() error { return stale.Truncate(10) }},
+				}
+				for _, write := range writes {
+					if err := write.write(); !errors.Is(err, syscall.ESTALE) {
+						t.Fatalf("%s: got %v, want %v", write.name, err, syscall.ESTALE)
+					}
+				}
+				checkTestFile(t, encFs, "/file", newData)
+
+				// truncating to zero gives the file a new IV again, the handle may write after it
+				if err := stale.Truncate(0); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := stale.WriteAt([]byte("fresh"), 0); err != nil {
+					t.Fatal(err)
+				}
+				if err := stale.Close(); err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, encFs, "/file", []byte("fresh"))
+			})
+		}
+	}
+}
+
+func TestStaleIvBufferedWrite(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	encFs.WithWriteBufferSize(4096)
+	writeTestFile(t, encFs, "/file", testPattern(100))
+	stale, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stale.Write([]byte("buffered")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/file", []byte("new contents"))
+	// the buffer would be encrypted with the old IV
+	if err := stale.Close(); !errors.Is(err, syscall.ESTALE) {
+		t.Fatalf("got %v, want %v", err, syscall.ESTALE)
+	}
+	checkTestFile(t, encFs, "/file", []byte("new contents"))
+}
+
+func TestStatLogicalSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"gcm block padding", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}},
+	}
+	sizes := []int{0, 1, 100, CONTENT_CHUNK_SIZE, 3*CONTENT_CHUNK_SIZE + 17}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestHmacEncFs()
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range sizes {
+				writeTestFile(t, encFs, "/dir/file", testPattern(size))
+				fileInfos := []os.FileInfo{}
+				fileInfo, err := encFs.Stat("/dir/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fileInfos = append(fileInfos, fileInfo)
+				fileInfo, _, err = encFs.LstatIfPossible("/dir/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fileInfos = append(fileInfos, fileInfo)
+				dirInfos, err := afero.ReadDir(encFs, "/dir")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fileInfos = append(fileInfos, dirInfos...)
+				f, err := encFs.Open("/dir/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fileInfo, err = f.Stat()
+				_ = f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				fileInfos = append(fileInfos, fileInfo)
+				if len(fileInfos) != 4 {
+					t.Fatalf("%d bytes: got %d file infos", size, len(fileInfos))
+				}
+				// file infos report the plaintext name and size
+				for i, fileInfo := range fileInfos {
+					if fileInfo.Name() != "file" || fileInfo.Size() != int64(size) {
+						t.Fatalf("%d bytes: file info %d has name %q and size %d", size, i, fileInfo.Name(),
+							fileInfo.Size())
+					}
+				}
+			}
+
+			// an open handle reports the size of buffered writes
+			f, err := encFs.OpenFile("/dir/file", os.O_RDWR|os.O_TRUNC, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			for _, size := range []int{10, CONTENT_CHUNK_SIZE + 10} {
+				if _, err := f.Write(testPattern(size / 2)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fileInfo, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(5 + (CONTENT_CHUNK_SIZE+10)/2); fileInfo.Size() != want {
+				t.Fatalf("got size %d while writing, want %d", fileInfo.Size(), want)
+			}
+			dirInfo, err := encFs.Stat("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dirInfo.Name() != "dir" || !dirInfo.IsDir() {
+				t.Fatalf("got directory %q", dirInfo.Name())
+			}
+		})
+	}
+}
+
+func TestEncFileReadDir(t *testing.T) {
+	encFs, _ := newTestHmacEncFs()
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	wantNames := []string{"sub"}
+	for i := 0; i < 9; i++ {
+		name := string(rune('a' + i))
+		writeTestFile(t, encFs, "/dir/"+name, testPattern(10*i))
+		wantNames = append(wantNames, name)
+	}
+	tests := []struct {
+		name  string
+		reads []func(f *EncFile) ([]string, error)
+		// counts of the reads, an error of io.EOF when -1
+		wantCounts []int
+	}{
+		{"all", []func(f *EncFile) ([]string, error){readTestDirEntries(-1)}, []int{10}},
+		{"batches", []func(f *EncFile) ([]string, error){
+			readTestDirEntries(4), readTestDirEntries(4), readTestDirEntries(4), readTestDirEntries(4),
+		}, []int{4, 4, 2, -1}},
+		{"rest", []func(f *EncFile) ([]string, error){readTestDirEntries(3), readTestDirEntries(0)}, []int{3, 7}},
+		// the listing continues across Readdir, ReadDir and Readdirnames
+		{"mixed", []func(f *EncFile) ([]string, error){
+			readTestDirEntries(3), readTestFileInfos(3), readTestDirNames(3), readTestDirEntries(3),
+			readTestFileInfos(3), readTestDirNames(3),
+		}, []int{3, 3, 3, 1, -1, -1}},
+		{"empty at end", []func(f *EncFile) ([]string, error){readTestDirEntries(-1), readTestDirEntries(-1)},
+			[]int{10, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := encFs.Open("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			var names []string
+			for i, read := range test.reads {
+				got, err := read(f.(*EncFile))
+				if test.wantCounts[i] < 0 {
+					if err != io.EOF || len(got) != 0 {
+						t.Fatalf("read %d: got %v and %v, want %v", i, got, err, io.EOF)
+					}
+					continue
+				}
+				if err != nil || len(got) != test.wantCounts[i] {
+					t.Fatalf("read %d: got %v and %v, want %d names", i, got, err, test.wantCounts[i])
+				}
+				names = append(names, got...)
+			}
+			// every entry is listed once, meta files are never listed
+			seen := make(map[string]bool)
+			for _, name := range names {
+				if seen[name] {
+					t.Fatalf("listed %s twice", name)
+				}
+				seen[name] = true
+			}
+			for _, name := range wantNames {
+				if !seen[name] {
+					t.Fatalf("got %v, want %v", names, wantNames)
+				}
+			}
+		})
+	}
+
+	f, err := encFs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirEntries, err := f.(*EncFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirEntry := range dirEntries {
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSize := int64(10 * (int(dirEntry.Name()[0]) - 'a'))
+		if dirEntry.IsDir() != (dirEntry.Name() == "sub") || fileInfo.Name() != dirEntry.Name() ||
+			dirEntry.Type() != fileInfo.Mode().Type() || (!dirEntry.IsDir() && fileInfo.Size() != wantSize) {
+			t.Fatalf("%s: got entry %v with info %v", dirEntry.Name(), dirEntry, fileInfo)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(*EncFile).ReadDir(-1); !errors.Is(err, afero.ErrFileClosed) {
+		t.Fatalf("got %v, want %v", err, afero.ErrFileClosed)
+	}
+}
+
+func readTestDirEntries(count int) func(f *EncFile) ([]string, error) {
+	return func(f *EncFile) ([]string, error) {
+		dirEntries, err := f.ReadDir(count)
+		var names []string
+		for _, dirEntry := range dirEntries {
+			names = append(names, dirEntry.Name())
+		}
+		return names, err
+	}
+}
+
+func readTestFileInfos(count int) func(f *EncFile) ([]string, error) {
+	return func(f *EncFile) ([]string, error) {
+		fileInfos, err := f.Readdir(count)
+		var names []string
+		for _, fileInfo := range fileInfos {
+			names = append(names, fileInfo.Name())
+		}
+		return names, err
+	}
+}
+
+func readTestDirNames(count int) func(f *EncFile) ([]string, error) {
+	return func(f *EncFile) ([]string, error) {
+		return f.Readdirnames(count)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm block padding", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}},
+	}
+	flags := []struct {
+		name string
+		flag int
+	}{
+		{"write only", os.O_WRONLY | os.O_APPEND},
+		{"read write", os.O_RDWR | os.O_APPEND},
+	}
+	data := testPattern(CONTENT_CHUNK_SIZE + 100)
+	for _, test := range tests {
+		for _, flag := range flags {
+			t.Run(test.name+" "+flag.name, func(t *testing.T) {
+				encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := test.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/file", data)
+				f, err := encFs.OpenFile("/file", flag.flag, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				// the position starts at the end of file
+				if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != int64(len(data)) {
+					t.Fatalf("got position %d and %v, want %d", pos, err, len(data))
+				}
+				if _, err := f.Write([]byte("first")); err != nil {
+					t.Fatal(err)
+				}
+				// writes go to the end of file after seeking
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Write([]byte("second")); err != nil {
+					t.Fatal(err)
+				}
+				// and after another handle appended
+				writeTestAppend(t, encFs, "/file", []byte("other"))
+				if _, err := f.Write([]byte("third")); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, encFs, "/file", append(append([]byte(nil), data...), "firstsecondotherthird"...))
+			})
+		}
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	tests := []struct {
+		name   string
+		cipher string
+	}{
+		{"ctr", CIPHER_AES_CTR},
+		{"gcm", CIPHER_AES_GCM},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(test.cipher); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/log", nil)
+			const handles, records = 8, 50
+			var wg sync.WaitGroup
+			for i := 0; i < handles; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					f, err := encFs.OpenFile("/log", os.O_WRONLY|os.O_APPEND, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer func() {
+						_ = f.Close()
+					}()
+					for j := 0; j < records; j++ {
+						if _, err := fmt.Fprintf(f, "handle %d record %03d\n", i, j); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			// no record overwrote another one
+			lines := strings.Split(strings.TrimSuffix(string(readTestFile(t, encFs, "/log")), "\n"), "\n")
+			if len(lines) != handles*records {
+				t.Fatalf("got %d records, want %d", len(lines), handles*records)
+			}
+			seen := make(map[string]bool)
+			for _, line := range lines {
+				var i, j int
+				if _, err := fmt.Sscanf(line, "handle %d record %03d", &i, &j); err != nil || seen[line] {
+					t.Fatalf("got record %q", line)
+				}
+				seen[line] = true
+			}
+		})
+	}
+}
+
+func writeTestAppend(t *testing.T, fs afero.Fs, name string, data []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedHandle(t *testing.T) {
+	const goroutines, records = 8, 50
+	record := func(i, j int) string { return fmt.Sprintf("goroutine %d record %03d\n", i, j) }
+	tests := []struct {
+		name string
+		// run is called by each goroutine on the shared handle
+		run   func(t *testing.T, f afero.File, i int)
+		check func(t *testing.T, encFs *EncFs)
+	}{
+		{"write", func(t *testing.T, f afero.File, i int) {
+			for j := 0; j < records; j++ {
+				if _, err := f.Write([]byte(record(i, j))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}, func(t *testing.T, encFs *EncFs) {
+			// records are never interleaved or overwritten
+			lines := strings.Split(strings.TrimSuffix(string(readTestFile(t, encFs, "/file")), "\n"), "\n")
+			seen := make(map[string]bool)
+			for _, line := range lines {
+				seen[line+"\n"] = true
+			}
+			for i := 0; i < goroutines; i++ {
+				for j := 0; j < records; j++ {
+					if !seen[record(i, j)] {
+						t.Fatalf("missing %q of %d lines", record(i, j), len(lines))
+					}
+				}
+			}
+		}},
+		{"write at", func(t *testing.T, f afero.File, i int) {
+			for j := 0; j < records; j++ {
+				off := int64((j*goroutines + i) * len(record(0, 0)))
+				if _, err := f.WriteAt([]byte(record(i, j)), off); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}, func(t *testing.T, encFs *EncFs) {
+			var want []byte
+			for j := 0; j < records; j++ {
+				for i := 0; i < goroutines; i++ {
+					want = append(want, record(i, j)...)
+				}
+			}
+			checkTestFile(t, encFs, "/file", want)
+		}},
+	}
+	for _, cipher := range []string{CIPHER_AES_CTR, CIPHER_AES_GCM} {
+		for _, test := range tests {
+			t.Run(cipher+" "+test.name, func(t *testing.T) {
+				encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := encFs.WithContentCipher(cipher); err != nil {
+					t.Fatal(err)
+				}
+				f, err := encFs.Create("/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var wg sync.WaitGroup
+				for i := 0; i < goroutines; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						test.run(t, f, i)
+					}(i)
+				}
+				wg.Wait()
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				test.check(t, encFs)
+			})
+		}
+	}
+}
+
+func TestSharedHandleRead(t *testing.T) {
+	for _, cipher := range []string{CIPHER_AES_CTR, CIPHER_AES_GCM} {
+		t.Run(cipher, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(cipher); err != nil {
+				t.Fatal(err)
+			}
+			// every block of 100 bytes starts with its index so concurrent reads can be put in order
+			const blocks, blockSize = 400, 100
+			data := make([]byte, 0, blocks*blockSize)
+			for i := 0; i < blocks; i++ {
+				data = append(data, fmt.Sprintf("%05d", i)...)
+				data = append(data, testPattern(blockSize-5)...)
+			}
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			got := make([][]byte, blocks)
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						block := make([]byte, blockSize)
+						// a shared position serves every block to one reader only, reads of a handle fill the buffer
+						n, err := f.Read(block)
+						if err == io.EOF {
+							return
+						}
+						if err != nil || n != blockSize {
+							t.Errorf("read %d bytes: %v", n, err)
+							return
+						}
+						var index int
+						if _, err := fmt.Sscanf(string(block[:5]), "%05d", &index); err != nil || index >= blocks {
+							t.Errorf("read block %q", block[:5])
+							return
+						}
+						mutex.Lock()
+						got[index] = block
+						mutex.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if !bytes.Equal(bytes.Join(got, nil), data) {
+				t.Fatal("concurrent reads got other data")
+			}
+		})
+	}
+}
+
+func TestHandlePositionAfterWriteAt(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs)
+	}{
+		{"ctr", func(encFs *EncFs) {}},
+		{"ctr header", func(encFs *EncFs) { encFs.WithFileFormat(FILE_FORMAT_HEADER) }},
+		{"ctr integrity tags", func(encFs *EncFs) { encFs.WithIntegrityTags(true) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			test.setup(encFs)
+			f, err := encFs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			// WriteAt of afero.MemMapFs moves the position of the underlying file, the handle keeps its own
+			if _, err := f.Write([]byte("abcdef")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("XY"), 100); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("gh")); err != nil {
+				t.Fatal(err)
+			}
+			if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 8 {
+				t.Fatalf("got position %d: %v, want 8", pos, err)
+			}
+			if _, err := f.Seek(2, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("Z"), 50); err != nil {
+				t.Fatal(err)
+			}
+			buff := make([]byte, 4)
+			if n, err := f.Read(buff); err != nil || string(buff[:n]) != "cdef" {
+				t.Fatalf("read %q: %v", buff[:n], err)
+			}
+			if err := f.Truncate(200); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("ij")); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 200)
+			copy(want, "abcdefij")
+			want[50], want[100], want[101] = 'Z', 'X', 'Y'
+			checkTestFile(t, encFs, "/file", want)
+		})
+	}
+}
+
+func TestStrictMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, encFs *EncFs, base afero.Fs)
+		flag  int
+		// the error of strict opens, other opens succeed
+		wantErr error
+	}{
+		{"sidecar meta", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, encFs, "/file", []byte("data"))
+		}, os.O_RDONLY, nil},
+		{"header", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			writeTestFile(t, encFs, "/file", []byte("data"))
+		}, os.O_RDONLY, nil},
+		{"lost meta", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			if err := base.Remove("/file" + EncFileExt); err != nil {
+				t.Fatal(err)
+			}
+		}, os.O_RDONLY, ErrMissingFileMeta},
+		{"lost meta read write", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			if err := base.Remove("/file" + EncFileExt); err != nil {
+				t.Fatal(err)
+			}
+		}, os.O_RDWR, ErrMissingFileMeta},
+		{"plain file", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, "/file", []byte("data"))
+		}, os.O_RDONLY, ErrMissingFileMeta},
+		// new files get meta
+		{"created", nil, os.O_RDWR | os.O_CREATE, nil},
+		{"passthrough", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			if err := encFs.WithPassthroughPatterns([]string{"file"}); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("data"))
+		}, os.O_RDONLY, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, strictMetadata := range []bool{false, true} {
+				encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if test.setup != nil {
+					test.setup(t, encFs, base)
+				}
+				encFs.WithStrictMetadata(strictMetadata)
+				f, err := encFs.OpenFile("/file", test.flag, 0644)
+				if err == nil {
+					_ = f.Close()
+				}
+				var wantErr error
+				if strictMetadata {
+					wantErr = test.wantErr
+				}
+				if !errors.Is(err, wantErr) {
+					t.Fatalf("strict %t: got %v, want %v", strictMetadata, err, wantErr)
+				}
+				var pathError *os.PathError
+				if err != nil && (!errors.As(err, &pathError) || pathError.Path != "/file") {
+					t.Fatalf("got %v, want a path error of the plaintext name", err)
+				}
+				// files without meta are read raw otherwise
+				if test.wantErr != nil && !strictMetadata {
+					checkTestFile(t, encFs, "/file", readTestFile(t, base, "/file"))
+				}
+			}
+		})
+	}
+}
+
+func TestNonceAdd(t *testing.T) {
+	tests := []struct {
+		nonce     string
+		increment uint64
+		want      string
+	}{
+		{"00000000000000000000000000000000", 0, "00000000000000000000000000000000"},
+		{"00000000000000000000000000000000", 1, "00000000000000000000000000000001"},
+		{"000000000000000000000000000000ff", 1, "00000000000000000000000000000100"},
+		{"0000000000000000fffffffffffffffe", 1, "0000000000000000ffffffffffffffff"},
+		// the low half carries into the high half
+		{"0000000000000000ffffffffffffffff", 1, "00000000000000010000000000000000"},
+		{"0000000000000000fffffffffffffff0", 0x20, "00000000000000010000000000000010"},
+		{"0123456789abcdeffffffffffffffffe", 0xffffffffffffffff, "0123456789abcdf0fffffffffffffffd"},
+		// the counter wraps at 128 bits like cipher.NewCTR
+		{"ffffffffffffffffffffffffffffffff", 1, "00000000000000000000000000000000"},
+	}
+	for _, test := range tests {
+		nonce := decodeTestHex(t, test.nonce)
+		got := nonceAdd(nonce, test.increment)
+		if hex.EncodeToString(got) != test.want {
+			t.Fatalf("%s + %x: got %x, want %s", test.nonce, test.increment, got, test.want)
+		}
+		if hex.EncodeToString(nonce) != test.nonce {
+			t.Fatalf("%s + %x changed the nonce", test.nonce, test.increment)
+		}
+	}
+}
+
+func TestXorCtrKeyStream(t *testing.T) {
+	key := testKeyBytes(1)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keystream byte at off is the byte off%16 of the AES block of iv+off/16
+	referenceKeyStream := func(iv []byte, off int64, size int) []byte {
+		keyStream := make([]byte, size)
+		modulus := new(big.Int).Lsh(big.NewInt(1), 128)
+		for i := range keyStream {
+			pos := off + int64(i)
+			counter := new(big.Int).Add(new(big.Int).SetBytes(iv), big.NewInt(pos/16))
+			counterBytes := make([]byte, 16)
+			counter.Mod(counter, modulus).FillBytes(counterBytes)
+			encrypted := make([]byte, 16)
+			block.Encrypt(encrypted, counterBytes)
+			keyStream[i] = encrypted[pos%16]
+		}
+		return keyStream
+	}
+	tests := []struct {
+		name string
+		iv   string
+		off  int64
+		size int
+	}{
+		{"start", "000102030405060708090a0b0c0d0e0f", 0, 100},
+		{"inside a block", "000102030405060708090a0b0c0d0e0f", 5, 30},
+		{"block boundary", "000102030405060708090a0b0c0d0e0f", 16, 16},
+		{"far offset", "000102030405060708090a0b0c0d0e0f", 1<<40 + 3, 50},
+		// the keystream crosses the carry of the low half of the counter
+		{"carry", "0000000000000000fffffffffffffffe", 17, 64},
+		{"carry at offset", "0000000000000000ffffffffffffff00", 0xff*16 + 9, 64},
+		{"wrap", "ffffffffffffffffffffffffffffffff", 3, 40},
+	}
+	for _, test := range tests {
+		iv := decodeTestHex(t, test.iv)
+		src := testPattern(test.size)
+		dst := make([]byte, test.size)
+		if err := xorCtrKeyStream(key, iv, test.off, dst, src); err != nil {
+			t.Fatal(err)
+		}
+		want := referenceKeyStream(iv, test.off, test.size)
+		for i := range want {
+			want[i] ^= src[i]
+		}
+		if !bytes.Equal(dst, want) {
+			t.Fatalf("%s: got other ciphertext", test.name)
+		}
+		// parts of the stream match the whole stream
+		for _, split := range []int{1, 15, 16, 17} {
+			if split >= test.size {
+				continue
+			}
+			part := make([]byte, test.size-split)
+			if err := xorCtrKeyStream(key, iv, test.off+int64(split), part, src[split:]); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(part, dst[split:]) {
+				t.Fatalf("%s: the stream at %d differs", test.name, split)
+			}
+		}
+	}
+}
+
+func TestCachedCiphersOfHandles(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"chacha20", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_CHACHA20_POLY1305) }},
+		{"ctr subkeys", func(encFs *EncFs) error {
+			encFs.key.WithSubkeys(true)
+			return nil
+		}},
+		// write buffers are never reused while a backend write may outlive its deadline
+		{"ctr deadline", func(encFs *EncFs) error {
+			encFs.WithOperationTimeout(time.Minute)
+			return nil
+		}},
+	}
+	// each step changes the file by the handle and the model
+	type step func(t *testing.T, f afero.File, model []byte) []byte
+	write := func(size int) step {
+		return func(t *testing.T, f afero.File, model []byte) []byte {
+			data := testRandomBytes(size, int64(size))
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			pos, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return overwriteTestBytes(model, pos-int64(size), data)
+		}
+	}
+	writeAt := func(off int64, size int) step {
+		return func(t *testing.T, f afero.File, model []byte) []byte {
+			data := testRandomBytes(size, off)
+			if _, err := f.WriteAt(data, off); err != nil {
+				t.Fatal(err)
+			}
+			return overwriteTestBytes(model, off, data)
+		}
+	}
+	truncate := func(size int64) step {
+		return func(t *testing.T, f afero.File, model []byte) []byte {
+			if err := f.Truncate(size); err != nil {
+				t.Fatal(err)
+			}
+			if size <= int64(len(model)) {
+				return model[:size]
+			}
+			return append(model, make([]byte, size-int64(len(model)))...)
+		}
+	}
+	steps := []step{
+		write(100), write(10), write(CONTENT_CHUNK_SIZE + 5), writeAt(3, 7), writeAt(50000, 20000),
+		truncate(200000), write(1), writeAt(199990, 30), truncate(1000), writeAt(0, 5000), write(3),
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			f, err := encFs.Create("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			var model []byte
+			for i, step := range steps {
+				model = step(t, f, model)
+				// the handle reads what it wrote, other handles too
+				got := make([]byte, len(model))
+				if n, err := f.ReadAt(got, 0); (err != nil && err != io.EOF) || n != len(model) {
+					t.Fatalf("step %d: read %d bytes: %v", i, n, err)
+				}
+				if !bytes.Equal(got, model) {
+					t.Fatalf("step %d: the handle read other contents", i)
+				}
+				if err := f.Sync(); err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, encFs, "/file", model)
+			}
+		})
+	}
+}
+
+// overwriteTestBytes writes data at off of b, b grows by zeros when off is after its end
+func overwriteTestBytes(b []byte, off int64, data []byte) []byte {
+	if end := off + int64(len(data)); end > int64(len(b)) {
+		b = append(b, make([]byte, end-int64(len(b)))...)
+	}
+	copy(b[off:], data)
+	return b
+}
+
+// failingMetaRenameFs fails renaming temp files onto meta files while failRename is set
+type failingMetaRenameFs struct {
+	afero.Fs
+	failRename bool
+}
+
+var errTestRenameFailed = errors.New("rename failed")
+
+func (fs *failingMetaRenameFs) Rename(oldname, newname string) error {
+	if fs.failRename && strings.HasSuffix(newname, EncFileExt) {
+		return errTestRenameFailed
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func TestAtomicMetaWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		// exists writes the file before the meta renames fail, keepsMeta keeps its meta when they do
+		exists    bool
+		keepsMeta bool
+		op        func(encFs *EncFs) error
+	}{
+		{"new file", false, false, func(encFs *EncFs) error {
+			return afero.WriteFile(encFs, "/file", []byte("new"), 0644)
+		}},
+		{"truncate to zero", true, true, func(encFs *EncFs) error {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			return f.Truncate(0)
+		}},
+		// the old meta is removed with the contents, an empty file gets its meta with the next write
+		{"O_TRUNC", true, false, func(encFs *EncFs) error {
+			return afero.WriteFile(encFs, "/file", []byte("new"), 0644)
+		}},
+		{"rewrite", true, true, func(encFs *EncFs) error {
+			encFileMeta, err := openEncFileMeta(encFs, encFs.base, "/file")
+			if err != nil {
+				return err
+			}
+			return encFs.rewriteEncFileMeta(encFs.base, "/file", encFileMeta)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := &failingMetaRenameFs{Fs: afero.NewMemMapFs()}
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			if test.exists {
+				writeTestFile(t, encFs, "/file", []byte("old"))
+			}
+			metaName := encFs.encFileMetaName("/file")
+			oldMeta := snapshotTestFs(t, base.Fs)[metaName]
+
+			base.failRename = true
+			if err := test.op(encFs); !errors.Is(err, errTestRenameFailed) {
+				t.Fatalf("got %v, want %v", err, errTestRenameFailed)
+			}
+			// the meta file is the old one or none, never empty or partly written, no temp file is left
+			snapshot := snapshotTestFs(t, base.Fs)
+			if meta, ok := snapshot[metaName]; ok != test.keepsMeta || ok && meta != oldMeta {
+				t.Fatalf("got meta %q, want %q", meta, oldMeta)
+			}
+			if !test.keepsMeta && snapshot["/file"] != "" {
+				t.Fatalf("got contents %q without meta", snapshot["/file"])
+			}
+			for name := range snapshot {
+				if strings.HasSuffix(name, NEW_TEMP_META_FILE_SUFFIX) ||
+					strings.HasSuffix(name, TRUNCATE_TEMP_META_FILE_SUFFIX) {
+					t.Fatalf("left temp meta %s", name)
+				}
+			}
+
+			base.failRename = false
+			if err := test.op(encFs); err != nil {
+				t.Fatal(err)
+			}
+			if meta := snapshotTestFs(t, base.Fs)[metaName]; meta == "" || meta == oldMeta && test.name != "rewrite" {
+				t.Fatalf("got meta %q", meta)
+			}
+			if _, err := decodeEncFileMeta([]byte(snapshotTestFs(t, base.Fs)[metaName])); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
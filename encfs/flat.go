@@ -0,0 +1,621 @@
+package encfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	FLAT_INDEX_FILE_NAME = "__ENCFS_INDEX__" + EncFileExt
+	FLAT_INDEX_KEY_INFO  = "encfs-flat-index"
+)
+
+var (
+	ErrBadFlatIndex = errors.New("flat layout index is broken")
+)
+
+type FlatEntry struct {
+	Object  string      `json:"object,omitempty"`
+	IsDir   bool        `json:"is_dir"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// FlatEncFs stores all encrypted files flat under random object names in root,
+// directory structure only lives in the encrypted index file
+type FlatEncFs struct {
+	key     *EncryptionMasterKey
+	root    string
+	encFs   *EncFs
+	mutex   *sync.Mutex
+	entries map[string]*FlatEntry
+}
+
+func NewFlatEncFs(key *EncryptionMasterKey, root string) (*FlatEncFs, error) {
+	return NewFlatEncFsWithBackend(key, root, afero.NewOsFs())
+}
+
+// NewFlatEncFsWithBackend stores the objects and the index in root of base
+func NewFlatEncFsWithBackend(key *EncryptionMasterKey, root string, base afero.Fs) (*FlatEncFs, error) {
+	flatEncFs := &FlatEncFs{
+		key:   key,
+		root:  root,
+		encFs: newEncFs(NewEncryptionMasterKey(key.key), base),
+		mutex: &sync.Mutex{},
+	}
+	if err := flatEncFs.backend().MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	if err := flatEncFs.loadIndex(); err != nil {
+		return nil, err
+	}
+	return flatEncFs, nil
+}
+
+func (*FlatEncFs) Name() string { return "FlatEncFs" }
+
+func (flatFs *FlatEncFs) Create(name string) (afero.File, error) {
+	return flatFs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (flatFs *FlatEncFs) Mkdir(name string, perm os.FileMode) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	if _, found := flatFs.entries[name]; found {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := flatFs.checkParentDir("mkdir", name); err != nil {
+		return err
+	}
+	flatFs.entries[name] = &FlatEntry{IsDir: true, Mode: os.ModeDir | perm.Perm(), ModTime: time.Now()}
+	return flatFs.saveIndex()
+}
+
+func (flatFs *FlatEncFs) MkdirAll(name string, perm os.FileMode) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	changed := false
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		if entry, found := flatFs.entries[dir]; found {
+			if !entry.IsDir {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		flatFs.entries[dir] = &FlatEntry{IsDir: true, Mode: os.ModeDir | perm.Perm(), ModTime: time.Now()}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return flatFs.saveIndex()
+}
+
+func (flatFs *FlatEncFs) Open(name string) (afero.File, error) {
+	return flatFs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (flatFs *FlatEncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	entry, found := flatFs.entries[name]
+	isCreate := false
+	if found {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := flatFs.checkParentDir("open", name); err != nil {
+			return nil, err
+		}
+		object, err := newFlatObjectName(flatFs.encFs)
+		if err != nil {
+			return nil, err
+		}
+		entry = &FlatEntry{Object: object, Mode: perm.Perm(), ModTime: time.Now()}
+		flatFs.entries[name] = entry
+		if err := flatFs.saveIndex(); err != nil {
+			delete(flatFs.entries, name)
+			return nil, err
+		}
+		isCreate = true
+	}
+	if entry.IsDir {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		rootDir, err := flatFs.backend().Open(flatFs.root)
+		if err != nil {
+			return nil, err
+		}
+		encFile, err := NewEncFile(flatFs.root, rootDir, flatFs.encFs, false)
+		if err != nil {
+			_ = rootDir.Close()
+			return nil, err
+		}
+		return &FlatFile{EncFile: encFile, flatFs: flatFs, name: name}, nil
+	}
+	objectName := flatFs.objectPath(entry.Object)
+	// O_EXCL is checked by the index, the object of a new entry never exists
+	baseFlag := flatFs.encFs.contentOpenFlag(objectName, flag&^os.O_EXCL)
+	file, err := flatFs.backend().OpenFile(objectName, baseFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// O_TRUNC gives the object a new IV like in EncFs
+	encFile, err := newEncFile(objectName, file, flatFs.encFs, isCreate, flag)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := encFile.emulateOpenFlags(flag, baseFlag); err != nil {
+		_ = encFile.Close()
+		return nil, err
+	}
+	return &FlatFile{EncFile: encFile, flatFs: flatFs, name: name}, nil
+}
+
+func (flatFs *FlatEncFs) Remove(name string) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	entry, found := flatFs.entries[name]
+	if !found {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if entry.IsDir && len(flatFs.childNames(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(flatFs.entries, name)
+	if err := flatFs.saveIndex(); err != nil {
+		return err
+	}
+	return flatFs.removeObject(entry)
+}
+
+func (flatFs *FlatEncFs) RemoveAll(name string) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	removedEntries := make([]*FlatEntry, 0)
+	for entryName, entry := range flatFs.entries {
+		if entryName == "/" {
+			continue
+		}
+		if name == "/" || entryName == name || strings.HasPrefix(entryName, name+"/") {
+			removedEntries = append(removedEntries, entry)
+			delete(flatFs.entries, entryName)
+		}
+	}
+	if len(removedEntries) == 0 {
+		return nil
+	}
+	if err := flatFs.saveIndex(); err != nil {
+		return err
+	}
+	for _, entry := range removedEntries {
+		if err := flatFs.removeObject(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (flatFs *FlatEncFs) Rename(oldname, newname string) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	oldname = cleanFlatPath(oldname)
+	newname = cleanFlatPath(newname)
+	entry, found := flatFs.entries[oldname]
+	if !found {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if oldname == "/" || newname == "/" || strings.HasPrefix(newname, oldname+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	if err := flatFs.checkParentDir("rename", newname); err != nil {
+		return err
+	}
+	var replacedEntry *FlatEntry
+	if newEntry, found := flatFs.entries[newname]; found {
+		if newEntry.IsDir != entry.IsDir || (newEntry.IsDir && len(flatFs.childNames(newname)) > 0) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+		}
+		replacedEntry = newEntry
+	}
+	for entryName, childEntry := range flatFs.entries {
+		if strings.HasPrefix(entryName, oldname+"/") {
+			delete(flatFs.entries, entryName)
+			flatFs.entries[newname+strings.TrimPrefix(entryName, oldname)] = childEntry
+		}
+	}
+	delete(flatFs.entries, oldname)
+	flatFs.entries[newname] = entry
+	if err := flatFs.saveIndex(); err != nil {
+		return err
+	}
+	if replacedEntry != nil {
+		return flatFs.removeObject(replacedEntry)
+	}
+	return nil
+}
+
+func (flatFs *FlatEncFs) Stat(name string) (os.FileInfo, error) {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	return flatFs.stat(cleanFlatPath(name))
+}
+
+func (flatFs *FlatEncFs) Chmod(name string, mode os.FileMode) error {
+	return flatFs.updateEntry("chmod", name, func(entry *FlatEntry) error {
+		if entry.IsDir {
+			entry.Mode = os.ModeDir | mode.Perm()
+			return nil
+		}
+		entry.Mode = mode.Perm()
+		return flatFs.backend().Chmod(flatFs.objectPath(entry.Object), mode)
+	})
+}
+
+func (flatFs *FlatEncFs) Chown(name string, uid, gid int) error {
+	return flatFs.updateEntry("chown", name, func(entry *FlatEntry) error {
+		if entry.IsDir {
+			return nil
+		}
+		return flatFs.backend().Chown(flatFs.objectPath(entry.Object), uid, gid)
+	})
+}
+
+func (flatFs *FlatEncFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return flatFs.updateEntry("chtimes", name, func(entry *FlatEntry) error {
+		entry.ModTime = mtime
+		if entry.IsDir {
+			return nil
+		}
+		return flatFs.backend().Chtimes(flatFs.objectPath(entry.Object), atime, mtime)
+	})
+}
+
+func (flatFs *FlatEncFs) updateEntry(op, name string, update func(entry *FlatEntry) error) error {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	name = cleanFlatPath(name)
+	entry, found := flatFs.entries[name]
+	if !found {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if err := update(entry); err != nil {
+		return err
+	}
+	return flatFs.saveIndex()
+}
+
+func (flatFs *FlatEncFs) stat(name string) (os.FileInfo, error) {
+	entry, found := flatFs.entries[name]
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	if entry.IsDir {
+		return &FlatFileInfo{name: path.Base(name), mode: entry.Mode, modTime: entry.ModTime}, nil
+	}
+	objectName := flatFs.objectPath(entry.Object)
+	objectFileInfo, err := flatFs.backend().Stat(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return &FlatFileInfo{
+		name:    path.Base(name),
+		size:    flatFs.encFs.logicalFileInfo(objectName, objectFileInfo).Size(),
+		mode:    objectFileInfo.Mode(),
+		modTime: objectFileInfo.ModTime(),
+		sys:     objectFileInfo.Sys(),
+	}, nil
+}
+
+func (flatFs *FlatEncFs) checkParentDir(op, name string) error {
+	parentName := path.Dir(name)
+	if parentName == "/" {
+		return nil
+	}
+	parentEntry, found := flatFs.entries[parentName]
+	if !found {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parentEntry.IsDir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (flatFs *FlatEncFs) childNames(dir string) []string {
+	childNames := make([]string, 0)
+	for entryName := range flatFs.entries {
+		if entryName != dir && path.Dir(entryName) == dir {
+			childNames = append(childNames, entryName)
+		}
+	}
+	sort.Strings(childNames)
+	return childNames
+}
+
+// backend returns the fs holding the objects and the index
+func (flatFs *FlatEncFs) backend() afero.Fs {
+	return flatFs.encFs.backend()
+}
+
+func (flatFs *FlatEncFs) objectPath(object string) string {
+	return filepath.Join(flatFs.root, object)
+}
+
+func (flatFs *FlatEncFs) removeObject(entry *FlatEntry) error {
+	if entry.IsDir {
+		return nil
+	}
+	objectName := flatFs.objectPath(entry.Object)
+	_ = flatFs.backend().Remove(flatFs.encFs.encFileMetaName(objectName))
+	err := flatFs.backend().Remove(objectName)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (flatFs *FlatEncFs) loadIndex() error {
+	indexBytes, err := afero.ReadFile(flatFs.backend(), filepath.Join(flatFs.root, FLAT_INDEX_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			flatFs.entries = make(map[string]*FlatEntry)
+			flatFs.ensureRootEntry()
+			return nil
+		}
+		return err
+	}
+	indexJsonBytes, err := openWithRandomNonce(flatFs.indexKey(), indexBytes)
+	if err != nil {
+		// indexes of older versions are sealed by the master key, they are sealed by the subkey when saved
+		if indexJsonBytes, err = openWithRandomNonce(flatFs.key.key, indexBytes); err != nil {
+			return ErrBadFlatIndex
+		}
+	}
+	entries := make(map[string]*FlatEntry)
+	if err := json.Unmarshal(indexJsonBytes, &entries); err != nil {
+		return ErrBadFlatIndex
+	}
+	flatFs.entries = entries
+	flatFs.ensureRootEntry()
+	return nil
+}
+
+func (flatFs *FlatEncFs) ensureRootEntry() {
+	if _, found := flatFs.entries["/"]; !found {
+		flatFs.entries["/"] = &FlatEntry{IsDir: true, Mode: os.ModeDir | 0700, ModTime: time.Now()}
+	}
+}
+
+// indexKey seals the index, derived by HKDF so the index and the objects never share a key
+func (flatFs *FlatEncFs) indexKey() []byte {
+	return hkdfSha256(flatFs.key.key, nil, []byte(FLAT_INDEX_KEY_INFO), len(flatFs.key.key))
+}
+
+// saveIndex replaces the index by a synced temp file and syncs the root, a crash leaves the old or the new index
+func (flatFs *FlatEncFs) saveIndex() error {
+	indexJsonBytes, err := json.Marshal(flatFs.entries)
+	if err != nil {
+		return err
+	}
+	indexBytes, err := sealWithRandomNonce(flatFs.indexKey(), indexJsonBytes)
+	if err != nil {
+		return err
+	}
+	indexName := filepath.Join(flatFs.root, FLAT_INDEX_FILE_NAME)
+	tempIndexName := indexName + ".tmp"
+	if err := writeSyncedFile(flatFs.backend(), tempIndexName, indexBytes); err != nil {
+		_ = flatFs.backend().Remove(tempIndexName)
+		return err
+	}
+	if err := flatFs.backend().Rename(tempIndexName, indexName); err != nil {
+		_ = flatFs.backend().Remove(tempIndexName)
+		return err
+	}
+	return syncBackendPath(flatFs.backend(), flatFs.root)
+}
+
+// FlatFile is a file or directory of FlatEncFs, directories are listed from the index, so the object names and the
+// index in the root are never seen
+type FlatFile struct {
+	*EncFile
+	flatFs *FlatEncFs
+	name   string
+}
+
+func (f *FlatFile) Name() string {
+	return f.name
+}
+
+// Stat returns the plaintext size of files, the mode and the times of directories come from the index
+func (f *FlatFile) Stat() (os.FileInfo, error) {
+	var size int64
+	if !f.isDir {
+		fileInfo, err := f.EncFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = fileInfo.Size()
+	}
+	f.flatFs.mutex.Lock()
+	defer f.flatFs.mutex.Unlock()
+	fileInfo, err := f.flatFs.stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir {
+		fileInfo.(*FlatFileInfo).size = size
+	}
+	return fileInfo, nil
+}
+
+// DirIterator returns an iterator over the entries of the directory in the index, sorted by name
+func (f *FlatFile) DirIterator() (*EncDirIterator, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.newDirIterator()
+}
+
+func (f *FlatFile) newDirIterator() (*EncDirIterator, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if !f.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	pos := 0
+	return &EncDirIterator{
+		encFile: f.EncFile,
+		nextBatch: func(count int) ([]fs.DirEntry, error) {
+			return f.flatFs.listDirBatch(f.name, &pos, count)
+		},
+	}, nil
+}
+
+// handleDirIterator returns the iterator kept on the handle like EncFile.handleDirIterator
+func (f *FlatFile) handleDirIterator() (*EncDirIterator, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.dirIterator == nil {
+		dirIterator, err := f.newDirIterator()
+		if err != nil {
+			return nil, err
+		}
+		f.dirIterator = dirIterator
+	}
+	return f.dirIterator, nil
+}
+
+func (f *FlatFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dirIterator, err := f.handleDirIterator()
+	if err != nil {
+		return nil, err
+	}
+	return readdirFromIterator(dirIterator, count)
+}
+
+func (f *FlatFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dirIterator, err := f.handleDirIterator()
+	if err != nil {
+		return nil, err
+	}
+	return readDirFromIterator(dirIterator, count)
+}
+
+func (f *FlatFile) Readdirnames(n int) ([]string, error) {
+	dirEntries, err := f.ReadDir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, dirEntry := range dirEntries {
+		names = append(names, dirEntry.Name())
+	}
+
+	return names, nil
+}
+
+// Seek of directories only supports Seek(0, io.SeekStart) which rewinds the listing, files seek their contents
+func (f *FlatFile) Seek(offset int64, whence int) (int64, error) {
+	if !f.isDir {
+		return f.EncFile.Seek(offset, whence)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.dirIterator = nil
+	return 0, nil
+}
+
+// listDirBatch returns count entries of dir after pos, sorted by name, io.EOF after the last one
+func (flatFs *FlatEncFs) listDirBatch(dir string, pos *int, count int) ([]fs.DirEntry, error) {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+	childNames := flatFs.childNames(dir)
+	if *pos >= len(childNames) {
+		return nil, io.EOF
+	}
+	childNames = childNames[*pos:]
+	if count > 0 && len(childNames) > count {
+		childNames = childNames[:count]
+	}
+	dirEntries := make([]fs.DirEntry, 0, len(childNames))
+	for _, childName := range childNames {
+		*pos++
+		fileInfo, err := flatFs.stat(childName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// the object was removed behind the index
+				continue
+			}
+			return dirEntries, err
+		}
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(fileInfo))
+	}
+	return dirEntries, nil
+}
+
+type FlatFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     interface{}
+}
+
+func (fi *FlatFileInfo) Name() string       { return fi.name }
+func (fi *FlatFileInfo) Size() int64        { return fi.size }
+func (fi *FlatFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *FlatFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *FlatFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *FlatFileInfo) Sys() interface{}   { return fi.sys }
+
+func cleanFlatPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func newFlatObjectName(encFs *EncFs) (string, error) {
+	objectBytes := make([]byte, 16)
+	if err := encFs.readRandom(objectBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(objectBytes), nil
+}
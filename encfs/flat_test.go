@@ -0,0 +1,324 @@
+package encfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func newTestFlatEncFs(t *testing.T) *FlatEncFs {
+	t.Helper()
+	flatFs, err := NewFlatEncFs(NewEncryptionMasterKey(testKeyBytes(1)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flatFs
+}
+
+func TestFlatFileListsIndexEntries(t *testing.T) {
+	flatFs := newTestFlatEncFs(t)
+	if err := flatFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, flatFs, "/a.txt", []byte("a"))
+	writeTestFile(t, flatFs, "/dir/b.txt", []byte("bb"))
+
+	listers := []struct {
+		name string
+		list func(f afero.File) ([]string, error)
+	}{
+		{"Readdirnames", func(f afero.File) ([]string, error) { return f.Readdirnames(-1) }},
+		{"Readdir", func(f afero.File) ([]string, error) {
+			fileInfos, err := f.Readdir(-1)
+			names := make([]string, len(fileInfos))
+			for i, fileInfo := range fileInfos {
+				names[i] = fileInfo.Name()
+			}
+			return names, err
+		}},
+		{"ReadDir", func(f afero.File) ([]string, error) {
+			dirEntries, err := f.(fs.ReadDirFile).ReadDir(-1)
+			names := make([]string, len(dirEntries))
+			for i, dirEntry := range dirEntries {
+				names[i] = dirEntry.Name()
+			}
+			return names, err
+		}},
+		{"DirIterator", func(f afero.File) ([]string, error) {
+			dirIterator, err := f.(*FlatFile).DirIterator()
+			if err != nil {
+				return nil, err
+			}
+			var names []string
+			for {
+				dirEntry, err := dirIterator.Next()
+				if err == io.EOF {
+					return names, nil
+				}
+				if err != nil {
+					return names, err
+				}
+				names = append(names, dirEntry.Name())
+			}
+		}},
+	}
+	dirs := []struct {
+		name string
+		want []string
+	}{
+		{"/", []string{"a.txt", "dir"}},
+		{"/dir", []string{"b.txt", "sub"}},
+		{"/dir/sub", nil},
+	}
+	for _, lister := range listers {
+		for _, dir := range dirs {
+			t.Run(lister.name+" "+dir.name, func(t *testing.T) {
+				f, err := flatFs.Open(dir.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				names, err := lister.list(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sort.Strings(names)
+				if len(names) == 0 {
+					names = nil
+				}
+				if !reflect.DeepEqual(names, dir.want) {
+					t.Fatalf("got %v, want %v", names, dir.want)
+				}
+			})
+		}
+	}
+}
+
+func TestFlatFileDirSeekRewinds(t *testing.T) {
+	flatFs := newTestFlatEncFs(t)
+	for _, name := range []string{"/a", "/b", "/c"} {
+		writeTestFile(t, flatFs, name, nil)
+	}
+	f, err := flatFs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	first, err := f.Readdirnames(2)
+	if err != nil || !reflect.DeepEqual(first, []string{"a", "b"}) {
+		t.Fatalf("first batch %v, %v", first, err)
+	}
+	if _, err := f.Seek(1, io.SeekStart); err == nil {
+		t.Fatal("seek to 1 of a directory succeeded")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	all, err := f.Readdirnames(-1)
+	if err != nil || !reflect.DeepEqual(all, []string{"a", "b", "c"}) {
+		t.Fatalf("after rewind %v, %v", all, err)
+	}
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		t.Fatalf("after the last entry got %v, want io.EOF", err)
+	}
+}
+
+func TestFlatFileStatReportsPlaintextSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(flatFs *FlatEncFs) error
+	}{
+		{"ctr", func(flatFs *FlatEncFs) error { return nil }},
+		{"gcm", func(flatFs *FlatEncFs) error { return flatFs.encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"header", func(flatFs *FlatEncFs) error { flatFs.encFs.WithFileFormat(FILE_FORMAT_HEADER); return nil }},
+	}
+	data := testPattern(10000)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flatFs := newTestFlatEncFs(t)
+			if err := test.setup(flatFs); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, flatFs, "/file", data)
+			fileInfo, err := flatFs.Stat("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Size() != int64(len(data)) {
+				t.Fatalf("Stat size %d, want %d", fileInfo.Size(), len(data))
+			}
+			f, err := flatFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			fileInfo, err = f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Name() != "file" || fileInfo.Size() != int64(len(data)) {
+				t.Fatalf("file Stat %s %d, want file %d", fileInfo.Name(), fileInfo.Size(), len(data))
+			}
+			checkTestFile(t, flatFs, "/file", data)
+		})
+	}
+}
+
+func TestFlatFileClosedDirectory(t *testing.T) {
+	flatFs := newTestFlatEncFs(t)
+	f, err := flatFs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Readdir(-1); err != afero.ErrFileClosed {
+		t.Fatalf("Readdir of a closed directory got %v", err)
+	}
+	if _, err := f.(*FlatFile).DirIterator(); err != afero.ErrFileClosed {
+		t.Fatalf("DirIterator of a closed directory got %v", err)
+	}
+	if _, err := os.Stat(flatFs.root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlatFileOpenFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(flatFs *FlatEncFs) error
+	}{
+		{"ctr", func(flatFs *FlatEncFs) error { return nil }},
+		{"gcm", func(flatFs *FlatEncFs) error { return flatFs.encFs.WithContentCipher(CIPHER_AES_GCM) }},
+	}
+	opens := []struct {
+		name string
+		flag int
+		data []byte
+		want []byte
+	}{
+		{"write only", os.O_WRONLY, []byte("AB"), []byte("ABcdef")},
+		{"append", os.O_WRONLY | os.O_APPEND, []byte("gh"), []byte("abcdefgh")},
+		{"truncate", os.O_WRONLY | os.O_TRUNC, []byte("xy"), []byte("xy")},
+		{"exclusive create of an existing file", os.O_WRONLY | os.O_CREATE | os.O_EXCL, nil, nil},
+	}
+	for _, test := range tests {
+		for _, open := range opens {
+			t.Run(test.name+" "+open.name, func(t *testing.T) {
+				flatFs := newTestFlatEncFs(t)
+				if err := test.setup(flatFs); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, flatFs, "/file", []byte("abcdef"))
+				f, err := flatFs.OpenFile("/file", open.flag, 0644)
+				if open.want == nil {
+					if !os.IsExist(err) {
+						t.Fatalf("got %v, want %v", err, os.ErrExist)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Write(open.data); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Read(make([]byte, 1)); err == nil {
+					t.Fatal("read of a write only file succeeded")
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, flatFs, "/file", open.want)
+			})
+		}
+	}
+}
+
+func TestFlatFileTruncateRenewsIv(t *testing.T) {
+	flatFs := newTestFlatEncFs(t)
+	data := testPattern(100)
+	writeTestFile(t, flatFs, "/file", data)
+	objectName := flatFs.objectPath(flatFs.entries["/file"].Object)
+	before, err := os.ReadFile(objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same contents, the keystream must differ
+	writeTestFile(t, flatFs, "/file", data)
+	after, err := os.ReadFile(objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatal("rewritten file reused the keystream")
+	}
+	checkTestFile(t, flatFs, "/file", data)
+}
+
+func TestFlatIndexKey(t *testing.T) {
+	root := t.TempDir()
+	key := NewEncryptionMasterKey(testKeyBytes(1))
+	flatFs, err := NewFlatEncFs(key, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, flatFs, "/file", []byte("data"))
+	indexName := filepath.Join(root, FLAT_INDEX_FILE_NAME)
+	indexBytes, err := os.ReadFile(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openWithRandomNonce(key.key, indexBytes); err == nil {
+		t.Fatal("index is sealed by the master key")
+	}
+	if _, err := os.Stat(indexName + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp index was left behind: %v", err)
+	}
+
+	// indexes of older versions are read and sealed by the subkey when saved
+	indexJsonBytes, err := openWithRandomNonce(flatFs.indexKey(), indexBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyIndexBytes, err := sealWithRandomNonce(key.key, indexJsonBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(indexName, legacyIndexBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	flatFs, err = NewFlatEncFs(key, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, flatFs, "/file", []byte("data"))
+	if err := flatFs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	indexBytes, err = os.ReadFile(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openWithRandomNonce(flatFs.indexKey(), indexBytes); err != nil {
+		t.Fatalf("saved index is not sealed by the subkey: %v", err)
+	}
+
+	if _, err := NewFlatEncFs(NewEncryptionMasterKey(testKeyBytes(2)), root); err != ErrBadFlatIndex {
+		t.Fatalf("other key got %v, want %v", err, ErrBadFlatIndex)
+	}
+}
@@ -1,10 +1,8 @@
 package encfs
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"encoding/base64"
-	"fmt"
+	"context"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -21,9 +19,10 @@ const ENCRYPTED_FILE_NAME_PREFIX = "__ENCFS__"
 
 type EncryptionMasterKey struct {
 	key           []byte
-	fileNameIv    []byte
-	mutex         *sync.Mutex
-	pathExistsMap map[string]bool
+	nameMapper    NameMapper
+	contentCipher string
+	// subkeys is set by WithSubkeys
+	subkeys bool
 }
 
 func NewEncryptionMasterKey(key []byte) *EncryptionMasterKey {
@@ -31,259 +30,712 @@ func NewEncryptionMasterKey(key []byte) *EncryptionMasterKey {
 }
 
 func NewEncryptionMasterKeyWithFileNameIv(key []byte, fileNameIv []byte) *EncryptionMasterKey {
-	mutex := &sync.Mutex{}
-	pathExistsMap := make(map[string]bool)
+	var nameMapper NameMapper
+	if fileNameIv == nil {
+		nameMapper = NewNoopNameMapper()
+	} else {
+		nameMapper = NewGcmNameMapper(key, fileNameIv)
+	}
+	return NewEncryptionMasterKeyWithNameMapper(key, nameMapper)
+}
+
+func NewEncryptionMasterKeyWithNameMapper(key []byte, nameMapper NameMapper) *EncryptionMasterKey {
 	return &EncryptionMasterKey{
-		key,
-		fileNameIv,
-		mutex,
-		pathExistsMap,
+		key:        key,
+		nameMapper: nameMapper,
 	}
 }
 
 func (k *EncryptionMasterKey) WithFileNameIv(fileNameIv []byte) {
-	k.fileNameIv = fileNameIv
+	if fileNameIv == nil {
+		k.WithNameMapper(NewNoopNameMapper())
+	} else {
+		k.WithNameMapper(NewGcmNameMapper(k.FileNameKey(), fileNameIv))
+	}
 }
 
-func (k *EncryptionMasterKey) EncryptFileName(name string) string {
-	if k.fileNameIv == nil {
-		// DO NOT ENCRYPT
-		return name
-	}
-	absName, err := filepath.Abs(name)
-	if err != nil {
-		// should not happen, file name is not encrypted
-		return name
+func (k *EncryptionMasterKey) WithNameMapper(nameMapper NameMapper) {
+	if nameMapper == nil {
+		nameMapper = NewNoopNameMapper()
 	}
-	encryptedName := k.recursiveEncrpteFileName(absName)
-	return encryptedName
+	k.nameMapper = nameMapper
+}
+
+func (k *EncryptionMasterKey) NameMapper() NameMapper {
+	return k.nameMapper
+}
+
+// EncryptFileName encrypts name of the os, parts which exist unencrypted are kept, names of other backends are
+// encrypted by their EncFs
+func (k *EncryptionMasterKey) EncryptFileName(name string) string {
+	return newEncFs(k, afero.NewOsFs()).encryptFileName(name)
 }
 
 func (k *EncryptionMasterKey) DecryptFileName(encryptedFileName string) string {
-	if k.fileNameIv == nil {
+	return k.decryptFileName(encryptedFileName, nil)
+}
+
+// decryptFileName decrypts encryptedFileName, memo maps on-disk prefixes to their decrypted last part
+func (k *EncryptionMasterKey) decryptFileName(encryptedFileName string, memo map[string]string) string {
+	if !k.isFileNameEncrypted() {
 		// DO NOT DECRYPT
 		return encryptedFileName
 	}
 	encrytpedFileNameParts := strings.Split(encryptedFileName, "/")
+	fileNameParts := make([]string, len(encrytpedFileNameParts))
 	for i := 0; i < len(encrytpedFileNameParts); i++ {
-		encrytpedFileNameParts[i] = k.decrypteFileNamePart(encrytpedFileNameParts[i])
+		encryptedParentName := strings.Join(encrytpedFileNameParts[:i], "/")
+		if encryptedParentName == "" && i > 0 {
+			encryptedParentName = "/"
+		}
+		encryptedPrefix := strings.Join(encrytpedFileNameParts[:i+1], "/")
+		if fileNamePart, found := memo[encryptedPrefix]; found {
+			fileNameParts[i] = fileNamePart
+			continue
+		}
+		fileNameParts[i] = k.nameMapper.DecryptFileNamePart(encryptedParentName, encrytpedFileNameParts[i])
+		if memo != nil {
+			memo[encryptedPrefix] = fileNameParts[i]
+		}
+	}
+	return strings.Join(fileNameParts, "/")
+}
+
+func (k *EncryptionMasterKey) decryptFileNamePart(encryptedParentName, encryptedName string) string {
+	if !k.isFileNameEncrypted() {
+		return encryptedName
 	}
-	return strings.Join(encrytpedFileNameParts, "/")
+	return k.nameMapper.DecryptFileNamePart(encryptedParentName, encryptedName)
 }
 
-func (k *EncryptionMasterKey) existsPath(path string) bool {
-	// perm store plaintext path in memory
-	k.mutex.Lock()
-	defer k.mutex.Unlock()
-	if exists, found := k.pathExistsMap[path]; found {
-		return exists
+func (k *EncryptionMasterKey) isFileNameEncrypted() bool {
+	if k.nameMapper == nil {
+		return false
 	}
-	_, err := os.Stat(path)
-	exists := err == nil
-	k.pathExistsMap[path] = exists
-	return exists
+	_, isNoop := k.nameMapper.(*NoopNameMapper)
+	return !isNoop
 }
 
-func (k *EncryptionMasterKey) recursiveEncrpteFileName(name string) string {
-	if name == "" || name == "/" || k.existsPath(name) {
+func (k *EncryptionMasterKey) recursiveEncrpteFileName(name string, existsPath func(string) bool, memo map[string]string) string {
+	if encryptedName, found := memo[name]; found {
+		return encryptedName
+	}
+	if name == "" || name == "/" || existsPath(name) {
 		return name
 	}
+	plainName := name
 	for strings.HasSuffix(name, "/") {
 		name = strings.TrimSuffix(name, "/")
 	}
 	parentName, currentName := path.Split(name)
-	parentName = k.recursiveEncrpteFileName(parentName)
-	currentName = k.encryptFileNamePart(currentName)
-	return path.Join(parentName, currentName)
-}
-
-func (k *EncryptionMasterKey) encryptFileNamePart(name string) string {
-	if name == "" {
-		return name
-	}
-	aesgcm, err := k.newAesGcm()
-	if err != nil {
-		// should not happen, file name is not encrypted
-		return name
+	parentName = k.recursiveEncrpteFileName(parentName, existsPath, memo)
+	currentName = k.nameMapper.EncryptFileNamePart(parentName, currentName)
+	encryptedName := path.Join(parentName, currentName)
+	if memo != nil {
+		memo[plainName] = encryptedName
 	}
-	encryptedFileName := aesgcm.Seal(nil, k.fileNameIv, []byte(name), nil)
-	return fmt.Sprintf("%s%s", ENCRYPTED_FILE_NAME_PREFIX, base64.RawURLEncoding.EncodeToString(encryptedFileName))
+	return encryptedName
 }
 
-func (k *EncryptionMasterKey) decrypteFileNamePart(encrytpedFileNamePart string) string {
-	if !strings.HasPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX) {
-		// file name is not encrypted
-		return encrytpedFileNamePart
-	}
-	prefixTrimedEncryptedFileName := strings.TrimPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX)
-	encryptedFileNameBytes, err := base64.RawURLEncoding.DecodeString(prefixTrimedEncryptedFileName)
-	if err != nil {
-		// decode file name failed, file name should be incorrect
-		return prefixTrimedEncryptedFileName
-	}
-	aesgcm, err := k.newAesGcm()
-	if err != nil {
-		// should not happen, file name must be incorrect
-		return encrytpedFileNamePart
-	}
-	nameBytes, err := aesgcm.Open(nil, k.fileNameIv, encryptedFileNameBytes, nil)
-	if err != nil {
-		// should not happen, file name must be incorrect
-		return encrytpedFileNamePart
-	}
-	return string(nameBytes)
+type EncFs struct {
+	// contentGeneration changes on every write of contents, ivGeneration whenever a file gets a new IV, they are
+	// accessed atomically and come first to be 64-bit aligned on 32-bit platforms
+	contentGeneration uint64
+	ivGeneration      uint64
+	key               *EncryptionMasterKey
+	base              afero.Fs
+	mutex             *sync.Mutex
+	pathExistsMap     map[string]bool
+	operationTimeout  time.Duration
+	operationContext  context.Context
+	retryPolicy       *RetryPolicy
+	auditSink         AuditSink
+	volumeRoot        string
+	symlinkPolicy     SymlinkPolicy
+	specialFilePolicy SpecialFilePolicy
+	contentCipher     string
+	caseInsensitive   bool
+	durabilityPolicy  DurabilityPolicy
+	writeBufferSize   int
+	fileFormat        FileFormat
+	integrityTags     bool
+	randomSource      io.Reader
+	lastRandomBlock   []byte
+	selfTestErr       error
+	foldedNameIndexes map[string]map[string][]string
+	openFlagsPolicy   OpenFlagsPolicy
+	autoQuarantine    bool
+	quarantinedFiles  map[string]*QuarantinedFile
+	changeJournal     *changeJournal
+	authorizer        Authorizer
+	// sizePadding and sizePaddingBlockSize are set by WithSizePadding
+	sizePadding          string
+	sizePaddingBlockSize int
+	// metaCache holds sidecar metas loaded by Preload by encrypted name
+	metaCache      map[string]*cachedEncFileMeta
+	strictMetadata bool
+	// passthroughPatterns are set by WithPassthroughPatterns
+	passthroughPatterns []string
+	// keyring holds the keys of WithKeyring by key id
+	keyring map[string]*EncryptionMasterKey
+	// lazyRekeyHandles counts open handles of files re-encrypted on close by WithLazyRekey, -1 while re-encrypting
+	lazyRekey        bool
+	lazyRekeyHandles map[string]int
+	// keystreamParallelism is set by WithKeystreamParallelism
+	keystreamParallelism int
+	// blockCache is set by WithBlockCache
+	blockCache *blockCache
+	// readAheadChunks is set by WithReadAhead
+	readAheadChunks int
+	// appendMutex serializes the writes of all handles opened with O_APPEND
+	appendMutex *sync.Mutex
+	// metaCopy is set by WithMetaCopy
+	metaCopy bool
+	// encryptedMeta is set by WithEncryptedMeta
+	encryptedMeta bool
+	// metaNaming is set by WithMetaFileNaming
+	metaNaming *metaFileNaming
+	// logger and operationTrace are set by WithLogger and WithOperationTrace
+	logger         Logger
+	operationTrace bool
+	// metricsCollector is set by WithMetricsCollector
+	metricsCollector MetricsCollector
 }
 
-func (k *EncryptionMasterKey) newAesGcm() (cipher.AEAD, error) {
-	block, err := aes.NewCipher(k.key)
-	if err != nil {
-		return nil, err
-	}
-	return cipher.NewGCM(block)
+func NewEncFs(key *EncryptionMasterKey) afero.Fs {
+	return newEncFs(key, afero.NewOsFs())
 }
 
-type EncFs struct {
-	key *EncryptionMasterKey
+// NewEncFsWithBackend encrypts files stored in base, e.g. afero.NewMemMapFs() or afero.NewBasePathFs(),
+// with NAME_MODE_HMAC the name mapper must be created by NewHmacNameMapperWithBackend with the same base
+func NewEncFsWithBackend(key *EncryptionMasterKey, base afero.Fs) afero.Fs {
+	return newEncFs(key, base)
 }
 
-func NewEncFs(key *EncryptionMasterKey) afero.Fs {
+func newEncFs(key *EncryptionMasterKey, base afero.Fs) *EncFs {
 	return &EncFs{
-		key: key,
+		key:               key,
+		base:              base,
+		mutex:             &sync.Mutex{},
+		pathExistsMap:     make(map[string]bool),
+		foldedNameIndexes: make(map[string]map[string][]string),
+		quarantinedFiles:  make(map[string]*QuarantinedFile),
+		metaCache:         make(map[string]*cachedEncFileMeta),
+		appendMutex:       &sync.Mutex{},
+		metaNaming:        &metaFileNaming{ext: EncFileExt},
 	}
 }
 
 func (*EncFs) Name() string { return "EncFs" }
 
-func (encFs *EncFs) Create(name string) (afero.File, error) {
+func (encFs *EncFs) Create(name string) (_ afero.File, err error) {
+	defer encFs.audit("create", name, "", 0, &err)
+	if err := encFs.authorize("create", name, "", os.O_RDWR|os.O_CREATE|os.O_TRUNC); err != nil {
+		return nil, err
+	}
 	if err := encFs.checkFileExt(name); err != nil {
 		return nil, err
 	}
-	name = encFs.key.EncryptFileName(name)
-	f, e := os.Create(name)
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	defer encFs.invalidateFoldedNameIndex(name)
+	if err := encFs.checkSymlinkPolicy("create", name, true); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkSpecialFile("create", name); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkQuarantine("create", name); err != nil {
+		return nil, err
+	}
+	if err := encFs.recordFileName(plainName, name); err != nil {
+		return nil, err
+	}
+	f, e := callWithRetry(encFs, retryWrite, "create", name, func() (afero.File, error) {
+		return encFs.base.Create(name)
+	}, closeAbandonedFile)
 	if f == nil {
 		// while this looks strange, we need to return a bare nil (of type nil) not
-		// a nil value of type *os.File or nil won't be nil
+		// a nil value of type afero.File or nil won't be nil
 		return nil, e
 	}
-	return convertOsFileToEncFile(name, f, e, encFs, true)
+	encFile, err := convertOsFileToEncFile(name, f, e, encFs, true, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	encFs.autoQuarantineOnErr(name, err)
+	return encFile, err
 }
 
-func (encFs *EncFs) Mkdir(name string, perm os.FileMode) error {
-	name = encFs.key.EncryptFileName(name)
-	return os.Mkdir(name, perm)
+func (encFs *EncFs) Mkdir(name string, perm os.FileMode) (err error) {
+	defer encFs.audit("mkdir", name, "", 0, &err)
+	if err := encFs.authorize("mkdir", name, "", 0); err != nil {
+		return err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	defer encFs.invalidateFoldedNameIndex(name)
+	if err := encFs.checkSymlinkPolicy("mkdir", name, false); err != nil {
+		return err
+	}
+	if err := encFs.recordFileName(plainName, name); err != nil {
+		return err
+	}
+	return callErrWithRetry(encFs, retryWrite, "mkdir", name, func() error {
+		return encFs.base.Mkdir(name, perm)
+	})
 }
 
-func (encFs *EncFs) MkdirAll(path string, perm os.FileMode) error {
-	path = encFs.key.EncryptFileName(path)
-	return os.MkdirAll(path, perm)
+func (encFs *EncFs) MkdirAll(path string, perm os.FileMode) (err error) {
+	defer encFs.audit("mkdirall", path, "", 0, &err)
+	if err := encFs.authorize("mkdirall", path, "", 0); err != nil {
+		return err
+	}
+	plainPath := path
+	path = encFs.encryptFileName(path)
+	defer encFs.restorePlainPath(&err, plainPath, path)
+	defer encFs.invalidateFoldedNameIndexes()
+	if err := encFs.checkSymlinkPolicy("mkdir", path, true); err != nil {
+		return err
+	}
+	if err := encFs.recordFileName(plainPath, path); err != nil {
+		return err
+	}
+	err = callErrWithRetry(encFs, retryIdempotent, "mkdir", path, func() error {
+		return encFs.base.MkdirAll(path, perm)
+	})
+	if err != nil {
+		return err
+	}
+	// names in directories created just now are kept in memory until their directory exists
+	return encFs.recordFileName(plainPath, path)
 }
 
-func (encFs *EncFs) Open(name string) (afero.File, error) {
+func (encFs *EncFs) Open(name string) (_ afero.File, err error) {
+	defer encFs.audit("open", name, "", os.O_RDONLY, &err)
+	if err := encFs.authorize("open", name, "", os.O_RDONLY); err != nil {
+		return nil, err
+	}
 	if err := encFs.checkFileExt(name); err != nil {
 		return nil, err
 	}
-	name = encFs.key.EncryptFileName(name)
-	f, e := os.Open(name)
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("open", name, true); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkSpecialFile("open", name); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkQuarantine("open", name); err != nil {
+		return nil, err
+	}
+	f, e := callWithRetry(encFs, retryIdempotent, "open", name, func() (afero.File, error) {
+		return encFs.base.Open(name)
+	}, closeAbandonedFile)
 	if f == nil {
 		// while this looks strange, we need to return a bare nil (of type nil) not
-		// a nil value of type *os.File or nil won't be nil
+		// a nil value of type afero.File or nil won't be nil
 		return nil, e
 	}
-	return convertOsFileToEncFile(name, f, e, encFs, false)
+	encFile, err := convertOsFileToEncFile(name, f, e, encFs, false, os.O_RDONLY)
+	encFs.autoQuarantineOnErr(name, err)
+	return encFile, err
 }
 
-func (encFs *EncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+func (encFs *EncFs) OpenFile(name string, flag int, perm os.FileMode) (_ afero.File, err error) {
+	defer encFs.audit("open", name, "", flag, &err)
+	if err := encFs.authorize("open", name, "", flag); err != nil {
+		return nil, err
+	}
 	if err := encFs.checkFileExt(name); err != nil {
 		return nil, err
 	}
-	name = encFs.key.EncryptFileName(name)
-	f, e := os.OpenFile(name, flag, perm)
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if flag&os.O_CREATE != 0 {
+		defer encFs.invalidateFoldedNameIndex(name)
+	}
+	if err := encFs.checkSymlinkPolicy("open", name, true); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkSpecialFile("open", name); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkQuarantine("open", name); err != nil {
+		return nil, err
+	}
+	if err := encFs.checkOpenFlags(name, flag); err != nil {
+		return nil, err
+	}
+	if flag&os.O_CREATE != 0 {
+		if err := encFs.recordFileName(plainName, name); err != nil {
+			return nil, err
+		}
+	}
+	journalCreate := false
+	if encFs.changeJournal != nil && flag&os.O_CREATE != 0 {
+		_, statErr := encFs.base.Stat(name)
+		journalCreate = os.IsNotExist(statErr)
+	}
+	baseFlag := encFs.contentOpenFlag(name, flag)
+	streaming := encFs.isStreamingOpen(flag)
+	if streaming {
+		// new files are written sequentially, no need to read chunks back
+		baseFlag = flag &^ os.O_APPEND
+	}
+	f, e := callWithRetry(encFs, openFileRetryClass(flag), "open", name, func() (afero.File, error) {
+		return encFs.base.OpenFile(name, baseFlag, perm)
+	}, closeAbandonedFile)
+	e = encFs.checkEmulatedOpenErr(name, flag, baseFlag, e)
 	if f == nil {
 		// while this looks strange, we need to return a bare nil (of type nil) not
-		// a nil value of type *os.File or nil won't be nil
+		// a nil value of type afero.File or nil won't be nil
 		return nil, e
 	}
-	return convertOsFileToEncFile(name, f, e, encFs, false)
+	encFile, err := convertOsFileToEncFile(name, f, e, encFs, false, flag)
+	encFs.autoQuarantineOnErr(name, err)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if streaming {
+		if baseFlag != flag {
+			encFile.(*EncFile).appendMode = flag&os.O_APPEND != 0
+			encFile.(*EncFile).writeOnly = flag&os.O_WRONLY != 0
+		}
+		if err := encFile.(*EncFile).startStreaming(); err != nil {
+			_ = encFile.Close()
+			return nil, err
+		}
+	} else if err := encFile.(*EncFile).emulateOpenFlags(flag, baseFlag); err != nil {
+		_ = encFile.Close()
+		return nil, err
+	}
+	if journalCreate {
+		encFs.recordChange(CHANGE_CREATE, encFile.Name(), "", false)
+	}
+	return encFile, nil
+}
+
+func (encFs *EncFs) Remove(name string) (err error) {
+	defer encFs.audit("remove", name, "", 0, &err)
+	if err := encFs.authorize("remove", name, "", 0); err != nil {
+		return err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	defer encFs.invalidateFoldedNameIndex(name)
+	if err := encFs.checkSymlinkPolicy("remove", name, false); err != nil {
+		return err
+	}
+	return encFs.remove(name)
 }
 
-func (encFs *EncFs) Remove(name string) error {
-	name = encFs.key.EncryptFileName(name)
-	encFileMetaName := name + EncFileExt
-	_ = os.Remove(encFileMetaName)
-	return os.Remove(name)
+func (encFs *EncFs) remove(name string) error {
+	encFileMetaName := encFs.encFileMetaName(name)
+	err := callErrWithRetry(encFs, retryWrite, "remove", name, func() error {
+		// the data goes first, a crash in between leaves an orphaned meta file instead of data without its IV
+		err := encFs.base.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		_ = encFs.base.Remove(encFileMetaName)
+		_ = encFs.base.Remove(name + INTEGRITY_FILE_SUFFIX)
+		return err
+	})
+	encFs.forgetCachedEncFileMetas(name)
+	if err == nil {
+		encFs.moveQuarantined(name, "")
+		encFs.forgetFileName(name)
+		encFs.removeLongNameSidecar(name)
+	}
+	return err
 }
 
-func (encFs *EncFs) RemoveAll(path string) error {
-	path = encFs.key.EncryptFileName(path)
-	fileInfo, err := os.Stat(path)
+func (encFs *EncFs) RemoveAll(path string) (err error) {
+	defer encFs.audit("removeall", path, "", 0, &err)
+	if err := encFs.authorize("removeall", path, "", 0); err != nil {
+		return err
+	}
+	plainPath := path
+	path = encFs.encryptFileName(path)
+	defer encFs.restorePlainPath(&err, plainPath, path)
+	defer encFs.invalidateFoldedNameIndexes()
+	if err := encFs.checkSymlinkPolicy("removeall", path, false); err != nil {
+		return err
+	}
+	fileInfo, err := callWithRetry(encFs, retryIdempotent, "stat", path, func() (os.FileInfo, error) {
+		return encFs.base.Stat(path)
+	}, nil)
 	if err == nil && !fileInfo.IsDir() {
-		return encFs.Remove(path)
+		return encFs.remove(path)
 	}
-	return os.RemoveAll(path)
+	err = callErrWithRetry(encFs, retryWrite, "removeall", path, func() error {
+		if err := encFs.removeTree(path); err != nil {
+			return err
+		}
+		return encFs.base.RemoveAll(path)
+	})
+	encFs.forgetCachedEncFileMetas(path)
+	if err == nil {
+		encFs.moveQuarantined(path, "")
+		encFs.forgetFileName(path)
+		encFs.removeLongNameSidecar(path)
+	}
+	return err
 }
 
-func (encFs *EncFs) Rename(oldname, newname string) error {
-	oldname = encFs.key.EncryptFileName(oldname)
-	newname = encFs.key.EncryptFileName(newname)
-	oldEncFileMetaName := oldname + EncFileExt
-	newEncFileMetaName := newname + EncFileExt
-	_ = os.Rename(oldEncFileMetaName, newEncFileMetaName)
-	return os.Rename(oldname, newname)
+// removeTree removes the files under the directory path in pairs, every data file before its meta and integrity
+// files, so an interrupted RemoveAll leaves orphaned meta files for CleanOrphans but never data without its meta
+func (encFs *EncFs) removeTree(path string) error {
+	dir, err := encFs.base.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	_ = dir.Close()
+	if err != nil {
+		return err
+	}
+	dataNames := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !encFs.metaFileNaming().isInternalName(name) {
+			dataNames[name] = true
+		}
+	}
+	for _, name := range names {
+		if dataName, ok := encFs.metaFileNaming().dataName(name); ok && dataNames[dataName] ||
+			strings.HasSuffix(name, INTEGRITY_FILE_SUFFIX) && dataNames[strings.TrimSuffix(name, INTEGRITY_FILE_SUFFIX)] {
+			// removed with its data file
+			continue
+		}
+		childName := filepath.Join(path, name)
+		fileInfo, _, err := encFs.lstat(childName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if fileInfo.IsDir() {
+			err = encFs.removeTree(childName)
+		} else if dataNames[name] {
+			err = encFs.removeDataFile(childName)
+		} else {
+			err = encFs.base.Remove(childName)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
-func (encFs *EncFs) Stat(name string) (os.FileInfo, error) {
-	name = encFs.key.EncryptFileName(name)
-	return os.Stat(name)
+// removeDataFile removes name and then its meta and integrity files
+func (encFs *EncFs) removeDataFile(name string) error {
+	if err := encFs.base.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := encFs.base.Remove(encFs.encFileMetaName(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := encFs.base.Remove(name + INTEGRITY_FILE_SUFFIX); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
-func (encFs *EncFs) Chmod(name string, mode os.FileMode) error {
-	name = encFs.key.EncryptFileName(name)
-	return os.Chmod(name, mode)
+func (encFs *EncFs) Rename(oldname, newname string) (err error) {
+	defer encFs.audit("rename", oldname, newname, 0, &err)
+	if err := encFs.authorize("rename", oldname, newname, 0); err != nil {
+		return err
+	}
+	plainOldname, plainNewname := oldname, newname
+	oldname = encFs.encryptFileName(oldname)
+	newname = encFs.encryptFileName(newname)
+	defer encFs.restorePlainPath(&err, plainOldname, oldname, plainNewname, newname)
+	defer encFs.invalidateFoldedNameIndexes()
+	if err := encFs.checkSymlinkPolicy("rename", oldname, false); err != nil {
+		return err
+	}
+	if err := encFs.checkSymlinkPolicy("rename", newname, false); err != nil {
+		return err
+	}
+	if err := encFs.recordFileName(plainNewname, newname); err != nil {
+		return err
+	}
+	oldEncFileMetaName := encFs.encFileMetaName(oldname)
+	newEncFileMetaName := encFs.encFileMetaName(newname)
+	err = callErrWithRetry(encFs, retryWrite, "rename", oldname, func() error {
+		_ = encFs.base.Rename(oldEncFileMetaName, newEncFileMetaName)
+		_ = encFs.base.Rename(oldname+INTEGRITY_FILE_SUFFIX, newname+INTEGRITY_FILE_SUFFIX)
+		return encFs.base.Rename(oldname, newname)
+	})
+	encFs.forgetCachedEncFileMetas(oldname)
+	encFs.forgetCachedEncFileMetas(newname)
+	if err == nil {
+		encFs.moveQuarantined(oldname, newname)
+		if oldname != newname {
+			encFs.forgetFileName(oldname)
+			encFs.removeLongNameSidecar(oldname)
+		}
+	}
+	return err
 }
 
-func (encFs *EncFs) Chown(name string, uid, gid int) error {
-	name = encFs.key.EncryptFileName(name)
-	return os.Chown(name, uid, gid)
+func (encFs *EncFs) Stat(name string) (_ os.FileInfo, err error) {
+	defer encFs.trace("stat", name, "", 0, &err)
+	if err := encFs.authorize("stat", name, "", 0); err != nil {
+		return nil, err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("stat", name, true); err != nil {
+		return nil, err
+	}
+	fileInfo, err := callWithRetry(encFs, retryIdempotent, "stat", name, func() (os.FileInfo, error) {
+		return encFs.base.Stat(name)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if encFs.isHiddenFileInfo(fileInfo) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return encFs.logicalFileInfo(name, fileInfo), nil
 }
 
-func (encFs *EncFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	name = encFs.key.EncryptFileName(name)
-	return os.Chtimes(name, atime, mtime)
+func (encFs *EncFs) Chmod(name string, mode os.FileMode) (err error) {
+	defer encFs.audit("chmod", name, "", 0, &err)
+	if err := encFs.authorize("chmod", name, "", 0); err != nil {
+		return err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("chmod", name, true); err != nil {
+		return err
+	}
+	return callErrWithRetry(encFs, retryIdempotent, "chmod", name, func() error {
+		return encFs.base.Chmod(name, mode)
+	})
 }
 
-func (encFs *EncFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
-	name = encFs.key.EncryptFileName(name)
-	fi, err := os.Lstat(name)
-	return fi, true, err
+func (encFs *EncFs) Chown(name string, uid, gid int) (err error) {
+	defer encFs.audit("chown", name, "", 0, &err)
+	if err := encFs.authorize("chown", name, "", 0); err != nil {
+		return err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("chown", name, true); err != nil {
+		return err
+	}
+	return callErrWithRetry(encFs, retryIdempotent, "chown", name, func() error {
+		return encFs.base.Chown(name, uid, gid)
+	})
 }
 
-func (encFs *EncFs) SymlinkIfPossible(oldname, newname string) error {
-	oldname = encFs.key.EncryptFileName(oldname)
-	newname = encFs.key.EncryptFileName(newname)
-	return os.Symlink(oldname, newname)
+func (encFs *EncFs) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	defer encFs.audit("chtimes", name, "", 0, &err)
+	if err := encFs.authorize("chtimes", name, "", 0); err != nil {
+		return err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("chtimes", name, true); err != nil {
+		return err
+	}
+	return callErrWithRetry(encFs, retryIdempotent, "chtimes", name, func() error {
+		return encFs.base.Chtimes(name, atime, mtime)
+	})
 }
 
-func (encFs *EncFs) ReadlinkIfPossible(name string) (string, error) {
-	name = encFs.key.EncryptFileName(name)
-	return os.Readlink(name)
+func (encFs *EncFs) LstatIfPossible(name string) (_ os.FileInfo, _ bool, err error) {
+	defer encFs.trace("lstat", name, "", 0, &err)
+	if err := encFs.authorize("lstat", name, "", 0); err != nil {
+		return nil, false, err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("lstat", name, false); err != nil {
+		return nil, true, err
+	}
+	_, lstatCalled := encFs.base.(afero.Lstater)
+	fi, err := callWithRetry(encFs, retryIdempotent, "lstat", name, func() (os.FileInfo, error) {
+		fileInfo, _, err := encFs.lstat(name)
+		return fileInfo, err
+	}, nil)
+	if err != nil {
+		return nil, lstatCalled, err
+	}
+	return encFs.logicalFileInfo(name, fi), lstatCalled, nil
 }
 
-func (encFS *EncFs) checkFileExt(name string) error {
-	if encFS.key.fileNameIv != nil {
-		// allow all file ext when file name is encrypted
-		return nil
+func (encFs *EncFs) SymlinkIfPossible(oldname, newname string) (err error) {
+	defer encFs.audit("symlink", oldname, newname, 0, &err)
+	if err := encFs.authorize("symlink", newname, oldname, 0); err != nil {
+		return err
+	}
+	plainOldname, plainNewname := oldname, newname
+	oldname = encFs.encryptFileName(oldname)
+	newname = encFs.encryptFileName(newname)
+	defer encFs.restorePlainPath(&err, plainOldname, oldname, plainNewname, newname)
+	defer encFs.invalidateFoldedNameIndex(newname)
+	if encFs.symlinkPolicy == SYMLINK_POLICY_REFUSE {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrSymlinkRefused}
+	}
+	if err := encFs.checkSymlinkPolicy("symlink", newname, false); err != nil {
+		return err
 	}
-	if strings.HasSuffix(name, EncFileExt) {
+	if err := encFs.recordFileName(plainNewname, newname); err != nil {
+		return err
+	}
+	return callErrWithRetry(encFs, retryWrite, "symlink", oldname, func() error {
+		return encFs.symlink(oldname, newname)
+	})
+}
+
+func (encFs *EncFs) ReadlinkIfPossible(name string) (_ string, err error) {
+	defer encFs.trace("readlink", name, "", 0, &err)
+	if err := encFs.authorize("readlink", name, "", 0); err != nil {
+		return "", err
+	}
+	plainName := name
+	name = encFs.encryptFileName(name)
+	defer encFs.restorePlainPath(&err, plainName, name)
+	if err := encFs.checkSymlinkPolicy("readlink", name, false); err != nil {
+		return "", err
+	}
+	return callWithRetry(encFs, retryIdempotent, "readlink", name, func() (string, error) {
+		return encFs.readlink(name)
+	}, nil)
+}
+
+// checkFileExt refuses names which look like meta files in every mode, without name encryption they would be taken
+// for the meta of another file and a tree could not be cloned to a volume without name encryption
+func (encFS *EncFs) checkFileExt(name string) error {
+	if strings.HasSuffix(name, EncFileExt) || encFS.metaFileNaming().isInternalName(filepath.Base(name)) {
 		return ErrFileForbiddenFileExt
 	}
 	return nil
 }
 
-func convertOsFileToEncFile(name string, file *os.File, e error, encFs *EncFs, isCreate bool) (afero.File, error) {
+func convertOsFileToEncFile(name string, file afero.File, e error, encFs *EncFs, isCreate bool, flag int) (afero.File, error) {
 	if e != nil {
 		return nil, e
 	}
-	encFile, err := NewEncFile(name, file, encFs, isCreate)
+	encFile, err := newEncFile(name, file, encFs, isCreate, flag)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,189 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// FSCK_MISSING_META is a non empty data file with neither a meta file nor a header, its IV is lost
+	FSCK_MISSING_META = "missing-meta"
+	// FSCK_ORPHANED_META is a meta file whose data file does not exist
+	FSCK_ORPHANED_META = "orphaned-meta"
+	// FSCK_UNDECRYPTABLE_NAME is a name which the name mapper of the key can not decrypt
+	FSCK_UNDECRYPTABLE_NAME = "undecryptable-name"
+	// FSCK_INVALID_META is a meta file or header which can not be parsed or has an unsupported version
+	FSCK_INVALID_META = "invalid-meta"
+	// FSCK_DAMAGED_META is a meta file failing its checksum whose redundant copy is intact
+	FSCK_DAMAGED_META = "damaged-meta"
+	// FSCK_WRONG_KEY is a file recording the key id of a key which is neither the key nor in the keyring
+	FSCK_WRONG_KEY = "wrong-key"
+)
+
+type FsckIssue struct {
+	Kind string `json:"kind"`
+	// Name is the plaintext name, parts which can not be decrypted are kept encrypted
+	Name          string `json:"name"`
+	EncryptedName string `json:"encrypted_name"`
+	Detail        string `json:"detail,omitempty"`
+	Repaired      bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Repair        bool        `json:"repair"`
+	ScannedCount  int         `json:"scanned_count"`
+	Issues        []FsckIssue `json:"issues"`
+	RepairedCount int         `json:"repaired_count"`
+}
+
+func (r *FsckReport) add(kind, name, encryptedName string, err error) *FsckIssue {
+	issue := FsckIssue{Kind: kind, Name: name, EncryptedName: encryptedName}
+	if err != nil {
+		issue.Detail = err.Error()
+	}
+	r.Issues = append(r.Issues, issue)
+	return &r.Issues[len(r.Issues)-1]
+}
+
+// repaired marks issue repaired when err is nil, a file removed meanwhile counts as repaired
+func (r *FsckReport) repaired(issue *FsckIssue, err error) error {
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	issue.Repaired = true
+	r.RepairedCount++
+	return nil
+}
+
+// Fsck checks the metadata of every file under root, with repair the safe fixes are applied: orphaned meta files
+// are removed, invalid meta files of empty data files too and damaged meta files are rewritten from their copy, files
+// with lost IVs, undecryptable names and files of another key are only reported since fixing them would lose data,
+// run it while the tree is not used
+func (encFs *EncFs) Fsck(root string, repair bool) (*FsckReport, error) {
+	encryptedRoot := encFs.encryptFileName(root)
+	plainNames := map[string]string{
+		encryptedRoot: root,
+	}
+	report := &FsckReport{Repair: repair, Issues: make([]FsckIssue, 0)}
+	err := afero.Walk(encFs.base, encryptedRoot, func(encryptedName string, fileInfo os.FileInfo, err error) error {
+		if err != nil && encryptedName != encryptedRoot && os.IsNotExist(err) {
+			// removed by a repair after its directory was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if encryptedName == encryptedRoot {
+			return nil
+		}
+		if encFs.metaFileNaming().isInternalName(fileInfo.Name()) {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			dataName, ok := encFs.metaFileNaming().dataName(encryptedName)
+			if !ok {
+				return nil
+			}
+			return encFs.fsckMeta(report, plainNames, encryptedName, dataName)
+		}
+		report.ScannedCount++
+		plainName := encFs.walkPlainName(plainNames, encryptedName, fileInfo)
+		if err := encFs.fsckName(encryptedName); err != nil {
+			report.add(FSCK_UNDECRYPTABLE_NAME, plainName, encryptedName, err)
+		}
+		if !fileInfo.Mode().IsRegular() || encFs.isPassthroughEncrypted(encryptedName) {
+			return nil
+		}
+		return encFs.fsckFile(report, plainName, encryptedName, fileInfo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// fsckName decrypts the last part of encryptedName, name mappers which can not report failures always succeed
+func (encFs *EncFs) fsckName(encryptedName string) error {
+	if !encFs.key.isFileNameEncrypted() {
+		return nil
+	}
+	nameDecrypter, ok := encFs.key.nameMapper.(nameDecrypter)
+	if !ok {
+		return nil
+	}
+	_, err := nameDecrypter.tryDecryptFileNamePart(filepath.Dir(encryptedName), filepath.Base(encryptedName))
+	return err
+}
+
+func (encFs *EncFs) fsckMeta(report *FsckReport, plainNames map[string]string, encryptedMetaName,
+	encryptedName string) error {
+	if _, _, err := encFs.lstat(encryptedName); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	plainName := filepath.Join(plainNames[filepath.Dir(encryptedName)],
+		encFs.key.decryptFileNamePart(filepath.Dir(encryptedName), filepath.Base(encryptedName)))
+	issue := report.add(FSCK_ORPHANED_META, plainName, encryptedMetaName, nil)
+	if !report.Repair {
+		return nil
+	}
+	return report.repaired(issue, encFs.base.Remove(encryptedMetaName))
+}
+
+func (encFs *EncFs) fsckFile(report *FsckReport, plainName, encryptedName string, fileInfo os.FileInfo) error {
+	encFileMeta, err := openEncFileMeta(encFs, encFs.base, encryptedName)
+	if err == nil && encFileMeta == nil {
+		encFileMeta, err = encFs.fsckHeader(encryptedName)
+		if err == nil && encFileMeta == nil {
+			// empty files get their meta with the first write
+			if fileInfo.Size() > 0 {
+				report.add(FSCK_MISSING_META, plainName, encryptedName, nil)
+			}
+			return nil
+		}
+	}
+	if errors.Is(err, ErrWrongKey) {
+		// a meta sealed by another key
+		report.add(FSCK_WRONG_KEY, plainName, encryptedName, err)
+		return nil
+	}
+	if err != nil {
+		if !isCorruptionError(err) && !errors.Is(err, ErrUnsupportedFormatVersion) {
+			return err
+		}
+		issue := report.add(FSCK_INVALID_META, plainName, encryptedName, err)
+		if !report.Repair || fileInfo.Size() > 0 {
+			return nil
+		}
+		// an empty file loses nothing with its meta, a new one is created with the next write
+		return report.repaired(issue, encFs.base.Remove(encFs.encFileMetaName(encryptedName)))
+	}
+	if err := encFs.checkKeyId(encryptedName, encFileMeta); err != nil {
+		report.add(FSCK_WRONG_KEY, plainName, encryptedName, err)
+	}
+	if encFileMeta.damaged {
+		issue := report.add(FSCK_DAMAGED_META, plainName, encryptedName, ErrBadMetaChecksum)
+		if report.Repair {
+			return report.repaired(issue, encFs.rewriteEncFileMeta(encFs.base, encryptedName, encFileMeta))
+		}
+	}
+	return nil
+}
+
+func (encFs *EncFs) fsckHeader(encryptedName string) (*EncFileMeta, error) {
+	if !encFs.readsHeaders() {
+		return nil, nil
+	}
+	file, err := encFs.base.Open(encryptedName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return readEncFileHeader(file)
+}
@@ -0,0 +1,155 @@
+package encfs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// fsckTestKinds returns the kinds of issues, the ones not repaired in unrepaired
+func fsckTestKinds(report *FsckReport) (kinds []string, unrepaired []string) {
+	for _, issue := range report.Issues {
+		kinds = append(kinds, issue.Kind)
+		if !issue.Repaired {
+			unrepaired = append(unrepaired, issue.Kind)
+		}
+	}
+	return kinds, unrepaired
+}
+
+func TestFsck(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    *EncryptionMasterKey
+		config func(encFs *EncFs)
+		// damage writes files through encFs and breaks them in base
+		damage func(t *testing.T, encFs *EncFs, base afero.Fs)
+		// wantKinds are the issues found, wantUnrepaired are the ones left after a repair
+		wantKinds      []string
+		wantUnrepaired []string
+	}{
+		{"clean", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {}, nil, nil},
+		{"orphaned meta", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			if err := base.Remove("/dir/file"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{FSCK_ORPHANED_META}, nil},
+		// the IV is lost with the meta, the file is only reported
+		{"missing meta", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			if err := base.Remove(encFs.encFileMetaName("/dir/file")); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{FSCK_MISSING_META}, []string{FSCK_MISSING_META}},
+		{"empty file without meta", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, "/empty", nil)
+		}, nil, nil},
+		{"invalid meta", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, encFs.encFileMetaName("/dir/file"), []byte("not json"))
+		}, []string{FSCK_INVALID_META}, []string{FSCK_INVALID_META}},
+		// an empty file loses nothing with its meta
+		{"invalid meta of an empty file", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, "/empty", nil)
+			writeTestFile(t, base, encFs.encFileMetaName("/empty"), []byte("not json"))
+		}, []string{FSCK_INVALID_META}, nil},
+		{"unsupported meta version", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, encFs.encFileMetaName("/dir/file"), []byte(`{"version":1000}`))
+		}, []string{FSCK_INVALID_META}, []string{FSCK_INVALID_META}},
+		{"damaged meta", nil, func(encFs *EncFs) { encFs.WithMetaCopy(true) },
+			func(t *testing.T, encFs *EncFs, base afero.Fs) {
+				flipTestByte(t, base, encFs.encFileMetaName("/dir/file"), 2)
+			}, []string{FSCK_DAMAGED_META}, nil},
+		{"wrong key", nil, nil, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			otherEncFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(2)), base)
+			writeTestFile(t, otherEncFs, "/other", []byte("other"))
+		}, []string{FSCK_WRONG_KEY}, []string{FSCK_WRONG_KEY}},
+		{"invalid header", nil, func(encFs *EncFs) { encFs.WithFileFormat(FILE_FORMAT_HEADER) },
+			func(t *testing.T, encFs *EncFs, base afero.Fs) {
+				// the version byte, a header without magic is data without meta
+				flipTestByte(t, base, "/dir/file", 4)
+			}, []string{FSCK_INVALID_META}, []string{FSCK_INVALID_META}},
+		{"undecryptable name", NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(3)[:12]), nil,
+			func(t *testing.T, encFs *EncFs, base afero.Fs) {
+				writeTestFile(t, base, "/"+ENCRYPTED_FILE_NAME_PREFIX+"AAAAAAAAAAAAAAAAAAAAAAAA", nil)
+			}, []string{FSCK_UNDECRYPTABLE_NAME}, []string{FSCK_UNDECRYPTABLE_NAME}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := test.key
+			if key == nil {
+				key = NewEncryptionMasterKey(testKeyBytes(1))
+			}
+			encFs, base := newTestEncFs(key)
+			if test.config != nil {
+				test.config(encFs)
+			}
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", []byte("file"))
+			writeTestFile(t, encFs, "/kept", []byte("kept"))
+			test.damage(t, encFs, base)
+
+			snapshot := snapshotTestFs(t, base)
+			report, err := encFs.Fsck("/", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// without repair nothing is changed
+			if kinds, unrepaired := fsckTestKinds(report); !reflect.DeepEqual(kinds, test.wantKinds) ||
+				!reflect.DeepEqual(unrepaired, test.wantKinds) || report.RepairedCount != 0 {
+				t.Fatalf("got issues %+v", report.Issues)
+			}
+			if !reflect.DeepEqual(snapshotTestFs(t, base), snapshot) {
+				t.Fatal("fsck without repair changed the backend")
+			}
+
+			report, err = encFs.Fsck("/", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kinds, unrepaired := fsckTestKinds(report); !reflect.DeepEqual(kinds, test.wantKinds) ||
+				!reflect.DeepEqual(unrepaired, test.wantUnrepaired) ||
+				report.RepairedCount != len(test.wantKinds)-len(test.wantUnrepaired) {
+				t.Fatalf("got issues %+v", report.Issues)
+			}
+			report, err = encFs.Fsck("/", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kinds, _ := fsckTestKinds(report); !reflect.DeepEqual(kinds, test.wantUnrepaired) {
+				t.Fatalf("got issues %+v after repair", report.Issues)
+			}
+			checkTestFile(t, encFs, "/kept", []byte("kept"))
+			if test.name == "damaged meta" {
+				checkTestFile(t, encFs, "/dir/file", []byte("file"))
+			}
+		})
+	}
+}
+
+func TestFsckNames(t *testing.T) {
+	encFs, base := newTestEncFs(NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(3)[:12]))
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/dir/sub/file", []byte("file"))
+	writeTestFile(t, encFs, "/dir/other", []byte("other"))
+	encryptedName := encFs.encryptFileName("/dir/sub/file")
+	if err := base.Remove(encryptedName); err != nil {
+		t.Fatal(err)
+	}
+	report, err := encFs.Fsck("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// issues carry the plaintext name, the meta file is the encrypted one
+	wantIssues := []FsckIssue{{Kind: FSCK_ORPHANED_META, Name: "/dir/sub/file",
+		EncryptedName: encFs.encFileMetaName(encryptedName)}}
+	if !reflect.DeepEqual(report.Issues, wantIssues) || report.ScannedCount != 2 {
+		t.Fatalf("got report %+v", *report)
+	}
+	if _, err := encFs.Fsck("/missing", false); err == nil {
+		t.Fatal("checked a missing root")
+	}
+}
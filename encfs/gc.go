@@ -0,0 +1,201 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ORPHAN_TEMP_META_GRACE_PERIOD spares temp metas younger than it from orphan collection, a create, truncate or
+// migration may still be about to rename them in place
+const ORPHAN_TEMP_META_GRACE_PERIOD = 10 * time.Minute
+
+type GcReport struct {
+	DryRun            bool     `json:"dry_run"`
+	ScannedCount      int      `json:"scanned_count"`
+	ReferencedCount   int      `json:"referenced_count"`
+	UnreferencedNames []string `json:"unreferenced_names"`
+	ReclaimedBytes    int64    `json:"reclaimed_bytes"`
+}
+
+func (r *GcReport) sweep(fs afero.Fs, name string, size int64) error {
+	r.UnreferencedNames = append(r.UnreferencedNames, name)
+	r.ReclaimedBytes += size
+	if r.DryRun {
+		return nil
+	}
+	err := fs.Remove(name)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// CollectGarbage removes chunks not referenced by any manifest, when dryRun is true
+// nothing is removed and the report lists what would be reclaimed
+func (chunkFs *ChunkStoreFs) CollectGarbage(dryRun bool) (*GcReport, error) {
+	chunkFs.volumeLock.Lock()
+	defer chunkFs.volumeLock.Unlock()
+
+	referencedIds := make(map[string]bool)
+	err := chunkFs.walkManifests(func(treeName string, manifest *ChunkManifest) error {
+		for _, chunkRef := range manifest.Chunks {
+			referencedIds[chunkRef.Id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GcReport{DryRun: dryRun, UnreferencedNames: make([]string, 0)}
+	chunksRoot := filepath.Join(chunkFs.root, CHUNK_STORE_CHUNKS_DIR)
+	err = afero.Walk(chunkFs.backend(), chunksRoot, func(chunkName string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return nil
+		}
+		report.ScannedCount++
+		if referencedIds[fileInfo.Name()] {
+			report.ReferencedCount++
+			return nil
+		}
+		// includes temp files left by interrupted chunk writes
+		return report.sweep(chunkFs.backend(), chunkName, fileInfo.Size())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// walkManifests calls fn with every manifest under root/files, an unreadable manifest stops the walk since its
+// chunks cannot be known
+func (chunkFs *ChunkStoreFs) walkManifests(fn func(treeName string, manifest *ChunkManifest) error) error {
+	filesRoot := filepath.Join(chunkFs.root, CHUNK_STORE_FILES_DIR)
+	return afero.Walk(chunkFs.backend(), filesRoot, func(treeName string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() || chunkFs.treeFs.metaFileNaming().isInternalName(fileInfo.Name()) {
+			return nil
+		}
+		manifestFile, err := chunkFs.backend().Open(treeName)
+		if err != nil {
+			return err
+		}
+		encFile, err := NewEncFile(treeName, manifestFile, chunkFs.treeFs, false)
+		if err != nil {
+			_ = manifestFile.Close()
+			return err
+		}
+		manifest, err := readChunkManifest(encFile)
+		_ = encFile.Close()
+		if err != nil {
+			return err
+		}
+		return fn(treeName, manifest)
+	})
+}
+
+// CollectGarbage removes objects not referenced by the index
+func (flatFs *FlatEncFs) CollectGarbage(dryRun bool) (*GcReport, error) {
+	flatFs.mutex.Lock()
+	defer flatFs.mutex.Unlock()
+
+	referencedObjects := make(map[string]bool)
+	for _, entry := range flatFs.entries {
+		if !entry.IsDir {
+			referencedObjects[entry.Object] = true
+		}
+	}
+	fileInfos, err := afero.ReadDir(flatFs.backend(), flatFs.root)
+	if err != nil {
+		return nil, err
+	}
+	report := &GcReport{DryRun: dryRun, UnreferencedNames: make([]string, 0)}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || name == FLAT_INDEX_FILE_NAME {
+			continue
+		}
+		report.ScannedCount++
+		object := name
+		if dataName, isMeta := flatFs.encFs.metaFileNaming().dataName(name); isMeta {
+			object = dataName
+		} else if strings.HasSuffix(name, INTEGRITY_FILE_SUFFIX) {
+			object = strings.TrimSuffix(name, INTEGRITY_FILE_SUFFIX)
+		}
+		if referencedObjects[object] {
+			report.ReferencedCount++
+			continue
+		}
+		if err := report.sweep(flatFs.backend(), filepath.Join(flatFs.root, name), fileInfo.Size()); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// CollectOrphanedMetas removes meta files under root whose data file no longer exists
+func (encFs *EncFs) CollectOrphanedMetas(root string, dryRun bool) (*GcReport, error) {
+	return encFs.collectOrphans(root, dryRun, false)
+}
+
+// CleanOrphans removes the meta and integrity files under path whose data file no longer exists, e.g. left by an
+// interrupted RemoveAll or by data files removed with other tools
+func (encFs *EncFs) CleanOrphans(path string) (report *GcReport, err error) {
+	defer encFs.audit("cleanorphans", path, "", 0, &err)
+	if err := encFs.authorize("cleanorphans", path, "", 0); err != nil {
+		return nil, err
+	}
+	return encFs.collectOrphans(path, false, true)
+}
+
+// collectOrphans removes meta files, and integrity files with includeIntegrity, of data files which do not exist
+func (encFs *EncFs) collectOrphans(root string, dryRun bool, includeIntegrity bool) (*GcReport, error) {
+	encryptedRoot := encFs.encryptFileName(root)
+	report := &GcReport{DryRun: dryRun, UnreferencedNames: make([]string, 0)}
+	err := afero.Walk(encFs.base, encryptedRoot, func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return nil
+		}
+		dataName, isMeta := encFs.metaFileNaming().dataName(name)
+		switch {
+		case isMeta:
+		case includeIntegrity && strings.HasSuffix(fileInfo.Name(), INTEGRITY_FILE_SUFFIX):
+			dataName = strings.TrimSuffix(name, INTEGRITY_FILE_SUFFIX)
+		default:
+			return nil
+		}
+		if isTempMetaName(fileInfo.Name()) && time.Since(fileInfo.ModTime()) < ORPHAN_TEMP_META_GRACE_PERIOD {
+			return nil
+		}
+		report.ScannedCount++
+		if _, _, err := encFs.lstat(dataName); err == nil {
+			report.ReferencedCount++
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return report.sweep(encFs.base, name, fileInfo.Size())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// isTempMetaName reports the temp metas which are renamed to the meta of a file once complete
+func isTempMetaName(name string) bool {
+	return strings.HasSuffix(name, NEW_TEMP_META_FILE_SUFFIX) || strings.HasSuffix(name, TRUNCATE_TEMP_META_FILE_SUFFIX) ||
+		strings.HasSuffix(name, MERKLE_TEMP_META_FILE_SUFFIX) || strings.HasSuffix(name, MIGRATE_TEMP_META_FILE_SUFFIX)
+}
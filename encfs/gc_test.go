@@ -0,0 +1,276 @@
+package encfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestCleanOrphans(t *testing.T) {
+	tests := []struct {
+		name        string
+		metaFileExt string
+		hidden      bool
+	}{
+		{"default naming", "", false},
+		{"meta file ext", ".__m", false},
+		{"hidden meta files", ".__m", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewNoopNameMapper()))
+			if err := encFs.WithMetaFileNaming(test.metaFileExt, test.hidden); err != nil {
+				t.Fatal(err)
+			}
+			encFs.WithIntegrityTags(true)
+			writeTestFile(t, encFs, "/kept", []byte("kept"))
+			writeTestFile(t, encFs, "/removed", []byte("removed"))
+			// data removed with other tools leaves its meta and integrity files
+			if err := base.Remove("/removed"); err != nil {
+				t.Fatal(err)
+			}
+			old := time.Now().Add(-2 * ORPHAN_TEMP_META_GRACE_PERIOD)
+			temps := []struct {
+				name      string
+				modTime   time.Time
+				wantSwept bool
+			}{
+				{"/kept.0001" + NEW_TEMP_META_FILE_SUFFIX, time.Now(), false},
+				{"/kept" + TRUNCATE_TEMP_META_FILE_SUFFIX, time.Now(), false},
+				{"/kept.0002" + NEW_TEMP_META_FILE_SUFFIX, old, true},
+				{"/kept" + MERKLE_TEMP_META_FILE_SUFFIX, old, true},
+			}
+			wantSwept := []string{encFs.encFileMetaName("/removed"), "/removed" + INTEGRITY_FILE_SUFFIX}
+			for _, temp := range temps {
+				if err := afero.WriteFile(base, temp.name, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := base.Chtimes(temp.name, temp.modTime, temp.modTime); err != nil {
+					t.Fatal(err)
+				}
+				if temp.wantSwept {
+					wantSwept = append(wantSwept, temp.name)
+				}
+			}
+
+			report, err := encFs.CleanOrphans("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(wantSwept)
+			sort.Strings(report.UnreferencedNames)
+			if !reflect.DeepEqual(report.UnreferencedNames, wantSwept) {
+				t.Fatalf("swept %q, want %q", report.UnreferencedNames, wantSwept)
+			}
+			for _, temp := range temps {
+				if exists, _ := afero.Exists(base, temp.name); exists == temp.wantSwept {
+					t.Fatalf("%s exists %t", temp.name, exists)
+				}
+			}
+			checkTestFile(t, encFs, "/kept", []byte("kept"))
+		})
+	}
+}
+
+func TestCollectGarbageWithMetaFileNaming(t *testing.T) {
+	tests := []struct {
+		name    string
+		newFs   func(t *testing.T) afero.Fs
+		collect func(fs afero.Fs) (*GcReport, error)
+	}{
+		{"flat", func(t *testing.T) afero.Fs {
+			flatFs, err := NewFlatEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), "/flat",
+				afero.NewMemMapFs())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := flatFs.encFs.WithMetaFileNaming(".__m", true); err != nil {
+				t.Fatal(err)
+			}
+			return flatFs
+		}, func(fs afero.Fs) (*GcReport, error) { return fs.(*FlatEncFs).CollectGarbage(false) }},
+		{"chunk store", func(t *testing.T) afero.Fs {
+			chunkFs, err := NewChunkStoreFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), "/chunks",
+				afero.NewMemMapFs())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := chunkFs.treeFs.WithMetaFileNaming(".__m", true); err != nil {
+				t.Fatal(err)
+			}
+			return chunkFs
+		}, func(fs afero.Fs) (*GcReport, error) { return fs.(*ChunkStoreFs).CollectGarbage(false) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storeFs := test.newFs(t)
+			data := testPattern(5000)
+			writeTestFile(t, storeFs, "/a", data)
+			writeTestFile(t, storeFs, "/b", []byte("b"))
+			if err := storeFs.Remove("/b"); err != nil {
+				t.Fatal(err)
+			}
+			report, err := test.collect(storeFs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// metas are neither swept nor read as manifests
+			for _, name := range report.UnreferencedNames {
+				if _, isMeta := (&metaFileNaming{ext: ".__m", hidden: true}).dataName(name); isMeta {
+					t.Fatalf("swept meta %s", name)
+				}
+			}
+			checkTestFile(t, storeFs, "/a", data)
+		})
+	}
+}
+
+func TestMetaLookingNamesRefused(t *testing.T) {
+	tests := []struct {
+		name        string
+		mapper      NameMapper
+		metaFileExt string
+		hidden      bool
+		fileName    string
+		wantErr     error
+	}{
+		{"plain", NewNoopNameMapper(), "", false, "/a.txt", nil},
+		{"default ext", NewNoopNameMapper(), "", false, "/a" + EncFileExt, ErrFileForbiddenFileExt},
+		{"default ext encrypted", NewSivNameMapper(testKeyBytes(2)), "", false, "/a" + EncFileExt,
+			ErrFileForbiddenFileExt},
+		{"volume file encrypted", NewSivNameMapper(testKeyBytes(2)), "", false, "/" + VOLUME_CONFIG_FILE_NAME,
+			ErrFileForbiddenFileExt},
+		{"meta file ext", NewNoopNameMapper(), ".__m", false, "/a.__m", ErrFileForbiddenFileExt},
+		{"meta file ext encrypted", NewSivNameMapper(testKeyBytes(2)), ".__m", false, "/dir/a.__m",
+			ErrFileForbiddenFileExt},
+		{"hidden", NewSivNameMapper(testKeyBytes(2)), ".__m", true, "/.a.__m", ErrFileForbiddenFileExt},
+		{"hidden data name", NewSivNameMapper(testKeyBytes(2)), ".__m", true, "/a.__m", nil},
+		{"old ext with meta file ext", NewSivNameMapper(testKeyBytes(2)), ".__m", true, "/a" + EncFileExt,
+			ErrFileForbiddenFileExt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.mapper))
+			if err := encFs.WithMetaFileNaming(test.metaFileExt, test.hidden); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := afero.WriteFile(encFs, test.fileName, []byte("data"), 0644)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if _, err := encFs.ToEncryptedPath(test.fileName); !errors.Is(err, test.wantErr) {
+				t.Fatalf("encrypted path: got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWalkManifestsSkipsMetas(t *testing.T) {
+	for _, hidden := range []bool{false, true} {
+		chunkFs := newTestChunkStoreFs(t)
+		if err := chunkFs.treeFs.WithMetaFileNaming(".__m", hidden); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, chunkFs, "/a", testPattern(5000))
+		var treeNames []string
+		err := chunkFs.walkManifests(func(treeName string, manifest *ChunkManifest) error {
+			treeNames = append(treeNames, treeName)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(treeNames) != 1 {
+			t.Fatalf("hidden %t: walked %q, want one manifest", hidden, treeNames)
+		}
+	}
+}
+
+// crashingRemoveFs fails every Remove after the first removeCount, like a RemoveAll interrupted by a crash
+type crashingRemoveFs struct {
+	afero.Fs
+	removeCount int
+}
+
+var errTestRemoveCrashed = errors.New("remove crashed")
+
+func (fs *crashingRemoveFs) Remove(name string) error {
+	if fs.removeCount <= 0 {
+		return errTestRemoveCrashed
+	}
+	fs.removeCount--
+	return fs.Fs.Remove(name)
+}
+
+func TestRemoveAllInPairs(t *testing.T) {
+	tests := []struct {
+		name        string
+		metaFileExt string
+		hidden      bool
+	}{
+		{"default naming", "", false},
+		{"hidden meta files", ".__m", true},
+	}
+	for _, test := range tests {
+		// every remove is a crash point, 4 data files with their meta and integrity files, directories go last
+		for removeCount := 0; removeCount < 4*3; removeCount++ {
+			t.Run(fmt.Sprintf("%s after %d removes", test.name, removeCount), func(t *testing.T) {
+				base := &crashingRemoveFs{Fs: afero.NewMemMapFs(), removeCount: math.MaxInt}
+				encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+				if err := encFs.WithMetaFileNaming(test.metaFileExt, test.hidden); err != nil {
+					t.Fatal(err)
+				}
+				encFs.WithIntegrityTags(true)
+				if err := encFs.MkdirAll("/dir/sub/deep", 0755); err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"/dir/a", "/dir/b", "/dir/sub/c", "/dir/sub/deep/d"} {
+					writeTestFile(t, encFs, name, []byte(name))
+				}
+				writeTestFile(t, encFs, "/kept", []byte("kept"))
+
+				base.removeCount = removeCount
+				if err := encFs.RemoveAll("/dir"); !errors.Is(err, errTestRemoveCrashed) {
+					t.Fatalf("removed the tree after %d removes: %v", removeCount, err)
+				}
+				// data files left by the crash keep their meta
+				err := afero.Walk(base.Fs, "/", func(name string, fileInfo os.FileInfo, err error) error {
+					if err != nil || fileInfo.IsDir() || encFs.metaFileNaming().isInternalName(fileInfo.Name()) ||
+						strings.HasSuffix(name, INTEGRITY_FILE_SUFFIX) {
+						return err
+					}
+					if exists, err := afero.Exists(base.Fs, encFs.encFileMetaName(name)); err != nil || !exists {
+						t.Fatalf("%s lost its meta after %d removes: %v", name, removeCount, err)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				base.removeCount = math.MaxInt
+				if _, err := encFs.CleanOrphans("/"); err != nil {
+					t.Fatal(err)
+				}
+				if err := encFs.RemoveAll("/dir"); err != nil {
+					t.Fatal(err)
+				}
+				checkTestFile(t, encFs, "/kept", []byte("kept"))
+				if names := snapshotTestFs(t, base.Fs); len(names) != 3 {
+					t.Fatalf("got backend files %q", names)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+)
+
+type FileFormat int
+
+const (
+	// IV and cipher are kept in the sidecar meta file name + EncFileExt
+	FILE_FORMAT_SIDECAR FileFormat = iota
+	// IV and cipher are kept in a header at the start of the data file
+	FILE_FORMAT_HEADER
+)
+
+// header layout: magic(4) || version(1) || flags(1) || cipher name length(1) || reserved(1) ||
+// chunk size(4) || key id(8) || IV(16) || cipher name(28, zero padded), padded files are version 2 with the
+// padding in flags and log2 of the padding block size in reserved, files with meta flags are version 5 with the
+// padding in the low bits of flags and a bit for each other meta flag
+const (
+	ENC_FILE_HEADER_MAGIC   = "ENCF"
+	ENC_FILE_HEADER_VERSION = 1
+	// padded files were written with ENC_FILE_META_VERSION_PADDED, files of content subkeys with
+	// ENC_FILE_META_VERSION_SUBKEYS, files with meta flags are written with ENC_FILE_META_VERSION_FLAGS
+	ENC_FILE_HEADER_MAX_VERSION = ENC_FILE_META_VERSION_FLAGS
+	ENC_FILE_HEADER_SIZE        = 64
+
+	encFileHeaderMaxCipherLen = 28
+
+	encFileHeaderPaddingMask    = 0x03
+	encFileHeaderFlagSubkeys    = 0x04
+	encFileHeaderFlagFinalChunk = 0x08
+	encFileHeaderSupportedFlags = encFileHeaderPaddingMask | encFileHeaderFlagSubkeys | encFileHeaderFlagFinalChunk
+)
+
+var (
+	ErrBadFileHeader = errors.New("file header is broken")
+)
+
+var encFileHeaderPaddingFlags = map[string]byte{
+	SIZE_PADDING_PADME: 1,
+	SIZE_PADDING_BLOCK: 2,
+}
+
+// WithFileFormat selects where the IV of files created afterwards is stored, files keep their format,
+// FILE_FORMAT_HEADER does not double the file count and meta can not be separated from its data
+func (encFs *EncFs) WithFileFormat(fileFormat FileFormat) {
+	encFs.fileFormat = fileFormat
+}
+
+func (encFs *EncFs) getFileFormat() FileFormat {
+	return encFs.fileFormat
+}
+
+// readsHeaders tells whether files without sidecar meta are read as header format files, the format comes from the
+// configuration, so sidecar volumes never mistake plaintext starting with the header magic for a header
+func (encFs *EncFs) readsHeaders() bool {
+	return encFs.getFileFormat() == FILE_FORMAT_HEADER
+}
+
+// headerBytes returns the header of a header format file, the one read from the file when it was opened
+func (encFileMeta *EncFileMeta) headerBytes() ([]byte, error) {
+	if encFileMeta.header != nil {
+		return encFileMeta.header, nil
+	}
+	return marshalEncFileHeader(encFileMeta)
+}
+
+// bindsHeader tells whether the header of a header format file is authenticated by the additional data of its
+// chunks, version 5 headers are, so a changed version, flag or cipher name fails the reads
+func (encFileMeta *EncFileMeta) bindsHeader(headerSize int64) bool {
+	return headerSize > 0 && encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK)
+}
+
+func marshalEncFileHeader(encFileMeta *EncFileMeta) ([]byte, error) {
+	if len(encFileMeta.Cipher) > encFileHeaderMaxCipherLen || len(encFileMeta.Iv) != 16 {
+		return nil, ErrBadFileHeader
+	}
+	keyId := make([]byte, 8)
+	if decodedKeyId, err := hex.DecodeString(encFileMeta.KeyId); err == nil && len(decodedKeyId) == 8 {
+		keyId = decodedKeyId
+	}
+	header := make([]byte, ENC_FILE_HEADER_SIZE)
+	copy(header, ENC_FILE_HEADER_MAGIC)
+	header[4] = ENC_FILE_HEADER_VERSION
+	if encFileMeta.isPadded() {
+		header[4] = ENC_FILE_META_VERSION_PADDED
+		header[5] = encFileHeaderPaddingFlags[encFileMeta.Padding]
+		if encFileMeta.PaddingBlockSize > 0 {
+			header[7] = byte(bits.TrailingZeros(uint(encFileMeta.PaddingBlockSize)))
+		}
+	}
+	if encFileMeta.usesSubkeys() {
+		header[4] = ENC_FILE_META_VERSION_SUBKEYS
+	}
+	if encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK) {
+		header[4] = ENC_FILE_META_VERSION_FLAGS
+		header[5] |= encFileHeaderFlagFinalChunk
+		if encFileMeta.usesSubkeys() {
+			header[5] |= encFileHeaderFlagSubkeys
+		}
+	}
+	header[6] = byte(len(encFileMeta.Cipher))
+	binary.BigEndian.PutUint32(header[8:12], uint32(encFileMeta.ChunkSize))
+	copy(header[12:20], keyId)
+	copy(header[20:36], encFileMeta.Iv)
+	copy(header[36:], encFileMeta.Cipher)
+	return header, nil
+}
+
+func unmarshalEncFileHeader(header []byte) (*EncFileMeta, error) {
+	if len(header) < ENC_FILE_HEADER_SIZE || string(header[:4]) != ENC_FILE_HEADER_MAGIC {
+		return nil, nil
+	}
+	if header[4] > ENC_FILE_HEADER_MAX_VERSION {
+		return nil, ErrUnsupportedFormatVersion
+	}
+	if header[4] == 0 || header[4] == ENC_FILE_META_VERSION_SEALED || int(header[6]) > encFileHeaderMaxCipherLen {
+		return nil, ErrBadFileHeader
+	}
+	flags := header[5]
+	if header[4] == ENC_FILE_META_VERSION_FLAGS && flags&^encFileHeaderSupportedFlags != 0 {
+		return nil, ErrUnsupportedFormatVersion
+	}
+	encFileMeta := &EncFileMeta{
+		Magic:     ENC_FILE_META_MAGIC,
+		Version:   int(header[4]),
+		Iv:        append([]byte(nil), header[20:36]...),
+		Cipher:    string(header[36 : 36+int(header[6])]),
+		ChunkSize: int(binary.BigEndian.Uint32(header[8:12])),
+	}
+	if !bytes.Equal(header[12:20], make([]byte, 8)) {
+		encFileMeta.KeyId = hex.EncodeToString(header[12:20])
+	}
+	if encFileMeta.Cipher != "" && !encFileMeta.isChunked() {
+		return nil, ErrUnsupportedCipher
+	}
+	if header[4] == ENC_FILE_META_VERSION_FLAGS {
+		encFileMeta.header = append([]byte(nil), header[:ENC_FILE_HEADER_SIZE]...)
+		if flags&encFileHeaderFlagSubkeys != 0 {
+			encFileMeta.setFlag(META_FLAG_SUBKEYS)
+		}
+		if flags&encFileHeaderFlagFinalChunk != 0 {
+			if !encFileMeta.isChunked() {
+				return nil, ErrBadFileHeader
+			}
+			encFileMeta.setFlag(META_FLAG_FINAL_CHUNK)
+		}
+		flags &= encFileHeaderPaddingMask
+	}
+	if header[4] >= ENC_FILE_META_VERSION_PADDED && flags != 0 {
+		for padding, paddingFlags := range encFileHeaderPaddingFlags {
+			if paddingFlags == flags {
+				encFileMeta.Padding = padding
+			}
+		}
+		if encFileMeta.Padding == "" || !encFileMeta.isChunked() || header[7] > 30 {
+			return nil, ErrBadFileHeader
+		}
+		if encFileMeta.Padding == SIZE_PADDING_BLOCK {
+			encFileMeta.PaddingBlockSize = 1 << header[7]
+		}
+	}
+	return encFileMeta, nil
+}
+
+// readEncFileHeader returns nil when file does not start with a header
+func readEncFileHeader(file afero.File) (*EncFileMeta, error) {
+	header := make([]byte, ENC_FILE_HEADER_SIZE)
+	readLen, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return unmarshalEncFileHeader(header[:readLen])
+}
+
+// newHeaderEncFileMeta creates the meta of a new header format file, the header is written with the first write
+func newHeaderEncFileMeta(encFs *EncFs) (*EncFileMeta, error) {
+	iv := make([]byte, 16)
+	if err := encFs.readRandom(iv); err != nil {
+		return nil, err
+	}
+	encFileMeta := &EncFileMeta{
+		Magic:   ENC_FILE_META_MAGIC,
+		Version: ENC_FILE_META_VERSION,
+		Iv:      iv,
+		Cipher:  encFs.newFileCipher(),
+		KeyId:   encFs.newFileKeyId(),
+	}
+	if encFileMeta.isChunked() {
+		encFileMeta.ChunkSize = CONTENT_CHUNK_SIZE
+	}
+	encFileMeta.applyFinalChunk()
+	encFs.applySizePadding(encFileMeta)
+	encFs.applySubkeys(encFileMeta)
+	return encFileMeta, nil
+}
+
+// readFileMeta reads the sidecar meta or the header of encryptedName, headerSize is 0 for sidecar meta
+func (encFs *EncFs) readFileMeta(encryptedName string) (*EncFileMeta, int64, error) {
+	encFileMeta, err := encFs.openCachedEncFileMeta(encryptedName)
+	if err != nil || encFileMeta != nil || !encFs.readsHeaders() {
+		return encFileMeta, 0, err
+	}
+	file, err := encFs.backend().Open(encryptedName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	encFileMeta, err = readEncFileHeader(file)
+	if err != nil || encFileMeta == nil {
+		return nil, 0, err
+	}
+	return encFileMeta, ENC_FILE_HEADER_SIZE, nil
+}
+
+// logicalSizeOf returns the plaintext size of a file with rawSize bytes on disk
+func logicalSizeOf(encFileMeta *EncFileMeta, headerSize int64, rawSize int64) int64 {
+	if rawSize < headerSize {
+		return 0
+	}
+	return encFileMeta.logicalSize(rawSize - headerSize)
+}
+
+// ensureHeader writes the header of a new header format file before its first modification
+func (f *EncFile) ensureHeader() error {
+	if !f.headerPending {
+		return nil
+	}
+	header, err := marshalEncFileHeader(f.encFileMeta)
+	if err != nil {
+		return err
+	}
+	_, err = callWithRetry(f.encFs, retryWrite, "write", f.file.Name(), func() (int, error) {
+		return f.file.WriteAt(header, 0)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	f.encFileMeta.header = header
+	f.underlyingPosMoved = true
+	f.headerPending = false
+	// the header replaced the one of a truncated file, other handles of it still have the old IV
+	atomic.AddUint64(&f.encFs.ivGeneration, 1)
+	return nil
+}
+
+// seekAfterHeader seeks within the contents of a header format file, positions inside the header are invalid
+func (f *EncFile) seekAfterHeader(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.filePos
+	case io.SeekEnd:
+		size, err := f.contentSize()
+		if err != nil {
+			return 0, err
+		}
+		base = size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if base+offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	_, err := callWithRetry(f.encFs, positionRetryClass(f.encFs, retryIdempotent), "seek", f.file.Name(),
+		func() (int64, error) {
+			return f.file.Seek(f.headerSize+base+offset, io.SeekStart)
+		}, nil)
+	if err != nil {
+		return 0, err
+	}
+	f.filePos = base + offset
+	return f.filePos, nil
+}
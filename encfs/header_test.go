@@ -0,0 +1,153 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestEncFileHeader(t *testing.T) {
+	iv := testKeyBytes(3)[:16]
+	tests := []struct {
+		name      string
+		meta      *EncFileMeta
+		wantFlags []string
+	}{
+		{"ctr", &EncFileMeta{Iv: iv}, nil},
+		{"gcm", &EncFileMeta{Iv: iv, Cipher: CIPHER_AES_GCM, ChunkSize: CONTENT_CHUNK_SIZE,
+			Flags: []string{META_FLAG_FINAL_CHUNK}}, []string{META_FLAG_FINAL_CHUNK}},
+		{"gcm padding and subkeys", &EncFileMeta{Iv: iv, Cipher: CIPHER_AES_GCM, ChunkSize: CONTENT_CHUNK_SIZE,
+			Padding: SIZE_PADDING_BLOCK, PaddingBlockSize: 4096,
+			Flags: []string{META_FLAG_FINAL_CHUNK, META_FLAG_PADDING, META_FLAG_SUBKEYS}},
+			[]string{META_FLAG_SUBKEYS, META_FLAG_FINAL_CHUNK}},
+		{"legacy padding", &EncFileMeta{Iv: iv, Cipher: CIPHER_AES_GCM, ChunkSize: CONTENT_CHUNK_SIZE,
+			Padding: SIZE_PADDING_PADME}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := marshalEncFileHeader(test.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encFileMeta, err := unmarshalEncFileHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encFileMeta.Iv, iv) || encFileMeta.Cipher != test.meta.Cipher ||
+				encFileMeta.Padding != test.meta.Padding || encFileMeta.PaddingBlockSize != test.meta.PaddingBlockSize ||
+				!reflect.DeepEqual(encFileMeta.Flags, test.wantFlags) {
+				t.Fatalf("got meta %+v", *encFileMeta)
+			}
+			// version 5 headers are kept to be bound to the chunks
+			wantHeader := encFileMeta.Version == ENC_FILE_META_VERSION_FLAGS
+			if (encFileMeta.header != nil) != wantHeader {
+				t.Fatalf("got header %x", encFileMeta.header)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEncFileHeaderErrors(t *testing.T) {
+	valid, err := marshalEncFileHeader(&EncFileMeta{Iv: testKeyBytes(3)[:16], Cipher: CIPHER_AES_GCM,
+		ChunkSize: CONTENT_CHUNK_SIZE, Flags: []string{META_FLAG_FINAL_CHUNK}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		change  func(header []byte)
+		wantErr error
+	}{
+		{"newer version", func(header []byte) { header[4] = ENC_FILE_META_VERSION_FLAGS + 1 },
+			ErrUnsupportedFormatVersion},
+		{"sealed version", func(header []byte) { header[4] = ENC_FILE_META_VERSION_SEALED }, ErrBadFileHeader},
+		{"unknown flag", func(header []byte) { header[5] |= 0x80 }, ErrUnsupportedFormatVersion},
+		{"final chunk of ctr", func(header []byte) {
+			header[6] = 0
+			copy(header[36:], make([]byte, encFileHeaderMaxCipherLen))
+		}, ErrBadFileHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := append([]byte(nil), valid...)
+			test.change(header)
+			if _, err := unmarshalEncFileHeader(header); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncFileHeaderBound(t *testing.T) {
+	tests := []struct {
+		name string
+		off  int64
+		// wantErr is nil when any error will do
+		wantErr error
+	}{
+		{"version", 4, nil},
+		{"flags", 5, nil},
+		{"chunk size", 10, nil},
+		{"iv", 20, nil},
+		{"cipher name", 36, nil},
+		// bytes unmarshalEncFileHeader ignores are still authenticated
+		{"reserved", 7, ErrDecryptFailed},
+		{"cipher name padding", 60, ErrDecryptFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(100000)
+			writeTestFile(t, encFs, "/file", data)
+			checkTestFile(t, encFs, "/file", data)
+			flipTestByte(t, base, "/file", test.off)
+			encFs.forgetCachedEncFileMetas("/file")
+			got, err := afero.ReadFile(encFs, "/file")
+			if err == nil || test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %d bytes, %v, want %v", len(got), err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFileFormatFromConfig(t *testing.T) {
+	// plaintext which starts with a valid header
+	header, err := marshalEncFileHeader(&EncFileMeta{Iv: testKeyBytes(3)[:16]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(header, []byte("plaintext after a header")...)
+	tests := []struct {
+		name       string
+		fileFormat FileFormat
+		wantRaw    bool
+	}{
+		{"sidecar", FILE_FORMAT_SIDECAR, true},
+		{"header", FILE_FORMAT_HEADER, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithFileFormat(test.fileFormat)
+			writeTestFile(t, base, "/file", data)
+			got := readTestFile(t, encFs, "/file")
+			if bytes.Equal(got, data) != test.wantRaw {
+				t.Fatalf("got %q, want raw %v", truncateTestBytes(got), test.wantRaw)
+			}
+			fileInfo, err := encFs.Stat("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantSize := int64(len(data)); test.wantRaw && fileInfo.Size() != wantSize {
+				t.Fatalf("got size %d, want %d", fileInfo.Size(), wantSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package encfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// testKeyBytes returns a 32 byte key, keys of different seeds differ
+func testKeyBytes(seed byte) []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed + byte(i)
+	}
+	return key
+}
+
+// newTestEncFs returns an EncFs of key over a new memory backend
+func newTestEncFs(key *EncryptionMasterKey) (*EncFs, afero.Fs) {
+	base := afero.NewMemMapFs()
+	return NewEncFsWithBackend(key, base).(*EncFs), base
+}
+
+// newTestHmacEncFs returns an EncFs with HMAC names over a new memory backend
+func newTestHmacEncFs() (*EncFs, afero.Fs) {
+	base := afero.NewMemMapFs()
+	key := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewHmacNameMapperWithBackend(testKeyBytes(2), base))
+	return NewEncFsWithBackend(key, base).(*EncFs), base
+}
+
+// testKdfParams returns cheap scrypt parameters for volumes of tests
+func testKdfParams() *KdfParams {
+	return &KdfParams{Algorithm: KDF_SCRYPT, N: 1024, R: 8, P: 1}
+}
+
+func writeTestFile(t *testing.T, fs afero.Fs, name string, data []byte) {
+	t.Helper()
+	if err := afero.WriteFile(fs, name, data, 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func readTestFile(t *testing.T, fs afero.Fs, name string) []byte {
+	t.Helper()
+	data, err := afero.ReadFile(fs, name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return data
+}
+
+func checkTestFile(t *testing.T, fs afero.Fs, name string, want []byte) {
+	t.Helper()
+	if got := readTestFile(t, fs, name); !bytes.Equal(got, want) {
+		t.Fatalf("read %s: got %q, want %q", name, truncateTestBytes(got), truncateTestBytes(want))
+	}
+}
+
+func truncateTestBytes(data []byte) []byte {
+	if len(data) > 64 {
+		return data[:64]
+	}
+	return data
+}
+
+// testPattern returns size bytes which differ at every offset of a small file
+func testPattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// snapshotTestFs returns the contents of all files of fs by name
+func snapshotTestFs(t *testing.T, fs afero.Fs) map[string]string {
+	t.Helper()
+	snapshot := make(map[string]string)
+	err := afero.Walk(fs, "/", func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil || fileInfo.IsDir() {
+			return err
+		}
+		file, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		data, err := io.ReadAll(file)
+		snapshot[name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	return snapshot
+}
+
+// testAuditSink keeps the audit events written to it
+type testAuditSink struct {
+	mutex  sync.Mutex
+	events []AuditEvent
+}
+
+func (s *testAuditSink) WriteAuditEvent(event *AuditEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func (s *testAuditSink) Close() error { return nil }
+
+// eventsOf returns the events of op
+func (s *testAuditSink) eventsOf(op string) []AuditEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []AuditEvent
+	for _, event := range s.events {
+		if event.Op == op {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// flipTestByte inverts the byte at off of the backend file name, writing a fixed byte may leave it unchanged
+func flipTestByte(t *testing.T, base afero.Fs, name string, off int64) {
+	t.Helper()
+	f, err := base.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{^b[0]}, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRecordingFs records the backend calls of an EncFs as "op name", file syncs included
+type testRecordingFs struct {
+	afero.Fs
+	mutex sync.Mutex
+	calls []string
+}
+
+func newTestRecordingFs(base afero.Fs) *testRecordingFs {
+	return &testRecordingFs{Fs: base}
+}
+
+func (fs *testRecordingFs) record(op, name string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.calls = append(fs.calls, op+" "+name)
+}
+
+// takeCalls returns the recorded calls and forgets them
+func (fs *testRecordingFs) takeCalls() []string {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	calls := fs.calls
+	fs.calls = nil
+	return calls
+}
+
+func (fs *testRecordingFs) Create(name string) (afero.File, error) {
+	fs.record("create", name)
+	f, err := fs.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &testRecordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *testRecordingFs) Open(name string) (afero.File, error) {
+	fs.record("open", name)
+	f, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &testRecordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *testRecordingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs.record("open", name)
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &testRecordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *testRecordingFs) Stat(name string) (os.FileInfo, error) {
+	fs.record("stat", name)
+	return fs.Fs.Stat(name)
+}
+
+func (fs *testRecordingFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fs.record("lstat", name)
+	if lstater, ok := fs.Fs.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fileInfo, err := fs.Fs.Stat(name)
+	return fileInfo, false, err
+}
+
+func (fs *testRecordingFs) Rename(oldname, newname string) error {
+	fs.record("rename", oldname)
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs *testRecordingFs) Remove(name string) error {
+	fs.record("remove", name)
+	return fs.Fs.Remove(name)
+}
+
+type testRecordingFile struct {
+	afero.File
+	fs *testRecordingFs
+}
+
+func (f *testRecordingFile) Sync() error {
+	f.fs.record("sync", f.Name())
+	return f.File.Sync()
+}
@@ -0,0 +1,28 @@
+package encfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// hkdfSha256 derives length bytes from secret as defined in RFC 5869
+func hkdfSha256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extractMac := hmac.New(sha256.New, salt)
+	extractMac.Write(secret)
+	prk := extractMac.Sum(nil)
+
+	okm := make([]byte, 0, length+sha256.Size)
+	var previous []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expandMac := hmac.New(sha256.New, prk)
+		expandMac.Write(previous)
+		expandMac.Write(info)
+		expandMac.Write([]byte{counter})
+		previous = expandMac.Sum(nil)
+		okm = append(okm, previous...)
+	}
+	return okm[:length]
+}
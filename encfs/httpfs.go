@@ -0,0 +1,79 @@
+package encfs
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// HTTPFileSystem is a read only http.FileSystem view of a subtree of EncFs for http.FileServer, file infos have the
+// plaintext sizes and modification times, reads of files are served by ReadAt so Range requests seek without
+// touching the backend and reuse the block cache
+type HTTPFileSystem struct {
+	iofs *IOFS
+}
+
+var _ http.FileSystem = (*HTTPFileSystem)(nil)
+
+// HTTPFileSystem returns an http.FileSystem view of root, pair it with EncFs.ETag to answer conditional requests
+func (encFs *EncFs) HTTPFileSystem(root string) *HTTPFileSystem {
+	return &HTTPFileSystem{iofs: encFs.IOFS(root)}
+}
+
+// Open opens name, a slash separated path like "/dir/file" relative to root
+func (v *HTTPFileSystem) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	f, err := v.iofs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	encFile, ok := f.(*EncFile)
+	if !ok || encFile.isDir {
+		return f.(http.File), nil
+	}
+	return &httpFile{EncFile: encFile}, nil
+}
+
+// httpFile keeps its own offset, Seek never reaches the backend and Read decrypts at the offset with ReadAt
+type httpFile struct {
+	*EncFile
+	offset int64
+}
+
+func (f *httpFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.EncFile.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		fileInfo, err := f.EncFile.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fileInfo.Size()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,133 @@
+package encfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHTTPFileSystem(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+		t.Fatal(err)
+	}
+	if err := encFs.MkdirAll("/www/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := testPattern(3*CONTENT_CHUNK_SIZE + 17)
+	writeTestFile(t, encFs, "/www/file.bin", data)
+	writeTestFile(t, encFs, "/www/dir/plainname.txt", []byte("text"))
+	writeTestFile(t, encFs, "/secret", []byte("secret"))
+	server := httptest.NewServer(http.FileServer(encFs.HTTPFileSystem("/www")))
+	defer server.Close()
+
+	size := len(data)
+	tests := []struct {
+		name       string
+		path       string
+		rangeValue string
+		wantStatus int
+		wantBody   string
+	}{
+		{"file", "/file.bin", "", http.StatusOK, string(data)},
+		{"range", "/file.bin", "bytes=10-19", http.StatusPartialContent, string(data[10:20])},
+		{"range across chunks", "/file.bin", "bytes=4090-8200", http.StatusPartialContent, string(data[4090:8201])},
+		{"open range", "/file.bin", "bytes=" + strconv.Itoa(size-5) + "-", http.StatusPartialContent,
+			string(data[size-5:])},
+		{"suffix range", "/file.bin", "bytes=-3", http.StatusPartialContent, string(data[size-3:])},
+		{"unsatisfiable range", "/file.bin", "bytes=" + strconv.Itoa(size) + "-",
+			http.StatusRequestedRangeNotSatisfiable, ""},
+		{"file in a directory", "/dir/plainname.txt", "", http.StatusOK, "text"},
+		{"directory", "/dir/", "", http.StatusOK, "plainname.txt"},
+		{"missing", "/missing", "", http.StatusNotFound, ""},
+		// paths never leave the root
+		{"outside the root", "/../secret", "", http.StatusNotFound, ""},
+	}
+	if _, err := encFs.HTTPFileSystem("/www").Open("../secret"); !os.IsNotExist(err) {
+		t.Fatalf("opened a file outside the root: %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.rangeValue != "" {
+				request.Header.Set("Range", test.rangeValue)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(response.Body)
+			_ = response.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.wantStatus {
+				t.Fatalf("got status %d, want %d", response.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusNotFound {
+				return
+			}
+			if test.path == "/dir/" {
+				if !strings.Contains(string(body), test.wantBody) {
+					t.Fatalf("listed %q", body)
+				}
+				return
+			}
+			if test.wantStatus != http.StatusRequestedRangeNotSatisfiable && string(body) != test.wantBody {
+				t.Fatalf("got %d bytes, want %d", len(body), len(test.wantBody))
+			}
+		})
+	}
+}
+
+func TestHTTPFileSeek(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/file", []byte("0123456789"))
+	f, err := encFs.HTTPFileSystem("/").Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tests := []struct {
+		offset  int64
+		whence  int
+		wantPos int64
+		wantErr bool
+	}{
+		{3, io.SeekStart, 3, false},
+		{2, io.SeekCurrent, 5, false},
+		{-4, io.SeekEnd, 6, false},
+		{20, io.SeekStart, 20, false},
+		{-1, io.SeekStart, 0, true},
+		{-11, io.SeekEnd, 0, true},
+		{0, 5, 0, true},
+	}
+	for _, test := range tests {
+		pos, err := f.Seek(test.offset, test.whence)
+		if (err != nil) != test.wantErr || (err == nil && pos != test.wantPos) {
+			t.Fatalf("seek %d from %d: got %d and %v", test.offset, test.whence, pos, err)
+		}
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 3)
+	if n, err := f.Read(buff); err != nil || string(buff[:n]) != "678" {
+		t.Fatalf("read %q: %v", buff[:n], err)
+	}
+	if n, err := f.Read(buff); err != nil || string(buff[:n]) != "9" {
+		t.Fatalf("read %q: %v", buff[:n], err)
+	}
+	if n, err := f.Read(buff); err != io.EOF || n != 0 {
+		t.Fatalf("read %d bytes at the end: %v", n, err)
+	}
+}
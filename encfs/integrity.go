@@ -0,0 +1,241 @@
+package encfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	INTEGRITY_FILE_SUFFIX = ".__integrity" + EncFileExt
+	INTEGRITY_BLOCK_SIZE  = 4096
+	INTEGRITY_TAG_SIZE    = sha256.Size
+	INTEGRITY_KEY_INFO    = "encfs-afero integrity"
+)
+
+var (
+	ErrIntegrityCheckFailed = errors.New("integrity check failed")
+	ErrNoIntegrityTags      = errors.New("file has no integrity tags")
+	// the header has no room for the merkle root, tags alone do not detect a dropped sidecar
+	ErrIntegrityTagsNeedSidecar = errors.New("integrity tags need the sidecar file format")
+)
+
+// WithIntegrityTags keeps HMAC-SHA256 tags of every 4KiB block of CTR files created afterwards in the sidecar
+// name + INTEGRITY_FILE_SUFFIX, tags of files having the sidecar are always verified on read and updated on write,
+// the meta of these files requires the sidecar, chunked ciphers are authenticated by themselves and never get tags,
+// FILE_FORMAT_HEADER files can not record the merkle root and are refused by ErrIntegrityTagsNeedSidecar
+func (encFs *EncFs) WithIntegrityTags(integrityTags bool) {
+	encFs.integrityTags = integrityTags
+}
+
+// requiresIntegrityTags reports files whose tags were recorded in the meta, their sidecar must not be missing
+func (encFileMeta *EncFileMeta) requiresIntegrityTags() bool {
+	return encFileMeta.IntegrityTags || encFileMeta.MerkleRoot != nil
+}
+
+// openIntegrityFile returns nil when encryptedName has no integrity tags, tags of empty files are dropped,
+// handles of read only backends can not update tags
+func openIntegrityFile(fs afero.Fs, encryptedName string, isEmpty bool, isCreate bool) (afero.File, error) {
+	integrityName := encryptedName + INTEGRITY_FILE_SUFFIX
+	flag := os.O_RDWR
+	if isEmpty {
+		flag |= os.O_TRUNC
+	}
+	if isCreate {
+		flag |= os.O_CREATE
+	}
+	integrityFile, err := fs.OpenFile(integrityName, flag, 0666)
+	if err == nil {
+		return integrityFile, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	// read only backends refuse O_RDWR even for missing files
+	integrityFile, readOnlyErr := fs.Open(integrityName)
+	if os.IsNotExist(readOnlyErr) {
+		return nil, nil
+	}
+	if readOnlyErr != nil {
+		return nil, err
+	}
+	return integrityFile, nil
+}
+
+func integrityKey(key []byte) []byte {
+	return hkdfSha256(key, nil, []byte(INTEGRITY_KEY_INFO), 32)
+}
+
+// integrityTag authenticates a block of ciphertext with the file IV and block index so blocks can not be swapped,
+// truncation at a block boundary is not detected
+func integrityTag(integrityKey, iv []byte, index int64, block []byte) []byte {
+	mac := hmac.New(sha256.New, integrityKey)
+	mac.Write(iv)
+	indexBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(indexBytes, uint64(index))
+	mac.Write(indexBytes)
+	mac.Write(block)
+	return mac.Sum(nil)
+}
+
+// readIntegrityBlock reads the ciphertext of block index of file, shorter at the end of file
+func readIntegrityBlock(file afero.File, headerSize int64, index int64) ([]byte, error) {
+	block := make([]byte, INTEGRITY_BLOCK_SIZE)
+	readLen, err := file.ReadAt(block, headerSize+index*INTEGRITY_BLOCK_SIZE)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return block[:readLen], nil
+}
+
+// verifyIntegrityTags checks the blocks covering n bytes of contents at off
+func (f *EncFile) verifyIntegrityTags(off, n int64) error {
+	if f.integrityFile == nil || n <= 0 {
+		return nil
+	}
+	key := integrityKey(f.contentKey())
+	tag := make([]byte, INTEGRITY_TAG_SIZE)
+	for index := off / INTEGRITY_BLOCK_SIZE; index <= (off+n-1)/INTEGRITY_BLOCK_SIZE; index++ {
+		block, err := readIntegrityBlock(f.file, f.headerSize, index)
+		if err != nil {
+			return err
+		}
+		if _, err := f.integrityFile.ReadAt(tag, index*INTEGRITY_TAG_SIZE); err != nil {
+			if err == io.EOF {
+				return &os.PathError{Op: "read", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+			}
+			return err
+		}
+		if !hmac.Equal(tag, integrityTag(key, f.encFileMeta.Iv, index, block)) {
+			return &os.PathError{Op: "read", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+		}
+	}
+	return nil
+}
+
+// updateIntegrityTags rewrites the tags of the blocks covering n bytes of contents at off after they are written
+func (f *EncFile) updateIntegrityTags(off, n int64) error {
+	if f.integrityFile == nil || n <= 0 {
+		return nil
+	}
+	key := integrityKey(f.contentKey())
+	for index := off / INTEGRITY_BLOCK_SIZE; index <= (off+n-1)/INTEGRITY_BLOCK_SIZE; index++ {
+		block, err := readIntegrityBlock(f.file, f.headerSize, index)
+		if err != nil {
+			return err
+		}
+		tag := integrityTag(key, f.encFileMeta.Iv, index, block)
+		if _, err := f.integrityFile.WriteAt(tag, index*INTEGRITY_TAG_SIZE); err != nil {
+			return err
+		}
+		if f.merkleTree != nil {
+			f.merkleTree.setLeaf(int(index), tag)
+			f.merkleDirty = true
+		}
+	}
+	return nil
+}
+
+// truncateIntegrityTags drops the tags after size and retags the last partial block
+func (f *EncFile) truncateIntegrityTags(size int64) error {
+	if f.integrityFile == nil {
+		return nil
+	}
+	blockCount := (size + INTEGRITY_BLOCK_SIZE - 1) / INTEGRITY_BLOCK_SIZE
+	if err := f.integrityFile.Truncate(blockCount * INTEGRITY_TAG_SIZE); err != nil {
+		return err
+	}
+	if f.merkleTree != nil {
+		f.merkleTree.truncate(int(blockCount))
+		f.merkleDirty = true
+	}
+	if size%INTEGRITY_BLOCK_SIZE == 0 {
+		return nil
+	}
+	return f.updateIntegrityTags(size-1, 1)
+}
+
+// writeIntegrityTags writes the tags of dataName as the integrity tags of encryptedName, the merkle root is
+// recorded in encFileMeta
+func (encFs *EncFs) writeIntegrityTags(encryptedName, dataName string, encFileMeta *EncFileMeta, headerSize int64) error {
+	file, err := encFs.base.Open(dataName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	integrityFile, err := openIntegrityFile(encFs.base, encryptedName, true, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = integrityFile.Close()
+	}()
+	key := integrityKey(encFs.contentKey(encFileMeta))
+	tags := make([][]byte, 0)
+	for index := int64(0); ; index++ {
+		block, err := readIntegrityBlock(file, headerSize, index)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			break
+		}
+		tag := integrityTag(key, encFileMeta.Iv, index, block)
+		if _, err := integrityFile.Write(tag); err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+		if len(block) < INTEGRITY_BLOCK_SIZE {
+			break
+		}
+	}
+	if headerSize == 0 {
+		encFileMeta.IntegrityTags = true
+		encFileMeta.MerkleRoot = newMerkleTree(tags).root(key, encFileMeta.Iv)
+	}
+	return integrityFile.Sync()
+}
+
+// VerifyFile checks the whole contents of name, integrity tags and merkle root of CTR files or the chunks of
+// chunked files, ErrNoIntegrityTags is returned for CTR files without tags
+func (encFs *EncFs) VerifyFile(name string) error {
+	file, err := encFs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	encFile, ok := file.(*EncFile)
+	if !ok || encFile.encFileMeta == nil {
+		return &os.PathError{Op: "verify", Path: name, Err: ErrNoIntegrityTags}
+	}
+	if encFile.encFileMeta.isChunked() {
+		// every chunk is authenticated when read
+		_, err := io.Copy(io.Discard, encFile)
+		return err
+	}
+	if encFile.integrityFile == nil {
+		return &os.PathError{Op: "verify", Path: name, Err: ErrNoIntegrityTags}
+	}
+	size, err := encFile.contentSize()
+	if err != nil {
+		return err
+	}
+	integrityInfo, err := encFile.integrityFile.Stat()
+	if err != nil {
+		return err
+	}
+	blockCount := (size + INTEGRITY_BLOCK_SIZE - 1) / INTEGRITY_BLOCK_SIZE
+	if integrityInfo.Size() != blockCount*INTEGRITY_TAG_SIZE {
+		return &os.PathError{Op: "verify", Path: name, Err: ErrIntegrityCheckFailed}
+	}
+	return encFile.verifyIntegrityTags(0, size)
+}
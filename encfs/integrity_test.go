@@ -0,0 +1,87 @@
+package encfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestIntegrityTagsRequired(t *testing.T) {
+	data := testPattern(3*INTEGRITY_BLOCK_SIZE + 100)
+	tests := []struct {
+		name          string
+		integrityTags bool
+		modify        func(t *testing.T, encFs *EncFs, base afero.Fs)
+		wantErr       error
+	}{
+		{"tags", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {}, nil},
+		{"no tags", false, func(t *testing.T, encFs *EncFs, base afero.Fs) {}, nil},
+		{"removed sidecar", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			if err := base.Remove("/file" + INTEGRITY_FILE_SUFFIX); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrIntegrityCheckFailed},
+		{"changed contents", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			flipTestByte(t, base, "/file", INTEGRITY_BLOCK_SIZE+1)
+		}, ErrIntegrityCheckFailed},
+		{"tags disabled afterwards", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			encFs.WithIntegrityTags(false)
+			writeTestFile(t, encFs, "/file", data[:10])
+			writeTestFile(t, encFs, "/file", data)
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithIntegrityTags(test.integrityTags)
+			writeTestFile(t, encFs, "/file", data)
+			test.modify(t, encFs, base)
+
+			_, err := afero.ReadFile(encFs, "/file")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("read: got %v, want %v", err, test.wantErr)
+			}
+			err = encFs.VerifyFile("/file")
+			if test.integrityTags && !errors.Is(err, test.wantErr) {
+				t.Fatalf("verify: got %v, want %v", err, test.wantErr)
+			}
+			if !test.integrityTags && !errors.Is(err, ErrNoIntegrityTags) {
+				t.Fatalf("verify: got %v, want %v", err, ErrNoIntegrityTags)
+			}
+		})
+	}
+}
+
+func TestIntegrityTagsOfReadOnlyBackends(t *testing.T) {
+	data := testPattern(3*INTEGRITY_BLOCK_SIZE + 100)
+	tests := []struct {
+		name          string
+		integrityTags bool
+		corrupt       bool
+		wantErr       error
+	}{
+		{"tags", true, false, nil},
+		{"no tags", false, false, nil},
+		{"changed contents", true, true, ErrIntegrityCheckFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithIntegrityTags(test.integrityTags)
+			writeTestFile(t, encFs, "/file", data)
+			if test.corrupt {
+				flipTestByte(t, base, "/file", INTEGRITY_BLOCK_SIZE+1)
+			}
+			// sidecars which can not be opened for writing are read only
+			readOnlyFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), afero.NewReadOnlyFs(base))
+			got, err := afero.ReadFile(readOnlyFs, "/file")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && string(got) != string(data) {
+				t.Fatal("read other contents")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package encfs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	INVENTORY_FORMAT_JSON = "json"
+	INVENTORY_FORMAT_CSV  = "csv"
+
+	CIPHER_NONE    = "none"
+	CIPHER_AES_CTR = "aes-ctr"
+	CIPHER_AES_GCM = "aes-gcm"
+
+	INTEGRITY_STATUS_OK           = "ok"
+	INTEGRITY_STATUS_MISSING_META = "missing-meta"
+	INTEGRITY_STATUS_BAD_META     = "bad-meta"
+)
+
+type InventoryRecord struct {
+	Path            string    `json:"path"`
+	IsDir           bool      `json:"is_dir"`
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"mod_time"`
+	KeyVersion      string    `json:"key_version"`
+	Cipher          string    `json:"cipher"`
+	IntegrityStatus string    `json:"integrity_status"`
+}
+
+// Inventory calls fn with a record for every file and directory under root
+func (encFs *EncFs) Inventory(root string, fn func(record *InventoryRecord) error) error {
+	return encFs.walkEncrypted(root, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		record := &InventoryRecord{
+			Path:            plainName,
+			IsDir:           fileInfo.IsDir(),
+			Size:            fileInfo.Size(),
+			ModTime:         fileInfo.ModTime(),
+			Cipher:          CIPHER_NONE,
+			IntegrityStatus: INTEGRITY_STATUS_OK,
+		}
+		if !fileInfo.IsDir() {
+			var encFileMeta *EncFileMeta
+			var headerSize int64
+			var err error
+			if fileInfo.Mode().IsRegular() {
+				encFileMeta, headerSize, err = encFs.readFileMeta(encryptedName)
+			} else {
+				// special files are never opened
+				encFileMeta, err = openEncFileMeta(encFs, encFs.base, encryptedName)
+			}
+			if err != nil {
+				record.IntegrityStatus = INTEGRITY_STATUS_BAD_META
+			} else if encFileMeta == nil {
+				record.IntegrityStatus = INTEGRITY_STATUS_MISSING_META
+			} else {
+				record.Cipher = encFileMeta.cipher()
+				record.KeyVersion = encFileMeta.KeyId
+				record.Size = encFs.fileLogicalSize(encryptedName, encFileMeta, headerSize, fileInfo.Size())
+			}
+		}
+		return fn(record)
+	})
+}
+
+// ExportInventory streams inventory of root to w, format is newline delimited JSON or CSV with header
+func (encFs *EncFs) ExportInventory(root string, w io.Writer, format string) error {
+	switch format {
+	case INVENTORY_FORMAT_JSON:
+		encoder := json.NewEncoder(w)
+		return encFs.Inventory(root, func(record *InventoryRecord) error {
+			return encoder.Encode(record)
+		})
+	case INVENTORY_FORMAT_CSV:
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write([]string{"path", "is_dir", "size", "mod_time", "key_version", "cipher", "integrity_status"}); err != nil {
+			return err
+		}
+		err := encFs.Inventory(root, func(record *InventoryRecord) error {
+			return csvWriter.Write([]string{
+				record.Path,
+				strconv.FormatBool(record.IsDir),
+				strconv.FormatInt(record.Size, 10),
+				record.ModTime.UTC().Format(time.RFC3339Nano),
+				record.KeyVersion,
+				record.Cipher,
+				record.IntegrityStatus,
+			})
+		})
+		csvWriter.Flush()
+		if err != nil {
+			return err
+		}
+		return csvWriter.Error()
+	default:
+		return fmt.Errorf("unknown inventory format: %s", format)
+	}
+}
@@ -0,0 +1,174 @@
+package encfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInventoryFs returns an EncFs with files of every integrity status and names which need CSV quoting
+func newTestInventoryFs(t *testing.T) *EncFs {
+	t.Helper()
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/dir/ctr", testPattern(100))
+	writeTestFile(t, encFs, "/dir/bad", []byte("bad"))
+	if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/dir/gcm", testPattern(CONTENT_CHUNK_SIZE+1))
+	writeTestFile(t, encFs, "/dir/comma, \"quoted\"", []byte("a"))
+	writeTestFile(t, encFs, "/dir/new\nline", []byte("ab"))
+	writeTestFile(t, base, "/dir/plain", []byte("plain"))
+	writeTestFile(t, base, encFs.encFileMetaName("/dir/bad"), []byte("{broken"))
+	encFs.forgetCachedEncFileMetas("/dir/bad")
+	if err := encFs.Mkdir("/dir/empty", 0755); err != nil {
+		t.Fatal(err)
+	}
+	return encFs
+}
+
+func collectTestInventory(t *testing.T, encFs *EncFs) map[string]*InventoryRecord {
+	t.Helper()
+	records := make(map[string]*InventoryRecord)
+	if err := encFs.Inventory("/dir", func(record *InventoryRecord) error {
+		records[record.Path] = record
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestInventory(t *testing.T) {
+	encFs := newTestInventoryFs(t)
+	records := collectTestInventory(t, encFs)
+	keyId := encFs.key.KeyId()
+	tests := []struct {
+		path                string
+		wantDir             bool
+		wantSize            int64
+		wantKeyVersion      string
+		wantCipher          string
+		wantIntegrityStatus string
+	}{
+		{"/dir", true, 0, "", CIPHER_NONE, INTEGRITY_STATUS_OK},
+		{"/dir/empty", true, 0, "", CIPHER_NONE, INTEGRITY_STATUS_OK},
+		// sizes are plaintext sizes
+		{"/dir/ctr", false, 100, keyId, CIPHER_AES_CTR, INTEGRITY_STATUS_OK},
+		{"/dir/gcm", false, CONTENT_CHUNK_SIZE + 1, keyId, CIPHER_AES_GCM, INTEGRITY_STATUS_OK},
+		{"/dir/comma, \"quoted\"", false, 1, keyId, CIPHER_AES_GCM, INTEGRITY_STATUS_OK},
+		{"/dir/new\nline", false, 2, keyId, CIPHER_AES_GCM, INTEGRITY_STATUS_OK},
+		{"/dir/plain", false, 5, "", CIPHER_NONE, INTEGRITY_STATUS_MISSING_META},
+		// the backend size is reported without a readable meta, CTR files have no overhead
+		{"/dir/bad", false, 3, "", CIPHER_NONE, INTEGRITY_STATUS_BAD_META},
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("got %d records, want %d", len(records), len(tests))
+	}
+	for _, test := range tests {
+		t.Run(strconv.Quote(test.path), func(t *testing.T) {
+			record := records[test.path]
+			if record == nil {
+				t.Fatal("no record")
+			}
+			if record.IsDir != test.wantDir || !test.wantDir && record.Size != test.wantSize ||
+				record.KeyVersion != test.wantKeyVersion || record.Cipher != test.wantCipher ||
+				record.IntegrityStatus != test.wantIntegrityStatus || record.ModTime.IsZero() {
+				t.Fatalf("got %+v", *record)
+			}
+		})
+	}
+}
+
+func TestExportInventory(t *testing.T) {
+	encFs := newTestInventoryFs(t)
+	wantRecords := collectTestInventory(t, encFs)
+	tests := []struct {
+		format string
+		// parse returns the records of the export
+		parse func(t *testing.T, output []byte) map[string]*InventoryRecord
+	}{
+		{INVENTORY_FORMAT_JSON, func(t *testing.T, output []byte) map[string]*InventoryRecord {
+			records := make(map[string]*InventoryRecord)
+			scanner := bufio.NewScanner(bytes.NewReader(output))
+			for scanner.Scan() {
+				var record InventoryRecord
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatalf("line %q: %v", scanner.Text(), err)
+				}
+				records[record.Path] = &record
+			}
+			return records
+		}},
+		{INVENTORY_FORMAT_CSV, func(t *testing.T, output []byte) map[string]*InventoryRecord {
+			// names with commas, quotes and newlines are quoted
+			for _, want := range []string{`"/dir/comma, ""quoted"""`, "\"/dir/new\nline\""} {
+				if !bytes.Contains(output, []byte(want)) {
+					t.Fatalf("got %q, want %q", output, want)
+				}
+			}
+			rows, err := csv.NewReader(bytes.NewReader(output)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantHeader := []string{"path", "is_dir", "size", "mod_time", "key_version", "cipher", "integrity_status"}
+			if len(rows) == 0 || !reflect.DeepEqual(rows[0], wantHeader) {
+				t.Fatalf("got rows %q", rows)
+			}
+			records := make(map[string]*InventoryRecord)
+			for _, row := range rows[1:] {
+				isDir, err := strconv.ParseBool(row[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				size, err := strconv.ParseInt(row[2], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				modTime, err := time.Parse(time.RFC3339Nano, row[3])
+				if err != nil {
+					t.Fatal(err)
+				}
+				records[row[0]] = &InventoryRecord{Path: row[0], IsDir: isDir, Size: size, ModTime: modTime,
+					KeyVersion: row[4], Cipher: row[5], IntegrityStatus: row[6]}
+			}
+			return records
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := encFs.ExportInventory("/dir", &output, test.format); err != nil {
+				t.Fatal(err)
+			}
+			records := test.parse(t, output.Bytes())
+			if len(records) != len(wantRecords) {
+				t.Fatalf("got %d records, want %d", len(records), len(wantRecords))
+			}
+			for path, want := range wantRecords {
+				got := records[path]
+				if got == nil || !got.ModTime.Equal(want.ModTime) {
+					t.Fatalf("got %+v, want %+v", got, *want)
+				}
+				got.ModTime = want.ModTime
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %+v, want %+v", *got, *want)
+				}
+			}
+		})
+	}
+
+	var output bytes.Buffer
+	if err := encFs.ExportInventory("/dir", &output, "xml"); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Fatalf("got %v, want unknown format", err)
+	}
+	if err := encFs.ExportInventory("/missing", &output, INVENTORY_FORMAT_CSV); err == nil {
+		t.Fatal("got no error of a missing root")
+	}
+}
@@ -0,0 +1,121 @@
+package encfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+// IOFS is a read only io/fs view of a subtree of EncFs, it passes fstest.TestFS so the decrypted tree can be
+// handed to html/template, http.FS and other stdlib consumers
+type IOFS struct {
+	encFs *EncFs
+	root  string
+}
+
+var (
+	_ fs.FS         = (*IOFS)(nil)
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+	_ fs.SubFS      = (*IOFS)(nil)
+)
+
+// IOFS returns an io/fs view of root, names are slash separated and relative to root like fs.ValidPath requires
+func (encFs *EncFs) IOFS(root string) *IOFS {
+	return &IOFS{encFs: encFs, root: path.Clean("/" + root)}
+}
+
+func (v *IOFS) Open(name string) (fs.File, error) {
+	realName, err := v.realName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := v.encFs.Open(realName)
+	if err != nil {
+		return nil, v.pathError("open", name, err)
+	}
+	return f, nil
+}
+
+func (v *IOFS) Stat(name string) (fs.FileInfo, error) {
+	realName, err := v.realName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := v.encFs.Stat(realName)
+	if err != nil {
+		return nil, v.pathError("stat", name, err)
+	}
+	return fileInfo, nil
+}
+
+// ReadDir returns the entries of the directory name sorted by name
+func (v *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	realName, err := v.realName("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := v.encFs.Open(realName)
+	if err != nil {
+		return nil, v.pathError("readdir", name, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	encFile, ok := f.(*EncFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	dirEntries, err := encFile.ReadDir(-1)
+	if err != nil {
+		return nil, v.pathError("readdir", name, err)
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries, nil
+}
+
+func (v *IOFS) ReadFile(name string) ([]byte, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, v.pathError("read", name, err)
+	}
+	return data, nil
+}
+
+// Sub returns the view of the directory dir
+func (v *IOFS) Sub(dir string) (fs.FS, error) {
+	realName, err := v.realName("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &IOFS{encFs: v.encFs, root: realName}, nil
+}
+
+func (v *IOFS) realName(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(v.root, name), nil
+}
+
+// pathError reports name of the view instead of the encrypted path of the backend
+func (v *IOFS) pathError(op, name string, err error) error {
+	var pathError *os.PathError
+	if errors.As(err, &pathError) {
+		err = pathError.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
@@ -0,0 +1,114 @@
+package encfs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	files := map[string][]byte{
+		"/a.txt":             []byte("a"),
+		"/empty":             nil,
+		"/dir/b.txt":         testPattern(CONTENT_CHUNK_SIZE + 1000),
+		"/dir/sub/c.txt":     []byte("c"),
+		"/dir/sub/名前.txt":    []byte("名前"),
+		"/other/dir/d.bin":   testPattern(5000),
+		"/other/dir/e space": []byte("e"),
+	}
+	tests := []struct {
+		name  string
+		newFs func() *EncFs
+	}{
+		{"ctr", func() *EncFs {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			return encFs
+		}},
+		{"gcm header", func() *EncFs {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				t.Fatal(err)
+			}
+			// fstest reads byte by byte, every uncached read of a chunked file decrypts the whole chunk
+			if err := encFs.WithBlockCache(CONTENT_CHUNK_SIZE, 4); err != nil {
+				t.Fatal(err)
+			}
+			return encFs
+		}},
+		{"hmac names", func() *EncFs {
+			encFs, _ := newTestHmacEncFs()
+			return encFs
+		}},
+		{"block cache", func() *EncFs {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithBlockCache(4096, 16); err != nil {
+				t.Fatal(err)
+			}
+			return encFs
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs := test.newFs()
+			for name, data := range files {
+				if err := encFs.MkdirAll(path.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, name, data)
+			}
+			views := []struct {
+				root     string
+				expected []string
+			}{
+				{"/", []string{"a.txt", "empty", "dir/b.txt", "dir/sub/c.txt", "dir/sub/名前.txt", "other/dir/d.bin"}},
+				{"/dir", []string{"b.txt", "sub/c.txt", "sub/名前.txt"}},
+				{"other/dir", []string{"d.bin", "e space"}},
+			}
+			for _, view := range views {
+				if err := fstest.TestFS(encFs.IOFS(view.root), view.expected...); err != nil {
+					t.Fatalf("view of %s: %v", view.root, err)
+				}
+			}
+			sub, err := fs.Sub(encFs.IOFS("/"), "dir/sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(sub, "c.txt", "名前.txt"); err != nil {
+				t.Fatalf("sub: %v", err)
+			}
+		})
+	}
+}
+
+func TestIOFSInvalidNames(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	iofs := encFs.IOFS("/")
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		{"file", nil},
+		{"/file", fs.ErrInvalid},
+		{"./file", fs.ErrInvalid},
+		{"../file", fs.ErrInvalid},
+		{"dir/", fs.ErrInvalid},
+		{"missing", fs.ErrNotExist},
+	}
+	for _, test := range tests {
+		_, err := iofs.Open(test.name)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("open %q: got %v, want %v", test.name, err, test.wantErr)
+		}
+		var pathError *fs.PathError
+		if err != nil && (!errors.As(err, &pathError) || pathError.Path != test.name) {
+			t.Fatalf("open %q: error %v does not report the name of the view", test.name, err)
+		}
+		if _, err := fs.ReadFile(iofs, test.name); !errors.Is(err, test.wantErr) {
+			t.Fatalf("read %q: got %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package encfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+const DIR_ITERATOR_BATCH_SIZE = 256
+
+// EncDirIterator lazily reads directory entries, meta files are skipped and names are decrypted
+type EncDirIterator struct {
+	encFile     *EncFile
+	closeOnDone bool
+	batch       []fs.DirEntry
+	batchPos    int
+	done        bool
+	// nextBatch lists the entries of directories which are not backend directories, e.g. of a FlatFile, they are
+	// returned as they are
+	nextBatch func(count int) ([]fs.DirEntry, error)
+}
+
+type EncDirEntry struct {
+	fs.DirEntry
+	encFile             *EncFile
+	encryptedParentName string
+}
+
+func (e *EncDirEntry) Name() string {
+	return e.encFile.encFs.key.decryptFileNamePart(e.encryptedParentName, e.DirEntry.Name())
+}
+
+func (e *EncDirEntry) Info() (fs.FileInfo, error) {
+	fileInfo, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return newEncFileInfoInDir(e.encFile, fileInfo, e.encryptedParentName), nil
+}
+
+func (f *EncFile) DirIterator() (*EncDirIterator, error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if !f.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	return &EncDirIterator{
+		encFile: f,
+	}, nil
+}
+
+// OpenDirIterator opens directory name, the directory is closed by Close or when Next returns io.EOF
+func (encFs *EncFs) OpenDirIterator(name string) (*EncDirIterator, error) {
+	f, err := encFs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	encFile, ok := f.(*EncFile)
+	if !ok {
+		_ = f.Close()
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrInvalid}
+	}
+	iterator, err := encFile.DirIterator()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	iterator.closeOnDone = true
+	return iterator, nil
+}
+
+// Next returns the next directory entry, io.EOF is returned after the last entry
+func (it *EncDirIterator) Next() (fs.DirEntry, error) {
+	for {
+		if it.batchPos < len(it.batch) {
+			dirEntry := it.batch[it.batchPos]
+			it.batchPos++
+			if it.nextBatch != nil {
+				return dirEntry, nil
+			}
+			if it.encFile.encFs.metaFileNaming().isInternalName(dirEntry.Name()) {
+				continue
+			}
+			if it.encFile.encFs.specialFilePolicy == SPECIAL_FILE_POLICY_HIDE &&
+				isSpecialFileMode(dirEntry.Type()) {
+				continue
+			}
+			return &EncDirEntry{
+				DirEntry:            dirEntry,
+				encFile:             it.encFile,
+				encryptedParentName: it.encFile.file.Name(),
+			}, nil
+		}
+		if it.done {
+			return nil, io.EOF
+		}
+		if it.encFile.closed {
+			return nil, afero.ErrFileClosed
+		}
+		var batch []fs.DirEntry
+		var err error
+		if it.nextBatch != nil {
+			batch, err = it.nextBatch(DIR_ITERATOR_BATCH_SIZE)
+		} else {
+			batch, err = callWithRetry(it.encFile.encFs, retryNever, "readdir", it.encFile.file.Name(),
+				func() ([]fs.DirEntry, error) {
+					return readDirBatch(it.encFile.file, DIR_ITERATOR_BATCH_SIZE)
+				}, nil)
+		}
+		it.batch = batch
+		it.batchPos = 0
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			it.done = true
+			if it.closeOnDone {
+				_ = it.encFile.Close()
+			}
+		}
+	}
+}
+
+// readDirBatch uses ReadDir when the backend file has it, entries of other backends are built from Readdir
+func readDirBatch(file afero.File, count int) ([]fs.DirEntry, error) {
+	if dirReader, ok := file.(fs.ReadDirFile); ok {
+		return dirReader.ReadDir(count)
+	}
+	fileInfos, err := file.Readdir(count)
+	if err == nil && len(fileInfos) == 0 {
+		// some backends return no error after the last entry
+		err = io.EOF
+	}
+	dirEntries := make([]fs.DirEntry, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		dirEntries[i] = fs.FileInfoToDirEntry(fileInfo)
+	}
+	return dirEntries, err
+}
+
+func (it *EncDirIterator) Close() error {
+	if it.closeOnDone && !it.encFile.closed {
+		return it.encFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package encfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestEncDirIterator(t *testing.T) {
+	backends := []struct {
+		name string
+		base func() afero.Fs
+	}{
+		{"mem", afero.NewMemMapFs},
+		// backend files without ReadDir are listed by Readdir
+		{"readdir only", func() afero.Fs { return newTestRecordingFs(afero.NewMemMapFs()) }},
+	}
+	// counts around DIR_ITERATOR_BATCH_SIZE, every file has a meta file next to it
+	counts := []int{0, 1, DIR_ITERATOR_BATCH_SIZE / 2, DIR_ITERATOR_BATCH_SIZE, DIR_ITERATOR_BATCH_SIZE + 1,
+		3*DIR_ITERATOR_BATCH_SIZE + 7}
+	for _, backend := range backends {
+		for _, count := range counts {
+			t.Run(fmt.Sprintf("%s %d", backend.name, count), func(t *testing.T) {
+				key := NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12])
+				encFs := NewEncFsWithBackend(key, backend.base()).(*EncFs)
+				if err := encFs.Mkdir("/dir", 0755); err != nil {
+					t.Fatal(err)
+				}
+				var wantNames []string
+				for i := 0; i < count; i++ {
+					name := fmt.Sprintf("file%04d", i)
+					writeTestFile(t, encFs, "/dir/"+name, []byte(name))
+					wantNames = append(wantNames, name)
+				}
+				if count > 0 {
+					if err := encFs.Mkdir("/dir/sub", 0755); err != nil {
+						t.Fatal(err)
+					}
+					wantNames = append(wantNames, "sub")
+				}
+
+				iterator, err := encFs.OpenDirIterator("/dir")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for {
+					dirEntry, err := iterator.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					fileInfo, err := dirEntry.Info()
+					if err != nil {
+						t.Fatal(err)
+					}
+					// sizes are plaintext sizes
+					if dirEntry.Name() != fileInfo.Name() || !dirEntry.IsDir() && fileInfo.Size() != 8 {
+						t.Fatalf("got %s of size %d", dirEntry.Name(), fileInfo.Size())
+					}
+					names = append(names, dirEntry.Name())
+				}
+				sort.Strings(names)
+				if !reflect.DeepEqual(names, wantNames) {
+					t.Fatalf("got %d names, want %d", len(names), len(wantNames))
+				}
+				// the directory is closed after the last entry
+				if _, err := iterator.Next(); err != io.EOF || !iterator.encFile.closed {
+					t.Fatalf("got %v, closed %v", err, iterator.encFile.closed)
+				}
+				if err := iterator.Close(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestEncDirIteratorClose(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	for i := 0; i < DIR_ITERATOR_BATCH_SIZE+1; i++ {
+		writeTestFile(t, encFs, fmt.Sprintf("/dir/file%d", i), nil)
+	}
+	tests := []struct {
+		name string
+		// next is the count of entries read before Close
+		next int
+	}{
+		{"before the first entry", 0},
+		// the rest of the batch is still returned, the next batch is not read
+		{"in the first batch", 10},
+		// io.EOF is only seen by reading past the last entry
+		{"at the last entry", DIR_ITERATOR_BATCH_SIZE + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iterator, err := encFs.OpenDirIterator("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.next; i++ {
+				if _, err := iterator.Next(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := iterator.Close(); err != nil || !iterator.encFile.closed {
+				t.Fatalf("got %v, closed %v", err, iterator.encFile.closed)
+			}
+			// closing twice does nothing
+			if err := iterator.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, err := iterator.Next()
+				if err == nil {
+					continue
+				}
+				if err != afero.ErrFileClosed {
+					t.Fatalf("got %v, want %v", err, afero.ErrFileClosed)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestDirIteratorErrors(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	tests := []struct {
+		name    string
+		open    func() (*EncDirIterator, error)
+		wantErr error
+	}{
+		{"missing", func() (*EncDirIterator, error) { return encFs.OpenDirIterator("/missing") }, os.ErrNotExist},
+		{"file", func() (*EncDirIterator, error) { return encFs.OpenDirIterator("/file") }, os.ErrInvalid},
+		{"closed", func() (*EncDirIterator, error) {
+			f, err := encFs.Open("/")
+			if err != nil {
+				return nil, err
+			}
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+			return f.(*EncFile).DirIterator()
+		}, afero.ErrFileClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.open(); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package encfs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	CHANGE_JOURNAL_FILE_NAME = "__ENCFS_JOURNAL__" + EncFileExt
+	CHANGE_JOURNAL_KEY_INFO  = "encfs-afero change journal"
+
+	CHANGE_CREATE = "create"
+	CHANGE_MODIFY = "modify"
+	CHANGE_RENAME = "rename"
+	CHANGE_DELETE = "delete"
+	CHANGE_ATTRIB = "attrib"
+)
+
+var (
+	ErrChangeJournalBroken   = errors.New("change journal is broken")
+	ErrChangeJournalDisabled = errors.New("change journal is not enabled")
+)
+
+// ChangeEvent is one entry of the change journal, FileId stays the same when a file or its parent is renamed
+type ChangeEvent struct {
+	Generation uint64    `json:"generation"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	FileId     string    `json:"file_id"`
+	Path       string    `json:"path"`
+	NewPath    string    `json:"new_path,omitempty"`
+	IsDir      bool      `json:"is_dir,omitempty"`
+}
+
+type changeJournal struct {
+	mutex      *sync.Mutex
+	fs         afero.Fs
+	name       string
+	key        []byte
+	generation uint64
+	fileIds    map[string]string
+	err        error
+}
+
+// WithChangeJournal appends every change of encFs to an encrypted journal in the plaintext directory root, sync
+// engines read it by ChangesSince instead of walking the whole volume, an existing journal is continued
+func (encFs *EncFs) WithChangeJournal(root string) error {
+	journal := &changeJournal{
+		mutex:   &sync.Mutex{},
+		fs:      encFs.base,
+		name:    filepath.Join(encFs.encryptFileName(root), CHANGE_JOURNAL_FILE_NAME),
+		key:     hkdfSha256(encFs.key.key, nil, []byte(CHANGE_JOURNAL_KEY_INFO), 32),
+		fileIds: make(map[string]string),
+	}
+	err := journal.read(func(event *ChangeEvent) error {
+		journal.generation = event.Generation
+		journal.apply(event)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	encFs.changeJournal = journal
+	return nil
+}
+
+// ChangeCursor returns the generation of the last change, ChangesSince with it returns later changes only
+func (encFs *EncFs) ChangeCursor() (uint64, error) {
+	journal := encFs.changeJournal
+	if journal == nil {
+		return 0, ErrChangeJournalDisabled
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return journal.generation, journal.err
+}
+
+// ChangesSince returns up to limit changes after cursor and the cursor of the last returned change, limit <= 0
+// returns all, ErrChangeJournalBroken means changes may be missing and a full scan is needed
+func (encFs *EncFs) ChangesSince(cursor uint64, limit int) ([]ChangeEvent, uint64, error) {
+	journal := encFs.changeJournal
+	if journal == nil {
+		return nil, cursor, ErrChangeJournalDisabled
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.err != nil {
+		return nil, cursor, journal.err
+	}
+	changes := make([]ChangeEvent, 0)
+	errLimitReached := errors.New("limit reached")
+	err := journal.read(func(event *ChangeEvent) error {
+		if event.Generation <= cursor {
+			return nil
+		}
+		if limit > 0 && len(changes) >= limit {
+			return errLimitReached
+		}
+		changes = append(changes, *event)
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		return nil, cursor, err
+	}
+	if len(changes) > 0 {
+		cursor = changes[len(changes)-1].Generation
+	}
+	return changes, cursor, nil
+}
+
+// read calls fn for every event of the journal file in order
+func (j *changeJournal) read(fn func(event *ChangeEvent) error) error {
+	file, err := j.fs.Open(j.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		sealedEvent, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrChangeJournalBroken, err)
+		}
+		eventBytes, err := openWithRandomNonce(j.key, sealedEvent)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrChangeJournalBroken, err)
+		}
+		var event ChangeEvent
+		if err := json.Unmarshal(eventBytes, &event); err != nil {
+			return fmt.Errorf("%w: %v", ErrChangeJournalBroken, err)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// apply updates the file ids of paths, renames and deletes of directories apply to the whole subtree
+func (j *changeJournal) apply(event *ChangeEvent) {
+	switch event.Type {
+	case CHANGE_RENAME:
+		prefix := event.Path + string(filepath.Separator)
+		movedFileIds := make(map[string]string)
+		for name, fileId := range j.fileIds {
+			if name == event.Path || strings.HasPrefix(name, prefix) {
+				delete(j.fileIds, name)
+				movedFileIds[event.NewPath+strings.TrimPrefix(name, event.Path)] = fileId
+			}
+		}
+		for name, fileId := range movedFileIds {
+			j.fileIds[name] = fileId
+		}
+		j.fileIds[event.NewPath] = event.FileId
+	case CHANGE_DELETE:
+		prefix := event.Path + string(filepath.Separator)
+		for name := range j.fileIds {
+			if name == event.Path || strings.HasPrefix(name, prefix) {
+				delete(j.fileIds, name)
+			}
+		}
+	default:
+		j.fileIds[event.Path] = event.FileId
+	}
+}
+
+// append records a change, failures break the journal instead of failing the operation
+func (j *changeJournal) append(encFs *EncFs, changeType, name, newName string, isDir bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.err != nil {
+		return
+	}
+	fileId, found := j.fileIds[name]
+	if !found || changeType == CHANGE_CREATE && !isDir {
+		// a create replaces the file at name
+		fileIdBytes := make([]byte, 16)
+		if err := encFs.readRandom(fileIdBytes); err != nil {
+			j.err = fmt.Errorf("%w: %v", ErrChangeJournalBroken, err)
+			encFs.getLogger().Error("change journal is broken", "error", j.err)
+			return
+		}
+		fileId = hex.EncodeToString(fileIdBytes)
+	}
+	event := &ChangeEvent{
+		Generation: j.generation + 1,
+		Time:       time.Now(),
+		Type:       changeType,
+		FileId:     fileId,
+		Path:       name,
+		NewPath:    newName,
+		IsDir:      isDir,
+	}
+	if err := j.write(encFs, event); err != nil {
+		j.err = fmt.Errorf("%w: %v", ErrChangeJournalBroken, err)
+		encFs.getLogger().Error("change journal is broken", "error", j.err)
+		return
+	}
+	j.generation = event.Generation
+	j.apply(event)
+}
+
+func (j *changeJournal) write(encFs *EncFs, event *ChangeEvent) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 12)
+	if err := encFs.readRandom(nonce); err != nil {
+		return err
+	}
+	sealedEvent, err := sealWithNonce(j.key, nonce, eventBytes)
+	if err != nil {
+		return err
+	}
+	file, err := j.fs.OpenFile(j.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err := file.Write([]byte(base64.StdEncoding.EncodeToString(sealedEvent) + "\n")); err != nil {
+		return err
+	}
+	if encFs.getDurabilityPolicy() >= DURABILITY_POLICY_META {
+		return file.Sync()
+	}
+	return nil
+}
+
+// recordChange appends a change of the plaintext name to the journal when it is enabled
+func (encFs *EncFs) recordChange(changeType, name, newName string, isDir bool) {
+	journal := encFs.changeJournal
+	if journal == nil {
+		return
+	}
+	absName, err := encFs.absBackendName(name)
+	if err != nil {
+		return
+	}
+	if newName != "" {
+		if newName, err = encFs.absBackendName(newName); err != nil {
+			return
+		}
+	}
+	journal.append(encFs, changeType, absName, newName, isDir)
+}
+
+// recordAuditedChange journals successful operations by their audit op, writes are journaled when closed
+func (encFs *EncFs) recordAuditedChange(op, name, newName string, err *error) {
+	if encFs.changeJournal == nil || err != nil && *err != nil {
+		return
+	}
+	switch op {
+	case "create":
+		encFs.recordChange(CHANGE_CREATE, name, "", false)
+	case "symlink":
+		encFs.recordChange(CHANGE_CREATE, newName, "", false)
+	case "mkdir", "mkdirall":
+		encFs.recordChange(CHANGE_CREATE, name, "", true)
+	case "remove", "removeall":
+		encFs.recordChange(CHANGE_DELETE, name, "", false)
+	case "rename":
+		encFs.recordChange(CHANGE_RENAME, name, newName, false)
+	case "chmod", "chown", "chtimes":
+		encFs.recordChange(CHANGE_ATTRIB, name, "", false)
+	}
+}
@@ -0,0 +1,208 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+type testChange struct {
+	changeType string
+	path       string
+	newPath    string
+	isDir      bool
+}
+
+func TestChangeJournal(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, encFs *EncFs)
+		wantChanges []testChange
+		// pairs of indexes of changes of the same file, every other change is of another file
+		sameFileIds [][2]int
+	}{
+		{"create", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, encFs, "/file", []byte("data"))
+		}, []testChange{{CHANGE_CREATE, "/file", "", false}, {CHANGE_MODIFY, "/file", "", false}}, [][2]int{{0, 1}}},
+		{"open create", func(t *testing.T, encFs *EncFs) {
+			f, err := encFs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+		}, []testChange{{CHANGE_CREATE, "/file", "", false}}, nil},
+		// unchanged files are not journaled when closed
+		{"read", func(t *testing.T, encFs *EncFs) {
+			readTestFile(t, encFs, "/existing")
+		}, nil, nil},
+		{"mkdir", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, []testChange{{CHANGE_CREATE, "/dir", "", true}}, nil},
+		{"rename", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/existing", "/renamed"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/renamed", []byte("more"))
+		}, []testChange{{CHANGE_RENAME, "/existing", "/renamed", false}, {CHANGE_MODIFY, "/renamed", "", false}},
+			[][2]int{{0, 1}}},
+		{"rename directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", []byte("data"))
+			if err := encFs.Rename("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.Chmod("/moved/file", 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, []testChange{{CHANGE_CREATE, "/dir", "", true}, {CHANGE_CREATE, "/dir/file", "", false},
+			{CHANGE_MODIFY, "/dir/file", "", false}, {CHANGE_RENAME, "/dir", "/moved", false},
+			{CHANGE_ATTRIB, "/moved/file", "", false}}, [][2]int{{0, 3}, {1, 2}, {1, 4}}},
+		// a file created again at a deleted path is another file
+		{"delete", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/existing"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/existing", []byte("new"))
+		}, []testChange{{CHANGE_DELETE, "/existing", "", false}, {CHANGE_CREATE, "/existing", "", false},
+			{CHANGE_MODIFY, "/existing", "", false}}, [][2]int{{1, 2}}},
+		{"failed operation", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/missing"); err == nil {
+				t.Fatal("removed a missing file")
+			}
+		}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithChangeJournal("/"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/existing", []byte("data"))
+			cursor, err := encFs.ChangeCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.change(t, encFs)
+
+			changes, nextCursor, err := encFs.ChangesSince(cursor, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != len(test.wantChanges) {
+				t.Fatalf("got %d changes %v, want %v", len(changes), changes, test.wantChanges)
+			}
+			for i, change := range changes {
+				want := test.wantChanges[i]
+				if change.Generation != cursor+uint64(i)+1 || change.Type != want.changeType ||
+					change.Path != want.path || change.NewPath != want.newPath || change.IsDir != want.isDir {
+					t.Fatalf("change %d: got %+v, want %+v", i, change, want)
+				}
+			}
+			if nextCursor != cursor+uint64(len(changes)) {
+				t.Fatalf("got cursor %d after %d", nextCursor, cursor)
+			}
+			fileIds := make(map[string]int)
+			for i, change := range changes {
+				fileIds[change.FileId] = i
+			}
+			for _, same := range test.sameFileIds {
+				if changes[same[0]].FileId != changes[same[1]].FileId {
+					t.Fatalf("changes %d and %d got file ids %s and %s", same[0], same[1], changes[same[0]].FileId,
+						changes[same[1]].FileId)
+				}
+			}
+			if len(fileIds) != len(changes)-len(test.sameFileIds) {
+				t.Fatalf("got %d file ids of %d changes", len(fileIds), len(changes))
+			}
+		})
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if _, _, err := encFs.ChangesSince(0, 0); !errors.Is(err, ErrChangeJournalDisabled) {
+		t.Fatalf("got %v, want %v", err, ErrChangeJournalDisabled)
+	}
+	if err := encFs.WithChangeJournal("/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if err := encFs.Mkdir(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		cursor     uint64
+		limit      int
+		wantPaths  []string
+		wantCursor uint64
+	}{
+		{0, 0, []string{"/a", "/b", "/c"}, 3},
+		{0, 2, []string{"/a", "/b"}, 2},
+		{2, 2, []string{"/c"}, 3},
+		{3, 0, nil, 3},
+		{5, 0, nil, 5},
+	}
+	for _, test := range tests {
+		changes, cursor, err := encFs.ChangesSince(test.cursor, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, change := range changes {
+			paths = append(paths, change.Path)
+		}
+		if len(paths) != len(test.wantPaths) || cursor != test.wantCursor {
+			t.Fatalf("since %d limit %d: got %v and %d, want %v and %d", test.cursor, test.limit, paths, cursor,
+				test.wantPaths, test.wantCursor)
+		}
+		for i := range paths {
+			if paths[i] != test.wantPaths[i] {
+				t.Fatalf("since %d limit %d: got %v, want %v", test.cursor, test.limit, paths, test.wantPaths)
+			}
+		}
+	}
+
+	// the journal is encrypted and continued by the next EncFs
+	journalBytes, err := afero.ReadFile(base, "/"+CHANGE_JOURNAL_FILE_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(journalBytes, []byte("generation")) {
+		t.Fatal("journal holds plaintext events")
+	}
+	reopened := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+	if err := reopened.WithChangeJournal("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Rename("/a", "/d"); err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err := reopened.ChangesSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 || changes[3].Generation != 4 || changes[3].FileId != changes[0].FileId {
+		t.Fatalf("got changes %v", changes)
+	}
+	fileInfos, err := afero.ReadDir(reopened, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileInfos) != 3 {
+		t.Fatalf("listed %d files, want the 3 directories", len(fileInfos))
+	}
+
+	// another key can not read the journal
+	otherKey := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(2)), base).(*EncFs)
+	if err := otherKey.WithChangeJournal("/"); !errors.Is(err, ErrChangeJournalBroken) {
+		t.Fatalf("got %v, want %v", err, ErrChangeJournalBroken)
+	}
+}
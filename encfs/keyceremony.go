@@ -0,0 +1,129 @@
+package encfs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownCustodian = errors.New("custodian is not part of the key ceremony")
+)
+
+// KeyCeremony records a split knowledge key ceremony in an audit log, events carry the ceremony id as purpose and
+// the custodian or the key id as path, shares and keys never appear in the transcript
+type KeyCeremony struct {
+	mutex      *sync.Mutex
+	id         string
+	auditSink  AuditSink
+	custodians map[string]bool
+	shares     map[string]*KeyShare
+}
+
+// NewKeyCeremony starts a ceremony with the custodians holding shares, use a hash chained sink like
+// NewHashChainFileAuditSink so the transcript can be verified later
+func NewKeyCeremony(id string, auditSink AuditSink, custodians []string) *KeyCeremony {
+	custodianSet := make(map[string]bool)
+	for _, custodian := range custodians {
+		custodianSet[custodian] = true
+	}
+	return &KeyCeremony{
+		mutex:      &sync.Mutex{},
+		id:         id,
+		auditSink:  auditSink,
+		custodians: custodianSet,
+		shares:     make(map[string]*KeyShare),
+	}
+}
+
+func (c *KeyCeremony) record(op, custodian string, err error) {
+	if c.auditSink == nil {
+		return
+	}
+	event := &AuditEvent{
+		Time:    time.Now(),
+		Op:      op,
+		Path:    custodian,
+		Purpose: c.id,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	_ = c.auditSink.WriteAuditEvent(event)
+}
+
+// GenerateShares generates a new master key and splits it into one share per custodian, threshold shares
+// assemble it, every issued share is recorded
+func (c *KeyCeremony) GenerateShares(custodians []string, threshold int) (_ map[string]*KeyShare, err error) {
+	keyId := ""
+	defer func() {
+		c.record("ceremony-generate", keyId, err)
+	}()
+	for _, custodian := range custodians {
+		if !c.custodians[custodian] {
+			return nil, ErrUnknownCustodian
+		}
+	}
+	key, err := GenerateEncryptionMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	keyId = key.KeyId()
+	shares, err := SplitEncryptionMasterKey(key, len(custodians), threshold)
+	if err != nil {
+		return nil, err
+	}
+	sharesByCustodian := make(map[string]*KeyShare)
+	for i, custodian := range custodians {
+		sharesByCustodian[custodian] = shares[i]
+		c.record("ceremony-share-issued", custodian, nil)
+	}
+	return sharesByCustodian, nil
+}
+
+// AddShare verifies and collects the encoded share of custodian, a custodian may correct a mistyped share
+func (c *KeyCeremony) AddShare(custodian, encodedShare string) (err error) {
+	defer func() {
+		c.record("ceremony-share-received", custodian, err)
+	}()
+	if !c.custodians[custodian] {
+		return ErrUnknownCustodian
+	}
+	share, err := ParseKeyShare(encodedShare)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for otherCustodian, otherShare := range c.shares {
+		if otherCustodian == custodian {
+			continue
+		}
+		if otherShare.KeyId != share.KeyId || otherShare.Threshold != share.Threshold {
+			return ErrKeyShareMismatch
+		}
+		if otherShare.Index == share.Index {
+			return ErrDuplicateKeyShare
+		}
+	}
+	c.shares[custodian] = share
+	return nil
+}
+
+// Assemble combines the collected shares into the master key
+func (c *KeyCeremony) Assemble() (key *EncryptionMasterKey, err error) {
+	defer func() {
+		keyId := ""
+		if key != nil {
+			keyId = key.KeyId()
+		}
+		c.record("ceremony-assemble", keyId, err)
+	}()
+	c.mutex.Lock()
+	shares := make([]*KeyShare, 0, len(c.shares))
+	for _, share := range c.shares {
+		shares = append(shares, share)
+	}
+	c.mutex.Unlock()
+	return CombineKeyShares(shares)
+}
@@ -0,0 +1,130 @@
+package encfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyCeremony(t *testing.T) {
+	custodians := []string{"alice", "bob", "carol"}
+	tests := []struct {
+		name    string
+		add     func(shares map[string]*KeyShare) map[string]string
+		wantErr error
+		// error of assemble when adding succeeded
+		wantAssembleErr error
+	}{
+		{"threshold shares", func(shares map[string]*KeyShare) map[string]string {
+			return map[string]string{"alice": shares["alice"].String(), "carol": shares["carol"].String()}
+		}, nil, nil},
+		{"all shares", func(shares map[string]*KeyShare) map[string]string {
+			return map[string]string{"alice": shares["alice"].String(), "bob": shares["bob"].String(),
+				"carol": shares["carol"].String()}
+		}, nil, nil},
+		{"too few shares", func(shares map[string]*KeyShare) map[string]string {
+			return map[string]string{"bob": shares["bob"].String()}
+		}, nil, ErrNotEnoughKeyShares},
+		{"unknown custodian", func(shares map[string]*KeyShare) map[string]string {
+			return map[string]string{"mallory": shares["bob"].String()}
+		}, ErrUnknownCustodian, nil},
+		{"duplicate share", func(shares map[string]*KeyShare) map[string]string {
+			return map[string]string{"alice": shares["bob"].String(), "bob": shares["bob"].String()}
+		}, ErrDuplicateKeyShare, nil},
+		{"share of another key", func(shares map[string]*KeyShare) map[string]string {
+			otherShares, err := SplitEncryptionMasterKey(NewEncryptionMasterKey(testKeyBytes(2)), 3, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return map[string]string{"alice": shares["alice"].String(), "bob": otherShares[1].String()}
+		}, ErrKeyShareMismatch, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auditSink := &testAuditSink{}
+			generation := NewKeyCeremony("ceremony-1", auditSink, custodians)
+			shares, err := generation.GenerateShares(custodians, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shares) != len(custodians) {
+				t.Fatalf("got %d shares", len(shares))
+			}
+			generated := auditSink.eventsOf("ceremony-generate")
+			if len(generated) != 1 || generated[0].Path == "" || generated[0].Purpose != "ceremony-1" {
+				t.Fatalf("got generate events %+v", generated)
+			}
+			keyId := generated[0].Path
+			if issued := auditSink.eventsOf("ceremony-share-issued"); len(issued) != len(custodians) {
+				t.Fatalf("got %d issued shares", len(issued))
+			}
+
+			assembly := NewKeyCeremony("ceremony-2", auditSink, custodians)
+			// map order is random, errors depend on the shares added before, so add in custodian order
+			encodedShares := test.add(shares)
+			var addErr error
+			for _, custodian := range append(custodians, "mallory") {
+				if encodedShare, found := encodedShares[custodian]; found {
+					if err := assembly.AddShare(custodian, encodedShare); err != nil {
+						addErr = err
+					}
+				}
+			}
+			if !errors.Is(addErr, test.wantErr) {
+				t.Fatalf("add: got %v, want %v", addErr, test.wantErr)
+			}
+			if addErr != nil {
+				received := auditSink.eventsOf("ceremony-share-received")
+				if received[len(received)-1].Error == "" {
+					t.Fatalf("got received events %+v", received)
+				}
+				return
+			}
+			key, err := assembly.Assemble()
+			if !errors.Is(err, test.wantAssembleErr) {
+				t.Fatalf("assemble: got %v, want %v", err, test.wantAssembleErr)
+			}
+			assembled := auditSink.eventsOf("ceremony-assemble")
+			if len(assembled) != 1 || assembled[0].Purpose != "ceremony-2" {
+				t.Fatalf("got assemble events %+v", assembled)
+			}
+			if err == nil && (key.KeyId() != keyId || assembled[0].Path != keyId) {
+				t.Fatalf("assembled key %s, want %s", key.KeyId(), keyId)
+			}
+
+			// the transcript holds neither shares nor keys
+			for _, event := range auditSink.events {
+				for _, share := range shares {
+					if strings.Contains(event.Path+event.Error, share.String()) {
+						t.Fatalf("%s event holds a share", event.Op)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestKeyCeremonyCorrectedShare(t *testing.T) {
+	custodians := []string{"alice", "bob"}
+	shares, err := NewKeyCeremony("generate", nil, custodians).GenerateShares(custodians, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceremony := NewKeyCeremony("assemble", nil, custodians)
+	if err := ceremony.AddShare("alice", "mistyped"); err == nil {
+		t.Fatal("added a mistyped share")
+	}
+	// a custodian may replace the share added before
+	for _, custodian := range []string{"alice", "bob", "bob"} {
+		if err := ceremony.AddShare(custodian, shares[custodian].String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ceremony.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKeyCeremony("generate", nil, custodians).GenerateShares([]string{"alice", "mallory"}, 2)
+	if !errors.Is(err, ErrUnknownCustodian) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownCustodian)
+	}
+}
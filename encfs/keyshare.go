@@ -0,0 +1,201 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	KEY_SHARE_PREFIX    = "encfs-share:"
+	KEY_SHARE_VERSION   = 1
+	KEY_SHARE_MAX_TOTAL = 255
+
+	// version(1) || threshold(1) || index(1) || key id(8) || share data || checksum(4)
+	keyShareHeaderSize   = 11
+	keyShareChecksumSize = 4
+)
+
+var (
+	ErrBadKeyShare          = errors.New("key share is broken")
+	ErrBadKeyShareParams    = errors.New("key share threshold must be between 2 and total shares")
+	ErrNotEnoughKeyShares   = errors.New("not enough key shares")
+	ErrKeyShareMismatch     = errors.New("key shares do not belong to the same key")
+	ErrDuplicateKeyShare    = errors.New("duplicate key share")
+	ErrKeyShareKeyIdInvalid = errors.New("assembled key does not match the key id of the shares")
+)
+
+// KeyShare is one share of a master key split by Shamir's secret sharing over GF(2^8), any Threshold shares
+// assemble the key while fewer reveal nothing about it
+type KeyShare struct {
+	Index     int
+	Threshold int
+	KeyId     string
+	Data      []byte
+}
+
+// GenerateEncryptionMasterKey returns a new random 32 bytes master key without file name encryption
+func GenerateEncryptionMasterKey() (*EncryptionMasterKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return NewEncryptionMasterKey(key), nil
+}
+
+// SplitEncryptionMasterKey splits key into total shares of which threshold assemble it, only the key bytes are
+// shared, the name mapper must be configured again after CombineKeyShares
+func SplitEncryptionMasterKey(key *EncryptionMasterKey, total, threshold int) ([]*KeyShare, error) {
+	if threshold < 2 || threshold > total || total > KEY_SHARE_MAX_TOTAL {
+		return nil, ErrBadKeyShareParams
+	}
+	keyId := key.KeyId()
+	shares := make([]*KeyShare, total)
+	for i := range shares {
+		shares[i] = &KeyShare{
+			Index:     i + 1,
+			Threshold: threshold,
+			KeyId:     keyId,
+			Data:      make([]byte, len(key.key)),
+		}
+	}
+	coefficients := make([]byte, threshold)
+	for byteIndex, secretByte := range key.key {
+		// random polynomial of degree threshold-1 with the secret byte as constant term
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = secretByte
+		for _, share := range shares {
+			share.Data[byteIndex] = gf256EvalPolynomial(coefficients, byte(share.Index))
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// CombineKeyShares assembles the master key from at least Threshold shares, the result is checked against the
+// key id recorded in the shares so a wrong or altered share is detected
+func CombineKeyShares(shares []*KeyShare) (*EncryptionMasterKey, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughKeyShares
+	}
+	first := shares[0]
+	seenIndexes := make(map[int]bool)
+	for _, share := range shares {
+		if share.Threshold != first.Threshold || share.KeyId != first.KeyId || len(share.Data) != len(first.Data) {
+			return nil, ErrKeyShareMismatch
+		}
+		if share.Index < 1 || share.Index > KEY_SHARE_MAX_TOTAL {
+			return nil, ErrBadKeyShare
+		}
+		if seenIndexes[share.Index] {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateKeyShare, share.Index)
+		}
+		seenIndexes[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("%w: %d of %d", ErrNotEnoughKeyShares, len(shares), first.Threshold)
+	}
+	shares = shares[:first.Threshold]
+	key := make([]byte, len(first.Data))
+	for byteIndex := range key {
+		// Lagrange interpolation at x = 0
+		var secretByte byte
+		for i, share := range shares {
+			basis := byte(1)
+			for j, otherShare := range shares {
+				if i == j {
+					continue
+				}
+				basis = gf256Mul(basis, gf256Div(byte(otherShare.Index), byte(otherShare.Index)^byte(share.Index)))
+			}
+			secretByte ^= gf256Mul(share.Data[byteIndex], basis)
+		}
+		key[byteIndex] = secretByte
+	}
+	encryptionMasterKey := NewEncryptionMasterKey(key)
+	if encryptionMasterKey.KeyId() != first.KeyId {
+		return nil, ErrKeyShareKeyIdInvalid
+	}
+	return encryptionMasterKey, nil
+}
+
+// String encodes the share with a checksum so typos of custodians are detected by ParseKeyShare
+func (s *KeyShare) String() string {
+	keyId, _ := hex.DecodeString(s.KeyId)
+	encoded := make([]byte, keyShareHeaderSize, keyShareHeaderSize+len(s.Data)+keyShareChecksumSize)
+	encoded[0] = KEY_SHARE_VERSION
+	encoded[1] = byte(s.Threshold)
+	encoded[2] = byte(s.Index)
+	copy(encoded[3:keyShareHeaderSize], keyId)
+	encoded = append(encoded, s.Data...)
+	checksum := sha256.Sum256(encoded)
+	encoded = append(encoded, checksum[:keyShareChecksumSize]...)
+	return KEY_SHARE_PREFIX + base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func ParseKeyShare(encodedShare string) (*KeyShare, error) {
+	encodedShare = strings.TrimSpace(encodedShare)
+	if !strings.HasPrefix(encodedShare, KEY_SHARE_PREFIX) {
+		return nil, ErrBadKeyShare
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encodedShare, KEY_SHARE_PREFIX))
+	if err != nil || len(encoded) <= keyShareHeaderSize+keyShareChecksumSize {
+		return nil, ErrBadKeyShare
+	}
+	if encoded[0] != KEY_SHARE_VERSION {
+		return nil, ErrUnsupportedFormatVersion
+	}
+	checksumOffset := len(encoded) - keyShareChecksumSize
+	checksum := sha256.Sum256(encoded[:checksumOffset])
+	if !bytes.Equal(checksum[:keyShareChecksumSize], encoded[checksumOffset:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBadKeyShare)
+	}
+	if encoded[1] < 2 || encoded[2] == 0 {
+		return nil, ErrBadKeyShare
+	}
+	return &KeyShare{
+		Index:     int(encoded[2]),
+		Threshold: int(encoded[1]),
+		KeyId:     hex.EncodeToString(encoded[3:keyShareHeaderSize]),
+		Data:      append([]byte(nil), encoded[keyShareHeaderSize:checksumOffset]...),
+	}, nil
+}
+
+func gf256EvalPolynomial(coefficients []byte, x byte) byte {
+	// Horner's method, highest degree first
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gf256Mul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// gf256Mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1, without table lookups
+func gf256Mul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ carry&0x1b
+		b >>= 1
+	}
+	return product
+}
+
+func gf256Div(a, b byte) byte {
+	// b^254 is the inverse of b
+	inverse := b
+	for i := 0; i < 6; i++ {
+		inverse = gf256Mul(gf256Mul(inverse, inverse), b)
+	}
+	return gf256Mul(a, gf256Mul(inverse, inverse))
+}
@@ -0,0 +1,121 @@
+package encfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyShares(t *testing.T) {
+	key := NewEncryptionMasterKey(testKeyBytes(1))
+	shares, err := SplitEncryptionMasterKey(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		shares  func() []*KeyShare
+		wantErr error
+	}{
+		{"threshold shares", func() []*KeyShare { return shares[:3] }, nil},
+		{"other shares", func() []*KeyShare { return []*KeyShare{shares[4], shares[1], shares[3]} }, nil},
+		{"all shares", func() []*KeyShare { return shares }, nil},
+		{"too few shares", func() []*KeyShare { return shares[:2] }, ErrNotEnoughKeyShares},
+		{"no shares", func() []*KeyShare { return nil }, ErrNotEnoughKeyShares},
+		{"duplicate share", func() []*KeyShare { return []*KeyShare{shares[0], shares[0], shares[1]} },
+			ErrDuplicateKeyShare},
+		{"altered share", func() []*KeyShare {
+			altered := *shares[2]
+			altered.Data = append([]byte(nil), altered.Data...)
+			altered.Data[0] ^= 1
+			return []*KeyShare{shares[0], shares[1], &altered}
+		}, ErrKeyShareKeyIdInvalid},
+		{"share of another key", func() []*KeyShare {
+			otherShares, err := SplitEncryptionMasterKey(NewEncryptionMasterKey(testKeyBytes(2)), 5, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return []*KeyShare{shares[0], shares[1], otherShares[2]}
+		}, ErrKeyShareMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			combinedKey, err := CombineKeyShares(test.shares())
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && combinedKey.KeyId() != key.KeyId() {
+				t.Fatal("combined a different key")
+			}
+		})
+	}
+}
+
+func TestSplitEncryptionMasterKeyParams(t *testing.T) {
+	tests := []struct {
+		total, threshold int
+		wantErr          error
+	}{
+		{2, 2, nil},
+		{255, 255, nil},
+		{3, 1, ErrBadKeyShareParams},
+		{2, 3, ErrBadKeyShareParams},
+		{256, 2, ErrBadKeyShareParams},
+	}
+	for _, test := range tests {
+		shares, err := SplitEncryptionMasterKey(NewEncryptionMasterKey(testKeyBytes(1)), test.total, test.threshold)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("split %d of %d: got %v, want %v", test.threshold, test.total, err, test.wantErr)
+		}
+		if err == nil && len(shares) != test.total {
+			t.Fatalf("split %d of %d: got %d shares", test.threshold, test.total, len(shares))
+		}
+	}
+}
+
+func TestParseKeyShare(t *testing.T) {
+	shares, err := SplitEncryptionMasterKey(NewEncryptionMasterKey(testKeyBytes(1)), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := shares[1].String()
+	typo := []byte(encoded)
+	typo[len(KEY_SHARE_PREFIX)+5] ^= 'a' ^ 'b'
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr error
+	}{
+		{"share", encoded, nil},
+		{"surrounding space", " " + encoded + "\n", nil},
+		{"typo", string(typo), ErrBadKeyShare},
+		{"missing prefix", strings.TrimPrefix(encoded, KEY_SHARE_PREFIX), ErrBadKeyShare},
+		{"truncated", encoded[:len(encoded)-4], ErrBadKeyShare},
+		{"not base64", KEY_SHARE_PREFIX + "!!!", ErrBadKeyShare},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			share, err := ParseKeyShare(test.encoded)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && share.String() != encoded {
+				t.Fatalf("parsed share encodes to %s", share.String())
+			}
+		})
+	}
+}
+
+func TestGf256(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gf256Mul(gf256Div(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d / %d * %d = %d", a, b, b, got)
+			}
+		}
+	}
+	// the AES polynomial, example of FIPS-197
+	if got := gf256Mul(0x57, 0x83); got != 0xc1 {
+		t.Fatalf("0x57 * 0x83 = %#x, want 0xc1", got)
+	}
+}
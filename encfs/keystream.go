@@ -0,0 +1,54 @@
+package encfs
+
+import (
+	"crypto/cipher"
+	"sync"
+)
+
+const (
+	// reads and writes of CTR files from PARALLEL_KEYSTREAM_MIN_SIZE bytes are split into segments of at least
+	// PARALLEL_KEYSTREAM_SEGMENT_SIZE bytes, smaller I/O stays on the calling goroutine
+	PARALLEL_KEYSTREAM_MIN_SIZE     = 1 << 20
+	PARALLEL_KEYSTREAM_SEGMENT_SIZE = 256 << 10
+)
+
+// WithKeystreamParallelism encrypts and decrypts large reads and writes of CTR files on up to parallelism
+// goroutines, 0 or 1 keeps all keystream generation on the calling goroutine
+func (encFs *EncFs) WithKeystreamParallelism(parallelism int) {
+	encFs.keystreamParallelism = parallelism
+}
+
+func (encFs *EncFs) getKeystreamParallelism() int {
+	if encFs == nil || encFs.keystreamParallelism < 1 {
+		return 1
+	}
+	return encFs.keystreamParallelism
+}
+
+// xorCtrBlockKeyStreamParallel is xorCtrBlockKeyStream on up to parallelism goroutines, segments start at block
+// boundaries so every goroutine seeks its own counter, the AES block is shared since it has no state
+func xorCtrBlockKeyStreamParallel(block cipher.Block, iv []byte, offset int64, dst, src []byte, parallelism int) {
+	if parallelism <= 1 || len(src) < PARALLEL_KEYSTREAM_MIN_SIZE {
+		xorCtrBlockKeyStream(block, iv, offset, dst, src)
+		return
+	}
+	segmentSize := (len(src) + parallelism - 1) / parallelism
+	if segmentSize < PARALLEL_KEYSTREAM_SEGMENT_SIZE {
+		segmentSize = PARALLEL_KEYSTREAM_SEGMENT_SIZE
+	}
+	segmentSize = (segmentSize + 15) / 16 * 16
+	// the first segment ends at a block boundary of the file
+	firstSegmentSize := segmentSize - int(offset%16)
+	var waitGroup sync.WaitGroup
+	for start, end := 0, firstSegmentSize; start < len(src); start, end = end, end+segmentSize {
+		if end > len(src) {
+			end = len(src)
+		}
+		waitGroup.Add(1)
+		go func(start, end int) {
+			defer waitGroup.Done()
+			xorCtrBlockKeyStream(block, iv, offset+int64(start), dst[start:end], src[start:end])
+		}(start, end)
+	}
+	waitGroup.Wait()
+}
@@ -0,0 +1,89 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"os"
+	"testing"
+)
+
+func TestXorCtrBlockKeyStreamParallel(t *testing.T) {
+	block, err := aes.NewCipher(testKeyBytes(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := testPattern(16)
+	tests := []struct {
+		name        string
+		offset      int64
+		size        int
+		parallelism int
+	}{
+		{"below the minimum size", 0, PARALLEL_KEYSTREAM_MIN_SIZE - 1, 8},
+		{"one goroutine", 0, PARALLEL_KEYSTREAM_MIN_SIZE, 1},
+		{"no parallelism", 5, PARALLEL_KEYSTREAM_MIN_SIZE, 0},
+		{"minimum size", 0, PARALLEL_KEYSTREAM_MIN_SIZE, 4},
+		{"unaligned offset", 7, PARALLEL_KEYSTREAM_MIN_SIZE + 3, 4},
+		{"unaligned size", 16, 3*PARALLEL_KEYSTREAM_MIN_SIZE + 5, 3},
+		// segments are never smaller than PARALLEL_KEYSTREAM_SEGMENT_SIZE
+		{"more goroutines than segments", 1<<40 + 9, PARALLEL_KEYSTREAM_MIN_SIZE + 1, 64},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := testRandomBytes(test.size, 1)
+			want := make([]byte, test.size)
+			xorCtrBlockKeyStream(block, iv, test.offset, want, src)
+			got := make([]byte, test.size)
+			xorCtrBlockKeyStreamParallel(block, iv, test.offset, got, src, test.parallelism)
+			if !bytes.Equal(got, want) {
+				t.Fatal("got another keystream than the one of a single goroutine")
+			}
+			// in place like the reads of EncFile
+			xorCtrBlockKeyStreamParallel(block, iv, test.offset, got, got, test.parallelism)
+			if !bytes.Equal(got, src) {
+				t.Fatal("decrypted other contents")
+			}
+		})
+	}
+}
+
+func TestKeystreamParallelism(t *testing.T) {
+	data := testRandomBytes(3*PARALLEL_KEYSTREAM_MIN_SIZE+11, 2)
+	tests := []struct {
+		name        string
+		parallelism int
+		subkeys     bool
+	}{
+		{"no parallelism", 0, false},
+		{"parallel", 4, false},
+		{"parallel subkeys", 4, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := NewEncryptionMasterKey(testKeyBytes(1))
+			key.WithSubkeys(test.subkeys)
+			encFs, base := newTestEncFs(key)
+			encFs.WithKeystreamParallelism(test.parallelism)
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a large unaligned write across segments
+			patch := testRandomBytes(PARALLEL_KEYSTREAM_MIN_SIZE+7, 3)
+			if _, err := f.WriteAt(patch, 13); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want := append([]byte(nil), data...)
+			copy(want[13:], patch)
+			checkTestFile(t, encFs, "/file", want)
+
+			// the contents are the ones encrypted without parallelism
+			serial := NewEncFsWithBackend(key, base).(*EncFs)
+			checkTestFile(t, serial, "/file", want)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package encfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -17,6 +18,8 @@ import (
 const LOCAL_MINI_KMS_ADDRESS = "LOCAL_MINI_KMS_ADDRESS"
 const ENCRYPTED_ENCRYPTION_MASTER_KEY = "ENCRYPTED_ENCRYPTION_MASTER_KEY"
 
+const KMS_DEFAULT_TIMEOUT = 5 * time.Second
+
 type MultiViewValue struct {
 	ValueHex    string `json:"value_hex"`
 	ValueBase64 string `json:"value_base64"`
@@ -27,28 +30,114 @@ type EncryptRequest struct {
 }
 
 var cachedcEncryptionMasterKey *EncryptionMasterKey = nil
+var cachedcEncryptionMasterKeyTime time.Time
+var cachedcEncryptionMasterKeyTtl time.Duration
 var cachedcEncryptionMasterKeyLock sync.Mutex
 
+// GetCachedEncryptionMasterKey returns the key decrypted by GetEncryptionMasterKey, it is decrypted again when the
+// TTL set by SetCachedEncryptionMasterKeyTtl has passed, file systems keep the key they were created with
 func GetCachedEncryptionMasterKey() (*EncryptionMasterKey, error) {
+	return GetCachedEncryptionMasterKeyWithContext(context.Background())
+}
+
+// GetCachedEncryptionMasterKeyWithContext is GetCachedEncryptionMasterKey with ctx passed to the key provider
+func GetCachedEncryptionMasterKeyWithContext(ctx context.Context) (*EncryptionMasterKey, error) {
 	cachedcEncryptionMasterKeyLock.Lock()
 	defer cachedcEncryptionMasterKeyLock.Unlock()
+	if cachedcEncryptionMasterKey != nil && cachedcEncryptionMasterKeyTtl > 0 &&
+		time.Since(cachedcEncryptionMasterKeyTime) >= cachedcEncryptionMasterKeyTtl {
+		cachedcEncryptionMasterKey = nil
+	}
+	if metricsCollector := getPackageMetricsCollector(); metricsCollector != nil {
+		addCacheRequest(metricsCollector, METRIC_CACHE_MASTER_KEY, cachedcEncryptionMasterKey != nil)
+	}
 	if cachedcEncryptionMasterKey == nil {
 		var err error
-		cachedcEncryptionMasterKey, err = GetEncryptionMasterKey()
+		cachedcEncryptionMasterKey, err = GetEncryptionMasterKeyWithContext(ctx)
 		if err != nil {
 			return nil, err
 		}
+		cachedcEncryptionMasterKeyTime = time.Now()
 	}
 	return cachedcEncryptionMasterKey, nil
 }
 
+// SetCachedEncryptionMasterKeyTtl limits how long GetCachedEncryptionMasterKey keeps the key, 0 keeps it forever
+func SetCachedEncryptionMasterKeyTtl(ttl time.Duration) {
+	cachedcEncryptionMasterKeyLock.Lock()
+	defer cachedcEncryptionMasterKeyLock.Unlock()
+	cachedcEncryptionMasterKeyTtl = ttl
+}
+
+// ResetCachedEncryptionMasterKey drops the cached key, the next GetCachedEncryptionMasterKey decrypts it again
+func ResetCachedEncryptionMasterKey() {
+	cachedcEncryptionMasterKeyLock.Lock()
+	defer cachedcEncryptionMasterKeyLock.Unlock()
+	cachedcEncryptionMasterKey = nil
+}
+
+// RefreshCachedEncryptionMasterKey decrypts the key again and replaces the cached key, the cached key is kept
+// when decryption fails so a KMS outage does not drop a working key
+func RefreshCachedEncryptionMasterKey() (*EncryptionMasterKey, error) {
+	return RefreshCachedEncryptionMasterKeyWithContext(context.Background())
+}
+
+func RefreshCachedEncryptionMasterKeyWithContext(ctx context.Context) (*EncryptionMasterKey, error) {
+	key, err := GetEncryptionMasterKeyWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cachedcEncryptionMasterKeyLock.Lock()
+	defer cachedcEncryptionMasterKeyLock.Unlock()
+	cachedcEncryptionMasterKey = key
+	cachedcEncryptionMasterKeyTime = time.Now()
+	return key, nil
+}
+
+// StartCachedEncryptionMasterKeyRefresh refreshes the cached key every interval in the background so rotated KMS
+// keys are picked up without restarting, onRefresh is called with every refreshed key or error when not nil,
+// the returned func stops refreshing
+func StartCachedEncryptionMasterKeyRefresh(interval time.Duration, onRefresh func(*EncryptionMasterKey, error)) func() {
+	stopCh := make(chan struct{})
+	stopOnce := &sync.Once{}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				key, err := RefreshCachedEncryptionMasterKey()
+				if err != nil {
+					getPackageLogger().Warn("refresh of the cached encryption master key failed, the cached key is kept",
+						"error", err)
+				}
+				if onRefresh != nil {
+					onRefresh(key, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		stopOnce.Do(func() {
+			close(stopCh)
+		})
+	}
+}
+
 func GetEncryptionMasterKey() (*EncryptionMasterKey, error) {
+	return GetEncryptionMasterKeyWithContext(context.Background())
+}
+
+// GetEncryptionMasterKeyWithContext decrypts ENCRYPTED_ENCRYPTION_MASTER_KEY, ctx cancels the KMS request
+func GetEncryptionMasterKeyWithContext(ctx context.Context) (*EncryptionMasterKey, error) {
 	encryptedEncryptionMasterKey := os.Getenv(ENCRYPTED_ENCRYPTION_MASTER_KEY)
 	if encryptedEncryptionMasterKey == "" {
-		fmt.Println("[ERROR] encrypted encryption master key is not present")
+		getPackageLogger().Error("encrypted encryption master key is not present")
 		return nil, errors.New("encrypted encryption master key is not present")
 	}
-	key, err := DecryptBytes(encryptedEncryptionMasterKey)
+	key, err := DecryptKeyWithContext(ctx, encryptedEncryptionMasterKey)
 	if err != nil {
 		return nil, err
 	}
@@ -56,16 +145,25 @@ func GetEncryptionMasterKey() (*EncryptionMasterKey, error) {
 }
 
 func DecryptBytes(encryptedValue string) ([]byte, error) {
+	return DecryptBytesWithContext(context.Background(), encryptedValue)
+}
+
+func DecryptBytesWithContext(ctx context.Context, encryptedValue string) ([]byte, error) {
 	localMiniKmsAddress := os.Getenv(LOCAL_MINI_KMS_ADDRESS)
 	if localMiniKmsAddress == "" {
 		localMiniKmsAddress = "127.0.0.1:5567"
 	}
-	if !strings.HasPrefix(strings.ToLower(localMiniKmsAddress), "http://") {
-		localMiniKmsAddress = fmt.Sprintf("http://%s", localMiniKmsAddress)
+	_, tlsConfig, err := getLocalMiniKmsHttpClient()
+	if err != nil {
+		return nil, err
 	}
-	multiViewValue, err := Decrypt(localMiniKmsAddress, encryptedValue)
+	localMiniKmsAddress, err = localMiniKmsEndpoint(localMiniKmsAddress, tlsConfig != nil)
 	if err != nil {
-		fmt.Println("[ERROR] Decrypt from", localMiniKmsAddress, "failed, error:", err)
+		return nil, err
+	}
+	multiViewValue, err := DecryptWithContext(ctx, localMiniKmsAddress, encryptedValue)
+	if err != nil {
+		getPackageLogger().Error("decrypt from local mini KMS failed", "address", localMiniKmsAddress, "error", err)
 		return nil, err
 	}
 	valueBytes, err := hex.DecodeString(multiViewValue.ValueHex)
@@ -76,6 +174,23 @@ func DecryptBytes(encryptedValue string) ([]byte, error) {
 }
 
 func Decrypt(endpoint, encryptedValue string) (*MultiViewValue, error) {
+	return DecryptWithContext(context.Background(), endpoint, encryptedValue)
+}
+
+// DecryptWithContext decrypts by the local mini KMS at endpoint with the TLS config of SetLocalMiniKmsTlsConfig,
+// the request is cancelled with ctx, each attempt times out after KMS_DEFAULT_TIMEOUT when ctx has no deadline
+// and transient failures are retried by SetKmsRetryPolicy
+func DecryptWithContext(ctx context.Context, endpoint, encryptedValue string) (*MultiViewValue, error) {
+	var multiViewValue *MultiViewValue
+	err := callKmsWithRetry(ctx, func() error {
+		var err error
+		multiViewValue, err = decryptOnce(ctx, endpoint, encryptedValue)
+		return err
+	})
+	return multiViewValue, err
+}
+
+func decryptOnce(ctx context.Context, endpoint, encryptedValue string) (*MultiViewValue, error) {
 	encryptRequest := EncryptRequest{
 		EncryptedValue: encryptedValue,
 	}
@@ -84,15 +199,33 @@ func Decrypt(endpoint, encryptedValue string) (*MultiViewValue, error) {
 		return nil, err
 	}
 	encryptRequestReader := bytes.NewReader(encryptRequestBytes)
-	client := http.Client{
-		Timeout: 5 * time.Second,
+	ctx, cancel := withKmsTimeout(ctx)
+	defer cancel()
+	encryptHttpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, joinEnpointPath(endpoint, "/decrypt"), encryptRequestReader)
+	if err != nil {
+		return nil, err
+	}
+	encryptHttpRequest.Header.Set("Content-Type", "application/json")
+	authHeader, authValue, err := getLocalMiniKmsAuthHeader()
+	if err != nil {
+		return nil, err
+	}
+	if authHeader != "" {
+		encryptHttpRequest.Header.Set(authHeader, authValue)
 	}
-	encryptResponse, err := client.Post(joinEnpointPath(endpoint, "/decrypt"), "application/json", encryptRequestReader)
+	httpClient, _, err := getLocalMiniKmsHttpClient()
 	if err != nil {
 		return nil, err
 	}
+	encryptResponse, err := httpClient.Do(encryptHttpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = encryptResponse.Body.Close()
+	}()
 	if encryptResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("decrypt failed, http status: %d", encryptResponse.StatusCode)
+		return nil, &KmsHttpStatusError{Op: "decrypt", StatusCode: encryptResponse.StatusCode}
 	}
 	encryptResponseBodyBytes, err := io.ReadAll(encryptResponse.Body)
 	if err != nil {
@@ -106,6 +239,14 @@ func Decrypt(endpoint, encryptedValue string) (*MultiViewValue, error) {
 	return &multiViewValue, nil
 }
 
+// withKmsTimeout applies KMS_DEFAULT_TIMEOUT to ctx without deadline
+func withKmsTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, KMS_DEFAULT_TIMEOUT)
+}
+
 func joinEnpointPath(endpoint, path string) string {
 	endpointEndsWithSlash := strings.HasSuffix(endpoint, "/")
 	pathStartsWithSlash := strings.HasPrefix(path, "/")
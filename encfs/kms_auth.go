@@ -0,0 +1,52 @@
+package encfs
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+const LOCAL_MINI_KMS_AUTH_TOKEN = "LOCAL_MINI_KMS_AUTH_TOKEN"
+const LOCAL_MINI_KMS_AUTH_TOKEN_FILE = "LOCAL_MINI_KMS_AUTH_TOKEN_FILE"
+const LOCAL_MINI_KMS_AUTH_HEADER = "LOCAL_MINI_KMS_AUTH_HEADER"
+
+const KMS_DEFAULT_AUTH_HEADER = "Authorization"
+
+var localMiniKmsAuthHeader string
+var localMiniKmsAuthToken string
+var localMiniKmsAuthLock sync.Mutex
+
+// SetLocalMiniKmsAuthToken sends token with requests to the local mini KMS, as bearer token in the Authorization
+// header when header is empty or as is in header like X-Api-Key, an empty token restores LOCAL_MINI_KMS_AUTH_TOKEN
+func SetLocalMiniKmsAuthToken(header, token string) {
+	localMiniKmsAuthLock.Lock()
+	defer localMiniKmsAuthLock.Unlock()
+	localMiniKmsAuthHeader = header
+	localMiniKmsAuthToken = token
+}
+
+// getLocalMiniKmsAuthHeader returns the header name and value of the token, the token file is read for every
+// request so rotated tokens are picked up, an empty name means no token is configured
+func getLocalMiniKmsAuthHeader() (string, string, error) {
+	localMiniKmsAuthLock.Lock()
+	header, token := localMiniKmsAuthHeader, localMiniKmsAuthToken
+	localMiniKmsAuthLock.Unlock()
+	if token == "" {
+		header = os.Getenv(LOCAL_MINI_KMS_AUTH_HEADER)
+		token = os.Getenv(LOCAL_MINI_KMS_AUTH_TOKEN)
+		if tokenFile := os.Getenv(LOCAL_MINI_KMS_AUTH_TOKEN_FILE); token == "" && tokenFile != "" {
+			tokenBytes, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return "", "", err
+			}
+			token = strings.TrimSpace(string(tokenBytes))
+		}
+	}
+	if token == "" {
+		return "", "", nil
+	}
+	if header == "" || strings.EqualFold(header, KMS_DEFAULT_AUTH_HEADER) {
+		return KMS_DEFAULT_AUTH_HEADER, "Bearer " + token, nil
+	}
+	return header, token, nil
+}
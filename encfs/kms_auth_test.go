@@ -0,0 +1,93 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalMiniKmsAuthToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		setHeader  string
+		setToken   string
+		envHeader  string
+		envToken   string
+		envFile    string
+		wantHeader string
+		wantValue  string
+		wantErr    bool
+	}{
+		{"no token", "", "", "", "", "", "", "", false},
+		{"env token", "", "", "", "env-token", "", "Authorization", "Bearer env-token", false},
+		{"env token in header", "", "", "X-Api-Key", "env-token", "", "X-Api-Key", "env-token", false},
+		{"authorization header", "", "", "authorization", "env-token", "", "Authorization", "Bearer env-token", false},
+		{"token file", "", "", "", "", tokenFile, "Authorization", "Bearer file-token", false},
+		{"env token before file", "", "", "", "env-token", tokenFile, "Authorization", "Bearer env-token", false},
+		{"missing token file", "", "", "", "", tokenFile + ".missing", "", "", true},
+		{"set token", "", "set-token", "X-Api-Key", "env-token", "", "Authorization", "Bearer set-token", false},
+		{"set token in header", "X-Api-Key", "set-token", "", "", "", "X-Api-Key", "set-token", false},
+		// an empty set token restores the environment
+		{"set header without token", "X-Api-Key", "", "", "env-token", "", "Authorization", "Bearer env-token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetLocalMiniKmsAuthToken(test.setHeader, test.setToken)
+			defer SetLocalMiniKmsAuthToken("", "")
+			t.Setenv(LOCAL_MINI_KMS_AUTH_HEADER, test.envHeader)
+			t.Setenv(LOCAL_MINI_KMS_AUTH_TOKEN, test.envToken)
+			t.Setenv(LOCAL_MINI_KMS_AUTH_TOKEN_FILE, test.envFile)
+			SetKmsRetryPolicy(nil)
+			defer SetKmsRetryPolicy(NewDefaultKmsRetryPolicy())
+			kms := &testMiniKms{}
+			newTestMiniKms(t, kms)
+
+			_, err := DecryptBytes("encrypted value")
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("decrypted without the token file")
+				}
+				if kms.requestCount() != 0 {
+					t.Fatal("sent a request without the token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := kms.requests[0]
+			for _, header := range []string{"Authorization", "X-Api-Key"} {
+				want := ""
+				if header == test.wantHeader {
+					want = test.wantValue
+				}
+				if got := request.Header.Get(header); got != want {
+					t.Fatalf("%s: got %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalMiniKmsAuthTokenRotation(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	t.Setenv(LOCAL_MINI_KMS_AUTH_TOKEN_FILE, tokenFile)
+	kms := &testMiniKms{}
+	newTestMiniKms(t, kms)
+	// the token file is read for every request
+	for i, token := range []string{"first", "second"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecryptBytes("encrypted value"); err != nil {
+			t.Fatal(err)
+		}
+		if got := kms.requests[i].Header.Get("Authorization"); got != "Bearer "+token {
+			t.Fatalf("got %q, want bearer %s", got, token)
+		}
+	}
+}
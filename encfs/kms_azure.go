@@ -0,0 +1,75 @@
+package encfs
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const AZURE_KEY_VAULT_ACCESS_TOKEN = "AZURE_KEY_VAULT_ACCESS_TOKEN"
+
+const (
+	AZURE_KEY_VAULT_API_VERSION  = "7.4"
+	AZURE_KEY_VAULT_ALGORITHM    = "RSA-OAEP-256"
+	AZURE_METADATA_TOKEN_ADDRESS = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fvault.azure.net"
+)
+
+// AzureKeyVaultKeyProvider decrypts azurekv://vault.vault.azure.net/keys/name/version#base64url ciphertext by
+// Azure Key Vault, the access token is AZURE_KEY_VAULT_ACCESS_TOKEN or fetched from the managed identity endpoint
+type AzureKeyVaultKeyProvider struct {
+	// Algorithm defaults to AZURE_KEY_VAULT_ALGORITHM
+	Algorithm string
+	// Endpoint replaces https://vault host when set, e.g. for a private endpoint
+	Endpoint string
+	Client   *http.Client
+}
+
+type azureKeyVaultDecryptRequest struct {
+	Alg   string `json:"alg"`
+	Value string `json:"value"`
+}
+
+type azureKeyVaultDecryptResponse struct {
+	Kid   string `json:"kid"`
+	Value string `json:"value"`
+}
+
+func (p *AzureKeyVaultKeyProvider) DecryptKey(keyUri string) ([]byte, error) {
+	return p.DecryptKeyWithContext(context.Background(), keyUri)
+}
+
+func (p *AzureKeyVaultKeyProvider) DecryptKeyWithContext(ctx context.Context, keyUri string) ([]byte, error) {
+	keyName, ciphertext, err := splitKeyUri(keyUri)
+	if err != nil {
+		return nil, err
+	}
+	vaultName, keyPath, found := strings.Cut(keyName, "/")
+	if !found || vaultName == "" {
+		return nil, ErrBadKeyUri
+	}
+	accessToken := os.Getenv(AZURE_KEY_VAULT_ACCESS_TOKEN)
+	if accessToken == "" {
+		accessToken, err = getMetadataAccessToken(ctx, p.Client, AZURE_METADATA_TOKEN_ADDRESS, "Metadata", "true")
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + vaultName
+	}
+	algorithm := p.Algorithm
+	if algorithm == "" {
+		algorithm = AZURE_KEY_VAULT_ALGORITHM
+	}
+	request := azureKeyVaultDecryptRequest{Alg: algorithm, Value: ciphertext}
+	var response azureKeyVaultDecryptResponse
+	err = postKmsJson(ctx, p.Client, joinEnpointPath(endpoint, "/"+keyPath+"/decrypt?api-version="+AZURE_KEY_VAULT_API_VERSION),
+		accessToken, &request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(response.Value, "="))
+}
@@ -0,0 +1,62 @@
+package encfs
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const GCP_KMS_ACCESS_TOKEN = "GCP_KMS_ACCESS_TOKEN"
+
+const (
+	GCP_KMS_ENDPOINT           = "https://cloudkms.googleapis.com"
+	GCP_METADATA_TOKEN_ADDRESS = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GcpKmsKeyProvider decrypts gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k#base64 ciphertext by
+// Google Cloud KMS, the access token is GCP_KMS_ACCESS_TOKEN or fetched from the instance metadata server
+type GcpKmsKeyProvider struct {
+	// Endpoint defaults to GCP_KMS_ENDPOINT
+	Endpoint string
+	Client   *http.Client
+}
+
+type gcpKmsDecryptRequest struct {
+	Ciphertext string `json:"ciphertext"`
+}
+
+type gcpKmsDecryptResponse struct {
+	Plaintext string `json:"plaintext"`
+}
+
+func (p *GcpKmsKeyProvider) DecryptKey(keyUri string) ([]byte, error) {
+	return p.DecryptKeyWithContext(context.Background(), keyUri)
+}
+
+func (p *GcpKmsKeyProvider) DecryptKeyWithContext(ctx context.Context, keyUri string) ([]byte, error) {
+	keyName, ciphertext, err := splitKeyUri(keyUri)
+	if err != nil {
+		return nil, err
+	}
+	accessToken := os.Getenv(GCP_KMS_ACCESS_TOKEN)
+	if accessToken == "" {
+		accessToken, err = getMetadataAccessToken(ctx, p.Client, GCP_METADATA_TOKEN_ADDRESS, "Metadata-Flavor", "Google")
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = GCP_KMS_ENDPOINT
+	}
+	request := gcpKmsDecryptRequest{Ciphertext: ciphertext}
+	var response gcpKmsDecryptResponse
+	err = postKmsJson(ctx, p.Client, joinEnpointPath(endpoint, "/v1/"+strings.TrimPrefix(keyName, "/")+":decrypt"),
+		accessToken, &request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Plaintext)
+}
@@ -0,0 +1,190 @@
+package encfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadKeyUri = errors.New("bad key uri")
+)
+
+// KeyProvider decrypts an encrypted master key, keyUri is scheme://key reference#ciphertext
+type KeyProvider interface {
+	DecryptKey(keyUri string) ([]byte, error)
+}
+
+// ContextKeyProvider is implemented by key providers which can be cancelled by ctx
+type ContextKeyProvider interface {
+	DecryptKeyWithContext(ctx context.Context, keyUri string) ([]byte, error)
+}
+
+var keyProviders = map[string]KeyProvider{
+	"gcpkms":  &GcpKmsKeyProvider{},
+	"azurekv": &AzureKeyVaultKeyProvider{},
+}
+var keyProvidersLock sync.Mutex
+
+// RegisterKeyProvider makes ENCRYPTED_ENCRYPTION_MASTER_KEY values starting with scheme:// decrypted by keyProvider,
+// gcpkms and azurekv are registered by default, values without a registered scheme go to the local mini KMS
+func RegisterKeyProvider(scheme string, keyProvider KeyProvider) {
+	keyProvidersLock.Lock()
+	defer keyProvidersLock.Unlock()
+	if keyProvider == nil {
+		delete(keyProviders, scheme)
+		return
+	}
+	keyProviders[scheme] = keyProvider
+}
+
+func getKeyProvider(encryptedValue string) KeyProvider {
+	scheme, _, found := strings.Cut(encryptedValue, "://")
+	if !found {
+		return nil
+	}
+	keyProvidersLock.Lock()
+	defer keyProvidersLock.Unlock()
+	return keyProviders[scheme]
+}
+
+// DecryptKey decrypts encryptedValue by the key provider of its scheme or by the local mini KMS
+func DecryptKey(encryptedValue string) ([]byte, error) {
+	return DecryptKeyWithContext(context.Background(), encryptedValue)
+}
+
+// DecryptKeyWithContext is DecryptKey with ctx passed to key providers implementing ContextKeyProvider
+func DecryptKeyWithContext(ctx context.Context, encryptedValue string) (_ []byte, err error) {
+	keyProvider := getKeyProvider(encryptedValue)
+	if metricsCollector := getPackageMetricsCollector(); metricsCollector != nil {
+		provider := METRIC_KMS_PROVIDER_LOCAL
+		if keyProvider != nil {
+			provider, _, _ = strings.Cut(encryptedValue, "://")
+		}
+		defer func(start time.Time) {
+			observeSince(metricsCollector, METRIC_KMS_DECRYPT_SECONDS, start, "provider", provider,
+				"result", metricResult(&err))
+		}(time.Now())
+	}
+	if keyProvider != nil {
+		if contextKeyProvider, ok := keyProvider.(ContextKeyProvider); ok {
+			return contextKeyProvider.DecryptKeyWithContext(ctx, encryptedValue)
+		}
+		return keyProvider.DecryptKey(encryptedValue)
+	}
+	return DecryptBytesWithContext(ctx, encryptedValue)
+}
+
+// LocalMiniKmsKeyProvider decrypts by the local mini KMS at LOCAL_MINI_KMS_ADDRESS, keyUri is the encrypted value
+type LocalMiniKmsKeyProvider struct {
+}
+
+func (*LocalMiniKmsKeyProvider) DecryptKey(keyUri string) ([]byte, error) {
+	return DecryptBytes(keyUri)
+}
+
+func (*LocalMiniKmsKeyProvider) DecryptKeyWithContext(ctx context.Context, keyUri string) ([]byte, error) {
+	return DecryptBytesWithContext(ctx, keyUri)
+}
+
+// splitKeyUri splits scheme://keyName#ciphertext
+func splitKeyUri(keyUri string) (string, string, error) {
+	_, rest, found := strings.Cut(keyUri, "://")
+	if !found {
+		return "", "", fmt.Errorf("%w: %s", ErrBadKeyUri, keyUri)
+	}
+	hashIndex := strings.LastIndex(rest, "#")
+	if hashIndex <= 0 || hashIndex == len(rest)-1 {
+		return "", "", fmt.Errorf("%w: missing key name or ciphertext", ErrBadKeyUri)
+	}
+	return rest[:hashIndex], rest[hashIndex+1:], nil
+}
+
+func getKmsHttpClient(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// postKmsJson posts request as JSON with the bearer token and decodes the JSON response
+func postKmsJson(ctx context.Context, client *http.Client, url, accessToken string, request, response interface{}) error {
+	return callKmsWithRetry(ctx, func() error {
+		return postKmsJsonOnce(ctx, client, url, accessToken, request, response)
+	})
+}
+
+func postKmsJsonOnce(ctx context.Context, client *http.Client, url, accessToken string, request, response interface{}) error {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withKmsTimeout(ctx)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(requestBytes))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Authorization", "Bearer "+accessToken)
+	httpResponse, err := getKmsHttpClient(client).Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = httpResponse.Body.Close()
+	}()
+	if httpResponse.StatusCode != 200 {
+		return &KmsHttpStatusError{Op: "decrypt", StatusCode: httpResponse.StatusCode}
+	}
+	responseBytes, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(responseBytes, response)
+}
+
+// getMetadataAccessToken fetches an access token from the metadata service of a cloud instance
+func getMetadataAccessToken(ctx context.Context, client *http.Client, url string, header string, headerValue string) (string, error) {
+	var accessToken string
+	err := callKmsWithRetry(ctx, func() error {
+		var err error
+		accessToken, err = getMetadataAccessTokenOnce(ctx, client, url, header, headerValue)
+		return err
+	})
+	return accessToken, err
+}
+
+func getMetadataAccessTokenOnce(ctx context.Context, client *http.Client, url string, header string, headerValue string) (string, error) {
+	ctx, cancel := withKmsTimeout(ctx)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	httpRequest.Header.Set(header, headerValue)
+	httpResponse, err := getKmsHttpClient(client).Do(httpRequest)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = httpResponse.Body.Close()
+	}()
+	if httpResponse.StatusCode != 200 {
+		return "", &KmsHttpStatusError{Op: "get access token", StatusCode: httpResponse.StatusCode}
+	}
+	var accessToken struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(httpResponse.Body).Decode(&accessToken); err != nil {
+		return "", err
+	}
+	return accessToken.AccessToken, nil
+}
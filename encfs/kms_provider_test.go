@@ -0,0 +1,228 @@
+package encfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testKeyProvider returns key for every key uri and records the key uris
+type testKeyProvider struct {
+	key     []byte
+	keyUris []string
+	ctx     context.Context
+}
+
+func (p *testKeyProvider) DecryptKey(keyUri string) ([]byte, error) {
+	p.keyUris = append(p.keyUris, keyUri)
+	return p.key, nil
+}
+
+// testContextKeyProvider also implements ContextKeyProvider
+type testContextKeyProvider struct {
+	testKeyProvider
+}
+
+func (p *testContextKeyProvider) DecryptKeyWithContext(ctx context.Context, keyUri string) ([]byte, error) {
+	p.ctx = ctx
+	return p.DecryptKey(keyUri)
+}
+
+type testContextKey struct{}
+
+func TestRegisterKeyProvider(t *testing.T) {
+	plainProvider := &testKeyProvider{key: testKeyBytes(1)}
+	contextProvider := &testContextKeyProvider{testKeyProvider{key: testKeyBytes(2)}}
+	RegisterKeyProvider("test-plain", plainProvider)
+	RegisterKeyProvider("test-context", contextProvider)
+	defer RegisterKeyProvider("test-plain", nil)
+	defer RegisterKeyProvider("test-context", nil)
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "value")
+	tests := []struct {
+		keyUri   string
+		provider *testKeyProvider
+	}{
+		{"test-plain://key#ciphertext", plainProvider},
+		{"test-context://key#ciphertext", &contextProvider.testKeyProvider},
+	}
+	for _, test := range tests {
+		key, err := DecryptKeyWithContext(ctx, test.keyUri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, test.provider.key) {
+			t.Fatalf("%s: decrypted by another provider", test.keyUri)
+		}
+		if len(test.provider.keyUris) != 1 || test.provider.keyUris[0] != test.keyUri {
+			t.Fatalf("%s: provider got %q", test.keyUri, test.provider.keyUris)
+		}
+	}
+	if contextProvider.ctx == nil || contextProvider.ctx.Value(testContextKey{}) != "value" {
+		t.Fatal("context key provider did not get the context")
+	}
+	if getKeyProvider("gcpkms://key#ciphertext") == nil || getKeyProvider("azurekv://key#ciphertext") == nil {
+		t.Fatal("default providers are not registered")
+	}
+	RegisterKeyProvider("test-plain", nil)
+	if getKeyProvider("test-plain://key#ciphertext") != nil {
+		t.Fatal("provider kept after unregistering")
+	}
+}
+
+func TestSplitKeyUri(t *testing.T) {
+	tests := []struct {
+		keyUri         string
+		wantKeyName    string
+		wantCiphertext string
+		wantErr        error
+	}{
+		{"gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k#YWJj", "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+			"YWJj", nil},
+		{"azurekv://v.vault.azure.net/keys/k/1#a#b", "v.vault.azure.net/keys/k/1#a", "b", nil},
+		{"no scheme#YWJj", "", "", ErrBadKeyUri},
+		{"gcpkms://key", "", "", ErrBadKeyUri},
+		{"gcpkms://#YWJj", "", "", ErrBadKeyUri},
+		{"gcpkms://key#", "", "", ErrBadKeyUri},
+	}
+	for _, test := range tests {
+		keyName, ciphertext, err := splitKeyUri(test.keyUri)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.keyUri, err, test.wantErr)
+		}
+		if keyName != test.wantKeyName || ciphertext != test.wantCiphertext {
+			t.Fatalf("%s: got %q and %q", test.keyUri, keyName, ciphertext)
+		}
+	}
+}
+
+// testCloudKms answers decrypt requests like a cloud KMS, requests are recorded
+type testCloudKms struct {
+	statusCode int
+	response   interface{}
+	requests   []*http.Request
+	bodies     []map[string]string
+}
+
+func (kms *testCloudKms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	kms.requests = append(kms.requests, r)
+	kms.bodies = append(kms.bodies, body)
+	if kms.statusCode != 0 {
+		w.WriteHeader(kms.statusCode)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(kms.response)
+}
+
+func TestGcpKmsKeyProvider(t *testing.T) {
+	key := testKeyBytes(1)
+	tests := []struct {
+		name       string
+		keyUri     string
+		statusCode int
+		plaintext  string
+		wantErr    bool
+	}{
+		{"decrypt", "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k#Y2lwaGVydGV4dA==", 0,
+			base64.StdEncoding.EncodeToString(key), false},
+		{"denied", "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k#Y2lwaGVydGV4dA==",
+			http.StatusForbidden, "", true},
+		{"bad plaintext", "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k#Y2lwaGVydGV4dA==", 0,
+			"not base64!", true},
+		{"bad key uri", "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k", 0, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(GCP_KMS_ACCESS_TOKEN, "token")
+			kms := &testCloudKms{statusCode: test.statusCode, response: map[string]string{"plaintext": test.plaintext}}
+			server := httptest.NewServer(kms)
+			defer server.Close()
+
+			provider := &GcpKmsKeyProvider{Endpoint: server.URL, Client: server.Client()}
+			got, err := provider.DecryptKey(test.keyUri)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, key) {
+				t.Fatal("decrypted another key")
+			}
+			if len(kms.requests) == 0 {
+				return
+			}
+			// a denied request is not retried
+			if len(kms.requests) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(kms.requests))
+			}
+			request := kms.requests[0]
+			if request.URL.Path != "/v1/projects/p/locations/l/keyRings/r/cryptoKeys/k:decrypt" {
+				t.Fatalf("posted to %s", request.URL.Path)
+			}
+			if request.Header.Get("Authorization") != "Bearer token" {
+				t.Fatalf("sent authorization %q", request.Header.Get("Authorization"))
+			}
+			if kms.bodies[0]["ciphertext"] != "Y2lwaGVydGV4dA==" {
+				t.Fatalf("sent %q", kms.bodies[0])
+			}
+		})
+	}
+}
+
+func TestAzureKeyVaultKeyProvider(t *testing.T) {
+	key := testKeyBytes(1)
+	tests := []struct {
+		name       string
+		algorithm  string
+		keyUri     string
+		statusCode int
+		wantAlg    string
+		wantErr    bool
+	}{
+		{"decrypt", "", "azurekv://v.vault.azure.net/keys/k/1#Y2lwaGVydGV4dA", 0, AZURE_KEY_VAULT_ALGORITHM, false},
+		{"algorithm", "RSA-OAEP", "azurekv://v.vault.azure.net/keys/k/1#Y2lwaGVydGV4dA", 0, "RSA-OAEP", false},
+		{"unauthorized", "", "azurekv://v.vault.azure.net/keys/k/1#Y2lwaGVydGV4dA", http.StatusUnauthorized, "", true},
+		{"no key path", "", "azurekv://v.vault.azure.net#Y2lwaGVydGV4dA", 0, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(AZURE_KEY_VAULT_ACCESS_TOKEN, "token")
+			// Key Vault answers base64url with or without padding
+			kms := &testCloudKms{statusCode: test.statusCode, response: map[string]string{
+				"kid":   "https://v.vault.azure.net/keys/k/1",
+				"value": base64.URLEncoding.EncodeToString(key),
+			}}
+			server := httptest.NewServer(kms)
+			defer server.Close()
+
+			provider := &AzureKeyVaultKeyProvider{Algorithm: test.algorithm, Endpoint: server.URL,
+				Client: server.Client()}
+			got, err := provider.DecryptKey(test.keyUri)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got %v, want error %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(got, key) {
+				t.Fatal("decrypted another key")
+			}
+			request := kms.requests[0]
+			if request.URL.Path != "/keys/k/1/decrypt" ||
+				request.URL.Query().Get("api-version") != AZURE_KEY_VAULT_API_VERSION {
+				t.Fatalf("posted to %s", request.URL)
+			}
+			if request.Header.Get("Authorization") != "Bearer token" {
+				t.Fatalf("sent authorization %q", request.Header.Get("Authorization"))
+			}
+			if kms.bodies[0]["alg"] != test.wantAlg || kms.bodies[0]["value"] != "Y2lwaGVydGV4dA" {
+				t.Fatalf("sent %q", kms.bodies[0])
+			}
+		})
+	}
+}
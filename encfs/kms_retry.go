@@ -0,0 +1,79 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KmsHttpStatusError is returned when a KMS answers with a status other than 200
+type KmsHttpStatusError struct {
+	Op         string
+	StatusCode int
+}
+
+func (e *KmsHttpStatusError) Error() string {
+	return fmt.Sprintf("%s failed, http status: %d", e.Op, e.StatusCode)
+}
+
+var kmsRetryPolicy = NewDefaultKmsRetryPolicy()
+var kmsRetryPolicyLock sync.Mutex
+
+// NewDefaultKmsRetryPolicy retries up to 5 attempts within about 3 seconds, long enough to ride out a restarting
+// mini KMS during startup
+func NewDefaultKmsRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}
+}
+
+// SetKmsRetryPolicy sets how KMS and access token requests are retried, decryption is idempotent so RetryWrites
+// is ignored, nil disables retrying
+func SetKmsRetryPolicy(retryPolicy *RetryPolicy) {
+	kmsRetryPolicyLock.Lock()
+	defer kmsRetryPolicyLock.Unlock()
+	kmsRetryPolicy = retryPolicy
+}
+
+func getKmsRetryPolicy() *RetryPolicy {
+	kmsRetryPolicyLock.Lock()
+	defer kmsRetryPolicyLock.Unlock()
+	return kmsRetryPolicy
+}
+
+// IsTransientKmsError reports transient network errors, server errors and throttling of a KMS
+func IsTransientKmsError(err error) bool {
+	var kmsHttpStatusError *KmsHttpStatusError
+	if errors.As(err, &kmsHttpStatusError) {
+		return kmsHttpStatusError.StatusCode >= 500 || kmsHttpStatusError.StatusCode == http.StatusTooManyRequests
+	}
+	return IsTransientError(err)
+}
+
+// callKmsWithRetry calls fn until it succeeds, fails permanently or ctx is done
+func callKmsWithRetry(ctx context.Context, fn func() error) error {
+	err := fn()
+	retryPolicy := getKmsRetryPolicy()
+	if err == nil || retryPolicy == nil {
+		return err
+	}
+	for attempt := 1; attempt < retryPolicy.MaxAttempts; attempt++ {
+		if retryPolicy.IsRetryable != nil && !retryPolicy.IsRetryable(err) ||
+			retryPolicy.IsRetryable == nil && !IsTransientKmsError(err) {
+			return err
+		}
+		if ctx.Err() != nil || sleepWithContext(ctx, retryPolicy.backoff(attempt)) != nil {
+			return err
+		}
+		getPackageLogger().Debug("retrying KMS request", "attempt", attempt+1, "error", err)
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKmsRetry(t *testing.T) {
+	retryPolicy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	tests := []struct {
+		name           string
+		retryPolicy    *RetryPolicy
+		statusCodes    []int
+		wantRequests   int
+		wantStatusCode int
+	}{
+		{"ok", retryPolicy, nil, 1, 0},
+		{"unavailable", retryPolicy, []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, 3, 0},
+		{"throttled", retryPolicy, []int{http.StatusTooManyRequests}, 2, 0},
+		{"denied", retryPolicy, []int{http.StatusForbidden}, 1, http.StatusForbidden},
+		{"attempts exhausted", retryPolicy, []int{500, 500, 500, 500}, 3, 500},
+		{"retry disabled", nil, []int{http.StatusServiceUnavailable}, 1, http.StatusServiceUnavailable},
+		{"retryable override", &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond,
+			IsRetryable: func(err error) bool { return true }}, []int{http.StatusForbidden}, 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetKmsRetryPolicy(test.retryPolicy)
+			defer SetKmsRetryPolicy(NewDefaultKmsRetryPolicy())
+			kms := &testMiniKms{statusCodes: test.statusCodes}
+			newTestMiniKms(t, kms)
+
+			key, err := DecryptBytesWithContext(context.Background(), "encrypted value")
+			var kmsHttpStatusError *KmsHttpStatusError
+			if test.wantStatusCode == 0 && err != nil ||
+				test.wantStatusCode != 0 && (!errors.As(err, &kmsHttpStatusError) ||
+					kmsHttpStatusError.StatusCode != test.wantStatusCode) {
+				t.Fatalf("got %v, want status %d", err, test.wantStatusCode)
+			}
+			if err == nil && string(key) != string(testKeyBytes(1)) {
+				t.Fatal("got another key")
+			}
+			if kms.requestCount() != test.wantRequests {
+				t.Fatalf("sent %d requests, want %d", kms.requestCount(), test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestKmsRetryStopsWithContext(t *testing.T) {
+	SetKmsRetryPolicy(&RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	defer SetKmsRetryPolicy(NewDefaultKmsRetryPolicy())
+	kms := &testMiniKms{statusCodes: []int{http.StatusServiceUnavailable}}
+	newTestMiniKms(t, kms)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := DecryptBytesWithContext(ctx, "encrypted value"); err == nil {
+		t.Fatal("decrypted while the KMS was unavailable")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("backoff outlived the context, took %v", elapsed)
+	}
+	if kms.requestCount() != 1 {
+		t.Fatalf("sent %d requests, want 1", kms.requestCount())
+	}
+}
+
+func TestIsTransientKmsError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&KmsHttpStatusError{Op: "decrypt", StatusCode: 500}, true},
+		{&KmsHttpStatusError{Op: "decrypt", StatusCode: 503}, true},
+		{&KmsHttpStatusError{Op: "decrypt", StatusCode: 429}, true},
+		{fmt.Errorf("wrapped: %w", &KmsHttpStatusError{Op: "decrypt", StatusCode: 502}), true},
+		{&KmsHttpStatusError{Op: "decrypt", StatusCode: 400}, false},
+		{&KmsHttpStatusError{Op: "decrypt", StatusCode: 401}, false},
+		{syscall.ECONNREFUSED, true},
+		{syscall.ECONNRESET, true},
+		{ErrBadKeyUri, false},
+	}
+	for _, test := range tests {
+		if got := IsTransientKmsError(test.err); got != test.want {
+			t.Fatalf("%v: got %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package encfs
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRotatingKeyProvider returns another key on every call, or err when set
+type testRotatingKeyProvider struct {
+	mutex *sync.Mutex
+	calls int
+	err   error
+}
+
+func (p *testRotatingKeyProvider) DecryptKey(keyUri string) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.calls++
+	return testKeyBytes(byte(p.calls)), nil
+}
+
+func (p *testRotatingKeyProvider) setErr(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.err = err
+}
+
+// useTestRotatingKeyProvider makes the master key decrypted by a new testRotatingKeyProvider until the test ends
+func useTestRotatingKeyProvider(t *testing.T) *testRotatingKeyProvider {
+	provider := &testRotatingKeyProvider{mutex: &sync.Mutex{}}
+	RegisterKeyProvider("test-rotating", provider)
+	t.Setenv(ENCRYPTED_ENCRYPTION_MASTER_KEY, "test-rotating://key#ciphertext")
+	ResetCachedEncryptionMasterKey()
+	t.Cleanup(func() {
+		RegisterKeyProvider("test-rotating", nil)
+		SetCachedEncryptionMasterKeyTtl(0)
+		ResetCachedEncryptionMasterKey()
+	})
+	return provider
+}
+
+func TestCachedEncryptionMasterKey(t *testing.T) {
+	errKms := errors.New("kms is down")
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		action  func(provider *testRotatingKeyProvider) error
+		wantKey byte
+		wantErr error
+	}{
+		{"cached", 0, func(provider *testRotatingKeyProvider) error { return nil }, 1, nil},
+		{"ttl not passed", time.Hour, func(provider *testRotatingKeyProvider) error { return nil }, 1, nil},
+		{"ttl passed", time.Millisecond, func(provider *testRotatingKeyProvider) error {
+			time.Sleep(2 * time.Millisecond)
+			return nil
+		}, 2, nil},
+		{"reset", 0, func(provider *testRotatingKeyProvider) error {
+			ResetCachedEncryptionMasterKey()
+			return nil
+		}, 2, nil},
+		{"refresh", 0, func(provider *testRotatingKeyProvider) error {
+			_, err := RefreshCachedEncryptionMasterKey()
+			return err
+		}, 2, nil},
+		// a failed refresh keeps the working key
+		{"failed refresh", 0, func(provider *testRotatingKeyProvider) error {
+			provider.setErr(errKms)
+			_, err := RefreshCachedEncryptionMasterKey()
+			return err
+		}, 1, errKms},
+		{"failed after reset", 0, func(provider *testRotatingKeyProvider) error {
+			provider.setErr(errKms)
+			ResetCachedEncryptionMasterKey()
+			return nil
+		}, 0, errKms},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := useTestRotatingKeyProvider(t)
+			SetCachedEncryptionMasterKeyTtl(test.ttl)
+			first, err := GetCachedEncryptionMasterKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.KeyId() != NewEncryptionMasterKey(testKeyBytes(1)).KeyId() {
+				t.Fatal("got another first key")
+			}
+			actionErr := test.action(provider)
+			key, err := GetCachedEncryptionMasterKey()
+			if !errors.Is(actionErr, test.wantErr) && !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v and %v, want %v", actionErr, err, test.wantErr)
+			}
+			if test.wantKey == 0 {
+				if key != nil {
+					t.Fatal("got a key from a failed KMS")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.KeyId() != NewEncryptionMasterKey(testKeyBytes(test.wantKey)).KeyId() {
+				t.Fatalf("got another key than key %d", test.wantKey)
+			}
+		})
+	}
+}
+
+func TestCachedEncryptionMasterKeyBackgroundRefresh(t *testing.T) {
+	provider := useTestRotatingKeyProvider(t)
+	if _, err := GetCachedEncryptionMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := make(chan *EncryptionMasterKey, 16)
+	stop := StartCachedEncryptionMasterKeyRefresh(time.Millisecond, func(key *EncryptionMasterKey, err error) {
+		if err == nil {
+			select {
+			case refreshed <- key:
+			default:
+			}
+		}
+	})
+	var key *EncryptionMasterKey
+	select {
+	case key = <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("key not refreshed")
+	}
+	stop()
+	stop()
+	provider.setErr(errors.New("stopped"))
+	cached, err := GetCachedEncryptionMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyId() == NewEncryptionMasterKey(testKeyBytes(1)).KeyId() {
+		t.Fatal("refreshed to the same key")
+	}
+	if cached.KeyId() == NewEncryptionMasterKey(testKeyBytes(1)).KeyId() {
+		t.Fatal("cached key not refreshed")
+	}
+}
+
+// testMiniKms answers decrypt requests like the local mini KMS, the key is testKeyBytes(1), statusCodes are
+// answered to the first requests
+type testMiniKms struct {
+	mutex       sync.Mutex
+	statusCodes []int
+	delay       time.Duration
+	requests    []*http.Request
+	bodies      []EncryptRequest
+}
+
+func (kms *testMiniKms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body EncryptRequest
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	kms.mutex.Lock()
+	kms.requests = append(kms.requests, r)
+	kms.bodies = append(kms.bodies, body)
+	statusCode := 0
+	if len(kms.statusCodes) > 0 {
+		statusCode, kms.statusCodes = kms.statusCodes[0], kms.statusCodes[1:]
+	}
+	kms.mutex.Unlock()
+	if kms.delay > 0 {
+		select {
+		case <-time.After(kms.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if statusCode != 0 {
+		w.WriteHeader(statusCode)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&MultiViewValue{ValueHex: hex.EncodeToString(testKeyBytes(1))})
+}
+
+func (kms *testMiniKms) requestCount() int {
+	kms.mutex.Lock()
+	defer kms.mutex.Unlock()
+	return len(kms.requests)
+}
+
+// newTestMiniKms starts kms and points LOCAL_MINI_KMS_ADDRESS at it until the test ends
+func newTestMiniKms(t *testing.T, kms *testMiniKms) *httptest.Server {
+	server := httptest.NewServer(kms)
+	t.Cleanup(server.Close)
+	t.Setenv(LOCAL_MINI_KMS_ADDRESS, server.URL)
+	return server
+}
+
+func TestDecryptWithContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		ctx         func() (context.Context, context.CancelFunc)
+		wantErr     error
+		maxDuration time.Duration
+	}{
+		{"decrypt", 0, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, nil, 5 * time.Second},
+		{"cancelled", 0, func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled, time.Second},
+		// the deadline of ctx replaces KMS_DEFAULT_TIMEOUT and stops retrying
+		{"deadline", time.Minute, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		}, context.DeadlineExceeded, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kms := &testMiniKms{delay: test.delay}
+			newTestMiniKms(t, kms)
+			t.Setenv(ENCRYPTED_ENCRYPTION_MASTER_KEY, "encrypted value")
+			ctx, cancel := test.ctx()
+			defer cancel()
+
+			start := time.Now()
+			key, err := GetEncryptionMasterKeyWithContext(ctx)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > test.maxDuration {
+				t.Fatalf("took %v", elapsed)
+			}
+			if err != nil {
+				return
+			}
+			if key.KeyId() != NewEncryptionMasterKey(testKeyBytes(1)).KeyId() {
+				t.Fatal("got another key")
+			}
+			if kms.requestCount() != 1 || kms.bodies[0].EncryptedValue != "encrypted value" {
+				t.Fatalf("sent %q", kms.bodies)
+			}
+		})
+	}
+}
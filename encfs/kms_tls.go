@@ -0,0 +1,116 @@
+package encfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const LOCAL_MINI_KMS_CA_FILE = "LOCAL_MINI_KMS_CA_FILE"
+const LOCAL_MINI_KMS_CLIENT_CERT_FILE = "LOCAL_MINI_KMS_CLIENT_CERT_FILE"
+const LOCAL_MINI_KMS_CLIENT_KEY_FILE = "LOCAL_MINI_KMS_CLIENT_KEY_FILE"
+
+var (
+	ErrKmsBadCaFile          = errors.New("no certificate found in KMS CA file")
+	ErrKmsInsecureEndpoint   = errors.New("KMS endpoint is not https while TLS is configured")
+	ErrKmsClientCertRequired = errors.New("KMS client certificate and key files must be set together")
+)
+
+var localMiniKmsTlsConfig *tls.Config
+var localMiniKmsHttpClient *http.Client
+var localMiniKmsHttpClientFiles string
+var localMiniKmsHttpClientLock sync.Mutex
+
+// NewKmsTlsConfig trusts the PEM certificates in caFile instead of the system roots when caFile is not empty,
+// and presents the client certificate of certFile and keyFile for mTLS when they are not empty
+func NewKmsTlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caBytes, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("%w: %s", ErrKmsBadCaFile, caFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, ErrKmsClientCertRequired
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// SetLocalMiniKmsTlsConfig sets the TLS config of requests to the local mini KMS, it takes precedence over
+// LOCAL_MINI_KMS_CA_FILE, LOCAL_MINI_KMS_CLIENT_CERT_FILE and LOCAL_MINI_KMS_CLIENT_KEY_FILE, nil restores them
+func SetLocalMiniKmsTlsConfig(tlsConfig *tls.Config) {
+	localMiniKmsHttpClientLock.Lock()
+	defer localMiniKmsHttpClientLock.Unlock()
+	localMiniKmsTlsConfig = tlsConfig
+	localMiniKmsHttpClient = nil
+}
+
+// getLocalMiniKmsHttpClient returns the client for the local mini KMS, nil tls config means TLS is not configured
+// and the endpoint may be plain http
+func getLocalMiniKmsHttpClient() (*http.Client, *tls.Config, error) {
+	localMiniKmsHttpClientLock.Lock()
+	defer localMiniKmsHttpClientLock.Unlock()
+	tlsConfig := localMiniKmsTlsConfig
+	files := ""
+	if tlsConfig == nil {
+		caFile := os.Getenv(LOCAL_MINI_KMS_CA_FILE)
+		certFile := os.Getenv(LOCAL_MINI_KMS_CLIENT_CERT_FILE)
+		keyFile := os.Getenv(LOCAL_MINI_KMS_CLIENT_KEY_FILE)
+		if caFile == "" && certFile == "" && keyFile == "" {
+			return http.DefaultClient, nil, nil
+		}
+		files = caFile + "\x00" + certFile + "\x00" + keyFile
+		if localMiniKmsHttpClient != nil && localMiniKmsHttpClientFiles == files {
+			return localMiniKmsHttpClient, localMiniKmsHttpClient.Transport.(*http.Transport).TLSClientConfig, nil
+		}
+		var err error
+		tlsConfig, err = NewKmsTlsConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if localMiniKmsHttpClient != nil {
+		return localMiniKmsHttpClient, tlsConfig, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	localMiniKmsHttpClient = &http.Client{Transport: transport}
+	localMiniKmsHttpClientFiles = files
+	return localMiniKmsHttpClient, tlsConfig, nil
+}
+
+// localMiniKmsEndpoint adds the scheme to address, https when TLS is configured, an explicit http endpoint is
+// refused then so the wrapped key is never sent unauthenticated
+func localMiniKmsEndpoint(address string, tlsConfigured bool) (string, error) {
+	lowerAddress := strings.ToLower(address)
+	if strings.HasPrefix(lowerAddress, "https://") {
+		return address, nil
+	}
+	if strings.HasPrefix(lowerAddress, "http://") {
+		if tlsConfigured {
+			return "", fmt.Errorf("%w: %s", ErrKmsInsecureEndpoint, address)
+		}
+		return address, nil
+	}
+	if tlsConfigured {
+		return "https://" + address, nil
+	}
+	return "http://" + address, nil
+}
@@ -0,0 +1,201 @@
+package encfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and its key, signed by parent or self signed
+type testCertificate struct {
+	certificate *x509.Certificate
+	der         []byte
+	key         *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, commonName string, isCa bool, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, der: der, key: key}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// writeFiles writes the PEM certificate and key to dir, returning their names
+func (c *testCertificate) writeFiles(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLocalMiniKmsTls(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", true, nil)
+	serverCertificate := newTestCertificate(t, "mini kms", false, ca)
+	clientCertificate := newTestCertificate(t, "client", false, ca)
+	otherCa := newTestCertificate(t, "other ca", true, nil)
+	dir := t.TempDir()
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	otherCaFile, _ := otherCa.writeFiles(t, dir, "other-ca")
+	clientCertFile, clientKeyFile := clientCertificate.writeFiles(t, dir, "client")
+	badCaFile := filepath.Join(dir, "bad-ca.crt")
+	if err := os.WriteFile(badCaFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		requireClientCert bool
+		caFile            string
+		clientCertFile    string
+		clientKeyFile     string
+		plainAddress      bool
+		wantErr           error
+		wantFailure       bool
+	}{
+		{"tls", false, caFile, "", "", false, nil, false},
+		{"mtls", true, caFile, clientCertFile, clientKeyFile, false, nil, false},
+		{"address without scheme", false, caFile, "", "", true, nil, false},
+		{"missing client certificate", true, caFile, "", "", false, nil, true},
+		{"other ca", false, otherCaFile, "", "", false, nil, true},
+		{"bad ca file", false, badCaFile, "", "", false, ErrKmsBadCaFile, false},
+		{"client certificate without key", true, caFile, clientCertFile, "", false, ErrKmsClientCertRequired, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetKmsRetryPolicy(nil)
+			defer SetKmsRetryPolicy(NewDefaultKmsRetryPolicy())
+			kms := &testMiniKms{}
+			server := httptest.NewUnstartedServer(kms)
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCertificate.tlsCertificate()}}
+			if test.requireClientCert {
+				clientCAs := x509.NewCertPool()
+				clientCAs.AddCert(ca.certificate)
+				server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TLS.ClientCAs = clientCAs
+			}
+			server.StartTLS()
+			defer server.Close()
+			address := server.URL
+			if test.plainAddress {
+				// addresses without scheme use https once TLS is configured
+				address = server.Listener.Addr().String()
+			}
+			t.Setenv(LOCAL_MINI_KMS_ADDRESS, address)
+			t.Setenv(LOCAL_MINI_KMS_CA_FILE, test.caFile)
+			t.Setenv(LOCAL_MINI_KMS_CLIENT_CERT_FILE, test.clientCertFile)
+			t.Setenv(LOCAL_MINI_KMS_CLIENT_KEY_FILE, test.clientKeyFile)
+
+			key, err := DecryptBytes("encrypted value")
+			if test.wantFailure {
+				if err == nil {
+					t.Fatal("decrypted over an untrusted connection")
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && string(key) != string(testKeyBytes(1)) {
+				t.Fatal("got another key")
+			}
+		})
+	}
+}
+
+func TestLocalMiniKmsEndpoint(t *testing.T) {
+	tests := []struct {
+		address       string
+		tlsConfigured bool
+		want          string
+		wantErr       error
+	}{
+		{"127.0.0.1:5567", false, "http://127.0.0.1:5567", nil},
+		{"127.0.0.1:5567", true, "https://127.0.0.1:5567", nil},
+		{"http://kms:5567", false, "http://kms:5567", nil},
+		{"HTTPS://kms:5567", false, "HTTPS://kms:5567", nil},
+		{"http://kms:5567", true, "", ErrKmsInsecureEndpoint},
+	}
+	for _, test := range tests {
+		got, err := localMiniKmsEndpoint(test.address, test.tlsConfigured)
+		if !errors.Is(err, test.wantErr) || got != test.want {
+			t.Fatalf("%s, tls %t: got %q and %v, want %q and %v", test.address, test.tlsConfigured, got, err,
+				test.want, test.wantErr)
+		}
+	}
+}
+
+func TestSetLocalMiniKmsTlsConfig(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", true, nil)
+	serverCertificate := newTestCertificate(t, "mini kms", false, ca)
+	server := httptest.NewUnstartedServer(&testMiniKms{})
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCertificate.tlsCertificate()}}
+	server.StartTLS()
+	defer server.Close()
+	t.Setenv(LOCAL_MINI_KMS_ADDRESS, server.URL)
+	SetKmsRetryPolicy(nil)
+	defer SetKmsRetryPolicy(NewDefaultKmsRetryPolicy())
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.certificate)
+	SetLocalMiniKmsTlsConfig(&tls.Config{RootCAs: rootCAs})
+	if _, err := DecryptBytes("encrypted value"); err != nil {
+		t.Fatal(err)
+	}
+	// nil restores the system roots, which do not trust the test CA
+	SetLocalMiniKmsTlsConfig(nil)
+	if _, err := DecryptBytes("encrypted value"); err == nil {
+		t.Fatal("decrypted over an untrusted connection")
+	}
+}
@@ -0,0 +1,53 @@
+package encfs
+
+import (
+	"errors"
+)
+
+var (
+	ErrLockNotSupported = errors.New("file lock is not supported")
+)
+
+type fdFile interface {
+	Fd() uintptr
+}
+
+// Fd returns the descriptor of the underlying file, ^uintptr(0) when the backend file has none
+func (f *EncFile) Fd() uintptr {
+	if file, ok := f.file.(fdFile); ok {
+		return file.Fd()
+	}
+	return ^uintptr(0)
+}
+
+// Lock takes an advisory lock on the whole underlying file, shared unless exclusive, and blocks
+// until it is granted, databases like SQLite running on EncFs coordinate their writers with it
+func (f *EncFile) Lock(exclusive bool) (err error) {
+	defer f.restorePlainPath(&err)
+	if err := f.checkIsFile(); err != nil {
+		return err
+	}
+	return f.lock(exclusive, true)
+}
+
+// TryLock is Lock without blocking, false is returned when the lock is held by another handle
+func (f *EncFile) TryLock(exclusive bool) (_ bool, err error) {
+	defer f.restorePlainPath(&err)
+	if err := f.checkIsFile(); err != nil {
+		return false, err
+	}
+	err = f.lock(exclusive, false)
+	if err == errLockWouldBlock {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock releases the lock taken by Lock or TryLock, closing the file releases it as well
+func (f *EncFile) Unlock() (err error) {
+	defer f.restorePlainPath(&err)
+	if err := f.checkIsFile(); err != nil {
+		return err
+	}
+	return f.unlock()
+}
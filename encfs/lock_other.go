@@ -0,0 +1,26 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package encfs
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockWouldBlock = errors.New("lock would block")
+
+func (f *EncFile) lock(exclusive bool, wait bool) error {
+	return &os.PathError{Op: "lock", Path: f.Name(), Err: ErrLockNotSupported}
+}
+
+func (f *EncFile) unlock() error {
+	return &os.PathError{Op: "unlock", Path: f.Name(), Err: ErrLockNotSupported}
+}
+
+func lockKeyMemory(keyBytes []byte) error {
+	return ErrMemoryLockNotSupported
+}
+
+func unlockKeyMemory(keyBytes []byte) error {
+	return ErrMemoryLockNotSupported
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package encfs
+
+import (
+	"os"
+	"syscall"
+)
+
+var errLockWouldBlock = syscall.EWOULDBLOCK
+
+func (f *EncFile) lock(exclusive bool, wait bool) error {
+	if _, ok := f.file.(fdFile); !ok {
+		return &os.PathError{Op: "lock", Path: f.Name(), Err: ErrLockNotSupported}
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func (f *EncFile) unlock() error {
+	if _, ok := f.file.(fdFile); !ok {
+		return &os.PathError{Op: "unlock", Path: f.Name(), Err: ErrLockNotSupported}
+	}
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+func lockKeyMemory(keyBytes []byte) error {
+	return syscall.Mlock(keyBytes)
+}
+
+func unlockKeyMemory(keyBytes []byte) error {
+	return syscall.Munlock(keyBytes)
+}
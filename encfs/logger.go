@@ -0,0 +1,129 @@
+package encfs
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Logger receives the diagnostics of the package, keysAndValues alternate keys and values like log/slog, so a
+// *slog.Logger is a Logger, NewSlogLogger and NewStdLogger adapt the standard loggers
+type Logger interface {
+	Debug(msg string, keysAndValues ...any)
+	Info(msg string, keysAndValues ...any)
+	Warn(msg string, keysAndValues ...any)
+	Error(msg string, keysAndValues ...any)
+}
+
+var packageLogger Logger = nopLogger{}
+var packageLoggerLock sync.Mutex
+
+// SetLogger sends the diagnostics of the package level functions, e.g. the KMS, and of every EncFs without
+// WithLogger to logger, nil discards them which is the default
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	packageLoggerLock.Lock()
+	defer packageLoggerLock.Unlock()
+	packageLogger = logger
+}
+
+func getPackageLogger() Logger {
+	packageLoggerLock.Lock()
+	defer packageLoggerLock.Unlock()
+	return packageLogger
+}
+
+// WithLogger sends the diagnostics of encFs to logger instead of the logger of SetLogger, nil restores it
+func (encFs *EncFs) WithLogger(logger Logger) {
+	encFs.logger = logger
+}
+
+// WithOperationTrace logs every operation of encFs at debug level with its plaintext paths, flag and error
+func (encFs *EncFs) WithOperationTrace(operationTrace bool) {
+	encFs.operationTrace = operationTrace
+}
+
+func (encFs *EncFs) getLogger() Logger {
+	if encFs == nil || encFs.logger == nil {
+		return getPackageLogger()
+	}
+	return encFs.logger
+}
+
+// trace logs an operation when WithOperationTrace is set
+func (encFs *EncFs) trace(op, name, newName string, flag int, err *error) {
+	if encFs == nil || !encFs.operationTrace {
+		return
+	}
+	keysAndValues := []any{"op", op, "path", name}
+	if newName != "" {
+		keysAndValues = append(keysAndValues, "new_path", newName)
+	}
+	if flag != 0 {
+		keysAndValues = append(keysAndValues, "flag", flag)
+	}
+	if err != nil && *err != nil {
+		keysAndValues = append(keysAndValues, "error", *err)
+	}
+	encFs.getLogger().Debug("encfs operation", keysAndValues...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// StdLogger writes the diagnostics as lines like "[ERROR] msg key=value" to a *log.Logger
+type StdLogger struct {
+	logger *log.Logger
+	debug  bool
+}
+
+// NewStdLogger returns a Logger writing to logger, log.Default() when nil, debug messages are dropped unless debug
+func NewStdLogger(logger *log.Logger, debug bool) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &StdLogger{logger: logger, debug: debug}
+}
+
+func (l *StdLogger) Debug(msg string, keysAndValues ...any) {
+	if l.debug {
+		l.print("DEBUG", msg, keysAndValues)
+	}
+}
+
+func (l *StdLogger) Info(msg string, keysAndValues ...any) {
+	l.print("INFO", msg, keysAndValues)
+}
+
+func (l *StdLogger) Warn(msg string, keysAndValues ...any) {
+	l.print("WARN", msg, keysAndValues)
+}
+
+func (l *StdLogger) Error(msg string, keysAndValues ...any) {
+	l.print("ERROR", msg, keysAndValues)
+}
+
+func (l *StdLogger) print(level, msg string, keysAndValues []any) {
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "[%s] %s", level, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			fmt.Fprintf(line, " %v", keysAndValues[i])
+			break
+		}
+		value := fmt.Sprint(keysAndValues[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(line, " %v=%s", keysAndValues[i], value)
+	}
+	l.logger.Print(line.String())
+}
@@ -0,0 +1,15 @@
+//go:build go1.21
+
+package encfs
+
+import (
+	"log/slog"
+)
+
+// NewSlogLogger returns a Logger writing to logger, slog.Default() when nil
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger
+}
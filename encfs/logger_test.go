@@ -0,0 +1,155 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testLogger keeps the messages logged to it as "LEVEL msg keysAndValues"
+type testLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) log(level, msg string, keysAndValues []any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf("%s %s %v", level, msg, keysAndValues))
+}
+
+func (l *testLogger) Debug(msg string, keysAndValues ...any) { l.log("DEBUG", msg, keysAndValues) }
+func (l *testLogger) Info(msg string, keysAndValues ...any)  { l.log("INFO", msg, keysAndValues) }
+func (l *testLogger) Warn(msg string, keysAndValues ...any)  { l.log("WARN", msg, keysAndValues) }
+func (l *testLogger) Error(msg string, keysAndValues ...any) { l.log("ERROR", msg, keysAndValues) }
+
+func (l *testLogger) takeMessages() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	messages := l.messages
+	l.messages = nil
+	return messages
+}
+
+// failingAuditSink fails every event
+type failingAuditSink struct{}
+
+func (failingAuditSink) WriteAuditEvent(event *AuditEvent) error { return errors.New("sink is full") }
+func (failingAuditSink) Close() error                            { return nil }
+
+func TestOperationTrace(t *testing.T) {
+	tests := []struct {
+		name         string
+		trace        bool
+		op           func(encFs *EncFs)
+		wantMessages []string
+	}{
+		{"stat", true, func(encFs *EncFs) {
+			_, _ = encFs.Stat("/file")
+		}, []string{"DEBUG encfs operation [op stat path /file]"}},
+		{"open with flag", true, func(encFs *EncFs) {
+			f, err := encFs.OpenFile("/file", os.O_WRONLY, 0)
+			if err == nil {
+				_ = f.Close()
+			}
+		}, []string{fmt.Sprintf("DEBUG encfs operation [op open path /file flag %d]", os.O_WRONLY)}},
+		{"rename", true, func(encFs *EncFs) {
+			_ = encFs.Rename("/file", "/renamed")
+		}, []string{"DEBUG encfs operation [op rename path /file new_path /renamed]"}},
+		// errors carry the plaintext path
+		{"error", true, func(encFs *EncFs) {
+			_ = encFs.Remove("/missing")
+		}, []string{"DEBUG encfs operation [op remove path /missing error remove /missing: file does not exist]"}},
+		{"without trace", false, func(encFs *EncFs) {
+			_, _ = encFs.Stat("/file")
+			_ = encFs.Remove("/missing")
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			logger := &testLogger{}
+			encFs.WithLogger(logger)
+			encFs.WithOperationTrace(test.trace)
+			test.op(encFs)
+			if messages := logger.takeMessages(); !reflect.DeepEqual(messages, test.wantMessages) {
+				t.Fatalf("got messages %q, want %q", messages, test.wantMessages)
+			}
+		})
+	}
+}
+
+func TestLoggers(t *testing.T) {
+	defer SetLogger(nil)
+	packageLogger, encFsLogger := &testLogger{}, &testLogger{}
+	tests := []struct {
+		name              string
+		setLogger         Logger
+		withLogger        Logger
+		wantPackageLogged bool
+		wantEncFsLogged   bool
+	}{
+		{"discarded", nil, nil, false, false},
+		{"package logger", packageLogger, nil, true, false},
+		{"EncFs logger", packageLogger, encFsLogger, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetLogger(test.setLogger)
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithLogger(test.withLogger)
+			// failed audit events do not fail the operation but are logged
+			encFs.WithAuditSink(failingAuditSink{})
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			wantMessage := "ERROR audit event not written [op mkdir path /dir error sink is full]"
+			for _, logged := range []struct {
+				logger *testLogger
+				want   bool
+			}{{packageLogger, test.wantPackageLogged}, {encFsLogger, test.wantEncFsLogged}} {
+				var wantMessages []string
+				if logged.want {
+					wantMessages = []string{wantMessage}
+				}
+				if messages := logged.logger.takeMessages(); !reflect.DeepEqual(messages, wantMessages) {
+					t.Fatalf("got messages %q, want %q", messages, wantMessages)
+				}
+			}
+		})
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		name       string
+		debug      bool
+		log        func(logger Logger)
+		wantOutput string
+	}{
+		{"info", false, func(logger Logger) { logger.Info("started", "path", "/dir/file", "size", 3) },
+			"[INFO] started path=/dir/file size=3\n"},
+		{"quoted values", false, func(logger Logger) { logger.Warn("failed", "error", "no such file", "empty", "") },
+			`[WARN] failed error="no such file" empty=""` + "\n"},
+		{"odd keys", false, func(logger Logger) { logger.Error("failed", "op", "open", "dangling") },
+			"[ERROR] failed op=open dangling\n"},
+		{"debug dropped", false, func(logger Logger) { logger.Debug("retrying") }, ""},
+		{"debug", true, func(logger Logger) { logger.Debug("retrying", "attempt", 2) },
+			"[DEBUG] retrying attempt=2\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			test.log(NewStdLogger(log.New(&output, "", 0), test.debug))
+			if output.String() != test.wantOutput {
+				t.Fatalf("got %q, want %q", output.String(), test.wantOutput)
+			}
+		})
+	}
+}
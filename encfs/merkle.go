@@ -0,0 +1,161 @@
+package encfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	MERKLE_ROOT_INFO             = "encfs-afero merkle root"
+	MERKLE_TEMP_META_FILE_SUFFIX = ".__merklemeta" + EncFileExt
+)
+
+// merkleTree is built over the integrity tags of a file, levels[0] are the tags, a node without sibling is
+// promoted to the next level unchanged
+type merkleTree struct {
+	levels [][][]byte
+}
+
+func newMerkleTree(leaves [][]byte) *merkleTree {
+	tree := &merkleTree{levels: [][][]byte{leaves}}
+	tree.rebuild()
+	return tree
+}
+
+func merkleParent(nodes [][]byte, parentIndex int) []byte {
+	left := nodes[2*parentIndex]
+	if 2*parentIndex+1 >= len(nodes) {
+		return left
+	}
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(nodes[2*parentIndex+1])
+	return hash.Sum(nil)
+}
+
+func (tree *merkleTree) rebuild() {
+	tree.levels = tree.levels[:1]
+	for level := 0; len(tree.levels[level]) > 1; level++ {
+		nodes := tree.levels[level]
+		parents := make([][]byte, (len(nodes)+1)/2)
+		for parentIndex := range parents {
+			parents[parentIndex] = merkleParent(nodes, parentIndex)
+		}
+		tree.levels = append(tree.levels, parents)
+	}
+}
+
+// setLeaf updates or appends leaf index and the nodes on its path to the root
+func (tree *merkleTree) setLeaf(index int, leaf []byte) {
+	leaves := tree.levels[0]
+	if index > len(leaves) {
+		// not contiguous, tags are always written in order
+		tree.levels[0] = append(leaves, make([][]byte, index-len(leaves))...)
+		tree.levels[0] = append(tree.levels[0], leaf)
+		tree.rebuild()
+		return
+	}
+	if index == len(leaves) {
+		tree.levels[0] = append(leaves, leaf)
+	} else {
+		leaves[index] = leaf
+	}
+	level := 0
+	for ; len(tree.levels[level]) > 1; level++ {
+		nodes := tree.levels[level]
+		parentCount := (len(nodes) + 1) / 2
+		if level+1 == len(tree.levels) {
+			tree.levels = append(tree.levels, nil)
+		}
+		parents := tree.levels[level+1]
+		if len(parents) > parentCount {
+			parents = parents[:parentCount]
+		}
+		for len(parents) < parentCount {
+			parents = append(parents, nil)
+		}
+		// the parent of the last node changes when a node is appended
+		parents[index/2] = merkleParent(nodes, index/2)
+		tree.levels[level+1] = parents
+		index /= 2
+	}
+	tree.levels = tree.levels[:level+1]
+}
+
+func (tree *merkleTree) truncate(leafCount int) {
+	if leafCount < len(tree.levels[0]) {
+		tree.levels[0] = tree.levels[0][:leafCount]
+		tree.rebuild()
+	}
+}
+
+// root binds the top node to the key, IV and leaf count, so tags can not be dropped or recomputed without the key
+func (tree *merkleTree) root(integrityKey, iv []byte) []byte {
+	mac := hmac.New(sha256.New, integrityKey)
+	mac.Write([]byte(MERKLE_ROOT_INFO))
+	mac.Write(iv)
+	leafCount := make([]byte, 8)
+	binary.BigEndian.PutUint64(leafCount, uint64(len(tree.levels[0])))
+	mac.Write(leafCount)
+	if top := tree.levels[len(tree.levels)-1]; len(top) > 0 {
+		mac.Write(top[0])
+	}
+	return mac.Sum(nil)
+}
+
+// readMerkleTree builds the tree of the tags in integrityFile
+func readMerkleTree(integrityFile io.Reader) (*merkleTree, error) {
+	tags, err := io.ReadAll(integrityFile)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([][]byte, len(tags)/INTEGRITY_TAG_SIZE)
+	for index := range leaves {
+		leaves[index] = tags[index*INTEGRITY_TAG_SIZE : (index+1)*INTEGRITY_TAG_SIZE]
+	}
+	return newMerkleTree(leaves), nil
+}
+
+// openMerkleTree builds the tree of a file with integrity tags and sidecar meta, a root recorded in the meta
+// must match, so tampered or dropped tags are detected when the file is opened, empty files start a new tree
+func (f *EncFile) openMerkleTree(isEmpty bool) error {
+	if f.integrityFile == nil || f.headerSize > 0 {
+		return nil
+	}
+	tree, err := readMerkleTree(f.integrityFile)
+	if err != nil {
+		return err
+	}
+	if isEmpty {
+		f.merkleDirty = f.encFileMeta.MerkleRoot != nil
+	} else if f.encFileMeta.MerkleRoot != nil &&
+		!hmac.Equal(f.encFileMeta.MerkleRoot, tree.root(integrityKey(f.contentKey()), f.encFileMeta.Iv)) {
+		return &os.PathError{Op: "open", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+	}
+	f.merkleTree = tree
+	return nil
+}
+
+// saveMerkleRoot records the root of a modified tree in the meta file, replaced by a rename
+func (f *EncFile) saveMerkleRoot() error {
+	if f.merkleTree == nil || !f.merkleDirty {
+		return nil
+	}
+	f.encFileMeta.MerkleRoot = f.merkleTree.root(integrityKey(f.contentKey()), f.encFileMeta.Iv)
+	encryptedName := f.file.Name()
+	tempName := encryptedName + MERKLE_TEMP_META_FILE_SUFFIX
+	if err := writeEncFileMeta(f.encFs.backend(), tempName, f.encFileMeta); err != nil {
+		_ = f.encFs.backend().Remove(tempName)
+		return err
+	}
+	if err := renameEncFileMeta(f.encFs.backend(), tempName, f.encFs.encFileMetaName(encryptedName)); err != nil {
+		return err
+	}
+	f.encFs.forgetCachedEncFileMetas(encryptedName)
+	f.merkleDirty = false
+	return nil
+}
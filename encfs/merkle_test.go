@@ -0,0 +1,169 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func testMerkleLeaves(count int, seed byte) [][]byte {
+	leaves := make([][]byte, count)
+	for i := range leaves {
+		leaf := sha256.Sum256([]byte{seed, byte(i), byte(i >> 8)})
+		leaves[i] = leaf[:]
+	}
+	return leaves
+}
+
+func TestMerkleTreeSetLeaf(t *testing.T) {
+	integrityKey, iv := testKeyBytes(1), testKeyBytes(2)[:16]
+	for _, count := range []int{1, 2, 3, 4, 5, 7, 8, 9, 33} {
+		leaves := testMerkleLeaves(count, 1)
+		// appending leaf by leaf gives the tree built at once
+		tree := newMerkleTree(nil)
+		for index, leaf := range leaves {
+			tree.setLeaf(index, leaf)
+		}
+		want := newMerkleTree(append([][]byte(nil), leaves...)).root(integrityKey, iv)
+		if got := tree.root(integrityKey, iv); !bytes.Equal(got, want) {
+			t.Fatalf("%d leaves: appended root differs", count)
+		}
+		// changing any leaf changes the root, changing it back restores it
+		for index := range leaves {
+			tree.setLeaf(index, testMerkleLeaves(1, 2)[0])
+			if bytes.Equal(tree.root(integrityKey, iv), want) {
+				t.Fatalf("%d leaves: root kept after leaf %d changed", count, index)
+			}
+			tree.setLeaf(index, leaves[index])
+			if !bytes.Equal(tree.root(integrityKey, iv), want) {
+				t.Fatalf("%d leaves: root differs after leaf %d restored", count, index)
+			}
+		}
+		if count > 1 {
+			tree.truncate(count - 1)
+			want := newMerkleTree(append([][]byte(nil), leaves[:count-1]...)).root(integrityKey, iv)
+			if got := tree.root(integrityKey, iv); !bytes.Equal(got, want) {
+				t.Fatalf("%d leaves: truncated root differs", count)
+			}
+		}
+	}
+}
+
+func TestMerkleTreeRootBinding(t *testing.T) {
+	integrityKey, iv := testKeyBytes(1), testKeyBytes(2)[:16]
+	root := newMerkleTree(testMerkleLeaves(4, 1)).root(integrityKey, iv)
+	tests := []struct {
+		name string
+		root []byte
+	}{
+		{"other key", newMerkleTree(testMerkleLeaves(4, 1)).root(testKeyBytes(3), iv)},
+		{"other iv", newMerkleTree(testMerkleLeaves(4, 1)).root(integrityKey, testKeyBytes(3)[:16])},
+		{"dropped leaf", newMerkleTree(testMerkleLeaves(3, 1)).root(integrityKey, iv)},
+		{"swapped leaves", func() []byte {
+			leaves := testMerkleLeaves(4, 1)
+			leaves[0], leaves[1] = leaves[1], leaves[0]
+			return newMerkleTree(leaves).root(integrityKey, iv)
+		}()},
+	}
+	for _, test := range tests {
+		if bytes.Equal(test.root, root) {
+			t.Fatalf("%s: same root", test.name)
+		}
+	}
+}
+
+func TestMerkleRootDetectsTamperedTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(tags []byte) []byte
+	}{
+		{"dropped last tag", func(tags []byte) []byte { return tags[:len(tags)-INTEGRITY_TAG_SIZE] }},
+		{"changed tag", func(tags []byte) []byte {
+			tags[0] ^= 1
+			return tags
+		}},
+		{"swapped tags", func(tags []byte) []byte {
+			swapped := append([]byte(nil), tags[INTEGRITY_TAG_SIZE:2*INTEGRITY_TAG_SIZE]...)
+			swapped = append(swapped, tags[:INTEGRITY_TAG_SIZE]...)
+			return append(swapped, tags[2*INTEGRITY_TAG_SIZE:]...)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithIntegrityTags(true)
+			data := testPattern(5 * INTEGRITY_BLOCK_SIZE)
+			writeTestFile(t, encFs, "/file", data)
+			checkTestFile(t, encFs, "/file", data)
+
+			integrityName := "/file" + INTEGRITY_FILE_SUFFIX
+			tags, err := afero.ReadFile(base, integrityName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(base, integrityName, test.tamper(tags), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := encFs.Open("/file"); !errors.Is(err, ErrIntegrityCheckFailed) {
+				t.Fatalf("got %v, want %v", err, ErrIntegrityCheckFailed)
+			}
+		})
+	}
+}
+
+func TestMerkleRootRequiresTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(t *testing.T, encFs *EncFs, base afero.Fs)
+		wantErr error
+	}{
+		{"tags", func(t *testing.T, encFs *EncFs, base afero.Fs) {}, nil},
+		{"removed sidecar of a root", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			// files tagged before IntegrityTags was recorded only have the root
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			encFileMeta.IntegrityTags = false
+			if err := writeEncFileMeta(base, encFs.encFileMetaName("/file"), encFileMeta); err != nil {
+				t.Fatal(err)
+			}
+			encFs.forgetCachedEncFileMetas("/file")
+			if err := base.Remove("/file" + INTEGRITY_FILE_SUFFIX); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrIntegrityCheckFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithIntegrityTags(true)
+			data := testPattern(3 * INTEGRITY_BLOCK_SIZE)
+			writeTestFile(t, encFs, "/file", data)
+			test.modify(t, encFs, base)
+			if _, err := afero.ReadFile(encFs, "/file"); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntegrityTagsRefuseHeaderFormat(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	encFs.WithFileFormat(FILE_FORMAT_HEADER)
+	encFs.WithIntegrityTags(true)
+	if err := afero.WriteFile(encFs, "/file", []byte("data"), 0644); !errors.Is(err, ErrIntegrityTagsNeedSidecar) {
+		t.Fatalf("got %v, want %v", err, ErrIntegrityTagsNeedSidecar)
+	}
+	_, err := InitVolume(afero.NewMemMapFs(), "/", "passphrase", &VolumeOptions{
+		FileFormat:    FILE_FORMAT_HEADER,
+		IntegrityTags: true,
+		Kdf:           testKdfParams(),
+	})
+	if !errors.Is(err, ErrIntegrityTagsNeedSidecar) {
+		t.Fatalf("init volume: got %v, want %v", err, ErrIntegrityTagsNeedSidecar)
+	}
+}
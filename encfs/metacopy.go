@@ -0,0 +1,95 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/spf13/afero"
+)
+
+// META_COPY_ALIGN is the sector size the redundant copy of a meta is aligned to
+const META_COPY_ALIGN = 4096
+
+var (
+	ErrBadMetaChecksum = errors.New("file meta checksum mismatch")
+)
+
+var encFileMetaCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WithMetaCopy keeps a redundant copy of the meta in every meta file written afterwards, the copy starts at the next
+// META_COPY_ALIGN boundary so corrupting one sector never damages both, files whose meta fails its checksum are read
+// from the copy and Fsck with repair rewrites them, meta files with a copy are not readable by older versions
+func (encFs *EncFs) WithMetaCopy(metaCopy bool) {
+	encFs.metaCopy = metaCopy
+}
+
+func encFileMetaChecksum(data []byte) string {
+	checksum := crc32.Checksum(data, encFileMetaCrcTable)
+	return hex.EncodeToString([]byte{byte(checksum >> 24), byte(checksum >> 16), byte(checksum >> 8), byte(checksum)})
+}
+
+// decodeEncFileMeta parses the first JSON value of data and verifies its checksum, metas without checksum and of
+// newer versions are not verified, checkVersion refuses the latter, empty and truncated metas are ErrBadFileMeta
+func decodeEncFileMeta(data []byte) (*EncFileMeta, error) {
+	var encFileMeta EncFileMeta
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&encFileMeta); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: %v", ErrBadFileMeta, err)
+		}
+		return nil, err
+	}
+	if encFileMeta.Checksum == "" || encFileMeta.Version > ENC_FILE_META_VERSION_FLAGS {
+		return &encFileMeta, nil
+	}
+	checksummed := encFileMeta
+	checksummed.Checksum = ""
+	checksummedData, err := json.Marshal(&checksummed)
+	if err != nil {
+		return nil, err
+	}
+	if encFileMetaChecksum(checksummedData) != encFileMeta.Checksum {
+		return nil, ErrBadMetaChecksum
+	}
+	return &encFileMeta, nil
+}
+
+// appendEncFileMetaCopy pads data with newlines to the next META_COPY_ALIGN boundary and appends the copy
+func appendEncFileMetaCopy(data []byte) []byte {
+	copyOffset := (len(data)/META_COPY_ALIGN + 1) * META_COPY_ALIGN
+	encFileMetaBytes := make([]byte, copyOffset, copyOffset+len(data))
+	copy(encFileMetaBytes, data)
+	for i := len(data); i < copyOffset; i++ {
+		encFileMetaBytes[i] = '\n'
+	}
+	return append(encFileMetaBytes, data...)
+}
+
+// findEncFileMetaCopy returns the copy starting at the last aligned offset holding a JSON object, nil without copy,
+// the padding before it is not checked since it may be in the damaged sector
+func findEncFileMetaCopy(data []byte) []byte {
+	for offset := (len(data) - 1) / META_COPY_ALIGN * META_COPY_ALIGN; offset > 0; offset -= META_COPY_ALIGN {
+		if data[offset] == '{' {
+			return data[offset:]
+		}
+	}
+	return nil
+}
+
+// rewriteEncFileMeta replaces the meta file of encryptedName, e.g. a damaged one by its intact copy
+func (encFs *EncFs) rewriteEncFileMeta(fs afero.Fs, encryptedName string, encFileMeta *EncFileMeta) error {
+	tempName, err := newEncFileMetaTempName(encFs, encryptedName)
+	if err != nil {
+		return err
+	}
+	if err := writeEncFileMeta(fs, tempName, encFileMeta); err != nil {
+		_ = fs.Remove(tempName)
+		return err
+	}
+	defer encFs.forgetCachedEncFileMetas(encryptedName)
+	return renameEncFileMeta(fs, tempName, encFs.encFileMetaName(encryptedName))
+}
@@ -0,0 +1,138 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestDecodeEncFileMeta(t *testing.T) {
+	var syntaxError *json.SyntaxError
+	tests := []struct {
+		name    string
+		data    string
+		wantErr func(err error) bool
+	}{
+		{"meta", `{"version":1}`, func(err error) bool { return err == nil }},
+		{"empty", "", func(err error) bool { return errors.Is(err, ErrBadFileMeta) }},
+		{"truncated", `{"version":1`, func(err error) bool { return errors.Is(err, ErrBadFileMeta) }},
+		{"not json", "not json", func(err error) bool { return errors.As(err, &syntaxError) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeEncFileMeta([]byte(test.data))
+			if !test.wantErr(err) {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestEncFileMetaChecksum(t *testing.T) {
+	encFileMeta := &EncFileMeta{Magic: ENC_FILE_META_MAGIC, Version: ENC_FILE_META_VERSION, Iv: testKeyBytes(1)[:16]}
+	data, err := marshalEncFileMeta(encFileMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"checksummed", string(data), nil},
+		{"tampered", strings.Replace(string(data), `"version":1`, `"version":2`, 1), ErrBadMetaChecksum},
+		// metas written before checksums are not verified
+		{"without checksum", `{"magic":"` + ENC_FILE_META_MAGIC + `","version":1}`, nil},
+		// newer versions may checksum differently, checkVersion refuses them
+		{"newer version", `{"version":1000,"checksum":"00000000"}`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := unmarchalEncFileMeta([]byte(test.data)); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncFileMetaCopy(t *testing.T) {
+	encFileMeta := &EncFileMeta{Magic: ENC_FILE_META_MAGIC, Version: ENC_FILE_META_VERSION, Iv: testKeyBytes(1)[:16],
+		hasCopy: true}
+	data, err := marshalEncFileMeta(encFileMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= META_COPY_ALIGN || data[META_COPY_ALIGN] != '{' {
+		t.Fatalf("the copy is not aligned in %d bytes", len(data))
+	}
+	tests := []struct {
+		name string
+		// damage changes a byte of the meta
+		damageOffset int
+		wantDamaged  bool
+		wantErr      error
+	}{
+		{"intact", -1, false, nil},
+		{"damaged meta", 2, true, nil},
+		{"damaged padding", META_COPY_ALIGN - 1, false, nil},
+		// the copy is not verified while the meta is intact
+		{"damaged copy", META_COPY_ALIGN + 2, false, nil},
+		{"damaged checksum", bytes.Index(data, []byte(`"checksum":"`)) + 12, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			damaged := append([]byte(nil), data...)
+			if test.damageOffset >= 0 {
+				damaged[test.damageOffset] ^= 0x01
+			}
+			got, err := unmarchalEncFileMeta(damaged)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if !got.hasCopy || got.damaged != test.wantDamaged || !bytes.Equal(got.Iv, encFileMeta.Iv) {
+				t.Fatalf("got meta %+v", got)
+			}
+		})
+	}
+	// a meta damaged in both sectors can not be read
+	damaged := append([]byte(nil), data...)
+	damaged[2] ^= 0x01
+	damaged[META_COPY_ALIGN+2] ^= 0x01
+	if _, err := unmarchalEncFileMeta(damaged); err == nil {
+		t.Fatal("read a meta damaged in both sectors")
+	}
+}
+
+func TestWithMetaCopy(t *testing.T) {
+	tests := []struct {
+		name     string
+		metaCopy bool
+		// wantReadable is whether the file is read after the first sector of its meta is damaged
+		wantReadable bool
+	}{
+		{"with copy", true, true},
+		{"without copy", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithMetaCopy(test.metaCopy)
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			flipTestByte(t, base, encFs.encFileMetaName("/file"), 2)
+			encFs.forgetCachedEncFileMetas("/file")
+			data, err := afero.ReadFile(encFs, "/file")
+			if (err == nil) != test.wantReadable || err == nil && string(data) != "data" {
+				t.Fatalf("read %q: %v", data, err)
+			}
+			// metas with and without copy are read either way
+			encFs.WithMetaCopy(!test.metaCopy)
+			writeTestFile(t, encFs, "/other", []byte("other"))
+			encFs.WithMetaCopy(test.metaCopy)
+			checkTestFile(t, encFs, "/other", []byte("other"))
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package encfs
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// META_FILE_EXT_PREFIX starts every meta file ext, exts of data files like ".txt" would turn data files into meta files
+const META_FILE_EXT_PREFIX = ".__"
+
+var (
+	ErrBadMetaFileExt = errors.New("meta file ext must start with .__ and must not contain a separator")
+)
+
+// metaFileNaming maps data file names to the names of their sidecar meta files, name + ext or with hidden
+// "." + name + ext, volume level files and temp files keep EncFileExt
+type metaFileNaming struct {
+	ext    string
+	hidden bool
+}
+
+func newMetaFileNaming(ext string, hidden bool) (*metaFileNaming, error) {
+	if ext == "" {
+		ext = EncFileExt
+	}
+	if !strings.HasPrefix(ext, META_FILE_EXT_PREFIX) || len(ext) <= len(META_FILE_EXT_PREFIX) ||
+		strings.ContainsAny(ext, `/\`) || strings.ContainsRune(ext, 0) {
+		return nil, ErrBadMetaFileExt
+	}
+	return &metaFileNaming{ext: ext, hidden: hidden}, nil
+}
+
+// WithMetaFileNaming names the meta files ext instead of EncFileExt and with hidden starts them with a dot, so
+// encrypted trees are not told apart by the suffix, existing meta files are not renamed so the naming must be chosen
+// before the first file is written, volumes record it in their config
+func (encFs *EncFs) WithMetaFileNaming(ext string, hidden bool) error {
+	metaNaming, err := newMetaFileNaming(ext, hidden)
+	if err != nil {
+		return err
+	}
+	// shared with the meta stores of a volume
+	*encFs.metaNaming = *metaNaming
+	return nil
+}
+
+func (encFs *EncFs) metaFileNaming() *metaFileNaming {
+	if encFs.metaNaming == nil {
+		return &metaFileNaming{ext: EncFileExt}
+	}
+	return encFs.metaNaming
+}
+
+// metaName returns the meta file name of the data file name
+func (n *metaFileNaming) metaName(name string) string {
+	if !n.hidden {
+		return name + n.ext
+	}
+	dir, base := filepath.Split(name)
+	return dir + "." + base + n.ext
+}
+
+// isMetaName reports meta file names of the naming, name is the last part
+func (n *metaFileNaming) isMetaName(name string) bool {
+	if n.ext == EncFileExt && !n.hidden {
+		return isEncFileMetaName(name)
+	}
+	if n.hidden {
+		return strings.HasPrefix(name, ".") && strings.HasSuffix(name, n.ext) && len(name) > len(n.ext)+1
+	}
+	return strings.HasSuffix(name, n.ext) && len(name) > len(n.ext)
+}
+
+// dataName returns the data file name of a meta file name, temp meta files ending with EncFileExt included, false
+// for other names
+func (n *metaFileNaming) dataName(name string) (string, bool) {
+	dir, base := filepath.Split(name)
+	switch {
+	case n.isMetaName(base):
+		base = strings.TrimSuffix(base, n.ext)
+		if n.hidden {
+			base = base[1:]
+		}
+	case isEncFileMetaName(base):
+		base = strings.TrimSuffix(base, EncFileExt)
+	default:
+		return "", false
+	}
+	return dir + base, true
+}
+
+// isInternalName reports meta files and volume level files which are hidden from listings, name is the last part
+func (n *metaFileNaming) isInternalName(name string) bool {
+	return isEncFsInternalName(name) || n.isMetaName(name)
+}
+
+func (encFs *EncFs) encFileMetaName(encryptedName string) string {
+	return encFs.metaFileNaming().metaName(encryptedName)
+}
+
+// isEncFileMetaName reports per file meta names of the default naming, excluding volume level files sharing the ext,
+// callers go through metaFileNaming which knows MetaFileExt and hidden names too
+func isEncFileMetaName(name string) bool {
+	return strings.HasSuffix(name, EncFileExt) && name != HMAC_NAME_LOOKUP_FILE_NAME &&
+		name != HMAC_NAME_LOOKUP_TEMP_FILE_NAME && name != FLAT_INDEX_FILE_NAME && name != PASSPHRASE_VOLUME_FILE_NAME &&
+		name != CHANGE_JOURNAL_FILE_NAME && name != VOLUME_CONFIG_FILE_NAME &&
+		name != META_STORE_FILE_NAME && name != META_STORE_TEMP_FILE_NAME &&
+		!strings.HasSuffix(name, REKEY_TEMP_FILE_SUFFIX) && !strings.HasSuffix(name, REKEY_TEMP_META_FILE_SUFFIX) &&
+		!strings.HasSuffix(name, INTEGRITY_FILE_SUFFIX) && !strings.HasSuffix(name, LONG_NAME_FILE_SUFFIX)
+}
+
+// isEncFsInternalName reports volume level files, temp files and meta files of the default naming which are hidden
+// from listings, see metaFileNaming.isInternalName
+func isEncFsInternalName(name string) bool {
+	return strings.HasSuffix(name, EncFileExt)
+}
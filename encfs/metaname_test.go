@@ -0,0 +1,60 @@
+package encfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestNewMetaFileNaming(t *testing.T) {
+	tests := []struct {
+		name    string
+		ext     string
+		wantExt string
+		wantErr error
+	}{
+		{"default", "", EncFileExt, nil},
+		{"encfile", EncFileExt, EncFileExt, nil},
+		{"reserved", ".__m", ".__m", nil},
+		// exts of data files would turn data files into meta files
+		{"txt", ".txt", "", ErrBadMetaFileExt},
+		{"go", ".go", "", ErrBadMetaFileExt},
+		{"dot", ".", "", ErrBadMetaFileExt},
+		{"prefix only", META_FILE_EXT_PREFIX, "", ErrBadMetaFileExt},
+		{"no dot", "__m", "", ErrBadMetaFileExt},
+		{"one underscore", "._m", "", ErrBadMetaFileExt},
+		{"separator", ".__m/x", "", ErrBadMetaFileExt},
+		{"backslash", ".__m\\x", "", ErrBadMetaFileExt},
+		{"nul", ".__m\x00", "", ErrBadMetaFileExt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metaNaming, err := newMetaFileNaming(test.ext, false)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && metaNaming.ext != test.wantExt {
+				t.Fatalf("got ext %q, want %q", metaNaming.ext, test.wantExt)
+			}
+
+			// the naming of an EncFs is kept when the ext is refused
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithMetaFileNaming(test.ext, true); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			wantMetaName := "/.file" + test.wantExt
+			if test.wantErr != nil {
+				wantMetaName = "/file" + EncFileExt
+			}
+			if metaName := encFs.encFileMetaName("/file"); metaName != wantMetaName {
+				t.Fatalf("got meta name %s, want %s", metaName, wantMetaName)
+			}
+
+			options := &VolumeOptions{Kdf: testKdfParams(), MetaFileExt: test.ext}
+			if _, err := InitVolume(afero.NewMemMapFs(), "/volume", "passphrase", options); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package encfs
+
+import (
+	"encoding/json"
+)
+
+const (
+	META_KEY_INFO = "encfs-meta"
+
+	// sealed metas were version 4 before META_FLAG_SEALED, older versions refuse both instead of reading a meta
+	// without IV
+	ENC_FILE_META_VERSION_SEALED = 4
+)
+
+// WithEncryptedMeta seals the meta files written afterwards by AES-GCM under a meta subkey derived by HKDF, the
+// cipher, IV and the other settings of a file are no longer readable without the key, existing meta files are sealed
+// by Migrate, files of the keyring keep the key they are sealed with
+func (encFs *EncFs) WithEncryptedMeta(encryptedMeta bool) {
+	encFs.encryptedMeta = encryptedMeta
+}
+
+func (k *EncryptionMasterKey) metaSubkey() []byte {
+	return hkdfSha256(k.key, nil, []byte(META_KEY_INFO), len(k.key))
+}
+
+// applyEncryptedMeta makes a new meta sealed by the key of encFs after WithEncryptedMeta
+func (encFs *EncFs) applyEncryptedMeta(encFileMeta *EncFileMeta) {
+	if encFs == nil || encFs.key == nil || !encFs.encryptedMeta {
+		return
+	}
+	encFileMeta.sealKey = encFs.key
+}
+
+// sealEncFileMeta returns the sealed form of encFileMeta which is written instead of it
+func sealEncFileMeta(encFileMeta *EncFileMeta) (*EncFileMeta, error) {
+	plain := *encFileMeta
+	plain.Checksum = ""
+	plainBytes, err := json.Marshal(&plain)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealWithRandomNonce(encFileMeta.sealKey.metaSubkey(), plainBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &EncFileMeta{
+		Magic:   ENC_FILE_META_MAGIC,
+		Version: ENC_FILE_META_VERSION_FLAGS,
+		Flags:   []string{META_FLAG_SEALED},
+		KeyId:   encFileMeta.sealKey.KeyId(),
+		Sealed:  sealed,
+	}, nil
+}
+
+// unsealEncFileMeta opens a sealed meta with the key of its key id, ErrWrongKey when neither the key of encFs nor
+// its keyring has it
+func (encFs *EncFs) unsealEncFileMeta(sealed *EncFileMeta) (*EncFileMeta, error) {
+	var key *EncryptionMasterKey
+	if encFs != nil && encFs.key != nil {
+		if sealed.KeyId == encFs.key.KeyId() {
+			key = encFs.key
+		} else {
+			key = encFs.keyring[sealed.KeyId]
+		}
+	}
+	if key == nil {
+		return nil, ErrWrongKey
+	}
+	plainBytes, err := openWithRandomNonce(key.metaSubkey(), sealed.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	var encFileMeta EncFileMeta
+	if err := json.Unmarshal(plainBytes, &encFileMeta); err != nil {
+		return nil, ErrBadFileMeta
+	}
+	if encFileMeta.Sealed != nil || encFileMeta.Version == ENC_FILE_META_VERSION_SEALED ||
+		encFileMeta.hasFlag(META_FLAG_SEALED) {
+		return nil, ErrBadFileMeta
+	}
+	if err := encFileMeta.checkVersion(); err != nil {
+		return nil, err
+	}
+	encFileMeta.hasCopy, encFileMeta.damaged = sealed.hasCopy, sealed.damaged
+	encFileMeta.sealKey = key
+	return &encFileMeta, nil
+}
@@ -0,0 +1,649 @@
+package encfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+const (
+	META_STORE_FILE_NAME      = "__ENCFS_META__" + EncFileExt
+	META_STORE_TEMP_FILE_NAME = "__ENCFS_META_COMPACT__" + EncFileExt
+
+	metaStoreOpPut        = "put"
+	metaStoreOpDelete     = "delete"
+	metaStoreOpRename     = "rename"
+	metaStoreOpDeleteTree = "delete_tree"
+
+	// the log is compacted when it holds more superseded records than this and than live ones
+	metaStoreCompactMinGarbage = 1024
+)
+
+var (
+	ErrMetaStoreBroken = errors.New("meta store is broken")
+)
+
+// metaStoreRecord is one line of the meta store log, renames and tree deletes apply to the whole subtree of Name
+type metaStoreRecord struct {
+	Op      string    `json:"op"`
+	Name    string    `json:"name"`
+	NewName string    `json:"new_name,omitempty"`
+	Data    []byte    `json:"data,omitempty"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+}
+
+type metaStoreEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+// metaStoreFs keeps the meta files of a volume in one append only log in its root instead of one sidecar per file,
+// the meta names stay visible through the afero.Fs so EncFs, Fsck and the gc see no difference, other names are
+// passed to the wrapped backend, the log is loaded into memory so only one process may use the volume at a time,
+// stores like bbolt or sqlite need an os file with mmap or locks while the log only needs append, sync and rename
+// of afero so it runs over every backend of EncFs, e.g. S3, a crash can only tear the last line which load drops
+type metaStoreFs struct {
+	afero.Fs
+	mutex      *sync.Mutex
+	naming     *metaFileNaming
+	name       string
+	logFile    afero.File
+	entries    map[string]*metaStoreEntry
+	dirEntries map[string]map[string]bool
+	garbage    int
+}
+
+func newMetaStoreFs(base afero.Fs, naming *metaFileNaming) (*metaStoreFs, error) {
+	fs := &metaStoreFs{
+		Fs:         base,
+		mutex:      &sync.Mutex{},
+		naming:     naming,
+		name:       filepath.Join(string(filepath.Separator), META_STORE_FILE_NAME),
+		entries:    make(map[string]*metaStoreEntry),
+		dirEntries: make(map[string]map[string]bool),
+	}
+	torn, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+	if torn {
+		// drops the torn last record before new ones are appended after it
+		if err := fs.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// load replays the log, a last line without newline is a torn append of a crash and reported instead of failing
+func (fs *metaStoreFs) load() (bool, error) {
+	file, err := fs.Fs.Open(fs.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return len(line) > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var record metaStoreRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return false, &os.PathError{Op: "open", Path: fs.name, Err: ErrMetaStoreBroken}
+		}
+		fs.apply(&record)
+	}
+}
+
+func (fs *metaStoreFs) apply(record *metaStoreRecord) {
+	switch record.Op {
+	case metaStoreOpPut:
+		if _, found := fs.entries[record.Name]; found {
+			fs.garbage++
+		} else {
+			fs.addDirEntry(record.Name)
+		}
+		fs.entries[record.Name] = &metaStoreEntry{data: record.Data, modTime: record.ModTime}
+	case metaStoreOpDelete:
+		fs.garbage++
+		fs.deleteEntry(record.Name)
+	case metaStoreOpRename:
+		fs.garbage++
+		for _, name := range fs.treeNames(record.Name) {
+			newName := record.NewName + strings.TrimPrefix(name, record.Name)
+			entry := fs.entries[name]
+			fs.deleteEntry(name)
+			if _, found := fs.entries[newName]; found {
+				fs.garbage++
+			} else {
+				fs.addDirEntry(newName)
+			}
+			fs.entries[newName] = entry
+		}
+	case metaStoreOpDeleteTree:
+		fs.garbage++
+		for _, name := range fs.treeNames(record.Name) {
+			fs.deleteEntry(name)
+		}
+	}
+}
+
+// treeNames returns name and the names below it which have a record
+func (fs *metaStoreFs) treeNames(name string) []string {
+	prefix := name + string(filepath.Separator)
+	names := make([]string, 0)
+	for entryName := range fs.entries {
+		if entryName == name || strings.HasPrefix(entryName, prefix) {
+			names = append(names, entryName)
+		}
+	}
+	return names
+}
+
+func (fs *metaStoreFs) addDirEntry(name string) {
+	dir := filepath.Dir(name)
+	if fs.dirEntries[dir] == nil {
+		fs.dirEntries[dir] = make(map[string]bool)
+	}
+	fs.dirEntries[dir][filepath.Base(name)] = true
+}
+
+func (fs *metaStoreFs) deleteEntry(name string) {
+	delete(fs.entries, name)
+	dir := filepath.Dir(name)
+	delete(fs.dirEntries[dir], filepath.Base(name))
+	if len(fs.dirEntries[dir]) == 0 {
+		delete(fs.dirEntries, dir)
+	}
+}
+
+// commit appends record to the log and applies it, the log is opened by the first commit since InitVolume creates
+// the volume root later, fs.mutex must be held
+func (fs *metaStoreFs) commit(record *metaStoreRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if fs.logFile == nil {
+		if fs.logFile, err = fs.Fs.OpenFile(fs.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return err
+		}
+	}
+	if _, err := fs.logFile.Write(append(recordBytes, '\n')); err != nil {
+		return err
+	}
+	if err := fs.logFile.Sync(); err != nil {
+		return err
+	}
+	fs.apply(record)
+	if fs.garbage > metaStoreCompactMinGarbage && fs.garbage > len(fs.entries) {
+		return fs.compact()
+	}
+	return nil
+}
+
+// compact replaces the log by one put per live record, written to a synced temp file and renamed over the log
+func (fs *metaStoreFs) compact() error {
+	tempName := filepath.Join(string(filepath.Separator), META_STORE_TEMP_FILE_NAME)
+	tempFile, err := fs.Fs.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(fs.entries))
+	for name := range fs.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writer := bufio.NewWriter(tempFile)
+	for _, name := range names {
+		entry := fs.entries[name]
+		recordBytes, err := json.Marshal(&metaStoreRecord{Op: metaStoreOpPut, Name: name, Data: entry.data, ModTime: entry.modTime})
+		if err != nil {
+			_ = tempFile.Close()
+			return err
+		}
+		_, _ = writer.Write(append(recordBytes, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Fs.Remove(tempName)
+		return err
+	}
+	if fs.logFile != nil {
+		_ = fs.logFile.Close()
+		fs.logFile = nil
+	}
+	if err := fs.Fs.Rename(tempName, fs.name); err != nil {
+		return err
+	}
+	fs.garbage = 0
+	return syncBackendPath(fs.Fs, filepath.Dir(fs.name))
+}
+
+func metaStoreKey(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
+
+// isMetaStoreName reports the names kept in the log, the sidecar meta files and their temp files
+func (fs *metaStoreFs) isMetaStoreName(name string) bool {
+	_, ok := fs.naming.dataName(name)
+	return ok
+}
+
+func (fs *metaStoreFs) Name() string {
+	return "metaStoreFs"
+}
+
+func (fs *metaStoreFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *metaStoreFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *metaStoreFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if fs.isMetaStoreName(name) {
+		return fs.openEntry(name, flag)
+	}
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return file, err
+	}
+	fs.mutex.Lock()
+	hasEntries := len(fs.dirEntries[metaStoreKey(name)]) > 0
+	fs.mutex.Unlock()
+	if !hasEntries {
+		// files keep the interfaces of the backend file, e.g. Fd for locks
+		return file, nil
+	}
+	return &metaStoreDir{File: file, fs: fs, name: metaStoreKey(name)}, nil
+}
+
+func (fs *metaStoreFs) openEntry(name string, flag int) (afero.File, error) {
+	key := metaStoreKey(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	entry, found := fs.entries[key]
+	if !found && flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if found && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !found {
+		if _, err := fs.Fs.Stat(filepath.Dir(name)); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		// a new entry is only in memory until written, which is enough to claim the name within the process
+		entry = &metaStoreEntry{modTime: time.Now()}
+		fs.entries[key] = entry
+		fs.addDirEntry(key)
+	}
+	return newMemMetaFile(name, entry.data, entry.modTime, flag, found, func(data []byte) error {
+		return fs.put(key, data)
+	}), nil
+}
+
+func (fs *metaStoreFs) put(name string, data []byte) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.commit(&metaStoreRecord{Op: metaStoreOpPut, Name: name, Data: data, ModTime: time.Now()})
+}
+
+func (fs *metaStoreFs) entryInfo(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	entry, found := fs.entries[metaStoreKey(name)]
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return newMemMetaFileInfo(filepath.Base(name), entry.data, entry.modTime), nil
+}
+
+func newMemMetaFileInfo(name string, data []byte, modTime time.Time) os.FileInfo {
+	fileData := mem.CreateFile(name)
+	mem.SetMode(fileData, 0600)
+	mem.SetModTime(fileData, modTime)
+	memFile := mem.NewFileHandle(fileData)
+	_, _ = memFile.Write(data)
+	return mem.GetFileInfo(fileData)
+}
+
+// entryInfos returns the infos of the entries in dir sorted by name
+func (fs *metaStoreFs) entryInfos(dir string) []os.FileInfo {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	names := make([]string, 0, len(fs.dirEntries[dir]))
+	for name := range fs.dirEntries[dir] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fileInfos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		entry := fs.entries[filepath.Join(dir, name)]
+		fileInfos = append(fileInfos, newMemMetaFileInfo(name, entry.data, entry.modTime))
+	}
+	return fileInfos
+}
+
+func (fs *metaStoreFs) Stat(name string) (os.FileInfo, error) {
+	if fs.isMetaStoreName(name) {
+		return fs.entryInfo(name)
+	}
+	return fs.Fs.Stat(name)
+}
+
+func (fs *metaStoreFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if fs.isMetaStoreName(name) {
+		fileInfo, err := fs.entryInfo(name)
+		return fileInfo, false, err
+	}
+	if lstater, ok := fs.Fs.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fileInfo, err := fs.Fs.Stat(name)
+	return fileInfo, false, err
+}
+
+func (fs *metaStoreFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := fs.Fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (fs *metaStoreFs) ReadlinkIfPossible(name string) (string, error) {
+	if linkReader, ok := fs.Fs.(afero.LinkReader); ok {
+		return linkReader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+func (fs *metaStoreFs) StreamingWritePartSize() int {
+	if streamingBackend, ok := fs.Fs.(StreamingBackend); ok {
+		return streamingBackend.StreamingWritePartSize()
+	}
+	return 0
+}
+
+func (fs *metaStoreFs) Remove(name string) error {
+	if !fs.isMetaStoreName(name) {
+		return fs.Fs.Remove(name)
+	}
+	key := metaStoreKey(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, found := fs.entries[key]; !found {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return fs.commit(&metaStoreRecord{Op: metaStoreOpDelete, Name: key})
+}
+
+func (fs *metaStoreFs) RemoveAll(path string) error {
+	if fs.isMetaStoreName(path) {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := fs.Fs.RemoveAll(path); err != nil {
+		return err
+	}
+	return fs.deleteTree(metaStoreKey(path))
+}
+
+func (fs *metaStoreFs) deleteTree(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if len(fs.treeNames(name)) == 0 {
+		return nil
+	}
+	return fs.commit(&metaStoreRecord{Op: metaStoreOpDeleteTree, Name: name})
+}
+
+func (fs *metaStoreFs) Rename(oldname, newname string) error {
+	oldIsEntry, newIsEntry := fs.isMetaStoreName(oldname), fs.isMetaStoreName(newname)
+	switch {
+	case oldIsEntry && newIsEntry:
+		return fs.renameEntries(oldname, newname, true)
+	case oldIsEntry || newIsEntry:
+		return fs.renameAcross(oldname, newname, oldIsEntry)
+	}
+	if err := fs.Fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	// the meta files below a renamed directory move with it
+	return fs.renameEntries(oldname, newname, false)
+}
+
+func (fs *metaStoreFs) renameEntries(oldname, newname string, mustExist bool) error {
+	oldKey, newKey := metaStoreKey(oldname), metaStoreKey(newname)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if mustExist {
+		if _, found := fs.entries[oldKey]; !found {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+		}
+	} else if len(fs.treeNames(oldKey)) == 0 {
+		return nil
+	}
+	return fs.commit(&metaStoreRecord{Op: metaStoreOpRename, Name: oldKey, NewName: newKey})
+}
+
+// renameAcross moves a file between the backend and the log, e.g. the temp meta of a rekey over the meta name
+func (fs *metaStoreFs) renameAcross(oldname, newname string, oldIsEntry bool) error {
+	oldFile, err := fs.Open(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.Unwrap(err)}
+	}
+	data, err := io.ReadAll(oldFile)
+	_ = oldFile.Close()
+	if err != nil {
+		return err
+	}
+	if oldIsEntry {
+		if err := writeSyncedFile(fs.Fs, newname, data); err != nil {
+			return err
+		}
+	} else if err := fs.put(metaStoreKey(newname), data); err != nil {
+		return err
+	}
+	return fs.Remove(oldname)
+}
+
+func writeSyncedFile(fs afero.Fs, name string, data []byte) error {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (fs *metaStoreFs) Chmod(name string, mode os.FileMode) error {
+	if fs.isMetaStoreName(name) {
+		_, err := fs.entryInfo(name)
+		return err
+	}
+	return fs.Fs.Chmod(name, mode)
+}
+
+func (fs *metaStoreFs) Chown(name string, uid, gid int) error {
+	if fs.isMetaStoreName(name) {
+		_, err := fs.entryInfo(name)
+		return err
+	}
+	return fs.Fs.Chown(name, uid, gid)
+}
+
+func (fs *metaStoreFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if fs.isMetaStoreName(name) {
+		_, err := fs.entryInfo(name)
+		return err
+	}
+	return fs.Fs.Chtimes(name, atime, mtime)
+}
+
+// memMetaFile is an open meta file which is not a file of the backend, writes are kept in memory and handed to put
+// by Sync and Close
+type memMetaFile struct {
+	*mem.File
+	put      func(data []byte) error
+	writable bool
+	dirty    bool
+}
+
+// newMemMetaFile opens data like OpenFile with flag, a truncating open of an existing meta file writes it back even
+// without writes
+func newMemMetaFile(name string, data []byte, modTime time.Time, flag int, exists bool,
+	put func(data []byte) error) *memMetaFile {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	truncated := writable && flag&os.O_TRUNC != 0
+	fileData := mem.CreateFile(name)
+	memFile := mem.NewFileHandle(fileData)
+	if !truncated {
+		_, _ = memFile.Write(data)
+		if flag&os.O_APPEND == 0 {
+			_, _ = memFile.Seek(0, io.SeekStart)
+		}
+	}
+	mem.SetMode(fileData, 0600)
+	mem.SetModTime(fileData, modTime)
+	return &memMetaFile{File: memFile, put: put, writable: writable, dirty: truncated && exists}
+}
+
+func (f *memMetaFile) checkWritable(op string) error {
+	if !f.writable {
+		return &os.PathError{Op: op, Path: f.File.Name(), Err: syscall.EBADF}
+	}
+	f.dirty = true
+	return nil
+}
+
+func (f *memMetaFile) Write(b []byte) (int, error) {
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+	return f.File.Write(b)
+}
+
+func (f *memMetaFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(b, off)
+}
+
+func (f *memMetaFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *memMetaFile) Truncate(size int64) error {
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *memMetaFile) Sync() error {
+	if !f.dirty {
+		return nil
+	}
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, fileInfo.Size())
+	if _, err := f.File.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if err := f.put(data); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *memMetaFile) Close() error {
+	err := f.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// metaStoreDir lists the meta files of the log after the entries of the backend directory
+type metaStoreDir struct {
+	afero.File
+	fs      *metaStoreFs
+	name    string
+	listed  bool
+	pending []os.FileInfo
+}
+
+func (d *metaStoreDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		fileInfos, err := d.File.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		d.pending = append(fileInfos, d.fs.entryInfos(d.name)...)
+		d.listed = true
+	}
+	if count <= 0 {
+		fileInfos := d.pending
+		d.pending = nil
+		return fileInfos, nil
+	}
+	if len(d.pending) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.pending) {
+		count = len(d.pending)
+	}
+	fileInfos := d.pending[:count]
+	d.pending = d.pending[count:]
+	return fileInfos, nil
+}
+
+func (d *metaStoreDir) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := d.Readdir(n)
+	names := make([]string, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	return names, err
+}
@@ -0,0 +1,352 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// newTestMetaStoreEncFs returns an EncFs over a meta store loaded from mem
+func newTestMetaStoreEncFs(t *testing.T, mem afero.Fs) (*EncFs, *metaStoreFs) {
+	t.Helper()
+	metaStore, err := newMetaStoreFs(mem, &metaFileNaming{ext: EncFileExt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), metaStore).(*EncFs), metaStore
+}
+
+// metaStoreTestLines returns the records of the log in mem
+func metaStoreTestLines(t *testing.T, mem afero.Fs) []string {
+	t.Helper()
+	data := readTestFile(t, mem, "/"+META_STORE_FILE_NAME)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestMetaStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func(t *testing.T, encFs *EncFs)
+		wantFiles map[string]string
+	}{
+		{"write", func(t *testing.T, encFs *EncFs) {}, map[string]string{"/dir/a": "a", "/dir/sub/b": "b", "/c": "c"}},
+		{"overwrite", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, encFs, "/c", []byte("new c"))
+		}, map[string]string{"/dir/a": "a", "/dir/sub/b": "b", "/c": "new c"}},
+		{"append", func(t *testing.T, encFs *EncFs) {
+			writeTestAppend(t, encFs, "/c", []byte("c"))
+		}, map[string]string{"/dir/a": "a", "/dir/sub/b": "b", "/c": "cc"}},
+		{"rename file", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/a", "/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/a": "a", "/dir/sub/b": "b", "/c": "c"}},
+		{"rename over a file", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/a", "/c"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/dir/sub/b": "b", "/c": "a"}},
+		// the meta files below a renamed directory move with it
+		{"rename directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/moved/a": "a", "/moved/sub/b": "b", "/c": "c"}},
+		{"remove", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/c"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/dir/a": "a", "/dir/sub/b": "b"}},
+		{"remove all", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.RemoveAll("/dir"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/c": "c"}},
+		{"truncate", func(t *testing.T, encFs *EncFs) {
+			f, err := encFs.OpenFile("/c", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("truncated")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/dir/a": "a", "/dir/sub/b": "b", "/c": "truncated"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := afero.NewMemMapFs()
+			encFs, _ := newTestMetaStoreEncFs(t, mem)
+			if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/a", []byte("a"))
+			writeTestFile(t, encFs, "/dir/sub/b", []byte("b"))
+			writeTestFile(t, encFs, "/c", []byte("c"))
+			test.op(t, encFs)
+
+			// the backend holds the data files and the log only
+			wantNames := []string{"/" + META_STORE_FILE_NAME}
+			for name := range test.wantFiles {
+				wantNames = append(wantNames, name)
+			}
+			sort.Strings(wantNames)
+			var names []string
+			for name := range snapshotTestFs(t, mem) {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, wantNames) {
+				t.Fatalf("got backend files %q, want %q", names, wantNames)
+			}
+			// the log is replayed by a new meta store
+			reopened, _ := newTestMetaStoreEncFs(t, mem)
+			for _, fs := range []*EncFs{encFs, reopened} {
+				for name, data := range test.wantFiles {
+					checkTestFile(t, fs, name, []byte(data))
+				}
+				if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+					t.Fatalf("got %v, want not exist", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMetaStoreListing(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	encFs, metaStore := newTestMetaStoreEncFs(t, mem)
+	writeTestFile(t, encFs, "/a", []byte("a"))
+	writeTestFile(t, encFs, "/b", []byte("b"))
+	// meta names stay visible through the meta store, EncFs hides them
+	tests := []struct {
+		name      string
+		fs        afero.Fs
+		wantNames []string
+	}{
+		{"meta store", metaStore, []string{"a", "b", META_STORE_FILE_NAME, "a" + EncFileExt, "b" + EncFileExt}},
+		{"EncFs", encFs, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := test.fs.Open("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = dir.Close()
+			}()
+			var names []string
+			for {
+				// listed in batches across the backend entries and the log
+				batch, err := dir.Readdirnames(2)
+				names = append(names, batch...)
+				if err != nil || len(batch) == 0 {
+					break
+				}
+			}
+			sort.Strings(names)
+			wantNames := append([]string(nil), test.wantNames...)
+			sort.Strings(wantNames)
+			if !reflect.DeepEqual(names, wantNames) {
+				t.Fatalf("got names %q, want %q", names, wantNames)
+			}
+		})
+	}
+	fileInfo, err := metaStore.Stat("/a" + EncFileExt)
+	if err != nil || fileInfo.Size() == 0 {
+		t.Fatalf("got %v: %v", fileInfo, err)
+	}
+	if _, err := metaStore.OpenFile("/a"+EncFileExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); !os.IsExist(err) {
+		t.Fatalf("got %v, want exist", err)
+	}
+	if _, err := metaStore.OpenFile("/missing/a"+EncFileExt, os.O_WRONLY|os.O_CREATE, 0600); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+	f, err := metaStore.Open("/a" + EncFileExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Fatal("wrote a read only meta file")
+	}
+}
+
+func TestMetaStoreLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the log written by two files
+		damage    func(data []byte) []byte
+		wantFiles []string
+		wantErr   error
+	}{
+		{"intact", func(data []byte) []byte { return data }, []string{"/a", "/b"}, nil},
+		// a torn append of a crash is dropped
+		{"torn last record", func(data []byte) []byte {
+			return append(data, `{"op":"put","name":"/c`...)
+		}, []string{"/a", "/b"}, nil},
+		{"broken record", func(data []byte) []byte {
+			return append([]byte("not json\n"), data...)
+		}, nil, ErrMetaStoreBroken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := afero.NewMemMapFs()
+			encFs, _ := newTestMetaStoreEncFs(t, mem)
+			writeTestFile(t, encFs, "/a", []byte("a"))
+			writeTestFile(t, encFs, "/b", []byte("b"))
+			data := readTestFile(t, mem, "/"+META_STORE_FILE_NAME)
+			writeTestFile(t, mem, "/"+META_STORE_FILE_NAME, test.damage(data))
+
+			_, err := newMetaStoreFs(mem, &metaFileNaming{ext: EncFileExt})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			reopened, _ := newTestMetaStoreEncFs(t, mem)
+			for _, name := range test.wantFiles {
+				checkTestFile(t, reopened, name, []byte(name[1:]))
+			}
+			// new records follow the last complete line
+			writeTestFile(t, reopened, "/c", []byte("c"))
+			reopened, _ = newTestMetaStoreEncFs(t, mem)
+			checkTestFile(t, reopened, "/c", []byte("c"))
+			if data := readTestFile(t, mem, "/"+META_STORE_FILE_NAME); !bytes.HasSuffix(data, []byte("\n")) {
+				t.Fatal("the log does not end with a record")
+			}
+		})
+	}
+}
+
+func TestMetaStoreCompact(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	encFs, _ := newTestMetaStoreEncFs(t, mem)
+	writeTestFile(t, encFs, "/kept", []byte("kept"))
+	// every create and remove of a file supersedes records
+	for i := 0; i < metaStoreCompactMinGarbage; i++ {
+		writeTestFile(t, encFs, "/temp", []byte("temp"))
+		if err := encFs.Remove("/temp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := metaStoreTestLines(t, mem); len(lines) > metaStoreCompactMinGarbage {
+		t.Fatalf("the log holds %d records", len(lines))
+	}
+	if exists, err := afero.Exists(mem, "/"+META_STORE_TEMP_FILE_NAME); err != nil || exists {
+		t.Fatalf("the compaction temp file is left: %v", err)
+	}
+	reopened, _ := newTestMetaStoreEncFs(t, mem)
+	checkTestFile(t, reopened, "/kept", []byte("kept"))
+	if exists, err := afero.Exists(reopened, "/temp"); err != nil || exists {
+		t.Fatalf("a removed file is back: %v", err)
+	}
+}
+
+// metaStoreTestEntries returns the data of the entries of metaStore by name
+func metaStoreTestEntries(metaStore *metaStoreFs) map[string]string {
+	entries := make(map[string]string)
+	for name, entry := range metaStore.entries {
+		entries[name] = string(entry.data)
+	}
+	return entries
+}
+
+func TestMetaStoreCrash(t *testing.T) {
+	put := func(name, data string) func(fs afero.Fs) error {
+		return func(fs afero.Fs) error { return afero.WriteFile(fs, name+EncFileExt, []byte(data), 0600) }
+	}
+	// every op appends one record
+	ops := []struct {
+		name string
+		op   func(fs afero.Fs) error
+	}{
+		{"put", put("/a", "a")},
+		{"put in a directory", put("/dir/b", "b")},
+		{"put another", put("/dir/d", "d")},
+		{"overwrite", put("/a", "new a")},
+		{"rename", func(fs afero.Fs) error { return fs.Rename("/dir/b"+EncFileExt, "/b"+EncFileExt) }},
+		{"rename directory", func(fs afero.Fs) error { return fs.Rename("/dir", "/moved") }},
+		{"remove", func(fs afero.Fs) error { return fs.Remove("/a" + EncFileExt) }},
+		{"remove all", func(fs afero.Fs) error { return fs.RemoveAll("/moved") }},
+		{"put after remove", put("/e", "e")},
+	}
+	mem := afero.NewMemMapFs()
+	metaStore, err := newMetaStoreFs(mem, &metaFileNaming{ext: EncFileExt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// ends and wantEntries are the log size and the entries after each op
+	ends := []int{0}
+	wantEntries := []map[string]string{{}}
+	for i, op := range ops {
+		if err := op.op(metaStore); err != nil {
+			t.Fatalf("%s: %v", op.name, err)
+		}
+		if lines := metaStoreTestLines(t, mem); len(lines) != i+1 {
+			t.Fatalf("%s: got %d records, want %d", op.name, len(lines), i+1)
+		}
+		ends = append(ends, len(readTestFile(t, mem, "/"+META_STORE_FILE_NAME)))
+		wantEntries = append(wantEntries, metaStoreTestEntries(metaStore))
+	}
+	data := readTestFile(t, mem, "/"+META_STORE_FILE_NAME)
+
+	// a crash tears the log at any offset, a compaction of the crash may have left a torn temp file
+	for offset := 0; offset <= len(data); offset++ {
+		crashed := afero.NewMemMapFs()
+		writeTestFile(t, crashed, "/"+META_STORE_FILE_NAME, data[:offset])
+		writeTestFile(t, crashed, "/"+META_STORE_TEMP_FILE_NAME, data[:offset/2])
+		completed := 0
+		for completed+1 < len(ends) && ends[completed+1] <= offset {
+			completed++
+		}
+
+		reopened, err := newMetaStoreFs(crashed, &metaFileNaming{ext: EncFileExt})
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		// the records of the complete lines are kept, the torn one is dropped
+		if entries := metaStoreTestEntries(reopened); !reflect.DeepEqual(entries, wantEntries[completed]) {
+			t.Fatalf("offset %d: got %q, want %q after %d ops", offset, entries, wantEntries[completed], completed)
+		}
+		if err := afero.WriteFile(reopened, "/f"+EncFileExt, []byte("f"), 0600); err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if err := reopened.logFile.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// new records follow the kept ones and survive the next open
+		reopened, err = newMetaStoreFs(crashed, &metaFileNaming{ext: EncFileExt})
+		if err != nil {
+			t.Fatalf("offset %d: reopen: %v", offset, err)
+		}
+		wantAfterWrite := map[string]string{"/f" + EncFileExt: "f"}
+		for name, data := range wantEntries[completed] {
+			wantAfterWrite[name] = data
+		}
+		if entries := metaStoreTestEntries(reopened); !reflect.DeepEqual(entries, wantAfterWrite) {
+			t.Fatalf("offset %d: got %q after a write, want %q", offset, entries, wantAfterWrite)
+		}
+		if lines := metaStoreTestLines(t, crashed); len(lines) > completed+1 {
+			t.Fatalf("offset %d: got %d records, want at most %d", offset, len(lines), completed+1)
+		}
+	}
+}
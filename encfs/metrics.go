@@ -0,0 +1,139 @@
+package encfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// METRIC_OPERATIONS_TOTAL counts the audited operations of an EncFs by op and result
+	METRIC_OPERATIONS_TOTAL = "encfs_operations_total"
+	// METRIC_READS_TOTAL and METRIC_WRITES_TOTAL count the reads and writes of files, METRIC_READ_BYTES_TOTAL and
+	// METRIC_WRITTEN_BYTES_TOTAL their plaintext bytes
+	METRIC_READS_TOTAL         = "encfs_reads_total"
+	METRIC_WRITES_TOTAL        = "encfs_writes_total"
+	METRIC_READ_BYTES_TOTAL    = "encfs_read_bytes_total"
+	METRIC_WRITTEN_BYTES_TOTAL = "encfs_written_bytes_total"
+	// METRIC_ENCRYPTED_BYTES_TOTAL and METRIC_DECRYPTED_BYTES_TOTAL count the contents passing the cipher by cipher,
+	// reads served from the block cache are not decrypted
+	METRIC_ENCRYPTED_BYTES_TOTAL = "encfs_encrypted_bytes_total"
+	METRIC_DECRYPTED_BYTES_TOTAL = "encfs_decrypted_bytes_total"
+	// METRIC_KEYSTREAM_SECONDS observes the time of generating and applying the CTR keystream of a read or write
+	METRIC_KEYSTREAM_SECONDS = "encfs_keystream_seconds"
+	// METRIC_KMS_DECRYPT_SECONDS observes the time of decrypting a key, retries included, by provider, the scheme of a
+	// registered key provider or local for the local mini KMS, and result
+	METRIC_KMS_DECRYPT_SECONDS = "encfs_kms_decrypt_seconds"
+	// METRIC_CACHE_REQUESTS_TOTAL counts the lookups of the block cache, the Preload meta cache and the cached master
+	// key by cache and result, hit or miss
+	METRIC_CACHE_REQUESTS_TOTAL = "encfs_cache_requests_total"
+
+	METRIC_RESULT_OK    = "ok"
+	METRIC_RESULT_ERROR = "error"
+	METRIC_RESULT_HIT   = "hit"
+	METRIC_RESULT_MISS  = "miss"
+
+	METRIC_CACHE_BLOCK      = "block"
+	METRIC_CACHE_META       = "meta"
+	METRIC_CACHE_MASTER_KEY = "master_key"
+
+	METRIC_KMS_PROVIDER_LOCAL = "local"
+)
+
+// MetricsCollector receives the measurements of the package named by the METRIC constants, labels alternate label
+// names and values, implementations must be safe for concurrent use, NewPrometheusCollector exposes them to
+// Prometheus and other collectors adapt e.g. a Prometheus registry or OpenTelemetry
+type MetricsCollector interface {
+	// AddCounter adds value to the counter name
+	AddCounter(name string, value float64, labels ...string)
+	// ObserveHistogram records value, durations are in seconds, in the histogram name
+	ObserveHistogram(name string, value float64, labels ...string)
+}
+
+// packageMetricsCollector is read on every read and write, so it is not guarded by a mutex
+var packageMetricsCollector atomic.Pointer[metricsCollectorHolder]
+
+type metricsCollectorHolder struct {
+	metricsCollector MetricsCollector
+}
+
+// SetMetricsCollector sends the measurements of the package level functions, e.g. the KMS, and of every EncFs
+// without WithMetricsCollector to metricsCollector, nil disables them which is the default
+func SetMetricsCollector(metricsCollector MetricsCollector) {
+	packageMetricsCollector.Store(&metricsCollectorHolder{metricsCollector: metricsCollector})
+}
+
+func getPackageMetricsCollector() MetricsCollector {
+	if holder := packageMetricsCollector.Load(); holder != nil {
+		return holder.metricsCollector
+	}
+	return nil
+}
+
+// WithMetricsCollector sends the measurements of encFs to metricsCollector instead of the collector of
+// SetMetricsCollector, nil restores it
+func (encFs *EncFs) WithMetricsCollector(metricsCollector MetricsCollector) {
+	encFs.metricsCollector = metricsCollector
+}
+
+// getMetricsCollector returns nil when measurements are disabled, callers skip measuring then
+func (encFs *EncFs) getMetricsCollector() MetricsCollector {
+	if encFs == nil || encFs.metricsCollector == nil {
+		return getPackageMetricsCollector()
+	}
+	return encFs.metricsCollector
+}
+
+// countOperation counts an audited operation by its result
+func (encFs *EncFs) countOperation(op string, err *error) {
+	if metricsCollector := encFs.getMetricsCollector(); metricsCollector != nil {
+		metricsCollector.AddCounter(METRIC_OPERATIONS_TOTAL, 1, "op", op, "result", metricResult(err))
+	}
+}
+
+// countIo counts a read or write of n plaintext bytes
+func (encFs *EncFs) countIo(countName, bytesName string, n *int) {
+	if metricsCollector := encFs.getMetricsCollector(); metricsCollector != nil {
+		metricsCollector.AddCounter(countName, 1)
+		metricsCollector.AddCounter(bytesName, float64(*n))
+	}
+}
+
+// countCipherBytes counts n bytes encrypted or decrypted by contentCipher
+func (encFs *EncFs) countCipherBytes(encrypt bool, contentCipher string, n int) {
+	metricsCollector := encFs.getMetricsCollector()
+	if metricsCollector == nil {
+		return
+	}
+	name := METRIC_DECRYPTED_BYTES_TOTAL
+	if encrypt {
+		name = METRIC_ENCRYPTED_BYTES_TOTAL
+	}
+	metricsCollector.AddCounter(name, float64(n), "cipher", contentCipher)
+}
+
+// countCacheRequest counts a lookup of cache
+func (encFs *EncFs) countCacheRequest(cache string, hit bool) {
+	if metricsCollector := encFs.getMetricsCollector(); metricsCollector != nil {
+		addCacheRequest(metricsCollector, cache, hit)
+	}
+}
+
+func addCacheRequest(metricsCollector MetricsCollector, cache string, hit bool) {
+	result := METRIC_RESULT_MISS
+	if hit {
+		result = METRIC_RESULT_HIT
+	}
+	metricsCollector.AddCounter(METRIC_CACHE_REQUESTS_TOTAL, 1, "cache", cache, "result", result)
+}
+
+// observeSince records the seconds since start in the histogram name
+func observeSince(metricsCollector MetricsCollector, name string, start time.Time, labels ...string) {
+	metricsCollector.ObserveHistogram(name, time.Since(start).Seconds(), labels...)
+}
+
+func metricResult(err *error) string {
+	if err != nil && *err != nil {
+		return METRIC_RESULT_ERROR
+	}
+	return METRIC_RESULT_OK
+}
@@ -0,0 +1,263 @@
+package encfs
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// metricsTestCounter returns the value of the counter name with labels in c
+func metricsTestCounter(c *PrometheusCollector, name string, labels ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counters[name][formatPrometheusLabels(labels)]
+}
+
+// metricsTestReadAt reads size bytes at off of name in encFs
+func metricsTestReadAt(encFs *EncFs, name string, size int, off int64) error {
+	f, err := encFs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = f.ReadAt(make([]byte, size), off)
+	return err
+}
+
+// metricsTestWrite writes a new file in a single write
+func metricsTestWrite(encFs *EncFs) error {
+	f, err := encFs.OpenFile("/new", os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func TestEncFsMetrics(t *testing.T) {
+	type counter struct {
+		name   string
+		labels []string
+		want   float64
+	}
+	tests := []struct {
+		name   string
+		config func(encFs *EncFs) error
+		op     func(encFs *EncFs) error
+		// wantCounters are the counters of op only, wantKeystream tells whether the CTR keystream is observed
+		wantCounters  []counter
+		wantKeystream bool
+	}{
+		{"write", nil, metricsTestWrite, []counter{
+			{METRIC_WRITES_TOTAL, nil, 1},
+			{METRIC_WRITTEN_BYTES_TOTAL, nil, 4},
+			{METRIC_ENCRYPTED_BYTES_TOTAL, []string{"cipher", CIPHER_AES_CTR}, 4},
+			{METRIC_OPERATIONS_TOTAL, []string{"op", "open", "result", METRIC_RESULT_OK}, 1},
+		}, true},
+		{"read", nil, func(encFs *EncFs) error { return metricsTestReadAt(encFs, "/file", 4, 2) }, []counter{
+			{METRIC_READS_TOTAL, nil, 1},
+			{METRIC_READ_BYTES_TOTAL, nil, 4},
+			{METRIC_DECRYPTED_BYTES_TOTAL, []string{"cipher", CIPHER_AES_CTR}, 4},
+			{METRIC_WRITES_TOTAL, nil, 0},
+		}, true},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }, metricsTestWrite,
+			[]counter{
+				{METRIC_ENCRYPTED_BYTES_TOTAL, []string{"cipher", CIPHER_AES_GCM}, 4},
+				{METRIC_ENCRYPTED_BYTES_TOTAL, []string{"cipher", CIPHER_AES_CTR}, 0},
+			}, false},
+		{"error", nil, func(encFs *EncFs) error {
+			_ = encFs.Remove("/missing")
+			return nil
+		}, []counter{
+			{METRIC_OPERATIONS_TOTAL, []string{"op", "remove", "result", METRIC_RESULT_ERROR}, 1},
+			{METRIC_OPERATIONS_TOTAL, []string{"op", "remove", "result", METRIC_RESULT_OK}, 0},
+		}, false},
+		// the block is decrypted once by the miss, the hit is served from the cache
+		{"block cache", func(encFs *EncFs) error { return encFs.WithBlockCache(4096, 16) }, func(encFs *EncFs) error {
+			if err := metricsTestReadAt(encFs, "/file", 4, 0); err != nil {
+				return err
+			}
+			return metricsTestReadAt(encFs, "/file", 4, 8)
+		}, []counter{
+			{METRIC_CACHE_REQUESTS_TOTAL, []string{"cache", METRIC_CACHE_BLOCK, "result", METRIC_RESULT_MISS}, 1},
+			{METRIC_CACHE_REQUESTS_TOTAL, []string{"cache", METRIC_CACHE_BLOCK, "result", METRIC_RESULT_HIT}, 1},
+			{METRIC_DECRYPTED_BYTES_TOTAL, []string{"cipher", CIPHER_AES_CTR}, 4096},
+			{METRIC_READ_BYTES_TOTAL, nil, 8},
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if test.config != nil {
+				if err := test.config(encFs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeTestFile(t, encFs, "/file", testPattern(8192))
+			collector := NewPrometheusCollector()
+			encFs.WithMetricsCollector(collector)
+			if err := test.op(encFs); err != nil {
+				t.Fatal(err)
+			}
+			for _, counter := range test.wantCounters {
+				if got := metricsTestCounter(collector, counter.name, counter.labels...); got != counter.want {
+					t.Fatalf("got %s%v %v, want %v", counter.name, counter.labels, got, counter.want)
+				}
+			}
+			collector.mutex.Lock()
+			_, observed := collector.histograms[METRIC_KEYSTREAM_SECONDS]
+			collector.mutex.Unlock()
+			if observed != test.wantKeystream {
+				t.Fatalf("got keystream observed %v, want %v", observed, test.wantKeystream)
+			}
+		})
+	}
+}
+
+func TestMetricsCollectors(t *testing.T) {
+	defer SetMetricsCollector(nil)
+	packageCollector, encFsCollector := NewPrometheusCollector(), NewPrometheusCollector()
+	tests := []struct {
+		name                 string
+		setCollector         MetricsCollector
+		withCollector        MetricsCollector
+		wantPackageCollected bool
+		wantEncFsCollected   bool
+	}{
+		{"disabled", nil, nil, false, false},
+		{"package collector", packageCollector, nil, true, false},
+		{"EncFs collector", packageCollector, encFsCollector, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetMetricsCollector(test.setCollector)
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithMetricsCollector(test.withCollector)
+			for _, collector := range []*PrometheusCollector{packageCollector, encFsCollector} {
+				collector.mutex.Lock()
+				collector.counters = map[string]map[string]float64{}
+				collector.mutex.Unlock()
+			}
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, collected := range []struct {
+				collector *PrometheusCollector
+				want      bool
+			}{{packageCollector, test.wantPackageCollected}, {encFsCollector, test.wantEncFsCollected}} {
+				got := metricsTestCounter(collected.collector, METRIC_OPERATIONS_TOTAL, "op", "mkdir", "result",
+					METRIC_RESULT_OK) == 1
+				if got != collected.want {
+					t.Fatalf("got collected %v, want %v", got, collected.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrometheusCollector(t *testing.T) {
+	tests := []struct {
+		name       string
+		collect    func(c *PrometheusCollector)
+		wantOutput string
+	}{
+		{"empty", func(c *PrometheusCollector) {}, ""},
+		// series are sorted, label values escaped
+		{"counter", func(c *PrometheusCollector) {
+			c.AddCounter(METRIC_OPERATIONS_TOTAL, 1, "op", "stat", "result", "ok")
+			c.AddCounter(METRIC_OPERATIONS_TOTAL, 2, "op", "mkdir", "result", "ok")
+			c.AddCounter(METRIC_OPERATIONS_TOTAL, 1, "op", "stat", "result", "ok")
+			c.AddCounter("custom_total", 0.5, "path", "a\"b\\c\nd", "dangling")
+		}, `# TYPE custom_total counter
+custom_total{path="a\"b\\c\nd"} 0.5
+# HELP encfs_operations_total Operations of the encrypted filesystem by op and result.
+# TYPE encfs_operations_total counter
+encfs_operations_total{op="mkdir",result="ok"} 2
+encfs_operations_total{op="stat",result="ok"} 2
+`},
+		{"histogram", func(c *PrometheusCollector) {
+			c.ObserveHistogram("custom_seconds", 0.2)
+			c.ObserveHistogram("custom_seconds", 0.7)
+			c.ObserveHistogram("custom_seconds", 3)
+			c.ObserveHistogram("labeled_seconds", 1, "result", "ok")
+		}, `# TYPE custom_seconds histogram
+custom_seconds_bucket{le="0.5"} 1
+custom_seconds_bucket{le="1"} 2
+custom_seconds_bucket{le="+Inf"} 3
+custom_seconds_sum 3.9
+custom_seconds_count 3
+# TYPE labeled_seconds histogram
+labeled_seconds_bucket{result="ok",le="0.5"} 0
+labeled_seconds_bucket{result="ok",le="1"} 1
+labeled_seconds_bucket{result="ok",le="+Inf"} 1
+labeled_seconds_sum{result="ok"} 1
+labeled_seconds_count{result="ok"} 1
+`},
+		{"special values", func(c *PrometheusCollector) {
+			c.AddCounter("inf_total", math.Inf(1))
+			c.AddCounter("nan_total", math.NaN())
+			c.AddCounter("negative_total", math.Inf(-1))
+		}, `# TYPE inf_total counter
+inf_total +Inf
+# TYPE nan_total counter
+nan_total NaN
+# TYPE negative_total counter
+negative_total -Inf
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the buckets are sorted
+			c := NewPrometheusCollector(1, 0.5)
+			test.collect(c)
+			var output bytes.Buffer
+			n, err := c.WriteTo(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output.String() != test.wantOutput || n != int64(output.Len()) {
+				t.Fatalf("wrote %d bytes %q, want %q", n, output.String(), test.wantOutput)
+			}
+		})
+	}
+}
+
+func TestPrometheusCollectorServeHTTP(t *testing.T) {
+	c := NewPrometheusCollector()
+	c.AddCounter(METRIC_READS_TOTAL, 3)
+	tests := []struct {
+		method          string
+		wantStatus      int
+		wantContentType string
+		wantAllow       string
+		wantBody        string
+	}{
+		{http.MethodGet, http.StatusOK, PROMETHEUS_CONTENT_TYPE, "",
+			"# HELP encfs_reads_total Reads of encrypted files.\n# TYPE encfs_reads_total counter\nencfs_reads_total 3\n"},
+		{http.MethodHead, http.StatusOK, PROMETHEUS_CONTENT_TYPE, "", ""},
+		{http.MethodPost, http.StatusMethodNotAllowed, "text/plain; charset=utf-8", "GET, HEAD", "Method Not Allowed\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c.ServeHTTP(recorder, httptest.NewRequest(test.method, "/metrics", nil))
+			response := recorder.Result()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.wantStatus || response.Header.Get("Content-Type") != test.wantContentType ||
+				response.Header.Get("Allow") != test.wantAllow || string(body) != test.wantBody {
+				t.Fatalf("got %d %v %q", response.StatusCode, response.Header, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package encfs
+
+// EncryptFileNames returns the on-disk names of names in order, parent directories shared by several names
+// are encrypted once, for indexers and sync engines translating many paths at once
+func (encFs *EncFs) EncryptFileNames(names []string) []string {
+	memo := make(map[string]string)
+	encryptedNames := make([]string, len(names))
+	for i, name := range names {
+		encryptedNames[i] = encFs.encryptMemoizedFileName(name, memo)
+	}
+	return encryptedNames
+}
+
+// DecryptFileNames returns the plaintext names of on-disk encryptedNames in order, parts of shared prefixes
+// are decrypted once
+func (encFs *EncFs) DecryptFileNames(encryptedNames []string) []string {
+	memo := make(map[string]string)
+	names := make([]string, len(encryptedNames))
+	for i, encryptedName := range encryptedNames {
+		names[i] = encFs.key.decryptFileName(encryptedName, memo)
+	}
+	return names
+}
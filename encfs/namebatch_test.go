@@ -0,0 +1,63 @@
+package encfs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestBatchFileNames(t *testing.T) {
+	names := []string{"/", "/a", "/dir/b", "/dir/sub/c", "/dir/sub/d", "/dir/b", "/other/dir/b", "/new/name"}
+	tests := []struct {
+		name      string
+		newMapper func(base afero.Fs) NameMapper
+	}{
+		{"noop", func(base afero.Fs) NameMapper { return NewNoopNameMapper() }},
+		{"gcm", func(base afero.Fs) NameMapper { return NewGcmNameMapper(testKeyBytes(2), make([]byte, 12)) }},
+		{"siv", func(base afero.Fs) NameMapper { return NewSivNameMapper(testKeyBytes(2)) }},
+		{"hmac", func(base afero.Fs) NameMapper { return NewHmacNameMapperWithBackend(testKeyBytes(2), base) }},
+		{"random nonce", func(base afero.Fs) NameMapper {
+			return NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.newMapper(base)),
+				base).(*EncFs)
+			for _, dir := range []string{"/dir/sub", "/other/dir"} {
+				if err := encFs.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"/a", "/dir/b", "/dir/sub/c", "/dir/sub/d", "/other/dir/b"} {
+				writeTestFile(t, encFs, name, []byte(name))
+			}
+
+			encryptedNames := encFs.EncryptFileNames(names)
+			if len(encryptedNames) != len(names) {
+				t.Fatalf("got %d names, want %d", len(encryptedNames), len(names))
+			}
+			// a batch translates like one name at a time
+			for i, name := range names {
+				if want := encFs.encryptFileName(name); encryptedNames[i] != want {
+					t.Fatalf("%s encrypted to %s, want %s", name, encryptedNames[i], want)
+				}
+			}
+			// HMAC names can only be reversed once they were created
+			existingNames := names[:len(names)-1]
+			if got := encFs.DecryptFileNames(encryptedNames[:len(existingNames)]); !reflect.DeepEqual(got, existingNames) {
+				t.Fatalf("decrypted %q, want %q", got, existingNames)
+			}
+			for _, encryptedName := range encryptedNames[1:6] {
+				if exists, _ := afero.Exists(base, encryptedName); !exists {
+					t.Fatalf("%s does not exist", encryptedName)
+				}
+			}
+			if got := encFs.EncryptFileNames(nil); len(got) != 0 {
+				t.Fatalf("encrypted %q of no names", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	NAME_MODE_NOOP = "noop"
+	NAME_MODE_GCM  = "gcm"
+)
+
+// NameMapper maps one plaintext file name part to its on-disk name and back,
+// encryptedParentName is the on-disk path of the directory holding the part
+type NameMapper interface {
+	Mode() string
+	EncryptFileNamePart(encryptedParentName, name string) string
+	DecryptFileNamePart(encryptedParentName, encryptedName string) string
+}
+
+// nameDecrypter is implemented by name mappers reporting names which can not be decrypted,
+// DecryptFileNamePart returns them unchanged
+type nameDecrypter interface {
+	tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error)
+}
+
+// nameRecorder is implemented by name mappers keeping the names of a directory in the backend, recordFileNamePart is
+// called before a name is created or renamed to, forgetFileNamePart after it was removed or renamed away, lookups
+// by EncryptFileNamePart never change the backend
+type nameRecorder interface {
+	recordFileNamePart(encryptedParentName, name string) error
+	forgetFileNamePart(encryptedParentName, encryptedName string) error
+}
+
+type NoopNameMapper struct {
+}
+
+func NewNoopNameMapper() NameMapper {
+	return &NoopNameMapper{}
+}
+
+func (*NoopNameMapper) Mode() string { return NAME_MODE_NOOP }
+
+func (*NoopNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	return name
+}
+
+func (*NoopNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	return encryptedName
+}
+
+type GcmNameMapper struct {
+	key        []byte
+	fileNameIv []byte
+	aesgcm     cipher.AEAD
+}
+
+func NewGcmNameMapper(key []byte, fileNameIv []byte) NameMapper {
+	// cipher setup is done once, AEAD is safe for concurrent use
+	aesgcm, _ := newAesGcm(key)
+	return &GcmNameMapper{
+		key:        key,
+		fileNameIv: fileNameIv,
+		aesgcm:     aesgcm,
+	}
+}
+
+func (m *GcmNameMapper) getAesGcm() (cipher.AEAD, error) {
+	if m.aesgcm != nil {
+		return m.aesgcm, nil
+	}
+	return newAesGcm(m.key)
+}
+
+func (*GcmNameMapper) Mode() string { return NAME_MODE_GCM }
+
+func (m *GcmNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	if name == "" {
+		return name
+	}
+	aesgcm, err := m.getAesGcm()
+	if err != nil {
+		// should not happen, file name is not encrypted
+		return name
+	}
+	encryptedFileName := aesgcm.Seal(nil, m.fileNameIv, []byte(name), nil)
+	return fmt.Sprintf("%s%s", ENCRYPTED_FILE_NAME_PREFIX, base64.RawURLEncoding.EncodeToString(encryptedFileName))
+}
+
+func (m *GcmNameMapper) DecryptFileNamePart(encryptedParentName, encrytpedFileNamePart string) string {
+	if !strings.HasPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX) {
+		// file name is not encrypted
+		return encrytpedFileNamePart
+	}
+	prefixTrimedEncryptedFileName := strings.TrimPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX)
+	if _, err := base64.RawURLEncoding.DecodeString(prefixTrimedEncryptedFileName); err != nil {
+		// decode file name failed, file name should be incorrect
+		return prefixTrimedEncryptedFileName
+	}
+	name, err := m.tryDecryptFileNamePart(encryptedParentName, encrytpedFileNamePart)
+	if err != nil {
+		// should not happen, file name must be incorrect
+		return encrytpedFileNamePart
+	}
+	return name
+}
+
+func (m *GcmNameMapper) tryDecryptFileNamePart(encryptedParentName, encrytpedFileNamePart string) (string, error) {
+	if !strings.HasPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX) {
+		return encrytpedFileNamePart, nil
+	}
+	encryptedFileNameBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encrytpedFileNamePart, ENCRYPTED_FILE_NAME_PREFIX))
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	aesgcm, err := m.getAesGcm()
+	if err != nil {
+		return "", err
+	}
+	nameBytes, err := aesgcm.Open(nil, m.fileNameIv, encryptedFileNameBytes, nil)
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	return string(nameBytes), nil
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithRandomNonce encrypts data with AES/GCM, output is nonce followed by ciphertext
+func sealWithRandomNonce(key []byte, data []byte) ([]byte, error) {
+	aesgcm, err := newAesGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aesgcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// sealWithNonce seals like sealWithRandomNonce with a nonce of the caller, e.g. read from the random source of EncFs
+func sealWithNonce(key []byte, nonce []byte, data []byte) ([]byte, error) {
+	aesgcm, err := newAesGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesgcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func openWithRandomNonce(key []byte, sealedData []byte) ([]byte, error) {
+	aesgcm, err := newAesGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealedData) < aesgcm.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	nonce := sealedData[:aesgcm.NonceSize()]
+	data, err := aesgcm.Open(nil, nonce, sealedData[aesgcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return data, nil
+}
+
+// recordFileName records the encrypted parts of name before encryptedName is created or renamed to, parts which
+// exist unencrypted, e.g. the root of the volume, or pass through are skipped
+func (encFs *EncFs) recordFileName(name, encryptedName string) error {
+	recorder, ok := encFs.key.nameMapper.(nameRecorder)
+	if !ok || !encFs.key.isFileNameEncrypted() {
+		return nil
+	}
+	name, encryptedName = filepath.Clean(name), filepath.Clean(encryptedName)
+	for {
+		part, encryptedPart := filepath.Base(name), filepath.Base(encryptedName)
+		encryptedParentName := filepath.Dir(encryptedName)
+		if part == "." || part == string(filepath.Separator) || encryptedParentName == encryptedName {
+			return nil
+		}
+		if encFs.key.nameMapper.EncryptFileNamePart(encryptedParentName, part) == encryptedPart {
+			if err := recorder.recordFileNamePart(encryptedParentName, part); err != nil {
+				return &os.PathError{Op: "record", Path: encryptedName, Err: err}
+			}
+		}
+		name, encryptedName = filepath.Dir(name), encryptedParentName
+	}
+}
+
+// forgetFileName forgets the last part of encryptedName after it was removed or renamed away, a name left in the
+// backend is only a stale entry
+func (encFs *EncFs) forgetFileName(encryptedName string) {
+	recorder, ok := encFs.key.nameMapper.(nameRecorder)
+	if !ok || !encFs.key.isFileNameEncrypted() {
+		return
+	}
+	if err := recorder.forgetFileNamePart(filepath.Dir(encryptedName), filepath.Base(encryptedName)); err != nil {
+		encFs.getLogger().Warn("encfs forget file name failed", "path", encryptedName, "error", err)
+	}
+}
@@ -0,0 +1,230 @@
+package encfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	NAME_MODE_HMAC = "hmac"
+
+	HMAC_FILE_NAME_PREFIX      = "__ENCFSH__"
+	HMAC_NAME_LOOKUP_FILE_NAME = "__ENCFS_NAMES__" + EncFileExt
+	// the lookup table is written to the temp file and renamed over the table
+	HMAC_NAME_LOOKUP_TEMP_FILE_NAME = "__ENCFS_NAMES__.__newtable" + EncFileExt
+)
+
+// HmacNameMapper stores fixed length HMAC-SHA256 digests on disk, plaintext names
+// are encrypted and kept in a lookup file inside each directory
+type HmacNameMapper struct {
+	key               []byte
+	fs                afero.Fs
+	mutex             *sync.Mutex
+	lookupTables      map[string]map[string]string
+	dirtyLookupTables map[string]bool
+}
+
+func NewHmacNameMapper(key []byte) NameMapper {
+	return NewHmacNameMapperWithBackend(key, afero.NewOsFs())
+}
+
+// NewHmacNameMapperWithBackend keeps lookup files in base, base must be the backend of EncFs
+func NewHmacNameMapperWithBackend(key []byte, base afero.Fs) NameMapper {
+	return &HmacNameMapper{
+		key:               key,
+		fs:                base,
+		mutex:             &sync.Mutex{},
+		lookupTables:      make(map[string]map[string]string),
+		dirtyLookupTables: make(map[string]bool),
+	}
+}
+
+func (*HmacNameMapper) Mode() string { return NAME_MODE_HMAC }
+
+// EncryptFileNamePart only hashes name, the lookup table is changed by recordFileNamePart when the name is created
+func (m *HmacNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	if name == "" {
+		return name
+	}
+	return m.hmacFileNamePart(name)
+}
+
+func (m *HmacNameMapper) recordFileNamePart(encryptedParentName, name string) error {
+	if name == "" {
+		return nil
+	}
+	hmacName := m.hmacFileNamePart(name)
+	encryptedParentName = path.Clean(encryptedParentName)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lookupTable, err := m.loadLookupTable(encryptedParentName)
+	if err != nil {
+		// lookup table is broken, do not override it
+		return err
+	}
+	if _, found := lookupTable[hmacName]; !found {
+		encryptedName, err := m.encryptName(name)
+		if err != nil {
+			return err
+		}
+		lookupTable[hmacName] = encryptedName
+		m.dirtyLookupTables[encryptedParentName] = true
+	}
+	return m.flushLookupTables()
+}
+
+// forgetFileNamePart removes encryptedName from the lookup table of its directory, cached tables of a removed or
+// renamed directory and of its subdirectories are dropped
+func (m *HmacNameMapper) forgetFileNamePart(encryptedParentName, encryptedName string) error {
+	encryptedParentName = path.Clean(encryptedParentName)
+	dirName := path.Join(encryptedParentName, encryptedName)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for tableDirName := range m.lookupTables {
+		if tableDirName == dirName || strings.HasPrefix(tableDirName, dirName+"/") {
+			delete(m.lookupTables, tableDirName)
+			delete(m.dirtyLookupTables, tableDirName)
+		}
+	}
+	lookupTable, err := m.loadLookupTable(encryptedParentName)
+	if err != nil {
+		return err
+	}
+	if _, found := lookupTable[encryptedName]; !found {
+		return nil
+	}
+	delete(lookupTable, encryptedName)
+	m.dirtyLookupTables[encryptedParentName] = true
+	return m.flushLookupTables()
+}
+
+func (m *HmacNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	name, err := m.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+	if err != nil {
+		return encryptedName
+	}
+	return name
+}
+
+func (m *HmacNameMapper) tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error) {
+	if !strings.HasPrefix(encryptedName, HMAC_FILE_NAME_PREFIX) {
+		// file name is not encrypted
+		return encryptedName, nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_ = m.flushLookupTables()
+	lookupTable, err := m.loadLookupTable(path.Clean(encryptedParentName))
+	if err != nil {
+		return "", err
+	}
+	encryptedLookupName, found := lookupTable[encryptedName]
+	if !found {
+		// lost from lookup table, file name cannot be recovered
+		return "", ErrDecryptFailed
+	}
+	return m.decryptName(encryptedLookupName)
+}
+
+func (m *HmacNameMapper) hmacFileNamePart(name string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(name))
+	return fmt.Sprintf("%s%s", HMAC_FILE_NAME_PREFIX, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (m *HmacNameMapper) encryptName(name string) (string, error) {
+	encryptedName, err := sealWithRandomNonce(m.key, []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encryptedName), nil
+}
+
+func (m *HmacNameMapper) decryptName(encryptedName string) (string, error) {
+	encryptedNameBytes, err := base64.RawURLEncoding.DecodeString(encryptedName)
+	if err != nil {
+		return "", err
+	}
+	nameBytes, err := openWithRandomNonce(m.key, encryptedNameBytes)
+	if err != nil {
+		return "", err
+	}
+	return string(nameBytes), nil
+}
+
+func (m *HmacNameMapper) loadLookupTable(encryptedParentName string) (map[string]string, error) {
+	if lookupTable, found := m.lookupTables[encryptedParentName]; found {
+		return lookupTable, nil
+	}
+	lookupTable := make(map[string]string)
+	lookupFile, err := m.fs.Open(path.Join(encryptedParentName, HMAC_NAME_LOOKUP_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			m.lookupTables[encryptedParentName] = lookupTable
+			return lookupTable, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = lookupFile.Close()
+	}()
+	lookupTableBytes, err := io.ReadAll(lookupFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(lookupTableBytes, &lookupTable); err != nil {
+		return nil, ErrBadLookupTable
+	}
+	m.lookupTables[encryptedParentName] = lookupTable
+	return lookupTable, nil
+}
+
+// flushLookupTables saves changed lookup tables, tables of directories not yet
+// created are kept in memory until the directory exists
+func (m *HmacNameMapper) flushLookupTables() error {
+	var firstErr error
+	for encryptedParentName := range m.dirtyLookupTables {
+		if _, err := m.fs.Stat(encryptedParentName); err != nil {
+			continue
+		}
+		err := m.saveLookupTable(encryptedParentName, m.lookupTables[encryptedParentName])
+		if err == nil {
+			delete(m.dirtyLookupTables, encryptedParentName)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// saveLookupTable writes the table to a synced temp file renamed over the old table, a crash leaves the old or the
+// new table but never a truncated one which would lose every name of the directory
+func (m *HmacNameMapper) saveLookupTable(encryptedParentName string, lookupTable map[string]string) error {
+	lookupTableBytes, err := json.Marshal(lookupTable)
+	if err != nil {
+		return err
+	}
+	lookupFileName := path.Join(encryptedParentName, HMAC_NAME_LOOKUP_FILE_NAME)
+	tempName := path.Join(encryptedParentName, HMAC_NAME_LOOKUP_TEMP_FILE_NAME)
+	if err := writeSyncedFile(m.fs, tempName, lookupTableBytes); err != nil {
+		_ = m.fs.Remove(tempName)
+		return err
+	}
+	if err := m.fs.Rename(tempName, lookupFileName); err != nil {
+		_ = m.fs.Remove(tempName)
+		return err
+	}
+	return syncBackendPath(m.fs, encryptedParentName)
+}
@@ -0,0 +1,188 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func readTestLookupTable(t *testing.T, base afero.Fs, encryptedDirName string) map[string]string {
+	t.Helper()
+	lookupTable := make(map[string]string)
+	data, err := afero.ReadFile(base, path.Join(encryptedDirName, HMAC_NAME_LOOKUP_FILE_NAME))
+	if os.IsNotExist(err) {
+		return lookupTable
+	}
+	if err != nil {
+		t.Fatalf("read lookup table: %v", err)
+	}
+	if err := json.Unmarshal(data, &lookupTable); err != nil {
+		t.Fatalf("parse lookup table: %v", err)
+	}
+	return lookupTable
+}
+
+func TestHmacNameMapperLookupsDoNotChangeBackend(t *testing.T) {
+	encFs, base := newTestHmacEncFs()
+	writeTestFile(t, encFs, "/existing", []byte("data"))
+	before := snapshotTestFs(t, base)
+
+	lookups := []struct {
+		name string
+		call func() error
+	}{
+		{"stat missing", func() error { _, err := encFs.Stat("/missing"); return err }},
+		{"open missing", func() error { _, err := encFs.Open("/missing/child"); return err }},
+		{"lstat missing", func() error { _, _, err := encFs.LstatIfPossible("/missing2"); return err }},
+		{"remove missing", func() error { return encFs.Remove("/missing3") }},
+		{"stat existing", func() error { _, err := encFs.Stat("/existing"); return err }},
+	}
+	for _, lookup := range lookups {
+		t.Run(lookup.name, func(t *testing.T) {
+			_ = lookup.call()
+			if after := snapshotTestFs(t, base); !reflect.DeepEqual(after, before) {
+				t.Fatalf("backend changed by a lookup")
+			}
+		})
+	}
+}
+
+func TestHmacNameMapperRecordsCreatedNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, encFs *EncFs)
+		want  []string
+	}{
+		{
+			name:  "create",
+			setup: func(t *testing.T, encFs *EncFs) { writeTestFile(t, encFs, "/a", nil) },
+			want:  []string{"a"},
+		},
+		{
+			name: "mkdir and rename",
+			setup: func(t *testing.T, encFs *EncFs) {
+				if err := encFs.Mkdir("/dir", 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/b", nil)
+				if err := encFs.Rename("/b", "/c"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"c", "dir"},
+		},
+		{
+			name: "remove",
+			setup: func(t *testing.T, encFs *EncFs) {
+				writeTestFile(t, encFs, "/a", nil)
+				writeTestFile(t, encFs, "/b", nil)
+				if err := encFs.Remove("/a"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "remove all",
+			setup: func(t *testing.T, encFs *EncFs) {
+				if err := encFs.MkdirAll("/x/y", 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/x/y/z", nil)
+				writeTestFile(t, encFs, "/keep", nil)
+				if err := encFs.RemoveAll("/x"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"keep"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestHmacEncFs()
+			test.setup(t, encFs)
+
+			lookupTable := readTestLookupTable(t, base, "/")
+			var names []string
+			for hmacName, encryptedName := range lookupTable {
+				name, err := encFs.key.nameMapper.(*HmacNameMapper).decryptName(encryptedName)
+				if err != nil {
+					t.Fatalf("decrypt %s: %v", hmacName, err)
+				}
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, test.want) {
+				t.Fatalf("lookup table names %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestHmacNameMapperNestedNamesAreListed(t *testing.T) {
+	encFs, base := newTestHmacEncFs()
+	if err := encFs.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/a/b/c/file", []byte("x"))
+
+	// a new mapper reads every name from the backend
+	reopened := NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1),
+		NewHmacNameMapperWithBackend(testKeyBytes(2), base)), base)
+	for dir, want := range map[string]string{"/": "a", "/a": "b", "/a/b": "c", "/a/b/c": "file"} {
+		names, err := afero.ReadDir(reopened, dir)
+		if err != nil {
+			t.Fatalf("read dir %s: %v", dir, err)
+		}
+		if len(names) != 1 || names[0].Name() != want {
+			t.Fatalf("read dir %s: got %v, want %s", dir, names, want)
+		}
+	}
+	checkTestFile(t, reopened, "/a/b/c/file", []byte("x"))
+}
+
+// failingCreateFs fails creating files named failName
+type failingCreateFs struct {
+	afero.Fs
+	failName string
+}
+
+var errTestCreateFailed = errors.New("create failed")
+
+func (fs *failingCreateFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if path.Base(name) == fs.failName && flag&os.O_CREATE != 0 {
+		return nil, errTestCreateFailed
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func (fs *failingCreateFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func TestHmacNameMapperSaveKeepsOldTableOnFailure(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	base := &failingCreateFs{Fs: memFs}
+	key := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewHmacNameMapperWithBackend(testKeyBytes(2), base))
+	encFs := NewEncFsWithBackend(key, base)
+	writeTestFile(t, encFs, "/first", []byte("1"))
+	before := readTestLookupTable(t, memFs, "/")
+
+	base.failName = HMAC_NAME_LOOKUP_TEMP_FILE_NAME
+	if err := afero.WriteFile(encFs, "/second", []byte("2"), 0644); !errors.Is(err, errTestCreateFailed) {
+		t.Fatalf("create with failing lookup table: got %v, want %v", err, errTestCreateFailed)
+	}
+	if after := readTestLookupTable(t, memFs, "/"); !reflect.DeepEqual(after, before) {
+		t.Fatalf("lookup table changed by a failed save")
+	}
+	if _, err := memFs.Stat(path.Join("/", HMAC_NAME_LOOKUP_TEMP_FILE_NAME)); !os.IsNotExist(err) {
+		t.Fatalf("temp lookup table left behind: %v", err)
+	}
+	checkTestFile(t, encFs, "/first", []byte("1"))
+}
@@ -0,0 +1,177 @@
+package encfs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	LONG_FILE_NAME_PREFIX = "__ENCFSL__"
+	LONG_NAME_FILE_SUFFIX = ".__longname" + EncFileExt
+
+	// NAME_MAX of common file systems
+	FILE_NAME_MAX_LEN = 255
+	// encrypted names are hashed when meta, integrity and temp suffixes would not fit into FILE_NAME_MAX_LEN
+	LONG_FILE_NAME_MIN_LEN = FILE_NAME_MAX_LEN - 32
+)
+
+// LongNameMapper wraps a name mapper, encrypted names longer than LONG_FILE_NAME_MIN_LEN are replaced on disk by
+// LONG_FILE_NAME_PREFIX and the hash of the encrypted name, the full encrypted name is kept in the sidecar file
+// hashed name + LONG_NAME_FILE_SUFFIX next to it
+type LongNameMapper struct {
+	nameMapper NameMapper
+	fs         afero.Fs
+	mutex      *sync.Mutex
+	longNames  map[string]string
+}
+
+// NewLongNameMapperWithBackend keeps sidecar files in base, base must be the backend of EncFs
+func NewLongNameMapperWithBackend(nameMapper NameMapper, base afero.Fs) NameMapper {
+	return &LongNameMapper{
+		nameMapper: nameMapper,
+		fs:         base,
+		mutex:      &sync.Mutex{},
+		longNames:  make(map[string]string),
+	}
+}
+
+func (m *LongNameMapper) Mode() string { return m.nameMapper.Mode() }
+
+func isLongFileName(name string) bool {
+	return strings.HasPrefix(name, LONG_FILE_NAME_PREFIX)
+}
+
+func hashLongFileName(encryptedName string) string {
+	hash := sha256.Sum256([]byte(encryptedName))
+	return LONG_FILE_NAME_PREFIX + base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func (m *LongNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	encryptedName := m.nameMapper.EncryptFileNamePart(encryptedParentName, name)
+	if len(encryptedName) <= LONG_FILE_NAME_MIN_LEN {
+		return encryptedName
+	}
+	longName := hashLongFileName(encryptedName)
+	longNamePath := path.Join(encryptedParentName, longName)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, found := m.longNames[longNamePath]; found {
+		return longName
+	}
+	// sidecar files are written when the name is first used, like lookup tables of HMAC names
+	if err := m.writeLongName(longNamePath, encryptedName); err == nil {
+		m.longNames[longNamePath] = encryptedName
+	}
+	return longName
+}
+
+func (m *LongNameMapper) writeLongName(longNamePath, encryptedName string) error {
+	sidecarName := longNamePath + LONG_NAME_FILE_SUFFIX
+	if _, err := m.fs.Stat(sidecarName); err == nil {
+		return nil
+	}
+	file, err := m.fs.OpenFile(sidecarName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	_, err = file.Write([]byte(encryptedName))
+	return err
+}
+
+func (m *LongNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	name, err := m.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+	if err != nil {
+		return encryptedName
+	}
+	return name
+}
+
+func (m *LongNameMapper) tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error) {
+	if isLongFileName(encryptedName) {
+		fullEncryptedName, err := m.readLongName(path.Join(encryptedParentName, encryptedName))
+		if err != nil {
+			return "", err
+		}
+		encryptedName = fullEncryptedName
+	}
+	if decrypter, ok := m.nameMapper.(nameDecrypter); ok {
+		return decrypter.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+	}
+	return m.nameMapper.DecryptFileNamePart(encryptedParentName, encryptedName), nil
+}
+
+func (m *LongNameMapper) readLongName(longNamePath string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if encryptedName, found := m.longNames[longNamePath]; found {
+		return encryptedName, nil
+	}
+	encryptedNameBytes, err := afero.ReadFile(m.fs, longNamePath+LONG_NAME_FILE_SUFFIX)
+	if err != nil {
+		return "", ErrDecryptFailed
+	}
+	encryptedName := string(encryptedNameBytes)
+	if hashLongFileName(encryptedName) != path.Base(longNamePath) {
+		return "", ErrDecryptFailed
+	}
+	m.longNames[longNamePath] = encryptedName
+	return encryptedName, nil
+}
+
+func (m *LongNameMapper) recordFileNamePart(encryptedParentName, name string) error {
+	if recorder, ok := m.nameMapper.(nameRecorder); ok {
+		return recorder.recordFileNamePart(encryptedParentName, name)
+	}
+	return nil
+}
+
+// forgetFileNamePart is called before the sidecar of a long name is removed, so the wrapped name mapper gets the full
+// encrypted name
+func (m *LongNameMapper) forgetFileNamePart(encryptedParentName, encryptedName string) error {
+	recorder, ok := m.nameMapper.(nameRecorder)
+	if !ok {
+		return nil
+	}
+	if isLongFileName(encryptedName) {
+		fullEncryptedName, err := m.readLongName(path.Join(encryptedParentName, encryptedName))
+		if err != nil {
+			return err
+		}
+		encryptedName = fullEncryptedName
+	}
+	return recorder.forgetFileNamePart(encryptedParentName, encryptedName)
+}
+
+// forgetLongName removes the sidecar of a removed or renamed long name
+func (m *LongNameMapper) forgetLongName(longNamePath string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.longNames, longNamePath)
+	_ = m.fs.Remove(longNamePath + LONG_NAME_FILE_SUFFIX)
+}
+
+func (m *LongNameMapper) withKey(key []byte) NameMapper {
+	nameMapper := m.nameMapper
+	if derivable, ok := nameMapper.(derivableNameMapper); ok {
+		nameMapper = derivable.withKey(key)
+	}
+	return NewLongNameMapperWithBackend(nameMapper, m.fs)
+}
+
+// removeLongNameSidecar removes the sidecar of encryptedName after it was removed or renamed
+func (encFs *EncFs) removeLongNameSidecar(encryptedName string) {
+	longNameMapper, ok := encFs.key.nameMapper.(*LongNameMapper)
+	if !ok || !isLongFileName(path.Base(encryptedName)) {
+		return
+	}
+	longNameMapper.forgetLongName(encryptedName)
+}
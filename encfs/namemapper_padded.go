@@ -0,0 +1,84 @@
+package encfs
+
+import (
+	"strings"
+)
+
+// name lengths are padded to the first bucket they fit in, longer names to a multiple of the last bucket
+var nameLengthBuckets = []int{16, 32, 64}
+
+// PaddedNameMapper pads names with NUL bytes to 16, 32, 64 or a multiple of 64 bytes before the wrapped name mapper
+// encrypts them, so encrypted names do not reveal the plaintext name length, names without padding are still
+// decrypted but existing GCM, SIV and HMAC names are not found by their plaintext name, use it for new volumes
+type PaddedNameMapper struct {
+	nameMapper NameMapper
+}
+
+func NewPaddedNameMapper(nameMapper NameMapper) NameMapper {
+	return &PaddedNameMapper{
+		nameMapper: nameMapper,
+	}
+}
+
+func (m *PaddedNameMapper) Mode() string { return m.nameMapper.Mode() }
+
+func padFileNamePart(name string) string {
+	paddedLen := 0
+	for _, bucket := range nameLengthBuckets {
+		if len(name) <= bucket {
+			paddedLen = bucket
+			break
+		}
+	}
+	if paddedLen == 0 {
+		lastBucket := nameLengthBuckets[len(nameLengthBuckets)-1]
+		paddedLen = (len(name) + lastBucket - 1) / lastBucket * lastBucket
+	}
+	// file names never contain NUL, so the padding is removed unambiguously
+	return name + strings.Repeat("\x00", paddedLen-len(name))
+}
+
+func unpadFileNamePart(name string) string {
+	return strings.TrimRight(name, "\x00")
+}
+
+func (m *PaddedNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	if name == "" {
+		return name
+	}
+	return m.nameMapper.EncryptFileNamePart(encryptedParentName, padFileNamePart(name))
+}
+
+func (m *PaddedNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	return unpadFileNamePart(m.nameMapper.DecryptFileNamePart(encryptedParentName, encryptedName))
+}
+
+func (m *PaddedNameMapper) tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error) {
+	if decrypter, ok := m.nameMapper.(nameDecrypter); ok {
+		name, err := decrypter.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+		return unpadFileNamePart(name), err
+	}
+	return m.DecryptFileNamePart(encryptedParentName, encryptedName), nil
+}
+
+func (m *PaddedNameMapper) recordFileNamePart(encryptedParentName, name string) error {
+	if recorder, ok := m.nameMapper.(nameRecorder); ok && name != "" {
+		return recorder.recordFileNamePart(encryptedParentName, padFileNamePart(name))
+	}
+	return nil
+}
+
+func (m *PaddedNameMapper) forgetFileNamePart(encryptedParentName, encryptedName string) error {
+	if recorder, ok := m.nameMapper.(nameRecorder); ok {
+		return recorder.forgetFileNamePart(encryptedParentName, encryptedName)
+	}
+	return nil
+}
+
+func (m *PaddedNameMapper) withKey(key []byte) NameMapper {
+	nameMapper := m.nameMapper
+	if derivable, ok := nameMapper.(derivableNameMapper); ok {
+		nameMapper = derivable.withKey(key)
+	}
+	return NewPaddedNameMapper(nameMapper)
+}
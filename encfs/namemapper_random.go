@@ -0,0 +1,138 @@
+package encfs
+
+import (
+	"encoding/base64"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	NAME_MODE_RANDOM_NONCE = "random-nonce"
+
+	RANDOM_NONCE_FILE_NAME_PREFIX = "__ENCFSR__"
+	// format flag, first byte of every encoded name
+	RANDOM_NONCE_NAME_FORMAT_V1 byte = 1
+)
+
+// RandomNonceNameMapper encrypts every name with AES/GCM and its own random nonce stored in the name,
+// same names in different places do not match on disk, plaintext names of a directory are found by
+// decrypting its listing once
+type RandomNonceNameMapper struct {
+	key         []byte
+	fs          afero.Fs
+	mutex       *sync.Mutex
+	nameIndexes map[string]map[string]string
+}
+
+func NewRandomNonceNameMapper(key []byte) NameMapper {
+	return NewRandomNonceNameMapperWithBackend(key, afero.NewOsFs())
+}
+
+// NewRandomNonceNameMapperWithBackend lists directories of base, base must be the backend of EncFs
+func NewRandomNonceNameMapperWithBackend(key []byte, base afero.Fs) NameMapper {
+	return &RandomNonceNameMapper{
+		key:         key,
+		fs:          base,
+		mutex:       &sync.Mutex{},
+		nameIndexes: make(map[string]map[string]string),
+	}
+}
+
+func (*RandomNonceNameMapper) Mode() string { return NAME_MODE_RANDOM_NONCE }
+
+func (m *RandomNonceNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	if name == "" {
+		return name
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	nameIndex := m.loadNameIndex(encryptedParentName)
+	if encryptedName, found := nameIndex[name]; found {
+		return encryptedName
+	}
+	sealedName, err := sealWithRandomNonce(m.key, []byte(name))
+	if err != nil {
+		// should not happen, file name is not encrypted
+		return name
+	}
+	encryptedName := RANDOM_NONCE_FILE_NAME_PREFIX +
+		base64.RawURLEncoding.EncodeToString(append([]byte{RANDOM_NONCE_NAME_FORMAT_V1}, sealedName...))
+	// names not created yet are kept, so the same name is used when it is created
+	nameIndex[name] = encryptedName
+	return encryptedName
+}
+
+func (m *RandomNonceNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	name, err := m.decryptName(encryptedName)
+	if err != nil {
+		return encryptedName
+	}
+	return name
+}
+
+func (m *RandomNonceNameMapper) tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error) {
+	return m.decryptName(encryptedName)
+}
+
+func (m *RandomNonceNameMapper) decryptName(encryptedName string) (string, error) {
+	if !strings.HasPrefix(encryptedName, RANDOM_NONCE_FILE_NAME_PREFIX) {
+		// file name is not encrypted
+		return encryptedName, nil
+	}
+	encodedName, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encryptedName, RANDOM_NONCE_FILE_NAME_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	if len(encodedName) == 0 || encodedName[0] != RANDOM_NONCE_NAME_FORMAT_V1 {
+		return "", ErrUnsupportedFormatVersion
+	}
+	nameBytes, err := openWithRandomNonce(m.key, encodedName[1:])
+	if err != nil {
+		return "", err
+	}
+	return string(nameBytes), nil
+}
+
+// loadNameIndex decrypts the listing of a directory once, names created by other processes afterwards
+// are not seen, when a name exists twice the smallest encrypted name wins
+func (m *RandomNonceNameMapper) loadNameIndex(encryptedParentName string) map[string]string {
+	if nameIndex, found := m.nameIndexes[encryptedParentName]; found {
+		return nameIndex
+	}
+	nameIndex := make(map[string]string)
+	m.nameIndexes[encryptedParentName] = nameIndex
+	dir, err := m.fs.Open(encryptedParentName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// listing failed, names created now may duplicate existing ones
+			delete(m.nameIndexes, encryptedParentName)
+		}
+		return nameIndex
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	encryptedNames, err := dir.Readdirnames(-1)
+	if err != nil {
+		delete(m.nameIndexes, encryptedParentName)
+		return nameIndex
+	}
+	sort.Strings(encryptedNames)
+	for _, encryptedName := range encryptedNames {
+		if !strings.HasPrefix(encryptedName, RANDOM_NONCE_FILE_NAME_PREFIX) {
+			continue
+		}
+		name, err := m.decryptName(encryptedName)
+		if err != nil {
+			continue
+		}
+		if _, found := nameIndex[name]; !found {
+			nameIndex[name] = encryptedName
+		}
+	}
+	return nameIndex
+}
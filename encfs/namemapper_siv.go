@@ -0,0 +1,122 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	NAME_MODE_SIV = "siv"
+
+	SIV_FILE_NAME_PREFIX = "__ENCFSS__"
+	// format flag, first byte of every encoded name
+	SIV_NAME_FORMAT_V1 byte = 1
+
+	SIV_NAME_ENC_KEY_INFO = "encfs-afero siv name enc key"
+	SIV_NAME_MAC_KEY_INFO = "encfs-afero siv name mac key"
+
+	sivNameIvSize = 16
+)
+
+// SivNameMapper encrypts names deterministically with a synthetic IV, the IV is the truncated HMAC-SHA256 of the
+// name and also authenticates it, AES/CTR with the IV encrypts the name, equal names only leak their equality
+type SivNameMapper struct {
+	encKey           []byte
+	macKey           []byte
+	block            cipher.Block
+	legacyNameMapper *GcmNameMapper
+	fs               afero.Fs
+}
+
+func NewSivNameMapper(key []byte) NameMapper {
+	return NewSivNameMapperWithLegacyGcmNames(key, nil, nil)
+}
+
+// NewSivNameMapperWithLegacyGcmNames lets SIV names coexist with names of NewGcmNameMapper(key, fileNameIv) in
+// base, existing GCM names are found and decrypted, new names are SIV names, base must be the backend of EncFs
+func NewSivNameMapperWithLegacyGcmNames(key []byte, fileNameIv []byte, base afero.Fs) NameMapper {
+	encKey := hkdfSha256(key, nil, []byte(SIV_NAME_ENC_KEY_INFO), 32)
+	// cipher setup is done once, the block is safe for concurrent use
+	block, _ := aes.NewCipher(encKey)
+	m := &SivNameMapper{
+		encKey: encKey,
+		macKey: hkdfSha256(key, nil, []byte(SIV_NAME_MAC_KEY_INFO), 32),
+		block:  block,
+	}
+	if fileNameIv != nil && base != nil {
+		m.legacyNameMapper = NewGcmNameMapper(key, fileNameIv).(*GcmNameMapper)
+		m.fs = base
+	}
+	return m
+}
+
+func (*SivNameMapper) Mode() string { return NAME_MODE_SIV }
+
+func (m *SivNameMapper) syntheticIv(name []byte) []byte {
+	mac := hmac.New(sha256.New, m.macKey)
+	mac.Write([]byte{SIV_NAME_FORMAT_V1})
+	mac.Write(name)
+	return mac.Sum(nil)[:sivNameIvSize]
+}
+
+func (m *SivNameMapper) EncryptFileNamePart(encryptedParentName, name string) string {
+	if name == "" || m.block == nil {
+		// block is nil for invalid keys, file name is not encrypted
+		return name
+	}
+	if m.legacyNameMapper != nil {
+		legacyName := m.legacyNameMapper.EncryptFileNamePart(encryptedParentName, name)
+		if _, err := m.fs.Stat(path.Join(encryptedParentName, legacyName)); err == nil {
+			return legacyName
+		}
+	}
+	iv := m.syntheticIv([]byte(name))
+	encoded := make([]byte, 1+sivNameIvSize+len(name))
+	encoded[0] = SIV_NAME_FORMAT_V1
+	copy(encoded[1:], iv)
+	cipher.NewCTR(m.block, iv).XORKeyStream(encoded[1+sivNameIvSize:], []byte(name))
+	return SIV_FILE_NAME_PREFIX + base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func (m *SivNameMapper) DecryptFileNamePart(encryptedParentName, encryptedName string) string {
+	name, err := m.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+	if err != nil {
+		return encryptedName
+	}
+	return name
+}
+
+func (m *SivNameMapper) tryDecryptFileNamePart(encryptedParentName, encryptedName string) (string, error) {
+	if m.legacyNameMapper != nil && strings.HasPrefix(encryptedName, ENCRYPTED_FILE_NAME_PREFIX) {
+		return m.legacyNameMapper.tryDecryptFileNamePart(encryptedParentName, encryptedName)
+	}
+	if !strings.HasPrefix(encryptedName, SIV_FILE_NAME_PREFIX) {
+		// file name is not encrypted
+		return encryptedName, nil
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encryptedName, SIV_FILE_NAME_PREFIX))
+	if err != nil || len(encoded) < 1+sivNameIvSize || encoded[0] != SIV_NAME_FORMAT_V1 || m.block == nil {
+		return "", ErrDecryptFailed
+	}
+	iv := encoded[1 : 1+sivNameIvSize]
+	name := make([]byte, len(encoded)-1-sivNameIvSize)
+	cipher.NewCTR(m.block, iv).XORKeyStream(name, encoded[1+sivNameIvSize:])
+	if !hmac.Equal(iv, m.syntheticIv(name)) {
+		return "", ErrDecryptFailed
+	}
+	return string(name), nil
+}
+
+func (m *SivNameMapper) withKey(key []byte) NameMapper {
+	if m.legacyNameMapper != nil {
+		return NewSivNameMapperWithLegacyGcmNames(key, m.legacyNameMapper.fileNameIv, m.fs)
+	}
+	return NewSivNameMapper(key)
+}
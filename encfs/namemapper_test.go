@@ -0,0 +1,320 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestNameMappersThroughEncFs(t *testing.T) {
+	longName := strings.Repeat("long name ", 30)
+	tests := []struct {
+		name      string
+		newMapper func(base afero.Fs) NameMapper
+		longNames bool
+	}{
+		{"gcm", func(base afero.Fs) NameMapper { return NewGcmNameMapper(testKeyBytes(2), make([]byte, 12)) }, false},
+		{"siv", func(base afero.Fs) NameMapper { return NewSivNameMapper(testKeyBytes(2)) }, false},
+		{"hmac", func(base afero.Fs) NameMapper { return NewHmacNameMapperWithBackend(testKeyBytes(2), base) }, false},
+		{"random nonce", func(base afero.Fs) NameMapper {
+			return NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+		}, false},
+		{"padded siv", func(base afero.Fs) NameMapper {
+			return NewPaddedNameMapper(NewSivNameMapper(testKeyBytes(2)))
+		}, false},
+		{"long siv", func(base afero.Fs) NameMapper {
+			return NewLongNameMapperWithBackend(NewSivNameMapper(testKeyBytes(2)), base)
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names := []string{"a", "file.txt", "名前 with spaces"}
+			// names longer than the backend allows need the long name mapper
+			if test.longNames {
+				names = append(names, longName)
+			}
+			base := afero.NewMemMapFs()
+			key := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.newMapper(base))
+			encFs := NewEncFsWithBackend(key, base).(*EncFs)
+			if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				writeTestFile(t, encFs, "/dir/sub/"+name, []byte(name))
+			}
+			for name := range snapshotTestFs(t, base) {
+				if strings.Contains(name, "file.txt") || strings.Contains(name, "/sub/") {
+					t.Fatalf("backend name %s contains a plaintext name", name)
+				}
+			}
+
+			// a new EncFs finds the files by their plaintext names
+			encFs = NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.newMapper(base)),
+				base).(*EncFs)
+			for _, name := range names {
+				checkTestFile(t, encFs, "/dir/sub/"+name, []byte(name))
+			}
+			got, err := afero.ReadDir(encFs, "/dir/sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotNames []string
+			for _, fileInfo := range got {
+				gotNames = append(gotNames, fileInfo.Name())
+			}
+			sort.Strings(names)
+			sort.Strings(gotNames)
+			if !reflect.DeepEqual(gotNames, names) {
+				t.Fatalf("listed %q, want %q", gotNames, names)
+			}
+
+			if err := encFs.Rename("/dir/sub/a", "/dir/b"); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/dir/b", []byte("a"))
+			if _, err := encFs.Stat("/dir/sub/a"); !os.IsNotExist(err) {
+				t.Fatalf("renamed file still exists: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeterministicNameMappers(t *testing.T) {
+	tests := []struct {
+		name   string
+		mapper NameMapper
+	}{
+		{"gcm", NewGcmNameMapper(testKeyBytes(2), make([]byte, 12))},
+		{"siv", NewSivNameMapper(testKeyBytes(2))},
+		{"padded siv", NewPaddedNameMapper(NewSivNameMapper(testKeyBytes(2)))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"a", "b", "a.txt", strings.Repeat("x", 100)} {
+				encryptedName := test.mapper.EncryptFileNamePart("/parent", name)
+				if encryptedName == name || len(name) > 3 && strings.Contains(encryptedName, name) {
+					t.Fatalf("%q is not encrypted: %q", name, encryptedName)
+				}
+				if again := test.mapper.EncryptFileNamePart("/parent", name); again != encryptedName {
+					t.Fatalf("%q encrypted to %q and %q", name, encryptedName, again)
+				}
+				if decryptedName := test.mapper.DecryptFileNamePart("/parent", encryptedName); decryptedName != name {
+					t.Fatalf("%q decrypted to %q", name, decryptedName)
+				}
+			}
+			// names of the same length only differ in content
+			if a, b := test.mapper.EncryptFileNamePart("/", "a"), test.mapper.EncryptFileNamePart("/", "b"); a == b ||
+				len(a) != len(b) {
+				t.Fatalf("a and b encrypted to %q and %q", a, b)
+			}
+			// a tampered name is not decrypted to a different name
+			encryptedName := []byte(test.mapper.EncryptFileNamePart("/", "name"))
+			encryptedName[len(encryptedName)-2] ^= 1
+			decrypter, ok := test.mapper.(nameDecrypter)
+			if !ok {
+				return
+			}
+			if name, err := decrypter.tryDecryptFileNamePart("/", string(encryptedName)); err == nil &&
+				!bytes.Equal([]byte(name), encryptedName) {
+				t.Fatalf("tampered name decrypted to %q", name)
+			}
+		})
+	}
+}
+
+func TestPaddedNameMapperHidesLength(t *testing.T) {
+	mapper := NewPaddedNameMapper(NewSivNameMapper(testKeyBytes(2)))
+	tests := []struct {
+		a, b     string
+		sameSize bool
+	}{
+		{"a", strings.Repeat("a", 16), true},
+		{"a", strings.Repeat("a", 17), false},
+		{strings.Repeat("a", 65), strings.Repeat("a", 128), true},
+	}
+	for _, test := range tests {
+		a, b := mapper.EncryptFileNamePart("/", test.a), mapper.EncryptFileNamePart("/", test.b)
+		if (len(a) == len(b)) != test.sameSize {
+			t.Fatalf("%d and %d byte names encrypted to %d and %d bytes", len(test.a), len(test.b), len(a), len(b))
+		}
+	}
+}
+
+func TestRandomNonceNameMapper(t *testing.T) {
+	base := afero.NewMemMapFs()
+	mapper := NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+	encryptedName := mapper.EncryptFileNamePart("/a", "name")
+	sealedName, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encryptedName, RANDOM_NONCE_FILE_NAME_PREFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedName[len(sealedName)-1] ^= 1
+	tests := []struct {
+		name          string
+		encryptedName string
+		wantName      string
+		wantErr       error
+	}{
+		{"name", encryptedName, "name", nil},
+		{"unencrypted", "plain", "plain", nil},
+		{"unknown format", RANDOM_NONCE_FILE_NAME_PREFIX + base64.RawURLEncoding.EncodeToString([]byte{2, 0, 0}), "",
+			ErrUnsupportedFormatVersion},
+		{"tampered", RANDOM_NONCE_FILE_NAME_PREFIX + base64.RawURLEncoding.EncodeToString(sealedName), "",
+			ErrDecryptFailed},
+		{"other key", NewRandomNonceNameMapperWithBackend(testKeyBytes(3), base).EncryptFileNamePart("/", "name"),
+			"", ErrDecryptFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := mapper.(nameDecrypter).tryDecryptFileNamePart("/a", test.encryptedName)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && name != test.wantName {
+				t.Fatalf("got %q, want %q", name, test.wantName)
+			}
+		})
+	}
+
+	// names not created yet are kept, the same name in other directories does not match on disk
+	if again := mapper.EncryptFileNamePart("/a", "name"); again != encryptedName {
+		t.Fatalf("name encrypted to %q and %q", encryptedName, again)
+	}
+	if other := mapper.EncryptFileNamePart("/b", "name"); other == encryptedName {
+		t.Fatal("same encrypted name in two directories")
+	}
+	// of two encrypted names of the same name the smallest wins
+	names := []string{
+		mapper.EncryptFileNamePart("/x", "dup"),
+		NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base).EncryptFileNamePart("/y", "dup"),
+	}
+	for _, name := range names {
+		writeTestFile(t, base, "/dir/"+name, nil)
+	}
+	sort.Strings(names)
+	listingMapper := NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+	if got := listingMapper.EncryptFileNamePart("/dir", "dup"); got != names[0] {
+		t.Fatalf("got %q, want %q", got, names[0])
+	}
+}
+
+func TestLongNameMapper(t *testing.T) {
+	longName := strings.Repeat("long name ", 30)
+	longDir := "/" + strings.Repeat("long directory ", 20)
+	tests := []struct {
+		name      string
+		newMapper func(base afero.Fs) NameMapper
+	}{
+		{"siv", func(base afero.Fs) NameMapper { return NewSivNameMapper(testKeyBytes(2)) }},
+		{"gcm", func(base afero.Fs) NameMapper { return NewGcmNameMapper(testKeyBytes(2), make([]byte, 12)) }},
+		{"padded siv", func(base afero.Fs) NameMapper { return NewPaddedNameMapper(NewSivNameMapper(testKeyBytes(2))) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			newEncFs := func() *EncFs {
+				nameMapper := NewLongNameMapperWithBackend(test.newMapper(base), base)
+				return NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), nameMapper),
+					base).(*EncFs)
+			}
+			encFs := newEncFs()
+			if err := encFs.MkdirAll(longDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"/short", "/" + longName, longDir + "/" + longName} {
+				writeTestFile(t, encFs, name, []byte(name))
+			}
+			sidecars := 0
+			for name := range snapshotTestFs(t, base) {
+				for _, part := range strings.Split(name, "/") {
+					if len(part) > FILE_NAME_MAX_LEN {
+						t.Fatalf("backend name %s is too long", part)
+					}
+				}
+				if strings.HasSuffix(name, LONG_NAME_FILE_SUFFIX) {
+					sidecars++
+				}
+			}
+			// the long directory and the long names in the root and in it
+			if sidecars != 3 {
+				t.Fatalf("got %d long name sidecars, want 3", sidecars)
+			}
+
+			// a new EncFs reads the full names from the sidecars, which are not listed
+			encFs = newEncFs()
+			checkTestFile(t, encFs, "/"+longName, []byte("/"+longName))
+			checkTestFile(t, encFs, longDir+"/"+longName, []byte(longDir+"/"+longName))
+			names, err := afero.ReadDir(encFs, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotNames []string
+			for _, fileInfo := range names {
+				gotNames = append(gotNames, fileInfo.Name())
+			}
+			wantNames := []string{longDir[1:], longName, "short"}
+			sort.Strings(gotNames)
+			sort.Strings(wantNames)
+			if !reflect.DeepEqual(gotNames, wantNames) {
+				t.Fatalf("listed %q, want %q", gotNames, wantNames)
+			}
+
+			// sidecars of renamed and removed long names are removed
+			if err := encFs.Rename("/"+longName, "/renamed"); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.Remove(longDir + "/" + longName); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/renamed", []byte("/"+longName))
+			sidecars = 0
+			for name := range snapshotTestFs(t, base) {
+				if strings.HasSuffix(name, LONG_NAME_FILE_SUFFIX) {
+					sidecars++
+				}
+			}
+			if sidecars != 1 {
+				t.Fatalf("got %d long name sidecars, want the one of the directory", sidecars)
+			}
+		})
+	}
+}
+
+func TestLongNameMapperTamperedSidecar(t *testing.T) {
+	base := afero.NewMemMapFs()
+	longName := strings.Repeat("long name ", 30)
+	nameMapper := NewLongNameMapperWithBackend(NewSivNameMapper(testKeyBytes(2)), base)
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), nameMapper), base).(*EncFs)
+	writeTestFile(t, encFs, "/"+longName, []byte("data"))
+	encryptedName := encFs.encryptFileName("/" + longName)
+	if !isLongFileName(strings.TrimPrefix(encryptedName, "/")) {
+		t.Fatalf("got encrypted name %s", encryptedName)
+	}
+	tests := []struct {
+		name    string
+		sidecar []byte
+	}{
+		{"other name", []byte("other")},
+		{"empty", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := afero.WriteFile(base, encryptedName+LONG_NAME_FILE_SUFFIX, test.sidecar, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// a new mapper has no cached names, a sidecar not matching the hash is refused
+			reopened := NewLongNameMapperWithBackend(NewSivNameMapper(testKeyBytes(2)), base).(*LongNameMapper)
+			if _, err := reopened.tryDecryptFileNamePart("/", strings.TrimPrefix(encryptedName, "/")); !errors.Is(err,
+				ErrDecryptFailed) {
+				t.Fatalf("got %v, want %v", err, ErrDecryptFailed)
+			}
+		})
+	}
+}
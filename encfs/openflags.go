@@ -0,0 +1,53 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+)
+
+type OpenFlagsPolicy int
+
+const (
+	// O_WRONLY and O_APPEND of files which must be read to be encrypted are emulated on a read write handle,
+	// meaningless combinations are passed to the backend
+	OPEN_FLAGS_POLICY_EMULATE OpenFlagsPolicy = iota
+	// combinations with undefined or half working behavior are refused with ErrUnsupportedOpenFlags
+	OPEN_FLAGS_POLICY_STRICT
+)
+
+var (
+	ErrUnsupportedOpenFlags = errors.New("open flags are not supported")
+)
+
+// WithOpenFlagsPolicy sets how OpenFile treats flags the encrypted layout can not honor as is, default is emulate
+func (encFs *EncFs) WithOpenFlagsPolicy(openFlagsPolicy OpenFlagsPolicy) {
+	encFs.openFlagsPolicy = openFlagsPolicy
+}
+
+func isExclusiveOpen(flag int) bool {
+	return flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL
+}
+
+// checkOpenFlags refuses with OPEN_FLAGS_POLICY_STRICT: both O_WRONLY and O_RDWR, O_EXCL without O_CREATE,
+// O_TRUNC or O_APPEND without write access, these are undefined by POSIX and differ between backends
+func (encFs *EncFs) checkOpenFlags(encryptedName string, flag int) error {
+	if encFs.openFlagsPolicy != OPEN_FLAGS_POLICY_STRICT {
+		return nil
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&os.O_WRONLY != 0 && flag&os.O_RDWR != 0 ||
+		flag&os.O_EXCL != 0 && flag&os.O_CREATE == 0 ||
+		flag&(os.O_TRUNC|os.O_APPEND) != 0 && !writable {
+		return &os.PathError{Op: "open", Path: encryptedName, Err: ErrUnsupportedOpenFlags}
+	}
+	return nil
+}
+
+// checkEmulatedOpenErr explains a permission error of a write only open which was upgraded to read write,
+// the emulation needs read access to the backend file
+func (encFs *EncFs) checkEmulatedOpenErr(encryptedName string, flag, baseFlag int, err error) error {
+	if err == nil || baseFlag|os.O_APPEND == flag|os.O_APPEND || encFs.openFlagsPolicy != OPEN_FLAGS_POLICY_STRICT || !os.IsPermission(err) {
+		return err
+	}
+	return &os.PathError{Op: "open", Path: encryptedName, Err: ErrUnsupportedOpenFlags}
+}
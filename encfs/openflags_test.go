@@ -0,0 +1,110 @@
+package encfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOpenFlagsPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		flag           int
+		wantEmulateErr error
+		wantStrictErr  error
+	}{
+		{"read only", os.O_RDONLY, nil, nil},
+		{"write only", os.O_WRONLY, nil, nil},
+		{"read write", os.O_RDWR, nil, nil},
+		{"append", os.O_WRONLY | os.O_APPEND, nil, nil},
+		{"write only and read write", os.O_WRONLY | os.O_RDWR, nil, ErrUnsupportedOpenFlags},
+		// passed to the backend when emulating, MemMapFs refuses it for existing files
+		{"exclusive without create", os.O_RDWR | os.O_EXCL, os.ErrExist, ErrUnsupportedOpenFlags},
+		{"truncate read only", os.O_RDONLY | os.O_TRUNC, nil, ErrUnsupportedOpenFlags},
+		{"append read only", os.O_RDONLY | os.O_APPEND, nil, ErrUnsupportedOpenFlags},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, policy := range []OpenFlagsPolicy{OPEN_FLAGS_POLICY_EMULATE, OPEN_FLAGS_POLICY_STRICT} {
+				encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				encFs.WithOpenFlagsPolicy(policy)
+				writeTestFile(t, encFs, "/file", []byte("data"))
+				f, err := encFs.OpenFile("/file", test.flag, 0)
+				wantErr := test.wantEmulateErr
+				if policy == OPEN_FLAGS_POLICY_STRICT {
+					wantErr = test.wantStrictErr
+				}
+				if !errors.Is(err, wantErr) {
+					t.Fatalf("policy %d: got %v, want %v", policy, err, wantErr)
+				}
+				if err == nil {
+					_ = f.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestOpenFlagsOfExistingFiles(t *testing.T) {
+	data := testPattern(5000)
+	tests := []struct {
+		name     string
+		flag     int
+		write    []byte
+		wantErr  error
+		wantData []byte
+	}{
+		{"exclusive create", os.O_RDWR | os.O_CREATE | os.O_EXCL, []byte("new"), os.ErrExist, data},
+		{"create", os.O_RDWR | os.O_CREATE, []byte("new"), nil, append([]byte("new"), data[3:]...)},
+		{"write only", os.O_WRONLY, []byte("new"), nil, append([]byte("new"), data[3:]...)},
+		{"truncate", os.O_WRONLY | os.O_TRUNC, []byte("new"), nil, []byte("new")},
+		{"append", os.O_WRONLY | os.O_APPEND, []byte("new"), nil, append(append([]byte(nil), data...), "new"...)},
+	}
+	// write only opens of files which must be read to be encrypted are emulated on read write handles
+	formats := []struct {
+		name     string
+		setup    func(encFs *EncFs) error
+		emulated bool
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }, false},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }, true},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}, true},
+	}
+	for _, format := range formats {
+		for _, test := range tests {
+			t.Run(format.name+" "+test.name, func(t *testing.T) {
+				encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := format.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, encFs, "/file", data)
+				f, err := encFs.OpenFile("/file", test.flag, 0644)
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %v, want %v", err, test.wantErr)
+				}
+				if err == nil {
+					if _, err := f.Write(test.write); err != nil {
+						t.Fatal(err)
+					}
+					// emulated write only handles can not be read either
+					if format.emulated && test.flag&os.O_WRONLY != 0 {
+						if _, err := f.Seek(0, io.SeekStart); err == nil {
+							if _, err := f.Read(make([]byte, 1)); err == nil {
+								t.Fatal("read a write only handle")
+							}
+						}
+					}
+					if err := f.Close(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// a refused exclusive create keeps the file and its meta
+				checkTestFile(t, encFs, "/file", test.wantData)
+			})
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package encfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+const (
+	// SIZE_PADDING_PADME pads to Padmé buckets, at most 12% overhead and only O(log log size) bits of the size leak
+	SIZE_PADDING_PADME = "padme"
+	// SIZE_PADDING_BLOCK pads to a multiple of the block size
+	SIZE_PADDING_BLOCK = "block"
+
+	SIZE_PADDING_MIN_BLOCK_SIZE = 16
+	SIZE_PADDING_MAX_BLOCK_SIZE = 1 << 30
+
+	// padded contents end with the big endian plaintext size
+	sizePaddingTrailerSize = 8
+)
+
+var (
+	ErrBadSizePadding = errors.New("size padding must be padme or block with a power of two block size")
+)
+
+// WithSizePadding pads files of chunked ciphers created afterwards so their size on disk only leaks a bucket, the
+// padding is encrypted with the contents, "" disables it, blockSize is only used by SIZE_PADDING_BLOCK, CTR files
+// and existing files are never padded
+func (encFs *EncFs) WithSizePadding(padding string, blockSize int) error {
+	switch padding {
+	case "", SIZE_PADDING_PADME:
+		blockSize = 0
+	case SIZE_PADDING_BLOCK:
+		if blockSize < SIZE_PADDING_MIN_BLOCK_SIZE || blockSize > SIZE_PADDING_MAX_BLOCK_SIZE ||
+			blockSize&(blockSize-1) != 0 {
+			return ErrBadSizePadding
+		}
+	default:
+		return ErrBadSizePadding
+	}
+	encFs.sizePadding = padding
+	encFs.sizePaddingBlockSize = blockSize
+	return nil
+}
+
+// applySizePadding records the size padding of encFs in the meta of a new file
+func (encFs *EncFs) applySizePadding(encFileMeta *EncFileMeta) {
+	if encFs == nil || encFs.sizePadding == "" || !encFileMeta.isChunked() {
+		return
+	}
+	encFileMeta.setFlag(META_FLAG_PADDING)
+	encFileMeta.Padding = encFs.sizePadding
+	encFileMeta.PaddingBlockSize = encFs.sizePaddingBlockSize
+}
+
+func (encFileMeta *EncFileMeta) isPadded() bool {
+	return encFileMeta.isChunked() && encFileMeta.Padding != ""
+}
+
+// paddedSize returns the size of the padded contents including the trailer, empty files stay empty
+func (encFileMeta *EncFileMeta) paddedSize(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	size += sizePaddingTrailerSize
+	switch encFileMeta.Padding {
+	case SIZE_PADDING_BLOCK:
+		blockSize := int64(encFileMeta.PaddingBlockSize)
+		return (size + blockSize - 1) / blockSize * blockSize
+	default:
+		// Padmé keeps the highest log2(log2(size)) + 1 bits and rounds up the others
+		exponent := bits.Len64(uint64(size)) - 1
+		significantBits := bits.Len64(uint64(exponent))
+		mask := int64(1)<<(exponent-significantBits) - 1
+		return (size + mask) &^ mask
+	}
+}
+
+// paddedContentSize reads the plaintext size from the trailer at the end of the padded contents
+func (f *EncFile) paddedContentSize(paddedSize int64) (int64, error) {
+	if paddedSize == 0 {
+		return 0, nil
+	}
+	if paddedSize < sizePaddingTrailerSize {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+	}
+	trailer := make([]byte, sizePaddingTrailerSize)
+	if _, err := f.readChunksAt(trailer, paddedSize-sizePaddingTrailerSize); err != nil {
+		if err == io.EOF {
+			err = &os.PathError{Op: "read", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+		}
+		return 0, err
+	}
+	size := int64(binary.BigEndian.Uint64(trailer))
+	if size < 0 || size > paddedSize-sizePaddingTrailerSize {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: ErrIntegrityCheckFailed}
+	}
+	return size, nil
+}
+
+// writeSizePadding moves the trailer after the contents grew from oldSize to size, the old padding is already
+// zero, only the old trailer and the new padding are written
+func (f *EncFile) writeSizePadding(oldSize, size int64) error {
+	if !f.encFileMeta.isPadded() || size <= oldSize {
+		return nil
+	}
+	paddingStart := size
+	if oldPaddedSize := f.encFileMeta.paddedSize(oldSize); oldPaddedSize-sizePaddingTrailerSize > paddingStart {
+		paddingStart = oldPaddedSize - sizePaddingTrailerSize
+	}
+	trailerOffset := f.encFileMeta.paddedSize(size) - sizePaddingTrailerSize
+	if err := f.fillChunked(paddingStart, trailerOffset); err != nil {
+		return err
+	}
+	trailer := make([]byte, sizePaddingTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(size))
+	_, err := f.updateChunks(trailer, trailerOffset)
+	return err
+}
+
+// truncatePadded shrinks padded contents to size, the contents after size are zeroed since they become padding
+func (f *EncFile) truncatePadded(size int64) error {
+	paddedSize := f.encFileMeta.paddedSize(size)
+	if err := f.truncateChunks(paddedSize); err != nil || size == 0 {
+		return err
+	}
+	trailerOffset := paddedSize - sizePaddingTrailerSize
+	if err := f.fillChunked(size, trailerOffset); err != nil {
+		return err
+	}
+	trailer := make([]byte, sizePaddingTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(size))
+	_, err := f.updateChunks(trailer, trailerOffset)
+	return err
+}
+
+// sizePaddingTail returns the padding and trailer appended to size bytes of contents written by streaming
+func (encFileMeta *EncFileMeta) sizePaddingTail(size int64) []byte {
+	if !encFileMeta.isPadded() || size == 0 {
+		return nil
+	}
+	tail := make([]byte, encFileMeta.paddedSize(size)-size)
+	binary.BigEndian.PutUint64(tail[len(tail)-sizePaddingTrailerSize:], uint64(size))
+	return tail
+}
+
+// fileLogicalSize returns the plaintext size of encryptedName with rawSize bytes on disk, the trailer of padded
+// files is read and decrypted, the padded size is returned when that fails
+func (encFs *EncFs) fileLogicalSize(encryptedName string, encFileMeta *EncFileMeta, headerSize, rawSize int64) int64 {
+	size := logicalSizeOf(encFileMeta, headerSize, rawSize)
+	if !encFileMeta.isPadded() {
+		return size
+	}
+	file, err := encFs.backend().Open(encryptedName)
+	if err != nil {
+		return size
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	encFile := &EncFile{
+		encFileMeta: encFileMeta,
+		encFs:       encFs,
+		file:        file,
+		headerSize:  headerSize,
+	}
+	contentSize, err := encFile.paddedContentSize(size)
+	if err != nil {
+		return size
+	}
+	return contentSize
+}
@@ -0,0 +1,211 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		padding   string
+		blockSize int
+		size      int64
+		want      int64
+	}{
+		{SIZE_PADDING_PADME, 0, 0, 0},
+		{SIZE_PADDING_PADME, 0, 1, 10},
+		{SIZE_PADDING_PADME, 0, 8, 16},
+		{SIZE_PADDING_PADME, 0, 100, 112},
+		{SIZE_PADDING_PADME, 0, 1000, 1024},
+		{SIZE_PADDING_PADME, 0, 4088, 4096},
+		{SIZE_PADDING_PADME, 0, 4089, 4352},
+		{SIZE_PADDING_PADME, 0, 1 << 20, 1081344},
+		{SIZE_PADDING_BLOCK, 4096, 0, 0},
+		{SIZE_PADDING_BLOCK, 4096, 1, 4096},
+		{SIZE_PADDING_BLOCK, 4096, 4088, 4096},
+		{SIZE_PADDING_BLOCK, 4096, 4089, 8192},
+		{SIZE_PADDING_BLOCK, 16, 100, 112},
+	}
+	for _, test := range tests {
+		encFileMeta := &EncFileMeta{Padding: test.padding, PaddingBlockSize: test.blockSize}
+		got := encFileMeta.paddedSize(test.size)
+		if got != test.want {
+			t.Fatalf("%s %d of %d bytes: got %d, want %d", test.padding, test.blockSize, test.size, got, test.want)
+		}
+		// the padding leaks little of the size
+		if test.padding == SIZE_PADDING_PADME && test.size > 1000 && float64(got) > 1.12*float64(test.size+8) {
+			t.Fatalf("padme of %d bytes: %d is more than 12%% overhead", test.size, got)
+		}
+	}
+}
+
+func TestWithSizePadding(t *testing.T) {
+	tests := []struct {
+		padding   string
+		blockSize int
+		wantErr   error
+	}{
+		{"", 0, nil},
+		{SIZE_PADDING_PADME, 0, nil},
+		{SIZE_PADDING_PADME, 3, nil},
+		{SIZE_PADDING_BLOCK, 4096, nil},
+		{SIZE_PADDING_BLOCK, SIZE_PADDING_MIN_BLOCK_SIZE, nil},
+		{SIZE_PADDING_BLOCK, SIZE_PADDING_MAX_BLOCK_SIZE, nil},
+		{SIZE_PADDING_BLOCK, 0, ErrBadSizePadding},
+		{SIZE_PADDING_BLOCK, 8, ErrBadSizePadding},
+		{SIZE_PADDING_BLOCK, 1000, ErrBadSizePadding},
+		{SIZE_PADDING_BLOCK, 2 * SIZE_PADDING_MAX_BLOCK_SIZE, ErrBadSizePadding},
+		{"other", 4096, ErrBadSizePadding},
+	}
+	for _, test := range tests {
+		encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+		if err := encFs.WithSizePadding(test.padding, test.blockSize); !errors.Is(err, test.wantErr) {
+			t.Fatalf("%q %d: got %v, want %v", test.padding, test.blockSize, err, test.wantErr)
+		}
+	}
+}
+
+func TestSizePadding(t *testing.T) {
+	const blockSize = 4096
+	tests := []struct {
+		name   string
+		sizes  []int
+		change func(t *testing.T, encFs *EncFs, data []byte) []byte
+	}{
+		{"written", []int{0, 1, 100, blockSize - 8, blockSize - 7, 3*CONTENT_CHUNK_SIZE + 17}, nil},
+		{"appended", []int{1, 100, blockSize - 8}, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			f, err := encFs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			more := testPattern(blockSize)
+			if _, err := f.Write(more); err != nil {
+				t.Fatal(err)
+			}
+			return append(append([]byte(nil), data...), more...)
+		}},
+		{"written past the end", []int{100}, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			if _, err := f.WriteAt([]byte("end"), 2*blockSize); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 2*blockSize+3)
+			copy(want, data)
+			copy(want[2*blockSize:], "end")
+			return want
+		}},
+		// the contents after the new size become padding, they read as zeros when the file grows again
+		{"truncated", []int{2 * blockSize}, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			truncateTestFile(t, encFs, "/file", 10)
+			checkTestFile(t, encFs, "/file", data[:10])
+			truncateTestFile(t, encFs, "/file", 100)
+			want := make([]byte, 100)
+			copy(want, data[:10])
+			return want
+		}},
+		{"truncated to zero", []int{100}, func(t *testing.T, encFs *EncFs, data []byte) []byte {
+			truncateTestFile(t, encFs, "/file", 0)
+			return []byte{}
+		}},
+	}
+	formats := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"chacha20", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_CHACHA20_POLY1305) }},
+	}
+	for _, format := range formats {
+		for _, test := range tests {
+			t.Run(format.name+" "+test.name, func(t *testing.T) {
+				encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+				if err := format.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				unpadded := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+				if err := format.setup(unpadded); err != nil {
+					t.Fatal(err)
+				}
+				if err := encFs.WithSizePadding(SIZE_PADDING_BLOCK, blockSize); err != nil {
+					t.Fatal(err)
+				}
+				for _, size := range test.sizes {
+					data := testPattern(size)
+					writeTestFile(t, encFs, "/file", data)
+					if test.change != nil {
+						data = test.change(t, encFs, data)
+					}
+					checkTestFile(t, encFs, "/file", data)
+					fileInfo, err := encFs.Stat("/file")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if fileInfo.Size() != int64(len(data)) {
+						t.Fatalf("%d bytes: got size %d, want %d", size, fileInfo.Size(), len(data))
+					}
+					// the backend size is the one of the padded contents, an unpadded file of the padded size
+					padded := (&EncFileMeta{Padding: SIZE_PADDING_BLOCK, PaddingBlockSize: blockSize}).paddedSize(
+						int64(len(data)))
+					writeTestFile(t, unpadded, "/unpadded", make([]byte, padded))
+					got, want := testBackendSize(t, encFs, "/file"), testBackendSize(t, unpadded, "/unpadded")
+					if got != want {
+						t.Fatalf("%d bytes: backend holds %d bytes, want %d", size, got, want)
+					}
+					// padding is only applied to new files, the padded file is still read by other EncFs
+					checkTestFile(t, unpadded, "/file", data)
+				}
+			})
+		}
+	}
+}
+
+func TestSizePaddingOfCtrFiles(t *testing.T) {
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	if err := encFs.WithSizePadding(SIZE_PADDING_PADME, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/file", testPattern(100))
+	// CTR files are not chunked and never padded
+	if got := testBackendSize(t, encFs, "/file"); got != 100 {
+		t.Fatalf("backend holds %d bytes of a CTR file of 100 bytes", got)
+	}
+	checkTestFile(t, NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base), "/file", testPattern(100))
+}
+
+// testBackendSize returns the size of the backend file of name
+func testBackendSize(t *testing.T, encFs *EncFs, name string) int64 {
+	t.Helper()
+	fileInfo, err := encFs.base.Stat(encFs.encryptFileName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInfo.Size()
+}
+
+func truncateTestFile(t *testing.T, encFs *EncFs, name string, size int64) {
+	t.Helper()
+	f, err := encFs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
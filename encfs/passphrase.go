@@ -0,0 +1,161 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KDF_ARGON2ID = "argon2id"
+	KDF_SCRYPT   = "scrypt"
+
+	PASSPHRASE_VOLUME_FILE_NAME = "__ENCFS_PASSPHRASE__" + EncFileExt
+	PASSPHRASE_SALT_SIZE        = 16
+)
+
+var (
+	ErrUnsupportedKdf   = errors.New("unsupported key derivation function")
+	ErrWrongPassphrase  = errors.New("wrong passphrase")
+	ErrNoPassphraseSalt = errors.New("passphrase salt is missing")
+)
+
+// KdfParams are the parameters deriving a master key from a passphrase, Memory is in KiB for Argon2id,
+// scrypt uses N, R and P
+type KdfParams struct {
+	Algorithm string `json:"algorithm"`
+	Time      uint32 `json:"time,omitempty"`
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+}
+
+// DefaultKdfParams returns Argon2id with 3 passes over 64MiB and 4 threads, as recommended by RFC 9106
+func DefaultKdfParams() *KdfParams {
+	return &KdfParams{
+		Algorithm: KDF_ARGON2ID,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}
+}
+
+// passphraseVolumeHeader is stored unencrypted in PASSPHRASE_VOLUME_FILE_NAME of the volume root, the key id
+// tells a wrong passphrase from a broken volume
+type passphraseVolumeHeader struct {
+	Magic   string     `json:"magic"`
+	Version int        `json:"version"`
+	Salt    []byte     `json:"salt"`
+	Kdf     *KdfParams `json:"kdf"`
+	KeyId   string     `json:"key_id"`
+}
+
+// NewEncryptionMasterKeyFromPassphrase derives a 32 bytes master key from passphrase and salt, params defaults
+// to DefaultKdfParams when nil
+func NewEncryptionMasterKeyFromPassphrase(passphrase string, salt []byte, params *KdfParams) (*EncryptionMasterKey, error) {
+	if len(salt) == 0 {
+		return nil, ErrNoPassphraseSalt
+	}
+	if params == nil {
+		params = DefaultKdfParams()
+	}
+	switch params.Algorithm {
+	case KDF_ARGON2ID:
+		if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+			return nil, ErrUnsupportedKdf
+		}
+		return NewEncryptionMasterKey(argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32)), nil
+	case KDF_SCRYPT:
+		key, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, 32)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptionMasterKey(key), nil
+	default:
+		return nil, ErrUnsupportedKdf
+	}
+}
+
+// CreatePassphraseVolume derives a master key from passphrase with a random salt and stores the salt and params
+// in the volume header of root on base, an existing volume header is never replaced
+func CreatePassphraseVolume(base afero.Fs, root string, passphrase string, params *KdfParams) (*EncryptionMasterKey, error) {
+	if params == nil {
+		params = DefaultKdfParams()
+	}
+	salt := make([]byte, PASSPHRASE_SALT_SIZE)
+	if err := (*EncFs)(nil).readRandom(salt); err != nil {
+		return nil, err
+	}
+	key, err := NewEncryptionMasterKeyFromPassphrase(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	header := &passphraseVolumeHeader{
+		Magic:   ENC_FILE_META_MAGIC,
+		Version: ENC_FILE_META_VERSION,
+		Salt:    salt,
+		Kdf:     params,
+		KeyId:   key.KeyId(),
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	headerFile, err := base.OpenFile(filepath.Join(root, PASSPHRASE_VOLUME_FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = headerFile.Close()
+	}()
+	if _, err := headerFile.Write(headerBytes); err != nil {
+		return nil, err
+	}
+	if err := headerFile.Sync(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// OpenPassphraseVolume derives the master key of the volume at root on base from passphrase and the volume header,
+// ErrWrongPassphrase is returned when the key does not match
+func OpenPassphraseVolume(base afero.Fs, root string, passphrase string) (*EncryptionMasterKey, error) {
+	headerName := filepath.Join(root, PASSPHRASE_VOLUME_FILE_NAME)
+	headerFile, err := base.Open(headerName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = headerFile.Close()
+	}()
+	headerBytes, err := io.ReadAll(headerFile)
+	if err != nil {
+		return nil, err
+	}
+	var header passphraseVolumeHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil || header.Magic != ENC_FILE_META_MAGIC {
+		return nil, &os.PathError{Op: "open", Path: headerName, Err: ErrBadFileMeta}
+	}
+	if header.Version > ENC_FILE_META_VERSION {
+		return nil, &os.PathError{Op: "open", Path: headerName, Err: ErrUnsupportedFormatVersion}
+	}
+	key, err := NewEncryptionMasterKeyFromPassphrase(passphrase, header.Salt, header.Kdf)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: headerName, Err: err}
+	}
+	if header.KeyId != key.KeyId() {
+		return nil, &os.PathError{Op: "open", Path: headerName, Err: ErrWrongPassphrase}
+	}
+	return key, nil
+}
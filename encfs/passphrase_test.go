@@ -0,0 +1,125 @@
+package encfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestEncryptionMasterKeyFromPassphrase(t *testing.T) {
+	salt := []byte("salt of sixteen!")
+	argon2Params := &KdfParams{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 64, Threads: 1}
+	tests := []struct {
+		name       string
+		passphrase string
+		salt       []byte
+		params     *KdfParams
+		wantKeyHex string
+		wantErr    error
+	}{
+		// RFC 7914 section 12, the key is the first 32 bytes of the derived 64
+		{"scrypt known answer", "password", []byte("NaCl"), &KdfParams{Algorithm: KDF_SCRYPT, N: 1024, R: 8, P: 16},
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162", nil},
+		{"argon2id", "passphrase", salt, argon2Params, "", nil},
+		{"scrypt", "passphrase", salt, testKdfParams(), "", nil},
+		{"no salt", "passphrase", nil, testKdfParams(), "", ErrNoPassphraseSalt},
+		{"unknown algorithm", "passphrase", salt, &KdfParams{Algorithm: "pbkdf2"}, "", ErrUnsupportedKdf},
+		{"argon2id without memory", "passphrase", salt, &KdfParams{Algorithm: KDF_ARGON2ID, Time: 1, Threads: 1}, "",
+			ErrUnsupportedKdf},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := NewEncryptionMasterKeyFromPassphrase(test.passphrase, test.salt, test.params)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if test.wantKeyHex != "" && hex.EncodeToString(key.key) != test.wantKeyHex {
+				t.Fatalf("got key %x", key.key)
+			}
+			// the same inputs give the same key, another passphrase or salt another one
+			again, err := NewEncryptionMasterKeyFromPassphrase(test.passphrase, test.salt, test.params)
+			if err != nil || !bytes.Equal(again.key, key.key) {
+				t.Fatalf("derived another key: %v", err)
+			}
+			other, err := NewEncryptionMasterKeyFromPassphrase(test.passphrase+"!", test.salt, test.params)
+			if err != nil || bytes.Equal(other.key, key.key) {
+				t.Fatalf("other passphrase derived the same key: %v", err)
+			}
+			other, err = NewEncryptionMasterKeyFromPassphrase(test.passphrase, append(test.salt, 0), test.params)
+			if err != nil || bytes.Equal(other.key, key.key) {
+				t.Fatalf("other salt derived the same key: %v", err)
+			}
+		})
+	}
+	if _, err := NewEncryptionMasterKeyFromPassphrase("passphrase", salt, &KdfParams{Algorithm: KDF_SCRYPT, N: 1000,
+		R: 8, P: 1}); err == nil {
+		t.Fatal("scrypt accepted N which is not a power of two")
+	}
+}
+
+func TestPassphraseVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		modify     func(header map[string]interface{})
+		wantErr    error
+	}{
+		{"passphrase", "passphrase", func(header map[string]interface{}) {}, nil},
+		{"wrong passphrase", "other", func(header map[string]interface{}) {}, ErrWrongPassphrase},
+		{"unknown version", "passphrase", func(header map[string]interface{}) {
+			header["version"] = ENC_FILE_META_VERSION + 1
+		}, ErrUnsupportedFormatVersion},
+		{"bad magic", "passphrase", func(header map[string]interface{}) {
+			header["magic"] = "other"
+		}, ErrBadFileMeta},
+		{"unknown kdf", "passphrase", func(header map[string]interface{}) {
+			header["kdf"] = map[string]string{"algorithm": "pbkdf2"}
+		}, ErrUnsupportedKdf},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			key, err := CreatePassphraseVolume(base, "/volume", "passphrase", testKdfParams())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := CreatePassphraseVolume(base, "/volume", "passphrase", testKdfParams()); !os.IsExist(err) {
+				t.Fatalf("created the volume twice: %v", err)
+			}
+
+			headerName := filepath.Join("/volume", PASSPHRASE_VOLUME_FILE_NAME)
+			headerBytes, err := afero.ReadFile(base, headerName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header map[string]interface{}
+			if err := json.Unmarshal(headerBytes, &header); err != nil {
+				t.Fatal(err)
+			}
+			test.modify(header)
+			if headerBytes, err = json.Marshal(header); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(base, headerName, headerBytes, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			opened, err := OpenPassphraseVolume(base, "/volume", test.passphrase)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(opened.key, key.key) {
+				t.Fatal("opened with another key")
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package encfs
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithPassthroughPatterns leaves files matching one of patterns unencrypted and unrenamed so encrypted and plain
+// files can be mixed in one tree, patterns without "/" like "*.jpg" match names at any depth, other patterns match
+// paths from the root like "photos/*.jpg", a trailing "/**" like ".git/**" is allowed, everything below a matching
+// directory is passed through too, existing encrypted files keep their names and stay encrypted until they are
+// truncated
+func (encFs *EncFs) WithPassthroughPatterns(patterns []string) error {
+	passthroughPatterns := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(strings.TrimSuffix(filepath.ToSlash(pattern), "/**"), "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		passthroughPatterns = append(passthroughPatterns, pattern)
+	}
+	encFs.passthroughPatterns = passthroughPatterns
+	return nil
+}
+
+// splitPassthroughName splits name before its first part matching a passthrough pattern, found is false when no
+// part matches
+func (encFs *EncFs) splitPassthroughName(name string) (parentName, passthroughName string, found bool) {
+	if encFs == nil || len(encFs.passthroughPatterns) == 0 {
+		return "", "", false
+	}
+	cleanName := filepath.ToSlash(filepath.Clean(string(filepath.Separator) + name))
+	if encFs.isOsBackend() {
+		if absName, err := filepath.Abs(name); err == nil {
+			cleanName = filepath.ToSlash(absName)
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(cleanName, "/"), "/")
+	for i, part := range parts {
+		if part != "" && encFs.matchPassthrough(strings.Join(parts[:i+1], "/"), part) {
+			return "/" + strings.Join(parts[:i], "/"), strings.Join(parts[i:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// isPassthroughEncrypted reports files whose contents are not encrypted by passthrough patterns
+func (encFs *EncFs) isPassthroughEncrypted(encryptedName string) bool {
+	if encFs == nil || len(encFs.passthroughPatterns) == 0 {
+		return false
+	}
+	_, _, found := encFs.splitPassthroughName(encFs.key.DecryptFileName(filepath.ToSlash(encryptedName)))
+	return found
+}
+
+func (encFs *EncFs) matchPassthrough(relName, baseName string) bool {
+	for _, pattern := range encFs.passthroughPatterns {
+		matchName := relName
+		if !strings.Contains(pattern, "/") {
+			matchName = baseName
+		}
+		if matched, _ := path.Match(pattern, matchName); matched {
+			return true
+		}
+	}
+	return false
+}
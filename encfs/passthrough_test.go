@@ -0,0 +1,101 @@
+package encfs
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestPassthroughPatterns(t *testing.T) {
+	tests := []struct {
+		name            string
+		patterns        []string
+		plainName       string
+		wantPassthrough bool
+	}{
+		{"name", []string{"*.jpg"}, "/a.jpg", true},
+		{"name in a directory", []string{"*.jpg"}, "/dir/a.jpg", true},
+		{"other name", []string{"*.jpg"}, "/a.txt", false},
+		{"path", []string{"photos/*.jpg"}, "/photos/a.jpg", true},
+		{"path with slash", []string{"/photos/*.jpg"}, "/photos/a.jpg", true},
+		{"path in another directory", []string{"photos/*.jpg"}, "/dir/photos/a.jpg", false},
+		{"path of another name", []string{"photos/*.jpg"}, "/photos/a.txt", false},
+		{"tree", []string{".git/**"}, "/.git/objects/ab/cdef", true},
+		{"tree in a directory", []string{".git/**"}, "/dir/.git/config", true},
+		{"below a directory", []string{"photos"}, "/photos/2020/a.jpg", true},
+		{"second pattern", []string{"*.jpg", "*.png"}, "/dir/a.png", true},
+		{"no patterns", nil, "/a.jpg", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestHmacEncFs()
+			if err := encFs.WithPassthroughPatterns(test.patterns); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.MkdirAll(filepath.Dir(test.plainName), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, test.plainName, []byte("data"))
+			checkTestFile(t, encFs, test.plainName, []byte("data"))
+
+			encryptedName := encFs.encryptFileName(test.plainName)
+			backendData, err := afero.ReadFile(base, encryptedName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, metaErr := base.Stat(encFs.encFileMetaName(encryptedName))
+			isPassthrough := filepath.Base(encryptedName) == filepath.Base(test.plainName) &&
+				string(backendData) == "data" && metaErr != nil
+			if isPassthrough != test.wantPassthrough {
+				t.Fatalf("%s is %s with contents %q, want passthrough %t", test.plainName, encryptedName,
+					backendData, test.wantPassthrough)
+			}
+			// passthrough files are listed with the others
+			names, err := afero.ReadDir(encFs, filepath.Dir(test.plainName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 || names[0].Name() != filepath.Base(test.plainName) || names[0].Size() != 4 {
+				t.Fatalf("listed %v", names)
+			}
+		})
+	}
+}
+
+func TestPassthroughPatternsOfExistingFiles(t *testing.T) {
+	encFs, base := newTestHmacEncFs()
+	writeTestFile(t, encFs, "/a.jpg", []byte("encrypted"))
+	if err := encFs.WithPassthroughPatterns([]string{"[", "*.jpg"}); !errors.Is(err, path.ErrBadPattern) {
+		t.Fatalf("got %v, want %v", err, path.ErrBadPattern)
+	}
+	if err := encFs.WithPassthroughPatterns([]string{"*.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	// existing encrypted files stay encrypted and readable until they are truncated
+	checkTestFile(t, encFs, "/a.jpg", []byte("encrypted"))
+	writeTestFile(t, encFs, "/b.jpg", []byte("plain"))
+	checkTestFile(t, base, "/b.jpg", []byte("plain"))
+	f, err := encFs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := f.Readdirnames(-1)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a.jpg" || names[1] != "b.jpg" {
+		t.Fatalf("listed %v", names)
+	}
+	writeTestFile(t, encFs, "/a.jpg", []byte("now plain"))
+	checkTestFile(t, encFs, "/a.jpg", []byte("now plain"))
+	// the encrypted name of the existing file is kept, its contents are written in plaintext
+	if backendData := readTestFile(t, base, encFs.encryptFileName("/a.jpg")); string(backendData) != "now plain" {
+		t.Fatalf("got backend contents %q", backendData)
+	}
+}
@@ -0,0 +1,93 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// plainPathError replaces the encrypted path of a backend error by plainName
+func (encFs *EncFs) plainPathError(err error, plainName string) error {
+	if pathError, ok := err.(*os.PathError); ok {
+		return &os.PathError{Op: pathError.Op, Path: plainName, Err: pathError.Err}
+	}
+	return err
+}
+
+// restorePlainPath replaces the backend paths of a *fs.PathError, *os.LinkError or *OperationTimeoutError in err by
+// the plaintext names of the caller, names are pairs of a plaintext name and its backend name, paths matching none of
+// them are kept
+func (encFs *EncFs) restorePlainPath(err *error, names ...string) {
+	if *err == nil {
+		return
+	}
+	switch e := (*err).(type) {
+	case *os.PathError:
+		*err = &os.PathError{Op: e.Op, Path: encFs.plainPath(e.Path, names), Err: e.Err}
+	case *os.LinkError:
+		*err = &os.LinkError{Op: e.Op, Old: encFs.plainPath(e.Old, names), New: encFs.plainPath(e.New, names), Err: e.Err}
+	case *OperationTimeoutError:
+		*err = &OperationTimeoutError{Op: e.Op, Path: encFs.plainPath(e.Path, names), Err: e.Err}
+	}
+}
+
+// plainPath returns the plaintext name of the backend path of an error, the meta and integrity files of a name, names
+// below it and its parents are mapped as well, backends below a root, e.g. afero.BasePathFs, report the root with it
+func (encFs *EncFs) plainPath(path string, names []string) string {
+	if dataName, ok := encFs.metaFileNaming().dataName(path); ok {
+		path = dataName
+	} else {
+		path = strings.TrimSuffix(path, INTEGRITY_FILE_SUFFIX)
+	}
+	for i := 0; i+1 < len(names); i += 2 {
+		if plainPath, ok := encFs.plainPathOf(path, names[i], names[i+1]); ok {
+			return plainPath
+		}
+	}
+	for i := 0; i+1 < len(names); i += 2 {
+		plainName, encryptedName := names[i], filepath.Clean(string(filepath.Separator)+names[i+1])
+		// both have a part per level, the plaintext name may be relative
+		for plainName != "." && plainName != string(filepath.Separator) && encryptedName != string(filepath.Separator) {
+			plainName, encryptedName = filepath.Dir(plainName), filepath.Dir(encryptedName)
+			if strings.HasSuffix(path, encryptedName) && encryptedName != string(filepath.Separator) {
+				return plainName
+			}
+		}
+	}
+	return path
+}
+
+// plainPathOf maps path when it is encryptedName or below it
+func (encFs *EncFs) plainPathOf(path, plainName, encryptedName string) (string, bool) {
+	encryptedName = filepath.Clean(string(filepath.Separator) + encryptedName)
+	if path == encryptedName {
+		return plainName, true
+	}
+	if encryptedName == string(filepath.Separator) {
+		// the root of the backend in path is unknown
+		return "", false
+	}
+	if strings.HasSuffix(path, encryptedName) {
+		return plainName, true
+	}
+	prefix := encryptedName + string(filepath.Separator)
+	index := strings.Index(path, prefix)
+	if index < 0 {
+		return "", false
+	}
+	for _, part := range strings.Split(path[index+len(prefix):], string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+		plainName = filepath.Join(plainName, encFs.key.decryptFileNamePart(encryptedName, part))
+		encryptedName = filepath.Join(encryptedName, part)
+	}
+	return plainName, true
+}
+
+// restorePlainPath replaces the backend paths of err by the plaintext name of the file
+func (f *EncFile) restorePlainPath(err *error) {
+	if *err != nil {
+		f.encFs.restorePlainPath(err, f.Name(), f.file.Name())
+	}
+}
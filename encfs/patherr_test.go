@@ -0,0 +1,140 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// newTestPathErrEncFs returns an EncFs with encrypted names below a root of its backend, so backend paths differ
+// from the plaintext ones in every part
+func newTestPathErrEncFs(t *testing.T) *EncFs {
+	t.Helper()
+	base := afero.NewBasePathFs(afero.NewMemMapFs(), "/backend/root")
+	key := NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(3)[:12])
+	encFs := NewEncFsWithBackend(key, base).(*EncFs)
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, encFs, "/dir/file", []byte("data"))
+	return encFs
+}
+
+// checkTestPlainPaths fails unless err carries the plaintext paths wantPaths
+func checkTestPlainPaths(t *testing.T, err error, wantPaths ...string) {
+	t.Helper()
+	var gotPaths []string
+	var pathError *os.PathError
+	var linkError *os.LinkError
+	switch {
+	case errors.As(err, &pathError):
+		gotPaths = []string{pathError.Path}
+	case errors.As(err, &linkError):
+		gotPaths = []string{linkError.Old, linkError.New}
+	default:
+		t.Fatalf("got %v, want a path error", err)
+	}
+	if strings.Join(gotPaths, " ") != strings.Join(wantPaths, " ") {
+		t.Fatalf("got paths %q of %v, want %q", gotPaths, err, wantPaths)
+	}
+}
+
+func TestPlainPathErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func(encFs *EncFs) error
+		wantPaths []string
+	}{
+		{"open", func(encFs *EncFs) error {
+			_, err := encFs.Open("/dir/missing")
+			return err
+		}, []string{"/dir/missing"}},
+		{"open below a missing directory", func(encFs *EncFs) error {
+			_, err := encFs.Open("/missing/file")
+			return err
+		}, []string{"/missing/file"}},
+		{"stat", func(encFs *EncFs) error {
+			_, err := encFs.Stat("/dir/missing")
+			return err
+		}, []string{"/dir/missing"}},
+		{"remove", func(encFs *EncFs) error { return encFs.Remove("/dir/missing") }, []string{"/dir/missing"}},
+		{"mkdir", func(encFs *EncFs) error { return encFs.Mkdir("/dir/sub", 0755) }, []string{"/dir/sub"}},
+		{"chmod", func(encFs *EncFs) error { return encFs.Chmod("/dir/missing", 0600) }, []string{"/dir/missing"}},
+		{"rename", func(encFs *EncFs) error {
+			return encFs.Rename("/dir/missing", "/dir/sub/renamed")
+		}, []string{"/dir/missing"}},
+		// the backend has no symlinks
+		{"symlink", func(encFs *EncFs) error {
+			return encFs.SymlinkIfPossible("/dir/file", "/dir/sub/link")
+		}, []string{"/dir/file", "/dir/sub/link"}},
+		{"exclusive create", func(encFs *EncFs) error {
+			_, err := encFs.OpenFile("/dir/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+			return err
+		}, []string{"/dir/file"}},
+		{"write a read only handle", func(encFs *EncFs) error {
+			f, err := encFs.Open("/dir/file")
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			_, err = f.Write([]byte("x"))
+			return err
+		}, []string{"/dir/file"}},
+		{"truncate a read only handle", func(encFs *EncFs) error {
+			f, err := encFs.Open("/dir/file")
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			return f.Truncate(0)
+		}, []string{"/dir/file"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs := newTestPathErrEncFs(t)
+			err := test.op(encFs)
+			checkTestPlainPaths(t, err, test.wantPaths...)
+			if strings.Contains(err.Error(), ENCRYPTED_FILE_NAME_PREFIX) || strings.Contains(err.Error(), "backend") {
+				t.Fatalf("got backend paths in %v", err)
+			}
+		})
+	}
+}
+
+func TestPlainPath(t *testing.T) {
+	encFs := newTestPathErrEncFs(t)
+	encryptedDir := encFs.encryptFileName("/dir")
+	encryptedFile := encFs.encryptFileName("/dir/file")
+	encryptedSub := encFs.encryptFileName("/dir/sub")
+	tests := []struct {
+		name  string
+		path  string
+		names []string
+		want  string
+	}{
+		{"name", encryptedFile, []string{"/dir/file", encryptedFile}, "/dir/file"},
+		{"meta file", encFs.encFileMetaName(encryptedFile), []string{"/dir/file", encryptedFile}, "/dir/file"},
+		{"integrity file", encryptedFile + INTEGRITY_FILE_SUFFIX, []string{"/dir/file", encryptedFile}, "/dir/file"},
+		// backends below a root report it with the path
+		{"backend root", "/backend/root" + encryptedFile, []string{"/dir/file", encryptedFile}, "/dir/file"},
+		{"below the name", encryptedSub, []string{"/dir", encryptedDir}, "/dir/sub"},
+		{"parent", encryptedDir, []string{"/dir/file", encryptedFile}, "/dir"},
+		{"relative name", encryptedDir, []string{"dir/file", encryptedFile}, "dir"},
+		{"second pair", encryptedSub, []string{"/dir/file", encryptedFile, "/dir/sub", encryptedSub}, "/dir/sub"},
+		{"unknown", "/other", []string{"/dir/file", encryptedFile}, "/other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := encFs.plainPath(test.path, test.names); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
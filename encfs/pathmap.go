@@ -0,0 +1,69 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ToEncryptedPath returns the on-disk path of plain, relative paths are resolved against the working directory on
+// the os backend and against "/" on other backends, an error is returned instead of falling back to plain names
+func (encFs *EncFs) ToEncryptedPath(plain string) (string, error) {
+	if plain == "" || strings.ContainsRune(plain, 0) {
+		return "", &os.PathError{Op: "encrypt", Path: plain, Err: os.ErrInvalid}
+	}
+	if err := encFs.checkFileExt(plain); err != nil {
+		return "", &os.PathError{Op: "encrypt", Path: plain, Err: err}
+	}
+	absName, err := encFs.absBackendName(plain)
+	if err != nil {
+		return "", &os.PathError{Op: "encrypt", Path: plain, Err: err}
+	}
+	if encFs.caseInsensitive {
+		absName = encFs.resolveFoldedName(absName)
+	}
+	encryptedName := encFs.encryptExactFileName(absName)
+	// names are checked by decrypting them again
+	if plainName, err := encFs.ToPlainPath(encryptedName); err != nil || plainName != filepath.ToSlash(absName) {
+		return "", &os.PathError{Op: "encrypt", Path: plain, Err: ErrDecryptFailed}
+	}
+	return encryptedName, nil
+}
+
+// ToPlainPath returns the plaintext path of the on-disk path enc, meta files and names which can not be decrypted
+// are reported as errors
+func (encFs *EncFs) ToPlainPath(enc string) (string, error) {
+	if enc == "" || strings.ContainsRune(enc, 0) {
+		return "", &os.PathError{Op: "decrypt", Path: enc, Err: os.ErrInvalid}
+	}
+	absName, err := encFs.absBackendName(enc)
+	if err != nil {
+		return "", &os.PathError{Op: "decrypt", Path: enc, Err: err}
+	}
+	absName = filepath.ToSlash(absName)
+	if encFs.metaFileNaming().isInternalName(filepath.Base(absName)) {
+		return "", &os.PathError{Op: "decrypt", Path: enc, Err: ErrFileForbiddenFileExt}
+	}
+	if !encFs.key.isFileNameEncrypted() {
+		return absName, nil
+	}
+	encryptedNameParts := strings.Split(absName, "/")
+	nameParts := make([]string, len(encryptedNameParts))
+	for i, encryptedNamePart := range encryptedNameParts {
+		encryptedParentName := strings.Join(encryptedNameParts[:i], "/")
+		if encryptedParentName == "" && i > 0 {
+			encryptedParentName = "/"
+		}
+		nameDecrypter, ok := encFs.key.nameMapper.(nameDecrypter)
+		if !ok {
+			nameParts[i] = encFs.key.nameMapper.DecryptFileNamePart(encryptedParentName, encryptedNamePart)
+			continue
+		}
+		namePart, err := nameDecrypter.tryDecryptFileNamePart(encryptedParentName, encryptedNamePart)
+		if err != nil {
+			return "", &os.PathError{Op: "decrypt", Path: enc, Err: ErrDecryptFailed}
+		}
+		nameParts[i] = namePart
+	}
+	return strings.Join(nameParts, "/"), nil
+}
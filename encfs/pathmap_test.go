@@ -0,0 +1,109 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestToEncryptedPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		newMapper func(base afero.Fs) NameMapper
+	}{
+		{"noop", func(base afero.Fs) NameMapper { return NewNoopNameMapper() }},
+		{"gcm", func(base afero.Fs) NameMapper { return NewGcmNameMapper(testKeyBytes(2), make([]byte, 12)) }},
+		{"siv", func(base afero.Fs) NameMapper { return NewSivNameMapper(testKeyBytes(2)) }},
+		{"random nonce", func(base afero.Fs) NameMapper {
+			return NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+		}},
+	}
+	paths := []struct {
+		plain     string
+		wantPlain string
+		wantErr   error
+	}{
+		{"/", "/", nil},
+		{"/dir/file", "/dir/file", nil},
+		{"dir/file", "/dir/file", nil},
+		{"/dir/../dir/./file", "/dir/file", nil},
+		{"/dir/new name", "/dir/new name", nil},
+		{"", "", os.ErrInvalid},
+		{"/dir/nul\x00", "", os.ErrInvalid},
+		{"/dir/file" + EncFileExt, "", ErrFileForbiddenFileExt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.newMapper(base)),
+				base).(*EncFs)
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", []byte("data"))
+			for _, path := range paths {
+				encryptedPath, err := encFs.ToEncryptedPath(path.plain)
+				if !errors.Is(err, path.wantErr) {
+					t.Fatalf("%q: got %v, want %v", path.plain, err, path.wantErr)
+				}
+				var pathError *os.PathError
+				if err != nil && (!errors.As(err, &pathError) || pathError.Path != path.plain) {
+					t.Fatalf("%q: error %v does not report the path", path.plain, err)
+				}
+				if err != nil {
+					continue
+				}
+				plain, err := encFs.ToPlainPath(encryptedPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if plain != path.wantPlain {
+					t.Fatalf("%q: translated back to %q, want %q", path.plain, plain, path.wantPlain)
+				}
+			}
+			encryptedPath, err := encFs.ToEncryptedPath("/dir/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists, _ := afero.Exists(base, encryptedPath); !exists {
+				t.Fatalf("%s does not exist", encryptedPath)
+			}
+		})
+	}
+}
+
+func TestToPlainPath(t *testing.T) {
+	base := afero.NewMemMapFs()
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewSivNameMapper(testKeyBytes(2))),
+		base).(*EncFs)
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	encryptedPath, err := encFs.ToEncryptedPath("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(encryptedPath)
+	tampered[len(tampered)-2] ^= 1
+	tests := []struct {
+		enc       string
+		wantPlain string
+		wantErr   error
+	}{
+		{encryptedPath, "/file", nil},
+		{encryptedPath[1:], "/file", nil},
+		{"/unencrypted", "/unencrypted", nil},
+		{string(tampered), "", ErrDecryptFailed},
+		{encFs.encFileMetaName(encryptedPath), "", ErrFileForbiddenFileExt},
+		{"", "", os.ErrInvalid},
+	}
+	for _, test := range tests {
+		plain, err := encFs.ToPlainPath(test.enc)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%q: got %v, want %v", test.enc, err, test.wantErr)
+		}
+		if plain != test.wantPlain {
+			t.Fatalf("%q: got %q, want %q", test.enc, plain, test.wantPlain)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package encfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// PreloadOptions selects how much of the matched files Preload warms up
+type PreloadOptions struct {
+	// Recursive preloads the whole tree of matched directories
+	Recursive bool
+	// PrefetchBytes reads and decrypts the leading bytes of every file so backend and page caches hold them,
+	// 0 only resolves names and caches meta files
+	PrefetchBytes int64
+}
+
+type PreloadReport struct {
+	FileCount       int   `json:"file_count"`
+	DirCount        int   `json:"dir_count"`
+	CachedMetaCount int   `json:"cached_meta_count"`
+	PrefetchedBytes int64 `json:"prefetched_bytes"`
+	ErrorCount      int   `json:"error_count"`
+}
+
+// cachedEncFileMeta is a sidecar meta file loaded by Preload, it is used while the meta file keeps the size and
+// modification time it had when loaded
+type cachedEncFileMeta struct {
+	encFileMeta *EncFileMeta
+	size        int64
+	modTime     time.Time
+}
+
+// Preload warms encFs up for the plaintext paths or glob patterns of filepath.Match, names are resolved, meta
+// files are cached and with PrefetchBytes leading contents are read, so services avoid cold open latency on their
+// hot files, paths failing to preload are counted and the first error is returned after all paths were tried
+func (encFs *EncFs) Preload(patterns []string, options *PreloadOptions) (_ *PreloadReport, err error) {
+	defer encFs.audit("preload", strings.Join(patterns, string(filepath.ListSeparator)), "", os.O_RDONLY, &err)
+	if options == nil {
+		options = &PreloadOptions{}
+	}
+	report := &PreloadReport{}
+	var firstErr error
+	recordErr := func(err error) {
+		report.ErrorCount++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, pattern := range patterns {
+		names := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[\\") {
+			if names, err = afero.Glob(encFs, pattern); err != nil {
+				return report, err
+			}
+		}
+		for _, name := range names {
+			if err := encFs.preload(name, options, report); err != nil {
+				recordErr(err)
+			}
+		}
+	}
+	return report, firstErr
+}
+
+func (encFs *EncFs) preload(name string, options *PreloadOptions, report *PreloadReport) error {
+	if err := encFs.authorize("preload", name, "", os.O_RDONLY); err != nil {
+		return err
+	}
+	// resolving the name fills the caches of the name mapper for every part
+	encryptedName := encFs.encryptFileName(name)
+	fileInfo, err := callWithRetry(encFs, retryIdempotent, "stat", encryptedName, func() (os.FileInfo, error) {
+		return encFs.base.Stat(encryptedName)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return encFs.preloadFile(encryptedName, fileInfo, options, report)
+	}
+	report.DirCount++
+	if !options.Recursive {
+		return nil
+	}
+	var firstErr error
+	err = encFs.walkEncrypted(name, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if fileInfo.IsDir() {
+			if plainName != name {
+				report.DirCount++
+			}
+			return nil
+		}
+		if err := encFs.preloadFile(encryptedName, fileInfo, options, report); err != nil {
+			report.ErrorCount++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func (encFs *EncFs) preloadFile(encryptedName string, fileInfo os.FileInfo, options *PreloadOptions,
+	report *PreloadReport) error {
+	report.FileCount++
+	if !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+	cached, err := encFs.cacheEncFileMeta(encryptedName)
+	if err != nil {
+		return err
+	}
+	if cached {
+		report.CachedMetaCount++
+	}
+	if options.PrefetchBytes <= 0 {
+		return nil
+	}
+	file, err := encFs.base.Open(encryptedName)
+	if err != nil {
+		return err
+	}
+	encFile, err := newEncFile(encryptedName, file, encFs, false, os.O_RDONLY)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	defer func() {
+		_ = encFile.Close()
+	}()
+	prefetchedBytes, err := io.CopyN(io.Discard, encFile, options.PrefetchBytes)
+	report.PrefetchedBytes += prefetchedBytes
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// cacheEncFileMeta caches the sidecar meta of encryptedName, metas with a merkle root change with every write
+// and header format files keep their meta in the contents, neither are cached
+func (encFs *EncFs) cacheEncFileMeta(encryptedName string) (bool, error) {
+	// stat before read, a meta replaced in between is detected by the next lookup
+	metaFileInfo, err := encFs.backend().Stat(encFs.encFileMetaName(encryptedName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	encFileMeta, err := openEncFileMeta(encFs, encFs.backend(), encryptedName)
+	if err != nil || encFileMeta == nil || encFileMeta.MerkleRoot != nil {
+		return false, err
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	encFs.metaCache[encryptedName] = &cachedEncFileMeta{
+		encFileMeta: encFileMeta,
+		size:        metaFileInfo.Size(),
+		modTime:     metaFileInfo.ModTime(),
+	}
+	return true, nil
+}
+
+// openCachedEncFileMeta is openEncFileMeta served from the Preload cache while the meta file is unchanged
+func (encFs *EncFs) openCachedEncFileMeta(encryptedName string) (*EncFileMeta, error) {
+	encFs.mutex.Lock()
+	cached, found := encFs.metaCache[encryptedName]
+	preloaded := len(encFs.metaCache) > 0
+	encFs.mutex.Unlock()
+	if !found {
+		if preloaded {
+			encFs.countCacheRequest(METRIC_CACHE_META, false)
+		}
+		return openEncFileMeta(encFs, encFs.backend(), encryptedName)
+	}
+	metaFileInfo, err := encFs.backend().Stat(encFs.encFileMetaName(encryptedName))
+	if err == nil && metaFileInfo.Size() == cached.size && metaFileInfo.ModTime().Equal(cached.modTime) {
+		encFs.countCacheRequest(METRIC_CACHE_META, true)
+		// handles update their meta, e.g. the merkle root, never the cached one
+		encFileMeta := *cached.encFileMeta
+		return &encFileMeta, nil
+	}
+	encFs.countCacheRequest(METRIC_CACHE_META, false)
+	encFs.forgetCachedEncFileMetas(encryptedName)
+	return openEncFileMeta(encFs, encFs.backend(), encryptedName)
+}
+
+// forgetCachedEncFileMetas drops the cached metas of encryptedName and the files below it after they were removed
+// or replaced, a new meta may have the same size and modification time as the cached one
+func (encFs *EncFs) forgetCachedEncFileMetas(encryptedName string) {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	if len(encFs.metaCache) == 0 {
+		return
+	}
+	delete(encFs.metaCache, encryptedName)
+	prefix := encryptedName + string(filepath.Separator)
+	for cachedName := range encFs.metaCache {
+		if strings.HasPrefix(cachedName, prefix) {
+			delete(encFs.metaCache, cachedName)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package encfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPreload(t *testing.T) {
+	tests := []struct {
+		name       string
+		patterns   []string
+		options    *PreloadOptions
+		wantReport PreloadReport
+		wantErr    bool
+	}{
+		{"file", []string{"/dir/a"}, nil, PreloadReport{FileCount: 1, CachedMetaCount: 1}, false},
+		{"directory", []string{"/dir"}, nil, PreloadReport{DirCount: 1}, false},
+		{"recursive", []string{"/dir"}, &PreloadOptions{Recursive: true},
+			PreloadReport{FileCount: 2, DirCount: 2, CachedMetaCount: 2}, false},
+		{"pattern", []string{"/*.txt"}, nil, PreloadReport{FileCount: 2, CachedMetaCount: 2}, false},
+		{"prefetch", []string{"/dir/a", "/c.txt"}, &PreloadOptions{PrefetchBytes: 10},
+			PreloadReport{FileCount: 2, CachedMetaCount: 2, PrefetchedBytes: 10 + 4}, false},
+		{"prefetch more than the file", []string{"/c.txt"}, &PreloadOptions{PrefetchBytes: 1000},
+			PreloadReport{FileCount: 1, CachedMetaCount: 1, PrefetchedBytes: 4}, false},
+		// the other paths are still preloaded
+		{"missing", []string{"/missing", "/dir/a"}, nil,
+			PreloadReport{FileCount: 1, CachedMetaCount: 1, ErrorCount: 1}, true},
+		{"pattern without matches", []string{"/*.jpg"}, nil, PreloadReport{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/a", testPattern(100))
+			writeTestFile(t, encFs, "/dir/sub/b", testPattern(200))
+			writeTestFile(t, encFs, "/c.txt", []byte("data"))
+			writeTestFile(t, encFs, "/d.txt", []byte("more data"))
+
+			report, err := encFs.Preload(test.patterns, test.options)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got %v, want error %t", err, test.wantErr)
+			}
+			if *report != test.wantReport {
+				t.Fatalf("got report %+v, want %+v", *report, test.wantReport)
+			}
+			if len(encFs.metaCache) != test.wantReport.CachedMetaCount {
+				t.Fatalf("cached %d metas, want %d", len(encFs.metaCache), test.wantReport.CachedMetaCount)
+			}
+		})
+	}
+}
+
+func TestPreloadedMetas(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte)
+	}{
+		{"unchanged", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			return "/file", testPattern(100)
+		}},
+		{"rewritten", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			writeTestFile(t, encFs, "/file", []byte("new"))
+			return "/file", []byte("new")
+		}},
+		// the meta replaced by another EncFs is detected by its size or modification time
+		{"rewritten by another EncFs", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			writeTestFile(t, other, "/file", []byte("other"))
+			return "/file", []byte("other")
+		}},
+		{"renamed over", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			writeTestFile(t, encFs, "/other", []byte("renamed"))
+			if err := encFs.Rename("/other", "/file"); err != nil {
+				t.Fatal(err)
+			}
+			return "/file", []byte("renamed")
+		}},
+		{"removed and created", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			if err := encFs.Remove("/file"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("created"))
+			return "/file", []byte("created")
+		}},
+		{"removed directory", func(t *testing.T, encFs *EncFs, other *EncFs) (string, []byte) {
+			if err := encFs.RemoveAll("/dir"); err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", []byte("created"))
+			return "/dir/file", []byte("created")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			other := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", testPattern(100))
+			writeTestFile(t, encFs, "/dir/file", testPattern(100))
+			if _, err := encFs.Preload([]string{"/"}, &PreloadOptions{Recursive: true}); err != nil {
+				t.Fatal(err)
+			}
+			name, want := test.change(t, encFs, other)
+			checkTestFile(t, encFs, name, want)
+			// handles never change the cached meta
+			f, err := encFs.OpenFile(name, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("x"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want = append([]byte("x"), want[1:]...)
+			checkTestFile(t, encFs, name, want)
+			checkTestFile(t, other, name, want)
+		})
+	}
+}
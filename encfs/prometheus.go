@@ -0,0 +1,209 @@
+package encfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PROMETHEUS_CONTENT_TYPE is the content type of the text exposition format served by PrometheusCollector
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultPrometheusBuckets are the upper bounds in seconds of the histograms of NewPrometheusCollector, from 100us
+// for keystream generation to 10s for slow KMS requests
+var DefaultPrometheusBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var prometheusHelps = map[string]string{
+	METRIC_OPERATIONS_TOTAL:      "Operations of the encrypted filesystem by op and result.",
+	METRIC_READS_TOTAL:           "Reads of encrypted files.",
+	METRIC_WRITES_TOTAL:          "Writes of encrypted files.",
+	METRIC_READ_BYTES_TOTAL:      "Plaintext bytes read from encrypted files.",
+	METRIC_WRITTEN_BYTES_TOTAL:   "Plaintext bytes written to encrypted files.",
+	METRIC_ENCRYPTED_BYTES_TOTAL: "Content bytes encrypted by cipher.",
+	METRIC_DECRYPTED_BYTES_TOTAL: "Content bytes decrypted by cipher.",
+	METRIC_KEYSTREAM_SECONDS:     "Time of generating and applying the CTR keystream of a read or write.",
+	METRIC_KMS_DECRYPT_SECONDS:   "Time of decrypting a master key by provider and result.",
+	METRIC_CACHE_REQUESTS_TOTAL:  "Cache lookups by cache and result.",
+}
+
+// PrometheusCollector is a MetricsCollector keeping the metrics in memory and serving them in the Prometheus text
+// exposition format, so no Prometheus client library is needed, it is an http.Handler for a /metrics endpoint
+type PrometheusCollector struct {
+	mutex      *sync.Mutex
+	buckets    []float64
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*prometheusHistogram
+}
+
+type prometheusHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewPrometheusCollector returns an empty collector whose histograms have buckets, DefaultPrometheusBuckets when
+// empty
+func NewPrometheusCollector(buckets ...float64) *PrometheusCollector {
+	if len(buckets) == 0 {
+		buckets = DefaultPrometheusBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusCollector{
+		mutex:      &sync.Mutex{},
+		buckets:    buckets,
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*prometheusHistogram{},
+	}
+}
+
+func (c *PrometheusCollector) AddCounter(name string, value float64, labels ...string) {
+	series := formatPrometheusLabels(labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counter := c.counters[name]
+	if counter == nil {
+		counter = map[string]float64{}
+		c.counters[name] = counter
+	}
+	counter[series] += value
+}
+
+func (c *PrometheusCollector) ObserveHistogram(name string, value float64, labels ...string) {
+	series := formatPrometheusLabels(labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	histograms := c.histograms[name]
+	if histograms == nil {
+		histograms = map[string]*prometheusHistogram{}
+		c.histograms[name] = histograms
+	}
+	histogram := histograms[series]
+	if histogram == nil {
+		histogram = &prometheusHistogram{counts: make([]uint64, len(c.buckets))}
+		histograms[series] = histogram
+	}
+	for i, bucket := range c.buckets {
+		if value <= bucket {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+// WriteTo writes all metrics in the text exposition format, metrics and series are sorted by name
+func (c *PrometheusCollector) WriteTo(w io.Writer) (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writer := &prometheusWriter{writer: bufio.NewWriter(w)}
+	for _, name := range sortedKeys(c.counters) {
+		writer.header(name, "counter")
+		for _, series := range sortedKeys(c.counters[name]) {
+			writer.sample(name, series, "", c.counters[name][series])
+		}
+	}
+	for _, name := range sortedKeys(c.histograms) {
+		writer.header(name, "histogram")
+		for _, series := range sortedKeys(c.histograms[name]) {
+			histogram := c.histograms[name][series]
+			for i, bucket := range c.buckets {
+				writer.sample(name+"_bucket", series, formatPrometheusValue(bucket), float64(histogram.counts[i]))
+			}
+			writer.sample(name+"_bucket", series, "+Inf", float64(histogram.count))
+			writer.sample(name+"_sum", series, "", histogram.sum)
+			writer.sample(name+"_count", series, "", float64(histogram.count))
+		}
+	}
+	if writer.err == nil {
+		writer.err = writer.writer.Flush()
+	}
+	return writer.n, writer.err
+}
+
+func (c *PrometheusCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = c.WriteTo(w)
+}
+
+type prometheusWriter struct {
+	writer *bufio.Writer
+	n      int64
+	err    error
+}
+
+func (w *prometheusWriter) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w.writer, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *prometheusWriter) header(name, metricType string) {
+	if help, found := prometheusHelps[name]; found {
+		w.printf("# HELP %s %s\n", name, help)
+	}
+	w.printf("# TYPE %s %s\n", name, metricType)
+}
+
+// sample writes a line of name with the formatted labels of series and le of a bucket when not empty
+func (w *prometheusWriter) sample(name, series, le string, value float64) {
+	if le != "" {
+		if series != "" {
+			series += ","
+		}
+		series += `le="` + le + `"`
+	}
+	if series != "" {
+		series = "{" + series + "}"
+	}
+	w.printf("%s%s %s\n", name, series, formatPrometheusValue(value))
+}
+
+// formatPrometheusLabels returns the label pairs as name="value" joined by commas, an odd last name is dropped
+func formatPrometheusLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+prometheusLabelValueReplacer.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,151 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrQuarantined = errors.New("file is quarantined")
+)
+
+type QuarantinedFile struct {
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// WithAutoQuarantine quarantines files when opening or reading them finds corruption, later opens fail with
+// ErrQuarantined instead of returning garbage or failing halfway, the rest of the volume stays usable
+func (encFs *EncFs) WithAutoQuarantine(autoQuarantine bool) {
+	encFs.autoQuarantine = autoQuarantine
+}
+
+// Quarantine refuses opening name with ErrQuarantined until Unquarantine, Remove or RemoveAll, Stat and
+// listing still work so the file can be found and restored from a backup
+func (encFs *EncFs) Quarantine(name, reason string) (err error) {
+	defer encFs.audit("quarantine", name, "", 0, &err)
+	encFs.quarantineEncrypted(encFs.encryptFileName(name), reason)
+	return nil
+}
+
+// Unquarantine makes name accessible again, e.g. after the corruption was repaired
+func (encFs *EncFs) Unquarantine(name string) (err error) {
+	defer encFs.audit("unquarantine", name, "", 0, &err)
+	encFs.unquarantineEncrypted(encFs.encryptFileName(name))
+	return nil
+}
+
+// QuarantinedFiles lists the quarantined files sorted by path
+func (encFs *EncFs) QuarantinedFiles() []QuarantinedFile {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	quarantinedFiles := make([]QuarantinedFile, 0, len(encFs.quarantinedFiles))
+	for _, quarantinedFile := range encFs.quarantinedFiles {
+		quarantinedFiles = append(quarantinedFiles, *quarantinedFile)
+	}
+	sort.Slice(quarantinedFiles, func(i, j int) bool {
+		return quarantinedFiles[i].Path < quarantinedFiles[j].Path
+	})
+	return quarantinedFiles
+}
+
+func (encFs *EncFs) IsQuarantined(name string) bool {
+	return encFs.isQuarantinedEncrypted(encFs.encryptFileName(name))
+}
+
+// QuarantineCorruptFiles verifies every file under root by VerifyFile and quarantines the corrupt ones, files
+// without integrity tags are skipped, the newly quarantined files are returned
+func (encFs *EncFs) QuarantineCorruptFiles(root string) ([]QuarantinedFile, error) {
+	var quarantinedFiles []QuarantinedFile
+	err := encFs.walkEncrypted(root, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if !fileInfo.Mode().IsRegular() || encFs.isQuarantinedEncrypted(encryptedName) {
+			return nil
+		}
+		err := encFs.VerifyFile(plainName)
+		if !isCorruptionError(err) {
+			return nil
+		}
+		quarantinedFiles = append(quarantinedFiles, *encFs.quarantineEncrypted(encryptedName, err.Error()))
+		return nil
+	})
+	return quarantinedFiles, err
+}
+
+// isCorruptionError reports errors caused by broken contents or meta, not by the backend
+func isCorruptionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	return errors.Is(err, ErrIntegrityCheckFailed) || errors.Is(err, ErrDecryptFailed) ||
+		errors.Is(err, ErrBadFileHeader) || errors.Is(err, ErrBadFileMeta) || errors.Is(err, ErrMissingFileMeta) ||
+		errors.Is(err, ErrBadMetaChecksum) || errors.As(err, &syntaxError) || errors.As(err, &unmarshalTypeError)
+}
+
+func (encFs *EncFs) quarantineEncrypted(encryptedName, reason string) *QuarantinedFile {
+	quarantinedFile := &QuarantinedFile{
+		Path:   encFs.key.DecryptFileName(encryptedName),
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	if encFs.quarantinedFiles == nil {
+		encFs.quarantinedFiles = make(map[string]*QuarantinedFile)
+	}
+	encFs.quarantinedFiles[encryptedName] = quarantinedFile
+	encFs.getLogger().Warn("file quarantined", "path", quarantinedFile.Path, "reason", reason)
+	return quarantinedFile
+}
+
+func (encFs *EncFs) unquarantineEncrypted(encryptedName string) {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	delete(encFs.quarantinedFiles, encryptedName)
+}
+
+func (encFs *EncFs) isQuarantinedEncrypted(encryptedName string) bool {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	return encFs.quarantinedFiles[encryptedName] != nil
+}
+
+// checkQuarantine refuses opening quarantined files
+func (encFs *EncFs) checkQuarantine(op, encryptedName string) error {
+	if encFs.isQuarantinedEncrypted(encryptedName) {
+		return &os.PathError{Op: op, Path: encryptedName, Err: ErrQuarantined}
+	}
+	return nil
+}
+
+// autoQuarantineOnErr quarantines encryptedName when err is caused by corruption and auto quarantine is on
+func (encFs *EncFs) autoQuarantineOnErr(encryptedName string, err error) {
+	if encFs != nil && encFs.autoQuarantine && isCorruptionError(err) {
+		encFs.quarantineEncrypted(encryptedName, err.Error())
+	}
+}
+
+// moveQuarantined keeps the quarantine of renamed files and of files in renamed or removed directories
+func (encFs *EncFs) moveQuarantined(oldEncryptedName, newEncryptedName string) {
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	prefix := oldEncryptedName + string(filepath.Separator)
+	for encryptedName, quarantinedFile := range encFs.quarantinedFiles {
+		if encryptedName != oldEncryptedName && !strings.HasPrefix(encryptedName, prefix) {
+			continue
+		}
+		delete(encFs.quarantinedFiles, encryptedName)
+		if newEncryptedName != "" {
+			movedName := newEncryptedName + strings.TrimPrefix(encryptedName, oldEncryptedName)
+			quarantinedFile.Path = encFs.key.DecryptFileName(movedName)
+			encFs.quarantinedFiles[movedName] = quarantinedFile
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func corruptTestFile(t *testing.T, base afero.Fs, name string) {
+	t.Helper()
+	flipTestByte(t, base, name, INTEGRITY_BLOCK_SIZE+1)
+}
+
+func TestAutoQuarantine(t *testing.T) {
+	data := testPattern(3*INTEGRITY_BLOCK_SIZE + 100)
+	tests := []struct {
+		name           string
+		autoQuarantine bool
+		corrupt        func(t *testing.T, base afero.Fs)
+		wantQuarantine bool
+	}{
+		{"changed contents", true, func(t *testing.T, base afero.Fs) { corruptTestFile(t, base, "/dir/file") }, true},
+		{"garbage meta", true, func(t *testing.T, base afero.Fs) {
+			if err := afero.WriteFile(base, "/dir/file"+EncFileExt, []byte("not json"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"truncated meta", true, func(t *testing.T, base afero.Fs) {
+			if err := afero.WriteFile(base, "/dir/file"+EncFileExt, []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"off", false, func(t *testing.T, base afero.Fs) { corruptTestFile(t, base, "/dir/file") }, false},
+		// backend errors are not corruption
+		{"removed", true, func(t *testing.T, base afero.Fs) {
+			if err := base.Remove("/dir/file"); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithIntegrityTags(true)
+			encFs.WithAutoQuarantine(test.autoQuarantine)
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", data)
+			writeTestFile(t, encFs, "/dir/other", data)
+			test.corrupt(t, base)
+
+			if _, err := afero.ReadFile(encFs, "/dir/file"); err == nil || errors.Is(err, ErrQuarantined) {
+				t.Fatalf("first read: got %v", err)
+			}
+			_, err := afero.ReadFile(encFs, "/dir/file")
+			if errors.Is(err, ErrQuarantined) != test.wantQuarantine {
+				t.Fatalf("second read: got %v", err)
+			}
+			if encFs.IsQuarantined("/dir/file") != test.wantQuarantine {
+				t.Fatalf("quarantined: got %t", !test.wantQuarantine)
+			}
+			quarantinedFiles := encFs.QuarantinedFiles()
+			if test.wantQuarantine {
+				if len(quarantinedFiles) != 1 || quarantinedFiles[0].Path != "/dir/file" ||
+					quarantinedFiles[0].Reason == "" {
+					t.Fatalf("got quarantined files %v", quarantinedFiles)
+				}
+				var pathError *os.PathError
+				if !errors.As(err, &pathError) {
+					t.Fatalf("got %v, want a path error", err)
+				}
+				// quarantined files can still be found
+				if _, err := encFs.Stat("/dir/file"); err != nil {
+					t.Fatal(err)
+				}
+			} else if len(quarantinedFiles) != 0 {
+				t.Fatalf("got quarantined files %v", quarantinedFiles)
+			}
+			checkTestFile(t, encFs, "/dir/other", data)
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tests := []struct {
+		name          string
+		change        func(t *testing.T, encFs *EncFs)
+		wantPaths     []string
+		wantReadable  []string
+		wantNotExists []string
+	}{
+		{"quarantined", func(t *testing.T, encFs *EncFs) {}, []string{"/dir/a", "/dir/sub/b"},
+			[]string{"/c"}, nil},
+		{"unquarantined", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Unquarantine("/dir/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/dir/sub/b"}, []string{"/dir/a", "/c"}, nil},
+		{"renamed file", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/a", "/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/a", "/dir/sub/b"}, []string{"/c"}, nil},
+		{"renamed directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/moved/a", "/moved/sub/b"}, []string{"/c"}, nil},
+		{"removed file", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/dir/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/dir/sub/b"}, []string{"/c"}, []string{"/dir/a"}},
+		{"removed directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.RemoveAll("/dir/sub"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/dir/a"}, []string{"/c"}, []string{"/dir/sub/b"}},
+		// a new file of a removed quarantined name is accessible
+		{"recreated", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/dir/a"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/a", []byte("data"))
+		}, []string{"/dir/sub/b"}, []string{"/dir/a", "/c"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"/dir/a", "/dir/sub/b", "/c"} {
+				writeTestFile(t, encFs, name, []byte("data"))
+			}
+			for _, name := range []string{"/dir/a", "/dir/sub/b"} {
+				if err := encFs.Quarantine(name, "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			test.change(t, encFs)
+
+			quarantinedFiles := encFs.QuarantinedFiles()
+			if len(quarantinedFiles) != len(test.wantPaths) {
+				t.Fatalf("got quarantined files %v, want %v", quarantinedFiles, test.wantPaths)
+			}
+			for i, quarantinedFile := range quarantinedFiles {
+				if quarantinedFile.Path != test.wantPaths[i] || quarantinedFile.Reason != "test" {
+					t.Fatalf("got quarantined files %v, want %v", quarantinedFiles, test.wantPaths)
+				}
+				for _, open := range []func() (afero.File, error){
+					func() (afero.File, error) { return encFs.Open(quarantinedFile.Path) },
+					func() (afero.File, error) { return encFs.OpenFile(quarantinedFile.Path, os.O_RDWR, 0) },
+					func() (afero.File, error) { return encFs.Create(quarantinedFile.Path) },
+				} {
+					if _, err := open(); !errors.Is(err, ErrQuarantined) {
+						t.Fatalf("%s: got %v, want %v", quarantinedFile.Path, err, ErrQuarantined)
+					}
+				}
+			}
+			for _, name := range test.wantReadable {
+				readTestFile(t, encFs, name)
+			}
+			for _, name := range test.wantNotExists {
+				if _, err := encFs.Stat(name); !os.IsNotExist(err) {
+					t.Fatalf("%s: got %v, want not exist", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestQuarantineCorruptFiles(t *testing.T) {
+	data := testPattern(2*INTEGRITY_BLOCK_SIZE + 100)
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	encFs.WithIntegrityTags(true)
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir/a", "/dir/sub/b", "/dir/sub/c"} {
+		writeTestFile(t, encFs, name, data)
+	}
+	// files without integrity tags are skipped
+	encFs.WithIntegrityTags(false)
+	writeTestFile(t, encFs, "/dir/untagged", data)
+	corruptTestFile(t, base, "/dir/untagged")
+	corruptTestFile(t, base, "/dir/sub/b")
+
+	quarantinedFiles, err := encFs.QuarantineCorruptFiles("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantinedFiles) != 1 || quarantinedFiles[0].Path != "/dir/sub/b" {
+		t.Fatalf("got quarantined files %v", quarantinedFiles)
+	}
+	if !errors.Is(encFs.VerifyFile("/dir/sub/b"), ErrQuarantined) {
+		t.Fatal("verified a quarantined file")
+	}
+	// quarantined files are not verified again
+	quarantinedFiles, err = encFs.QuarantineCorruptFiles("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantinedFiles) != 0 {
+		t.Fatalf("quarantined again %v", quarantinedFiles)
+	}
+	checkTestFile(t, encFs, "/dir/sub/c", data)
+}
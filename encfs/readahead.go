@@ -0,0 +1,149 @@
+package encfs
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// reads continuing READ_AHEAD_MIN_SEQUENTIAL_READS reads in a row are sequential and start read-ahead
+const READ_AHEAD_MIN_SEQUENTIAL_READS = 2
+
+// readAheadBuffer holds decrypted contents at offset, prefetched by a goroutine or by the Read needing it first
+type readAheadBuffer struct {
+	offset int64
+	size   int
+	data   []byte
+	err    error
+	filled bool
+	// generation is the content generation of encFs when data was read, data is stale once it changes
+	generation uint64
+}
+
+// WithReadAhead prefetches and decrypts the next chunks of 64KiB, or of the chunk size of chunked files, in the
+// background once a handle is read sequentially, so streaming consumers like tar or media servers do not wait for
+// decryption, up to two buffers of chunks are held per handle, writes through this EncFs drop prefetched contents,
+// 0 disables read-ahead
+func (encFs *EncFs) WithReadAhead(chunks int) {
+	encFs.readAheadChunks = chunks
+}
+
+func (encFs *EncFs) getReadAheadChunks() int {
+	if encFs == nil || encFs.key == nil || encFs.readAheadChunks < 0 {
+		return 0
+	}
+	return encFs.readAheadChunks
+}
+
+func (encFs *EncFs) getContentGeneration() uint64 {
+	return atomic.LoadUint64(&encFs.contentGeneration)
+}
+
+// readAheadRead is Read of handles with read-ahead, sequential reads are served from prefetched buffers and
+// keep the next buffer prefetching
+func (f *EncFile) readAheadRead(p []byte, chunks int) (int, error) {
+	if f.filePos != f.readAheadPos {
+		f.readAheadBuffers = nil
+		f.readAheadStreak = 0
+	}
+	readLen, err := f.readAheadBuffered(p)
+	if readLen == 0 && err == nil {
+		readLen, err = f.readAtCached(p, f.filePos)
+	}
+	f.filePos += int64(readLen)
+	if err := f.seekUnderlyingFilePos(readLen); err != nil {
+		return readLen, err
+	}
+	f.readAheadPos = f.filePos
+	f.readAheadStreak++
+	if f.readAheadStreak >= READ_AHEAD_MIN_SEQUENTIAL_READS {
+		f.startReadAhead(int(f.encFileMeta.chunkSize()) * chunks)
+	}
+	if err == io.EOF && readLen > 0 {
+		err = nil
+	}
+	return readLen, err
+}
+
+// readAheadBuffered copies prefetched contents at the file position into p, nothing is copied when the contents
+// are not prefetched, stale or failed to read, the caller reads them itself then
+func (f *EncFile) readAheadBuffered(p []byte) (int, error) {
+	for len(f.readAheadBuffers) > 0 {
+		buffer := f.readAheadBuffers[0]
+		f.fillReadAhead(buffer)
+		if buffer.err != nil || buffer.generation != f.encFs.getContentGeneration() || f.filePos < buffer.offset {
+			f.readAheadBuffers = nil
+			return 0, nil
+		}
+		bufferOffset := f.filePos - buffer.offset
+		if bufferOffset < int64(len(buffer.data)) {
+			return copy(p, buffer.data[bufferOffset:]), nil
+		}
+		if len(buffer.data) < buffer.size {
+			// the buffer ends at the end of file
+			f.readAheadBuffers = nil
+			return 0, io.EOF
+		}
+		f.readAheadBuffers = f.readAheadBuffers[1:]
+	}
+	return 0, nil
+}
+
+// startReadAhead prefetches size bytes after the last buffer when at most half of the buffers are left to read
+func (f *EncFile) startReadAhead(size int) {
+	offset := f.filePos
+	if bufferCount := len(f.readAheadBuffers); bufferCount > 0 {
+		lastBuffer := f.readAheadBuffers[bufferCount-1]
+		if bufferCount > 1 || lastBuffer.filled && len(lastBuffer.data) < lastBuffer.size {
+			return
+		}
+		if remaining := lastBuffer.offset + int64(lastBuffer.size) - f.filePos; remaining > int64(size/2) {
+			return
+		}
+		offset = lastBuffer.offset + int64(lastBuffer.size)
+	}
+	buffer := &readAheadBuffer{offset: offset, size: size}
+	f.readAheadBuffers = append(f.readAheadBuffers, buffer)
+	go func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		// a Read may have filled the buffer or dropped it meanwhile
+		for _, readAheadBuffer := range f.readAheadBuffers {
+			if readAheadBuffer == buffer && !f.closed {
+				f.fillReadAhead(buffer)
+			}
+		}
+	}()
+}
+
+// fillReadAhead reads the contents of buffer unless done, f.mutex must be held
+func (f *EncFile) fillReadAhead(buffer *readAheadBuffer) {
+	if buffer.filled {
+		return
+	}
+	buffer.filled = true
+	buffer.generation = f.encFs.getContentGeneration()
+	data := make([]byte, buffer.size)
+	readLen, err := f.readAtCached(data, buffer.offset)
+	if err == io.EOF {
+		err = nil
+	}
+	buffer.data, buffer.err = data[:readLen], err
+}
+
+// readAtCached is readAt through the block cache when enabled
+func (f *EncFile) readAtCached(p []byte, off int64) (int, error) {
+	if cache := f.getBlockCache(); cache != nil {
+		return f.readAtBlockCache(cache, p, off)
+	}
+	return f.readAt(p, off)
+}
+
+// seekUnderlyingFilePos moves the underlying file of CTR files to the file position after readLen bytes were read
+// without it, writes continue there
+func (f *EncFile) seekUnderlyingFilePos(readLen int) error {
+	if f.encFileMeta.isChunked() || readLen == 0 {
+		return nil
+	}
+	_, err := f.file.Seek(f.filePos+f.headerSize, io.SeekStart)
+	return err
+}
@@ -0,0 +1,137 @@
+package encfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReadAhead(t *testing.T) {
+	tests := []struct {
+		name     string
+		cipher   string
+		chunks   int
+		readSize int
+		// blockCache reads through the block cache
+		blockCache bool
+	}{
+		{"ctr", CIPHER_AES_CTR, 1, 1000, false},
+		{"ctr small reads", CIPHER_AES_CTR, 2, 7, false},
+		{"ctr reads larger than buffers", CIPHER_AES_CTR, 1, 100000, false},
+		{"gcm", CIPHER_AES_GCM, 2, 3000, false},
+		{"gcm block cache", CIPHER_AES_GCM, 1, 5000, true},
+		{"disabled", CIPHER_AES_CTR, 0, 1000, false},
+	}
+	data := testRandomBytes(300000+17, 1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(test.cipher); err != nil {
+				t.Fatal(err)
+			}
+			if test.blockCache {
+				if err := encFs.WithBlockCache(4096, 100); err != nil {
+					t.Fatal(err)
+				}
+			}
+			encFs.WithReadAhead(test.chunks)
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			var got []byte
+			buff := make([]byte, test.readSize)
+			prefetched := false
+			for {
+				n, err := f.Read(buff)
+				got = append(got, buff[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				encFile := f.(*EncFile)
+				encFile.mutex.Lock()
+				prefetched = prefetched || len(encFile.readAheadBuffers) > 0
+				encFile.mutex.Unlock()
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("read other contents")
+			}
+			if prefetched != (test.chunks > 0) {
+				t.Fatalf("got prefetched %t with %d chunks", prefetched, test.chunks)
+			}
+		})
+	}
+}
+
+func TestReadAheadOfChangedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		cipher string
+	}{
+		{"ctr", CIPHER_AES_CTR},
+		{"gcm", CIPHER_AES_GCM},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.WithContentCipher(test.cipher); err != nil {
+				t.Fatal(err)
+			}
+			encFs.WithReadAhead(2)
+			data := testRandomBytes(200000, 2)
+			writeTestFile(t, encFs, "/file", data)
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			buff := make([]byte, 100)
+			for i := 0; i < 3; i++ {
+				if _, err := io.ReadFull(f, buff); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// writes of another handle drop the prefetched contents
+			other, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.WriteAt([]byte("changed"), 300); err != nil {
+				t.Fatal(err)
+			}
+			if err := other.Close(); err != nil {
+				t.Fatal(err)
+			}
+			copy(data[300:], "changed")
+			if _, err := io.ReadFull(f, buff); err != nil || !bytes.Equal(buff, data[300:400]) {
+				t.Fatalf("read %q: %v", buff[:10], err)
+			}
+			// a seek ends the sequential reads
+			if _, err := f.Seek(100000, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(f, buff); err != nil || !bytes.Equal(buff, data[100000:100100]) {
+				t.Fatalf("read %q after a seek: %v", buff[:10], err)
+			}
+			// writes continue at the position of the handle, not at the end of the prefetched contents
+			if _, err := f.Write([]byte("written")); err != nil {
+				t.Fatal(err)
+			}
+			copy(data[100100:], "written")
+			if _, err := io.ReadFull(f, buff); err != nil || !bytes.Equal(buff, data[100107:100207]) {
+				t.Fatalf("read %q after a write: %v", buff[:10], err)
+			}
+			checkTestFile(t, encFs, "/file", data)
+		})
+	}
+}
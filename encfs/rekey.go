@@ -0,0 +1,342 @@
+package encfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	KEY_ID_INFO = "encfs-key-id"
+
+	REKEY_TEMP_FILE_SUFFIX      = ".__rekey" + EncFileExt
+	REKEY_TEMP_META_FILE_SUFFIX = ".__rekeymeta" + EncFileExt
+)
+
+var (
+	ErrRekeyNameMapper = errors.New("new key must use the name mapper of the current key")
+	ErrRekeyUnknownKey = errors.New("file is encrypted with an unknown key")
+	ErrWrongKey        = errors.New("file is encrypted with another key")
+)
+
+type RekeyReport struct {
+	ScannedCount int `json:"scanned_count"`
+	RekeyedCount int `json:"rekeyed_count"`
+	SkippedCount int `json:"skipped_count"`
+}
+
+// KeyId returns a short identifier of the key recorded in meta files, the key can not be derived from it
+func (k *EncryptionMasterKey) KeyId() string {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte(KEY_ID_INFO))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (encFs *EncFs) newFileKeyId() string {
+	if encFs == nil || encFs.key == nil {
+		return ""
+	}
+	return encFs.key.KeyId()
+}
+
+// WithKeyring keeps files encrypted with one of keys readable and writable after a key rotation, the key id recorded
+// in the meta selects the key, new files use the key of encFs, file names are always mapped by the key of encFs and
+// Rekey moves files of the keyring to a new key
+func (encFs *EncFs) WithKeyring(keys []*EncryptionMasterKey) {
+	keyring := make(map[string]*EncryptionMasterKey, len(keys))
+	for _, key := range keys {
+		keyring[key.KeyId()] = key
+	}
+	encFs.keyring = keyring
+}
+
+// contentKey returns the key of the contents of encFileMeta, the key of encFs unless the meta records the key id of
+// a key in the keyring, version 3 files use the content subkey of it
+func (encFs *EncFs) contentKey(encFileMeta *EncFileMeta) []byte {
+	key := encFs.key
+	if encFileMeta != nil && encFileMeta.KeyId != "" && encFs.keyring[encFileMeta.KeyId] != nil {
+		key = encFs.keyring[encFileMeta.KeyId]
+	}
+	if encFileMeta != nil && encFileMeta.usesSubkeys() {
+		return key.contentSubkey()
+	}
+	return key.key
+}
+
+func (f *EncFile) contentKey() []byte {
+	return f.encFs.contentKey(f.encFileMeta)
+}
+
+// WithLazyRekey re-encrypts files of the keyring with the key of encFs when their last handle is closed, so a key
+// rotation completes gradually as files are used, failures are audited as "lazy-rekey" and leave the file readable
+// with its old key
+func (encFs *EncFs) WithLazyRekey(lazyRekey bool) {
+	encFs.lazyRekey = lazyRekey
+}
+
+// trackLazyRekey counts the handles of a file which is re-encrypted when the last of them is closed, files of the
+// current key and the handles used by the re-encryption itself are not tracked
+func (encFs *EncFs) trackLazyRekey(encryptedName string, encFileMeta *EncFileMeta) bool {
+	if encFs == nil || !encFs.lazyRekey || encFileMeta == nil || encFileMeta.KeyId == "" ||
+		encFileMeta.KeyId == encFs.key.KeyId() || encFs.keyring[encFileMeta.KeyId] == nil {
+		return false
+	}
+	encFs.mutex.Lock()
+	defer encFs.mutex.Unlock()
+	if encFs.lazyRekeyHandles == nil {
+		encFs.lazyRekeyHandles = make(map[string]int)
+	}
+	if encFs.lazyRekeyHandles[encryptedName] < 0 {
+		return false
+	}
+	encFs.lazyRekeyHandles[encryptedName]++
+	return true
+}
+
+// lazyRekeyOnClose re-encrypts encryptedName after its last tracked handle was closed, handles failing to close
+// leave the file to the next close
+func (encFs *EncFs) lazyRekeyOnClose(encryptedName string, closed bool) {
+	encFs.mutex.Lock()
+	encFs.lazyRekeyHandles[encryptedName]--
+	if encFs.lazyRekeyHandles[encryptedName] > 0 || !closed {
+		if encFs.lazyRekeyHandles[encryptedName] == 0 {
+			delete(encFs.lazyRekeyHandles, encryptedName)
+		}
+		encFs.mutex.Unlock()
+		return
+	}
+	// handles opened while re-encrypting are not tracked
+	encFs.lazyRekeyHandles[encryptedName] = -1
+	encFs.mutex.Unlock()
+	defer func() {
+		encFs.mutex.Lock()
+		delete(encFs.lazyRekeyHandles, encryptedName)
+		encFs.mutex.Unlock()
+	}()
+	var err error
+	defer encFs.audit("lazy-rekey", encFs.key.DecryptFileName(encryptedName), "", 0, &err)
+	fileInfo, err := encFs.base.Stat(encryptedName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed or renamed while open
+			err = nil
+		}
+		return
+	}
+	if _, err = encFs.rekeyFile(encFs, encryptedName, fileInfo); err != nil {
+		encFs.getLogger().Warn("lazy rekey failed, the file keeps its old key", "path",
+			encFs.key.DecryptFileName(encryptedName), "error", err)
+	}
+}
+
+// checkKeyId fails with ErrWrongKey when encFileMeta records the key id of another key, so a wrong key fails on
+// open instead of returning garbage, files written before key ids can not be checked
+func (encFs *EncFs) checkKeyId(encryptedName string, encFileMeta *EncFileMeta) error {
+	if encFileMeta == nil || encFileMeta.KeyId == "" || encFs == nil || encFs.key == nil {
+		return nil
+	}
+	if encFileMeta.KeyId != encFs.key.KeyId() && encFs.keyring[encFileMeta.KeyId] == nil {
+		return &os.PathError{Op: "open", Path: encryptedName, Err: ErrWrongKey}
+	}
+	return nil
+}
+
+// Rekey re-encrypts the content of every file under root with newKey and a new IV, files already
+// encrypted with newKey are skipped so an interrupted Rekey can be resumed by calling it again, use
+// NewEncFs(newKey) afterwards, file names are not re-encrypted so newKey must share the name mapper
+func (encFs *EncFs) Rekey(ctx context.Context, root string, newKey *EncryptionMasterKey) (*RekeyReport, error) {
+	if encFs.key.isFileNameEncrypted() && newKey.nameMapper != encFs.key.nameMapper {
+		return nil, ErrRekeyNameMapper
+	}
+	newEncFs := newEncFs(newKey, encFs.base)
+	newEncFs.retryPolicy = encFs.retryPolicy
+	report := &RekeyReport{}
+	err := encFs.walkEncrypted(root, func(plainName, encryptedName string, fileInfo os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		report.ScannedCount++
+		rekeyed, err := encFs.rekeyFile(newEncFs, encryptedName, fileInfo)
+		if err != nil {
+			return err
+		}
+		if rekeyed {
+			report.RekeyedCount++
+		} else {
+			report.SkippedCount++
+		}
+		return nil
+	})
+	return report, err
+}
+
+// rekeyFile writes the new data and meta to temp files, then renames the meta and the data into
+// place, a temp data file next to a meta with the new key id means only the data rename is left,
+// header format files are replaced by a single rename
+func (encFs *EncFs) rekeyFile(newEncFs *EncFs, encryptedName string, fileInfo os.FileInfo) (bool, error) {
+	tempName := encryptedName + REKEY_TEMP_FILE_SUFFIX
+	tempMetaName := encryptedName + REKEY_TEMP_META_FILE_SUFFIX
+	newKeyId := newEncFs.key.KeyId()
+	encFileMeta, headerSize, err := encFs.readFileMeta(encryptedName)
+	if err != nil || encFileMeta == nil {
+		// files without meta are not encrypted
+		return false, err
+	}
+	if _, err := encFs.base.Stat(tempName); err == nil {
+		if encFileMeta.KeyId == newKeyId && headerSize == 0 {
+			if err := encFs.base.Rename(tempName, encryptedName); err != nil {
+				return false, err
+			}
+			return true, encFs.syncBackendFile(filepath.Dir(encryptedName))
+		}
+		// interrupted before the meta was renamed, start over
+		_ = encFs.base.Remove(tempName)
+		_ = encFs.base.Remove(tempMetaName)
+	}
+	if encFileMeta.KeyId == newKeyId {
+		return false, nil
+	}
+	if encFileMeta.KeyId != "" && encFileMeta.KeyId != encFs.key.KeyId() && encFs.keyring[encFileMeta.KeyId] == nil {
+		return false, &os.PathError{Op: "rekey", Path: encryptedName, Err: ErrRekeyUnknownKey}
+	}
+
+	iv := make([]byte, 16)
+	if err := encFs.readRandom(iv); err != nil {
+		return false, err
+	}
+	newEncFileMeta := &EncFileMeta{
+		Magic:     ENC_FILE_META_MAGIC,
+		Version:   ENC_FILE_META_VERSION,
+		Iv:        iv,
+		Cipher:    encFileMeta.Cipher,
+		ChunkSize: encFileMeta.ChunkSize,
+		KeyId:     newKeyId,
+		// padded files stay padded with the same scheme
+		Padding:          encFileMeta.Padding,
+		PaddingBlockSize: encFileMeta.PaddingBlockSize,
+	}
+	if newEncFileMeta.isPadded() {
+		newEncFileMeta.setFlag(META_FLAG_PADDING)
+	}
+	newEncFileMeta.applyFinalChunk()
+	newEncFs.applySubkeys(newEncFileMeta)
+	newEncFileMeta.hasCopy = encFileMeta.hasCopy || newEncFs.metaCopy
+	if encFileMeta.sealKey != nil || newEncFs.encryptedMeta {
+		// sealed metas stay sealed, by the new key
+		newEncFileMeta.sealKey = newEncFs.key
+	}
+	if err := encFs.rekeyFileContent(newEncFs, encryptedName, tempName, newEncFileMeta, headerSize, fileInfo); err != nil {
+		_ = encFs.base.Remove(tempName)
+		return false, err
+	}
+	if err := newEncFs.rekeyIntegrityTags(encryptedName, tempName, newEncFileMeta, headerSize); err != nil {
+		_ = encFs.base.Remove(tempName)
+		return false, err
+	}
+	if headerSize > 0 {
+		if err := encFs.base.Rename(tempName, encryptedName); err != nil {
+			return false, err
+		}
+		return true, encFs.syncBackendFile(filepath.Dir(encryptedName))
+	}
+	if err := writeEncFileMeta(encFs.base, tempMetaName, newEncFileMeta); err != nil {
+		_ = encFs.base.Remove(tempName)
+		_ = encFs.base.Remove(tempMetaName)
+		return false, err
+	}
+	if err := encFs.base.Rename(tempMetaName, encFs.encFileMetaName(encryptedName)); err != nil {
+		return false, err
+	}
+	encFs.forgetCachedEncFileMetas(encryptedName)
+	if err := encFs.base.Rename(tempName, encryptedName); err != nil {
+		return false, err
+	}
+	return true, encFs.syncBackendFile(filepath.Dir(encryptedName))
+}
+
+func (encFs *EncFs) rekeyFileContent(newEncFs *EncFs, encryptedName, tempName string, newEncFileMeta *EncFileMeta,
+	headerSize int64, fileInfo os.FileInfo) error {
+	file, err := encFs.base.Open(encryptedName)
+	if err != nil {
+		return err
+	}
+	oldEncFile, err := NewEncFile(encryptedName, file, encFs, false)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	defer func() {
+		_ = oldEncFile.Close()
+	}()
+	// the temp file is written to the backend of newEncFs, the same backend unless a volume is cloned
+	tempFile, err := newEncFs.base.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	newEncFile := &EncFile{
+		encFileMeta:   newEncFileMeta,
+		encFs:         newEncFs,
+		file:          tempFile,
+		headerSize:    headerSize,
+		headerPending: headerSize > 0,
+	}
+	defer func() {
+		_ = newEncFile.Close()
+	}()
+	if err := newEncFile.ensureHeader(); err != nil {
+		return err
+	}
+	if _, err := tempFile.Seek(headerSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(newEncFile, oldEncFile); err != nil {
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	return newEncFs.base.Chtimes(tempName, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+func writeEncFileMeta(fs afero.Fs, name string, encFileMeta *EncFileMeta) error {
+	encFileMetaBytes, err := marshalEncFileMeta(encFileMeta)
+	if err != nil {
+		return err
+	}
+	metaFile, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = metaFile.Close()
+	}()
+	if _, err := metaFile.Write(encFileMetaBytes); err != nil {
+		return err
+	}
+	return metaFile.Sync()
+}
+
+// rekeyIntegrityTags replaces the integrity tags of encryptedName by the tags of the rekeyed temp file, reads fail
+// until the temp file is renamed into place and resuming Rekey finishes the rename
+func (encFs *EncFs) rekeyIntegrityTags(encryptedName, tempName string, newEncFileMeta *EncFileMeta, headerSize int64) error {
+	if newEncFileMeta.isChunked() {
+		return nil
+	}
+	if _, err := encFs.base.Stat(encryptedName + INTEGRITY_FILE_SUFFIX); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return encFs.writeIntegrityTags(encryptedName, tempName, newEncFileMeta, headerSize)
+}
@@ -0,0 +1,317 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestWrongKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+		// legacy files have no key id
+		legacy  bool
+		wantErr error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }, false, ErrWrongKey},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }, false, ErrWrongKey},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}, false, ErrWrongKey},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}, false, ErrWrongKey},
+		{"encrypted meta", func(encFs *EncFs) error {
+			encFs.WithEncryptedMeta(true)
+			return nil
+		}, false, ErrWrongKey},
+		{"ctr without key id", func(encFs *EncFs) error { return nil }, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			if test.legacy {
+				encFileMeta, _, err := encFs.readFileMeta("/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				encFileMeta.KeyId = ""
+				if err := writeEncFileMeta(base, encFs.encFileMetaName("/file"), encFileMeta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTestFile(t, encFs, "/file", []byte("data"))
+
+			otherFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(2)), base).(*EncFs)
+			if err := test.setup(otherFs); err != nil {
+				t.Fatal(err)
+			}
+			for _, flag := range []int{os.O_RDONLY, os.O_RDWR, os.O_WRONLY | os.O_APPEND} {
+				snapshot := snapshotTestFs(t, base)
+				f, err := otherFs.OpenFile("/file", flag, 0)
+				if err == nil {
+					_ = f.Close()
+				}
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("open %d: got %v, want %v", flag, err, test.wantErr)
+				}
+				var pathError *os.PathError
+				if err != nil && (!errors.As(err, &pathError) || pathError.Path != "/file") {
+					t.Fatalf("got %v, want a path error of the plaintext name", err)
+				}
+				// a wrong key never changes the file
+				if err != nil && !equalTestSnapshots(snapshot, snapshotTestFs(t, base)) {
+					t.Fatal("opening with a wrong key changed the backend")
+				}
+			}
+			// files without key id can not be checked, they read as garbage
+			if test.legacy {
+				if got, err := afero.ReadFile(otherFs, "/file"); err != nil || string(got) == "data" {
+					t.Fatalf("got %q and %v", got, err)
+				}
+			}
+			checkTestFile(t, encFs, "/file", []byte("data"))
+		})
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		subkeys bool
+		setup   func(encFs *EncFs) error
+	}{
+		{"ctr", false, func(encFs *EncFs) error { return nil }},
+		{"gcm", false, func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", false, func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm subkeys", true, func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+	}
+	data := testPattern(3*CONTENT_CHUNK_SIZE + 17)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nameMapper := NewNoopNameMapper()
+			oldKey := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), nameMapper)
+			newKey := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(2), nameMapper)
+			oldKey.WithSubkeys(test.subkeys)
+			newKey.WithSubkeys(test.subkeys)
+			oldFs, base := newTestEncFs(oldKey)
+			if err := test.setup(oldFs); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, oldFs, "/old", data)
+			writeTestFile(t, oldFs, "/changed", data)
+
+			encFs := NewEncFsWithBackend(newKey, base).(*EncFs)
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := encFs.Open("/old"); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("got %v without keyring, want %v", err, ErrWrongKey)
+			}
+			encFs.WithKeyring([]*EncryptionMasterKey{oldKey})
+			checkTestFile(t, encFs, "/old", data)
+
+			// files of the keyring are written with their key
+			f, err := encFs.OpenFile("/changed", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("changed"), CONTENT_CHUNK_SIZE-3); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			writeTestAppend(t, encFs, "/changed", []byte("appended"))
+			changed := append(append([]byte(nil), data...), "appended"...)
+			copy(changed[CONTENT_CHUNK_SIZE-3:], "changed")
+			checkTestFile(t, encFs, "/changed", changed)
+			checkTestFile(t, oldFs, "/changed", changed)
+			// new files use the key of encFs
+			writeTestFile(t, encFs, "/new", []byte("new"))
+			wantKeyIds := map[string]string{"/old": oldKey.KeyId(), "/changed": oldKey.KeyId(), "/new": newKey.KeyId()}
+			for name, keyId := range wantKeyIds {
+				encFileMeta, _, err := encFs.readFileMeta(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if encFileMeta.KeyId != keyId {
+					t.Fatalf("%s has key id %s, want %s", name, encFileMeta.KeyId, keyId)
+				}
+			}
+
+			// Rekey moves the files of the keyring to the new key
+			report, err := encFs.Rekey(context.Background(), "/", newKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.ScannedCount != 3 || report.RekeyedCount != 2 || report.SkippedCount != 1 {
+				t.Fatalf("got report %+v", report)
+			}
+			rekeyed := NewEncFsWithBackend(newKey, base).(*EncFs)
+			if err := test.setup(rekeyed); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, rekeyed, "/old", data)
+			checkTestFile(t, rekeyed, "/changed", changed)
+			checkTestFile(t, rekeyed, "/new", []byte("new"))
+			if _, err := oldFs.Open("/old"); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("got %v with the old key, want %v", err, ErrWrongKey)
+			}
+		})
+	}
+}
+
+func TestKeyringOfOtherKeys(t *testing.T) {
+	encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	otherFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(2)), base).(*EncFs)
+	tests := []struct {
+		name    string
+		keyring []*EncryptionMasterKey
+		wantErr error
+	}{
+		{"empty", nil, ErrWrongKey},
+		{"unrelated key", []*EncryptionMasterKey{NewEncryptionMasterKey(testKeyBytes(3))}, ErrWrongKey},
+		{"key of the file", []*EncryptionMasterKey{NewEncryptionMasterKey(testKeyBytes(3)),
+			NewEncryptionMasterKey(testKeyBytes(1))}, nil},
+		// the keyring replaces the one set before
+		{"replaced", []*EncryptionMasterKey{NewEncryptionMasterKey(testKeyBytes(3))}, ErrWrongKey},
+	}
+	for _, test := range tests {
+		otherFs.WithKeyring(test.keyring)
+		_, err := afero.ReadFile(otherFs, "/file")
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestLazyRekey(t *testing.T) {
+	data := testPattern(5000)
+	tests := []struct {
+		name      string
+		lazyRekey bool
+		// use opens and closes the file by encFs
+		use        func(t *testing.T, encFs *EncFs)
+		wantKeyId  int
+		wantEvents int
+	}{
+		{"read", true, func(t *testing.T, encFs *EncFs) {
+			checkTestFile(t, encFs, "/file", data)
+		}, 2, 1},
+		{"written", true, func(t *testing.T, encFs *EncFs) {
+			writeTestAppend(t, encFs, "/file", nil)
+		}, 2, 1},
+		{"off", false, func(t *testing.T, encFs *EncFs) {
+			checkTestFile(t, encFs, "/file", data)
+		}, 1, 0},
+		{"never opened", true, func(t *testing.T, encFs *EncFs) {
+			if _, err := encFs.Stat("/file"); err != nil {
+				t.Fatal(err)
+			}
+		}, 1, 0},
+		// the file is re-encrypted when the last handle is closed
+		{"two handles", true, func(t *testing.T, encFs *EncFs) {
+			first, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/file", data)
+			if encFileMeta, _, err := encFs.readFileMeta("/file"); err != nil || encFileMeta.KeyId != first.(*EncFile).
+				encFileMeta.KeyId {
+				t.Fatalf("rekeyed while a handle is open: %v", err)
+			}
+			if err := first.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}, 2, 1},
+		{"removed while open", true, func(t *testing.T, encFs *EncFs) {
+			f, err := encFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.Remove("/file"); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, NewEncFsWithBackend(encFs.keyring[NewEncryptionMasterKey(testKeyBytes(1)).KeyId()],
+				encFs.base), "/file", data)
+		}, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := []*EncryptionMasterKey{nil, NewEncryptionMasterKey(testKeyBytes(1)),
+				NewEncryptionMasterKey(testKeyBytes(2))}
+			oldFs, base := newTestEncFs(keys[1])
+			writeTestFile(t, oldFs, "/file", data)
+			encFs := NewEncFsWithBackend(keys[2], base).(*EncFs)
+			encFs.WithKeyring(keys[1:2])
+			encFs.WithLazyRekey(test.lazyRekey)
+			auditSink := &testAuditSink{}
+			encFs.WithAuditSink(auditSink)
+
+			test.use(t, encFs)
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encFileMeta.KeyId != keys[test.wantKeyId].KeyId() {
+				t.Fatalf("got key id %s, want the one of key %d", encFileMeta.KeyId, test.wantKeyId)
+			}
+			events := auditSink.eventsOf("lazy-rekey")
+			if len(events) != test.wantEvents {
+				t.Fatalf("got lazy rekey events %+v", events)
+			}
+			for _, event := range events {
+				if event.Path != "/file" || event.Error != "" {
+					t.Fatalf("got lazy rekey event %+v", event)
+				}
+			}
+			// the contents are kept, the file is never re-encrypted again
+			checkTestFile(t, encFs, "/file", data)
+			if test.wantKeyId == 2 && len(auditSink.eventsOf("lazy-rekey")) != test.wantEvents {
+				t.Fatal("rekeyed a file of the current key")
+			}
+		})
+	}
+}
+
+func TestLazyRekeyFailure(t *testing.T) {
+	oldKey := NewEncryptionMasterKey(testKeyBytes(1))
+	oldFs, base := newTestEncFs(oldKey)
+	writeTestFile(t, oldFs, "/file", []byte("data"))
+	// the backend refuses the writes of the re-encryption
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(2)), afero.NewReadOnlyFs(base)).(*EncFs)
+	encFs.WithKeyring([]*EncryptionMasterKey{oldKey})
+	encFs.WithLazyRekey(true)
+	auditSink := &testAuditSink{}
+	encFs.WithAuditSink(auditSink)
+	snapshot := snapshotTestFs(t, base)
+
+	checkTestFile(t, encFs, "/file", []byte("data"))
+	events := auditSink.eventsOf("lazy-rekey")
+	if len(events) != 1 || events[0].Error == "" {
+		t.Fatalf("got lazy rekey events %+v", events)
+	}
+	// the file keeps its old key
+	if !equalTestSnapshots(snapshot, snapshotTestFs(t, base)) {
+		t.Fatal("a failed lazy rekey changed the backend")
+	}
+	checkTestFile(t, oldFs, "/file", []byte("data"))
+}
@@ -0,0 +1,214 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Permission is a set of operations allowed by RestrictedEncFs, PERM_DELETE guards removing names, renaming onto an
+// existing file removes it too, O_TRUNC and Truncate keep the name and only need PERM_WRITE like writes overwriting
+// the contents
+type Permission int
+
+const (
+	PERM_READ Permission = 1 << iota
+	PERM_WRITE
+	PERM_DELETE
+	PERM_RENAME
+
+	PERM_READ_ONLY = PERM_READ
+	PERM_NO_DELETE = PERM_READ | PERM_WRITE | PERM_RENAME
+	PERM_NO_RENAME = PERM_READ | PERM_WRITE | PERM_DELETE
+	PERM_ALL       = PERM_READ | PERM_WRITE | PERM_DELETE | PERM_RENAME
+)
+
+// RestrictedEncFs is a view of a subtree of EncFs allowing only a set of operations,
+// names are resolved inside the subtree and symlinks are never followed
+type RestrictedEncFs struct {
+	encFs *EncFs
+	root  string
+	perms Permission
+}
+
+// Restrict returns a view limited to subpath and perms, e.g. PERM_READ_ONLY for plugins
+func (encFs *EncFs) Restrict(subpath string, perms Permission) afero.Fs {
+	return &RestrictedEncFs{
+		encFs: encFs,
+		root:  filepath.Clean(subpath),
+		perms: perms,
+	}
+}
+
+func (*RestrictedEncFs) Name() string { return "RestrictedEncFs" }
+
+func (r *RestrictedEncFs) Create(name string) (afero.File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *RestrictedEncFs) Mkdir(name string, perm os.FileMode) error {
+	realName, err := r.realName("mkdir", name, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return r.encFs.Mkdir(realName, perm)
+}
+
+func (r *RestrictedEncFs) MkdirAll(name string, perm os.FileMode) error {
+	realName, err := r.realName("mkdir", name, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return r.encFs.MkdirAll(realName, perm)
+}
+
+func (r *RestrictedEncFs) Open(name string) (afero.File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (r *RestrictedEncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	required := PERM_READ
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		required |= PERM_WRITE
+	}
+	if flag&os.O_WRONLY != 0 {
+		required &^= PERM_READ
+	}
+	realName, err := r.realName("open", name, required)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.encFs.OpenFile(realName, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &RestrictedFile{File: f, name: r.viewName(name)}, nil
+}
+
+func (r *RestrictedEncFs) Remove(name string) error {
+	realName, err := r.realName("remove", name, PERM_DELETE)
+	if err != nil {
+		return err
+	}
+	if realName == r.root {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return r.encFs.Remove(realName)
+}
+
+func (r *RestrictedEncFs) RemoveAll(name string) error {
+	realName, err := r.realName("removeall", name, PERM_DELETE)
+	if err != nil {
+		return err
+	}
+	if realName == r.root {
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrPermission}
+	}
+	return r.encFs.RemoveAll(realName)
+}
+
+func (r *RestrictedEncFs) Rename(oldname, newname string) error {
+	realOldname, err := r.realName("rename", oldname, PERM_RENAME)
+	if err != nil {
+		return err
+	}
+	realNewname, err := r.realName("rename", newname, PERM_RENAME)
+	if err != nil {
+		return err
+	}
+	if realOldname == r.root || realNewname == r.root {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	if r.perms&PERM_DELETE == 0 {
+		// the existing file would be removed
+		if _, _, err := r.encFs.LstatIfPossible(realNewname); err == nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.encFs.Rename(realOldname, realNewname)
+}
+
+func (r *RestrictedEncFs) Stat(name string) (os.FileInfo, error) {
+	realName, err := r.realName("stat", name, PERM_READ)
+	if err != nil {
+		return nil, err
+	}
+	return r.encFs.Stat(realName)
+}
+
+func (r *RestrictedEncFs) Chmod(name string, mode os.FileMode) error {
+	realName, err := r.realName("chmod", name, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return r.encFs.Chmod(realName, mode)
+}
+
+func (r *RestrictedEncFs) Chown(name string, uid, gid int) error {
+	realName, err := r.realName("chown", name, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return r.encFs.Chown(realName, uid, gid)
+}
+
+func (r *RestrictedEncFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	realName, err := r.realName("chtimes", name, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return r.encFs.Chtimes(realName, atime, mtime)
+}
+
+func (r *RestrictedEncFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	realName, err := r.realName("lstat", name, PERM_READ)
+	if err != nil {
+		return nil, true, err
+	}
+	return r.encFs.LstatIfPossible(realName)
+}
+
+// realName maps name into the subtree, ".." can not leave it and paths through symlinks are refused
+func (r *RestrictedEncFs) realName(op, name string, required Permission) (string, error) {
+	if r.perms&required != required {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	cleanName := filepath.Clean(string(filepath.Separator) + name)
+	realName := filepath.Join(r.root, cleanName)
+	relName := strings.TrimPrefix(cleanName, string(filepath.Separator))
+	if relName == "" {
+		return realName, nil
+	}
+	checkName := r.root
+	for _, part := range strings.Split(relName, string(filepath.Separator)) {
+		checkName = filepath.Join(checkName, part)
+		fileInfo, _, err := r.encFs.LstatIfPossible(checkName)
+		if err != nil {
+			// not existing parts can not be symlinks
+			break
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+		}
+	}
+	return realName, nil
+}
+
+func (r *RestrictedEncFs) viewName(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
+
+// RestrictedFile hides the real path of the subtree from Name
+type RestrictedFile struct {
+	afero.File
+	name string
+}
+
+func (f *RestrictedFile) Name() string {
+	return f.name
+}
@@ -0,0 +1,71 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRestrictedEncFsPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		perms   Permission
+		call    func(r *RestrictedEncFs) error
+		wantErr bool
+	}{
+		{"rename to a new name", PERM_NO_DELETE, func(r *RestrictedEncFs) error {
+			return r.Rename("/a", "/c")
+		}, false},
+		{"rename onto an existing file without delete", PERM_NO_DELETE, func(r *RestrictedEncFs) error {
+			return r.Rename("/a", "/b")
+		}, true},
+		{"rename onto an existing file", PERM_ALL, func(r *RestrictedEncFs) error {
+			return r.Rename("/a", "/b")
+		}, false},
+		{"rename without rename", PERM_NO_RENAME, func(r *RestrictedEncFs) error {
+			return r.Rename("/a", "/c")
+		}, true},
+		{"truncate open without delete", PERM_NO_DELETE, func(r *RestrictedEncFs) error {
+			f, err := r.OpenFile("/a", os.O_WRONLY|os.O_TRUNC, 0)
+			if err == nil {
+				err = f.Close()
+			}
+			return err
+		}, false},
+		{"remove without delete", PERM_NO_DELETE, func(r *RestrictedEncFs) error {
+			return r.Remove("/a")
+		}, true},
+		{"write read only", PERM_READ_ONLY, func(r *RestrictedEncFs) error {
+			_, err := r.OpenFile("/a", os.O_RDWR, 0)
+			return err
+		}, true},
+		{"escape the root", PERM_ALL, func(r *RestrictedEncFs) error {
+			_, err := r.Stat("/../outside")
+			return err
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			if err := encFs.Mkdir("/root", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/root/a", []byte("a"))
+			writeTestFile(t, encFs, "/root/b", []byte("b"))
+			writeTestFile(t, encFs, "/outside", []byte("o"))
+			r := encFs.Restrict("/root", test.perms).(*RestrictedEncFs)
+			err := test.call(r)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr && !errors.Is(err, os.ErrPermission) && !os.IsNotExist(err) {
+				t.Fatalf("got error %v, want a permission error", err)
+			}
+			if test.wantErr {
+				// refused operations change nothing
+				checkTestFile(t, encFs, "/root/a", []byte("a"))
+				checkTestFile(t, encFs, "/root/b", []byte("b"))
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package encfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+type retryClass int
+
+const (
+	// never retried, e.g. stateful directory reads
+	retryNever retryClass = iota
+	// safe to repeat, e.g. ReadAt, Stat
+	retryIdempotent
+	// only retried when RetryPolicy.RetryWrites is set
+	retryWrite
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryWrites allows retrying mutating operations, writes with partial progress are never retried
+	RetryWrites bool
+	// IsRetryable overrides IsTransientError when present
+	IsRetryable func(err error) bool
+}
+
+func NewDefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		RetryWrites:    false,
+	}
+}
+
+// WithRetryPolicy retries transient backend errors, nil disables retrying
+func (encFs *EncFs) WithRetryPolicy(retryPolicy *RetryPolicy) {
+	encFs.retryPolicy = retryPolicy
+}
+
+// IsTransientError reports errors which may disappear when the operation is retried
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var operationTimeoutError *OperationTimeoutError
+	if errors.As(err, &operationTimeoutError) {
+		return errors.Is(operationTimeoutError.Err, context.DeadlineExceeded)
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EIO, syscall.ESTALE, syscall.EAGAIN, syscall.EINTR,
+		syscall.ETIMEDOUT, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return netError.Timeout()
+	}
+	return false
+}
+
+func (p *RetryPolicy) isRetryable(err error) bool {
+	if p.IsRetryable != nil {
+		return p.IsRetryable(err)
+	}
+	return IsTransientError(err)
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// add up to 50% jitter
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func callWithRetry[T any](encFs *EncFs, class retryClass, op, name string, fn func() (T, error), cleanup func(T)) (T, error) {
+	value, err := callWithDeadline(encFs, op, name, fn, cleanup)
+	if err == nil || encFs.retryPolicy == nil || class == retryNever {
+		return value, err
+	}
+	retryPolicy := encFs.retryPolicy
+	if class == retryWrite && !retryPolicy.RetryWrites {
+		return value, err
+	}
+	for attempt := 1; attempt < retryPolicy.MaxAttempts; attempt++ {
+		if n, ok := any(value).(int); ok && n > 0 {
+			// partial progress, retrying would repeat or skip data
+			return value, err
+		}
+		if !retryPolicy.isRetryable(err) {
+			return value, err
+		}
+		if sleepErr := encFs.sleepBeforeRetry(retryPolicy.backoff(attempt)); sleepErr != nil {
+			return value, err
+		}
+		encFs.getLogger().Debug("retrying operation", "op", op, "attempt", attempt+1, "error", err)
+		value, err = callWithDeadline(encFs, op, name, fn, cleanup)
+		if err == nil {
+			return value, nil
+		}
+	}
+	return value, err
+}
+
+func callErrWithRetry(encFs *EncFs, class retryClass, op, name string, fn func() error) error {
+	_, err := callWithRetry(encFs, class, op, name, func() (struct{}, error) {
+		return struct{}{}, fn()
+	}, nil)
+	return err
+}
+
+func (encFs *EncFs) sleepBeforeRetry(backoff time.Duration) error {
+	ctx := encFs.operationContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return sleepWithContext(ctx, backoff)
+}
+
+func sleepWithContext(ctx context.Context, backoff time.Duration) error {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func openFileRetryClass(flag int) retryClass {
+	if flag&(os.O_CREATE|os.O_TRUNC|os.O_EXCL) != 0 {
+		return retryWrite
+	}
+	return retryIdempotent
+}
+
+// positionRetryClass returns retryNever for reads, writes and seeks at the position of the handle when operations
+// have a deadline, a timed out call keeps running in background and may still move the position
+func positionRetryClass(encFs *EncFs, class retryClass) retryClass {
+	if encFs.hasOperationDeadline() {
+		return retryNever
+	}
+	return class
+}
+
+func seekRetryClass(whence int) retryClass {
+	if whence == io.SeekCurrent {
+		// relative to the position a failed attempt may have moved
+		return retryNever
+	}
+	return retryIdempotent
+}
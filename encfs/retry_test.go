@@ -0,0 +1,170 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// slowFs delays the next stalls reads and writes of its files by delay, calls counts them all, stalled is done when
+// the delayed calls returned
+type slowFs struct {
+	afero.Fs
+	mutex   sync.Mutex
+	stalls  int
+	delay   time.Duration
+	calls   int
+	stalled sync.WaitGroup
+}
+
+type slowFile struct {
+	afero.File
+	fs *slowFs
+}
+
+func (fs *slowFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{File: file, fs: fs}, nil
+}
+
+func (fs *slowFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *slowFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// stall returns the function ending the call
+func (fs *slowFs) stall() func() {
+	fs.mutex.Lock()
+	fs.calls++
+	stall := fs.stalls > 0
+	if stall {
+		fs.stalls--
+		fs.stalled.Add(1)
+	}
+	fs.mutex.Unlock()
+	if !stall {
+		return func() {}
+	}
+	time.Sleep(fs.delay)
+	return fs.stalled.Done
+}
+
+func (fs *slowFs) arm(stalls int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.stalls = stalls
+	fs.calls = 0
+}
+
+func (fs *slowFs) callCount() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.calls
+}
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	defer f.fs.stall()()
+	return f.File.Read(p)
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	defer f.fs.stall()()
+	return f.File.ReadAt(p, off)
+}
+
+func (f *slowFile) Write(p []byte) (int, error) {
+	defer f.fs.stall()()
+	return f.File.Write(p)
+}
+
+func (f *slowFile) WriteAt(p []byte, off int64) (int, error) {
+	defer f.fs.stall()()
+	return f.File.WriteAt(p, off)
+}
+
+func TestRetryAfterOperationTimeout(t *testing.T) {
+	data := testPattern(100)
+	tests := []struct {
+		name      string
+		call      func(f afero.File) error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name: "read is not retried",
+			call: func(f afero.File) error {
+				_, err := f.Read(make([]byte, 10))
+				return err
+			},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "write is not retried",
+			call: func(f afero.File) error {
+				_, err := f.Write([]byte("x"))
+				return err
+			},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "read at is retried",
+			call: func(f afero.File) error {
+				p := make([]byte, 10)
+				if _, err := f.ReadAt(p, 20); err != nil {
+					return err
+				}
+				if !bytes.Equal(p, data[20:30]) {
+					return errors.New("read at returned wrong data")
+				}
+				return nil
+			},
+			wantCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := &slowFs{Fs: afero.NewMemMapFs(), delay: 200 * time.Millisecond}
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			writeTestFile(t, encFs, "/file", data)
+			encFs.WithOperationTimeout(20 * time.Millisecond)
+			retryPolicy := NewDefaultRetryPolicy()
+			retryPolicy.InitialBackoff = time.Millisecond
+			retryPolicy.RetryWrites = true
+			encFs.WithRetryPolicy(retryPolicy)
+
+			f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				base.stalled.Wait()
+				_ = f.Close()
+			}()
+			base.arm(1)
+			err = test.call(f)
+			if gotErr := err != nil && err != io.EOF; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr && !errors.Is(err, ErrOperationTimeout) {
+				t.Fatalf("got error %v, want %v", err, ErrOperationTimeout)
+			}
+			if calls := base.callCount(); calls != test.wantCalls {
+				t.Fatalf("backend called %d times, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+}
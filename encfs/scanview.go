@@ -0,0 +1,112 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ScanEncFs is a read only view of a subtree of EncFs for content indexers and antivirus scanners, reads are
+// limited to a byte rate and every open is audited with a purpose tag
+type ScanEncFs struct {
+	afero.Fs
+	encFs   *EncFs
+	root    string
+	purpose string
+	limiter *byteRateLimiter
+}
+
+// ScanView returns a read only view of subpath, opens are audited as "scan-open" with purpose, bytesPerSecond
+// limits reads of all files of the view, 0 is unlimited
+func (encFs *EncFs) ScanView(subpath string, purpose string, bytesPerSecond int64) *ScanEncFs {
+	return &ScanEncFs{
+		Fs:      encFs.Restrict(subpath, PERM_READ_ONLY),
+		encFs:   encFs,
+		root:    filepath.Clean(subpath),
+		purpose: purpose,
+		limiter: newByteRateLimiter(bytesPerSecond),
+	}
+}
+
+func (*ScanEncFs) Name() string { return "ScanEncFs" }
+
+func (v *ScanEncFs) Create(name string) (afero.File, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (v *ScanEncFs) Open(name string) (afero.File, error) {
+	return v.OpenWithPurpose(name, v.purpose)
+}
+
+func (v *ScanEncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		err := error(&os.PathError{Op: "open", Path: name, Err: os.ErrPermission})
+		v.encFs.auditWithPurpose("scan-open", v.auditName(name), "", flag, v.purpose, &err)
+		return nil, err
+	}
+	return v.OpenWithPurpose(name, v.purpose)
+}
+
+// OpenWithPurpose opens name for reading and records purpose in the audit log instead of the purpose of the view
+func (v *ScanEncFs) OpenWithPurpose(name string, purpose string) (_ afero.File, err error) {
+	defer v.encFs.auditWithPurpose("scan-open", v.auditName(name), "", os.O_RDONLY, purpose, &err)
+	f, err := v.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &scanFile{File: f, limiter: v.limiter}, nil
+}
+
+func (v *ScanEncFs) auditName(name string) string {
+	return filepath.Join(v.root, filepath.Clean(string(filepath.Separator)+name))
+}
+
+// scanFile throttles reads, writes are refused by the read only view
+type scanFile struct {
+	afero.File
+	limiter *byteRateLimiter
+}
+
+func (f *scanFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.limiter.wait(n)
+	return n, err
+}
+
+func (f *scanFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.limiter.wait(n)
+	return n, err
+}
+
+// byteRateLimiter delays callers so on average no more than bytesPerSecond pass, shared by all files of a view
+type byteRateLimiter struct {
+	mutex          *sync.Mutex
+	bytesPerSecond int64
+	next           time.Time
+}
+
+func newByteRateLimiter(bytesPerSecond int64) *byteRateLimiter {
+	return &byteRateLimiter{
+		mutex:          &sync.Mutex{},
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+func (l *byteRateLimiter) wait(n int) {
+	if l.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
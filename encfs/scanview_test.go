@@ -0,0 +1,109 @@
+package encfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestScanView(t *testing.T) {
+	tests := []struct {
+		name        string
+		open        func(scanFs *ScanEncFs) (afero.File, error)
+		wantPath    string
+		wantPurpose string
+		wantErr     error
+	}{
+		{"open", func(scanFs *ScanEncFs) (afero.File, error) { return scanFs.Open("/file") }, "/dir/file", "index",
+			nil},
+		{"open with purpose", func(scanFs *ScanEncFs) (afero.File, error) {
+			return scanFs.OpenWithPurpose("file", "antivirus")
+		}, "/dir/file", "antivirus", nil},
+		{"read only flag", func(scanFs *ScanEncFs) (afero.File, error) {
+			return scanFs.OpenFile("/file", os.O_RDONLY, 0)
+		}, "/dir/file", "index", nil},
+		{"write", func(scanFs *ScanEncFs) (afero.File, error) {
+			return scanFs.OpenFile("/file", os.O_RDWR, 0)
+		}, "/dir/file", "index", os.ErrPermission},
+		{"create", func(scanFs *ScanEncFs) (afero.File, error) { return scanFs.Create("/new") }, "/dir/new", "index",
+			os.ErrPermission},
+		{"outside", func(scanFs *ScanEncFs) (afero.File, error) { return scanFs.Open("/../other") }, "/dir/other",
+			"index", os.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			auditSink := &testAuditSink{}
+			encFs.WithAuditSink(auditSink)
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/file", []byte("data"))
+			writeTestFile(t, encFs, "/other", []byte("other"))
+			scanFs := encFs.ScanView("/dir", "index", 0)
+
+			f, err := test.open(scanFs)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil {
+				data, err := io.ReadAll(f)
+				if err != nil || string(data) != "data" {
+					t.Fatalf("read %q: %v", data, err)
+				}
+				if _, err := f.Write([]byte("x")); err == nil {
+					t.Fatal("wrote to a scanned file")
+				}
+				_ = f.Close()
+			}
+			events := auditSink.eventsOf("scan-open")
+			if len(events) != 1 {
+				t.Fatalf("got %d scan-open events, want 1", len(events))
+			}
+			if events[0].Path != test.wantPath || events[0].Purpose != test.wantPurpose {
+				t.Fatalf("audited %s with purpose %q", events[0].Path, events[0].Purpose)
+			}
+			if (events[0].Error != "") != (test.wantErr != nil) {
+				t.Fatalf("audited error %q", events[0].Error)
+			}
+			checkTestFile(t, encFs, "/dir/file", []byte("data"))
+		})
+	}
+}
+
+func TestScanViewRateLimit(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	data := testPattern(3000)
+	writeTestFile(t, encFs, "/file", data)
+	tests := []struct {
+		bytesPerSecond int64
+		minDuration    time.Duration
+	}{
+		{0, 0},
+		// the first read passes at once, the following ones wait for the bytes before them
+		{10000, 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		scanFs := encFs.ScanView("/", "index", test.bytesPerSecond)
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			f, err := scanFs.Open("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(data))
+			if _, err := f.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+		}
+		if elapsed := time.Since(start); elapsed < test.minDuration {
+			t.Fatalf("%d bytes per second: read in %v, want at least %v", test.bytesPerSecond, elapsed,
+				test.minDuration)
+		}
+	}
+}
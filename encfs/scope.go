@@ -0,0 +1,60 @@
+package encfs
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+const SCOPED_KEY_INFO_PREFIX = "encfs-afero scoped key:"
+
+// derivableNameMapper is implemented by name mappers which can be rebuilt with a derived key
+type derivableNameMapper interface {
+	withKey(key []byte) NameMapper
+}
+
+func (m *NoopNameMapper) withKey(key []byte) NameMapper {
+	return m
+}
+
+func (m *GcmNameMapper) withKey(key []byte) NameMapper {
+	return NewGcmNameMapper(key, m.fileNameIv)
+}
+
+func (m *HmacNameMapper) withKey(key []byte) NameMapper {
+	return NewHmacNameMapperWithBackend(key, m.fs)
+}
+
+func (m *RandomNonceNameMapper) withKey(key []byte) NameMapper {
+	return NewRandomNonceNameMapperWithBackend(key, m.fs)
+}
+
+// DeriveScopedKey derives an independent key with HKDF using scope as context, files
+// encrypted with the derived key cannot be decrypted with other scopes and vice versa
+func (k *EncryptionMasterKey) DeriveScopedKey(scope string) *EncryptionMasterKey {
+	derivedKey := hkdfSha256(k.key, nil, []byte(SCOPED_KEY_INFO_PREFIX+scope), len(k.key))
+	scopedKey := NewEncryptionMasterKeyWithNameMapper(derivedKey, k.nameMapper)
+	scopedKey.contentCipher = k.contentCipher
+	scopedKey.subkeys = k.subkeys
+	if derivable, ok := k.nameMapper.(derivableNameMapper); ok {
+		scopedKey.nameMapper = derivable.withKey(scopedKey.FileNameKey())
+	}
+	return scopedKey
+}
+
+// NewScopedEncFs returns a view of subtree root of the OS filesystem for principal, all paths are
+// resolved inside root and contents are encrypted with a key derived from principal and root
+func NewScopedEncFs(masterKey *EncryptionMasterKey, principal string, root string) (afero.Fs, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return NewScopedEncFsWithBackend(masterKey, afero.NewOsFs(), principal, absRoot), nil
+}
+
+// NewScopedEncFsWithBackend is NewScopedEncFs over base, root is a path of base
+func NewScopedEncFsWithBackend(masterKey *EncryptionMasterKey, base afero.Fs, principal string, root string) afero.Fs {
+	root = filepath.Clean(root)
+	scopedKey := masterKey.DeriveScopedKey(principal + "\x00" + filepath.ToSlash(root))
+	return afero.NewBasePathFs(NewEncFsWithBackend(scopedKey, base), root)
+}
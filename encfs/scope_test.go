@@ -0,0 +1,118 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestDeriveScopedKey(t *testing.T) {
+	masterKey := NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12])
+	if err := masterKey.WithContentCipher(CIPHER_AES_GCM); err != nil {
+		t.Fatal(err)
+	}
+	masterKey.WithSubkeys(true)
+	scopedKey := masterKey.DeriveScopedKey("alice")
+	tests := []struct {
+		name      string
+		otherKey  *EncryptionMasterKey
+		wantEqual bool
+	}{
+		{"same scope", masterKey.DeriveScopedKey("alice"), true},
+		{"other scope", masterKey.DeriveScopedKey("bob"), false},
+		{"unscoped", masterKey, false},
+		{"scope of scope", scopedKey.DeriveScopedKey("alice"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bytes.Equal(scopedKey.key, test.otherKey.key) != test.wantEqual ||
+				(scopedKey.KeyId() == test.otherKey.KeyId()) != test.wantEqual {
+				t.Fatalf("got key id %s and %s, want equal %v", scopedKey.KeyId(), test.otherKey.KeyId(), test.wantEqual)
+			}
+			// the name mapper is rebuilt with the derived key
+			encryptedName := scopedKey.EncryptFileName("/dir/file")
+			if (encryptedName == test.otherKey.EncryptFileName("/dir/file")) != test.wantEqual {
+				t.Fatalf("got encrypted names %s and %s, want equal %v", encryptedName,
+					test.otherKey.EncryptFileName("/dir/file"), test.wantEqual)
+			}
+		})
+	}
+	if scopedKey.contentCipher != CIPHER_AES_GCM || !scopedKey.subkeys {
+		t.Fatalf("got content cipher %q and subkeys %v", scopedKey.contentCipher, scopedKey.subkeys)
+	}
+}
+
+func TestScopedEncFs(t *testing.T) {
+	keys := []struct {
+		name string
+		key  func() *EncryptionMasterKey
+	}{
+		{"plain names", func() *EncryptionMasterKey { return NewEncryptionMasterKey(testKeyBytes(1)) }},
+		{"gcm names", func() *EncryptionMasterKey {
+			return NewEncryptionMasterKeyWithFileNameIv(testKeyBytes(1), testKeyBytes(2)[:12])
+		}},
+	}
+	readers := []struct {
+		name string
+		// fs opens name written by alice under /data in base
+		fs   func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string)
+		want bool
+	}{
+		{"same scope", func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string) {
+			return NewScopedEncFsWithBackend(masterKey, base, "alice", "/data"), "/file"
+		}, true},
+		{"same scope unclean root", func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string) {
+			return NewScopedEncFsWithBackend(masterKey, base, "alice", "/other/../data/"), "/file"
+		}, true},
+		{"other principal", func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string) {
+			return NewScopedEncFsWithBackend(masterKey, base, "bob", "/data"), "/file"
+		}, false},
+		// the root is part of the scope
+		{"parent root", func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string) {
+			return NewScopedEncFsWithBackend(masterKey, base, "alice", "/"), "/data/file"
+		}, false},
+		{"unscoped", func(masterKey *EncryptionMasterKey, base afero.Fs) (afero.Fs, string) {
+			return NewEncFsWithBackend(masterKey, base), "/data/file"
+		}, false},
+	}
+	data := []byte("scoped data")
+	for _, key := range keys {
+		for _, reader := range readers {
+			t.Run(key.name+" "+reader.name, func(t *testing.T) {
+				base := afero.NewMemMapFs()
+				writeTestFile(t, NewScopedEncFsWithBackend(key.key(), base, "alice", "/data"), "/file", data)
+				if exists, err := afero.Exists(base, "/file"); err != nil || exists {
+					t.Fatalf("got /file outside of the root: %v", err)
+				}
+				fs, name := reader.fs(key.key(), base)
+				got, err := afero.ReadFile(fs, name)
+				if reader.want {
+					if err != nil || !bytes.Equal(got, data) {
+						t.Fatalf("got %q, %v, want %q", got, err, data)
+					}
+					return
+				}
+				// files are either not found under other names or opened with the wrong key
+				if !errors.Is(err, ErrWrongKey) && !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("got %q, %v, want %v or %v", got, err, ErrWrongKey, os.ErrNotExist)
+				}
+			})
+		}
+	}
+}
+
+func TestScopedEncFsEscape(t *testing.T) {
+	base := afero.NewMemMapFs()
+	writeTestFile(t, base, "/secret", []byte("secret"))
+	fs := NewScopedEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base, "alice", "/data")
+	for _, name := range []string{"/../secret", "../secret", "/data/../../secret"} {
+		t.Run(name, func(t *testing.T) {
+			if got, err := afero.ReadFile(fs, name); err == nil {
+				t.Fatalf("read %q outside of the root", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package encfs
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrMemoryLockNotSupported = errors.New("memory lock is not supported")
+)
+
+// ScratchEncFs is an encrypted in-memory file system for temporary decrypted intermediates, the key
+// is random and only held in RAM, so contents are unreadable once the process exits or Close is called
+type ScratchEncFs struct {
+	*EncFs
+	keyBytes     []byte
+	memoryLocked bool
+	closeOnce    *sync.Once
+}
+
+// NewScratchEncFs creates an empty scratch space, lockMemory keeps the key out of swap by mlock where
+// supported, contents are stored encrypted in memory and may still be swapped
+func NewScratchEncFs(lockMemory bool) (*ScratchEncFs, error) {
+	keyBytes := make([]byte, 32)
+	memoryLocked := false
+	if lockMemory {
+		if err := lockKeyMemory(keyBytes); err != nil {
+			return nil, err
+		}
+		memoryLocked = true
+	}
+	if _, err := rand.Read(keyBytes); err != nil {
+		if memoryLocked {
+			_ = unlockKeyMemory(keyBytes)
+		}
+		return nil, err
+	}
+	return &ScratchEncFs{
+		EncFs:        newEncFs(NewEncryptionMasterKey(keyBytes), afero.NewMemMapFs()),
+		keyBytes:     keyBytes,
+		memoryLocked: memoryLocked,
+		closeOnce:    &sync.Once{},
+	}, nil
+}
+
+func (*ScratchEncFs) Name() string { return "ScratchEncFs" }
+
+// Close drops all files and wipes the key, the scratch space is empty and read only afterwards,
+// Close must not be called while other goroutines still use it
+func (scratchFs *ScratchEncFs) Close() (err error) {
+	scratchFs.closeOnce.Do(func() {
+		_ = scratchFs.EncFs.base.RemoveAll("/")
+		scratchFs.EncFs.base = afero.NewReadOnlyFs(afero.NewMemMapFs())
+		for i := range scratchFs.keyBytes {
+			scratchFs.keyBytes[i] = 0
+		}
+		if scratchFs.memoryLocked {
+			err = unlockKeyMemory(scratchFs.keyBytes)
+		}
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestScratchEncFs(t *testing.T) {
+	tests := []struct {
+		name       string
+		lockMemory bool
+	}{
+		{"unlocked", false},
+		{"locked", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scratchFs, err := NewScratchEncFs(test.lockMemory)
+			if errors.Is(err, ErrMemoryLockNotSupported) || errors.Is(err, syscall.EPERM) ||
+				errors.Is(err, syscall.ENOMEM) {
+				t.Skipf("memory lock: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(5000)
+			if err := scratchFs.MkdirAll("/dir", 0700); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, scratchFs, "/dir/file", data)
+			checkTestFile(t, scratchFs, "/dir/file", data)
+			// the memory backend only holds ciphertext
+			for name, contents := range snapshotTestFs(t, scratchFs.EncFs.base) {
+				if bytes.Contains([]byte(contents), data[:64]) {
+					t.Fatalf("%s holds plaintext", name)
+				}
+			}
+
+			if err := scratchFs.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(scratchFs.keyBytes, make([]byte, 32)) {
+				t.Fatal("key not wiped")
+			}
+			if exists, _ := afero.Exists(scratchFs, "/dir/file"); exists {
+				t.Fatal("file kept after close")
+			}
+			if err := afero.WriteFile(scratchFs, "/file", data, 0600); err == nil {
+				t.Fatal("wrote after close")
+			}
+			if err := scratchFs.Close(); err != nil {
+				t.Fatalf("second close: %v", err)
+			}
+		})
+	}
+}
+
+func TestScratchEncFsKeysDiffer(t *testing.T) {
+	first, err := NewScratchEncFs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewScratchEncFs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.keyBytes, second.keyBytes) {
+		t.Fatal("scratch spaces share a key")
+	}
+}
@@ -0,0 +1,237 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrSelfTestFailed = errors.New("crypto self test failed")
+)
+
+// known answers of chunked ciphers in hex, AES/GCM from the GCM spec test case 14, ChaCha20-Poly1305 and
+// XChaCha20-Poly1305 from the golang.org/x/crypto test vectors
+var chunkedCipherKnownAnswersHex = map[string]struct {
+	key, nonce, additionalData, plaintext, ciphertext string
+}{
+	CIPHER_AES_GCM: {
+		key:        "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce:      "000000000000000000000000",
+		plaintext:  "00000000000000000000000000000000",
+		ciphertext: "cea7403d4d606b6e074ec5d3baf39d18d0d1c8a799996bf0265b98b5d48ab919",
+	},
+	CIPHER_CHACHA20_POLY1305: {
+		key:            "a5117e70953568bf750862df9e6f92af81677c3a188e847917a4a915bda7792e",
+		nonce:          "129039b5572e8a7a8131f76a",
+		additionalData: "00000000000000001603030010",
+		plaintext:      "1400000cebccee3bf561b292340fec60",
+		ciphertext:     "2b487a2941bc07f3cc76d1a531662588ee7c2598e59778c24d5b27559a80d163",
+	},
+	CIPHER_XCHACHA20_POLY1305: {
+		key:        "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce:      "000000000000000000000000000000000000000000000000",
+		plaintext:  "000000000000000000000000000000",
+		ciphertext: "789e9689e5208d7fd9e1f3c5b5341fb2f7033812ac9ebd3745e2c99c7bbfeb",
+	},
+}
+
+type knownAnswer struct {
+	key, nonce, additionalData, plaintext, ciphertext []byte
+}
+
+// known answers decoded once by init, the self test itself never decodes
+var (
+	chunkedCipherKnownAnswers = make(map[string]*knownAnswer)
+	// ctrKnownAnswer is NIST SP 800-38A F.5.1, the nonce is the IV
+	ctrKnownAnswer *knownAnswer
+	// hkdfKnownAnswer is RFC 5869 test case 1, the nonce is the salt and the additional data the info
+	hkdfKnownAnswer *knownAnswer
+)
+
+func init() {
+	for contentCipher, answer := range chunkedCipherKnownAnswersHex {
+		chunkedCipherKnownAnswers[contentCipher] = &knownAnswer{
+			key:            mustDecodeHex(answer.key),
+			nonce:          mustDecodeHex(answer.nonce),
+			additionalData: mustDecodeHex(answer.additionalData),
+			plaintext:      mustDecodeHex(answer.plaintext),
+			ciphertext:     mustDecodeHex(answer.ciphertext),
+		}
+	}
+	ctrKnownAnswer = &knownAnswer{
+		key:        mustDecodeHex("2b7e151628aed2a6abf7158809cf4f3c"),
+		nonce:      mustDecodeHex("f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"),
+		plaintext:  mustDecodeHex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51"),
+		ciphertext: mustDecodeHex("874d6191b620e3261bef6864990db6ce9806f66b7970fdff8617187bb9fffdff"),
+	}
+	hkdfKnownAnswer = &knownAnswer{
+		key:            bytes.Repeat([]byte{0x0b}, 22),
+		nonce:          mustDecodeHex("000102030405060708090a0b0c"),
+		additionalData: mustDecodeHex("f0f1f2f3f4f5f6f7f8f9"),
+		ciphertext: mustDecodeHex("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf" +
+			"34007208d5b887185865"),
+	}
+}
+
+// mustDecodeHex decodes the known answers in init only, they are constants so a panic is a bug of this file
+func mustDecodeHex(s string) []byte {
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
+
+// WithSelfTest runs SelfTest and refuses all I/O of encFs when it fails, some certification regimes require
+// it before serving files
+func (encFs *EncFs) WithSelfTest(keyCheckValue string) error {
+	err := encFs.SelfTest(keyCheckValue)
+	encFs.selfTestErr = err
+	return err
+}
+
+// SelfTest runs known answer tests of AES/CTR, HKDF, the content cipher of new files and the name mapper,
+// a non empty keyCheckValue must equal the KeyId of the key
+func (encFs *EncFs) SelfTest(keyCheckValue string) error {
+	if err := selfTestCtr(); err != nil {
+		return err
+	}
+	if err := selfTestHkdf(); err != nil {
+		return err
+	}
+	if err := selfTestContentCipher(encFs.newFileCipher(), encFs.key.key); err != nil {
+		return err
+	}
+	if err := selfTestNameMapper(encFs.key); err != nil {
+		return err
+	}
+	if NewEncryptionMasterKey(make([]byte, 32)).KeyId() != "a3c41f154be89354" {
+		return fmt.Errorf("%w: key id", ErrSelfTestFailed)
+	}
+	if keyCheckValue != "" && keyCheckValue != encFs.key.KeyId() {
+		return fmt.Errorf("%w: key check value", ErrSelfTestFailed)
+	}
+	return nil
+}
+
+// selfTestCtr checks the keystream against NIST SP 800-38A F.5.1 and at an unaligned offset
+func selfTestCtr() error {
+	key, iv, plaintext := ctrKnownAnswer.key, ctrKnownAnswer.nonce, ctrKnownAnswer.plaintext
+	keystream, err := generateCtrEncryptBytes(key, iv, 0, int64(len(plaintext)))
+	if err != nil {
+		return err
+	}
+	encrypted := make([]byte, len(plaintext))
+	subtle.XORBytes(encrypted, plaintext, keystream)
+	if !bytes.Equal(encrypted, ctrKnownAnswer.ciphertext) {
+		return fmt.Errorf("%w: %s", ErrSelfTestFailed, CIPHER_AES_CTR)
+	}
+	unalignedKeystream, err := generateCtrEncryptBytes(key, iv, 5, 20)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(unalignedKeystream, keystream[5:25]) {
+		return fmt.Errorf("%w: %s", ErrSelfTestFailed, CIPHER_AES_CTR)
+	}
+	return nil
+}
+
+// selfTestHkdf checks RFC 5869 test case 1
+func selfTestHkdf() error {
+	okm := hkdfSha256(hkdfKnownAnswer.key, hkdfKnownAnswer.nonce, hkdfKnownAnswer.additionalData,
+		len(hkdfKnownAnswer.ciphertext))
+	if !bytes.Equal(okm, hkdfKnownAnswer.ciphertext) {
+		return fmt.Errorf("%w: hkdf", ErrSelfTestFailed)
+	}
+	return nil
+}
+
+// selfTestContentCipher checks the known answer of a chunked cipher, then seals and opens with the key,
+// registered ciphers without known answer are only checked by the round trip
+func selfTestContentCipher(contentCipher string, key []byte) error {
+	if contentCipher == "" {
+		return nil
+	}
+	suite := getChunkedCipherSuite(contentCipher)
+	if suite == nil {
+		return ErrUnsupportedCipher
+	}
+	failed := fmt.Errorf("%w: %s", ErrSelfTestFailed, contentCipher)
+	if knownAnswer, found := chunkedCipherKnownAnswers[contentCipher]; found {
+		aead, err := suite.newAead(knownAnswer.key)
+		if err != nil {
+			return err
+		}
+		sealed := aead.Seal(nil, knownAnswer.nonce, knownAnswer.plaintext, knownAnswer.additionalData)
+		if !bytes.Equal(sealed, knownAnswer.ciphertext) {
+			return failed
+		}
+	}
+	aead, err := suite.newAead(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, suite.nonceSize)
+	plaintext := []byte("encfs-afero self test")
+	sealed := aead.Seal(nil, nonce, plaintext, nonce)
+	if opened, err := aead.Open(nil, nonce, sealed, nonce); err != nil || !bytes.Equal(opened, plaintext) {
+		return failed
+	}
+	sealed[0] ^= 1
+	if _, err := aead.Open(nil, nonce, sealed, nonce); err == nil {
+		return failed
+	}
+	return nil
+}
+
+// selfTestNameMapper checks the known answers of GCM and SIV names and a round trip with the name mapper of the key,
+// HMAC and random nonce names are tested on a memory backend since they keep state per directory
+func selfTestNameMapper(key *EncryptionMasterKey) error {
+	failed := fmt.Errorf("%w: name encryption", ErrSelfTestFailed)
+	gcmNameMapper := NewGcmNameMapper(make([]byte, 32), make([]byte, 12))
+	if gcmNameMapper.EncryptFileNamePart("", "selftest") != ENCRYPTED_FILE_NAME_PREFIX+"vcIsWzkFGBqz6S3wBdUWCKo1yUGXxAM-" {
+		return failed
+	}
+	if NewSivNameMapper(make([]byte, 32)).EncryptFileNamePart("", "selftest") != SIV_FILE_NAME_PREFIX+"AYb8SsJUd44sTUmqfKp3P1V8Jo-N3y84EA" {
+		return failed
+	}
+	nameMapper := selfTestNameMapperOf(key)
+	if nameMapper == nil || nameMapper.Mode() == NAME_MODE_NOOP {
+		return nil
+	}
+	name := "encfs-afero-self-test"
+	encryptedName := nameMapper.EncryptFileNamePart("/", name)
+	if recorder, ok := nameMapper.(nameRecorder); ok {
+		if err := recorder.recordFileNamePart("/", name); err != nil {
+			return failed
+		}
+	}
+	if encryptedName == name || nameMapper.DecryptFileNamePart("/", encryptedName) != name {
+		return failed
+	}
+	return nil
+}
+
+// selfTestNameMapperOf returns the name mapper of key for the round trip, mappers with state are rebuilt from
+// FileNameKey like NewEncFs builds them, so the master key is not used for names after WithSubkeys
+func selfTestNameMapperOf(key *EncryptionMasterKey) NameMapper {
+	nameMapper := key.nameMapper
+	if nameMapper == nil {
+		return nil
+	}
+	switch nameMapper.Mode() {
+	case NAME_MODE_HMAC:
+		return NewHmacNameMapperWithBackend(key.FileNameKey(), afero.NewMemMapFs())
+	case NAME_MODE_RANDOM_NONCE:
+		return NewRandomNonceNameMapperWithBackend(key.FileNameKey(), afero.NewMemMapFs())
+	case NAME_MODE_SIV:
+		// legacy GCM names are looked up in the backend
+		return NewSivNameMapper(key.FileNameKey())
+	}
+	return nameMapper
+}
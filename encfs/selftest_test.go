@@ -0,0 +1,173 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSelfTest(t *testing.T) {
+	keyId := NewEncryptionMasterKey(testKeyBytes(1)).KeyId()
+	tests := []struct {
+		name          string
+		nameMapper    func(base afero.Fs) NameMapper
+		contentCipher string
+		keyCheckValue string
+		wantErr       error
+	}{
+		{"ctr", nil, CIPHER_AES_CTR, "", nil},
+		{"gcm", nil, CIPHER_AES_GCM, "", nil},
+		{"chacha20-poly1305", nil, CIPHER_CHACHA20_POLY1305, "", nil},
+		{"xchacha20-poly1305", nil, CIPHER_XCHACHA20_POLY1305, "", nil},
+		{"noop names", func(base afero.Fs) NameMapper { return NewNoopNameMapper() }, CIPHER_AES_CTR, "", nil},
+		{"hmac names", func(base afero.Fs) NameMapper {
+			return NewHmacNameMapperWithBackend(testKeyBytes(2), base)
+		}, CIPHER_AES_CTR, "", nil},
+		{"siv names", func(base afero.Fs) NameMapper { return NewSivNameMapper(testKeyBytes(2)) }, CIPHER_AES_CTR,
+			"", nil},
+		{"random nonce names", func(base afero.Fs) NameMapper {
+			return NewRandomNonceNameMapperWithBackend(testKeyBytes(2), base)
+		}, CIPHER_AES_CTR, "", nil},
+		{"key check value", nil, CIPHER_AES_CTR, keyId, nil},
+		{"wrong key check value", nil, CIPHER_AES_CTR, NewEncryptionMasterKey(testKeyBytes(2)).KeyId(),
+			ErrSelfTestFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			key := NewEncryptionMasterKey(testKeyBytes(1))
+			if test.nameMapper != nil {
+				key = NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), test.nameMapper(base))
+			}
+			encFs := NewEncFsWithBackend(key, base).(*EncFs)
+			if err := encFs.WithContentCipher(test.contentCipher); err != nil {
+				t.Fatal(err)
+			}
+			err := encFs.WithSelfTest(test.keyCheckValue)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			// the self test leaves no files behind, a failed one refuses all I/O
+			if snapshot := snapshotTestFs(t, base); len(snapshot) != 0 {
+				t.Fatalf("self test wrote %d files", len(snapshot))
+			}
+			writeErr := afero.WriteFile(encFs, "/file", []byte("data"), 0644)
+			if !errors.Is(writeErr, test.wantErr) {
+				t.Fatalf("write: got %v, want %v", writeErr, test.wantErr)
+			}
+			var pathError *os.PathError
+			if writeErr != nil && !errors.As(writeErr, &pathError) {
+				t.Fatalf("write error %v has no path", writeErr)
+			}
+			if _, err := encFs.Stat("/"); !errors.Is(err, test.wantErr) {
+				t.Fatalf("stat: got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelfTestContentCipher(t *testing.T) {
+	tests := []struct {
+		contentCipher string
+		wantErr       error
+	}{
+		{"", nil},
+		{CIPHER_AES_GCM, nil},
+		{CIPHER_CHACHA20_POLY1305, nil},
+		{CIPHER_XCHACHA20_POLY1305, nil},
+		{"unknown", ErrUnsupportedCipher},
+	}
+	for _, test := range tests {
+		if err := selfTestContentCipher(test.contentCipher, testKeyBytes(1)); !errors.Is(err, test.wantErr) {
+			t.Fatalf("%q: got %v, want %v", test.contentCipher, err, test.wantErr)
+		}
+	}
+}
+
+func TestSelfTestNameMapperKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		newMapper func(key []byte) NameMapper
+		// usesKey reports whether the round trip mapper of the self test is built from key
+		usesKey func(nameMapper NameMapper, key []byte) bool
+	}{
+		{"hmac", func(key []byte) NameMapper { return NewHmacNameMapperWithBackend(key, afero.NewMemMapFs()) },
+			func(nameMapper NameMapper, key []byte) bool {
+				return bytes.Equal(nameMapper.(*HmacNameMapper).key, key)
+			}},
+		{"random nonce", func(key []byte) NameMapper {
+			return NewRandomNonceNameMapperWithBackend(key, afero.NewMemMapFs())
+		}, func(nameMapper NameMapper, key []byte) bool {
+			return bytes.Equal(nameMapper.(*RandomNonceNameMapper).key, key)
+		}},
+		// SIV names are deterministic
+		{"siv", NewSivNameMapper, func(nameMapper NameMapper, key []byte) bool {
+			return nameMapper.EncryptFileNamePart("/", "name") == NewSivNameMapper(key).EncryptFileNamePart("/", "name")
+		}},
+	}
+	for _, test := range tests {
+		for _, subkeys := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s subkeys %v", test.name, subkeys), func(t *testing.T) {
+				key := NewEncryptionMasterKey(testKeyBytes(1))
+				key.WithSubkeys(subkeys)
+				key.WithNameMapper(test.newMapper(key.FileNameKey()))
+				nameMapper := selfTestNameMapperOf(key)
+				if nameMapper == key.nameMapper || !test.usesKey(nameMapper, key.FileNameKey()) {
+					t.Fatal("the self test does not use the file name key")
+				}
+				// the master key is not used for names after WithSubkeys
+				if subkeys && test.usesKey(nameMapper, testKeyBytes(1)) {
+					t.Fatal("the self test uses the master key")
+				}
+				encFs := NewEncFsWithBackend(key, afero.NewMemMapFs()).(*EncFs)
+				if err := encFs.SelfTest(""); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestSelfTestKnownAnswers(t *testing.T) {
+	tests := []struct {
+		name string
+		// answer is corrupted before run
+		answer *knownAnswer
+		run    func() error
+	}{
+		{"ctr", ctrKnownAnswer, selfTestCtr},
+		{"hkdf", hkdfKnownAnswer, selfTestHkdf},
+		{CIPHER_AES_GCM, chunkedCipherKnownAnswers[CIPHER_AES_GCM], func() error {
+			return selfTestContentCipher(CIPHER_AES_GCM, testKeyBytes(1))
+		}},
+		{CIPHER_CHACHA20_POLY1305, chunkedCipherKnownAnswers[CIPHER_CHACHA20_POLY1305], func() error {
+			return selfTestContentCipher(CIPHER_CHACHA20_POLY1305, testKeyBytes(1))
+		}},
+		{CIPHER_XCHACHA20_POLY1305, chunkedCipherKnownAnswers[CIPHER_XCHACHA20_POLY1305], func() error {
+			return selfTestContentCipher(CIPHER_XCHACHA20_POLY1305, testKeyBytes(1))
+		}},
+	}
+	if len(chunkedCipherKnownAnswers) != len(chunkedCipherKnownAnswersHex) {
+		t.Fatalf("got %d known answers, want %d", len(chunkedCipherKnownAnswers), len(chunkedCipherKnownAnswersHex))
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the known answers are decoded once by init
+			if test.answer == nil || len(test.answer.key) == 0 || len(test.answer.ciphertext) == 0 {
+				t.Fatal("known answer not decoded")
+			}
+			if err := test.run(); err != nil {
+				t.Fatal(err)
+			}
+			test.answer.ciphertext[0] ^= 1
+			defer func() { test.answer.ciphertext[0] ^= 1 }()
+			if err := test.run(); !errors.Is(err, ErrSelfTestFailed) {
+				t.Fatalf("got %v, want %v", err, ErrSelfTestFailed)
+			}
+		})
+	}
+}
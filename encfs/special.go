@@ -0,0 +1,56 @@
+package encfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+type SpecialFilePolicy int
+
+const (
+	// FIFOs, sockets and devices are opened without decryption and meta file
+	SPECIAL_FILE_POLICY_PASSTHROUGH SpecialFilePolicy = iota
+	// FIFOs, sockets and devices are refused with ErrSpecialFile
+	SPECIAL_FILE_POLICY_REFUSE
+	// FIFOs, sockets and devices are not listed and look like not existing
+	SPECIAL_FILE_POLICY_HIDE
+)
+
+const specialFileModes = os.ModeNamedPipe | os.ModeSocket | os.ModeDevice | os.ModeCharDevice | os.ModeIrregular
+
+var (
+	ErrSpecialFile = errors.New("special file is refused by policy")
+)
+
+// WithSpecialFilePolicy sets how FIFOs, sockets and device nodes are handled, default is passthrough which
+// costs no stat per open, refuse keeps the decrypting path from blocking on them or corrupting data
+func (encFs *EncFs) WithSpecialFilePolicy(specialFilePolicy SpecialFilePolicy) {
+	encFs.specialFilePolicy = specialFilePolicy
+}
+
+func isSpecialFileMode(mode fs.FileMode) bool {
+	return mode&specialFileModes != 0
+}
+
+// checkSpecialFile stats encryptedName before opening, so FIFOs are never opened when refused
+func (encFs *EncFs) checkSpecialFile(op, encryptedName string) error {
+	if encFs.specialFilePolicy == SPECIAL_FILE_POLICY_PASSTHROUGH {
+		return nil
+	}
+	fileInfo, err := callWithRetry(encFs, retryIdempotent, "stat", encryptedName, func() (os.FileInfo, error) {
+		return encFs.base.Stat(encryptedName)
+	}, nil)
+	if err != nil || !isSpecialFileMode(fileInfo.Mode()) {
+		// missing files are reported by the operation itself
+		return nil
+	}
+	if encFs.specialFilePolicy == SPECIAL_FILE_POLICY_HIDE {
+		return &os.PathError{Op: op, Path: encryptedName, Err: os.ErrNotExist}
+	}
+	return &os.PathError{Op: op, Path: encryptedName, Err: ErrSpecialFile}
+}
+
+func (encFs *EncFs) isHiddenFileInfo(fileInfo os.FileInfo) bool {
+	return encFs.specialFilePolicy == SPECIAL_FILE_POLICY_HIDE && isSpecialFileMode(fileInfo.Mode())
+}
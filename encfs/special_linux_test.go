@@ -0,0 +1,74 @@
+//go:build linux
+
+package encfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSpecialFilePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SpecialFilePolicy
+		// wantOpenErr is the error of opening the FIFO, wantListed tells whether it is listed and stated
+		wantOpenErr error
+		wantListed  bool
+	}{
+		// opened read write a FIFO does not block
+		{"passthrough", SPECIAL_FILE_POLICY_PASSTHROUGH, nil, true},
+		{"refuse", SPECIAL_FILE_POLICY_REFUSE, ErrSpecialFile, true},
+		{"hide", SPECIAL_FILE_POLICY_HIDE, os.ErrNotExist, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0600); err != nil {
+				t.Skipf("no FIFOs: %v", err)
+			}
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)),
+				afero.NewBasePathFs(afero.NewOsFs(), root)).(*EncFs)
+			encFs.WithSpecialFilePolicy(test.policy)
+			writeTestFile(t, encFs, "/file", []byte("data"))
+
+			f, err := encFs.OpenFile("/fifo", os.O_RDWR, 0)
+			if err == nil {
+				_ = f.Close()
+			}
+			if !errors.Is(err, test.wantOpenErr) {
+				t.Fatalf("got %v, want %v", err, test.wantOpenErr)
+			}
+			fileInfo, err := encFs.Stat("/fifo")
+			if test.wantListed && (err != nil || fileInfo.Mode()&os.ModeNamedPipe == 0) {
+				t.Fatalf("got %v: %v, want a FIFO", fileInfo, err)
+			}
+			if !test.wantListed && !os.IsNotExist(err) {
+				t.Fatalf("got %v, want not exist", err)
+			}
+			fileInfos, err := afero.ReadDir(encFs, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fileInfo := range fileInfos {
+				names = append(names, fileInfo.Name())
+			}
+			wantNames := []string{"file"}
+			if test.wantListed {
+				wantNames = append(wantNames, "fifo")
+			}
+			sort.Strings(wantNames)
+			if !reflect.DeepEqual(names, wantNames) {
+				t.Fatalf("listed %q, want %q", names, wantNames)
+			}
+			checkTestFile(t, encFs, "/file", []byte("data"))
+		})
+	}
+}
@@ -0,0 +1,337 @@
+//go:build cgo
+
+package encfs
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/psanford/sqlite3vfs"
+	"github.com/spf13/afero"
+)
+
+// sqliteVFS serves the files of an afero.Fs to SQLite, locks only exist inside the process which is enough for one
+// connection
+type sqliteVFS struct {
+	fs        afero.Fs
+	dir       string
+	tempCount int64
+}
+
+type sqliteFile struct {
+	afero.File
+	fs            afero.Fs
+	deleteOnClose bool
+	lockMutex     sync.Mutex
+	lock          sqlite3vfs.LockType
+}
+
+var sqliteVFSCount int64
+
+// registerSqliteVFS registers a VFS of the files in dir of fs and returns its name
+func registerSqliteVFS(t *testing.T, fs afero.Fs, dir string) string {
+	t.Helper()
+	name := fmt.Sprintf("encfs%d", atomic.AddInt64(&sqliteVFSCount, 1))
+	if err := sqlite3vfs.RegisterVFS(name, &sqliteVFS{fs: fs, dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func (vfs *sqliteVFS) Open(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
+	if name == "" {
+		name = fmt.Sprintf("temp%d", atomic.AddInt64(&vfs.tempCount, 1))
+		flags |= sqlite3vfs.OpenDeleteOnClose
+	}
+	fileFlag := os.O_RDONLY
+	if flags&sqlite3vfs.OpenReadWrite != 0 {
+		fileFlag = os.O_RDWR
+	}
+	if flags&sqlite3vfs.OpenCreate != 0 {
+		fileFlag |= os.O_CREATE
+	}
+	if flags&sqlite3vfs.OpenExclusive != 0 {
+		fileFlag |= os.O_EXCL
+	}
+	fullName := vfs.FullPathname(name)
+	file, err := vfs.fs.OpenFile(fullName, fileFlag, 0600)
+	if err != nil {
+		return nil, 0, sqlite3vfs.CantOpenError
+	}
+	return &sqliteFile{File: file, fs: vfs.fs, deleteOnClose: flags&sqlite3vfs.OpenDeleteOnClose != 0}, flags, nil
+}
+
+func (vfs *sqliteVFS) Delete(name string, dirSync bool) error {
+	// SQLite deletes journals that may not exist
+	err := vfs.fs.Remove(vfs.FullPathname(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (vfs *sqliteVFS) Access(name string, flags sqlite3vfs.AccessFlag) (bool, error) {
+	_, err := vfs.fs.Stat(vfs.FullPathname(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (vfs *sqliteVFS) FullPathname(name string) string {
+	return filepath.Join(vfs.dir, filepath.Base(name))
+}
+
+func (f *sqliteFile) Close() error {
+	err := f.File.Close()
+	if f.deleteOnClose {
+		if removeErr := f.fs.Remove(f.File.Name()); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+func (f *sqliteFile) Sync(flag sqlite3vfs.SyncType) error {
+	return f.File.Sync()
+}
+
+func (f *sqliteFile) FileSize() (int64, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (f *sqliteFile) Lock(lock sqlite3vfs.LockType) error {
+	f.lockMutex.Lock()
+	defer f.lockMutex.Unlock()
+	if lock > f.lock {
+		f.lock = lock
+	}
+	return nil
+}
+
+func (f *sqliteFile) Unlock(lock sqlite3vfs.LockType) error {
+	f.lockMutex.Lock()
+	defer f.lockMutex.Unlock()
+	if lock < f.lock {
+		f.lock = lock
+	}
+	return nil
+}
+
+func (f *sqliteFile) CheckReservedLock() (bool, error) {
+	f.lockMutex.Lock()
+	defer f.lockMutex.Unlock()
+	return f.lock >= sqlite3vfs.LockReserved, nil
+}
+
+func (f *sqliteFile) SectorSize() int64 {
+	return 0
+}
+
+func (f *sqliteFile) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
+	return 0
+}
+
+func openTestSqlite(t *testing.T, vfsName string, journalMode string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:test.db?vfs=%s&_journal_mode=%s", vfsName, journalMode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the locks of sqliteVFS only serialize one connection
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+// runSqliteWorkload fills a table in transactions, updates and deletes random rows and returns the expected rows
+func runSqliteWorkload(t *testing.T, db *sql.DB) map[int]string {
+	t.Helper()
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, value TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE INDEX items_value ON items (value)`); err != nil {
+		t.Fatal(err)
+	}
+	random := rand.New(rand.NewSource(1))
+	want := make(map[int]string)
+	for batch := 0; batch < 8; batch++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 250; i++ {
+			id := batch*250 + i
+			value := fmt.Sprintf("%d-%x", id, random.Int63())
+			// values of several pages make SQLite write overflow pages and grow the file in steps
+			if id%50 == 0 {
+				value += string(testPattern(5000 + random.Intn(5000)))
+			}
+			if _, err := tx.Exec(`INSERT INTO items (id, value) VALUES (?, ?)`, id, value); err != nil {
+				t.Fatal(err)
+			}
+			want[id] = value
+		}
+		// a rolled back change must leave no trace
+		if batch%3 == 2 {
+			if _, err := tx.Exec(`DELETE FROM items`); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 250; i++ {
+				delete(want, batch*250+i)
+			}
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		id := random.Intn(2000)
+		if _, found := want[id]; !found {
+			continue
+		}
+		if i%2 == 0 {
+			if _, err := db.Exec(`DELETE FROM items WHERE id = ?`, id); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, id)
+			continue
+		}
+		value := fmt.Sprintf("updated-%d", random.Int63())
+		if _, err := db.Exec(`UPDATE items SET value = ? WHERE id = ?`, value, id); err != nil {
+			t.Fatal(err)
+		}
+		want[id] = value
+	}
+	// VACUUM rewrites the database through a temp file and truncates it
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		t.Fatal(err)
+	}
+	return want
+}
+
+func checkSqliteRows(t *testing.T, db *sql.DB, want map[int]string) {
+	t.Helper()
+	var integrity string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		t.Fatal(err)
+	}
+	if integrity != "ok" {
+		t.Fatalf("integrity check: %s", integrity)
+	}
+	rows, err := db.Query(`SELECT id, value FROM items`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	count := 0
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			t.Fatal(err)
+		}
+		if want[id] != value {
+			t.Fatalf("row %d differs", id)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(want) {
+		t.Fatalf("got %d rows, want %d", count, len(want))
+	}
+}
+
+func TestSqliteOverEncFs(t *testing.T) {
+	tests := []struct {
+		name        string
+		osBackend   bool
+		journalMode string
+		setup       func(encFs *EncFs) error
+	}{
+		{"ctr", false, "DELETE", func(encFs *EncFs) error { return nil }},
+		{"ctr os", true, "DELETE", func(encFs *EncFs) error { return nil }},
+		{"ctr truncate journal", false, "TRUNCATE", func(encFs *EncFs) error { return nil }},
+		{"ctr persist journal", false, "PERSIST", func(encFs *EncFs) error { return nil }},
+		{"gcm", false, "DELETE", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"gcm os", true, "DELETE", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"chacha20", false, "DELETE", func(encFs *EncFs) error {
+			return encFs.WithContentCipher(CIPHER_XCHACHA20_POLY1305)
+		}},
+		{"header", false, "DELETE", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"integrity tags", false, "DELETE", func(encFs *EncFs) error {
+			encFs.WithIntegrityTags(true)
+			return nil
+		}},
+		{"write buffer", false, "DELETE", func(encFs *EncFs) error {
+			encFs.WithWriteBufferSize(64 * 1024)
+			return nil
+		}},
+		{"block cache", false, "DELETE", func(encFs *EncFs) error { return encFs.WithBlockCache(4096, 64) }},
+		{"read ahead", false, "DELETE", func(encFs *EncFs) error {
+			encFs.WithReadAhead(4)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"size padding", false, "DELETE", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 16*1024)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var base afero.Fs = afero.NewMemMapFs()
+			dir := "/db"
+			if test.osBackend {
+				base = afero.NewOsFs()
+				dir = t.TempDir()
+			}
+			newEncFs := func() *EncFs {
+				encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+				if err := test.setup(encFs); err != nil {
+					t.Fatal(err)
+				}
+				return encFs
+			}
+			encFs := newEncFs()
+			if err := encFs.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			db := openTestSqlite(t, registerSqliteVFS(t, encFs, dir), test.journalMode)
+			want := runSqliteWorkload(t, db)
+			checkSqliteRows(t, db, want)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a new EncFs reads the database from the backend only
+			db = openTestSqlite(t, registerSqliteVFS(t, newEncFs(), dir), test.journalMode)
+			defer func() {
+				_ = db.Close()
+			}()
+			checkSqliteRows(t, db, want)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package encfs
+
+import (
+	"io"
+	"os"
+)
+
+// StreamingBackend is implemented by backends like object stores whose files are uploaded in sequential parts,
+// many small WriteAt calls are pathological for them, StreamingWritePartSize is the preferred size of each Write
+type StreamingBackend interface {
+	StreamingWritePartSize() int
+}
+
+// streamingWritePartSize returns the part size of a streaming backend, 0 for other backends
+func (encFs *EncFs) streamingWritePartSize() int {
+	if streamingBackend, ok := encFs.base.(StreamingBackend); ok {
+		return streamingBackend.StreamingWritePartSize()
+	}
+	return 0
+}
+
+// isStreamingOpen reports opens writing a new file from the start on a streaming backend
+func (encFs *EncFs) isStreamingOpen(flag int) bool {
+	if encFs.streamingWritePartSize() <= 0 || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return false
+	}
+	return flag&os.O_TRUNC != 0 || flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL
+}
+
+// startStreaming makes writes of a new file encrypted in parts and written with sequential Write calls only,
+// files with integrity tags are not streamed since tags are computed from the written blocks
+func (f *EncFile) startStreaming() error {
+	if f.encFileMeta == nil || f.integrityFile != nil {
+		return nil
+	}
+	size, err := f.contentSize()
+	if err != nil || size > 0 {
+		return err
+	}
+	if f.headerPending {
+		// the header is written by the first part
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	f.streaming = true
+	return nil
+}
+
+// streamWrite buffers sequential writes and writes full parts, other writes end streaming
+func (f *EncFile) streamWrite(p []byte) (int, error) {
+	if f.filePos != f.writeBufferOffset+int64(len(f.writeBuffer)) {
+		if err := f.flushWriteBuffer(false); err != nil {
+			return 0, err
+		}
+		return f.write(p)
+	}
+	f.writeBuffer = append(f.writeBuffer, p...)
+	f.filePos += int64(len(p))
+	// a part is written once data follows it, so the last chunk kept by flushStream does not shorten it
+	if len(f.writeBuffer) > f.encFs.streamingWritePartSize() {
+		if err := f.flushStream(true); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// endStreaming writes all buffered data, the handle falls back to ReadAt and WriteAt afterwards which the backend
+// may refuse
+func (f *EncFile) endStreaming() error {
+	f.streaming = false
+	err := f.flushStream(false)
+	if f.headerPending {
+		if _, seekErr := f.file.Seek(f.headerSize, io.SeekStart); seekErr != nil && err == nil {
+			err = seekErr
+		}
+	}
+	return err
+}
+
+// flushStream encrypts buffered data and appends it with one Write, with alignOnly chunked files keep the
+// tail after the last chunk boundary buffered so every chunk is written once
+func (f *EncFile) flushStream(alignOnly bool) error {
+	contentEnd := f.writeBufferOffset + int64(len(f.writeBuffer))
+	if !alignOnly {
+		// the last part of padded files ends with the padding
+		f.writeBuffer = append(f.writeBuffer, f.encFileMeta.sizePaddingTail(contentEnd)...)
+	}
+	if len(f.writeBuffer) == 0 {
+		return nil
+	}
+	flushLen := int64(len(f.writeBuffer))
+	var part []byte
+	if f.headerPending {
+		header, err := marshalEncFileHeader(f.encFileMeta)
+		if err != nil {
+			return err
+		}
+		f.encFileMeta.header = header
+		part = header
+	}
+	if f.encFileMeta.isChunked() {
+		chunkSize := f.encFileMeta.chunkSize()
+		if alignOnly {
+			flushLen = flushLen / chunkSize * chunkSize
+			if flushLen == int64(len(f.writeBuffer)) && f.encFileMeta.hasFlag(META_FLAG_FINAL_CHUNK) {
+				// the last chunk is kept until it is known to be final
+				flushLen -= chunkSize
+			}
+			if flushLen == 0 {
+				return nil
+			}
+		}
+		for chunkOffset := int64(0); chunkOffset < flushLen; chunkOffset += chunkSize {
+			chunkEnd := chunkOffset + chunkSize
+			if chunkEnd > flushLen {
+				chunkEnd = flushLen
+			}
+			final := !alignOnly && chunkEnd == flushLen
+			encryptedChunk, err := f.sealChunk((f.writeBufferOffset+chunkOffset)/chunkSize,
+				f.writeBuffer[chunkOffset:chunkEnd], final)
+			if err != nil {
+				return err
+			}
+			part = append(part, encryptedChunk...)
+		}
+	} else {
+		partLen := len(part)
+		part = append(part, f.writeBuffer[:flushLen]...)
+		if err := f.xorCtrKeyStream(f.writeBufferOffset, part[partLen:], part[partLen:], true); err != nil {
+			return err
+		}
+	}
+	_, err := callWithRetry(f.encFs, retryWrite, "write", f.file.Name(), func() (int, error) {
+		return f.file.Write(part)
+	}, nil)
+	f.invalidateBlockCache(f.writeBufferOffset, flushLen)
+	if err != nil {
+		// like a failed write, buffered data is dropped
+		f.filePos = f.writeBufferOffset
+		f.writeBuffer = f.writeBuffer[:0]
+		return err
+	}
+	f.headerPending = false
+	f.writeBuffer = append(f.writeBuffer[:0], f.writeBuffer[flushLen:]...)
+	f.writeBufferOffset += flushLen
+	if f.writeBufferOffset > contentEnd {
+		f.writeBufferOffset = contentEnd
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+var errTestNotStreamed = errors.New("write at an offset of a streaming backend")
+
+// testStreamingFs is a StreamingBackend over a memory backend, it records the sizes of the writes of each file
+// and refuses WriteAt like an object store upload
+type testStreamingFs struct {
+	afero.Fs
+	partSize int
+	mutex    *sync.Mutex
+	writes   map[string][]int
+}
+
+func newTestStreamingFs(partSize int) *testStreamingFs {
+	return &testStreamingFs{
+		Fs:       afero.NewMemMapFs(),
+		partSize: partSize,
+		mutex:    &sync.Mutex{},
+		writes:   make(map[string][]int),
+	}
+}
+
+func (fs *testStreamingFs) StreamingWritePartSize() int { return fs.partSize }
+
+func (fs *testStreamingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &testStreamingFile{File: f, fs: fs}, nil
+}
+
+func (fs *testStreamingFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+type testStreamingFile struct {
+	afero.File
+	fs *testStreamingFs
+}
+
+func (f *testStreamingFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	f.fs.writes[f.Name()] = append(f.fs.writes[f.Name()], len(p))
+	f.fs.mutex.Unlock()
+	return f.File.Write(p)
+}
+
+func (f *testStreamingFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errTestNotStreamed
+}
+
+func TestStreamingWrites(t *testing.T) {
+	const partSize = 3 * CONTENT_CHUNK_SIZE
+	formats := []struct {
+		name  string
+		setup func(encFs *EncFs) error
+	}{
+		{"ctr", func(encFs *EncFs) error { return nil }},
+		{"gcm", func(encFs *EncFs) error { return encFs.WithContentCipher(CIPHER_AES_GCM) }},
+		{"ctr header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return nil
+		}},
+		{"gcm header", func(encFs *EncFs) error {
+			encFs.WithFileFormat(FILE_FORMAT_HEADER)
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}},
+		{"gcm padding", func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}},
+	}
+	sizes := []int{0, 100, partSize, 3*partSize + 17}
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			base := newTestStreamingFs(partSize)
+			encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+			if err := format.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range sizes {
+				data := testPattern(size)
+				// small writes are coalesced to parts
+				f, err := encFs.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for offset := 0; offset < size; offset += 1000 {
+					end := offset + 1000
+					if end > size {
+						end = size
+					}
+					if _, err := f.Write(data[offset:end]); err != nil {
+						t.Fatalf("%d bytes: %v", size, err)
+					}
+				}
+				if err := f.Close(); err != nil {
+					t.Fatalf("%d bytes: %v", size, err)
+				}
+				checkTestFile(t, encFs, "/file", data)
+
+				writes := base.writes["/file"]
+				for i, written := range writes {
+					if i < len(writes)-1 && written < partSize {
+						t.Fatalf("%d bytes: wrote parts of %v bytes", size, writes)
+					}
+				}
+				delete(base.writes, "/file")
+			}
+		})
+	}
+}
+
+func TestStreamingEndsOnSeek(t *testing.T) {
+	base := newTestStreamingFs(CONTENT_CHUNK_SIZE)
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), base).(*EncFs)
+	f, err := encFs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(testPattern(100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(10, 0); err != nil {
+		t.Fatal(err)
+	}
+	// buffered data is written before the handle falls back to writes at its position
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := testPattern(100)
+	want[10] = 'x'
+	checkTestFile(t, encFs, "/file", want)
+}
@@ -0,0 +1,39 @@
+package encfs
+
+const (
+	CONTENT_KEY_INFO   = "encfs-content"
+	FILE_NAME_KEY_INFO = "encfs-file-name"
+
+	// files encrypted with the content subkey were version 3 before META_FLAG_SUBKEYS, header format files still are
+	ENC_FILE_META_VERSION_SUBKEYS = 3
+)
+
+// WithSubkeys separates the keys of contents and file names, new files are encrypted with a content subkey derived
+// by HKDF and existing files keep the master key, name mappers of new volumes should be created with FileNameKey
+func (k *EncryptionMasterKey) WithSubkeys(subkeys bool) {
+	k.subkeys = subkeys
+}
+
+// FileNameKey returns the key for name mappers, a subkey derived by HKDF after WithSubkeys, the master key otherwise
+func (k *EncryptionMasterKey) FileNameKey() []byte {
+	if !k.subkeys {
+		return k.key
+	}
+	return hkdfSha256(k.key, nil, []byte(FILE_NAME_KEY_INFO), len(k.key))
+}
+
+func (k *EncryptionMasterKey) contentSubkey() []byte {
+	return hkdfSha256(k.key, nil, []byte(CONTENT_KEY_INFO), len(k.key))
+}
+
+// applySubkeys records the content subkey in the meta of a new file when the key of encFs uses subkeys
+func (encFs *EncFs) applySubkeys(encFileMeta *EncFileMeta) {
+	if encFs == nil || encFs.key == nil || !encFs.key.subkeys {
+		return
+	}
+	encFileMeta.setFlag(META_FLAG_SUBKEYS)
+}
+
+func (encFileMeta *EncFileMeta) usesSubkeys() bool {
+	return encFileMeta.hasFlag(META_FLAG_SUBKEYS) || encFileMeta.Version == ENC_FILE_META_VERSION_SUBKEYS
+}
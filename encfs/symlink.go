@@ -0,0 +1,194 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type SymlinkPolicy int
+
+const (
+	// symlinks are followed wherever they point to
+	SYMLINK_POLICY_FOLLOW SymlinkPolicy = iota
+	// paths through symlinks are refused
+	SYMLINK_POLICY_REFUSE
+	// symlinks are only followed when the target stays inside the volume root
+	SYMLINK_POLICY_CONTAIN
+)
+
+// SYMLINK_MAX_FOLLOWS bounds the symlinks resolved for one name, loops fail with ELOOP
+const SYMLINK_MAX_FOLLOWS = 255
+
+var (
+	ErrSymlinkRefused = errors.New("symlink is refused by policy")
+)
+
+// WithVolumeRoot sets the on-disk root directory of the volume
+func (encFs *EncFs) WithVolumeRoot(volumeRoot string) error {
+	absVolumeRoot, err := encFs.absBackendName(volumeRoot)
+	if err != nil {
+		return err
+	}
+	encFs.volumeRoot = absVolumeRoot
+	return nil
+}
+
+// WithSymlinkPolicy sets how symlinks inside the volume are handled, SYMLINK_POLICY_CONTAIN
+// requires WithVolumeRoot, without a volume root SYMLINK_POLICY_REFUSE only checks the last part
+func (encFs *EncFs) WithSymlinkPolicy(symlinkPolicy SymlinkPolicy) {
+	encFs.symlinkPolicy = symlinkPolicy
+}
+
+// checkSymlinkPolicy checks encryptedName before an operation, followLast is false for
+// operations acting on the link itself like Remove, Rename and Lstat
+func (encFs *EncFs) checkSymlinkPolicy(op, encryptedName string, followLast bool) error {
+	switch encFs.symlinkPolicy {
+	case SYMLINK_POLICY_REFUSE:
+		return encFs.checkNoSymlink(op, encryptedName, followLast)
+	case SYMLINK_POLICY_CONTAIN:
+		return encFs.checkSymlinkContained(op, encryptedName, followLast)
+	default:
+		return nil
+	}
+}
+
+func (encFs *EncFs) checkNoSymlink(op, encryptedName string, followLast bool) error {
+	absName, err := encFs.absBackendName(encryptedName)
+	if err != nil {
+		return err
+	}
+	checkNames := make([]string, 0)
+	if encFs.volumeRoot != "" && isSubPath(encFs.volumeRoot, absName) {
+		relName, err := filepath.Rel(encFs.volumeRoot, absName)
+		if err != nil {
+			return err
+		}
+		checkName := encFs.volumeRoot
+		for _, part := range strings.Split(relName, string(filepath.Separator)) {
+			if part == "." {
+				continue
+			}
+			checkName = filepath.Join(checkName, part)
+			checkNames = append(checkNames, checkName)
+		}
+	} else {
+		checkNames = append(checkNames, absName)
+	}
+	if !followLast && len(checkNames) > 0 {
+		checkNames = checkNames[:len(checkNames)-1]
+	}
+	for _, checkName := range checkNames {
+		fileInfo, _, err := encFs.lstat(checkName)
+		if err != nil {
+			// not existing parts can not be symlinks
+			return nil
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return &os.PathError{Op: op, Path: encryptedName, Err: ErrSymlinkRefused}
+		}
+	}
+	return nil
+}
+
+func (encFs *EncFs) checkSymlinkContained(op, encryptedName string, followLast bool) error {
+	if encFs.volumeRoot == "" {
+		return &os.PathError{Op: op, Path: encryptedName, Err: ErrSymlinkRefused}
+	}
+	if !encFs.isOsBackend() {
+		// targets can not be resolved on other backends, symlinks are refused instead
+		return encFs.checkNoSymlink(op, encryptedName, followLast)
+	}
+	realVolumeRoot, err := encFs.resolveSymlinks(encFs.volumeRoot)
+	if err != nil {
+		return err
+	}
+	absName, err := filepath.Abs(encryptedName)
+	if err != nil {
+		return err
+	}
+	if !followLast {
+		// the last part is not followed, only its parent must resolve inside
+		absName = filepath.Dir(absName)
+	}
+	realName, err := encFs.resolveSymlinks(absName)
+	if err != nil {
+		return err
+	}
+	if !isSubPath(realVolumeRoot, realName) {
+		return &os.PathError{Op: op, Path: encryptedName, Err: ErrSymlinkRefused}
+	}
+	return nil
+}
+
+// absBackendName makes name absolute, names of other backends than the os are rooted at "/"
+func (encFs *EncFs) absBackendName(name string) (string, error) {
+	if encFs.isOsBackend() {
+		return filepath.Abs(name)
+	}
+	return filepath.Clean(string(filepath.Separator) + name), nil
+}
+
+// resolveSymlinks resolves every symlink of the absolute name part by part, parts are read with Lstat and link targets
+// with Readlink, dangling links are resolved to their target too since creating through them writes there, parts
+// which do not exist are appended
+func (encFs *EncFs) resolveSymlinks(name string) (string, error) {
+	volumeName := filepath.VolumeName(name)
+	realName := volumeName + string(filepath.Separator)
+	parts := splitPathParts(name[len(volumeName):])
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			realName = filepath.Dir(realName)
+			continue
+		}
+		checkName := filepath.Join(realName, part)
+		fileInfo, _, err := encFs.lstat(checkName)
+		if err != nil {
+			if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+				return "", err
+			}
+			// not existing parts can not be symlinks
+			realName = checkName
+			continue
+		}
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			realName = checkName
+			continue
+		}
+		links++
+		if links > SYMLINK_MAX_FOLLOWS {
+			return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := encFs.readlink(checkName)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			targetVolumeName := filepath.VolumeName(target)
+			realName = targetVolumeName + string(filepath.Separator)
+			target = target[len(targetVolumeName):]
+		}
+		parts = append(splitPathParts(target), parts...)
+	}
+	return realName, nil
+}
+
+func splitPathParts(name string) []string {
+	return strings.Split(filepath.ToSlash(name), "/")
+}
+
+func isSubPath(root, name string) bool {
+	relName, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return relName != ".." && !strings.HasPrefix(relName, ".."+string(filepath.Separator))
+}
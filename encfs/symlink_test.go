@@ -0,0 +1,68 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSymlinkPolicyContain(t *testing.T) {
+	tests := []struct {
+		name string
+		// links maps link names inside the root to targets, "$OUT" is replaced by the outside directory
+		links   map[string]string
+		open    string
+		wantErr error
+	}{
+		{"link inside", map[string]string{"in": "sub"}, "in/file", nil},
+		{"absolute link outside", map[string]string{"out": "$OUT"}, "out/file", ErrSymlinkRefused},
+		{"dangling link outside", map[string]string{"dangling": "$OUT/missing"}, "dangling", ErrSymlinkRefused},
+		{"dangling relative link outside", map[string]string{"dangling": "../outside/missing"}, "dangling",
+			ErrSymlinkRefused},
+		{"dangling link inside", map[string]string{"dangling": "sub/missing"}, "dangling", nil},
+		{"link to a dangling link outside", map[string]string{"a": "b", "b": "$OUT/missing"}, "a", ErrSymlinkRefused},
+		{"link back inside", map[string]string{"out": "$OUT", "back": "out/../root/sub"}, "back/file", nil},
+		{"loop", map[string]string{"a": "b", "b": "a"}, "a", syscall.ELOOP},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			root := filepath.Join(base, "root")
+			outside := filepath.Join(base, "outside")
+			for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for link, target := range test.links {
+				if target == "$OUT" || filepath.Dir(target) == "$OUT" {
+					target = filepath.Join(outside, target[len("$OUT"):])
+				}
+				if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewNoopNameMapper())
+			encFs := NewEncFsWithBackend(key, afero.NewOsFs()).(*EncFs)
+			if err := encFs.WithVolumeRoot(root); err != nil {
+				t.Fatal(err)
+			}
+			encFs.WithSymlinkPolicy(SYMLINK_POLICY_CONTAIN)
+
+			f, err := encFs.OpenFile(filepath.Join(root, test.open), os.O_RDWR|os.O_CREATE, 0644)
+			if err == nil {
+				_ = f.Close()
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("open: got %v, want %v", err, test.wantErr)
+			}
+			if entries, err := os.ReadDir(outside); err != nil || len(entries) != 0 {
+				t.Fatalf("outside directory changed: %v, %v", entries, err)
+			}
+		})
+	}
+}
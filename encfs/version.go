@@ -0,0 +1,116 @@
+package encfs
+
+import (
+	"errors"
+)
+
+// meta files without magic and version were written before versioning and are read as version 1
+const (
+	ENC_FILE_META_MAGIC   = "encfs-afero"
+	ENC_FILE_META_VERSION = 1
+	// padded files are version 2 so older versions refuse them instead of returning the padding
+	ENC_FILE_META_VERSION_PADDED = 2
+	// metas with flags are version 5, versions 2 to 4 each stood for one feature so features could not be combined,
+	// new features need no new version, only a new META_FLAG constant
+	ENC_FILE_META_VERSION_FLAGS = 5
+
+	META_FLAG_PADDING = "padding"
+	META_FLAG_SUBKEYS = "subkeys"
+	META_FLAG_SEALED  = "sealed"
+	// META_FLAG_FINAL_CHUNK authenticates the last chunk of chunked files as such, see EncFile.chunkAead
+	META_FLAG_FINAL_CHUNK = "final_chunk"
+
+	MIGRATE_TEMP_META_FILE_SUFFIX = ".__migratemeta" + EncFileExt
+)
+
+var (
+	ErrBadFileMeta              = errors.New("file meta is broken")
+	ErrUnsupportedFormatVersion = errors.New("unsupported file format version")
+)
+
+// supportedMetaFlags are the flags of ENC_FILE_META_VERSION_FLAGS metas this version can read
+var supportedMetaFlags = map[string]bool{
+	META_FLAG_PADDING:     true,
+	META_FLAG_SUBKEYS:     true,
+	META_FLAG_SEALED:      true,
+	META_FLAG_FINAL_CHUNK: true,
+}
+
+// checkVersion refuses meta of another format, written by a newer version or with flags this version does not know
+func (encFileMeta *EncFileMeta) checkVersion() error {
+	if encFileMeta.Magic != "" && encFileMeta.Magic != ENC_FILE_META_MAGIC {
+		return ErrBadFileMeta
+	}
+	if encFileMeta.Version > ENC_FILE_META_VERSION_FLAGS {
+		return ErrUnsupportedFormatVersion
+	}
+	if len(encFileMeta.Flags) > 0 && encFileMeta.Version < ENC_FILE_META_VERSION_FLAGS {
+		return ErrBadFileMeta
+	}
+	for _, flag := range encFileMeta.Flags {
+		if !supportedMetaFlags[flag] {
+			return ErrUnsupportedFormatVersion
+		}
+	}
+	sealed := encFileMeta.Sealed != nil
+	if encFileMeta.Version == ENC_FILE_META_VERSION_FLAGS && encFileMeta.hasFlag(META_FLAG_SEALED) != sealed {
+		return ErrBadFileMeta
+	}
+	return nil
+}
+
+// setFlag records flag in the meta of a new file, older versions refuse it instead of ignoring the flag
+func (encFileMeta *EncFileMeta) setFlag(flag string) {
+	if !encFileMeta.hasFlag(flag) {
+		encFileMeta.Flags = append(encFileMeta.Flags, flag)
+	}
+	encFileMeta.Version = ENC_FILE_META_VERSION_FLAGS
+}
+
+func (encFileMeta *EncFileMeta) hasFlag(flag string) bool {
+	for _, metaFlag := range encFileMeta.Flags {
+		if metaFlag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (encFileMeta *EncFileMeta) isCurrentVersion() bool {
+	return encFileMeta.Magic == ENC_FILE_META_MAGIC && encFileMeta.Version >= ENC_FILE_META_VERSION
+}
+
+// Migrate upgrades the meta of name to ENC_FILE_META_VERSION and seals it after WithEncryptedMeta, the contents are
+// kept as they are, files of the current version, header format files and files without meta are left untouched
+func (encFs *EncFs) Migrate(name string) (err error) {
+	defer encFs.audit("migrate", name, "", 0, &err)
+	encryptedName := encFs.encryptFileName(name)
+	encFileMeta, headerSize, err := encFs.readFileMeta(encryptedName)
+	if err != nil {
+		return err
+	}
+	unsealed := encFs.encryptedMeta && encFileMeta != nil && encFileMeta.sealKey == nil
+	if encFileMeta == nil || headerSize > 0 || encFileMeta.isCurrentVersion() && !unsealed {
+		return nil
+	}
+	if !encFileMeta.isCurrentVersion() {
+		encFileMeta.Magic = ENC_FILE_META_MAGIC
+		encFileMeta.Version = ENC_FILE_META_VERSION
+	}
+	if unsealed {
+		// sealed by the key of its contents, the name written by older versions is dropped
+		encFileMeta.sealKey = encFs.key
+		if encFileMeta.KeyId != "" && encFs.keyring[encFileMeta.KeyId] != nil {
+			encFileMeta.sealKey = encFs.keyring[encFileMeta.KeyId]
+		}
+		encFileMeta.Name = ""
+	}
+	encFileMetaName := encFs.encFileMetaName(encryptedName)
+	tempName := encryptedName + MIGRATE_TEMP_META_FILE_SUFFIX
+	if err := writeEncFileMeta(encFs.base, tempName, encFileMeta); err != nil {
+		_ = encFs.base.Remove(tempName)
+		return err
+	}
+	defer encFs.forgetCachedEncFileMetas(encryptedName)
+	return renameEncFileMeta(encFs.base, tempName, encFileMetaName)
+}
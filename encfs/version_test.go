@@ -0,0 +1,276 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMetaFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		subkeys   bool
+		setup     func(encFs *EncFs) error
+		wantFlags []string
+	}{
+		{"none", false, func(encFs *EncFs) error { return nil }, nil},
+		{"subkeys", true, func(encFs *EncFs) error { return nil }, []string{META_FLAG_SUBKEYS}},
+		{"padding and subkeys", true, func(encFs *EncFs) error {
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_PADME, 0)
+		}, []string{META_FLAG_FINAL_CHUNK, META_FLAG_PADDING, META_FLAG_SUBKEYS}},
+		{"sealed padding", false, func(encFs *EncFs) error {
+			encFs.WithEncryptedMeta(true)
+			if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+				return err
+			}
+			return encFs.WithSizePadding(SIZE_PADDING_BLOCK, 4096)
+		}, []string{META_FLAG_FINAL_CHUNK, META_FLAG_PADDING}},
+		{"gcm", false, func(encFs *EncFs) error {
+			return encFs.WithContentCipher(CIPHER_AES_GCM)
+		}, []string{META_FLAG_FINAL_CHUNK}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := NewEncryptionMasterKey(testKeyBytes(1))
+			key.WithSubkeys(test.subkeys)
+			encFs, _ := newTestEncFs(key)
+			if err := test.setup(encFs); err != nil {
+				t.Fatal(err)
+			}
+			data := testPattern(5000)
+			writeTestFile(t, encFs, "/file", data)
+			checkTestFile(t, encFs, "/file", data)
+
+			encFileMeta, _, err := encFs.readFileMeta(encFs.encryptFileName("/file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(encFileMeta.Flags, test.wantFlags) {
+				t.Fatalf("got flags %q, want %q", encFileMeta.Flags, test.wantFlags)
+			}
+			wantVersion := ENC_FILE_META_VERSION
+			if len(test.wantFlags) > 0 {
+				wantVersion = ENC_FILE_META_VERSION_FLAGS
+			}
+			if encFileMeta.Version != wantVersion {
+				t.Fatalf("got version %d, want %d", encFileMeta.Version, wantVersion)
+			}
+			if encFileMeta.usesSubkeys() != test.subkeys {
+				t.Fatalf("uses subkeys %t, want %t", encFileMeta.usesSubkeys(), test.subkeys)
+			}
+		})
+	}
+}
+
+func TestMetaVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(encFileMeta *EncFileMeta)
+		wantErr error
+	}{
+		{"flags", func(encFileMeta *EncFileMeta) {}, nil},
+		{"legacy subkeys version", func(encFileMeta *EncFileMeta) {
+			// files of content subkeys were version 3 before flags
+			encFileMeta.Version = ENC_FILE_META_VERSION_SUBKEYS
+			encFileMeta.Flags = nil
+		}, nil},
+		{"unknown flag", func(encFileMeta *EncFileMeta) {
+			encFileMeta.Flags = append(encFileMeta.Flags, "from the future")
+		}, ErrUnsupportedFormatVersion},
+		{"unknown version", func(encFileMeta *EncFileMeta) {
+			encFileMeta.Version = ENC_FILE_META_VERSION_FLAGS + 1
+		}, ErrUnsupportedFormatVersion},
+		{"flags of an old version", func(encFileMeta *EncFileMeta) {
+			encFileMeta.Version = ENC_FILE_META_VERSION
+		}, ErrBadFileMeta},
+		{"sealed flag without sealed meta", func(encFileMeta *EncFileMeta) {
+			encFileMeta.Flags = append(encFileMeta.Flags, META_FLAG_SEALED)
+		}, ErrBadFileMeta},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := NewEncryptionMasterKeyWithNameMapper(testKeyBytes(1), NewNoopNameMapper())
+			key.WithSubkeys(true)
+			encFs, base := newTestEncFs(key)
+			data := testPattern(5000)
+			writeTestFile(t, encFs, "/file", data)
+
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(encFileMeta)
+			if err := writeEncFileMeta(base, encFs.encFileMetaName("/file"), encFileMeta); err != nil {
+				t.Fatal(err)
+			}
+			encFs.forgetCachedEncFileMetas("/file")
+
+			got, err := afero.ReadFile(encFs, "/file")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, data) {
+				t.Fatal("read other contents")
+			}
+			var pathError *os.PathError
+			if err != nil && !errors.As(err, &pathError) {
+				t.Fatalf("error %v has no path", err)
+			}
+		})
+	}
+}
+
+// writeBaselineTestFile writes name as the first version did, a CTR file with a plaintext meta of name and iv
+func writeBaselineTestFile(t *testing.T, encFs *EncFs, base afero.Fs, name string, data []byte) {
+	t.Helper()
+	writeTestFile(t, encFs, name, data)
+	encFileMeta, _, err := encFs.readFileMeta(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaBytes, err := json.Marshal(struct {
+		Name string `json:"name"`
+		Iv   []byte `json:"iv"`
+	}{name, encFileMeta.Iv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, base, encFs.encFileMetaName(name), metaBytes)
+	encFs.forgetCachedEncFileMetas(name)
+}
+
+func TestMigrate(t *testing.T) {
+	data := testPattern(5000)
+	tests := []struct {
+		name          string
+		encryptedMeta bool
+		// write writes /file
+		write      func(t *testing.T, encFs *EncFs, base afero.Fs)
+		wantSealed bool
+		// wantUntouched is set when the meta file is kept as it is
+		wantUntouched bool
+	}{
+		{"baseline", false, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeBaselineTestFile(t, encFs, base, "/file", data)
+		}, false, false},
+		{"baseline sealed", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeBaselineTestFile(t, encFs, base, "/file", data)
+		}, true, false},
+		{"current", false, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, encFs, "/file", data)
+		}, false, true},
+		{"current sealed", true, func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, encFs, "/file", data)
+		}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			encFs.WithEncryptedMeta(test.encryptedMeta)
+			test.write(t, encFs, base)
+			checkTestFile(t, encFs, "/file", data)
+			before := snapshotTestFs(t, base)
+
+			if err := encFs.Migrate("/file"); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/file", data)
+			after := snapshotTestFs(t, base)
+			// the contents are kept as they are
+			if after["/file"] != before["/file"] || len(after) != len(before) {
+				t.Fatalf("got %d backend files, want %d with the same contents", len(after), len(before))
+			}
+			metaName := encFs.encFileMetaName("/file")
+			if (after[metaName] == before[metaName]) != test.wantUntouched {
+				t.Fatalf("got meta %s, want untouched %v", after[metaName], test.wantUntouched)
+			}
+			encFs.forgetCachedEncFileMetas("/file")
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !encFileMeta.isCurrentVersion() || (encFileMeta.sealKey != nil) != test.wantSealed {
+				t.Fatalf("got version %d sealed %v", encFileMeta.Version, encFileMeta.sealKey != nil)
+			}
+			// a second migration changes nothing
+			if err := encFs.Migrate("/file"); err != nil {
+				t.Fatal(err)
+			}
+			if again := snapshotTestFs(t, base); !reflect.DeepEqual(again, after) {
+				t.Fatalf("second migration changed %d backend files", len(again))
+			}
+		})
+	}
+}
+
+// testFailingRenameFs fails renames, like a crash between writing and renaming the temp meta file
+type testFailingRenameFs struct {
+	afero.Fs
+}
+
+func (fs *testFailingRenameFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.New("rename failed")}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	data := testPattern(5000)
+	tests := []struct {
+		name string
+		// interrupt interrupts the migration of /file written to base
+		interrupt func(t *testing.T, encFs *EncFs, base afero.Fs)
+	}{
+		{"rename fails", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			failingFs := NewEncFsWithBackend(encFs.key, &testFailingRenameFs{base}).(*EncFs)
+			if err := failingFs.Migrate("/file"); err == nil {
+				t.Fatal("got no error")
+			}
+		}},
+		// the process died before renaming, the temp meta file is left over
+		{"temp meta left", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			encFileMeta.Magic, encFileMeta.Version = ENC_FILE_META_MAGIC, ENC_FILE_META_VERSION
+			if err := writeEncFileMeta(base, "/file"+MIGRATE_TEMP_META_FILE_SUFFIX, encFileMeta); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"temp meta cut", func(t *testing.T, encFs *EncFs, base afero.Fs) {
+			writeTestFile(t, base, "/file"+MIGRATE_TEMP_META_FILE_SUFFIX, []byte(`{"magic":"encfs-af`))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+			writeBaselineTestFile(t, encFs, base, "/file", data)
+			test.interrupt(t, encFs, base)
+			encFs.forgetCachedEncFileMetas("/file")
+			checkTestFile(t, encFs, "/file", data)
+			fileInfos, err := afero.ReadDir(encFs, "/")
+			if err != nil || len(fileInfos) != 1 || fileInfos[0].Name() != "file" {
+				t.Fatalf("got %d files: %v, want only the file", len(fileInfos), err)
+			}
+
+			// migrating again finishes the migration
+			if err := encFs.Migrate("/file"); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/file", data)
+			if exists, err := afero.Exists(base, "/file"+MIGRATE_TEMP_META_FILE_SUFFIX); err != nil || exists {
+				t.Fatalf("got the temp meta file left: %v", err)
+			}
+			encFileMeta, _, err := encFs.readFileMeta("/file")
+			if err != nil || !encFileMeta.isCurrentVersion() {
+				t.Fatalf("got %+v: %v", encFileMeta, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	VOLUME_CONFIG_FILE_NAME = "__ENCFS_VOLUME__" + EncFileExt
+	VOLUME_CONFIG_VERSION   = 1
+	// VOLUME_CONFIG_VERSION_META_STORAGE was written for volumes keeping their metas outside of sidecars, by
+	// MetaStore or XattrMeta, so older versions refuse them
+	VOLUME_CONFIG_VERSION_META_STORAGE = 2
+	// VOLUME_CONFIG_VERSION_META_NAMING was written for volumes naming their meta files by MetaFileExt or
+	// HiddenMetaFiles, which older versions would not find
+	VOLUME_CONFIG_VERSION_META_NAMING = 3
+	// VOLUME_CONFIG_VERSION_FEATURES is written by InitVolume, the config lists the features readers must support
+	// in Features, new features need no new version, only a new VOLUME_FEATURE constant
+	VOLUME_CONFIG_VERSION_FEATURES = 4
+
+	VOLUME_FEATURE_META_STORAGE   = "meta_storage"
+	VOLUME_FEATURE_META_NAMING    = "meta_naming"
+	VOLUME_FEATURE_SUBKEYS        = "subkeys"
+	VOLUME_FEATURE_ENCRYPTED_META = "encrypted_meta"
+
+	volumeKeySize        = 32
+	volumeFileNameIvSize = 12
+	volumeWrapNonceSize  = 12
+)
+
+var (
+	ErrUnsupportedNameMode = errors.New("unsupported file name mode")
+	ErrBadVolumeConfig     = errors.New("volume config is broken")
+	ErrMetaStorageConflict = errors.New("meta store and xattr meta exclude each other")
+	ErrUnsupportedFeature  = errors.New("unsupported volume feature")
+)
+
+// supportedVolumeFeatures are the features of VOLUME_CONFIG_VERSION_FEATURES configs this version can open
+var supportedVolumeFeatures = map[string]bool{
+	VOLUME_FEATURE_META_STORAGE:   true,
+	VOLUME_FEATURE_META_NAMING:    true,
+	VOLUME_FEATURE_SUBKEYS:        true,
+	VOLUME_FEATURE_ENCRYPTED_META: true,
+}
+
+// VolumeOptions are the settings of a volume created by InitVolume, the zero value gives CTR contents in sidecar
+// format with SIV names and DefaultKdfParams
+type VolumeOptions struct {
+	ContentCipher string
+	FileFormat    FileFormat
+	// NameMode is one of the NAME_MODE constants, NAME_MODE_SIV when empty
+	NameMode string
+	// NamePadding and LongNames wrap the name mapper by NewPaddedNameMapper and NewLongNameMapperWithBackend
+	NamePadding          bool
+	LongNames            bool
+	SizePadding          string
+	SizePaddingBlockSize int
+	IntegrityTags        bool
+	// MetaStore keeps the meta files in one log in the volume root instead of one sidecar per file, which halves the
+	// inode usage and speeds up directory scans on network filesystems, only one process may use such a volume
+	MetaStore bool
+	// XattrMeta keeps the meta of a data file in its extended attribute XATTR_META_NAME, volumes on other backends than
+	// afero.OsFs and filesystems without user attributes use sidecars
+	XattrMeta bool
+	// MetaFileExt replaces EncFileExt as the ext of the meta files and HiddenMetaFiles starts their names with a dot,
+	// see WithMetaFileNaming
+	MetaFileExt     string
+	HiddenMetaFiles bool
+	Kdf             *KdfParams
+}
+
+// VolumeConfig is stored unencrypted in VOLUME_CONFIG_FILE_NAME of the volume root, the master key is random and
+// wrapped by a key derived from the passphrase, KeyId is the fingerprint of the master key
+type VolumeConfig struct {
+	Magic   string `json:"magic"`
+	Version int    `json:"version"`
+	// Features lists the VOLUME_FEATURE constants of VOLUME_CONFIG_VERSION_FEATURES configs, readers refuse volumes
+	// with features they do not know
+	Features             []string   `json:"features,omitempty"`
+	KeyId                string     `json:"key_id"`
+	Kdf                  *KdfParams `json:"kdf"`
+	Salt                 []byte     `json:"salt"`
+	WrappedKey           []byte     `json:"wrapped_key"`
+	ContentCipher        string     `json:"content_cipher,omitempty"`
+	FileFormat           FileFormat `json:"file_format,omitempty"`
+	NameMode             string     `json:"name_mode"`
+	FileNameIv           []byte     `json:"file_name_iv,omitempty"`
+	NamePadding          bool       `json:"name_padding,omitempty"`
+	LongNames            bool       `json:"long_names,omitempty"`
+	SizePadding          string     `json:"size_padding,omitempty"`
+	SizePaddingBlockSize int        `json:"size_padding_block_size,omitempty"`
+	IntegrityTags        bool       `json:"integrity_tags,omitempty"`
+	// Subkeys is set for volumes whose contents and names use separate subkeys, see WithSubkeys
+	Subkeys   bool `json:"subkeys,omitempty"`
+	MetaStore bool `json:"meta_store,omitempty"`
+	XattrMeta bool `json:"xattr_meta,omitempty"`
+	// EncryptedMeta is set for volumes whose meta files are sealed, see WithEncryptedMeta
+	EncryptedMeta   bool   `json:"encrypted_meta,omitempty"`
+	MetaFileExt     string `json:"meta_file_ext,omitempty"`
+	HiddenMetaFiles bool   `json:"hidden_meta_files,omitempty"`
+}
+
+// InitVolume creates a volume in root of base with a random master key wrapped by passphrase and returns the
+// EncFs of it, the backend of the EncFs is root, an existing volume config is never replaced
+func InitVolume(base afero.Fs, root string, passphrase string, options *VolumeOptions) (*EncFs, error) {
+	if options == nil {
+		options = &VolumeOptions{}
+	}
+	config := &VolumeConfig{
+		Magic:                ENC_FILE_META_MAGIC,
+		Version:              VOLUME_CONFIG_VERSION_FEATURES,
+		Kdf:                  options.Kdf,
+		Salt:                 make([]byte, PASSPHRASE_SALT_SIZE),
+		ContentCipher:        options.ContentCipher,
+		FileFormat:           options.FileFormat,
+		NameMode:             options.NameMode,
+		NamePadding:          options.NamePadding,
+		LongNames:            options.LongNames,
+		SizePadding:          options.SizePadding,
+		SizePaddingBlockSize: options.SizePaddingBlockSize,
+		IntegrityTags:        options.IntegrityTags,
+		Subkeys:              true,
+		EncryptedMeta:        true,
+		MetaStore:            options.MetaStore,
+		XattrMeta:            options.XattrMeta,
+		MetaFileExt:          options.MetaFileExt,
+		HiddenMetaFiles:      options.HiddenMetaFiles,
+	}
+	config.Features = config.requiredFeatures()
+	if config.Kdf == nil {
+		config.Kdf = DefaultKdfParams()
+	}
+	if config.NameMode == "" {
+		config.NameMode = NAME_MODE_SIV
+	}
+	if config.NameMode == NAME_MODE_GCM {
+		config.FileNameIv = make([]byte, volumeFileNameIvSize)
+		if err := (*EncFs)(nil).readRandom(config.FileNameIv); err != nil {
+			return nil, err
+		}
+	}
+	masterKey := make([]byte, volumeKeySize)
+	if err := (*EncFs)(nil).readRandom(masterKey); err != nil {
+		return nil, err
+	}
+	if err := (*EncFs)(nil).readRandom(config.Salt); err != nil {
+		return nil, err
+	}
+	wrappingKey, err := NewEncryptionMasterKeyFromPassphrase(passphrase, config.Salt, config.Kdf)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, volumeWrapNonceSize)
+	if err := (*EncFs)(nil).readRandom(nonce); err != nil {
+		return nil, err
+	}
+	if config.WrappedKey, err = sealWithNonce(wrappingKey.key, nonce, masterKey); err != nil {
+		return nil, err
+	}
+	config.KeyId = NewEncryptionMasterKey(masterKey).KeyId()
+	// the settings are checked before the config is written
+	encFs, err := newVolumeEncFs(base, root, config, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	configFile, err := base.OpenFile(filepath.Join(root, VOLUME_CONFIG_FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = configFile.Close()
+	}()
+	if _, err := configFile.Write(configBytes); err != nil {
+		return nil, err
+	}
+	if err := configFile.Sync(); err != nil {
+		return nil, err
+	}
+	return encFs, nil
+}
+
+// ReadVolumeConfig reads the volume config of root in base, e.g. to show the key fingerprint and the settings
+func ReadVolumeConfig(base afero.Fs, root string) (*VolumeConfig, error) {
+	configName := filepath.Join(root, VOLUME_CONFIG_FILE_NAME)
+	configFile, err := base.Open(configName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = configFile.Close()
+	}()
+	configBytes, err := io.ReadAll(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var config VolumeConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil || config.Magic != ENC_FILE_META_MAGIC {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: ErrBadVolumeConfig}
+	}
+	if config.Version > VOLUME_CONFIG_VERSION_FEATURES {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: ErrUnsupportedFormatVersion}
+	}
+	if err := config.checkFeatures(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: err}
+	}
+	return &config, nil
+}
+
+// requiredFeatures returns the features the settings of config need, a reader ignoring any of them would misread
+// names, metas or contents
+func (config *VolumeConfig) requiredFeatures() []string {
+	var features []string
+	if config.MetaStore || config.XattrMeta {
+		features = append(features, VOLUME_FEATURE_META_STORAGE)
+	}
+	if (config.MetaFileExt != "" && config.MetaFileExt != EncFileExt) || config.HiddenMetaFiles {
+		features = append(features, VOLUME_FEATURE_META_NAMING)
+	}
+	if config.Subkeys {
+		features = append(features, VOLUME_FEATURE_SUBKEYS)
+	}
+	if config.EncryptedMeta {
+		features = append(features, VOLUME_FEATURE_ENCRYPTED_META)
+	}
+	return features
+}
+
+// checkFeatures refuses features this version does not know and settings whose feature is not listed, configs
+// older than VOLUME_CONFIG_VERSION_FEATURES have no features and are opened by their settings
+func (config *VolumeConfig) checkFeatures() error {
+	if config.Version < VOLUME_CONFIG_VERSION_FEATURES {
+		return nil
+	}
+	listed := make(map[string]bool, len(config.Features))
+	for _, feature := range config.Features {
+		if !supportedVolumeFeatures[feature] {
+			return fmt.Errorf("%w: %s", ErrUnsupportedFeature, feature)
+		}
+		listed[feature] = true
+	}
+	for _, feature := range config.requiredFeatures() {
+		if !listed[feature] {
+			return ErrBadVolumeConfig
+		}
+	}
+	return nil
+}
+
+// OpenVolume unwraps the master key of the volume in root of base with passphrase and returns an EncFs configured
+// by the volume config, ErrWrongPassphrase is returned when the passphrase does not match
+func OpenVolume(base afero.Fs, root string, passphrase string) (*EncFs, error) {
+	config, err := ReadVolumeConfig(base, root)
+	if err != nil {
+		return nil, err
+	}
+	configName := filepath.Join(root, VOLUME_CONFIG_FILE_NAME)
+	wrappingKey, err := NewEncryptionMasterKeyFromPassphrase(passphrase, config.Salt, config.Kdf)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: err}
+	}
+	masterKey, err := openWithRandomNonce(wrappingKey.key, config.WrappedKey)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: ErrWrongPassphrase}
+	}
+	if NewEncryptionMasterKey(masterKey).KeyId() != config.KeyId {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: ErrBadVolumeConfig}
+	}
+	encFs, err := newVolumeEncFs(base, root, config, masterKey)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: configName, Err: err}
+	}
+	return encFs, nil
+}
+
+// newVolumeEncFs returns the EncFs of config on root of base
+func newVolumeEncFs(base afero.Fs, root string, config *VolumeConfig, masterKey []byte) (*EncFs, error) {
+	if config.MetaStore && config.XattrMeta {
+		return nil, ErrMetaStorageConflict
+	}
+	if config.IntegrityTags && config.FileFormat == FILE_FORMAT_HEADER {
+		return nil, ErrIntegrityTagsNeedSidecar
+	}
+	metaNaming, err := newMetaFileNaming(config.MetaFileExt, config.HiddenMetaFiles)
+	if err != nil {
+		return nil, err
+	}
+	_, isOsFs := base.(*afero.OsFs)
+	if root != "" && root != string(filepath.Separator) {
+		base = afero.NewBasePathFs(base, root)
+	}
+	if config.XattrMeta && isOsFs {
+		base = newXattrMetaFs(base, metaNaming, func(name string) string {
+			return filepath.Join(root, name)
+		})
+	}
+	if config.MetaStore {
+		metaStoreFs, err := newMetaStoreFs(base, metaNaming)
+		if err != nil {
+			return nil, err
+		}
+		base = metaStoreFs
+	}
+	key := NewEncryptionMasterKey(masterKey)
+	key.WithSubkeys(config.Subkeys)
+	fileNameKey := key.FileNameKey()
+	var nameMapper NameMapper
+	switch config.NameMode {
+	case NAME_MODE_NOOP:
+		nameMapper = NewNoopNameMapper()
+	case NAME_MODE_GCM:
+		if len(config.FileNameIv) != volumeFileNameIvSize {
+			return nil, ErrBadVolumeConfig
+		}
+		nameMapper = NewGcmNameMapper(fileNameKey, config.FileNameIv)
+	case NAME_MODE_HMAC:
+		nameMapper = NewHmacNameMapperWithBackend(fileNameKey, base)
+	case NAME_MODE_RANDOM_NONCE:
+		nameMapper = NewRandomNonceNameMapperWithBackend(fileNameKey, base)
+	case NAME_MODE_SIV:
+		nameMapper = NewSivNameMapper(fileNameKey)
+	default:
+		return nil, ErrUnsupportedNameMode
+	}
+	if config.NamePadding {
+		nameMapper = NewPaddedNameMapper(nameMapper)
+	}
+	if config.LongNames {
+		nameMapper = NewLongNameMapperWithBackend(nameMapper, base)
+	}
+	key.WithNameMapper(nameMapper)
+	encFs := newEncFs(key, base)
+	// shared with the meta stores
+	encFs.metaNaming = metaNaming
+	if config.ContentCipher != "" {
+		if err := encFs.WithContentCipher(config.ContentCipher); err != nil {
+			return nil, err
+		}
+	}
+	if config.FileFormat != FILE_FORMAT_SIDECAR && config.FileFormat != FILE_FORMAT_HEADER {
+		return nil, ErrBadVolumeConfig
+	}
+	encFs.WithFileFormat(config.FileFormat)
+	if err := encFs.WithSizePadding(config.SizePadding, config.SizePaddingBlockSize); err != nil {
+		return nil, err
+	}
+	encFs.WithIntegrityTags(config.IntegrityTags)
+	encFs.WithEncryptedMeta(config.EncryptedMeta)
+	return encFs, nil
+}
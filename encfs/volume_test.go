@@ -0,0 +1,304 @@
+package encfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestInitVolumeFeatures(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      VolumeOptions
+		wantFeatures []string
+	}{
+		{"default", VolumeOptions{}, []string{VOLUME_FEATURE_SUBKEYS, VOLUME_FEATURE_ENCRYPTED_META}},
+		{"meta store", VolumeOptions{MetaStore: true},
+			[]string{VOLUME_FEATURE_META_STORAGE, VOLUME_FEATURE_SUBKEYS, VOLUME_FEATURE_ENCRYPTED_META}},
+		{"hidden meta files", VolumeOptions{HiddenMetaFiles: true},
+			[]string{VOLUME_FEATURE_META_NAMING, VOLUME_FEATURE_SUBKEYS, VOLUME_FEATURE_ENCRYPTED_META}},
+		{"default meta file ext", VolumeOptions{MetaFileExt: EncFileExt},
+			[]string{VOLUME_FEATURE_SUBKEYS, VOLUME_FEATURE_ENCRYPTED_META}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			test.options.Kdf = testKdfParams()
+			encFs, err := InitVolume(base, "/volume", "passphrase", &test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			config, err := ReadVolumeConfig(base, "/volume")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Version != VOLUME_CONFIG_VERSION_FEATURES {
+				t.Fatalf("got version %d, want %d", config.Version, VOLUME_CONFIG_VERSION_FEATURES)
+			}
+			if !reflect.DeepEqual(config.Features, test.wantFeatures) {
+				t.Fatalf("got features %q, want %q", config.Features, test.wantFeatures)
+			}
+			encFs, err = OpenVolume(base, "/volume", "passphrase")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, encFs, "/file", []byte("data"))
+		})
+	}
+}
+
+func TestOpenVolumeFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(config map[string]interface{})
+		wantErr error
+	}{
+		{"features", func(config map[string]interface{}) {}, nil},
+		{"unknown feature", func(config map[string]interface{}) {
+			config["features"] = append(config["features"].([]interface{}), "from the future")
+		}, ErrUnsupportedFeature},
+		{"unknown version", func(config map[string]interface{}) {
+			config["version"] = VOLUME_CONFIG_VERSION_FEATURES + 1
+		}, ErrUnsupportedFormatVersion},
+		{"unlisted subkeys", func(config map[string]interface{}) {
+			config["features"] = []string{VOLUME_FEATURE_ENCRYPTED_META}
+		}, ErrBadVolumeConfig},
+		{"legacy version", func(config map[string]interface{}) {
+			// configs of older versions have no features, their settings are used as they are
+			config["version"] = VOLUME_CONFIG_VERSION
+			delete(config, "features")
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			encFs, err := InitVolume(base, "/volume", "passphrase", &VolumeOptions{Kdf: testKdfParams()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("data"))
+
+			configName := filepath.Join("/volume", VOLUME_CONFIG_FILE_NAME)
+			configBytes, err := afero.ReadFile(base, configName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config map[string]interface{}
+			if err := json.Unmarshal(configBytes, &config); err != nil {
+				t.Fatal(err)
+			}
+			test.modify(config)
+			if configBytes, err = json.Marshal(config); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(base, configName, configBytes, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			encFs, err = OpenVolume(base, "/volume", "passphrase")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil {
+				checkTestFile(t, encFs, "/file", []byte("data"))
+			}
+		})
+	}
+}
+
+func TestVolumeSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		options VolumeOptions
+		// plainNames is set when the backend keeps the plaintext names
+		plainNames bool
+	}{
+		{"default", VolumeOptions{}, false},
+		{"gcm", VolumeOptions{ContentCipher: CIPHER_AES_GCM}, false},
+		{"header", VolumeOptions{FileFormat: FILE_FORMAT_HEADER}, false},
+		{"noop names", VolumeOptions{NameMode: NAME_MODE_NOOP}, true},
+		{"gcm names", VolumeOptions{NameMode: NAME_MODE_GCM}, false},
+		{"hmac names", VolumeOptions{NameMode: NAME_MODE_HMAC}, false},
+		{"random nonce names", VolumeOptions{NameMode: NAME_MODE_RANDOM_NONCE}, false},
+		{"padded long names", VolumeOptions{NamePadding: true, LongNames: true}, false},
+		{"size padding", VolumeOptions{ContentCipher: CIPHER_AES_GCM, SizePadding: SIZE_PADDING_PADME}, false},
+		{"integrity tags", VolumeOptions{IntegrityTags: true}, false},
+		{"meta file naming", VolumeOptions{MetaFileExt: ".__meta", HiddenMetaFiles: true}, false},
+	}
+	files := map[string][]byte{
+		"/file":                            []byte("data"),
+		"/dir/other":                       testPattern(3*CONTENT_CHUNK_SIZE + 17),
+		"/dir/" + strings.Repeat("n", 200): []byte("long name"),
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			test.options.Kdf = testKdfParams()
+			encFs, err := InitVolume(base, "/volume", "passphrase", &test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := encFs.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range files {
+				writeTestFile(t, encFs, name, data)
+			}
+			config, err := ReadVolumeConfig(base, "/volume")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.KeyId != encFs.key.KeyId() || config.ContentCipher != test.options.ContentCipher ||
+				config.NamePadding != test.options.NamePadding || config.SizePadding != test.options.SizePadding {
+				t.Fatalf("got config %+v", config)
+			}
+			// the volume is kept below its root, names and contents are encrypted
+			for name, contents := range snapshotTestFs(t, base) {
+				if !strings.HasPrefix(name, "/volume/") {
+					t.Fatalf("%s is outside of the volume", name)
+				}
+				if !test.plainNames && (strings.Contains(name, "plainname") || strings.Contains(name, "othername") ||
+					strings.Contains(name, "longlong")) {
+					t.Fatalf("%s holds a plaintext name", name)
+				}
+				if strings.Contains(contents, "data") || strings.Contains(contents, "long name") {
+					t.Fatalf("%s holds plaintext", name)
+				}
+			}
+
+			// the settings are read from the config
+			reopened, err := OpenVolume(base, "/volume", "passphrase")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range files {
+				checkTestFile(t, reopened, name, data)
+			}
+			writeTestFile(t, reopened, "/dir/new", []byte("new"))
+			// random nonce names keep the listings of each EncFs, the file is looked up by another open
+			if reopened, err = OpenVolume(base, "/volume", "passphrase"); err != nil {
+				t.Fatal(err)
+			}
+			checkTestFile(t, reopened, "/dir/new", []byte("new"))
+		})
+	}
+}
+
+func TestOpenVolume(t *testing.T) {
+	tests := []struct {
+		name string
+		// modify changes the config, the volume is opened with passphrase
+		modify     func(config map[string]interface{})
+		passphrase string
+		wantErr    error
+	}{
+		{"passphrase", nil, "passphrase", nil},
+		{"wrong passphrase", nil, "other", ErrWrongPassphrase},
+		{"other key id", func(config map[string]interface{}) {
+			config["key_id"] = NewEncryptionMasterKey(testKeyBytes(1)).KeyId()
+		}, "passphrase", ErrBadVolumeConfig},
+		{"unsupported name mode", func(config map[string]interface{}) {
+			config["name_mode"] = "rot13"
+		}, "passphrase", ErrUnsupportedNameMode},
+		{"gcm names without iv", func(config map[string]interface{}) {
+			config["name_mode"] = NAME_MODE_GCM
+		}, "passphrase", ErrBadVolumeConfig},
+		{"unknown file format", func(config map[string]interface{}) {
+			config["file_format"] = "other"
+		}, "passphrase", ErrBadVolumeConfig},
+		{"missing volume", func(config map[string]interface{}) {}, "passphrase", os.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			encFs, err := InitVolume(base, "/volume", "passphrase", &VolumeOptions{Kdf: testKdfParams()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/file", []byte("data"))
+			configName := filepath.Join("/volume", VOLUME_CONFIG_FILE_NAME)
+			if test.modify != nil {
+				configBytes, err := afero.ReadFile(base, configName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var config map[string]interface{}
+				if err := json.Unmarshal(configBytes, &config); err != nil {
+					t.Fatal(err)
+				}
+				test.modify(config)
+				if configBytes, err = json.Marshal(config); err != nil {
+					t.Fatal(err)
+				}
+				if err := afero.WriteFile(base, configName, configBytes, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root := "/volume"
+			if errors.Is(test.wantErr, os.ErrNotExist) {
+				root = "/missing"
+			}
+
+			encFs, err = OpenVolume(base, root, test.passphrase)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err == nil {
+				checkTestFile(t, encFs, "/file", []byte("data"))
+			}
+		})
+	}
+}
+
+func TestInitVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		options VolumeOptions
+		wantErr error
+	}{
+		{"meta store and xattr meta", VolumeOptions{MetaStore: true, XattrMeta: true}, ErrMetaStorageConflict},
+		{"integrity tags in headers", VolumeOptions{IntegrityTags: true, FileFormat: FILE_FORMAT_HEADER},
+			ErrIntegrityTagsNeedSidecar},
+		{"unsupported name mode", VolumeOptions{NameMode: "rot13"}, ErrUnsupportedNameMode},
+		{"bad size padding", VolumeOptions{SizePadding: "other"}, ErrBadSizePadding},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := afero.NewMemMapFs()
+			test.options.Kdf = testKdfParams()
+			if _, err := InitVolume(base, "/volume", "passphrase", &test.options); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			// settings are checked before anything is written
+			if len(snapshotTestFs(t, base)) != 0 {
+				t.Fatal("a refused volume wrote files")
+			}
+		})
+	}
+
+	// an existing volume is never replaced
+	base := afero.NewMemMapFs()
+	if _, err := InitVolume(base, "/volume", "passphrase", &VolumeOptions{Kdf: testKdfParams()}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadVolumeConfig(base, "/volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitVolume(base, "/volume", "other", &VolumeOptions{Kdf: testKdfParams()}); !os.IsExist(err) {
+		t.Fatalf("got %v, want exist", err)
+	}
+	if _, err := OpenVolume(base, "/volume", "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if reread, err := ReadVolumeConfig(base, "/volume"); err != nil || reread.KeyId != config.KeyId {
+		t.Fatalf("got %v, the config was replaced", err)
+	}
+}
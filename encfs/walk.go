@@ -0,0 +1,80 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+type encryptedWalkFunc func(plainName, encryptedName string, fileInfo os.FileInfo) error
+
+// walkEncrypted walks the on-disk tree of root, meta files are skipped and plaintext names are
+// decrypted part by part so every name is only decrypted once
+func (encFs *EncFs) walkEncrypted(root string, walkFn encryptedWalkFunc) error {
+	return encFs.walkEncryptedInternal(root, false, walkFn)
+}
+
+// walkEncryptedInternal walks like walkEncrypted, meta files and volume level files are passed to walkFn
+// with an empty plainName when includeInternal is true
+func (encFs *EncFs) walkEncryptedInternal(root string, includeInternal bool, walkFn encryptedWalkFunc) error {
+	encryptedRoot := encFs.encryptFileName(root)
+	plainNames := map[string]string{
+		encryptedRoot: root,
+	}
+	return afero.Walk(encFs.base, encryptedRoot, func(encryptedName string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if encryptedName != encryptedRoot && encFs.metaFileNaming().isInternalName(fileInfo.Name()) {
+			if includeInternal {
+				return walkFn("", encryptedName, fileInfo)
+			}
+			return nil
+		}
+		return walkFn(encFs.walkPlainName(plainNames, encryptedName, fileInfo), encryptedName, fileInfo)
+	})
+}
+
+// walkPlainName decrypts the last part of encryptedName, plainNames holds the plaintext names of the walked
+// directories so parents are never decrypted again
+func (encFs *EncFs) walkPlainName(plainNames map[string]string, encryptedName string, fileInfo os.FileInfo) string {
+	plainName, found := plainNames[encryptedName]
+	if !found {
+		encryptedParentName := filepath.Dir(encryptedName)
+		plainName = filepath.Join(plainNames[encryptedParentName],
+			encFs.key.decryptFileNamePart(encryptedParentName, fileInfo.Name()))
+		if fileInfo.IsDir() {
+			plainNames[encryptedName] = plainName
+		}
+	}
+	return plainName
+}
+
+// Walk walks the tree of root like afero.Walk, meta files are hidden and walkFn gets plaintext paths and file
+// infos with plaintext names and sizes, errors are passed to walkFn with the plaintext path too, entries of a
+// directory are visited in the order of their encrypted names
+func (encFs *EncFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	encryptedRoot := encFs.encryptFileName(root)
+	plainNames := map[string]string{
+		encryptedRoot: root,
+	}
+	return afero.Walk(encFs.base, encryptedRoot, func(encryptedName string, fileInfo os.FileInfo, err error) error {
+		if fileInfo == nil {
+			return walkFn(root, nil, encFs.plainPathError(err, root))
+		}
+		if encryptedName != encryptedRoot && encFs.metaFileNaming().isInternalName(fileInfo.Name()) {
+			return nil
+		}
+		plainName := encFs.walkPlainName(plainNames, encryptedName, fileInfo)
+		if err != nil {
+			return walkFn(plainName, encFs.logicalFileInfo(encryptedName, fileInfo), encFs.plainPathError(err, plainName))
+		}
+		return walkFn(plainName, encFs.logicalFileInfo(encryptedName, fileInfo), nil)
+	})
+}
+
+// Glob returns the plaintext names matching pattern like filepath.Glob, meta files never match
+func (encFs *EncFs) Glob(pattern string) ([]string, error) {
+	return afero.Glob(encFs, pattern)
+}
@@ -0,0 +1,130 @@
+package encfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestWalkFs(t *testing.T) *EncFs {
+	t.Helper()
+	encFs, _ := newTestHmacEncFs()
+	if err := encFs.WithContentCipher(CIPHER_AES_GCM); err != nil {
+		t.Fatal(err)
+	}
+	if err := encFs.MkdirAll("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"/a.txt": 1, "/dir/b.txt": 100, "/dir/c.jpg": 0, "/dir/sub/d.txt": 5000} {
+		writeTestFile(t, encFs, name, testPattern(size))
+	}
+	return encFs
+}
+
+func TestWalk(t *testing.T) {
+	encFs := newTestWalkFs(t)
+	tests := []struct {
+		name string
+		root string
+		// skip is returned for the path when set
+		skip      string
+		skipErr   error
+		wantPaths []string
+	}{
+		{"volume", "/", "", nil, []string{"/", "/a.txt", "/dir", "/dir/b.txt", "/dir/c.jpg", "/dir/sub",
+			"/dir/sub/d.txt"}},
+		{"directory", "/dir", "", nil, []string{"/dir", "/dir/b.txt", "/dir/c.jpg", "/dir/sub", "/dir/sub/d.txt"}},
+		{"file", "/dir/b.txt", "", nil, []string{"/dir/b.txt"}},
+		{"skipped directory", "/", "/dir/sub", filepath.SkipDir, []string{"/", "/a.txt", "/dir", "/dir/b.txt",
+			"/dir/c.jpg", "/dir/sub"}},
+	}
+	sizes := map[string]int64{"/a.txt": 1, "/dir/b.txt": 100, "/dir/c.jpg": 0, "/dir/sub/d.txt": 5000}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var paths []string
+			err := encFs.Walk(test.root, func(name string, fileInfo os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				paths = append(paths, name)
+				// file infos have plaintext names and sizes
+				if fileInfo.Name() != filepath.Base(name) && name != "/" {
+					t.Fatalf("%s: got name %q", name, fileInfo.Name())
+				}
+				if size, found := sizes[name]; found && (fileInfo.Size() != size || fileInfo.IsDir()) {
+					t.Fatalf("%s: got size %d, want %d", name, fileInfo.Size(), size)
+				}
+				if name == test.skip {
+					return test.skipErr
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// entries are visited in the order of their encrypted names
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Fatalf("got %v, want %v", paths, test.wantPaths)
+			}
+		})
+	}
+}
+
+func TestWalkErrors(t *testing.T) {
+	encFs := newTestWalkFs(t)
+	var gotName string
+	var gotErr error
+	err := encFs.Walk("/missing", func(name string, fileInfo os.FileInfo, err error) error {
+		gotName, gotErr = name, err
+		return err
+	})
+	var pathError *os.PathError
+	if !os.IsNotExist(err) || gotName != "/missing" || !errors.As(gotErr, &pathError) || pathError.Path != "/missing" {
+		t.Fatalf("got %v at %q, want a plaintext not exist error", gotErr, gotName)
+	}
+	// errors of walkFn stop the walk
+	stop := errors.New("stop")
+	count := 0
+	err = encFs.Walk("/", func(name string, fileInfo os.FileInfo, err error) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Fatalf("got %v after %d entries", err, count)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	encFs := newTestWalkFs(t)
+	tests := []struct {
+		pattern   string
+		wantNames []string
+		wantErr   error
+	}{
+		{"/*", []string{"/a.txt", "/dir"}, nil},
+		{"/*.txt", []string{"/a.txt"}, nil},
+		{"/dir/*.txt", []string{"/dir/b.txt"}, nil},
+		{"/dir/?.*", []string{"/dir/b.txt", "/dir/c.jpg"}, nil},
+		{"/*/*/*.txt", []string{"/dir/sub/d.txt"}, nil},
+		{"/dir/sub", []string{"/dir/sub"}, nil},
+		// meta files never match
+		{"/*" + EncFileExt, nil, nil},
+		{"/dir/*" + EncFileExt, nil, nil},
+		{"/missing/*", nil, nil},
+		{"/[", nil, filepath.ErrBadPattern},
+	}
+	for _, test := range tests {
+		names, err := encFs.Glob(test.pattern)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.pattern, err, test.wantErr)
+		}
+		sort.Strings(names)
+		if len(names) != len(test.wantNames) || (len(names) > 0 && !reflect.DeepEqual(names, test.wantNames)) {
+			t.Fatalf("%s: got %v, want %v", test.pattern, names, test.wantNames)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package encfs
+
+// WithWriteBufferSize enables a per handle buffer coalescing small sequential writes, Write after Write or WriteAt
+// after WriteAt at the end of the buffered data, buffered data is written when size bytes are buffered and on Flush,
+// Sync, Close, Seek and any other operation of the handle, write errors of buffered data are returned by the
+// operation flushing it, 0 disables buffering
+func (encFs *EncFs) WithWriteBufferSize(size int) {
+	encFs.writeBufferSize = size
+}
+
+func (encFs *EncFs) getWriteBufferSize() int {
+	return encFs.writeBufferSize
+}
+
+func (f *EncFile) bufferWrite(p []byte, writeBufferSize int) (int, error) {
+	if len(f.writeBuffer) > 0 && (f.writeBufferAt || f.filePos != f.writeBufferOffset+int64(len(f.writeBuffer))) {
+		if err := f.flushWriteBuffer(false); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.writeBuffer) == 0 {
+		f.writeBufferAt = false
+		if f.appendMode {
+			size, err := f.contentSize()
+			if err != nil {
+				return 0, err
+			}
+			f.filePos = size
+		}
+		f.writeBufferOffset = f.filePos
+	}
+	f.writeBuffer = append(f.writeBuffer, p...)
+	f.filePos += int64(len(p))
+	if len(f.writeBuffer) >= writeBufferSize {
+		if err := f.flushWriteBuffer(true); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// bufferWriteAt buffers WriteAt like bufferWrite, the file position does not move
+func (f *EncFile) bufferWriteAt(p []byte, off int64, writeBufferSize int) (int, error) {
+	if len(f.writeBuffer) > 0 && (!f.writeBufferAt || off != f.writeBufferOffset+int64(len(f.writeBuffer))) {
+		if err := f.flushWriteBuffer(false); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.writeBuffer) == 0 {
+		f.writeBufferAt = true
+		f.writeBufferOffset = off
+	}
+	f.writeBuffer = append(f.writeBuffer, p...)
+	if len(f.writeBuffer) >= writeBufferSize {
+		if err := f.flushWriteBuffer(true); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes data buffered by WithWriteBufferSize or streaming writes without syncing it like Sync, chunked
+// files written by streaming keep their last incomplete chunk buffered
+func (f *EncFile) Flush() (err error) {
+	defer f.restorePlainPath(&err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkIsFile(); err != nil {
+		return err
+	}
+	if f.streaming {
+		return f.flushStream(true)
+	}
+	return f.flushWriteBuffer(false)
+}
+
+// flushWriteBuffer writes buffered data, with alignOnly chunked files keep the tail after the last
+// chunk boundary buffered so chunks are written whole instead of rewritten per write
+func (f *EncFile) flushWriteBuffer(alignOnly bool) error {
+	if f.streaming {
+		return f.endStreaming()
+	}
+	if len(f.writeBuffer) == 0 {
+		return nil
+	}
+	if err := f.checkWriteIv("write"); err != nil {
+		// buffered data of a stale handle is dropped like a failed write
+		if !f.writeBufferAt {
+			f.filePos = f.writeBufferOffset
+		}
+		f.writeBuffer = f.writeBuffer[:0]
+		return err
+	}
+	flushLen := int64(len(f.writeBuffer))
+	var writeLen int
+	var err error
+	if f.encFileMeta.isChunked() {
+		if alignOnly {
+			chunkSize := f.encFileMeta.chunkSize()
+			alignedEnd := (f.writeBufferOffset + flushLen) / chunkSize * chunkSize
+			if alignedEnd > f.writeBufferOffset {
+				flushLen = alignedEnd - f.writeBufferOffset
+			}
+		}
+		writeLen, err = f.writeChunkedAt(f.writeBuffer[:flushLen], f.writeBufferOffset)
+	} else if f.writeBufferAt {
+		writeLen, err = f.writeAt(f.writeBuffer[:flushLen], f.writeBufferOffset)
+	} else {
+		// the file position of the underlying file is still at the buffer offset
+		filePos := f.filePos
+		f.filePos = f.writeBufferOffset
+		writeLen, err = f.writeAtFilePos(f.writeBuffer[:flushLen])
+		f.filePos = filePos
+	}
+	f.writeBuffer = append(f.writeBuffer[:0], f.writeBuffer[writeLen:]...)
+	f.writeBufferOffset += int64(writeLen)
+	if err != nil {
+		// buffered data which could not be written is dropped like a failed write
+		if !f.writeBufferAt {
+			f.filePos = f.writeBufferOffset
+		}
+		f.writeBuffer = f.writeBuffer[:0]
+	}
+	return err
+}
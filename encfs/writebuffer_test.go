@@ -0,0 +1,152 @@
+package encfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// writeBufferTestStep is an operation of a handle with a write buffer of 100 bytes, flushed tells whether another
+// EncFs reads all data written so far after it
+type writeBufferTestStep struct {
+	op      string
+	off     int64
+	size    int
+	flushed bool
+}
+
+func TestWriteBuffer(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []writeBufferTestStep
+	}{
+		{"writes", []writeBufferTestStep{{"write", 0, 10, false}, {"write", 0, 10, false}, {"flush", 0, 0, true}}},
+		{"adjacent WriteAt", []writeBufferTestStep{{"writeAt", 5, 10, false}, {"writeAt", 15, 10, false},
+			{"flush", 0, 0, true}}},
+		{"WriteAt elsewhere", []writeBufferTestStep{{"writeAt", 0, 10, false}, {"writeAt", 40, 10, false},
+			{"flush", 0, 0, true}}},
+		{"full buffer", []writeBufferTestStep{{"write", 0, 60, false}, {"write", 0, 60, true}}},
+		{"write larger than the buffer", []writeBufferTestStep{{"write", 0, 250, true}}},
+		{"WriteAt after write", []writeBufferTestStep{{"write", 0, 10, false}, {"writeAt", 10, 10, false},
+			{"write", 0, 5, false}, {"flush", 0, 0, true}}},
+		{"seek", []writeBufferTestStep{{"write", 0, 10, false}, {"seek", 30, 0, true}, {"write", 0, 10, false},
+			{"flush", 0, 0, true}}},
+		{"read", []writeBufferTestStep{{"write", 0, 10, false}, {"read", 0, 5, true}, {"write", 0, 10, false},
+			{"read", 0, 5, true}}},
+		{"ReadAt", []writeBufferTestStep{{"writeAt", 45, 10, false}, {"readAt", 40, 10, true}}},
+		{"sync", []writeBufferTestStep{{"write", 0, 10, false}, {"sync", 0, 0, true}}},
+		{"truncate", []writeBufferTestStep{{"write", 0, 10, false}, {"truncate", 30, 0, true},
+			{"write", 0, 10, false}, {"close", 0, 0, true}}},
+	}
+	for _, cipher := range []string{CIPHER_AES_CTR, CIPHER_AES_GCM} {
+		for _, test := range tests {
+			t.Run(cipher+" "+test.name, func(t *testing.T) {
+				key := NewEncryptionMasterKey(testKeyBytes(1))
+				encFs, base := newTestEncFs(key)
+				if err := encFs.WithContentCipher(cipher); err != nil {
+					t.Fatal(err)
+				}
+				encFs.WithWriteBufferSize(100)
+				want := testPattern(50)
+				writeTestFile(t, encFs, "/file", want)
+				want = append([]byte(nil), want...)
+				other := NewEncFsWithBackend(key, base)
+				f, err := encFs.OpenFile("/file", os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				var filePos int64
+				for i, step := range test.steps {
+					data := testRandomBytes(step.size, int64(i))
+					switch step.op {
+					case "write":
+						if n, err := f.Write(data); err != nil || n != step.size {
+							t.Fatalf("step %d: wrote %d bytes: %v", i, n, err)
+						}
+						want = overwriteTestBytes(want, filePos, data)
+						filePos += int64(step.size)
+					case "writeAt":
+						if n, err := f.WriteAt(data, step.off); err != nil || n != step.size {
+							t.Fatalf("step %d: wrote %d bytes: %v", i, n, err)
+						}
+						want = overwriteTestBytes(want, step.off, data)
+					case "read":
+						n, err := io.ReadFull(f, data)
+						if err != nil || string(data[:n]) != string(want[filePos:filePos+int64(n)]) {
+							t.Fatalf("step %d: read %d bytes: %v", i, n, err)
+						}
+						filePos += int64(n)
+					case "readAt":
+						n, err := f.ReadAt(data, step.off)
+						if err != nil || string(data[:n]) != string(want[step.off:step.off+int64(n)]) {
+							t.Fatalf("step %d: read %d bytes: %v", i, n, err)
+						}
+					case "seek":
+						if _, err := f.Seek(step.off, io.SeekStart); err != nil {
+							t.Fatalf("step %d: %v", i, err)
+						}
+						filePos = step.off
+					case "truncate":
+						if err := f.Truncate(step.off); err != nil {
+							t.Fatalf("step %d: %v", i, err)
+						}
+						want = append(want[:0:0], want[:step.off]...)
+					case "flush":
+						if err := f.(*EncFile).Flush(); err != nil {
+							t.Fatalf("step %d: %v", i, err)
+						}
+					case "sync":
+						if err := f.Sync(); err != nil {
+							t.Fatalf("step %d: %v", i, err)
+						}
+					case "close":
+						if err := f.Close(); err != nil {
+							t.Fatalf("step %d: %v", i, err)
+						}
+					}
+					got, err := afero.ReadFile(other, "/file")
+					if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if flushed := string(got) == string(want); flushed != step.flushed {
+						t.Fatalf("step %d: %s got flushed %t, want %t", i, step.op, flushed, step.flushed)
+					}
+				}
+				checkTestFile(t, encFs, "/file", want)
+			})
+		}
+	}
+}
+
+func TestWriteBufferOfAppends(t *testing.T) {
+	encFs, _ := newTestEncFs(NewEncryptionMasterKey(testKeyBytes(1)))
+	encFs.WithWriteBufferSize(100)
+	writeTestFile(t, encFs, "/file", []byte("start"))
+	f, err := encFs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the end of file is found when buffering starts, appends of another handle meanwhile are kept
+	if _, err := f.Write([]byte(" a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.(*EncFile).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestAppend(t, encFs, "/file", []byte(" b"))
+	if _, err := f.Write([]byte(" c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/file", []byte("start a b c d"))
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package encfs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// getXattr reads attr of path without following symlinks, errNoXattr when path has no such attribute
+func getXattr(path, attr string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		data := make([]byte, size)
+		n, err := unix.Lgetxattr(path, attr, data)
+		if err == unix.ERANGE {
+			// grown meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return data[:n], nil
+	}
+}
+
+// setXattr writes attr of path, with create it fails with EEXIST when path has the attribute already
+func setXattr(path, attr string, data []byte, create bool) error {
+	flags := 0
+	if create {
+		flags = unix.XATTR_CREATE
+	}
+	return xattrError(unix.Lsetxattr(path, attr, data, flags))
+}
+
+func removeXattr(path, attr string) error {
+	return xattrError(unix.Lremovexattr(path, attr))
+}
+
+func xattrError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case unix.ENODATA:
+		return errNoXattr
+	case unix.ENOTSUP, unix.EPERM, unix.E2BIG, unix.ENOSPC:
+		// user attributes are not allowed on symlinks, values above the limit of the filesystem fail with E2BIG or
+		// ENOSPC, a sidecar is written instead which fails again when the filesystem is full
+		return errXattrUnsupported
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package encfs
+
+func getXattr(path, attr string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(path, attr string, data []byte, create bool) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(path, attr string) error {
+	return errXattrUnsupported
+}
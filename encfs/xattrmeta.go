@@ -0,0 +1,306 @@
+package encfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// XATTR_META_NAME is the extended attribute of a data file holding its meta in volumes with XattrMeta
+const XATTR_META_NAME = "user.encfs.meta"
+
+var (
+	errNoXattr          = errors.New("no such extended attribute")
+	errXattrUnsupported = errors.New("extended attributes are not supported")
+)
+
+// xattrMetaFs keeps the meta file of a data file in XATTR_META_NAME of the data file instead of a sidecar, sidecars
+// are used where attributes are not available, e.g. filesystems without user attributes, metas above the size limit
+// of the filesystem and temp metas which have no data file, an attribute takes precedence over a sidecar
+type xattrMetaFs struct {
+	afero.Fs
+	naming *metaFileNaming
+	// realPath returns the os path of a name of Fs
+	realPath func(name string) string
+}
+
+func newXattrMetaFs(base afero.Fs, naming *metaFileNaming, realPath func(name string) string) *xattrMetaFs {
+	return &xattrMetaFs{Fs: base, naming: naming, realPath: realPath}
+}
+
+// isMetaName reports the meta file names and their temp files
+func (fs *xattrMetaFs) isMetaName(name string) bool {
+	_, ok := fs.naming.dataName(name)
+	return ok
+}
+
+// dataName returns the data file name of the meta file name
+func (fs *xattrMetaFs) dataName(name string) string {
+	dataName, _ := fs.naming.dataName(name)
+	return dataName
+}
+
+// readMeta returns the attribute of the data file of the meta file name
+func (fs *xattrMetaFs) readMeta(name string) ([]byte, error) {
+	if !fs.isMetaName(name) {
+		return nil, errNoXattr
+	}
+	return getXattr(fs.realPath(fs.dataName(name)), XATTR_META_NAME)
+}
+
+// setMeta stores data in the attribute of the data file of the meta file name, false when the data file does not
+// exist or does not take it
+func (fs *xattrMetaFs) setMeta(name string, data []byte) (bool, error) {
+	dataName := fs.dataName(name)
+	err := setXattr(fs.realPath(dataName), XATTR_META_NAME, data, false)
+	if errors.Is(err, errXattrUnsupported) || os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "setxattr", Path: dataName, Err: err}
+	}
+	// a sidecar left by a fallback is superseded
+	if err := fs.Fs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, syncBackendPath(fs.Fs, dataName)
+}
+
+// dropMeta removes the attribute of the data file of the meta file name, a stale one would hide the sidecar
+func (fs *xattrMetaFs) dropMeta(name string) error {
+	dataName := fs.dataName(name)
+	err := removeXattr(fs.realPath(dataName), XATTR_META_NAME)
+	if err != nil && !isNoXattrError(err) {
+		return &os.PathError{Op: "removexattr", Path: dataName, Err: err}
+	}
+	return nil
+}
+
+// writeMeta stores data as the meta file name, in a sidecar when the data file does not take it
+func (fs *xattrMetaFs) writeMeta(name string, data []byte) error {
+	if taken, err := fs.setMeta(name, data); taken || err != nil {
+		return err
+	}
+	if err := writeSyncedFile(fs.Fs, name, data); err != nil {
+		return err
+	}
+	return fs.dropMeta(name)
+}
+
+// isNoXattrError reports errors of names which have no attribute, so their sidecar is used
+func isNoXattrError(err error) bool {
+	return errors.Is(err, errNoXattr) || errors.Is(err, errXattrUnsupported) || os.IsNotExist(err)
+}
+
+func (fs *xattrMetaFs) Name() string {
+	return "xattrMetaFs"
+}
+
+func (fs *xattrMetaFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *xattrMetaFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *xattrMetaFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if !fs.isMetaName(name) {
+		return fs.Fs.OpenFile(name, flag, perm)
+	}
+	data, err := fs.readMeta(name)
+	put := func(data []byte) error {
+		return fs.writeMeta(name, data)
+	}
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		return newMemMetaFile(name, data, fs.modTime(name), flag, true, put), nil
+	case errors.Is(err, errNoXattr) && flag&os.O_CREATE != 0:
+		if _, err := fs.Fs.Stat(name); err == nil {
+			// metas written before by the sidecar fallback stay sidecars
+			break
+		}
+		if flag&os.O_EXCL == 0 {
+			return newMemMetaFile(name, nil, time.Now(), flag, true, put), nil
+		}
+		// concurrent creators are told apart by the attribute like by O_EXCL for sidecars
+		realName := fs.realPath(fs.dataName(name))
+		err := setXattr(realName, XATTR_META_NAME, nil, true)
+		if err == nil {
+			return newMemMetaFile(name, nil, time.Now(), flag, false, put), nil
+		}
+		if os.IsExist(err) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if !errors.Is(err, errXattrUnsupported) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	case !isNoXattrError(err):
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+// modTime returns the modification time of the data file of the meta file name
+func (fs *xattrMetaFs) modTime(name string) time.Time {
+	fileInfo, err := fs.Fs.Stat(fs.dataName(name))
+	if err != nil {
+		return time.Now()
+	}
+	return fileInfo.ModTime()
+}
+
+func (fs *xattrMetaFs) Stat(name string) (os.FileInfo, error) {
+	if data, err := fs.readMeta(name); err == nil {
+		return newMemMetaFileInfo(filepath.Base(name), data, fs.modTime(name)), nil
+	}
+	return fs.Fs.Stat(name)
+}
+
+func (fs *xattrMetaFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if data, err := fs.readMeta(name); err == nil {
+		return newMemMetaFileInfo(filepath.Base(name), data, fs.modTime(name)), false, nil
+	}
+	if lstater, ok := fs.Fs.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fileInfo, err := fs.Fs.Stat(name)
+	return fileInfo, false, err
+}
+
+func (fs *xattrMetaFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := fs.Fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+func (fs *xattrMetaFs) ReadlinkIfPossible(name string) (string, error) {
+	if linkReader, ok := fs.Fs.(afero.LinkReader); ok {
+		return linkReader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+func (fs *xattrMetaFs) Remove(name string) error {
+	if fs.isMetaName(name) {
+		dataName := fs.dataName(name)
+		err := removeXattr(fs.realPath(dataName), XATTR_META_NAME)
+		if err == nil {
+			return nil
+		}
+		if !isNoXattrError(err) {
+			return &os.PathError{Op: "remove", Path: name, Err: err}
+		}
+	}
+	return fs.Fs.Remove(name)
+}
+
+func (fs *xattrMetaFs) RemoveAll(path string) error {
+	if fs.isMetaName(path) {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fs.Fs.RemoveAll(path)
+}
+
+// Rename keeps the sidecar semantics, the attribute of a data file moves with it so a meta rename copies the
+// attribute while the renamed data file keeps the meta of newname, with a single atomic rename of the backend
+func (fs *xattrMetaFs) Rename(oldname, newname string) error {
+	if !fs.isMetaName(newname) {
+		if fs.isMetaName(oldname) {
+			return fs.Fs.Rename(oldname, newname)
+		}
+		return fs.renameData(oldname, newname)
+	}
+	data, err := fs.readMeta(oldname)
+	if err == nil {
+		if _, err := fs.Fs.Stat(fs.dataName(newname)); os.IsNotExist(err) {
+			// moved by the rename of the data file which follows
+			return nil
+		}
+		return fs.writeMeta(newname, data)
+	}
+	if !isNoXattrError(err) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	// a sidecar, e.g. a temp meta, moves into the attribute of the data file of newname when it takes it
+	oldFile, err := fs.Fs.Open(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.Unwrap(err)}
+	}
+	data, err = io.ReadAll(oldFile)
+	_ = oldFile.Close()
+	if err != nil {
+		return err
+	}
+	taken, err := fs.setMeta(newname, data)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return fs.Fs.Remove(oldname)
+	}
+	if err := fs.Fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	return fs.dropMeta(newname)
+}
+
+// renameData renames a data file after giving it the attribute of newname, which a sidecar of newname would keep,
+// e.g. a rekeyed temp file renamed over its data file, the attribute of oldname is restored when the rename fails
+func (fs *xattrMetaFs) renameData(oldname, newname string) error {
+	data, err := getXattr(fs.realPath(newname), XATTR_META_NAME)
+	if err != nil {
+		if !isNoXattrError(err) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		return fs.Fs.Rename(oldname, newname)
+	}
+	oldData, oldErr := getXattr(fs.realPath(oldname), XATTR_META_NAME)
+	if oldErr != nil && !isNoXattrError(oldErr) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: oldErr}
+	}
+	if err := setXattr(fs.realPath(oldname), XATTR_META_NAME, data, false); err != nil && !isNoXattrError(err) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if err := fs.Fs.Rename(oldname, newname); err != nil {
+		if oldErr == nil {
+			_ = setXattr(fs.realPath(oldname), XATTR_META_NAME, oldData, false)
+		} else {
+			_ = removeXattr(fs.realPath(oldname), XATTR_META_NAME)
+		}
+		return err
+	}
+	return nil
+}
+
+func (fs *xattrMetaFs) Chmod(name string, mode os.FileMode) error {
+	if _, err := fs.readMeta(name); err == nil {
+		return nil
+	}
+	return fs.Fs.Chmod(name, mode)
+}
+
+func (fs *xattrMetaFs) Chown(name string, uid, gid int) error {
+	if _, err := fs.readMeta(name); err == nil {
+		return nil
+	}
+	return fs.Fs.Chown(name, uid, gid)
+}
+
+func (fs *xattrMetaFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if _, err := fs.readMeta(name); err == nil {
+		return nil
+	}
+	return fs.Fs.Chtimes(name, atime, mtime)
+}
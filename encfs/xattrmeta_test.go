@@ -0,0 +1,210 @@
+package encfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// newTestXattrVolume returns a volume with XattrMeta in a temporary directory, skipping when its filesystem has no
+// user attributes
+func newTestXattrVolume(t *testing.T) (*EncFs, string) {
+	t.Helper()
+	root := t.TempDir()
+	probeName := filepath.Join(root, "probe")
+	if err := os.WriteFile(probeName, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(probeName, XATTR_META_NAME, []byte("probe"), false); err != nil {
+		t.Skipf("no user attributes: %v", err)
+	}
+	if err := os.Remove(probeName); err != nil {
+		t.Fatal(err)
+	}
+	encFs, err := InitVolume(afero.NewOsFs(), root, "passphrase", &VolumeOptions{Kdf: testKdfParams(),
+		NameMode: NAME_MODE_NOOP, XattrMeta: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encFs, root
+}
+
+// xattrTestSidecars returns the meta files and temp metas written as files under root
+func xattrTestSidecars(t *testing.T, root string) []string {
+	t.Helper()
+	var sidecars []string
+	err := filepath.Walk(root, func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil || fileInfo.IsDir() {
+			return err
+		}
+		if isEncFileMetaName(fileInfo.Name()) {
+			sidecars = append(sidecars, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sidecars
+}
+
+func TestXattrMeta(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func(t *testing.T, encFs *EncFs)
+		wantFiles map[string]string
+	}{
+		{"write", func(t *testing.T, encFs *EncFs) {}, map[string]string{"/dir/a": "a", "/b": "b"}},
+		{"rename", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/a", "/a"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/a": "a", "/b": "b"}},
+		// the meta of the renamed file moves with it, the one of the replaced file is dropped
+		{"rename over a file", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir/a", "/b"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/b": "a"}},
+		{"rename directory", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Rename("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/moved/a": "a", "/b": "b"}},
+		// a new IV is written to a temp meta and renamed into the attribute
+		{"truncate", func(t *testing.T, encFs *EncFs) {
+			f, err := encFs.OpenFile("/b", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("truncated")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/dir/a": "a", "/b": "truncated"}},
+		{"O_TRUNC", func(t *testing.T, encFs *EncFs) {
+			writeTestFile(t, encFs, "/b", []byte("new b"))
+		}, map[string]string{"/dir/a": "a", "/b": "new b"}},
+		{"remove", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.Remove("/b"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/dir/a": "a"}},
+		{"remove all", func(t *testing.T, encFs *EncFs) {
+			if err := encFs.RemoveAll("/dir"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"/b": "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, root := newTestXattrVolume(t)
+			if err := encFs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, encFs, "/dir/a", []byte("a"))
+			writeTestFile(t, encFs, "/b", []byte("b"))
+			test.op(t, encFs)
+
+			if sidecars := xattrTestSidecars(t, root); len(sidecars) > 0 {
+				t.Fatalf("got sidecars %q", sidecars)
+			}
+			reopened, err := OpenVolume(afero.NewOsFs(), root, "passphrase")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fs := range []*EncFs{encFs, reopened} {
+				for name, data := range test.wantFiles {
+					checkTestFile(t, fs, name, []byte(data))
+					if _, err := getXattr(filepath.Join(root, name), XATTR_META_NAME); err != nil {
+						t.Fatalf("%s has no meta attribute: %v", name, err)
+					}
+				}
+			}
+			// the attributes are hidden from listings
+			names, err := afero.ReadDir(reopened, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotNames, wantNames []string
+			for _, fileInfo := range names {
+				if !fileInfo.IsDir() {
+					gotNames = append(gotNames, "/"+fileInfo.Name())
+				}
+			}
+			for name := range test.wantFiles {
+				if filepath.Dir(name) == "/" {
+					wantNames = append(wantNames, name)
+				}
+			}
+			sort.Strings(wantNames)
+			if !reflect.DeepEqual(gotNames, wantNames) {
+				t.Fatalf("listed %q, want %q", gotNames, wantNames)
+			}
+		})
+	}
+}
+
+func TestXattrMetaFallback(t *testing.T) {
+	// names missing from the os, like those of a backend which is not the os, use sidecars
+	mem := afero.NewMemMapFs()
+	missingRoot := filepath.Join(t.TempDir(), "missing")
+	xattrFs := newXattrMetaFs(mem, &metaFileNaming{ext: EncFileExt}, func(name string) string {
+		return filepath.Join(missingRoot, name)
+	})
+	encFs := NewEncFsWithBackend(NewEncryptionMasterKey(testKeyBytes(1)), xattrFs).(*EncFs)
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	if err := encFs.Rename("/file", "/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/renamed", []byte("data"))
+	if exists, err := afero.Exists(mem, encFs.encFileMetaName("/renamed")); err != nil || !exists {
+		t.Fatalf("no sidecar: %v", err)
+	}
+	if err := encFs.Remove("/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := snapshotTestFs(t, mem); len(snapshot) != 0 {
+		t.Fatalf("left files %v", snapshot)
+	}
+}
+
+func TestXattrMetaOverSidecar(t *testing.T) {
+	encFs, root := newTestXattrVolume(t)
+	writeTestFile(t, encFs, "/file", []byte("data"))
+	// a sidecar written before the attribute is superseded by it
+	data, err := getXattr(filepath.Join(root, "file"), XATTR_META_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"+EncFileExt), []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/file", []byte("data"))
+	// a sidecar without attribute is used, and moved into the attribute by the next meta write
+	if err := removeXattr(filepath.Join(root, "file"), XATTR_META_NAME); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"+EncFileExt), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encFs, err = OpenVolume(afero.NewOsFs(), root, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, encFs, "/file", []byte("data"))
+	writeTestFile(t, encFs, "/file", []byte("new"))
+	checkTestFile(t, encFs, "/file", []byte("new"))
+	if sidecars := xattrTestSidecars(t, root); len(sidecars) > 0 {
+		t.Fatalf("got sidecars %q", sidecars)
+	}
+}
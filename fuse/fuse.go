@@ -0,0 +1,315 @@
+//go:build linux || darwin || freebsd
+
+// Package fuse serves an afero.Fs like an encfs.EncFs as a go-fuse node tree, so programs not written in Go read and
+// write the decrypted view of a volume through a kernel mount
+//
+//	server, err := fs.Mount(mountPoint, encfsfuse.NewRoot(encFs, nil), &fs.Options{})
+package fuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/spf13/afero"
+)
+
+// open flags passed to the volume, O_APPEND is left out since the kernel sends appends with their offset
+const OPEN_FLAGS_MASK = os.O_RDONLY | os.O_WRONLY | os.O_RDWR | os.O_TRUNC | os.O_EXCL
+
+// Options configure NewRoot, the zero value serves the volume read write
+type Options struct {
+	// ReadOnly refuses all requests changing the volume with EPERM
+	ReadOnly bool
+}
+
+// NewRoot returns the root node of volumeFs to pass to fs.Mount, nodes are looked up by path so the node tree works
+// without a kernel mount too, e.g. through fs.NewNodeFS
+func NewRoot(volumeFs afero.Fs, options *Options) fs.InodeEmbedder {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.ReadOnly {
+		volumeFs = afero.NewReadOnlyFs(volumeFs)
+	}
+	return &encFsNode{encFs: volumeFs}
+}
+
+// encFsNode is a file or directory of the mounted volume, nodes are looked up by path in encFs
+type encFsNode struct {
+	fs.Inode
+	encFs afero.Fs
+}
+
+var (
+	_ fs.NodeLookuper  = (*encFsNode)(nil)
+	_ fs.NodeGetattrer = (*encFsNode)(nil)
+	_ fs.NodeSetattrer = (*encFsNode)(nil)
+	_ fs.NodeReaddirer = (*encFsNode)(nil)
+	_ fs.NodeOpener    = (*encFsNode)(nil)
+	_ fs.NodeCreater   = (*encFsNode)(nil)
+	_ fs.NodeMkdirer   = (*encFsNode)(nil)
+	_ fs.NodeUnlinker  = (*encFsNode)(nil)
+	_ fs.NodeRmdirer   = (*encFsNode)(nil)
+	_ fs.NodeRenamer   = (*encFsNode)(nil)
+)
+
+func (n *encFsNode) name() string {
+	return "/" + n.Path(n.Root())
+}
+
+func (n *encFsNode) childName(name string) string {
+	return path.Join(n.name(), name)
+}
+
+// newChild returns the inode of a child described by fileInfo and fills out with its attributes
+func (n *encFsNode) newChild(ctx context.Context, fileInfo os.FileInfo, out *fuse.EntryOut) *fs.Inode {
+	fillAttr(fileInfo, &out.Attr)
+	child := &encFsNode{encFs: n.encFs}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: fileType(fileInfo.Mode()), Ino: out.Attr.Ino})
+}
+
+func (n *encFsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fileInfo, err := n.encFs.Stat(n.childName(name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fileInfo, out), fs.OK
+}
+
+func (n *encFsNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if handle, ok := f.(*encFsHandle); ok {
+		return handle.Getattr(ctx, out)
+	}
+	fileInfo, err := n.encFs.Stat(n.name())
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(fileInfo, &out.Attr)
+	return fs.OK
+}
+
+func (n *encFsNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	name := n.name()
+	if size, ok := in.GetSize(); ok {
+		if err := n.truncate(f, int64(size)); err != nil {
+			return toErrno(err)
+		}
+	}
+	if mode, ok := in.GetMode(); ok {
+		if err := n.encFs.Chmod(name, os.FileMode(mode).Perm()); err != nil {
+			return toErrno(err)
+		}
+	}
+	mtime, mtimeOk := in.GetMTime()
+	atime, atimeOk := in.GetATime()
+	if mtimeOk || atimeOk {
+		if !mtimeOk || !atimeOk {
+			fileInfo, err := n.encFs.Stat(name)
+			if err != nil {
+				return toErrno(err)
+			}
+			if !mtimeOk {
+				mtime = fileInfo.ModTime()
+			}
+			if !atimeOk {
+				atime = fileInfo.ModTime()
+			}
+		}
+		if err := n.encFs.Chtimes(name, atime, mtime); err != nil {
+			return toErrno(err)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// truncate truncates through the open handle f when there is one, the file is opened for it otherwise
+func (n *encFsNode) truncate(f fs.FileHandle, size int64) error {
+	if handle, ok := f.(*encFsHandle); ok {
+		return handle.file.Truncate(size)
+	}
+	file, err := n.encFs.OpenFile(n.name(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (n *encFsNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	dir, err := n.encFs.Open(n.name())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	defer dir.Close()
+	fileInfos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		entries = append(entries, fuse.DirEntry{Name: fileInfo.Name(), Mode: fileType(fileInfo.Mode())})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *encFsNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	file, err := n.encFs.OpenFile(n.name(), int(flags)&OPEN_FLAGS_MASK, 0)
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+	return &encFsHandle{file: file}, 0, fs.OK
+}
+
+func (n *encFsNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	childName := n.childName(name)
+	file, err := n.encFs.OpenFile(childName, int(flags)&OPEN_FLAGS_MASK|os.O_CREATE, os.FileMode(mode).Perm())
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, 0, toErrno(err)
+	}
+	return n.newChild(ctx, fileInfo, out), &encFsHandle{file: file}, 0, fs.OK
+}
+
+func (n *encFsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	childName := n.childName(name)
+	if err := n.encFs.Mkdir(childName, os.FileMode(mode).Perm()); err != nil {
+		return nil, toErrno(err)
+	}
+	fileInfo, err := n.encFs.Stat(childName)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fileInfo, out), fs.OK
+}
+
+func (n *encFsNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.encFs.Remove(n.childName(name)))
+}
+
+func (n *encFsNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.encFs.Remove(n.childName(name)))
+}
+
+func (n *encFsNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	newParentNode, ok := newParent.(*encFsNode)
+	if !ok || flags != 0 {
+		// RENAME_NOREPLACE and RENAME_EXCHANGE can not be done atomically through afero
+		return syscall.EINVAL
+	}
+	return toErrno(n.encFs.Rename(n.childName(name), newParentNode.childName(newName)))
+}
+
+// encFsHandle is an open file of the mounted volume
+type encFsHandle struct {
+	file afero.File
+}
+
+var (
+	_ fs.FileReader    = (*encFsHandle)(nil)
+	_ fs.FileWriter    = (*encFsHandle)(nil)
+	_ fs.FileGetattrer = (*encFsHandle)(nil)
+	_ fs.FileFlusher   = (*encFsHandle)(nil)
+	_ fs.FileFsyncer   = (*encFsHandle)(nil)
+	_ fs.FileReleaser  = (*encFsHandle)(nil)
+)
+
+func (h *encFsHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, toErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (h *encFsHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := h.file.WriteAt(data, off)
+	return uint32(n), toErrno(err)
+}
+
+func (h *encFsHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fileInfo, err := h.file.Stat()
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(fileInfo, &out.Attr)
+	return fs.OK
+}
+
+// Flush writes data buffered by the handle, e.g. by encfs.EncFs.WithWriteBufferSize, on every close(2)
+func (h *encFsHandle) Flush(ctx context.Context) syscall.Errno {
+	if flusher, ok := h.file.(interface{ Flush() error }); ok {
+		return toErrno(flusher.Flush())
+	}
+	return fs.OK
+}
+
+func (h *encFsHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return toErrno(h.file.Sync())
+}
+
+func (h *encFsHandle) Release(ctx context.Context) syscall.Errno {
+	return toErrno(h.file.Close())
+}
+
+// fillAttr sets attr from fileInfo, access and change times are the modification time, the volume keeps no others
+func fillAttr(fileInfo os.FileInfo, attr *fuse.Attr) {
+	mode := fileInfo.Mode()
+	attr.Mode = fileType(mode) | uint32(mode.Perm())
+	attr.Size = uint64(fileInfo.Size())
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Nlink = 1
+	// inode numbers of the backend are kept across lookups and renames, tools like cp compare them, other backends
+	// get numbers generated by go-fuse
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		attr.Ino = uint64(stat.Ino)
+	}
+	modTime := fileInfo.ModTime()
+	attr.SetTimes(&modTime, &modTime, &modTime)
+	attr.Owner = *fuse.CurrentOwner()
+}
+
+func fileType(mode os.FileMode) uint32 {
+	switch {
+	case mode.IsDir():
+		return syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		return syscall.S_IFLNK
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+// toErrno maps errors of encFs to errno, errors without one like decryption failures are EIO
+func toErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return fs.OK
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, os.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, afero.ErrFileClosed):
+		return syscall.EBADF
+	}
+	return syscall.EIO
+}
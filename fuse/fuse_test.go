@@ -0,0 +1,295 @@
+//go:build linux || darwin || freebsd
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/spf13/afero"
+)
+
+// testRawFs sends requests to the node tree like the kernel would, without mounting it
+type testRawFs struct {
+	t   *testing.T
+	raw fuse.RawFileSystem
+}
+
+// newTestRawFs returns the node tree of an EncFs over a memory backend, with /dir/file and /other
+func newTestRawFs(t *testing.T, options *Options) (*testRawFs, afero.Fs, fs.InodeEmbedder) {
+	t.Helper()
+	key := encfs.NewEncryptionMasterKeyWithFileNameIv(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	encFs := encfs.NewEncFsWithBackend(key, afero.NewMemMapFs())
+	if err := afero.WriteFile(encFs, "/dir/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(encFs, "/other", []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := NewRoot(encFs, options)
+	return &testRawFs{t: t, raw: fs.NewNodeFS(root, &fs.Options{})}, encFs, root
+}
+
+func (r *testRawFs) lookup(parent uint64, name string) (uint64, fuse.Status) {
+	out := &fuse.EntryOut{}
+	status := r.raw.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, out)
+	return out.NodeId, status
+}
+
+// mustLookup looks up a path below the root
+func (r *testRawFs) mustLookup(names ...string) uint64 {
+	r.t.Helper()
+	node := uint64(fuse.FUSE_ROOT_ID)
+	for _, name := range names {
+		var status fuse.Status
+		if node, status = r.lookup(node, name); !status.Ok() {
+			r.t.Fatalf("lookup %s: %v", name, status)
+		}
+	}
+	return node
+}
+
+func (r *testRawFs) open(node uint64, flags int) (uint64, fuse.Status) {
+	out := &fuse.OpenOut{}
+	status := r.raw.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: node}, Flags: uint32(flags)}, out)
+	return out.Fh, status
+}
+
+func (r *testRawFs) release(node, fh uint64) {
+	r.raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: node}, Fh: fh})
+}
+
+func (r *testRawFs) write(node, fh uint64, offset int64, data string) fuse.Status {
+	in := &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: node}, Fh: fh, Offset: uint64(offset), Size: uint32(len(data))}
+	written, status := r.raw.Write(nil, in, []byte(data))
+	if status.Ok() && int(written) != len(data) {
+		r.t.Fatalf("wrote %d bytes, want %d", written, len(data))
+	}
+	return status
+}
+
+// readAll reads a file by a new handle
+func (r *testRawFs) readAll(names ...string) string {
+	r.t.Helper()
+	node := r.mustLookup(names...)
+	fh, status := r.open(node, os.O_RDONLY)
+	if !status.Ok() {
+		r.t.Fatalf("open: %v", status)
+	}
+	defer r.release(node, fh)
+	buf := make([]byte, 1024)
+	in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: node}, Fh: fh, Size: uint32(len(buf))}
+	result, status := r.raw.Read(nil, in, buf)
+	if !status.Ok() {
+		r.t.Fatalf("read: %v", status)
+	}
+	data, status := result.Bytes(buf)
+	if !status.Ok() {
+		r.t.Fatalf("read: %v", status)
+	}
+	return string(data)
+}
+
+func TestNodeRoundTrip(t *testing.T) {
+	root := uint64(fuse.FUSE_ROOT_ID)
+	tests := []struct {
+		name    string
+		options *Options
+		op      func(r *testRawFs) fuse.Status
+		// wantFiles are the files of the volume after op, empty directories end with a separator
+		wantStatus fuse.Status
+		wantFiles  map[string]string
+	}{
+		{"create", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: root}, Flags: uint32(os.O_RDWR), Mode: 0644}
+			out := &fuse.CreateOut{}
+			if status := r.raw.Create(nil, in, "new", out); !status.Ok() {
+				return status
+			}
+			defer r.release(out.NodeId, out.Fh)
+			return r.write(out.NodeId, out.Fh, 0, "new data")
+		}, fuse.OK, map[string]string{"/dir/file": "data", "/other": "other", "/new": "new data"}},
+		// writes land at the offset of the kernel
+		{"write at offset", nil, func(r *testRawFs) fuse.Status {
+			node := r.mustLookup("other")
+			fh, status := r.open(node, os.O_WRONLY|os.O_APPEND)
+			if !status.Ok() {
+				return status
+			}
+			defer r.release(node, fh)
+			return r.write(node, fh, 5, " appended")
+		}, fuse.OK, map[string]string{"/dir/file": "data", "/other": "other appended"}},
+		{"truncate", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+				InHeader: fuse.InHeader{NodeId: r.mustLookup("dir", "file")}, Valid: fuse.FATTR_SIZE, Size: 2}}
+			return r.raw.SetAttr(nil, in, &fuse.AttrOut{})
+		}, fuse.OK, map[string]string{"/dir/file": "da", "/other": "other"}},
+		{"mkdir", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: root}, Mode: 0755}
+			return r.raw.Mkdir(nil, in, "new", &fuse.EntryOut{})
+		}, fuse.OK, map[string]string{"/dir/file": "data", "/other": "other", "/new/": ""}},
+		{"rename", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: r.mustLookup("dir")}, Newdir: root}
+			return r.raw.Rename(nil, in, "file", "renamed")
+		}, fuse.OK, map[string]string{"/dir/": "", "/other": "other", "/renamed": "data"}},
+		{"rename directory", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: root}, Newdir: root}
+			return r.raw.Rename(nil, in, "dir", "moved")
+		}, fuse.OK, map[string]string{"/moved/file": "data", "/other": "other"}},
+		// RENAME_NOREPLACE can not be done atomically
+		{"rename no replace", nil, func(r *testRawFs) fuse.Status {
+			in := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: root}, Newdir: root, Flags: 1}
+			return r.raw.Rename(nil, in, "other", "renamed")
+		}, fuse.EINVAL, map[string]string{"/dir/file": "data", "/other": "other"}},
+		{"unlink", nil, func(r *testRawFs) fuse.Status {
+			return r.raw.Unlink(nil, &fuse.InHeader{NodeId: root}, "other")
+		}, fuse.OK, map[string]string{"/dir/file": "data"}},
+		{"unlink missing", nil, func(r *testRawFs) fuse.Status {
+			return r.raw.Unlink(nil, &fuse.InHeader{NodeId: root}, "missing")
+		}, fuse.ENOENT, map[string]string{"/dir/file": "data", "/other": "other"}},
+		{"rmdir", nil, func(r *testRawFs) fuse.Status {
+			if status := r.raw.Unlink(nil, &fuse.InHeader{NodeId: r.mustLookup("dir")}, "file"); !status.Ok() {
+				return status
+			}
+			return r.raw.Rmdir(nil, &fuse.InHeader{NodeId: root}, "dir")
+		}, fuse.OK, map[string]string{"/other": "other"}},
+		{"lookup missing", nil, func(r *testRawFs) fuse.Status {
+			_, status := r.lookup(root, "missing")
+			return status
+		}, fuse.ENOENT, map[string]string{"/dir/file": "data", "/other": "other"}},
+		{"read only create", &Options{ReadOnly: true}, func(r *testRawFs) fuse.Status {
+			in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: root}, Flags: uint32(os.O_RDWR), Mode: 0644}
+			return r.raw.Create(nil, in, "new", &fuse.CreateOut{})
+		}, fuse.EPERM, map[string]string{"/dir/file": "data", "/other": "other"}},
+		{"read only write", &Options{ReadOnly: true}, func(r *testRawFs) fuse.Status {
+			_, status := r.open(r.mustLookup("other"), os.O_WRONLY)
+			return status
+		}, fuse.EPERM, map[string]string{"/dir/file": "data", "/other": "other"}},
+		{"read only unlink", &Options{ReadOnly: true}, func(r *testRawFs) fuse.Status {
+			return r.raw.Unlink(nil, &fuse.InHeader{NodeId: root}, "other")
+		}, fuse.EPERM, map[string]string{"/dir/file": "data", "/other": "other"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, encFs, _ := newTestRawFs(t, test.options)
+			if status := test.op(r); status != test.wantStatus {
+				t.Fatalf("got %v, want %v", status, test.wantStatus)
+			}
+			files := make(map[string]string)
+			err := afero.Walk(encFs, "/", func(name string, fileInfo os.FileInfo, err error) error {
+				if err != nil || name == "/" {
+					return err
+				}
+				if fileInfo.IsDir() {
+					if entries, err := afero.ReadDir(encFs, name); err != nil || len(entries) > 0 {
+						return err
+					}
+					files[name+"/"] = ""
+					return nil
+				}
+				data, err := afero.ReadFile(encFs, name)
+				files[name] = string(data)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(files, test.wantFiles) {
+				t.Fatalf("got files %q, want %q", files, test.wantFiles)
+			}
+			// reads through the node tree agree
+			for name, data := range test.wantFiles {
+				if name[len(name)-1] == '/' {
+					continue
+				}
+				if got := r.readAll(strings.Split(name[1:], "/")...); got != data {
+					t.Fatalf("%s: got %q, want %q", name, got, data)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeAttributes(t *testing.T) {
+	r, _, root := newTestRawFs(t, nil)
+	tests := []struct {
+		name     string
+		path     []string
+		wantType uint32
+		wantSize uint64
+	}{
+		// sizes are plaintext sizes
+		{"file", []string{"dir", "file"}, syscall.S_IFREG, 4},
+		{"other", []string{"other"}, syscall.S_IFREG, 5},
+		{"dir", []string{"dir"}, syscall.S_IFDIR, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &fuse.AttrOut{}
+			in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: r.mustLookup(test.path...)}}
+			if status := r.raw.GetAttr(nil, in, out); !status.Ok() {
+				t.Fatal(status)
+			}
+			if out.Mode&syscall.S_IFMT != test.wantType || test.wantType == syscall.S_IFREG && out.Size != test.wantSize {
+				t.Fatalf("got mode %o size %d", out.Mode, out.Size)
+			}
+		})
+	}
+
+	// directories list plaintext names
+	listings := []struct {
+		node      *fs.Inode
+		wantNames []string
+	}{
+		{root.EmbeddedInode(), []string{"dir", "other"}},
+		{root.EmbeddedInode().GetChild("dir"), []string{"file"}},
+	}
+	for _, listing := range listings {
+		stream, errno := listing.node.Operations().(fs.NodeReaddirer).Readdir(context.Background())
+		if errno != fs.OK {
+			t.Fatal(errno)
+		}
+		var names []string
+		for stream.HasNext() {
+			entry, errno := stream.Next()
+			if errno != fs.OK {
+				t.Fatal(errno)
+			}
+			names = append(names, entry.Name)
+		}
+		if !reflect.DeepEqual(names, listing.wantNames) {
+			t.Fatalf("got names %q, want %q", names, listing.wantNames)
+		}
+	}
+}
+
+func TestToErrno(t *testing.T) {
+	tests := []struct {
+		err       error
+		wantErrno syscall.Errno
+	}{
+		{nil, fs.OK},
+		{syscall.ENOSPC, syscall.ENOSPC},
+		{&os.PathError{Op: "open", Path: "/a", Err: os.ErrNotExist}, syscall.ENOENT},
+		{os.ErrExist, syscall.EEXIST},
+		{os.ErrPermission, syscall.EACCES},
+		{os.ErrInvalid, syscall.EINVAL},
+		{afero.ErrFileClosed, syscall.EBADF},
+		// decryption failures have no errno
+		{errors.New("message authentication failed"), syscall.EIO},
+	}
+	for _, test := range tests {
+		if errno := toErrno(test.err); errno != test.wantErrno {
+			t.Fatalf("%v: got %v, want %v", test.err, errno, test.wantErrno)
+		}
+	}
+}
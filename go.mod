@@ -1,7 +1,20 @@
 module github.com/jht5945/encfs-afero
 
-go 1.19
+go 1.20
 
-require github.com/spf13/afero v1.11.0
+require (
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/pkg/sftp v1.13.9
+	github.com/psanford/sqlite3vfs v0.0.0-20251127171934-4e34e03a991a
+	github.com/spf13/afero v1.11.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
+)
 
-require golang.org/x/text v0.14.0 // indirect
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
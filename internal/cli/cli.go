@@ -0,0 +1,69 @@
+// Package cli holds what the commands share, reading the passphrase and opening volumes
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/spf13/afero"
+	"golang.org/x/term"
+)
+
+const PASSPHRASE_ENV = "ENCFS_PASSPHRASE"
+
+// ReadPassphrase returns ENCFS_PASSPHRASE when set, the passphrase is prompted on the terminal or read as a line
+// from stdin otherwise
+func ReadPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(PASSPHRASE_ENV); ok {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	defer fmt.Fprintln(os.Stderr)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return string(passphrase), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// OpenVolume opens the volume in volumeDir, with initVolume a missing volume is created with default options
+func OpenVolume(volumeDir, passphrase string, initVolume bool) (*encfs.EncFs, error) {
+	base := afero.NewOsFs()
+	encFs, err := encfs.OpenVolume(base, volumeDir, passphrase)
+	if initVolume && errors.Is(err, os.ErrNotExist) {
+		if err := base.MkdirAll(volumeDir, 0700); err != nil {
+			return nil, err
+		}
+		return encfs.InitVolume(base, volumeDir, passphrase, nil)
+	}
+	return encFs, err
+}
+
+// OpenTree opens the volume in encryptedDir with ReadPassphrase, trees without volume config are opened with the master
+// key in ENCRYPTED_ENCRYPTION_MASTER_KEY decrypted by its key provider, root is the path of the tree in encFs
+func OpenTree(encryptedDir string) (encFs *encfs.EncFs, root string, err error) {
+	if _, err := encfs.ReadVolumeConfig(afero.NewOsFs(), encryptedDir); err == nil {
+		passphrase, err := ReadPassphrase()
+		if err != nil {
+			return nil, "", err
+		}
+		encFs, err := OpenVolume(encryptedDir, passphrase, false)
+		return encFs, "/", err
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+	key, err := encfs.GetEncryptionMasterKey()
+	if err != nil {
+		return nil, "", err
+	}
+	// names of the os backend are absolute paths, existing parts of them are not encrypted
+	return encfs.NewEncFs(key).(*encfs.EncFs), encryptedDir, nil
+}
@@ -0,0 +1,481 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	UNSIGNED_PAYLOAD   = "UNSIGNED-PAYLOAD"
+	EMPTY_PAYLOAD_HASH = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	META_HEADER_PREFIX = "X-Amz-Meta-"
+)
+
+// Error is returned when S3 answers with an error status, Code and Message come from the XML error body
+type Error struct {
+	Op         string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3 %s failed, http status: %d, code: %s, message: %s", e.Op, e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports throttling and server errors as transient errnos so EncFs retries them
+func (e *Error) Is(target error) bool {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable:
+		return target == syscall.EAGAIN
+	case e.StatusCode >= 500:
+		return target == syscall.EIO
+	}
+	return false
+}
+
+type errorResponse struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// request is a signed S3 request of an object key, the bucket when key is empty
+type request struct {
+	op          string
+	method      string
+	key         string
+	query       url.Values
+	header      http.Header
+	body        io.Reader
+	size        int64
+	payloadHash string
+}
+
+func newRequest(op, method, key string) *request {
+	return &request{op: op, method: method, key: key, query: url.Values{}, header: http.Header{}, payloadHash: EMPTY_PAYLOAD_HASH}
+}
+
+// withXml sends data as the signed payload
+func (r *request) withXml(data []byte) *request {
+	hash := sha256.Sum256(data)
+	r.body, r.size, r.payloadHash = bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:])
+	r.header.Set("Content-Type", "application/xml")
+	return r
+}
+
+// withBody streams body unsigned, it is not read twice to be hashed
+func (r *request) withBody(body io.Reader, size int64) *request {
+	r.body, r.size, r.payloadHash = body, size, UNSIGNED_PAYLOAD
+	return r
+}
+
+// do sends r and returns the response of a 2xx status, other statuses are returned as *Error
+func (fs *Fs) do(r *request) (*http.Response, error) {
+	canonicalPath := "/" + uriEncode(r.key, false)
+	host := fs.endpoint.Host
+	if fs.options.PathStyle {
+		canonicalPath = "/" + uriEncode(fs.options.Bucket, false) + canonicalPath
+	} else {
+		host = fs.options.Bucket + "." + host
+	}
+	// endpoints of S3 compatible servers may have a path like http://gateway/s3
+	canonicalPath = strings.TrimSuffix(fs.endpoint.EscapedPath(), "/") + canonicalPath
+	canonicalQuery := canonicalQueryString(r.query)
+	requestUrl := &url.URL{
+		Scheme:   fs.endpoint.Scheme,
+		Host:     host,
+		Path:     unescapePath(canonicalPath),
+		RawPath:  canonicalPath,
+		RawQuery: canonicalQuery,
+	}
+	body := r.body
+	if body == nil || r.size == 0 {
+		body = http.NoBody
+	}
+	httpRequest, err := http.NewRequest(r.method, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.ContentLength = r.size
+	for name, values := range r.header {
+		httpRequest.Header[name] = values
+	}
+	if fs.options.AccessKeyId != "" {
+		fs.sign(httpRequest, canonicalPath, canonicalQuery, r.payloadHash, time.Now())
+	}
+	response, err := fs.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	s3Error := &Error{Op: r.op, StatusCode: response.StatusCode}
+	// HEAD responses have no body, the status tells enough
+	var errorBody errorResponse
+	if data, err := io.ReadAll(io.LimitReader(response.Body, 64<<10)); err == nil && xml.Unmarshal(data, &errorBody) == nil {
+		s3Error.Code, s3Error.Message = errorBody.Code, errorBody.Message
+	}
+	return nil, s3Error
+}
+
+// doXml sends r and decodes the XML response into response, CopyObject and CompleteMultipartUpload report some
+// failures with status 200 and an error body
+func (fs *Fs) doXml(r *request, response interface{}) error {
+	httpResponse, err := fs.do(r)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	data, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	var errorBody errorResponse
+	if xml.Unmarshal(data, &errorBody) == nil && errorBody.XMLName.Local == "Error" {
+		return &Error{Op: r.op, StatusCode: http.StatusInternalServerError, Code: errorBody.Code, Message: errorBody.Message}
+	}
+	if response == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, response)
+}
+
+// sign adds the AWS signature version 4 of the request, host and all x-amz headers are signed
+func (fs *Fs) sign(httpRequest *http.Request, canonicalPath, canonicalQuery, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + fs.options.Region + "/s3/aws4_request"
+	httpRequest.Header.Set("X-Amz-Date", amzDate)
+	httpRequest.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if fs.options.SessionToken != "" {
+		httpRequest.Header.Set("X-Amz-Security-Token", fs.options.SessionToken)
+	}
+
+	headers := map[string]string{"host": httpRequest.URL.Host}
+	for name, values := range httpRequest.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-amz-") || lowerName == "content-type" || lowerName == "range" {
+			trimmedValues := make([]string, len(values))
+			for i, value := range values {
+				trimmedValues[i] = strings.Join(strings.Fields(value), " ")
+			}
+			headers[lowerName] = strings.Join(trimmedValues, ",")
+		}
+	}
+	signedHeaderNames := make([]string, 0, len(headers))
+	for name := range headers {
+		signedHeaderNames = append(signedHeaderNames, name)
+	}
+	sort.Strings(signedHeaderNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaderNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		httpRequest.Method, canonicalPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSha256([]byte("AWS4"+fs.options.SecretAccessKey), amzDate[:8])
+	for _, part := range []string{fs.options.Region, "s3", "aws4_request"} {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	httpRequest.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+fs.options.AccessKeyId+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes all bytes but unreserved characters like signature version 4 requires, slashes are kept
+// unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func unescapePath(escapedPath string) string {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return escapedPath
+	}
+	return path
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// objectInfo is the HEAD response of an object
+type objectInfo struct {
+	size         int64
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+func (fs *Fs) headObject(key string) (*objectInfo, error) {
+	response, err := fs.do(newRequest("head", http.MethodHead, key))
+	if err != nil {
+		return nil, err
+	}
+	_ = response.Body.Close()
+	info := &objectInfo{size: response.ContentLength, metadata: map[string]string{}}
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.lastModified = lastModified
+	}
+	for name, values := range response.Header {
+		if strings.HasPrefix(name, META_HEADER_PREFIX) && len(values) > 0 {
+			info.metadata[strings.ToLower(strings.TrimPrefix(name, META_HEADER_PREFIX))] = values[0]
+		}
+	}
+	return info, nil
+}
+
+// getObject returns n bytes of key from off, or all bytes from off when n is negative
+func (fs *Fs) getObject(key string, off, n int64) (io.ReadCloser, error) {
+	r := newRequest("get", http.MethodGet, key)
+	if n < 0 {
+		r.header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-")
+	} else {
+		r.header.Set("Range", "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(off+n-1, 10))
+	}
+	response, err := fs.do(r)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (fs *Fs) putObject(key string, body io.Reader, size int64, metadata map[string]string) error {
+	r := newRequest("put", http.MethodPut, key).withBody(body, size)
+	setMetadataHeaders(r.header, metadata)
+	response, err := fs.do(r)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// copyObject copies srcKey to dstKey with metadata, or the metadata of srcKey when metadata is nil, objects larger
+// than a single copy allows are copied part by part
+func (fs *Fs) copyObject(srcKey, dstKey string, size int64, metadata map[string]string) error {
+	if size > MAX_COPY_OBJECT_SIZE {
+		if metadata == nil {
+			info, err := fs.headObject(srcKey)
+			if err != nil {
+				return err
+			}
+			metadata = info.metadata
+		}
+		return fs.multipartCopyObject(srcKey, dstKey, size, metadata)
+	}
+	r := newRequest("copy", http.MethodPut, dstKey)
+	r.header.Set("X-Amz-Copy-Source", fs.copySource(srcKey))
+	if metadata != nil {
+		r.header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		setMetadataHeaders(r.header, metadata)
+	}
+	return fs.doXml(r, nil)
+}
+
+func (fs *Fs) copySource(key string) string {
+	return "/" + uriEncode(fs.options.Bucket, false) + "/" + uriEncode(key, false)
+}
+
+func (fs *Fs) deleteObject(key string) error {
+	response, err := fs.do(newRequest("delete", http.MethodDelete, key))
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func setMetadataHeaders(header http.Header, metadata map[string]string) {
+	for name, value := range metadata {
+		header.Set(META_HEADER_PREFIX+name, value)
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects calls fn with every page of keys under prefix, keys below delimiter are grouped into common prefixes
+// unless delimiter is empty, fn returns false to stop
+func (fs *Fs) listObjects(prefix, delimiter string, maxKeys int, fn func(result *listBucketResult) bool) error {
+	continuationToken := ""
+	for {
+		r := newRequest("list", http.MethodGet, "")
+		r.query.Set("list-type", "2")
+		r.query.Set("prefix", prefix)
+		if delimiter != "" {
+			r.query.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			r.query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if continuationToken != "" {
+			r.query.Set("continuation-token", continuationToken)
+		}
+		var result listBucketResult
+		if err := fs.doXml(r, &result); err != nil {
+			return err
+		}
+		if !fn(&result) || !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type copyPartResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// partSize returns the part size of objects of size, parts grow when size needs more than MAX_PARTS parts
+func (fs *Fs) partSize(size int64) int64 {
+	partSize := fs.options.PartSize
+	if minPartSize := (size + MAX_PARTS - 1) / MAX_PARTS; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return partSize
+}
+
+// multipartUpload uploads size bytes of body in parts, the upload is aborted when a part fails so no parts are
+// left billed in the bucket
+func (fs *Fs) multipartUpload(key string, body io.ReaderAt, size int64, metadata map[string]string) error {
+	return fs.multipart(key, metadata, size, func(uploadId string, partNumber int, off, n int64) (string, error) {
+		r := newRequest("upload part", http.MethodPut, key).withBody(io.NewSectionReader(body, off, n), n)
+		r.query.Set("partNumber", strconv.Itoa(partNumber))
+		r.query.Set("uploadId", uploadId)
+		response, err := fs.do(r)
+		if err != nil {
+			return "", err
+		}
+		_ = response.Body.Close()
+		return response.Header.Get("ETag"), nil
+	})
+}
+
+func (fs *Fs) multipartCopyObject(srcKey, dstKey string, size int64, metadata map[string]string) error {
+	return fs.multipart(dstKey, metadata, size, func(uploadId string, partNumber int, off, n int64) (string, error) {
+		r := newRequest("upload part copy", http.MethodPut, dstKey)
+		r.query.Set("partNumber", strconv.Itoa(partNumber))
+		r.query.Set("uploadId", uploadId)
+		r.header.Set("X-Amz-Copy-Source", fs.copySource(srcKey))
+		r.header.Set("X-Amz-Copy-Source-Range", "bytes="+strconv.FormatInt(off, 10)+"-"+strconv.FormatInt(off+n-1, 10))
+		var result copyPartResult
+		if err := fs.doXml(r, &result); err != nil {
+			return "", err
+		}
+		return result.ETag, nil
+	})
+}
+
+func (fs *Fs) multipart(key string, metadata map[string]string, size int64,
+	uploadPart func(uploadId string, partNumber int, off, n int64) (string, error)) (err error) {
+	r := newRequest("create multipart upload", http.MethodPost, key)
+	r.query.Set("uploads", "")
+	setMetadataHeaders(r.header, metadata)
+	var initiateResult initiateMultipartUploadResult
+	if err := fs.doXml(r, &initiateResult); err != nil {
+		return err
+	}
+	uploadId := initiateResult.UploadId
+	defer func() {
+		if err != nil {
+			abortRequest := newRequest("abort multipart upload", http.MethodDelete, key)
+			abortRequest.query.Set("uploadId", uploadId)
+			if response, abortErr := fs.do(abortRequest); abortErr == nil {
+				_ = response.Body.Close()
+			}
+		}
+	}()
+
+	partSize := fs.partSize(size)
+	var complete completeMultipartUpload
+	for off, partNumber := int64(0), 1; off < size; off, partNumber = off+partSize, partNumber+1 {
+		n := partSize
+		if off+n > size {
+			n = size - off
+		}
+		etag, err := uploadPart(uploadId, partNumber, off, n)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: etag})
+	}
+	data, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	completeRequest := newRequest("complete multipart upload", http.MethodPost, key).withXml(data)
+	completeRequest.query.Set("uploadId", uploadId)
+	return fs.doXml(completeRequest, nil)
+}
@@ -0,0 +1,414 @@
+package s3
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// File is a handle of an object or a directory, read only handles read ranges of the object, writable handles
+// work on a temporary copy uploaded by Sync and Close
+type File struct {
+	mutex    sync.Mutex
+	fs       *Fs
+	name     string
+	key      string
+	fileInfo *objectFileInfo
+	closed   bool
+	offset   int64
+
+	// body streams the object from bodyOffset for sequential reads
+	body       io.ReadCloser
+	bodyOffset int64
+
+	spool *os.File
+	flag  int
+	dirty bool
+
+	dirEntries []os.FileInfo
+	dirRead    bool
+}
+
+var _ afero.File = (*File)(nil)
+
+// openSpool opens a writable handle, the object is downloaded first unless it is truncated
+func (fs *Fs) openSpool(name string, flag int, fileInfo *objectFileInfo, truncate bool) (*File, error) {
+	spool, err := os.CreateTemp(fs.options.TempDir, "encfs-s3-")
+	if err != nil {
+		return nil, err
+	}
+	f := &File{fs: fs, name: name, key: fs.key(name), fileInfo: fileInfo, spool: spool, flag: flag, dirty: truncate}
+	if !truncate && fileInfo.size > 0 {
+		body, err := fs.getObject(f.key, 0, -1)
+		if err == nil {
+			_, err = io.Copy(spool, body)
+			_ = body.Close()
+		}
+		if err != nil {
+			f.removeSpool()
+			return nil, pathError("open", name, err)
+		}
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		f.removeSpool()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) removeSpool() {
+	_ = f.spool.Close()
+	_ = os.Remove(f.spool.Name())
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) checkOpen(op string) error {
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	if f.fileInfo.IsDir() {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *File) checkWritable(op string) error {
+	if err := f.checkOpen(op); err != nil {
+		return err
+	}
+	if f.spool == nil {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *File) checkReadable(op string) error {
+	if err := f.checkOpen(op); err != nil {
+		return err
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkReadable("read"); err != nil {
+		return 0, err
+	}
+	if f.spool != nil {
+		return f.spool.Read(p)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.offset >= f.fileInfo.size {
+		return 0, io.EOF
+	}
+	if f.body == nil || f.bodyOffset != f.offset {
+		f.closeBody()
+		body, err := f.fs.getObject(f.key, f.offset, -1)
+		if err != nil {
+			return 0, pathError("read", f.name, err)
+		}
+		f.body, f.bodyOffset = body, f.offset
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOffset += int64(n)
+	if err == io.EOF {
+		f.closeBody()
+		if n > 0 || f.offset >= f.fileInfo.size {
+			return n, nil
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.closeBody()
+		return n, pathError("read", f.name, err)
+	}
+	return n, nil
+}
+
+func (f *File) closeBody() {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+}
+
+// ReadAt reads the range of p with one ranged GET
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkReadable("read"); err != nil {
+		return 0, err
+	}
+	if f.spool != nil {
+		return f.spool.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	if off >= f.fileInfo.size {
+		return 0, io.EOF
+	}
+	readLen := int64(len(p))
+	if off+readLen > f.fileInfo.size {
+		readLen = f.fileInfo.size - off
+	}
+	if readLen == 0 {
+		return 0, nil
+	}
+	body, err := f.fs.getObject(f.key, off, readLen)
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:readLen])
+	if err != nil {
+		return n, pathError("read", f.name, err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.fileInfo.IsDir() {
+		// rewinds the directory listing
+		if offset != 0 || whence != io.SeekStart {
+			return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+		}
+		f.dirEntries, f.dirRead = nil, false
+		return 0, nil
+	}
+	if f.spool != nil {
+		return f.spool.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.fileInfo.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		if _, err := f.spool.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	f.dirty = true
+	return f.spool.Write(p)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkWritable("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.dirty = true
+	return f.spool.WriteAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkWritable("truncate"); err != nil {
+		return err
+	}
+	f.dirty = true
+	return f.spool.Truncate(size)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.spool == nil {
+		return f.fileInfo, nil
+	}
+	spoolInfo, err := f.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileInfo := *f.fileInfo
+	fileInfo.size = spoolInfo.Size()
+	if f.dirty {
+		fileInfo.modTime = spoolInfo.ModTime()
+	}
+	return &fileInfo, nil
+}
+
+// Sync uploads the changes of a writable handle
+func (f *File) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	return f.upload()
+}
+
+func (f *File) upload() error {
+	if f.spool == nil || !f.dirty {
+		return nil
+	}
+	spoolInfo, err := f.spool.Stat()
+	if err != nil {
+		return err
+	}
+	size := spoolInfo.Size()
+	f.fileInfo.modTime = time.Now()
+	if size > f.fs.options.PartSize {
+		err = f.fs.multipartUpload(f.key, f.spool, size, f.fileInfo.metadata())
+	} else {
+		err = f.fs.putObject(f.key, io.NewSectionReader(f.spool, 0, size), size, f.fileInfo.metadata())
+	}
+	if err != nil {
+		return pathError("sync", f.name, err)
+	}
+	f.fileInfo.size, f.dirty = size, false
+	return nil
+}
+
+// Close uploads the changes of a writable handle, the handle is closed even when the upload fails
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	f.closed = true
+	f.closeBody()
+	if f.spool == nil {
+		return nil
+	}
+	err := f.upload()
+	f.removeSpool()
+	return err
+}
+
+// Readdir lists the directory on the first call, files have default modes in listings
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if !f.fileInfo.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.dirRead {
+		dirEntries, err := f.fs.readDir(f.key)
+		if err != nil {
+			return nil, pathError("readdir", f.name, err)
+		}
+		f.dirEntries, f.dirRead = dirEntries, true
+	}
+	if count <= 0 {
+		dirEntries := f.dirEntries
+		f.dirEntries = nil
+		return dirEntries, nil
+	}
+	if len(f.dirEntries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.dirEntries) {
+		count = len(f.dirEntries)
+	}
+	dirEntries := f.dirEntries[:count]
+	f.dirEntries = f.dirEntries[count:]
+	return dirEntries, nil
+}
+
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fileInfos, err := f.Readdir(n)
+	names := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		names[i] = fileInfo.Name()
+	}
+	return names, err
+}
+
+// readDir lists the keys and common prefixes directly below key sorted by name
+func (fs *Fs) readDir(key string) ([]os.FileInfo, error) {
+	prefix := dirPrefix(key)
+	var fileInfos []os.FileInfo
+	var listErr error
+	err := fs.listObjects(prefix, "/", 0, func(result *listBucketResult) bool {
+		for _, content := range result.Contents {
+			if content.Key == prefix {
+				// the marker of the directory itself
+				continue
+			}
+			lastModified, err := time.Parse(time.RFC3339Nano, content.LastModified)
+			if err != nil {
+				listErr = err
+				return false
+			}
+			fileInfos = append(fileInfos, &objectFileInfo{
+				name: strings.TrimPrefix(content.Key, prefix), size: content.Size, mode: 0644, modTime: lastModified,
+			})
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			fileInfos = append(fileInfos, &objectFileInfo{
+				name: path.Base(commonPrefix.Prefix), mode: os.ModeDir | 0755,
+			})
+		}
+		return true
+	})
+	if err == nil {
+		err = listErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].Name() < fileInfos[j].Name()
+	})
+	return fileInfos, nil
+}
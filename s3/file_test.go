@@ -0,0 +1,246 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func testBytes(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestRangedReads(t *testing.T) {
+	fs, fake := newTestFs(t, nil)
+	data := testBytes(1000, 1)
+	if err := afero.WriteFile(fs, "/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tests := []struct {
+		off       int64
+		size      int
+		wantLen   int
+		wantErr   error
+		wantRange string
+	}{
+		{0, 10, 10, nil, "bytes=0-9"},
+		{995, 5, 5, nil, "bytes=995-999"},
+		// reads past the end of file ask for the rest only
+		{990, 20, 10, io.EOF, "bytes=990-999"},
+		{1000, 10, 0, io.EOF, ""},
+		{2000, 10, 0, io.EOF, ""},
+		{5, 0, 0, nil, ""},
+	}
+	for _, test := range tests {
+		buff := make([]byte, test.size)
+		n, err := f.ReadAt(buff, test.off)
+		if n != test.wantLen || err != test.wantErr ||
+			(n > 0 && !bytes.Equal(buff[:n], data[test.off:test.off+int64(n)])) {
+			t.Fatalf("read %d bytes at %d: %v", n, test.off, err)
+		}
+		if gotRanges := fake.takeRanges(); (test.wantRange == "" && len(gotRanges) > 0) ||
+			(test.wantRange != "" && !reflect.DeepEqual(gotRanges, []string{test.wantRange})) {
+			t.Fatalf("read at %d: got ranges %v, want %s", test.off, gotRanges, test.wantRange)
+		}
+	}
+	if _, err := f.ReadAt(make([]byte, 1), -1); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("got %v, want %v", err, os.ErrInvalid)
+	}
+
+	// sequential reads stream one GET, seeks start another
+	buff := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		if _, err := io.ReadFull(f, buff); err != nil || !bytes.Equal(buff, data[i*100:(i+1)*100]) {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, data[990:]) {
+		t.Fatalf("read %d bytes at the end: %v", len(rest), err)
+	}
+	if gotRanges := fake.takeRanges(); !reflect.DeepEqual(gotRanges, []string{"bytes=0-", "bytes=990-"}) {
+		t.Fatalf("got ranges %v", gotRanges)
+	}
+	// read only handles are not writable
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("got %v, want %v", err, syscall.EBADF)
+	}
+}
+
+func TestUploads(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		failParts bool
+		wantPuts  int
+		wantParts int
+	}{
+		{"empty", 0, false, 2, 0},
+		{"single put", MIN_PART_SIZE, false, 2, 0},
+		{"two parts", MIN_PART_SIZE + 1, false, 1, 2},
+		{"three parts", 2*MIN_PART_SIZE + 5, false, 1, 3},
+		// the upload is aborted, the object keeps its contents
+		{"failed part", MIN_PART_SIZE + 1, true, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, fake := newTestFs(t, nil)
+			fake.update(func() { fake.failParts = test.failParts })
+			data := testBytes(test.size, 2)
+			// the object is created empty right away, and uploaded on close
+			f, err := fs.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0640)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			err = f.Close()
+			if (err != nil) != test.failParts {
+				t.Fatalf("got %v, want error %t", err, test.failParts)
+			}
+			if test.failParts && !errors.Is(err, syscall.EIO) {
+				t.Fatalf("got %v, want a transient error", err)
+			}
+			if puts, parts := fake.requestsOf("put"), fake.requestsOf("upload part"); puts != test.wantPuts ||
+				parts != test.wantParts {
+				t.Fatalf("got %d puts and %d parts, want %d and %d", puts, parts, test.wantPuts, test.wantParts)
+			}
+			if test.failParts {
+				uploadCount := 0
+				fake.update(func() { uploadCount = len(fake.uploads) })
+				if fake.requestsOf("abort multipart upload") != 1 || uploadCount != 0 {
+					t.Fatal("the failed upload was not aborted")
+				}
+				data = nil
+			}
+			got, err := afero.ReadFile(fs, "/file")
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes: %v", len(got), err)
+			}
+			fileInfo, err := fs.Stat("/file")
+			if err != nil || fileInfo.Size() != int64(len(data)) || fileInfo.Mode() != 0640 {
+				t.Fatalf("got %v: %v", fileInfo, err)
+			}
+		})
+	}
+}
+
+func TestWritableHandles(t *testing.T) {
+	tests := []struct {
+		name  string
+		flag  int
+		write func(f afero.File) error
+		want  string
+	}{
+		{"write", os.O_RDWR, func(f afero.File) error {
+			_, err := f.Write([]byte("AB"))
+			return err
+		}, "ABcdef"},
+		{"write at", os.O_WRONLY, func(f afero.File) error {
+			_, err := f.WriteAt([]byte("XY"), 4)
+			return err
+		}, "abcdXY"},
+		{"write past the end", os.O_RDWR, func(f afero.File) error {
+			_, err := f.WriteAt([]byte("Z"), 8)
+			return err
+		}, "abcdef\x00\x00Z"},
+		{"append", os.O_WRONLY | os.O_APPEND, func(f afero.File) error {
+			_, err := f.Write([]byte("gh"))
+			return err
+		}, "abcdefgh"},
+		{"truncate", os.O_RDWR, func(f afero.File) error {
+			return f.Truncate(3)
+		}, "abc"},
+		{"O_TRUNC", os.O_RDWR | os.O_TRUNC, func(f afero.File) error {
+			_, err := f.Write([]byte("new"))
+			return err
+		}, "new"},
+		{"unchanged", os.O_RDWR, func(f afero.File) error { return nil }, "abcdef"},
+		{"sync", os.O_RDWR, func(f afero.File) error {
+			if _, err := f.Seek(2, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := f.Write([]byte("C")); err != nil {
+				return err
+			}
+			return f.Sync()
+		}, "abCdef"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, fake := newTestFs(t, nil)
+			if err := afero.WriteFile(fs, "/file", []byte("abcdef"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			puts := fake.requestsOf("put")
+			f, err := fs.OpenFile("/file", test.flag, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.write(f); err != nil {
+				t.Fatal(err)
+			}
+			fileInfo, err := f.Stat()
+			if err != nil || fileInfo.Size() != int64(len(test.want)) {
+				t.Fatalf("got %v: %v", fileInfo, err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != afero.ErrFileClosed {
+				t.Fatalf("got %v, want %v", err, afero.ErrFileClosed)
+			}
+			if data, err := afero.ReadFile(fs, "/file"); err != nil || string(data) != test.want {
+				t.Fatalf("got %q: %v", data, err)
+			}
+			// unchanged handles upload nothing
+			if test.name == "unchanged" && fake.requestsOf("put") != puts {
+				t.Fatal("an unchanged handle uploaded the object")
+			}
+		})
+	}
+	fs, _ := newTestFs(t, nil)
+	f, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("got %v, want exist", err)
+	}
+	f, err = fs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.WriteAt([]byte("x"), 0); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("got %v, want %v", err, os.ErrInvalid)
+	}
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("got %v, want %v", err, syscall.EBADF)
+	}
+}
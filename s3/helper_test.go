@@ -0,0 +1,364 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "bucket"
+
+// fakeS3 is an in-memory bucket serving the path style requests of Fs, every request is recorded by its op
+type fakeS3 struct {
+	mutex    sync.Mutex
+	objects  map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	uploadId int
+	requests []string
+	// ranges holds the Range headers of GETs
+	ranges []string
+	// pageSize limits the keys of list responses, failParts fails part uploads with status 500
+	pageSize  int
+	failParts bool
+}
+
+type fakeObject struct {
+	data         []byte
+	metadata     http.Header
+	lastModified time.Time
+}
+
+type fakeUpload struct {
+	key      string
+	metadata http.Header
+	parts    map[int][]byte
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name           `xml:"ListBucketResult"`
+	Contents              []fakeListContent  `xml:"Contents"`
+	CommonPrefixes        []fakeCommonPrefix `xml:"CommonPrefixes"`
+	IsTruncated           bool               `xml:"IsTruncated"`
+	NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+}
+
+type fakeListContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+}
+
+type fakeCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// newTestFs returns an Fs of a fake bucket with the smallest part size, options changes the other options
+func newTestFs(t *testing.T, options *Options) (*Fs, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: map[string]*fakeObject{}, uploads: map[string]*fakeUpload{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	if options == nil {
+		options = &Options{}
+	}
+	options.Endpoint, options.Bucket, options.PathStyle = server.URL, testBucket, true
+	if options.PartSize == 0 {
+		options.PartSize = MIN_PART_SIZE
+	}
+	options.AccessKeyId, options.SecretAccessKey, options.TempDir = "id", "secret", t.TempDir()
+	fs, err := NewFs(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, fake
+}
+
+// requestsOf returns the recorded requests of op
+func (s *fakeS3) requestsOf(op string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, request := range s.requests {
+		if request == op {
+			count++
+		}
+	}
+	return count
+}
+
+// update changes the bucket while no request is served
+func (s *fakeS3) update(fn func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn()
+}
+
+// takeRanges returns the Range headers of GETs since the last call
+func (s *fakeS3) takeRanges() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ranges := s.ranges
+	s.ranges = nil
+	return ranges
+}
+
+func (s *fakeS3) keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+testBucket), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.requests = append(s.requests, "list")
+		s.list(w, query)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.requests = append(s.requests, strings.ToLower(r.Method))
+		s.get(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, key, query)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.requests = append(s.requests, "copy")
+		source, found := s.objects[s.copySourceKey(r)]
+		if !found {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		metadata := source.metadata
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			metadata = fakeMetadata(r.Header)
+		}
+		s.objects[key] = &fakeObject{data: source.data, metadata: metadata, lastModified: time.Now()}
+		_, _ = io.WriteString(w, "<CopyObjectResult><ETag>\"copy\"</ETag></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		s.requests = append(s.requests, "put")
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = &fakeObject{data: data, metadata: fakeMetadata(r.Header), lastModified: time.Now()}
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.requests = append(s.requests, "create multipart upload")
+		s.uploadId++
+		uploadId := strconv.Itoa(s.uploadId)
+		s.uploads[uploadId] = &fakeUpload{key: key, metadata: fakeMetadata(r.Header), parts: map[int][]byte{}}
+		_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			uploadId)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.requests = append(s.requests, "complete multipart upload")
+		s.completeUpload(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.requests = append(s.requests, "abort multipart upload")
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		s.requests = append(s.requests, "delete")
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) copySourceKey(r *http.Request) string {
+	source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	return strings.TrimPrefix(source, "/"+testBucket+"/")
+}
+
+func (s *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, found := s.objects[key]
+	if !found {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	for name, values := range object.metadata {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Last-Modified", object.lastModified.UTC().Format(http.TimeFormat))
+	data := object.data
+	status := http.StatusOK
+	if rangeValue := r.Header.Get("Range"); rangeValue != "" && r.Method == http.MethodGet {
+		s.ranges = append(s.ranges, rangeValue)
+		start, end, ok := parseFakeRange(rangeValue, int64(len(data)))
+		if !ok {
+			writeFakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		data, status = data[start:end], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+// parseFakeRange returns the bounds of "bytes=start-" and "bytes=start-end" in an object of size
+func parseFakeRange(rangeValue string, size int64) (int64, int64, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(rangeValue, "bytes="), "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || len(bounds) != 2 || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if bounds[1] != "" {
+		last, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+func (s *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	upload, found := s.uploads[query.Get("uploadId")]
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if !found || upload.key != key || err != nil {
+		writeFakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		s.requests = append(s.requests, "upload part copy")
+		source, found := s.objects[s.copySourceKey(r)]
+		if !found {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		start, end, ok := parseFakeRange(r.Header.Get("X-Amz-Copy-Source-Range"), int64(len(source.data)))
+		if !ok {
+			writeFakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		upload.parts[partNumber] = source.data[start:end]
+		_, _ = fmt.Fprintf(w, "<CopyPartResult><ETag>\"%d\"</ETag></CopyPartResult>", partNumber)
+		return
+	}
+	s.requests = append(s.requests, "upload part")
+	if s.failParts {
+		writeFakeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	upload.parts[partNumber] = data
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", partNumber))
+}
+
+func (s *fakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key, uploadId string) {
+	upload, found := s.uploads[uploadId]
+	var complete completeMultipartUpload
+	if !found || upload.key != key || xml.NewDecoder(r.Body).Decode(&complete) != nil {
+		writeFakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var data []byte
+	for i, part := range complete.Parts {
+		partData, found := upload.parts[part.PartNumber]
+		if !found || part.PartNumber != i+1 || part.ETag != fmt.Sprintf("\"%d\"", part.PartNumber) {
+			// like S3, failures of a complete request are errors in a 200 response
+			_, _ = io.WriteString(w, "<Error><Code>InvalidPart</Code><Message>bad part</Message></Error>")
+			return
+		}
+		// parts but the last one are at least MIN_PART_SIZE
+		if i < len(complete.Parts)-1 && len(partData) < MIN_PART_SIZE {
+			_, _ = io.WriteString(w, "<Error><Code>EntityTooSmall</Code><Message>small part</Message></Error>")
+			return
+		}
+		data = append(data, partData...)
+	}
+	s.objects[key] = &fakeObject{data: data, metadata: upload.metadata, lastModified: time.Now()}
+	delete(s.uploads, uploadId)
+	_, _ = io.WriteString(w, "<CompleteMultipartUploadResult><Key>"+key+"</Key></CompleteMultipartUploadResult>")
+}
+
+// list answers ListObjectsV2, the continuation token is the last key or prefix returned
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if value, err := strconv.Atoi(query.Get("max-keys")); err == nil {
+		maxKeys = value
+	}
+	if s.pageSize > 0 && s.pageSize < maxKeys {
+		maxKeys = s.pageSize
+	}
+	entries := map[string]bool{}
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entries[key[:len(prefix)+i+1]] = true
+		} else {
+			entries[key] = false
+		}
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		if name > query.Get("continuation-token") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var result fakeListResult
+	if len(names) > maxKeys {
+		names = names[:maxKeys]
+		result.IsTruncated, result.NextContinuationToken = true, names[maxKeys-1]
+	}
+	for _, name := range names {
+		if entries[name] {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeCommonPrefix{Prefix: name})
+			continue
+		}
+		object := s.objects[name]
+		result.Contents = append(result.Contents, fakeListContent{
+			Key: name, LastModified: object.lastModified.UTC().Format(time.RFC3339Nano), Size: int64(len(object.data)),
+		})
+	}
+	data, _ := xml.Marshal(&result)
+	_, _ = w.Write(data)
+}
+
+func fakeMetadata(header http.Header) http.Header {
+	metadata := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, META_HEADER_PREFIX) {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
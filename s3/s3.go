@@ -0,0 +1,530 @@
+// Package s3 is an afero.Fs of an S3 bucket for EncFs, so encrypted trees live directly in AWS S3, MinIO and other
+// S3 compatible object storage
+//
+//	backend, err := s3.NewFs(&s3.Options{Bucket: "backups", Region: "eu-west-1"})
+//	encFs, err := encfs.InitVolume(backend, "/", passphrase, nil)
+//
+// Requests are signed with signature version 4 by net/http, no SDK is needed. Meta files of EncFs are companion
+// objects next to their contents, directories are "dir/" marker objects and key prefixes, permissions and
+// modification times are user metadata of the objects. Reads are ranged GETs, writes are spooled to a temporary
+// file and uploaded on Sync and Close, in parts when larger than Options.PartSize.
+package s3
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	DEFAULT_REGION       = "us-east-1"
+	DEFAULT_PART_SIZE    = 16 << 20
+	MIN_PART_SIZE        = 5 << 20
+	MAX_PARTS            = 10000
+	MAX_COPY_OBJECT_SIZE = 5 << 30
+
+	ACCESS_KEY_ID_ENV     = "AWS_ACCESS_KEY_ID"
+	SECRET_ACCESS_KEY_ENV = "AWS_SECRET_ACCESS_KEY"
+	SESSION_TOKEN_ENV     = "AWS_SESSION_TOKEN"
+	REGION_ENV            = "AWS_REGION"
+
+	META_MODE  = "mode"
+	META_MTIME = "mtime"
+	META_UID   = "uid"
+	META_GID   = "gid"
+)
+
+var (
+	ErrNoBucket       = errors.New("s3 bucket is required")
+	ErrBadPartSize    = errors.New("s3 part size must be at least 5 MiB")
+	ErrRenameRootDir  = errors.New("s3 root can not be renamed")
+	ErrUnsupportedUrl = errors.New("s3 endpoint must be an http or https URL")
+)
+
+// Options configure NewFs, only Bucket is required
+type Options struct {
+	// Endpoint is like http://127.0.0.1:9000 for MinIO, https://s3.<Region>.amazonaws.com when empty
+	Endpoint string
+	// Region defaults to AWS_REGION or DEFAULT_REGION
+	Region string
+	Bucket string
+	// Prefix roots the file system at a key prefix like "volumes/alice"
+	Prefix string
+	// PathStyle sends the bucket in the path instead of the host name, MinIO and most self hosted servers need it
+	PathStyle bool
+	// AccessKeyId, SecretAccessKey and SessionToken default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN, requests are not signed without an access key for public buckets
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// PartSize is the size of multipart upload parts, DEFAULT_PART_SIZE when 0
+	PartSize int64
+	// TempDir holds files being written until they are uploaded, os.TempDir() when empty
+	TempDir string
+	Client  *http.Client
+}
+
+// Fs is an afero.Fs of a bucket, changes of a file are visible to other handles once it is synced or closed
+type Fs struct {
+	options  Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+var _ afero.Fs = (*Fs)(nil)
+
+// NewFs returns the file system of options.Bucket, the bucket is not contacted until the first operation
+func NewFs(options *Options) (*Fs, error) {
+	fs := &Fs{options: *options}
+	if fs.options.Bucket == "" {
+		return nil, ErrNoBucket
+	}
+	if fs.options.Region == "" {
+		fs.options.Region = os.Getenv(REGION_ENV)
+	}
+	if fs.options.Region == "" {
+		fs.options.Region = DEFAULT_REGION
+	}
+	if fs.options.AccessKeyId == "" {
+		fs.options.AccessKeyId = os.Getenv(ACCESS_KEY_ID_ENV)
+		fs.options.SecretAccessKey = os.Getenv(SECRET_ACCESS_KEY_ENV)
+		fs.options.SessionToken = os.Getenv(SESSION_TOKEN_ENV)
+	}
+	if fs.options.PartSize == 0 {
+		fs.options.PartSize = DEFAULT_PART_SIZE
+	}
+	if fs.options.PartSize < MIN_PART_SIZE {
+		return nil, ErrBadPartSize
+	}
+	fs.options.Prefix = strings.Trim(fs.options.Prefix, "/")
+	endpoint := fs.options.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + fs.options.Region + ".amazonaws.com"
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https") || endpointUrl.Host == "" {
+		return nil, ErrUnsupportedUrl
+	}
+	fs.endpoint = endpointUrl
+	fs.client = fs.options.Client
+	if fs.client == nil {
+		fs.client = http.DefaultClient
+	}
+	return fs, nil
+}
+
+func (fs *Fs) Name() string {
+	return "s3"
+}
+
+// key returns the object key of name, the key of the root is the prefix
+func (fs *Fs) key(name string) string {
+	return strings.TrimPrefix(path.Join(fs.options.Prefix, path.Clean("/"+name)), "/")
+}
+
+// dirPrefix returns the prefix of the keys in the directory of key
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (fs *Fs) isRoot(key string) bool {
+	return key == fs.options.Prefix
+}
+
+// stat returns the file info of name, directories without marker objects exist while they have keys below them
+func (fs *Fs) stat(op, name string) (*objectFileInfo, error) {
+	key := fs.key(name)
+	if fs.isRoot(key) {
+		return &objectFileInfo{name: path.Base(path.Clean("/" + name)), mode: os.ModeDir | 0755}, nil
+	}
+	info, err := fs.headObject(key)
+	if err == nil {
+		return newFileInfo(path.Base(key), info, false), nil
+	}
+	if !isNotFound(err) {
+		return nil, pathError(op, name, err)
+	}
+	found, isMarker := false, false
+	err = fs.listObjects(dirPrefix(key), "/", 1, func(result *listBucketResult) bool {
+		for _, content := range result.Contents {
+			found, isMarker = true, content.Key == dirPrefix(key)
+		}
+		found = found || len(result.CommonPrefixes) > 0
+		return false
+	})
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	if !found {
+		return nil, pathError(op, name, os.ErrNotExist)
+	}
+	if isMarker {
+		if info, err := fs.headObject(dirPrefix(key)); err == nil {
+			return newFileInfo(path.Base(key), info, true), nil
+		}
+	}
+	return &objectFileInfo{name: path.Base(key), mode: os.ModeDir | 0755}, nil
+}
+
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	fileInfo, err := fs.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo, nil
+}
+
+// checkParentDir fails with ErrNotExist when the parent of name is missing, S3 would create the object anyway
+func (fs *Fs) checkParentDir(op, name string) error {
+	parentName := path.Dir(path.Clean("/" + name))
+	if parentName == "/" {
+		return nil
+	}
+	parentInfo, err := fs.stat(op, parentName)
+	if err != nil {
+		return pathError(op, name, os.ErrNotExist)
+	}
+	if !parentInfo.IsDir() {
+		return pathError(op, name, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	if _, err := fs.stat("mkdir", name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.checkParentDir("mkdir", name); err != nil {
+		return err
+	}
+	return fs.putDirMarker("mkdir", name, perm)
+}
+
+func (fs *Fs) putDirMarker(op, name string, perm os.FileMode) error {
+	metadata := map[string]string{
+		META_MODE:  strconv.FormatUint(uint64(os.ModeDir|perm.Perm()), 10),
+		META_MTIME: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if err := fs.putObject(dirPrefix(fs.key(name)), nil, 0, metadata); err != nil {
+		return pathError(op, name, err)
+	}
+	return nil
+}
+
+func (fs *Fs) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	fileInfo, err := fs.stat("mkdir", name)
+	if err == nil {
+		if !fileInfo.IsDir() {
+			return pathError("mkdir", name, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.MkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+	return fs.putDirMarker("mkdir", name, perm)
+}
+
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens directories and files for reading without downloading them, files opened for writing are
+// downloaded into a temporary file unless they are truncated, new files are created empty right away
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	fileInfo, err := fs.stat("open", name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, pathError("open", name, os.ErrExist)
+		}
+		if fileInfo.IsDir() {
+			if writable {
+				return nil, pathError("open", name, syscall.EISDIR)
+			}
+			return &File{fs: fs, name: name, key: fs.key(name), fileInfo: fileInfo}, nil
+		}
+		if !writable {
+			return &File{fs: fs, name: name, key: fs.key(name), fileInfo: fileInfo}, nil
+		}
+		return fs.openSpool(name, flag, fileInfo, flag&os.O_TRUNC != 0)
+	}
+	if flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+	if err := fs.checkParentDir("open", name); err != nil {
+		return nil, err
+	}
+	fileInfo = &objectFileInfo{name: path.Base(fs.key(name)), mode: perm.Perm(), modTime: time.Now()}
+	if err := fs.putObject(fs.key(name), nil, 0, fileInfo.metadata()); err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if !writable {
+		return &File{fs: fs, name: name, key: fs.key(name), fileInfo: fileInfo}, nil
+	}
+	return fs.openSpool(name, flag, fileInfo, false)
+}
+
+func (fs *Fs) Remove(name string) error {
+	key := fs.key(name)
+	fileInfo, err := fs.stat("remove", name)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		if err := fs.deleteObject(key); err != nil {
+			return pathError("remove", name, err)
+		}
+		return nil
+	}
+	if fs.isRoot(key) {
+		return pathError("remove", name, os.ErrPermission)
+	}
+	empty := true
+	err = fs.listObjects(dirPrefix(key), "", 2, func(result *listBucketResult) bool {
+		for _, content := range result.Contents {
+			empty = empty && content.Key == dirPrefix(key)
+		}
+		return false
+	})
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	if !empty {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	if err := fs.deleteObject(dirPrefix(key)); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll deletes name and every key below it, the root keeps existing as the prefix
+func (fs *Fs) RemoveAll(name string) error {
+	key := fs.key(name)
+	var keys []string
+	err := fs.listObjects(dirPrefix(key), "", 0, func(result *listBucketResult) bool {
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return pathError("removeall", name, err)
+	}
+	if !fs.isRoot(key) {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		// deleting a missing key succeeds
+		if err := fs.deleteObject(key); err != nil {
+			return pathError("removeall", name, err)
+		}
+	}
+	return nil
+}
+
+// Rename copies and deletes objects since S3 has no rename, renaming a directory copies every key below it and is
+// not atomic, an interrupted rename leaves keys under both names
+func (fs *Fs) Rename(oldname, newname string) error {
+	oldKey, newKey := fs.key(oldname), fs.key(newname)
+	if fs.isRoot(oldKey) || fs.isRoot(newKey) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrRenameRootDir}
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	oldInfo, err := fs.stat("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkParentDir("rename", newname); err != nil {
+		return err
+	}
+	if newInfo, err := fs.stat("rename", newname); err == nil {
+		if newInfo.IsDir() != oldInfo.IsDir() || newInfo.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if !oldInfo.IsDir() {
+		if err := fs.copyObject(oldKey, newKey, oldInfo.size, nil); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		if err := fs.deleteObject(oldKey); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		return nil
+	}
+	if strings.HasPrefix(newKey, dirPrefix(oldKey)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrInvalid}
+	}
+	type object struct {
+		key  string
+		size int64
+	}
+	var objects []object
+	err = fs.listObjects(dirPrefix(oldKey), "", 0, func(result *listBucketResult) bool {
+		for _, content := range result.Contents {
+			objects = append(objects, object{key: content.Key, size: content.Size})
+		}
+		return true
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	// keys are copied in order and deleted afterwards, the contents are complete under the new name first
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].key < objects[j].key
+	})
+	for _, object := range objects {
+		err := fs.copyObject(object.key, dirPrefix(newKey)+strings.TrimPrefix(object.key, dirPrefix(oldKey)), object.size, nil)
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	for _, object := range objects {
+		if err := fs.deleteObject(object.key); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.updateMetadata("chmod", name, func(fileInfo *objectFileInfo) {
+		fileInfo.mode = fileInfo.mode&^os.ModePerm | mode.Perm()
+	})
+}
+
+func (fs *Fs) Chown(name string, uid, gid int) error {
+	return fs.updateMetadata("chown", name, func(fileInfo *objectFileInfo) {
+		fileInfo.uid, fileInfo.gid = strconv.Itoa(uid), strconv.Itoa(gid)
+	})
+}
+
+// Chtimes stores the modification time, S3 keeps no access times
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.updateMetadata("chtimes", name, func(fileInfo *objectFileInfo) {
+		fileInfo.modTime = mtime
+	})
+}
+
+// updateMetadata copies the object onto itself with the updated metadata, directories without a marker get one
+func (fs *Fs) updateMetadata(op, name string, update func(fileInfo *objectFileInfo)) error {
+	key := fs.key(name)
+	fileInfo, err := fs.stat(op, name)
+	if err != nil {
+		return err
+	}
+	if fs.isRoot(key) {
+		return nil
+	}
+	update(fileInfo)
+	if fileInfo.IsDir() {
+		if err := fs.putObject(dirPrefix(key), nil, 0, fileInfo.metadata()); err != nil {
+			return pathError(op, name, err)
+		}
+		return nil
+	}
+	if err := fs.copyObject(key, key, fileInfo.size, fileInfo.metadata()); err != nil {
+		return pathError(op, name, err)
+	}
+	return nil
+}
+
+// objectFileInfo is built from HEAD responses, listings carry no metadata so their modes are defaults and their
+// modification times are the last upload
+type objectFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	uid     string
+	gid     string
+}
+
+func newFileInfo(name string, info *objectInfo, isDir bool) *objectFileInfo {
+	fileInfo := &objectFileInfo{name: name, size: info.size, mode: 0644, modTime: info.lastModified}
+	if isDir {
+		fileInfo.size, fileInfo.mode = 0, os.ModeDir|0755
+	}
+	if mode, err := strconv.ParseUint(info.metadata[META_MODE], 10, 32); err == nil {
+		fileInfo.mode = os.FileMode(mode)
+	}
+	if mtime, err := strconv.ParseInt(info.metadata[META_MTIME], 10, 64); err == nil {
+		fileInfo.modTime = time.Unix(0, mtime)
+	}
+	fileInfo.uid, fileInfo.gid = info.metadata[META_UID], info.metadata[META_GID]
+	return fileInfo
+}
+
+func (fi *objectFileInfo) metadata() map[string]string {
+	metadata := map[string]string{
+		META_MODE:  strconv.FormatUint(uint64(fi.mode), 10),
+		META_MTIME: strconv.FormatInt(fi.modTime.UnixNano(), 10),
+	}
+	if fi.uid != "" {
+		metadata[META_UID], metadata[META_GID] = fi.uid, fi.gid
+	}
+	return metadata
+}
+
+func (fi *objectFileInfo) Name() string       { return fi.name }
+func (fi *objectFileInfo) Size() int64        { return fi.size }
+func (fi *objectFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *objectFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *objectFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *objectFileInfo) Sys() interface{}   { return nil }
+
+func isNotFound(err error) bool {
+	var s3Error *Error
+	return errors.As(err, &s3Error) && s3Error.StatusCode == http.StatusNotFound
+}
+
+// pathError maps missing keys and denied requests to the errors of os so os.IsNotExist and os.IsPermission work
+func pathError(op, name string, err error) error {
+	var s3Error *Error
+	if errors.As(err, &s3Error) {
+		switch s3Error.StatusCode {
+		case http.StatusNotFound:
+			err = os.ErrNotExist
+		case http.StatusForbidden:
+			err = os.ErrPermission
+		}
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
@@ -0,0 +1,349 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/spf13/afero"
+)
+
+func TestNewFs(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      Options
+		wantErr      error
+		wantEndpoint string
+		wantPrefix   string
+	}{
+		{"defaults", Options{Bucket: "b", Region: "eu-west-1", AccessKeyId: "id"}, nil,
+			"https://s3.eu-west-1.amazonaws.com", ""},
+		{"endpoint", Options{Bucket: "b", Endpoint: "http://127.0.0.1:9000/s3", AccessKeyId: "id"}, nil,
+			"http://127.0.0.1:9000/s3", ""},
+		{"prefix", Options{Bucket: "b", Prefix: "/volumes/a/", AccessKeyId: "id"}, nil,
+			"https://s3.us-east-1.amazonaws.com", "volumes/a"},
+		{"no bucket", Options{AccessKeyId: "id"}, ErrNoBucket, "", ""},
+		{"small parts", Options{Bucket: "b", PartSize: MIN_PART_SIZE - 1, AccessKeyId: "id"}, ErrBadPartSize, "", ""},
+		{"other scheme", Options{Bucket: "b", Endpoint: "ftp://host", AccessKeyId: "id"}, ErrUnsupportedUrl, "", ""},
+		{"no host", Options{Bucket: "b", Endpoint: "http://", AccessKeyId: "id"}, ErrUnsupportedUrl, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, err := NewFs(&test.options)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if fs.endpoint.String() != test.wantEndpoint || fs.options.Prefix != test.wantPrefix {
+				t.Fatalf("got endpoint %s and prefix %q", fs.endpoint, fs.options.Prefix)
+			}
+			if fs.options.PartSize != DEFAULT_PART_SIZE || fs.options.Region == "" {
+				t.Fatalf("got part size %d and region %q", fs.options.PartSize, fs.options.Region)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   string
+		want   string
+	}{
+		{"", "/", ""},
+		{"", "/a/b", "a/b"},
+		{"", "a/../b/", "b"},
+		{"volumes", "/", "volumes"},
+		{"volumes", "/a", "volumes/a"},
+		// names never leave the prefix
+		{"volumes", "/../a", "volumes/a"},
+	}
+	for _, test := range tests {
+		fs := &Fs{options: Options{Prefix: test.prefix}}
+		if got := fs.key(test.name); got != test.want {
+			t.Fatalf("key(%q) with prefix %q = %q, want %q", test.name, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantTransient error
+		wantPathErr   error
+	}{
+		{http.StatusNotFound, nil, os.ErrNotExist},
+		{http.StatusForbidden, nil, os.ErrPermission},
+		{http.StatusTooManyRequests, syscall.EAGAIN, nil},
+		{http.StatusServiceUnavailable, syscall.EAGAIN, nil},
+		{http.StatusInternalServerError, syscall.EIO, nil},
+		{http.StatusBadRequest, nil, nil},
+	}
+	for _, test := range tests {
+		s3Error := &Error{Op: "get", StatusCode: test.status, Code: "Code"}
+		for _, transient := range []error{syscall.EAGAIN, syscall.EIO} {
+			if errors.Is(s3Error, transient) != (transient == test.wantTransient) {
+				t.Fatalf("status %d: errors.Is(%v) = %t", test.status, transient, errors.Is(s3Error, transient))
+			}
+		}
+		err := pathError("open", "/a", s3Error)
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) || pathErr.Path != "/a" {
+			t.Fatalf("status %d: got %v", test.status, err)
+		}
+		if test.wantPathErr != nil && !errors.Is(err, test.wantPathErr) {
+			t.Fatalf("status %d: got %v, want %v", test.status, err, test.wantPathErr)
+		}
+		if test.wantPathErr == nil && !errors.Is(err, s3Error) {
+			t.Fatalf("status %d: got %v, want the S3 error", test.status, err)
+		}
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	fs, fake := newTestFs(t, &Options{Prefix: "volume"})
+	if err := fs.MkdirAll("/a/b", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/a/file", []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// a directory without a marker exists while keys are below it
+	fake.update(func() {
+		fake.objects["volume/implicit/file"] = &fakeObject{data: []byte("x"), lastModified: time.Now()}
+	})
+	tests := []struct {
+		name     string
+		wantDir  bool
+		wantMode os.FileMode
+		wantErr  error
+	}{
+		{"/", true, os.ModeDir | 0755, nil},
+		{"/a", true, os.ModeDir | 0750, nil},
+		{"/a/b", true, os.ModeDir | 0750, nil},
+		{"/a/file", false, 0640, nil},
+		{"/implicit", true, os.ModeDir | 0755, nil},
+		{"/missing", false, 0, os.ErrNotExist},
+		{"/a/fil", false, 0, os.ErrNotExist},
+	}
+	for _, test := range tests {
+		fileInfo, err := fs.Stat(test.name)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if err == nil && (fileInfo.IsDir() != test.wantDir || fileInfo.Mode() != test.wantMode) {
+			t.Fatalf("%s: got mode %v", test.name, fileInfo.Mode())
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		op      func() error
+		wantErr error
+	}{
+		{"mkdir of an existing directory", func() error { return fs.Mkdir("/a", 0755) }, os.ErrExist},
+		{"mkdir without parent", func() error { return fs.Mkdir("/missing/dir", 0755) }, os.ErrNotExist},
+		{"mkdir below a file", func() error { return fs.Mkdir("/a/file/dir", 0755) }, syscall.ENOTDIR},
+		{"mkdirall below a file", func() error { return fs.MkdirAll("/a/file/dir", 0755) }, syscall.ENOTDIR},
+		{"create without parent", func() error {
+			_, err := fs.Create("/missing/file")
+			return err
+		}, os.ErrNotExist},
+		{"open a directory for writing", func() error {
+			_, err := fs.OpenFile("/a", os.O_RDWR, 0)
+			return err
+		}, syscall.EISDIR},
+		{"remove a directory which is not empty", func() error { return fs.Remove("/a") }, syscall.ENOTEMPTY},
+		{"remove the root", func() error { return fs.Remove("/") }, os.ErrPermission},
+	} {
+		if err := test.op(); !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+
+	// listings page through the keys
+	fake.update(func() { fake.pageSize = 1 })
+	f, err := fs.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := f.Readdirnames(-1)
+	_ = f.Close()
+	if err != nil || !reflect.DeepEqual(names, []string{"b", "file"}) {
+		t.Fatalf("listed %v: %v", names, err)
+	}
+	if err := fs.Remove("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.keys(); !reflect.DeepEqual(keys, []string{"volume/implicit/file"}) {
+		t.Fatalf("left keys %v", keys)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldname  string
+		newname  string
+		wantErr  error
+		wantKeys []string
+	}{
+		{"file", "/dir/a", "/b", nil, []string{"b", "dir/", "dir/sub/", "dir/sub/c", "other/"}},
+		{"over a file", "/dir/a", "/dir/sub/c", nil, []string{"dir/", "dir/sub/", "dir/sub/c", "other/"}},
+		{"directory", "/dir", "/new", nil, []string{"new/", "new/a", "new/sub/", "new/sub/c", "other/"}},
+		{"same name", "/dir/a", "/dir/a", nil, []string{"dir/", "dir/a", "dir/sub/", "dir/sub/c", "other/"}},
+		{"over a directory", "/dir", "/other", os.ErrExist, nil},
+		{"file over a directory", "/dir/a", "/other", os.ErrExist, nil},
+		{"into itself", "/dir", "/dir/sub/dir", os.ErrInvalid, nil},
+		{"missing", "/missing", "/b", os.ErrNotExist, nil},
+		{"without parent", "/dir/a", "/missing/b", os.ErrNotExist, nil},
+		{"root", "/", "/b", ErrRenameRootDir, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, fake := newTestFs(t, nil)
+			if err := fs.MkdirAll("/dir/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Mkdir("/other", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(fs, "/dir/a", []byte("a"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(fs, "/dir/sub/c", []byte("c"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := fs.Rename(test.oldname, test.newname)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if keys := fake.keys(); !reflect.DeepEqual(keys, test.wantKeys) {
+				t.Fatalf("got keys %v, want %v", keys, test.wantKeys)
+			}
+			// renamed files keep their contents and modes
+			fileInfo, err := fs.Stat(test.newname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fileInfo.IsDir() {
+				data, err := afero.ReadFile(fs, test.newname)
+				if err != nil || string(data) != "a" || fileInfo.Mode() != 0600 {
+					t.Fatalf("got %q and mode %v: %v", data, fileInfo.Mode(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	fs, fake := newTestFs(t, nil)
+	if err := afero.WriteFile(fs, "/file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name     string
+		update   func(name string) error
+		wantMode os.FileMode
+		wantTime time.Time
+	}{
+		{"/file", func(name string) error { return fs.Chmod(name, 0640) }, 0640, time.Time{}},
+		{"/file", func(name string) error { return fs.Chtimes(name, modTime, modTime) }, 0640, modTime},
+		{"/dir", func(name string) error { return fs.Chmod(name, 0700) }, os.ModeDir | 0700, time.Time{}},
+		{"/dir", func(name string) error { return fs.Chtimes(name, modTime, modTime) }, os.ModeDir | 0700, modTime},
+		{"/", func(name string) error { return fs.Chmod(name, 0700) }, os.ModeDir | 0755, time.Time{}},
+	}
+	for _, test := range tests {
+		if err := test.update(test.name); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		fileInfo, err := fs.Stat(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Mode() != test.wantMode || (!test.wantTime.IsZero() && !fileInfo.ModTime().Equal(test.wantTime)) {
+			t.Fatalf("%s: got mode %v and time %v", test.name, fileInfo.Mode(), fileInfo.ModTime())
+		}
+	}
+	if err := fs.Chown("/file", 1000, 1001); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := fs.stat("stat", "/file")
+	if err != nil || fileInfo.uid != "1000" || fileInfo.gid != "1001" {
+		t.Fatalf("got owner %s:%s: %v", fileInfo.uid, fileInfo.gid, err)
+	}
+	// metadata updates copy objects onto themselves
+	if data, err := afero.ReadFile(fs, "/file"); err != nil || string(data) != "data" {
+		t.Fatalf("got %q: %v", data, err)
+	}
+	if fake.requestsOf("copy") != 3 {
+		t.Fatalf("got %d copies", fake.requestsOf("copy"))
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	fs, _ := newTestFs(t, nil)
+	fs.options.AccessKeyId = "other"
+	if _, err := fs.Stat("/file"); !os.IsPermission(err) {
+		t.Fatalf("got %v, want a permission error", err)
+	}
+}
+
+func TestEncFsVolume(t *testing.T) {
+	fs, fake := newTestFs(t, &Options{Prefix: "volumes"})
+	kdf := &encfs.KdfParams{Algorithm: encfs.KDF_SCRYPT, N: 1024, R: 8, P: 1}
+	encFs, err := encfs.InitVolume(fs, "/a", "passphrase", &encfs.VolumeOptions{Kdf: kdf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encFs.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := testBytes(100000, 3)
+	if err := afero.WriteFile(encFs, "/dir/plainname", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := encFs.Rename("/dir/plainname", "/dir/othername"); err != nil {
+		t.Fatal(err)
+	}
+	// the volume is opened again with its passphrase, names and contents stay encrypted in the bucket
+	encFs, err = encfs.OpenVolume(fs, "/a", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := afero.ReadFile(encFs, "/dir/othername"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	for _, key := range fake.keys() {
+		if !strings.HasPrefix(key, "volumes/a/") || strings.Contains(key, "plainname") ||
+			strings.Contains(key, "othername") {
+			t.Fatalf("got key %s", key)
+		}
+	}
+	fake.update(func() {
+		for _, object := range fake.objects {
+			if bytes.Contains(object.data, data[:100]) {
+				t.Fatal("an object holds plaintext")
+			}
+		}
+	})
+}
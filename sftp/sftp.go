@@ -0,0 +1,258 @@
+// Package sftp serves an afero.Fs like an encfs.EncFs with the request server of github.com/pkg/sftp, so an SSH
+// server serves the decrypted view of a volume without mounting it
+//
+//	server := sftp.NewRequestServer(channel, encfssftp.NewHandlers(encFs, nil))
+//	err := server.Serve()
+package sftp
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+// Options configure NewHandlers, the zero value serves the volume read write
+type Options struct {
+	// ReadOnly refuses all requests changing the volume with permission denied
+	ReadOnly bool
+}
+
+// NewHandlers returns the handlers of a request server serving fs, symlinks are served when fs supports them
+func NewHandlers(fs afero.Fs, options *Options) sftp.Handlers {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.ReadOnly {
+		fs = afero.NewReadOnlyFs(fs)
+	}
+	handler := &handler{fs: fs}
+	return sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler}
+}
+
+type handler struct {
+	fs afero.Fs
+}
+
+var (
+	_ sftp.OpenFileWriter       = (*handler)(nil)
+	_ sftp.PosixRenameFileCmder = (*handler)(nil)
+	_ sftp.LstatFileLister      = (*handler)(nil)
+)
+
+func (h *handler) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	return h.fs.Open(request.Filepath)
+}
+
+func (h *handler) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	return h.OpenFile(request)
+}
+
+// OpenFile opens files for reading and writing through one handle, writes of handles opened with append go to the
+// end of file whatever their offset is
+func (h *handler) OpenFile(request *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	pflags := request.Pflags()
+	flag := os.O_RDONLY
+	if pflags.Write {
+		flag = os.O_WRONLY
+		if pflags.Read {
+			flag = os.O_RDWR
+		}
+	}
+	if pflags.Append {
+		flag |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	// Flags of open requests are open flags, AttrFlags can not tell whether permissions were sent
+	file, err := h.fs.OpenFile(request.Filepath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if pflags.Append {
+		return &appendFile{File: file}, nil
+	}
+	return file, nil
+}
+
+// appendFile writes at the end of file, WriteAt of handles opened with O_APPEND fails
+type appendFile struct {
+	afero.File
+}
+
+func (f *appendFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.File.Write(p)
+}
+
+func (h *handler) Filecmd(request *sftp.Request) error {
+	switch request.Method {
+	case "Setstat":
+		return h.setstat(request)
+	case "Rename":
+		// SFTP renames never replace the target, posix-rename@openssh.com does
+		if _, err := h.lstat(request.Target); err == nil {
+			return &os.LinkError{Op: "rename", Old: request.Filepath, New: request.Target, Err: os.ErrExist}
+		}
+		return h.fs.Rename(request.Filepath, request.Target)
+	case "Rmdir":
+		fileInfo, err := h.lstat(request.Filepath)
+		if err != nil {
+			return err
+		}
+		if !fileInfo.IsDir() {
+			return &os.PathError{Op: "rmdir", Path: request.Filepath, Err: sftp.ErrSSHFxFailure}
+		}
+		return h.fs.Remove(request.Filepath)
+	case "Remove":
+		fileInfo, err := h.lstat(request.Filepath)
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return &os.PathError{Op: "remove", Path: request.Filepath, Err: sftp.ErrSSHFxFailure}
+		}
+		return h.fs.Remove(request.Filepath)
+	case "Mkdir":
+		perm := os.FileMode(0755)
+		if request.AttrFlags().Permissions {
+			perm = request.Attributes().FileMode().Perm()
+		}
+		return h.fs.Mkdir(request.Filepath, perm)
+	case "Symlink":
+		linker, ok := h.fs.(afero.Linker)
+		if !ok {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		// Target is the name of the new link, Filepath what it points to
+		return linker.SymlinkIfPossible(request.Filepath, request.Target)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handler) PosixRename(request *sftp.Request) error {
+	return h.fs.Rename(request.Filepath, request.Target)
+}
+
+func (h *handler) setstat(request *sftp.Request) error {
+	attrFlags := request.AttrFlags()
+	attributes := request.Attributes()
+	if attrFlags.Size {
+		if err := h.truncate(request.Filepath, int64(attributes.Size)); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Permissions {
+		if err := h.fs.Chmod(request.Filepath, attributes.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrFlags.UidGid {
+		if err := h.fs.Chown(request.Filepath, int(attributes.UID), int(attributes.GID)); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Acmodtime {
+		if err := h.fs.Chtimes(request.Filepath, attributes.AccessTime(), attributes.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *handler) truncate(name string, size int64) error {
+	file, err := h.fs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (h *handler) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	switch request.Method {
+	case "List":
+		dir, err := h.fs.Open(request.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		fileInfos, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(fileInfos, func(i, j int) bool {
+			return fileInfos[i].Name() < fileInfos[j].Name()
+		})
+		return listerAt(fileInfos), nil
+	case "Stat":
+		fileInfo, err := h.fs.Stat(request.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fileInfo}, nil
+	case "Readlink":
+		linkReader, ok := h.fs.(afero.LinkReader)
+		if !ok {
+			return nil, sftp.ErrSSHFxOpUnsupported
+		}
+		target, err := linkReader.ReadlinkIfPossible(request.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		// the request server sends the name of the only entry as the target
+		return listerAt{linkTarget(target)}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handler) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
+	fileInfo, err := h.lstat(request.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fileInfo}, nil
+}
+
+func (h *handler) lstat(name string) (os.FileInfo, error) {
+	if lstater, ok := h.fs.(afero.Lstater); ok {
+		fileInfo, _, err := lstater.LstatIfPossible(name)
+		return fileInfo, err
+	}
+	return h.fs.Stat(name)
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(fileInfos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fileInfos, l[offset:])
+	if n < len(fileInfos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkTarget is the file info of a symlink target, only its name is used
+type linkTarget string
+
+func (t linkTarget) Name() string       { return string(t) }
+func (t linkTarget) Size() int64        { return 0 }
+func (t linkTarget) Mode() os.FileMode  { return os.ModeSymlink }
+func (t linkTarget) ModTime() time.Time { return time.Time{} }
+func (t linkTarget) IsDir() bool        { return false }
+func (t linkTarget) Sys() interface{}   { return nil }
@@ -0,0 +1,263 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+// newTestEncFs returns an EncFs with encrypted names over a memory backend
+func newTestEncFs() (afero.Fs, afero.Fs) {
+	base := afero.NewMemMapFs()
+	key := encfs.NewEncryptionMasterKeyWithFileNameIv(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	return encfs.NewEncFsWithBackend(key, base), base
+}
+
+// testPipe joins the read side of one pipe and the write side of another
+type testPipe struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newTestClient returns a client of a request server serving fs in process
+func newTestClient(t *testing.T, fs afero.Fs, options *Options) *sftp.Client {
+	t.Helper()
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server := sftp.NewRequestServer(testPipe{serverReader, serverWriter}, NewHandlers(fs, options))
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// closing the server ends the reads of the client
+		_ = server.Close()
+		_ = client.Close()
+		<-served
+	})
+	return client
+}
+
+func writeTestFile(t *testing.T, client *sftp.Client, name string, data []byte) {
+	t.Helper()
+	f, err := client.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, client *sftp.Client, name string) []byte {
+	t.Helper()
+	f, err := client.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHandlersRoundTrip(t *testing.T) {
+	// spans several SFTP packets and encryption chunks
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024+3)
+	tests := []struct {
+		name string
+		op   func(t *testing.T, client *sftp.Client)
+		// wantFiles are the files of the volume after op
+		wantFiles map[string][]byte
+	}{
+		{"write", func(t *testing.T, client *sftp.Client) {},
+			map[string][]byte{"/dir/file": data, "/other": []byte("other")}},
+		{"overwrite", func(t *testing.T, client *sftp.Client) {
+			writeTestFile(t, client, "/dir/file", []byte("new"))
+		}, map[string][]byte{"/dir/file": []byte("new"), "/other": []byte("other")}},
+		{"append", func(t *testing.T, client *sftp.Client) {
+			f, err := client.OpenFile("/other", os.O_WRONLY|os.O_APPEND)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte(" appended")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/dir/file": data, "/other": []byte("other appended")}},
+		{"truncate", func(t *testing.T, client *sftp.Client) {
+			if err := client.Truncate("/dir/file", 10); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/dir/file": data[:10], "/other": []byte("other")}},
+		{"rename", func(t *testing.T, client *sftp.Client) {
+			if err := client.Rename("/dir/file", "/renamed"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/renamed": data, "/other": []byte("other")}},
+		// SFTP renames never replace the target
+		{"rename over a file", func(t *testing.T, client *sftp.Client) {
+			if err := client.Rename("/dir/file", "/other"); err == nil {
+				t.Fatal("renamed over a file")
+			}
+		}, map[string][]byte{"/dir/file": data, "/other": []byte("other")}},
+		{"posix rename over a file", func(t *testing.T, client *sftp.Client) {
+			if err := client.PosixRename("/dir/file", "/other"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/other": data}},
+		{"rename directory", func(t *testing.T, client *sftp.Client) {
+			if err := client.Rename("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/moved/file": data, "/other": []byte("other")}},
+		{"remove", func(t *testing.T, client *sftp.Client) {
+			if err := client.Remove("/dir/file"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.RemoveDirectory("/dir"); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string][]byte{"/other": []byte("other")}},
+		{"remove missing", func(t *testing.T, client *sftp.Client) {
+			if err := client.Remove("/missing"); !os.IsNotExist(err) {
+				t.Fatalf("got %v, want not exist", err)
+			}
+		}, map[string][]byte{"/dir/file": data, "/other": []byte("other")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs()
+			client := newTestClient(t, encFs, nil)
+			if err := client.Mkdir("/dir"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, client, "/dir/file", data)
+			writeTestFile(t, client, "/other", []byte("other"))
+			test.op(t, client)
+
+			var names []string
+			err := afero.Walk(encFs, "/", func(name string, fileInfo os.FileInfo, err error) error {
+				if err != nil || fileInfo.IsDir() {
+					return err
+				}
+				names = append(names, name)
+				// reads through the server and through the EncFs agree
+				want, found := test.wantFiles[name]
+				if !found {
+					t.Fatalf("got unexpected file %s", name)
+				}
+				if got := readTestFile(t, client, name); !bytes.Equal(got, want) {
+					t.Fatalf("%s: got %d bytes, want %d", name, len(got), len(want))
+				}
+				if fileInfo.Size() != int64(len(want)) {
+					t.Fatalf("%s: got size %d, want %d", name, fileInfo.Size(), len(want))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != len(test.wantFiles) {
+				t.Fatalf("got files %q, want %d", names, len(test.wantFiles))
+			}
+			// the backend holds encrypted names only
+			plainNames := map[string]bool{"dir": true, "file": true, "other": true, "renamed": true, "moved": true}
+			err = afero.Walk(base, "/", func(name string, _ os.FileInfo, err error) error {
+				if err == nil && plainNames[strings.TrimSuffix(path.Base(name), encfs.EncFileExt)] {
+					t.Fatalf("backend name %s is not encrypted", name)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandlersList(t *testing.T) {
+	encFs, _ := newTestEncFs()
+	client := newTestClient(t, encFs, nil)
+	for _, name := range []string{"/b", "/a", "/dir/c"} {
+		if err := client.MkdirAll("/dir"); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, client, name, []byte(name))
+	}
+	tests := []struct {
+		dir       string
+		wantNames []string
+	}{
+		{"/", []string{"a", "b", "dir"}},
+		{"/dir", []string{"c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.dir, func(t *testing.T) {
+			fileInfos, err := client.ReadDir(test.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fileInfo := range fileInfos {
+				names = append(names, fileInfo.Name())
+			}
+			if !reflect.DeepEqual(names, test.wantNames) {
+				t.Fatalf("got %q, want %q", names, test.wantNames)
+			}
+		})
+	}
+}
+
+func TestHandlersReadOnly(t *testing.T) {
+	encFs, _ := newTestEncFs()
+	if err := afero.WriteFile(encFs, "/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, encFs, &Options{ReadOnly: true})
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{"create", func() error {
+			f, err := client.Create("/new")
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"rename", func() error { return client.Rename("/file", "/renamed") }},
+		{"remove", func() error { return client.Remove("/file") }},
+		{"mkdir", func() error { return client.Mkdir("/dir") }},
+		{"truncate", func() error { return client.Truncate("/file", 0) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.op(); err == nil {
+				t.Fatal("changed a read only volume")
+			}
+		})
+	}
+	if data := readTestFile(t, client, "/file"); string(data) != "data" {
+		t.Fatalf("got %q", data)
+	}
+}
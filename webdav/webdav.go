@@ -0,0 +1,132 @@
+// Package webdav serves an afero.Fs like an encfs.EncFs over WebDAV so clients like Finder or Explorer can mount the
+// decrypted view of a volume
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+)
+
+const DEFAULT_REALM = "encfs"
+
+// Options configure NewHandler, the zero value serves the volume read write without authentication
+type Options struct {
+	// Prefix is stripped from request paths, e.g. "/dav" when the handler is mounted there
+	Prefix string
+	// ReadOnly refuses all methods changing the volume with 405 Method Not Allowed
+	ReadOnly bool
+	// Username and Password enable HTTP basic authentication, Authenticate replaces them when set
+	Username     string
+	Password     string
+	Authenticate func(username, password string) bool
+	// Realm is sent with authentication challenges, DEFAULT_REALM when empty
+	Realm string
+	// Logger is called after every request with the error of the WebDAV handler if any
+	Logger func(request *http.Request, err error)
+}
+
+// NewHandler returns a WebDAV handler of fs, file infos of EncFs provide ETags without reading contents, serve it
+// with TLS when it requires authentication since basic authentication sends the password in clear
+func NewHandler(fs afero.Fs, options *Options) http.Handler {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.ReadOnly {
+		fs = afero.NewReadOnlyFs(fs)
+	}
+	davHandler := &webdav.Handler{
+		Prefix:     options.Prefix,
+		FileSystem: &FileSystem{Fs: fs},
+		LockSystem: webdav.NewMemLS(),
+		Logger:     options.Logger,
+	}
+	return &handler{davHandler: davHandler, options: options}
+}
+
+type handler struct {
+	davHandler *webdav.Handler
+	options    *Options
+}
+
+func (h *handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !h.authenticate(request) {
+		realm := h.options.Realm
+		if realm == "" {
+			realm = DEFAULT_REALM
+		}
+		writer.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if h.options.ReadOnly && !isReadOnlyMethod(request.Method) {
+		writer.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	h.davHandler.ServeHTTP(writer, request)
+}
+
+func (h *handler) authenticate(request *http.Request) bool {
+	if h.options.Authenticate == nil && h.options.Username == "" && h.options.Password == "" {
+		return true
+	}
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	if h.options.Authenticate != nil {
+		return h.options.Authenticate(username, password)
+	}
+	// hashes compare in constant time whatever the lengths are
+	usernameHash, expectedUsernameHash := sha256.Sum256([]byte(username)), sha256.Sum256([]byte(h.options.Username))
+	passwordHash, expectedPasswordHash := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(h.options.Password))
+	usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:])
+	passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:])
+	return usernameMatch&passwordMatch == 1
+}
+
+func isReadOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// FileSystem adapts an afero.Fs to webdav.FileSystem, afero files already implement webdav.File
+type FileSystem struct {
+	Fs afero.Fs
+}
+
+var _ webdav.FileSystem = (*FileSystem)(nil)
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.Fs.Mkdir(name, perm)
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+// RemoveAll refuses removing the root, it would remove the volume config too
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrPermission}
+	}
+	return fs.Fs.RemoveAll(name)
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return fs.Fs.Rename(oldName, newName)
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.Fs.Stat(name)
+}
@@ -0,0 +1,196 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jht5945/encfs-afero/encfs"
+	"github.com/spf13/afero"
+)
+
+// newTestEncFs returns an EncFs with encrypted names over a memory backend
+func newTestEncFs() (afero.Fs, afero.Fs) {
+	base := afero.NewMemMapFs()
+	key := encfs.NewEncryptionMasterKeyWithFileNameIv(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 12))
+	return encfs.NewEncFsWithBackend(key, base), base
+}
+
+// serveTestRequest serves one request by handler, with basic authentication when username is not empty
+func serveTestRequest(handler http.Handler, method, target, body, username, password string,
+	header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if username != "" {
+		request.SetBasicAuth(username, password)
+	}
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHandlerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+		// target is the URL of the file, dir the URL of its directory
+		target, dir string
+	}{
+		{"root", nil, "/file.txt", "/"},
+		{"prefix", &Options{Prefix: "/dav"}, "/dav/file.txt", "/dav/"},
+		{"authenticated", &Options{Username: "user", Password: "secret"}, "/file.txt", "/"},
+	}
+	data := "hello over webdav"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, base := newTestEncFs()
+			handler := NewHandler(encFs, test.options)
+			serve := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+				return serveTestRequest(handler, method, target, body, "user", "secret", header)
+			}
+
+			if recorder := serve(http.MethodPut, test.target, data, nil); recorder.Code != http.StatusCreated {
+				t.Fatalf("put: got %d: %s", recorder.Code, recorder.Body)
+			}
+			recorder := serve(http.MethodGet, test.target, "", nil)
+			if recorder.Code != http.StatusOK || recorder.Body.String() != data {
+				t.Fatalf("get: got %d: %q", recorder.Code, recorder.Body)
+			}
+			if recorder.Header().Get("ETag") == "" {
+				t.Fatal("get: no ETag")
+			}
+			recorder = serve("PROPFIND", test.dir, "", map[string]string{"Depth": "1"})
+			if recorder.Code != http.StatusMultiStatus || !strings.Contains(recorder.Body.String(), "file.txt") {
+				t.Fatalf("propfind: got %d: %s", recorder.Code, recorder.Body)
+			}
+			if !strings.Contains(recorder.Body.String(), "<D:getcontentlength>17</D:getcontentlength>") {
+				t.Fatalf("propfind: got %s, want the plaintext size", recorder.Body)
+			}
+
+			// the backend holds the file encrypted
+			err := afero.Walk(base, "/", func(name string, _ os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if strings.Contains(name, "file.txt") {
+					t.Fatalf("backend name %s is not encrypted", name)
+				}
+				if content, err := afero.ReadFile(base, name); err == nil && bytes.Contains(content, []byte(data)) {
+					t.Fatalf("backend file %s is not encrypted", name)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandlerAuthentication(t *testing.T) {
+	authenticate := func(username, password string) bool { return username == "other" && password == "pass" }
+	tests := []struct {
+		name               string
+		options            *Options
+		username, password string
+		wantCode           int
+	}{
+		{"no authentication", nil, "", "", http.StatusMultiStatus},
+		{"no credentials", &Options{Username: "user", Password: "secret"}, "", "", http.StatusUnauthorized},
+		{"valid", &Options{Username: "user", Password: "secret"}, "user", "secret", http.StatusMultiStatus},
+		{"wrong password", &Options{Username: "user", Password: "secret"}, "user", "secrets", http.StatusUnauthorized},
+		{"wrong user", &Options{Username: "user", Password: "secret"}, "users", "secret", http.StatusUnauthorized},
+		{"password only", &Options{Password: "secret"}, "any", "secret", http.StatusUnauthorized},
+		{"authenticate", &Options{Authenticate: authenticate}, "other", "pass", http.StatusMultiStatus},
+		{"authenticate refused", &Options{Authenticate: authenticate}, "user", "secret", http.StatusUnauthorized},
+		{"authenticate no credentials", &Options{Authenticate: authenticate}, "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encFs, _ := newTestEncFs()
+			recorder := serveTestRequest(NewHandler(encFs, test.options), "PROPFIND", "/", "", test.username,
+				test.password, map[string]string{"Depth": "0"})
+			if recorder.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", recorder.Code, test.wantCode)
+			}
+			challenge := recorder.Header().Get("WWW-Authenticate")
+			if (test.wantCode == http.StatusUnauthorized) != (challenge == `Basic realm="encfs", charset="UTF-8"`) {
+				t.Fatalf("got challenge %q", challenge)
+			}
+		})
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	encFs, _ := newTestEncFs()
+	if err := afero.WriteFile(encFs, "/file.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(encFs, &Options{ReadOnly: true})
+	tests := []struct {
+		method   string
+		wantCode int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{"PROPFIND", http.StatusMultiStatus},
+		{http.MethodPut, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+		{"MKCOL", http.StatusMethodNotAllowed},
+		{"MOVE", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			body := ""
+			if test.method == http.MethodPut {
+				body = "new"
+			}
+			recorder := serveTestRequest(handler, test.method, "/file.txt", body, "", "",
+				map[string]string{"Destination": "/moved.txt"})
+			if recorder.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", recorder.Code, test.wantCode)
+			}
+		})
+	}
+	data, err := afero.ReadFile(encFs, "/file.txt")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("got %q: %v", data, err)
+	}
+}
+
+func TestFileSystemRemoveAll(t *testing.T) {
+	encFs, _ := newTestEncFs()
+	if err := afero.WriteFile(encFs, "/dir/file.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSystem{Fs: encFs}
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		// removing the root would remove the volume config
+		{"/", os.ErrPermission},
+		{"", os.ErrPermission},
+		{"/dir/..", os.ErrPermission},
+		{"/dir", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := fs.RemoveAll(context.Background(), test.name); !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+	if _, err := encFs.Stat("/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encFs.Stat("/dir"); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist", err)
+	}
+}